@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go-load-balance/lib"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an {"error": msg} response.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// registerRouteAdmin mounts the route admin endpoints:
+//
+//	GET /admin/routes                 routes with weights and served counts
+//	PUT /admin/routes/{id}/weights    {"pool-a": 90, "pool-b": 10}
+func registerRouteAdmin(mux *http.ServeMux, router *lib.Router) {
+	mux.HandleFunc("GET /admin/routes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, router.Stats())
+	})
+	mux.HandleFunc("PUT /admin/routes/{id}/weights", func(w http.ResponseWriter, r *http.Request) {
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "body must be a JSON object of pool name to weight: "+err.Error())
+			return
+		}
+		id := r.PathValue("id")
+		if err := router.SetWeights(id, weights); err != nil {
+			status := http.StatusBadRequest
+			if lib.IsUnknownRoute(err) {
+				status = http.StatusNotFound
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+		for _, rs := range router.Stats() {
+			if rs.ID == id {
+				writeJSON(w, http.StatusOK, rs)
+				return
+			}
+		}
+		writeJSONError(w, http.StatusNotFound, "unknown route "+id)
+	})
+}
+
+// registerSplitAdmin mounts the traffic split endpoints:
+//
+//	GET /admin/split    percentages and per-group counters
+//	PUT /admin/split    {"stable": 75, "canary": 25}
+func registerSplitAdmin(mux *http.ServeMux, splitter *lib.Splitter) {
+	mux.HandleFunc("GET /admin/split", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, splitter.Stats())
+	})
+	mux.HandleFunc("PUT /admin/split", func(w http.ResponseWriter, r *http.Request) {
+		var percents map[string]float64
+		if err := json.NewDecoder(r.Body).Decode(&percents); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "body must be a JSON object of pool name to percent: "+err.Error())
+			return
+		}
+		if err := splitter.SetPercents(percents); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("[ADMIN] split set to %s", formatPercents(splitter.Stats()))
+		writeJSON(w, http.StatusOK, splitter.Stats())
+	})
+}
+
+// formatPercents shows a split's percentages, "stable 75%, canary 25%".
+func formatPercents(s lib.SplitStats) string {
+	parts := make([]string, 0, len(s.Groups))
+	for _, g := range s.Groups {
+		parts = append(parts, fmt.Sprintf("%s %g%%", g.Pool, g.Percent))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// backendAdminStatus is a backend's maintenance state, summed over the pools
+// holding it.
+type backendAdminStatus struct {
+	URL         string `json:"url"`
+	Drained     bool   `json:"drained"`
+	Healthy     bool   `json:"healthy"`
+	ActiveConns int    `json:"active_conns"`
+}
+
+// registerBackendAdmin mounts the backend admin endpoints:
+//
+//	POST /admin/backends/expect-restart    {"url": URL, "window": "90s"}
+//	POST /admin/backends/conn-limit        {"url": URL, "limit": 12}, 0 unpins
+//	POST /admin/backends/{id}/drain        stop new requests for maintenance
+//	POST /admin/backends/{id}/enable       back into rotation
+//	GET  /admin/backends/{id}              drained, healthy, active_conns
+//	PUT  /admin/backends/{id}              {"url": URL}: replace in place
+//
+// {id} is the backend's URL, path-escaped (http:%2F%2Fgpu-3:8000), or its
+// host:port for http backends; URL is a backend URL (http://gpu-3:8000).
+func registerBackendAdmin(mux *http.ServeMux, pools []*lib.Pool) {
+	// A URL may back several pools; drain and enable it in each, after
+	// finding it in them all, so a lookup one pool refuses changes none.
+	maintenance := func(action func(*lib.Pool, string) (*lib.Backend, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			var holding []*lib.Pool
+			for _, pool := range pools {
+				_, err := pool.Backend(id)
+				if lib.IsUnknownBackend(err) {
+					continue
+				}
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				holding = append(holding, pool)
+			}
+			if holding == nil {
+				writeJSONError(w, http.StatusNotFound, "unknown backend "+id)
+				return
+			}
+			var status backendAdminStatus
+			for _, pool := range holding {
+				b, err := action(pool, id)
+				if err != nil {
+					writeJSONError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				status.URL, status.Drained = b.ID(), b.Drained()
+				status.Healthy = status.Healthy || b.IsHealthy()
+				status.ActiveConns += b.GetActiveConns()
+			}
+			writeJSON(w, http.StatusOK, status)
+		}
+	}
+	mux.HandleFunc("GET /admin/backends/{id}", maintenance((*lib.Pool).Backend))
+	mux.HandleFunc("POST /admin/backends/{id}/drain", maintenance((*lib.Pool).Drain))
+	mux.HandleFunc("POST /admin/backends/{id}/enable", maintenance((*lib.Pool).Enable))
+
+	mux.HandleFunc("PUT /admin/backends/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+			writeJSONError(w, http.StatusBadRequest, `body must be {"url": ...}`)
+			return
+		}
+		// A URL may back several pools; check them all first, so a replace
+		// one pool would refuse changes none.
+		id := r.PathValue("id")
+		var holding []*lib.Pool
+		for _, pool := range pools {
+			if _, err := pool.Backend(id); err != nil {
+				continue
+			}
+			if _, err := pool.Backend(req.URL); err == nil {
+				writeJSONError(w, http.StatusConflict, "backend "+req.URL+" is already in the pool")
+				return
+			}
+			holding = append(holding, pool)
+		}
+		if holding == nil {
+			writeJSONError(w, http.StatusNotFound, "unknown backend "+id)
+			return
+		}
+		var replaced string
+		for _, pool := range holding {
+			old, _ := pool.Backend(id)
+			replaced = old.ID()
+			if err := pool.ReplaceBackend(id, req.URL); err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		b, _ := holding[0].Backend(req.URL)
+		writeJSON(w, http.StatusOK, map[string]any{"url": b.ID(), "replaced": replaced, "pools": len(holding)})
+	})
+
+	mux.HandleFunc("POST /admin/backends/conn-limit", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			URL   string `json:"url"`
+			Limit *int   `json:"limit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Limit == nil {
+			writeJSONError(w, http.StatusBadRequest, `body must be {"url": ..., "limit": n}`)
+			return
+		}
+		found := false
+		for _, pool := range pools {
+			err := pool.PinConnLimit(req.URL, *req.Limit)
+			if lib.IsUnknownBackend(err) {
+				continue
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			found = true
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "unknown backend "+req.URL)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"url": req.URL, "limit": *req.Limit, "pinned": *req.Limit > 0})
+	})
+
+	mux.HandleFunc("POST /admin/backends/expect-restart", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			URL    string `json:"url"`
+			Window string `json:"window"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "body must be {\"url\": ..., \"window\": ...}: "+err.Error())
+			return
+		}
+		window, err := time.ParseDuration(req.Window)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "window: "+err.Error())
+			return
+		}
+		// A URL may back several pools; announce the restart to each.
+		found := false
+		for _, pool := range pools {
+			err := pool.ExpectRestart(req.URL, window)
+			if lib.IsUnknownBackend(err) {
+				continue
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			found = true
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "unknown backend "+req.URL)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"url": req.URL, "window": window.String(), "until": time.Now().Add(window).Format(time.RFC3339)})
+	})
+}
+
+// healthCheckRun is one backend's result of POST /admin/healthcheck, with
+// its pool's name when there are several.
+type healthCheckRun struct {
+	Pool string `json:"pool,omitempty"`
+	lib.HealthCheckResult
+}
+
+// healthOverride is a backend's health after POST /admin/backends/{id}/health.
+type healthOverride struct {
+	URL          string    `json:"url"`
+	Healthy      bool      `json:"healthy"`
+	HealthSource string    `json:"health_source"`
+	Until        time.Time `json:"until"`
+	Pools        int       `json:"pools"`
+}
+
+// registerHealthAdmin mounts the health endpoints:
+//
+//	POST /admin/healthcheck                probe every backend now
+//	POST /admin/healthcheck?backend={id}   probe one backend now
+//	POST /admin/backends/{id}/health       override health:
+//	                                       {"healthy": false, "ttl": "5m"}
+//
+// Probes answer with their results. checkers are the pools' health
+// checkers, in pool order.
+func registerHealthAdmin(mux *http.ServeMux, pools []*lib.Pool, checkers []*lib.HealthChecker) {
+	mux.HandleFunc("POST /admin/healthcheck", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("backend")
+		runs := []healthCheckRun{}
+		found := false
+		for i, hc := range checkers {
+			results, err := hc.CheckNow(r.Context(), id)
+			if lib.IsUnknownBackend(err) {
+				continue
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			found = true
+			for _, res := range results {
+				runs = append(runs, healthCheckRun{Pool: pools[i].Name(), HealthCheckResult: res})
+			}
+		}
+		if id != "" && !found {
+			writeJSONError(w, http.StatusNotFound, "unknown backend "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"results": runs})
+	})
+
+	mux.HandleFunc("POST /admin/backends/{id}/health", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Healthy *bool  `json:"healthy"`
+			TTL     string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Healthy == nil {
+			writeJSONError(w, http.StatusBadRequest, `body must be {"healthy": true|false, "ttl": ...}`)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "ttl: "+err.Error())
+			return
+		}
+		// A URL may back several pools; override it in each.
+		id := r.PathValue("id")
+		status := healthOverride{Healthy: *req.Healthy, HealthSource: lib.HealthSourceManual, Until: time.Now().Add(ttl)}
+		for _, pool := range pools {
+			b, err := pool.OverrideHealth(id, *req.Healthy, ttl)
+			if lib.IsUnknownBackend(err) {
+				continue
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			status.URL = b.ID()
+			status.Pools++
+		}
+		if status.Pools == 0 {
+			writeJSONError(w, http.StatusNotFound, "unknown backend "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+}
+
+// registerChaosAdmin mounts the failure injection endpoints:
+//
+//	GET    /admin/chaos    active rules
+//	POST   /admin/chaos    add a rule, one of
+//	    {"kind": "latency", "percent": 10, "latency": "2s", "duration": "5m"}
+//	    {"kind": "error", "percent": 5, "duration": "1m"}
+//	    {"kind": "blackhole", "backend": "http://gpu-3:8000", "duration": "30s"}
+//	DELETE /admin/chaos    remove every rule
+func registerChaosAdmin(mux *http.ServeMux, chaos *lib.Chaos, pools []*lib.Pool) {
+	mux.HandleFunc("GET /admin/chaos", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"rules": chaos.Rules()})
+	})
+	mux.HandleFunc("POST /admin/chaos", func(w http.ResponseWriter, r *http.Request) {
+		var spec lib.ChaosSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "body must be a JSON chaos rule: "+err.Error())
+			return
+		}
+		if spec.Kind == lib.ChaosBlackhole {
+			found := false
+			for _, pool := range pools {
+				if _, err := pool.Backend(spec.Backend); err == nil {
+					found = true
+				}
+			}
+			if !found {
+				writeJSONError(w, http.StatusNotFound, "unknown backend "+spec.Backend)
+				return
+			}
+		}
+		rule, err := chaos.Add(spec)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	})
+	mux.HandleFunc("DELETE /admin/chaos", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]int{"cleared": chaos.Clear()})
+	})
+}
+
+// registerQueueAdmin mounts the admission queues, with requests waiting per
+// tenant under --queue-tenant-header:
+//
+//	GET /admin/queues
+func registerQueueAdmin(mux *http.ServeMux, pools []*lib.Pool) {
+	mux.HandleFunc("GET /admin/queues", func(w http.ResponseWriter, r *http.Request) {
+		queues := []*lib.QueueStats{}
+		for _, pool := range pools {
+			if s := pool.QueueStats(); s != nil {
+				queues = append(queues, s)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"queues": queues})
+	})
+}
+
+// registerDebugAdmin mounts the --debug-headers decision log, newest first:
+//
+//	GET /admin/last-requests
+func registerDebugAdmin(mux *http.ServeMux, decisions *lib.DecisionLog) {
+	mux.HandleFunc("GET /admin/last-requests", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, decisions.Last())
+	})
+}
+
+// registerPeerAdmin mounts the --peers state: the replicas heard from and
+// the latest transition of each backend:
+//
+//	GET /admin/peers
+func registerPeerAdmin(mux *http.ServeMux, peers *lib.PeerSync) {
+	mux.HandleFunc("GET /admin/peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, peers.Stats())
+	})
+}
+
+// registerInflightAdmin mounts the --max-inflight-per-client usage, busiest
+// client first; keys and addresses are hashed with --hash-client-ids:
+//
+//	GET /admin/inflight
+func registerInflightAdmin(mux *http.ServeMux, inflight *lib.InflightLimiter, hasher *lib.IdentityHasher) {
+	mux.HandleFunc("GET /admin/inflight", func(w http.ResponseWriter, r *http.Request) {
+		clients := inflight.Usage(hasher)
+		if clients == nil {
+			clients = []lib.InflightClient{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"max_per_client": inflight.Max(), "clients": clients})
+	})
+}
+
+// inflightRequest is one request of GET /admin/inflight-requests, with its
+// pool's name when there are several.
+type inflightRequest struct {
+	Pool string `json:"pool,omitempty"`
+	lib.InflightRequest
+}
+
+// registerInflightRequestsAdmin mounts the list of requests in flight at the
+// backends, oldest first, to find the ones a hung backend is holding:
+//
+//	GET /admin/inflight-requests               every request
+//	GET /admin/inflight-requests?min_age=30s   those at a backend 30s or more
+func registerInflightRequestsAdmin(mux *http.ServeMux, pools []*lib.Pool) {
+	mux.HandleFunc("GET /admin/inflight-requests", func(w http.ResponseWriter, r *http.Request) {
+		var minAge time.Duration
+		if v := r.URL.Query().Get("min_age"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeJSONError(w, http.StatusBadRequest, "min_age must be a duration such as 30s, got "+v)
+				return
+			}
+			minAge = d
+		}
+		requests := []inflightRequest{}
+		for _, pool := range pools {
+			for _, req := range pool.InflightRequests(minAge) {
+				requests = append(requests, inflightRequest{Pool: pool.Name(), InflightRequest: req})
+			}
+		}
+		slices.SortStableFunc(requests, func(a, b inflightRequest) int { return a.Started.Compare(b.Started) })
+		writeJSON(w, http.StatusOK, map[string]any{"min_age": minAge.String(), "count": len(requests), "requests": requests})
+	})
+}
+
+// registerWeightsAdmin mounts every backend's static and effective
+// selection weight (see --weight-tuning):
+//
+//	GET /admin/weights
+func registerWeightsAdmin(mux *http.ServeMux, pools []*lib.Pool) {
+	mux.HandleFunc("GET /admin/weights", func(w http.ResponseWriter, r *http.Request) {
+		weights := []backendWeight{}
+		for _, pool := range pools {
+			for _, bw := range pool.Weights() {
+				weights = append(weights, backendWeight{Pool: pool.Name(), BackendWeight: bw})
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"backends": weights})
+	})
+}
+
+// backendWeight is one backend of GET /admin/weights, with its pool's name
+// when there are several.
+type backendWeight struct {
+	Pool string `json:"pool,omitempty"`
+	lib.BackendWeight
+}
+
+// registerIdentityAdmin mounts the identifier hashing endpoint, so operators
+// can find a client's entries in a log written with --hash-client-ids:
+//
+//	POST /admin/identifiers/hash    {"id": "10.0.0.7"}
+func registerIdentityAdmin(mux *http.ServeMux, hasher *lib.IdentityHasher) {
+	mux.HandleFunc("POST /admin/identifiers/hash", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+			writeJSONError(w, http.StatusBadRequest, `body must be {"id": ...}`)
+			return
+		}
+		hash, expires := hasher.HashWithExpiry(req.ID)
+		writeJSON(w, http.StatusOK, map[string]string{"hash": hash, "expires": expires.Format(time.RFC3339)})
+	})
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-load-balance/lib"
+	"go-load-balance/lib/mockbackend"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouteWeightsAdmin(t *testing.T) {
+	pools := map[string]*lib.Pool{}
+	for _, name := range []string{"a", "b"} {
+		p, err := lib.NewPool([]string{"http://" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = p
+	}
+	router, err := lib.NewRouter([]lib.RouteConfig{{
+		ID: "c", Prefix: "/v1/completions",
+		Targets: []lib.RouteTarget{{Pool: "a", Weight: 90}, {Pool: "b", Weight: 10}},
+	}}, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerRouteAdmin(mux, router)
+
+	put := func(id, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/routes/"+id+"/weights", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := put("c", `{"a": 50, "b": 50}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT weights = %d %s", rec.Code, rec.Body)
+	}
+	var rs lib.RouteStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.Targets[0].Weight != 50 || rs.Targets[1].Weight != 50 {
+		t.Errorf("weights = %+v, want 50/50", rs.Targets)
+	}
+
+	if rec := put("missing", `{"a": 1, "b": 1}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown route = %d, want 404", rec.Code)
+	}
+	if rec := put("c", `{"a": 0, "b": 0}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid weights = %d, want 400", rec.Code)
+	}
+	if rec := put("c", `not json`); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed body = %d, want 400", rec.Code)
+	}
+
+	get := httptest.NewRecorder()
+	mux.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/admin/routes", nil))
+	if get.Code != http.StatusOK || !strings.Contains(get.Body.String(), `"weight":50`) {
+		t.Errorf("GET /admin/routes = %d %s", get.Code, get.Body)
+	}
+}
+
+func TestSplitAdmin(t *testing.T) {
+	pools := map[string]*lib.Pool{}
+	for _, name := range []string{"stable", "canary"} {
+		p, err := lib.NewPool([]string{"http://" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = p
+	}
+	splitter, err := lib.NewSplitter(lib.SplitConfig{Groups: []lib.SplitGroup{
+		{Pool: "stable", Percent: 95}, {Pool: "canary", Percent: 5},
+	}}, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerSplitAdmin(mux, splitter)
+	put := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/split", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := put(`{"stable": 75, "canary": 25}`)
+	var st lib.SplitStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/split = %d %s", rec.Code, rec.Body)
+	}
+	if st.Groups[0].Percent != 75 || st.Groups[1].Percent != 25 {
+		t.Errorf("percents %+v, want 75/25", st.Groups)
+	}
+	if rec := put(`{"stable": 75, "canary": 30}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("sum over 100 = %d, want 400", rec.Code)
+	}
+	if rec := put(`not json`); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed body = %d, want 400", rec.Code)
+	}
+
+	get := httptest.NewRecorder()
+	mux.ServeHTTP(get, httptest.NewRequest(http.MethodGet, "/admin/split", nil))
+	if get.Code != http.StatusOK || !strings.Contains(get.Body.String(), `"percent":25`) {
+		t.Errorf("GET /admin/split = %d %s", get.Code, get.Body)
+	}
+}
+
+func TestExpectRestartAdmin(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0:8000", "http://gpu-1:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerBackendAdmin(mux, []*lib.Pool{pool})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/backends/expect-restart", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := post(`{"url": "gpu-0:8000", "window": "90s"}`); rec.Code != http.StatusOK {
+		t.Fatalf("expect-restart = %d %s", rec.Code, rec.Body)
+	}
+	if state := pool.Stats().Backends[0].State; state != "restarting (expected)" {
+		t.Errorf("state = %q, want restarting (expected)", state)
+	}
+	for body, want := range map[string]int{
+		`{"url": "http://gpu-9:8000", "window": "90s"}`:  http.StatusNotFound,
+		`{"url": "http://gpu-1:8000", "window": "soon"}`: http.StatusBadRequest,
+		`{"url": "http://gpu-1:8000", "window": "0s"}`:   http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		if rec := post(body); rec.Code != want {
+			t.Errorf("%s: %d, want %d", body, rec.Code, want)
+		}
+	}
+}
+
+func TestChaosAdmin(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chaos := lib.NewChaos()
+	pool.SetChaos(chaos)
+	mux := http.NewServeMux()
+	registerChaosAdmin(mux, chaos, []*lib.Pool{pool})
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/admin/chaos", strings.NewReader(body)))
+		return rec
+	}
+
+	for body, want := range map[string]int{
+		`{"kind": "blackhole", "backend": "gpu-0:8000", "duration": "30s"}`:     http.StatusCreated,
+		`{"kind": "latency", "percent": 10, "latency": "2s", "duration": "5m"}`: http.StatusCreated,
+		`{"kind": "blackhole", "backend": "gpu-9:8000", "duration": "30s"}`:     http.StatusNotFound,
+		`{"kind": "error", "percent": 5}`:                                       http.StatusBadRequest,
+		`not json`:                                                              http.StatusBadRequest,
+	} {
+		if rec := do(http.MethodPost, body); rec.Code != want {
+			t.Errorf("%s: %d %s, want %d", body, rec.Code, rec.Body, want)
+		}
+	}
+	if rec := do(http.MethodGet, ""); rec.Code != http.StatusOK || strings.Count(rec.Body.String(), `"kind"`) != 2 {
+		t.Errorf("GET /admin/chaos = %d %s, want two rules", rec.Code, rec.Body)
+	}
+	if state := pool.Stats().Backends[0].State; state != "blackholed (chaos)" {
+		t.Errorf("state = %q, want blackholed (chaos)", state)
+	}
+	if rec := do(http.MethodDelete, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"cleared":2`) {
+		t.Errorf("DELETE /admin/chaos = %d %s", rec.Code, rec.Body)
+	}
+	if rules := chaos.Rules(); len(rules) != 0 {
+		t.Errorf("rules after DELETE = %+v", rules)
+	}
+}
+
+func TestReplaceAdmin(t *testing.T) {
+	a, err := lib.NewPool([]string{"http://gpu-0:8000,zone=a", "http://gpu-1:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := lib.NewPool([]string{"http://gpu-0:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerBackendAdmin(mux, []*lib.Pool{a, b})
+	put := func(id, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/backends/"+id, strings.NewReader(body)))
+		return rec
+	}
+
+	for _, c := range []struct {
+		id, body string
+		want     int
+	}{
+		{"gpu-9:8000", `{"url": "gpu-2:8000"}`, http.StatusNotFound},
+		{"gpu-0:8000", `{"url": "gpu-1:8000"}`, http.StatusConflict},
+		{"gpu-0:8000", `{"url": "ftp://gpu-2"}`, http.StatusBadRequest},
+		{"gpu-0:8000", `{}`, http.StatusBadRequest},
+	} {
+		if rec := put(c.id, c.body); rec.Code != c.want {
+			t.Errorf("PUT %s %s = %d %s, want %d", c.id, c.body, rec.Code, rec.Body, c.want)
+		}
+	}
+	for _, pool := range []*lib.Pool{a, b} {
+		if id := pool.GetBackends()[0].ID(); id != "http://gpu-0:8000" {
+			t.Fatalf("a refused replace changed a pool: %s", id)
+		}
+	}
+
+	rec := put(url.PathEscape("http://gpu-0:8000"), `{"url": "gpu-2:8000"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"pools":2`) {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+	for _, pool := range []*lib.Pool{a, b} {
+		if id := pool.GetBackends()[0].ID(); id != "http://gpu-2:8000" {
+			t.Errorf("backend = %s, want the replacement in every pool", id)
+		}
+	}
+	if zone := a.Stats().Backends[0].Labels["zone"]; zone != "a" {
+		t.Errorf("zone = %q, want the label carried over", zone)
+	}
+}
+
+func TestQueueAdmin(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetQueue(lib.QueueConfig{Size: 10, Timeout: time.Second, TenantHeader: "X-Tenant", TenantSize: 2})
+	plain, err := lib.NewPool([]string{"http://gpu-1:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerQueueAdmin(mux, []*lib.Pool{pool, plain})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/queues", nil))
+	var got struct {
+		Queues []lib.QueueStats `json:"queues"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/queues = %d %s", rec.Code, rec.Body)
+	}
+	if len(got.Queues) != 1 || got.Queues[0].Size != 10 || got.Queues[0].TenantHeader != "X-Tenant" || got.Queues[0].TenantSize != 2 {
+		t.Errorf("queues = %+v, want only the queued pool", got.Queues)
+	}
+}
+
+func TestConnLimitAdmin(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetAdaptiveConns(lib.AdaptiveConnsConfig{Floor: 1, LatencyTarget: time.Second})
+	mux := http.NewServeMux()
+	registerBackendAdmin(mux, []*lib.Pool{pool})
+
+	for body, want := range map[string]int{
+		`{"url": "gpu-0:8000", "limit": 6}`:        http.StatusOK,
+		`{"url": "http://gpu-9:8000", "limit": 6}`: http.StatusNotFound,
+		`{"url": "gpu-0:8000", "limit": -1}`:       http.StatusBadRequest,
+		`{"url": "gpu-0:8000"}`:                    http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/backends/conn-limit", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Errorf("%s: %d %s, want %d", body, rec.Code, rec.Body, want)
+		}
+	}
+	if s := pool.Stats().Backends[0].ConnLimit; s == nil || s.Limit != 6 || !s.Pinned {
+		t.Errorf("conn_limit = %+v, want pinned at 6", s)
+	}
+}
+
+func TestIdentityHashAdmin(t *testing.T) {
+	hasher := lib.NewIdentityHasher(24 * time.Hour)
+	mux := http.NewServeMux()
+	registerIdentityAdmin(mux, hasher)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/identifiers/hash", strings.NewReader(body)))
+		return rec
+	}
+	rec := post(`{"id": "10.0.0.7"}`)
+	var got map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("hash = %d %s", rec.Code, rec.Body)
+	}
+	if got["hash"] != hasher.Hash("10.0.0.7") || got["expires"] == "" {
+		t.Errorf("response %v, want the current hash and its expiry", got)
+	}
+	if rec := post(`{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing id = %d, want 400", rec.Code)
+	}
+}
+
+func TestLastRequestsAdmin(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	pool, err := lib.NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions := lib.NewDecisionLog(10)
+	pool.SetDebug(decisions)
+	for _, path := range []string{"/v1/models", "/v1/completions"} {
+		pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	mux := http.NewServeMux()
+	registerDebugAdmin(mux, decisions)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/last-requests", nil))
+	var got []lib.Decision
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /admin/last-requests = %d %s", rec.Code, rec.Body)
+	}
+	if len(got) != 2 || got[0].Path != "/v1/completions" || got[0].Backend != backend.URL || got[0].Status != http.StatusOK {
+		t.Errorf("last requests %+v", got)
+	}
+}
+
+func TestDrainAdmin(t *testing.T) {
+	slow := mockbackend.Start(t, mockbackend.Config{Mode: mockbackend.ModeSlow, Delay: 400 * time.Millisecond})
+	other := mockbackend.Start(t, mockbackend.Config{})
+	pool, err := lib.NewPool([]string{slow.URL, other.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	mux := http.NewServeMux()
+	registerBackendAdmin(mux, []*lib.Pool{pool})
+	admin := func(method, id, action string) backendAdminStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/admin/backends/"+id+action, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s%s = %d %s", method, id, action, rec.Code, rec.Body)
+		}
+		var status backendAdminStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	complete := func() {
+		resp, err := http.Post(lb.URL+"/v1/completions", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	id := url.PathEscape(slow.URL)
+	b := pool.GetBackends()[0]
+
+	// Hold a request on the slow backend (the other drained meanwhile), then
+	// drain it.
+	admin(http.MethodPost, url.PathEscape(other.URL), "/drain")
+	var wg sync.WaitGroup
+	wg.Go(complete)
+	for b.GetActiveConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	admin(http.MethodPost, url.PathEscape(other.URL), "/enable")
+	status := admin(http.MethodPost, id, "/drain")
+	if !status.Drained || status.ActiveConns != 1 || status.URL != slow.URL {
+		t.Errorf("drain = %+v, want drained with 1 active", status)
+	}
+	if state := pool.Stats().Backends[0].State; state != "draining" {
+		t.Errorf("state = %q, want draining", state)
+	}
+	for range 5 {
+		complete()
+	}
+	if n := slow.Stats().Paths["/v1/completions"]; n != 1 {
+		t.Errorf("drained backend served %d requests, want only the in-flight one", n)
+	}
+
+	// The in-flight request finishes; health checks do not undrain.
+	for admin(http.MethodGet, id, "").ActiveConns != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	b.RecordCheckSuccess()
+	if status := admin(http.MethodGet, strings.TrimPrefix(slow.URL, "http://"), ""); !status.Drained || !status.Healthy {
+		t.Errorf("after a health check = %+v, want drained and healthy", status)
+	}
+
+	if status := admin(http.MethodPost, id, "/enable"); status.Drained {
+		t.Errorf("enable = %+v", status)
+	}
+	for range 4 {
+		complete()
+	}
+	if n := slow.Stats().Paths["/v1/completions"]; n < 2 {
+		t.Error("enabled backend not selected again")
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/backends/gpu-9:8000/drain", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown backend = %d, want 404", rec.Code)
+	}
+}
+
+// A backend shared by pools is drained and enabled in each of them, and
+// one no pool holds changes none.
+func TestDrainAdminAcrossPools(t *testing.T) {
+	var pools []*lib.Pool
+	for _, urls := range [][]string{{"http://gpu-0:8000", "http://gpu-1:8000"}, {"http://gpu-0:8000"}, {"http://gpu-1:8000"}} {
+		p, err := lib.NewPool(urls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools = append(pools, p)
+	}
+	mux := http.NewServeMux()
+	registerBackendAdmin(mux, pools)
+	post := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+	drained := func() []bool {
+		var out []bool
+		for _, p := range pools {
+			for _, b := range p.GetBackends() {
+				out = append(out, b.Drained())
+			}
+		}
+		return out
+	}
+
+	if code := post("/admin/backends/gpu-0:8000/drain"); code != http.StatusOK {
+		t.Fatalf("drain = %d", code)
+	}
+	if got := fmt.Sprint(drained()); got != "[true false true false]" {
+		t.Errorf("drained %s, want gpu-0 in both its pools only", got)
+	}
+	if code := post("/admin/backends/gpu-9:8000/drain"); code != http.StatusNotFound {
+		t.Errorf("unknown backend = %d, want 404", code)
+	}
+	if code := post("/admin/backends/gpu-0:8000/enable"); code != http.StatusOK {
+		t.Fatalf("enable = %d", code)
+	}
+	if got := fmt.Sprint(drained()); got != "[false false false false]" {
+		t.Errorf("drained %s after enable, want none", got)
+	}
+}
+
+func TestInflightRequestsAdmin(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.Config{Mode: mockbackend.ModeTimeout})
+	pool, err := lib.NewPool([]string{mock.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	mux := http.NewServeMux()
+	registerInflightRequestsAdmin(mux, []*lib.Pool{pool})
+	get := func(query string) (int, []inflightRequest) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/inflight-requests"+query, nil))
+		var body struct {
+			Requests []inflightRequest `json:"requests"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Requests
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, lb.URL+"/v1/models", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	for mock.Stats().InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if code, got := get(""); code != http.StatusOK || len(got) != 1 || got[0].Backend != mock.URL || got[0].Path != "/v1/models" {
+		t.Errorf("GET /admin/inflight-requests = %d %+v", code, got)
+	}
+	if code, got := get("?min_age=1h"); code != http.StatusOK || len(got) != 0 {
+		t.Errorf("min_age=1h = %d %+v", code, got)
+	}
+	if code, _ := get("?min_age=soon"); code != http.StatusBadRequest {
+		t.Errorf("bad min_age = %d, want 400", code)
+	}
+	cancel()
+	<-done
+}
+
+func TestWeightsAdmin(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://a:8000", "http://b:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerWeightsAdmin(mux, []*lib.Pool{pool})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/weights", nil))
+	var body struct {
+		Backends []backendWeight `json:"backends"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /admin/weights = %d %s", rec.Code, rec.Body)
+	}
+	if len(body.Backends) != 2 || body.Backends[0].Backend != "http://a:8000" || body.Backends[0].Static != 1 || body.Backends[0].Effective != 1 || body.Backends[1].Multiplier != 1 {
+		t.Errorf("weights %+v", body.Backends)
+	}
+}
+
+func TestInflightAdmin(t *testing.T) {
+	inflight := lib.NewInflightLimiter(2, "X-Api-Key")
+	release := make(chan struct{})
+	handler := inflight.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	mux := http.NewServeMux()
+	registerInflightAdmin(mux, inflight, nil)
+	get := func() string {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/inflight", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /admin/inflight = %d %s", rec.Code, rec.Body)
+		}
+		return strings.TrimSpace(rec.Body.String())
+	}
+
+	if got := get(); got != `{"clients":[],"max_per_client":2}` {
+		t.Errorf("idle: %s", got)
+	}
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			req := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+			req.Header.Set("X-Api-Key", "team-a")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	}
+	want := `{"clients":[{"client":"key:team-a","inflight":2}],"max_per_client":2}`
+	for get() != want {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if got := get(); got != `{"clients":[],"max_per_client":2}` {
+		t.Errorf("after the requests ended: %s", got)
+	}
+}
+
+func TestInflightAdminHashesAddresses(t *testing.T) {
+	inflight := lib.NewInflightLimiter(2, "X-Api-Key")
+	release := make(chan struct{})
+	handler := inflight.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	hasher := lib.NewIdentityHasher(24 * time.Hour)
+	mux := http.NewServeMux()
+	registerInflightAdmin(mux, inflight, hasher)
+
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+		req.RemoteAddr = "10.0.0.7:4000"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	want := `{"clients":[{"client":"ip:` + hasher.Hash("10.0.0.7") + `","inflight":1}],"max_per_client":2}`
+	for {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/inflight", nil))
+		got := strings.TrimSpace(rec.Body.String())
+		if strings.Contains(got, "10.0.0.7") {
+			t.Fatalf("address left unhashed: %s", got)
+		}
+		if got == want {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	<-done
+}
+
+func TestHealthAdmin(t *testing.T) {
+	up := mockbackend.Start(t, mockbackend.Config{})
+	down := mockbackend.Start(t, mockbackend.Config{Mode: mockbackend.ModeFailing})
+	pool, err := lib.NewPool([]string{up.URL, down.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := lib.NewHealthChecker(pool, lib.WithProbeTimeout(time.Second))
+	mux := http.NewServeMux()
+	registerHealthAdmin(mux, []*lib.Pool{pool}, []*lib.HealthChecker{hc})
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post("/admin/healthcheck", "")
+	var run struct {
+		Results []healthCheckRun `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &run); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/healthcheck = %d %s", rec.Code, rec.Body)
+	}
+	if len(run.Results) != 2 || !run.Results[0].Passed || run.Results[1].Passed || run.Results[1].Healthy {
+		t.Errorf("results %+v", run.Results)
+	}
+	rec = post("/admin/healthcheck?backend="+url.QueryEscape(up.URL), "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &run); err != nil || len(run.Results) != 1 || run.Results[0].Backend != up.URL {
+		t.Errorf("single backend = %d %s", rec.Code, rec.Body)
+	}
+	if rec := post("/admin/healthcheck?backend=gpu-9:8000", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown backend = %d %s", rec.Code, rec.Body)
+	}
+
+	rec = post("/admin/backends/"+url.PathEscape(up.URL)+"/health", `{"healthy": false, "ttl": "5m"}`)
+	var status healthOverride
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("override = %d %s", rec.Code, rec.Body)
+	}
+	if status.URL != up.URL || status.Healthy || status.HealthSource != "manual" || status.Pools != 1 {
+		t.Errorf("override %+v", status)
+	}
+	if s := pool.Stats().Backends[0]; s.Healthy || s.HealthSource != "manual" {
+		t.Errorf("stats healthy %v, source %q", s.Healthy, s.HealthSource)
+	}
+	for body, want := range map[string]int{
+		`{"ttl": "5m"}`:                    http.StatusBadRequest,
+		`{"healthy": true, "ttl": "soon"}`: http.StatusBadRequest,
+		`{"healthy": true, "ttl": "48h"}`:  http.StatusBadRequest,
+	} {
+		if rec := post("/admin/backends/"+url.PathEscape(up.URL)+"/health", body); rec.Code != want {
+			t.Errorf("%s = %d %s, want %d", body, rec.Code, rec.Body, want)
+		}
+	}
+	if rec := post("/admin/backends/gpu-9:8000/health", `{"healthy": true, "ttl": "1m"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown backend = %d %s", rec.Code, rec.Body)
+	}
+}
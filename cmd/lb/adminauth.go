@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Admin protection (--admin-basic-auth, --admin-allow-cidr): every
+// listener's operational routes — /health, /stats, /metrics and /admin/* —
+// go through adminGuard, which answers 403 to a peer outside the allowed
+// CIDRs and then 401 to a request without the credentials, before the
+// request is routed: a listener serving only operational routes gives an
+// unknown path the same 401/403 as a known one. The proxied paths of a
+// listener never see the guard. The peer is the connection's address, not
+// X-Forwarded-For; a unix socket peer has none and matches no CIDR.
+
+// adminGuard checks requests to operational routes.
+type adminGuard struct {
+	// SHA-256 of the basic auth user and password, compared in constant
+	// time; unset without --admin-basic-auth
+	user, pass [sha256.Size]byte
+	auth       bool
+	allow      []netip.Prefix
+}
+
+// parseAdminGuard parses --admin-basic-auth user:pass and --admin-allow-cidr;
+// it returns nil when neither is set.
+func parseAdminGuard(basicAuth string, cidrs []string) (*adminGuard, error) {
+	if basicAuth == "" && len(cidrs) == 0 {
+		return nil, nil
+	}
+	g := &adminGuard{}
+	if basicAuth != "" {
+		user, pass, ok := strings.Cut(basicAuth, ":")
+		if !ok || user == "" || pass == "" {
+			return nil, errors.New("admin-basic-auth must be user:password")
+		}
+		g.user, g.pass, g.auth = sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass)), true
+	}
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil || addr.Zone() != "" {
+				return nil, fmt.Errorf("invalid admin-allow-cidr %q: want a CIDR like 10.0.0.0/8 or fd00::/8, or an address", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		g.allow = append(g.allow, prefix.Masked())
+	}
+	return g, nil
+}
+
+// allowed reports whether the peer at remoteAddr is in an allowed CIDR.
+func (g *adminGuard) allowed(remoteAddr string) bool {
+	if len(g.allow) == 0 {
+		return true
+	}
+	peer, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := peer.Addr().Unmap().WithZone("")
+	for _, prefix := range g.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized reports whether r carries the basic auth credentials.
+func (g *adminGuard) authorized(r *http.Request) bool {
+	if !g.auth {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	userHash, passHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))
+	userOK := subtle.ConstantTimeCompare(userHash[:], g.user[:])
+	passOK := subtle.ConstantTimeCompare(passHash[:], g.pass[:])
+	return ok && userOK&passOK == 1
+}
+
+// wrap returns h behind the guard; a nil guard lets everything through.
+func (g *adminGuard) wrap(h http.Handler) http.Handler {
+	if g == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.allowed(r.RemoteAddr) {
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if !g.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lb admin"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (g *adminGuard) String() string {
+	var parts []string
+	if g.auth {
+		parts = append(parts, "basic auth")
+	}
+	if len(g.allow) > 0 {
+		cidrs := make([]string, len(g.allow))
+		for i, prefix := range g.allow {
+			cidrs[i] = prefix.String()
+		}
+		parts = append(parts, "peers in "+strings.Join(cidrs, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-load-balance/lib"
+)
+
+func TestAdminGuardCIDRs(t *testing.T) {
+	g, err := parseAdminGuard("", []string{"10.0.0.0/8", "fd00:abcd::/32", "192.168.1.7", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote string
+		want   bool
+	}{
+		{"10.1.2.3:51000", true},
+		{"11.0.0.1:51000", false},
+		{"[::ffff:10.9.9.9]:51000", true}, // IPv4 on a dual-stack socket
+		{"[fd00:abcd:1::5]:51000", true},
+		{"[fd00:abce::5]:51000", false},
+		{"[fd00:abcd::5%eth0]:51000", true},
+		{"192.168.1.7:80", true},
+		{"192.168.1.8:80", false},
+		{"[2001:db8::1]:80", true},
+		{"[2001:db8::2]:80", false},
+		{"@", false}, // a unix socket peer
+	} {
+		if got := g.allowed(c.remote); got != c.want {
+			t.Errorf("allowed(%s) = %v, want %v", c.remote, got, c.want)
+		}
+	}
+	if g.String() != "peers in 10.0.0.0/8, fd00:abcd::/32, 192.168.1.7/32, 2001:db8::1/128" {
+		t.Errorf("String() = %q", g)
+	}
+
+	if g, err := parseAdminGuard("", nil); g != nil || err != nil {
+		t.Errorf("no flags: %v, %v", g, err)
+	}
+	for _, bad := range [][2]string{{"admin", ""}, {":secret", ""}, {"admin:", ""}, {"", "10.0.0.0/33"}, {"", "gpu-0"}, {"", "fe80::1%eth0"}} {
+		var cidrs []string
+		if bad[1] != "" {
+			cidrs = []string{bad[1]}
+		}
+		if _, err := parseAdminGuard(bad[0], cidrs); err == nil {
+			t.Errorf("parseAdminGuard(%q, %q) accepted", bad[0], bad[1])
+		}
+	}
+}
+
+func TestAdminPortGuarded(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &endpoints{pools: []*lib.Pool{pool}, poolsByName: map[string]*lib.Pool{"default": pool}}
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot) // stands in for the pools
+	})
+	registerAdmin := func(mux *http.ServeMux) { registerBackendAdmin(mux, []*lib.Pool{pool}) }
+	listeners, err := parseListeners(nil, 8080, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners = append(withoutInlineAdmin(listeners), adminListener(9090))
+	guard, err := parseAdminGuard("ops:s3cret", []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := httptest.NewServer(listeners[0].routes.mux(ep, proxy, registerAdmin, guard))
+	defer public.Close()
+	admin := httptest.NewServer(listeners[1].routes.mux(ep, proxy, registerAdmin, guard))
+	defer admin.Close()
+	denied := httptest.NewServer(listeners[1].routes.mux(ep, proxy, registerAdmin, &adminGuard{allow: guard.allow[1:]}))
+	defer denied.Close()
+
+	for _, c := range []struct {
+		srv        *httptest.Server
+		path, auth string
+		want       int
+	}{
+		// The proxy listener carries no operational route and never asks.
+		{public, "/v1/models", "", http.StatusTeapot},
+		{public, "/health", "", http.StatusTeapot},
+		{public, "/admin/backends/gpu-0", "", http.StatusTeapot},
+		{public, "/metrics", "wrong:pass", http.StatusTeapot},
+		// Unknown paths fail like known ones until authorized.
+		{admin, "/stats", "", http.StatusUnauthorized},
+		{admin, "/no-such-path", "", http.StatusUnauthorized},
+		{admin, "/stats", "ops:wrong", http.StatusUnauthorized},
+		{admin, "/stats", "other:s3cret", http.StatusUnauthorized},
+		{admin, "/stats", "ops:s3cret", http.StatusOK},
+		{admin, "/health", "ops:s3cret", http.StatusOK},
+		{admin, "/metrics", "ops:s3cret", http.StatusOK},
+		{admin, "/admin/backends/gpu-0", "ops:s3cret", http.StatusOK},
+		{admin, "/no-such-path", "ops:s3cret", http.StatusNotFound},
+		{admin, "/v1/models", "ops:s3cret", http.StatusNotFound},
+		// The peer check comes first, credentials or not.
+		{denied, "/stats", "", http.StatusForbidden},
+		{denied, "/no-such-path", "", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, c.srv.URL+c.path, nil)
+		if user, pass, ok := strings.Cut(c.auth, ":"); ok {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("GET %s (auth %q) on %s = %d, want %d", c.path, c.auth, c.srv.URL, resp.StatusCode, c.want)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %s: 401 without WWW-Authenticate", c.path)
+		}
+	}
+}
+
+func TestInlineAdminGuarded(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &endpoints{pools: []*lib.Pool{pool}, poolsByName: map[string]*lib.Pool{"default": pool}}
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	guard, err := parseAdminGuard("ops:s3cret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := parseListeners(nil, 8080, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(listeners[0].routes.mux(ep, proxy, func(*http.ServeMux) {}, guard))
+	defer srv.Close()
+	for path, want := range map[string]int{
+		"/v1/chat/completions": http.StatusTeapot,
+		"/anything":            http.StatusTeapot,
+		"/stats":               http.StatusUnauthorized,
+		"/health":              http.StatusUnauthorized,
+		"/metrics":             http.StatusUnauthorized,
+		"/admin/queues":        http.StatusUnauthorized,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
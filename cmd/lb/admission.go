@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"go-load-balance/lib"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// admissionFlags are the flags of which requests are let in, and when: the
+// admission queue, request priorities, load shedding, per-client limits,
+// API keys and request validation.
+type admissionFlags struct {
+	queue         lib.QueueConfig
+	priority      lib.PriorityConfig
+	promoteAfter  time.Duration
+	priorities    *lib.RequestPriorities
+	shedder       *lib.Shedder
+	inflight      *lib.InflightLimiter
+	apiKeysFile   string
+	apiKeys       *lib.APIKeys
+	validator     *lib.RequestValidator
+	validateBody  int
+	allowedModels []string
+}
+
+// parseAdmissionFlags parses the admission flags, opening --api-keys-file.
+// Rejections are written in errorFormat.
+func parseAdmissionFlags(cmd *cli.Command, errorFormat lib.ErrorFormat) (admissionFlags, error) {
+	f := admissionFlags{
+		queue: lib.QueueConfig{
+			Size:          cmd.Int("queue-size"),
+			Timeout:       cmd.Duration("queue-timeout"),
+			ProgressPaths: cmd.StringSlice("queue-progress-path"),
+			TenantHeader:  strings.TrimSpace(cmd.String("queue-tenant-header")),
+			TenantSize:    cmd.Int("queue-tenant-size"),
+		},
+		priority: lib.PriorityConfig{
+			Header:    strings.TrimSpace(cmd.String("priority-header")),
+			HighAllow: cmd.StringSlice("priority-high-allow"),
+		},
+		promoteAfter:  cmd.Duration("priority-promote-after"),
+		apiKeysFile:   cmd.String("api-keys-file"),
+		validateBody:  cmd.Int("validate-max-body"),
+		allowedModels: cmd.StringSlice("allowed-models"),
+	}
+	shed := lib.ShedConfig{
+		MaxInflight:   cmd.Int("max-inflight"),
+		MaxGoroutines: cmd.Int("shed-goroutines"),
+	}
+	perClient := cmd.Int("max-inflight-per-client")
+	concurrencyKey := cmd.String("concurrency-key")
+
+	q := &f.queue
+	if q.Size < 0 {
+		return f, configErrorf("queue-size cannot be negative")
+	}
+	if q.Size > 0 && q.Timeout <= 0 {
+		return f, configErrorf("queue-timeout must be positive, got %v", q.Timeout)
+	}
+	for _, prefix := range q.ProgressPaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return f, configErrorf("queue-progress-path must start with /, got %q", prefix)
+		}
+	}
+	if q.TenantSize < 0 {
+		return f, configErrorf("queue-tenant-size cannot be negative")
+	}
+	if q.TenantHeader != "" && q.Size == 0 {
+		return f, configErrorf("queue-tenant-header requires --queue-size")
+	}
+	if q.TenantSize > 0 && q.TenantHeader == "" {
+		return f, configErrorf("queue-tenant-size requires --queue-tenant-header")
+	}
+	if f.priority.Header != "" {
+		if q.TenantHeader != "" {
+			return f, configErrorf("priority-header and queue-tenant-header cannot be combined: the queue dispatches either by priority or by tenant")
+		}
+		if f.promoteAfter < 0 {
+			return f, configErrorf("priority-promote-after cannot be negative")
+		}
+		var err error
+		if f.priorities, err = lib.NewRequestPriorities(f.priority); err != nil {
+			return f, configError(err)
+		}
+		q.Prioritized = true
+		q.PromoteAfter = f.promoteAfter
+		shed.ByPriority = true
+	} else if len(f.priority.HighAllow) > 0 {
+		return f, configErrorf("priority-high-allow requires --priority-header")
+	}
+
+	if shed.MaxInflight < 0 || shed.MaxGoroutines < 0 {
+		return f, configErrorf("max-inflight and shed-goroutines cannot be negative")
+	}
+	if shed.MaxInflight > 0 || shed.MaxGoroutines > 0 {
+		f.shedder = lib.NewShedder(shed)
+	}
+	if perClient < 0 {
+		return f, configErrorf("max-inflight-per-client must be non-negative, got %d", perClient)
+	}
+	if concurrencyKey != "" && perClient == 0 {
+		return f, configErrorf("concurrency-key requires --max-inflight-per-client")
+	}
+	if perClient > 0 {
+		f.inflight = lib.NewInflightLimiter(perClient, concurrencyKey)
+		f.inflight.SetErrorFormat(errorFormat)
+	}
+
+	if f.validateBody < 1 {
+		return f, configErrorf("validate-max-body must be positive, got %d", f.validateBody)
+	}
+	validate := cmd.Bool("validate-requests")
+	if len(f.allowedModels) > 0 && !validate {
+		return f, configErrorf("allowed-models requires --validate-requests")
+	}
+	if validate {
+		f.validator = lib.NewRequestValidator(int64(f.validateBody), f.allowedModels)
+		f.validator.SetErrorFormat(errorFormat)
+	}
+	if f.apiKeysFile != "" {
+		keys, err := lib.NewAPIKeys(f.apiKeysFile)
+		if err != nil {
+			return f, configError(err)
+		}
+		keys.SetErrorFormat(errorFormat)
+		f.apiKeys = keys
+	}
+	return f, nil
+}
+
+func (f admissionFlags) log() {
+	if q := f.queue; q.Size > 0 {
+		log.Printf("Admission queue: %d requests, timeout %v, progress on %v", q.Size, q.Timeout, q.ProgressPaths)
+		if q.TenantHeader != "" {
+			log.Printf("Fair queuing: tenants by %s, up to %d queued each (0 = no cap)", q.TenantHeader, q.TenantSize)
+		}
+	}
+	if f.priorities != nil {
+		allowed := "anyone"
+		if len(f.priority.HighAllow) > 0 {
+			allowed = strings.Join(f.priority.HighAllow, ", ")
+		}
+		log.Printf("Request priority: %s, high allowed for %s, promoted after %v queued (0 = never)", f.priority.Header, allowed, f.promoteAfter)
+	}
+	if f.apiKeys != nil {
+		log.Printf("API keys: %d from %s", f.apiKeys.Len(), f.apiKeysFile)
+	}
+	if f.validator != nil {
+		if len(f.allowedModels) > 0 {
+			log.Printf("Request validation: bodies up to %d bytes, models %s", f.validateBody, strings.Join(f.allowedModels, ", "))
+		} else {
+			log.Printf("Request validation: bodies up to %d bytes, any model", f.validateBody)
+		}
+	}
+}
+
+// apply sets how pool admits requests.
+func (f admissionFlags) apply(pool *lib.Pool) {
+	if f.shedder != nil {
+		pool.SetShedder(f.shedder)
+	}
+	pool.SetRequestPriorities(f.priorities)
+	if f.queue.Size > 0 {
+		pool.SetQueue(f.queue)
+	}
+}
+
+// start watches --api-keys-file until ctx ends, reloading it on SIGHUP too.
+func (f admissionFlags) start(ctx context.Context) {
+	if f.apiKeys == nil {
+		return
+	}
+	go f.apiKeys.Start(ctx)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				f.apiKeys.Reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// lb bench: drives load at a URL from --concurrency workers for --duration,
+// each sending its next request as soon as the last one's response has been
+// read to the end, and reports throughput, latency quantiles and status
+// codes. Against lb with --debug-headers it also reports which backends
+// served the requests, from X-LB-Backend. With --stream the response is
+// read as OpenAI-style SSE: the time to the first data: event and the
+// number of chunks are reported too. Requests still running when the
+// duration ends are cancelled and left out of the report; transport errors
+// are counted apart from statuses.
+
+// benchBackendHeader names the backend that served a request (see
+// lib/debug.go).
+const benchBackendHeader = "X-LB-Backend"
+
+// benchConfig is one bench run's load.
+type benchConfig struct {
+	target      string
+	method      string
+	body        []byte
+	header      http.Header
+	concurrency int
+	duration    time.Duration
+	timeout     time.Duration
+	stream      bool
+}
+
+// benchResult is one request's outcome.
+type benchResult struct {
+	// latency is to the end of the response body, ttft to the first SSE
+	// data: event (--stream)
+	latency, ttft time.Duration
+	// status is 0 after a transport error
+	status  int
+	backend string
+	chunks  int
+}
+
+// benchReport is a bench run's summary, the JSON of --output json.
+type benchReport struct {
+	Target   string `json:"target"`
+	Requests int    `json:"requests"`
+	// Errors counts requests that got no response (transport errors).
+	Errors            int     `json:"errors"`
+	DurationSec       float64 `json:"duration_s"`
+	RequestsPerSecond float64 `json:"requests_per_s"`
+	// Latency is of the requests with a response, to the end of its body.
+	Latency *benchQuantiles `json:"latency_ms,omitempty"`
+	// TTFT is the time to the first SSE event and StreamChunks the data
+	// events received (--stream).
+	TTFT         *benchQuantiles `json:"ttft_ms,omitempty"`
+	StreamChunks int             `json:"stream_chunks,omitempty"`
+	// Statuses counts responses by status code.
+	Statuses map[string]int `json:"statuses"`
+	// Backends counts responses by X-LB-Backend, when present.
+	Backends map[string]int `json:"backends,omitempty"`
+}
+
+// benchQuantiles summarizes durations, in milliseconds.
+type benchQuantiles struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// summarizeDurations returns the quantiles of ds, sorting it; nil for none.
+func summarizeDurations(ds []time.Duration) *benchQuantiles {
+	if len(ds) == 0 {
+		return nil
+	}
+	slices.Sort(ds)
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return &benchQuantiles{
+		Mean: benchMs(sum / time.Duration(len(ds))),
+		P50:  benchMs(quantile(ds, 0.5)),
+		P90:  benchMs(quantile(ds, 0.9)),
+		P99:  benchMs(quantile(ds, 0.99)),
+		Max:  benchMs(ds[len(ds)-1]),
+	}
+}
+
+// quantile returns the nearest-rank q quantile of sorted.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+func benchMs(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// summarize reports results, which took elapsed.
+func summarize(target string, results []benchResult, elapsed time.Duration) benchReport {
+	r := benchReport{Target: target, Requests: len(results), DurationSec: elapsed.Seconds(), Statuses: map[string]int{}}
+	if elapsed > 0 {
+		r.RequestsPerSecond = float64(len(results)) / elapsed.Seconds()
+	}
+	var latencies, ttfts []time.Duration
+	for _, res := range results {
+		if res.status == 0 {
+			r.Errors++
+			continue
+		}
+		r.Statuses[strconv.Itoa(res.status)]++
+		latencies = append(latencies, res.latency)
+		if res.ttft > 0 {
+			ttfts = append(ttfts, res.ttft)
+		}
+		r.StreamChunks += res.chunks
+		if res.backend != "" {
+			if r.Backends == nil {
+				r.Backends = map[string]int{}
+			}
+			r.Backends[res.backend]++
+		}
+	}
+	r.Latency = summarizeDurations(latencies)
+	r.TTFT = summarizeDurations(ttfts)
+	return r
+}
+
+// runBench drives cfg's load and returns every finished request's result
+// and the time taken.
+func runBench(ctx context.Context, cfg benchConfig) ([]benchResult, time.Duration) {
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, MaxIdleConnsPerHost: cfg.concurrency},
+		Timeout:   cfg.timeout,
+	}
+	defer client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	var mu sync.Mutex
+	var results []benchResult
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range cfg.concurrency {
+		wg.Go(func() {
+			var mine []benchResult
+			for ctx.Err() == nil {
+				res, err := benchRequest(ctx, client, cfg)
+				if err != nil && ctx.Err() != nil {
+					break // cut off by the end of the run
+				}
+				mine = append(mine, res)
+			}
+			mu.Lock()
+			results = append(results, mine...)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	return results, time.Since(start)
+}
+
+// benchRequest sends one request and reads its response to the end.
+func benchRequest(ctx context.Context, client *http.Client, cfg benchConfig) (benchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, cfg.method, cfg.target, bytes.NewReader(cfg.body))
+	if err != nil {
+		return benchResult{}, err
+	}
+	req.Header = cfg.header.Clone()
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(start)}, err
+	}
+	defer resp.Body.Close()
+	res := benchResult{status: resp.StatusCode, backend: resp.Header.Get(benchBackendHeader)}
+	if cfg.stream {
+		err = readStream(resp.Body, start, &res)
+	} else {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	res.latency = time.Since(start)
+	if err != nil {
+		res.status = 0 // the body was cut off
+	}
+	return res, err
+}
+
+// readStream reads an SSE body, recording the time to its first data:
+// event and the data events other than [DONE].
+func readStream(body io.Reader, start time.Time, res *benchResult) error {
+	lines := bufio.NewScanner(body)
+	lines.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data:")
+		if !ok {
+			continue
+		}
+		if res.ttft == 0 {
+			res.ttft = time.Since(start)
+		}
+		if strings.TrimSpace(data) != "[DONE]" {
+			res.chunks++
+		}
+	}
+	return lines.Err()
+}
+
+// parseBenchConfig reads the bench flags and target argument.
+func parseBenchConfig(cmd *cli.Command) (benchConfig, error) {
+	cfg := benchConfig{
+		target:      cmd.Args().First(),
+		method:      strings.ToUpper(cmd.String("method")),
+		header:      http.Header{},
+		concurrency: cmd.Int("concurrency"),
+		duration:    cmd.Duration("duration"),
+		timeout:     cmd.Duration("client-timeout"),
+		stream:      cmd.Bool("stream"),
+	}
+	if cmd.Args().Len() != 1 {
+		return cfg, errors.New("lb bench takes one target URL")
+	}
+	u, err := url.Parse(cfg.target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return cfg, fmt.Errorf("invalid target URL %q: want http(s)://host[:port]/path", cfg.target)
+	}
+	if cfg.concurrency < 1 {
+		return cfg, errors.New("concurrency must be at least 1")
+	}
+	if cfg.duration <= 0 || cfg.timeout < 0 {
+		return cfg, errors.New("duration must be positive and client-timeout non-negative")
+	}
+	if path := cmd.String("body-file"); path != "" {
+		if cfg.body, err = os.ReadFile(path); err != nil {
+			return cfg, fmt.Errorf("body-file: %w", err)
+		}
+	}
+	if cfg.method == "" {
+		cfg.method = http.MethodGet
+		if cfg.body != nil {
+			cfg.method = http.MethodPost
+		}
+	}
+	for _, h := range cmd.StringSlice("header") {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return cfg, fmt.Errorf("invalid header %q: want \"Name: value\"", h)
+		}
+		cfg.header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if cfg.body != nil && cfg.header.Get("Content-Type") == "" {
+		cfg.header.Set("Content-Type", "application/json")
+	}
+	return cfg, nil
+}
+
+func bench(ctx context.Context, cmd *cli.Command) error {
+	output := cmd.String("output")
+	if output != "text" && output != "json" {
+		return configErrorf("output must be text or json, got %q", output)
+	}
+	cfg, err := parseBenchConfig(cmd)
+	if err != nil {
+		return configError(err)
+	}
+	results, elapsed := runBench(ctx, cfg)
+	report := summarize(cfg.target, results, elapsed)
+	w := cmd.Root().Writer
+	if output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.writeText(w)
+}
+
+// writeText writes the report for a terminal.
+func (r benchReport) writeText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Target:\t%s\n", r.Target)
+	fmt.Fprintf(w, "Requests:\t%d in %.2fs, %.1f/s (%d errors)\n", r.Requests, r.DurationSec, r.RequestsPerSecond, r.Errors)
+	quantiles := func(name string, q *benchQuantiles) {
+		if q != nil {
+			fmt.Fprintf(w, "%s (ms):\tmean %.1f\tp50 %.1f\tp90 %.1f\tp99 %.1f\tmax %.1f\n", name, q.Mean, q.P50, q.P90, q.P99, q.Max)
+		}
+	}
+	quantiles("Latency", r.Latency)
+	quantiles("Time to first token", r.TTFT)
+	if r.TTFT != nil {
+		fmt.Fprintf(w, "Stream chunks:\t%d\n", r.StreamChunks)
+	}
+	fmt.Fprintln(w, "Status codes:")
+	for _, status := range slices.Sorted(maps.Keys(r.Statuses)) {
+		fmt.Fprintf(w, "  %s\t%d\n", status, r.Statuses[status])
+	}
+	if len(r.Backends) > 0 {
+		responses := 0
+		for _, n := range r.Statuses {
+			responses += n
+		}
+		fmt.Fprintf(w, "Backends (%s):\n", benchBackendHeader)
+		for _, backend := range slices.Sorted(maps.Keys(r.Backends)) {
+			n := r.Backends[backend]
+			fmt.Fprintf(w, "  %s\t%d\t%.1f%%\n", backend, n, 100*float64(n)/float64(responses))
+		}
+	}
+	return w.Flush()
+}
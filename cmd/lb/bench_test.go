@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib"
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestBenchSummarize(t *testing.T) {
+	var results []benchResult
+	for i := 1; i <= 100; i++ {
+		results = append(results, benchResult{latency: time.Duration(i) * time.Millisecond, status: 200, backend: "http://a"})
+	}
+	results[0].status, results[1].status = 503, 0 // 1ms and 2ms
+	results[2].backend = "http://b"
+	r := summarize("http://lb/v1/models", results, 4*time.Second)
+
+	if r.Requests != 100 || r.Errors != 1 || r.RequestsPerSecond != 25 {
+		t.Errorf("requests %d, errors %d, %v/s; want 100, 1, 25/s", r.Requests, r.Errors, r.RequestsPerSecond)
+	}
+	if r.Statuses["200"] != 98 || r.Statuses["503"] != 1 || len(r.Statuses) != 2 {
+		t.Errorf("statuses %v", r.Statuses)
+	}
+	if r.Backends["http://a"] != 98 || r.Backends["http://b"] != 1 {
+		t.Errorf("backends %v", r.Backends)
+	}
+	// 99 latencies, 1ms and 3..100ms: the rank k one is k+1ms from k=2.
+	want := benchQuantiles{Mean: benchMs(5048 * time.Millisecond / 99), P50: 51, P90: 91, P99: 100, Max: 100}
+	if l := r.Latency; l == nil || *l != want {
+		t.Errorf("latency %+v, want %+v", l, want)
+	}
+	if r.TTFT != nil || r.StreamChunks != 0 {
+		t.Errorf("stream stats without --stream: %+v, %d", r.TTFT, r.StreamChunks)
+	}
+
+	empty := summarize("http://lb", nil, 0)
+	if empty.Latency != nil || empty.RequestsPerSecond != 0 || empty.Backends != nil {
+		t.Errorf("empty report %+v", empty)
+	}
+}
+
+func TestBenchQuantile(t *testing.T) {
+	one := []time.Duration{7}
+	for _, q := range []float64{0, 0.5, 0.999, 1} {
+		if got := quantile(one, q); got != 7 {
+			t.Errorf("quantile(one, %v) = %v", q, got)
+		}
+	}
+	four := []time.Duration{1, 2, 3, 4}
+	for q, want := range map[float64]time.Duration{0.25: 1, 0.26: 2, 0.5: 2, 0.75: 3, 0.9: 4, 1: 4} {
+		if got := quantile(four, q); got != want {
+			t.Errorf("quantile(four, %v) = %v, want %v", q, got, want)
+		}
+	}
+}
+
+// runBenchApp runs lb bench with args and decodes its JSON report.
+func runBenchApp(t *testing.T, args ...string) benchReport {
+	t.Helper()
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	if err := app.Run(context.Background(), append([]string{"lb", "bench", "--output", "json"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	var r benchReport
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatalf("%v in %s", err, out.String())
+	}
+	return r
+}
+
+func TestBenchAgainstPool(t *testing.T) {
+	cfg := mockbackend.Config{StreamChunks: 3, StreamDelay: 5 * time.Millisecond}
+	a, b := mockbackend.Start(t, cfg), mockbackend.Start(t, cfg)
+	pool, err := lib.NewPool([]string{a.URL, b.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetDebug(lib.NewDecisionLog(0))
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	r := runBenchApp(t, "--concurrency", "4", "--duration", "300ms", lb.URL+"/v1/models")
+	if r.Requests == 0 || r.Errors != 0 || r.Statuses["200"] != r.Requests || r.Latency == nil {
+		t.Fatalf("report %+v", r)
+	}
+	if len(r.Backends) != 2 || r.Backends[a.URL]+r.Backends[b.URL] != r.Requests {
+		t.Errorf("backends %v for %d requests", r.Backends, r.Requests)
+	}
+
+	body := filepath.Join(t.TempDir(), "body.json")
+	if err := os.WriteFile(body, []byte(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r = runBenchApp(t, "--concurrency", "2", "--duration", "300ms", "--stream", "--body-file", body, lb.URL+"/v1/chat/completions")
+	// role, three content chunks and the stop chunk; [DONE] is not one
+	if r.Statuses["200"] == 0 || r.TTFT == nil || r.StreamChunks != 5*r.Statuses["200"] {
+		t.Errorf("stream report %+v", r)
+	}
+	if r.TTFT != nil && r.Latency != nil && r.TTFT.Max > r.Latency.Max {
+		t.Errorf("time to first token %v over latency %v", r.TTFT, r.Latency)
+	}
+}
+
+func TestBenchText(t *testing.T) {
+	var out bytes.Buffer
+	r := summarize("http://lb/v1/models", []benchResult{
+		{latency: 10 * time.Millisecond, status: 200, backend: "http://a"},
+		{latency: 30 * time.Millisecond, status: 200, backend: "http://b"},
+		{latency: 20 * time.Millisecond, status: 429},
+	}, time.Second)
+	if err := r.writeText(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Requests:      3 in 1.00s, 3.0/s (0 errors)",
+		"Latency (ms):  mean 20.0  p50 20.0  p90 30.0  p99 30.0  max 30.0",
+		"  429  1",
+		"  http://a  1  33.3%",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestBenchInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"localhost:8080"},
+		{"http://a", "http://b"},
+		{"--concurrency", "0", "http://a"},
+		{"--duration", "0s", "http://a"},
+		{"--header", "no-colon", "http://a"},
+		{"--body-file", "/nonexistent", "http://a"},
+		{"--output", "yaml", "http://a"},
+	} {
+		assertExit(t, runApp(t, append([]string{"bench"}, args...)...), exitConfig, "config")
+	}
+}
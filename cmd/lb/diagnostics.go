@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"go-load-balance/lib"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Diagnostics (--enable-pprof): net/http/pprof under /debug/pprof/ and
+// GET /admin/runtime, mounted only on the listeners without the proxy
+// (--admin-port, or --listen ADDR,admin), so neither is ever reachable on a
+// port serving traffic, and behind the admin guard like every operational
+// route; --enable-pprof without such a listener is a config error. The
+// runtime supports one CPU profile and one execution trace at a time: a
+// second request gets 429 while one runs, and either is capped at
+// pprofMaxSeconds. /debug/pprof/cmdline is left out, since lb's command
+// line can carry secrets (--admin-basic-auth, --peer-secret).
+
+// pprofMaxSeconds caps a CPU profile's or execution trace's ?seconds=.
+const pprofMaxSeconds = 120
+
+// runtimePauses is how many of the most recent GC pauses /admin/runtime's
+// quantiles cover, all the runtime keeps.
+const runtimePauses = 256
+
+// diagnostics serves the --enable-pprof endpoints.
+type diagnostics struct {
+	pools []*lib.Pool
+	// profiling and tracing are set while a CPU profile or execution
+	// trace runs
+	profiling, tracing atomic.Bool
+}
+
+// register mounts the diagnostics endpoints:
+//
+//	GET /debug/pprof/...   net/http/pprof, without cmdline
+//	GET /admin/runtime     runtime and backend connection stats
+func (d *diagnostics) register(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.Handle("/debug/pprof/profile", oneAtATime(&d.profiling, "a CPU profile", pprof.Profile))
+	mux.Handle("/debug/pprof/trace", oneAtATime(&d.tracing, "an execution trace", pprof.Trace))
+	mux.HandleFunc("GET /admin/runtime", d.handleRuntime)
+}
+
+// oneAtATime serves h to one request at a time, answering 429 to the
+// others meanwhile, and 400 to a ?seconds= over pprofMaxSeconds.
+func oneAtATime(running *atomic.Bool, what string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := r.FormValue("seconds"); s != "" {
+			if n, err := strconv.ParseFloat(s, 64); err != nil || n > pprofMaxSeconds {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("seconds must be a number up to %d", pprofMaxSeconds))
+				return
+			}
+		}
+		if !running.CompareAndSwap(false, true) {
+			writeJSONError(w, http.StatusTooManyRequests, what+" is already running")
+			return
+		}
+		defer running.Store(false)
+		h(w, r)
+	})
+}
+
+// runtimeResponse is the GET /admin/runtime payload.
+type runtimeResponse struct {
+	Goroutines int         `json:"goroutines"`
+	GOMAXPROCS int         `json:"gomaxprocs"`
+	Heap       runtimeHeap `json:"heap"`
+	GC         runtimeGC   `json:"gc"`
+	// OpenFDs is lb's open file descriptors, left out where the count is
+	// not available (it is read from /proc/self/fd)
+	OpenFDs     *int                `json:"open_fds,omitempty"`
+	Connections []lib.ConnPoolStats `json:"connections"`
+}
+
+type runtimeHeap struct {
+	AllocBytes  uint64 `json:"alloc_bytes"`
+	InuseBytes  uint64 `json:"inuse_bytes"`
+	IdleBytes   uint64 `json:"idle_bytes"`
+	SysBytes    uint64 `json:"sys_bytes"`
+	Objects     uint64 `json:"objects"`
+	NextGCBytes uint64 `json:"next_gc_bytes"`
+}
+
+// runtimeGC reports collections since start, and quantiles of the most
+// recent pauses (up to runtimePauses of them).
+type runtimeGC struct {
+	Count        uint32  `json:"count"`
+	CPUFraction  float64 `json:"cpu_fraction"`
+	PauseTotalMs float64 `json:"pause_total_ms"`
+	Pauses       int     `json:"pauses"`
+	PauseP50Ms   float64 `json:"pause_p50_ms"`
+	PauseP90Ms   float64 `json:"pause_p90_ms"`
+	PauseP99Ms   float64 `json:"pause_p99_ms"`
+	PauseMaxMs   float64 `json:"pause_max_ms"`
+}
+
+func (d *diagnostics) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	resp := runtimeResponse{
+		Goroutines: runtime.NumGoroutine(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Heap: runtimeHeap{
+			AllocBytes:  m.HeapAlloc,
+			InuseBytes:  m.HeapInuse,
+			IdleBytes:   m.HeapIdle,
+			SysBytes:    m.HeapSys,
+			Objects:     m.HeapObjects,
+			NextGCBytes: m.NextGC,
+		},
+		GC:          gcStats(&m),
+		Connections: []lib.ConnPoolStats{},
+	}
+	if n, err := openFDs(); err == nil {
+		resp.OpenFDs = &n
+	}
+	for _, pool := range d.pools {
+		resp.Connections = append(resp.Connections, pool.ConnPoolStats()...)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// gcStats summarizes m's collections and recent pauses.
+func gcStats(m *runtime.MemStats) runtimeGC {
+	n := int(min(m.NumGC, runtimePauses))
+	pauses := make([]time.Duration, n)
+	for i := range n {
+		pauses[i] = time.Duration(m.PauseNs[(int(m.NumGC)-1-i+runtimePauses)%runtimePauses]) // #nosec G115 -- a GC pause fits in int64 nanoseconds
+	}
+	slices.Sort(pauses)
+	quantile := func(q float64) float64 {
+		if n == 0 {
+			return 0
+		}
+		return ms(pauses[min(n-1, int(q*float64(n)))])
+	}
+	return runtimeGC{
+		Count:        m.NumGC,
+		CPUFraction:  m.GCCPUFraction,
+		PauseTotalMs: ms(time.Duration(m.PauseTotalNs)), // #nosec G115 -- total pause time fits in int64 nanoseconds
+		Pauses:       n,
+		PauseP50Ms:   quantile(0.5),
+		PauseP90Ms:   quantile(0.9),
+		PauseP99Ms:   quantile(0.99),
+		PauseMaxMs:   quantile(1),
+	}
+}
+
+// ms is d in (fractional) milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// openFDs counts lb's open file descriptors, not counting the one reading
+// them.
+func openFDs() (int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries) - 1, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"go-load-balance/lib"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestDiagnosticsOnlyOnAdminListeners(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &endpoints{pools: []*lib.Pool{pool}, poolsByName: map[string]*lib.Pool{"default": pool}, diagnostics: &diagnostics{pools: []*lib.Pool{pool}}}
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot) // stands in for the pools
+	})
+	registerAdmin := func(mux *http.ServeMux) { registerBackendAdmin(mux, []*lib.Pool{pool}) }
+	// The proxy listener with inline admin routes, as without --admin-port.
+	public := httptest.NewServer(listenerRoutes{proxy: true, admin: true, metrics: true, health: true}.mux(ep, proxy, registerAdmin, nil))
+	defer public.Close()
+	internal := httptest.NewServer(listenerRoutes{admin: true, metrics: true, health: true}.mux(ep, proxy, registerAdmin, nil))
+	defer internal.Close()
+
+	// On the proxy listener pprof paths are proxied like any other, and
+	// /admin/runtime is an unknown admin route.
+	for path, proxied := range map[string]int{
+		"/debug/pprof/":          http.StatusTeapot,
+		"/debug/pprof/heap":      http.StatusTeapot,
+		"/debug/pprof/goroutine": http.StatusTeapot,
+		"/admin/runtime":         http.StatusNotFound,
+	} {
+		for _, tc := range []struct {
+			name string
+			srv  *httptest.Server
+			want int
+		}{{"public", public, proxied}, {"internal", internal, http.StatusOK}} {
+			resp, err := http.Get(tc.srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("GET %s on the %s listener = %d, want %d", path, tc.name, resp.StatusCode, tc.want)
+			}
+		}
+	}
+	resp, err := http.Get(internal.URL + "/debug/pprof/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("cmdline = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDiagnosticsOneCPUProfile(t *testing.T) {
+	d := &diagnostics{}
+	mux := http.NewServeMux()
+	d.register(mux)
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+	d.profiling.Store(true)
+	if code := get("/debug/pprof/profile?seconds=1"); code != http.StatusTooManyRequests {
+		t.Errorf("second CPU profile = %d, want 429", code)
+	}
+	d.profiling.Store(false)
+	if code := get("/debug/pprof/profile?seconds=600"); code != http.StatusBadRequest {
+		t.Errorf("10 minute CPU profile = %d, want 400", code)
+	}
+	if code := get("/debug/pprof/trace?seconds=0.01"); code != http.StatusOK || d.tracing.Load() {
+		t.Errorf("trace = %d, still tracing %v", code, d.tracing.Load())
+	}
+}
+
+func TestRuntimeShape(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0", "http://gpu-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.GC()
+	d := &diagnostics{pools: []*lib.Pool{pool}}
+	rec := httptest.NewRecorder()
+	d.handleRuntime(rec, httptest.NewRequest(http.MethodGet, "/admin/runtime", nil))
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"goroutines", "gomaxprocs", "heap", "gc", "connections"} {
+		if _, ok := body[key]; !ok {
+			t.Errorf("no %s in %s", key, rec.Body)
+		}
+	}
+	if runtime.GOOS == "linux" && body["open_fds"].(float64) < 3 {
+		t.Errorf("open_fds %v", body["open_fds"])
+	}
+	heap := body["heap"].(map[string]any)
+	for _, key := range []string{"alloc_bytes", "inuse_bytes", "idle_bytes", "sys_bytes", "objects", "next_gc_bytes"} {
+		if _, ok := heap[key]; !ok {
+			t.Errorf("no heap.%s in %s", key, rec.Body)
+		}
+	}
+	gc := body["gc"].(map[string]any)
+	if gc["count"].(float64) < 1 || gc["pauses"].(float64) < 1 || gc["pause_max_ms"].(float64) < gc["pause_p50_ms"].(float64) {
+		t.Errorf("gc %v", gc)
+	}
+	conns := body["connections"].([]any)
+	if len(conns) != 2 {
+		t.Fatalf("connections %v", conns)
+	}
+	if c := conns[0].(map[string]any); c["pool"] != "default" || c["backend"] != "http://gpu-0" || c["open"] != 0.0 || c["active"] != 0.0 || c["idle"] != 0.0 {
+		t.Errorf("connection stats %v", c)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"go-load-balance/lib"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// endpoints serves lb's own operational endpoints.
+type endpoints struct {
+	pools       []*lib.Pool
+	poolsByName map[string]*lib.Pool
+	router      *lib.Router           // nil without --config
+	cache       *lib.ResponseCache    // nil without --cache-path
+	coalescer   *lib.Coalescer        // nil without --coalesce-path
+	splitter    *lib.Splitter         // nil without a config split
+	tenants     *lib.TenantRouter     // nil without config tenant routing
+	apiKeys     *lib.APIKeys          // nil without --api-keys-file
+	validator   *lib.RequestValidator // nil without --validate-requests
+	diagnostics *diagnostics          // nil without --enable-pprof
+	// metricsTimeout bounds rendering a /metrics scrape
+	metricsTimeout time.Duration
+}
+
+// healthStatus builds the /health fields for a set of pools.
+func healthStatus(pools ...*lib.Pool) map[string]any {
+	var totalActive, healthyCount, totalCount int
+	panicMode := false
+	var unhealthy []lib.UnhealthyBackend
+	for _, pool := range pools {
+		active, healthy, total := pool.GetStatus()
+		totalActive += active
+		healthyCount += healthy
+		totalCount += total
+		panicMode = panicMode || pool.PanicMode()
+		unhealthy = append(unhealthy, pool.Unhealthy()...)
+	}
+	status := "ok"
+	if healthyCount == 0 && !panicMode {
+		status = "degraded"
+	}
+	s := map[string]any{
+		"status":           status,
+		"healthy_backends": healthyCount,
+		"total_backends":   totalCount,
+		"active_conns":     totalActive,
+	}
+	if panicMode {
+		s["panic_mode"] = true
+	}
+	if len(unhealthy) > 0 {
+		s["unhealthy"] = unhealthy
+	}
+	return s
+}
+
+// handleHealth reports lb's own status without proxying: 200 while any
+// backend is healthy or a pool is routing in panic mode (with "panic_mode":
+// true), 503 otherwise. Unhealthy backends are listed with how long they
+// have been down and why. With a config file each pool is also
+// reported on its own, so one group being down is visible even while the
+// others keep the overall status at 200.
+func (ep *endpoints) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus(ep.pools...)
+	if ep.router != nil {
+		pools := make(map[string]any, len(ep.poolsByName))
+		for name, pool := range ep.poolsByName {
+			pools[name] = healthStatus(pool)
+		}
+		status["pools"] = pools
+	}
+	code := http.StatusOK
+	if status["status"] != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// statsResponse is the /stats payload: the single pool's stats inline, or
+// every named pool plus the routes between them when a config file is used.
+type statsResponse struct {
+	*lib.PoolStats
+	Pools      map[string]lib.PoolStats `json:"pools,omitempty"`
+	Routes     []lib.RouteStats         `json:"routes,omitempty"`
+	Split      *lib.SplitStats          `json:"split,omitempty"`
+	Tenants    []lib.TenantStats        `json:"tenants,omitempty"`
+	Cache      []lib.CacheRouteStats    `json:"cache,omitempty"`
+	Coalescing []lib.CoalesceRouteStats `json:"coalescing,omitempty"`
+	Auth       *lib.APIKeyStats         `json:"auth,omitempty"`
+	Validation *lib.ValidationStats     `json:"validation,omitempty"`
+}
+
+func (ep *endpoints) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("tenant") {
+		ep.handleTenantStats(w, r.URL.Query().Get("tenant"))
+		return
+	}
+	var resp statsResponse
+	if ep.router == nil {
+		s := ep.pools[0].Stats()
+		resp.PoolStats = &s
+	} else {
+		resp.Pools = make(map[string]lib.PoolStats, len(ep.poolsByName))
+		for name, pool := range ep.poolsByName {
+			resp.Pools[name] = pool.Stats()
+		}
+		resp.Routes = ep.router.Stats()
+	}
+	if ep.splitter != nil {
+		s := ep.splitter.Stats()
+		resp.Split = &s
+	}
+	if ep.tenants != nil {
+		resp.Tenants = ep.tenants.Stats()
+	}
+	if ep.cache != nil {
+		resp.Cache = ep.cache.Stats()
+	}
+	if ep.coalescer != nil {
+		resp.Coalescing = ep.coalescer.Stats()
+	}
+	if ep.apiKeys != nil {
+		resp.Auth = ep.apiKeys.Stats()
+	}
+	if ep.validator != nil {
+		resp.Validation = ep.validator.Stats()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// tenantStatsResponse is the /stats?tenant= payload: the tenant's counters
+// and its pool's stats (none for the default group).
+type tenantStatsResponse struct {
+	lib.TenantStats
+	PoolStats *lib.PoolStats `json:"pool_stats,omitempty"`
+}
+
+// handleTenantStats serves /stats?tenant=NAME: one tenant's stats, 404 for
+// an unknown tenant or without tenant routing.
+func (ep *endpoints) handleTenantStats(w http.ResponseWriter, name string) {
+	if ep.tenants == nil {
+		writeJSONError(w, http.StatusNotFound, "tenant routing is not configured")
+		return
+	}
+	s, pool, ok := ep.tenants.Tenant(name)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown tenant %q", name))
+		return
+	}
+	resp := tenantStatsResponse{TenantStats: s}
+	if pool != nil {
+		ps := pool.Stats()
+		resp.PoolStats = &ps
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleMetrics serves the pools' metrics in the Prometheus text format.
+func (ep *endpoints) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = lib.WriteMetrics(w, ep.pools, ep.metricsTimeout)
+}
+
+// parseCachePath parses a --cache-path value: "<prefix>[,public]".
+func parseCachePath(spec string) (lib.CacheRoute, error) {
+	prefix, attr, hasAttr := strings.Cut(spec, ",")
+	if !strings.HasPrefix(prefix, "/") {
+		return lib.CacheRoute{}, fmt.Errorf("cache-path %q must start with /", spec)
+	}
+	if hasAttr && attr != "public" {
+		return lib.CacheRoute{}, fmt.Errorf("cache-path %q: unknown attribute %q (only \"public\")", spec, attr)
+	}
+	return lib.CacheRoute{Prefix: prefix, Public: hasAttr}, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"go-load-balance/lib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthReportsEachPool(t *testing.T) {
+	gpu, err := lib.NewPool([]string{"http://gpu-0", "http://gpu-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu, err := lib.NewPool([]string{"http://cpu-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.GetBackends()[0].MarkUnhealthy()
+	byName := map[string]*lib.Pool{"gpu": gpu, "cpu": cpu}
+	router, err := lib.NewRouter(nil, byName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &endpoints{pools: []*lib.Pool{gpu, cpu}, poolsByName: byName, router: router}
+
+	rec := httptest.NewRecorder()
+	ep.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/health = %d, want 200 while any pool is healthy", rec.Code)
+	}
+	var body struct {
+		Status          string `json:"status"`
+		HealthyBackends int    `json:"healthy_backends"`
+		Pools           map[string]struct {
+			Status          string `json:"status"`
+			HealthyBackends int    `json:"healthy_backends"`
+		} `json:"pools"`
+		Unhealthy []lib.UnhealthyBackend `json:"unhealthy"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.HealthyBackends != 2 || body.Pools["gpu"].Status != "ok" || body.Pools["cpu"].Status != "degraded" {
+		t.Errorf("/health = %s", rec.Body)
+	}
+	if len(body.Unhealthy) != 1 || body.Unhealthy[0].URL != "http://cpu-0" || body.Unhealthy[0].Reason != "marked unhealthy" || body.Unhealthy[0].UnhealthyFor == "" {
+		t.Errorf("/health unhealthy = %+v", body.Unhealthy)
+	}
+
+	gpu.GetBackends()[0].MarkUnhealthy()
+	gpu.GetBackends()[1].MarkUnhealthy()
+	rec = httptest.NewRecorder()
+	ep.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/health = %d, want 503 with every pool down", rec.Code)
+	}
+}
+
+func TestHealthPanicMode(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0", "http://gpu-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetPanicThreshold(50)
+	for _, b := range pool.GetBackends() {
+		b.MarkUnhealthy()
+	}
+	b, err := pool.SelectBackend() // enters panic mode
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.DecrementConns()
+	ep := &endpoints{pools: []*lib.Pool{pool}}
+
+	rec := httptest.NewRecorder()
+	ep.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var body struct {
+		Status    string `json:"status"`
+		PanicMode bool   `json:"panic_mode"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || body.Status != "ok" || !body.PanicMode {
+		t.Errorf("/health = %d %s, want 200 with panic_mode while routing regardless of health", rec.Code, rec.Body)
+	}
+}
+
+func TestStatsForTenant(t *testing.T) {
+	acme, err := lib.NewPool([]string{"http://acme-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := lib.NewPool([]string{"http://shared-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*lib.Pool{"acme": acme, "shared": shared}
+	router, err := lib.NewRouter(nil, byName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := lib.NewTenantRouter(lib.TenantRoutingConfig{Tenants: map[string]lib.TenantRouteConfig{"acme": {Pool: "acme", KeyPrefixes: []string{"sk-acme-"}}}}, byName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &endpoints{pools: []*lib.Pool{acme, shared}, poolsByName: byName, router: router, tenants: tenants}
+
+	stats := func(query string) (int, map[string]any) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ep.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats"+query, nil))
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, body
+	}
+	code, body := stats("?tenant=acme")
+	if code != http.StatusOK || body["tenant"] != "acme" || body["pool"] != "acme" || body["pool_stats"] == nil {
+		t.Errorf("/stats?tenant=acme = %d %v", code, body)
+	}
+	if code, body = stats("?tenant=default"); code != http.StatusOK || body["pool_stats"] != nil {
+		t.Errorf("/stats?tenant=default = %d %v", code, body)
+	}
+	if code, _ = stats("?tenant=initech"); code != http.StatusNotFound {
+		t.Errorf("/stats?tenant=initech = %d, want 404", code)
+	}
+	if _, body = stats(""); len(body["tenants"].([]any)) != 2 {
+		t.Errorf("/stats tenants = %v", body["tenants"])
+	}
+}
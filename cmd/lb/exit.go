@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes are part of lb's interface: a process supervisor can tell a
+// failure worth restarting from one that will fail identically every time.
+const (
+	exitRuntime = 1 // fatal error while serving, or backends not ready: restart
+	exitConfig  = 2 // invalid flags or configuration: do not restart
+	exitBind    = 3 // cannot listen on the address: restart with backoff
+)
+
+// exitCodesHelp documents the exit codes in --help.
+const exitCodesHelp = `Exit codes (the last stderr line carries a matching error_class= field):
+   0  clean shutdown
+   1  runtime failure while serving, or too few ready backends with
+      --startup-timeout-exit (error_class=runtime)
+   2  invalid flags or configuration (error_class=config)
+   3  cannot bind the listen address (error_class=bind)`
+
+// exitError tags an error with its exit code and error_class.
+type exitError struct {
+	code  int
+	class string
+	err   error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func configError(err error) error {
+	return &exitError{code: exitConfig, class: "config", err: err}
+}
+
+func configErrorf(format string, args ...any) error {
+	return configError(fmt.Errorf(format, args...))
+}
+
+func bindError(err error) error {
+	return &exitError{code: exitBind, class: "bind", err: err}
+}
+
+func runtimeError(err error) error {
+	return &exitError{code: exitRuntime, class: "runtime", err: err}
+}
+
+// exitStatus maps an error returned by the command to its exit code and
+// class. Unclassified errors come from urfave/cli's flag parsing (unknown
+// flag, malformed value, missing --backends), i.e. configuration.
+func exitStatus(err error) (code int, class string) {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code, e.class
+	}
+	return exitConfig, "config"
+}
+
+// exit is the single exit path for failures: one machine-parseable line on
+// stderr, then the class's exit code.
+func exit(err error) {
+	code, class := exitStatus(err)
+	log.Printf("error_class=%s exit_code=%d error=%q", class, code, err.Error())
+	os.Exit(code)
+}
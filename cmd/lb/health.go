@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-load-balance/lib"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// healthFlags are the health checking flags, and those of waiting for the
+// backends at startup.
+type healthFlags struct {
+	interval          time.Duration
+	unhealthyInterval time.Duration
+	timeout           time.Duration
+	concurrency       int
+	jitter            float64
+	unhealthyAfter    int
+	healthyAfter      int
+	latencyWarn       time.Duration
+	latencyUnhealthy  time.Duration
+	path              string
+	check             string
+	grpcService       string
+	disableExec       bool
+	startup           lib.StartupConfig
+
+	waitReady   bool
+	minHealthy  int
+	waitTimeout time.Duration
+	exitOnWait  bool
+	prewarm     bool
+}
+
+func parseHealthFlags(cmd *cli.Command) (healthFlags, error) {
+	f := healthFlags{
+		interval:          cmd.Duration("health-check-interval"),
+		unhealthyInterval: cmd.Duration("unhealthy-check-interval"),
+		timeout:           cmd.Duration("health-check-timeout"),
+		concurrency:       cmd.Int("health-check-concurrency"),
+		jitter:            cmd.Float64("health-check-jitter"),
+		unhealthyAfter:    cmd.Int("unhealthy-threshold"),
+		healthyAfter:      cmd.Int("healthy-threshold"),
+		latencyWarn:       cmd.Duration("health-latency-warn"),
+		latencyUnhealthy:  cmd.Duration("health-latency-unhealthy"),
+		path:              cmd.String("health-path"),
+		check:             cmd.String("health-check"),
+		grpcService:       cmd.String("health-grpc-service"),
+		disableExec:       cmd.Bool("disable-exec-checks"),
+		startup: lib.StartupConfig{
+			Grace:          cmd.Duration("startup-grace"),
+			NotReadyStatus: cmd.Int("startup-not-ready-status"),
+			NotReadyBody:   cmd.String("startup-not-ready-body"),
+		},
+		waitReady:   cmd.Bool("wait-ready"),
+		minHealthy:  cmd.Int("min-healthy"),
+		waitTimeout: cmd.Duration("startup-timeout"),
+		exitOnWait:  cmd.Bool("startup-timeout-exit"),
+		prewarm:     cmd.Bool("prewarm"),
+	}
+	if f.interval < 5*time.Second {
+		return f, configErrorf("health-check-interval must be at least 5s, got %v", f.interval)
+	}
+	if f.unhealthyInterval < time.Second {
+		return f, configErrorf("unhealthy-check-interval must be at least 1s, got %v", f.unhealthyInterval)
+	}
+	// Unhealthy backends are never probed less often than healthy ones.
+	f.unhealthyInterval = min(f.unhealthyInterval, f.interval)
+
+	if f.timeout < 0 {
+		return f, configErrorf("health-check-timeout cannot be negative, got %v", f.timeout)
+	}
+	if !strings.HasPrefix(f.path, "/") {
+		return f, configErrorf("health-path must start with /, got %q", f.path)
+	}
+	switch f.check {
+	case lib.HealthCheckHTTP, lib.HealthCheckTCP, lib.HealthCheckGRPC:
+	default:
+		return f, configErrorf("health-check must be http, tcp or grpc, got %q", f.check)
+	}
+	if f.startup.Grace < 0 {
+		return f, configErrorf("startup-grace cannot be negative, got %v", f.startup.Grace)
+	}
+	if f.startup.NotReadyStatus < 100 || f.startup.NotReadyStatus > 599 {
+		return f, configErrorf("startup-not-ready-status must be an HTTP status code, got %d", f.startup.NotReadyStatus)
+	}
+
+	if f.waitReady {
+		if f.minHealthy < 1 {
+			return f, configErrorf("min-healthy must be at least 1, got %d", f.minHealthy)
+		}
+		if f.waitTimeout <= 0 {
+			return f, configErrorf("startup-timeout must be positive, got %v", f.waitTimeout)
+		}
+	} else if f.prewarm {
+		return f, configErrorf("prewarm requires --wait-ready")
+	}
+
+	if f.concurrency < 1 {
+		return f, configErrorf("health-check-concurrency must be at least 1, got %d", f.concurrency)
+	}
+	if f.jitter < 0 || f.jitter > 0.5 {
+		return f, configErrorf("health-check-jitter must be between 0 and 0.5, got %v", f.jitter)
+	}
+	if f.unhealthyAfter < 1 || f.healthyAfter < 1 {
+		return f, configErrorf("unhealthy-threshold and healthy-threshold must be at least 1, got %d and %d", f.unhealthyAfter, f.healthyAfter)
+	}
+	if f.latencyWarn < 0 || f.latencyUnhealthy < 0 {
+		return f, configErrorf("health-latency-warn and health-latency-unhealthy cannot be negative")
+	}
+	return f, nil
+}
+
+func (f healthFlags) log() {
+	switch f.check {
+	case lib.HealthCheckTCP:
+		log.Printf("Health check interval: %v (%v while unhealthy), tcp connect", f.interval, f.unhealthyInterval)
+	case lib.HealthCheckGRPC:
+		log.Printf("Health check interval: %v (%v while unhealthy), grpc service %q", f.interval, f.unhealthyInterval, f.grpcService)
+	default:
+		log.Printf("Health check interval: %v (%v while unhealthy), path %s", f.interval, f.unhealthyInterval, f.path)
+	}
+	log.Printf("Health thresholds: unhealthy after %d consecutive failures, healthy after %d passing checks", f.unhealthyAfter, f.healthyAfter)
+	switch {
+	case f.latencyWarn > 0 && f.latencyUnhealthy > 0:
+		log.Printf("Health check latency: warning over %v, failed over %v", f.latencyWarn, f.latencyUnhealthy)
+	case f.latencyWarn > 0:
+		log.Printf("Health check latency: warning over %v", f.latencyWarn)
+	case f.latencyUnhealthy > 0:
+		log.Printf("Health check latency: failed over %v", f.latencyUnhealthy)
+	}
+	if f.disableExec {
+		log.Printf("Exec health checks: disabled (check_cmd= ignored)")
+	}
+	if f.startup.Grace > 0 {
+		log.Printf("Startup grace: %v (not ready: status %d)", f.startup.Grace, f.startup.NotReadyStatus)
+	}
+	if f.waitReady {
+		then := "serve degraded"
+		if f.exitOnWait {
+			then = "exit"
+		}
+		log.Printf("Wait ready: %d healthy backend(s) per pool, timeout %v (then %s)", f.minHealthy, f.waitTimeout, then)
+	}
+}
+
+// apply sets how pool's backends are probed and judged.
+func (f healthFlags) apply(pool *lib.Pool) error {
+	if err := pool.SetHealthThresholds(f.unhealthyAfter, f.healthyAfter); err != nil {
+		return configError(err)
+	}
+	if err := pool.SetHealthPath(f.path); err != nil {
+		return configError(err)
+	}
+	if err := pool.SetHealthCheck(f.check, f.grpcService); err != nil {
+		return configError(err)
+	}
+	if f.disableExec {
+		pool.DisableExecChecks()
+	}
+	pool.SetStartup(f.startup)
+	return nil
+}
+
+// checker returns pool's health checker, sharing probes through share. It
+// is started once the pools are ready, if waiting.
+func (f healthFlags) checker(pool *lib.Pool, share *lib.ProbeShare) *lib.HealthChecker {
+	hc := lib.NewHealthChecker(pool,
+		lib.WithInterval(f.interval),
+		lib.WithUnhealthyInterval(f.unhealthyInterval),
+		lib.WithProbeTimeout(f.timeout))
+	hc.SetConcurrency(f.concurrency)
+	hc.SetJitter(f.jitter)
+	_ = hc.SetLatencyThresholds(f.latencyWarn, f.latencyUnhealthy) // validated by parseHealthFlags
+	hc.SetProbeShare(share)
+	return hc
+}
+
+// awaitBackends waits for the pools' backends before serving: connections
+// made meanwhile wait in the listen backlog. systemd is told lb is ready
+// only after the backends' first health checks: those of --wait-ready, or
+// else a single pass.
+func (f healthFlags) awaitBackends(ctx context.Context, pools []*lib.Pool, checkers []*lib.HealthChecker, sd *lib.SdNotifier) error {
+	if f.waitReady {
+		return awaitReady(ctx, pools, checkers, f.minHealthy, f.waitTimeout, f.exitOnWait, f.prewarm)
+	}
+	if sd != nil {
+		var wg sync.WaitGroup
+		for _, hc := range checkers {
+			wg.Go(func() { hc.WaitReady(ctx, 0) }) // one pass: 0 are always enough
+		}
+		wg.Wait()
+	}
+	return nil
+}
+
+// awaitReady probes each pool's backends until minHealthy of them pass or
+// timeout runs out, then either serves degraded or fails with a runtime
+// error (a restart may find the backends up), and optionally prewarms the
+// healthy backends' connections.
+func awaitReady(ctx context.Context, pools []*lib.Pool, checkers []*lib.HealthChecker, minHealthy int, timeout time.Duration, exitOnTimeout, prewarm bool) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ready := make([]int, len(pools))
+	var wg sync.WaitGroup
+	for i, hc := range checkers {
+		wg.Go(func() { ready[i] = hc.WaitReady(waitCtx, minHealthy) })
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil // shutting down
+	}
+	var short []string
+	for i, pool := range pools {
+		total := len(pool.GetBackends())
+		if ready[i] < minHealthy {
+			short = append(short, fmt.Sprintf("%s %d/%d", poolLabel(pool), ready[i], total))
+			continue
+		}
+		log.Printf("[HEALTH] %s ready: %d/%d backends healthy", poolLabel(pool), ready[i], total)
+	}
+	if len(short) > 0 {
+		err := fmt.Errorf("fewer than %d healthy backend(s) after %v: %s", minHealthy, timeout, strings.Join(short, ", "))
+		if exitOnTimeout {
+			return runtimeError(err)
+		}
+		log.Printf("[HEALTH] %v; serving degraded", err)
+	}
+	if prewarm {
+		for i, hc := range checkers {
+			log.Printf("[HEALTH] %s: prewarmed connections to %d backend(s)", poolLabel(pools[i]), hc.Prewarm(ctx))
+		}
+	}
+	return nil
+}
+
+// readyStatus is the status line sent to systemd with READY=1.
+func readyStatus(pools []*lib.Pool, listeners int) string {
+	var healthy, total int
+	for _, pool := range pools {
+		_, h, t := pool.GetStatus()
+		healthy += h
+		total += t
+	}
+	return fmt.Sprintf("serving on %d listener(s); %d/%d backends healthy", listeners, healthy, total)
+}
+
+// poolLabel names a pool in log lines.
+func poolLabel(pool *lib.Pool) string {
+	if name := pool.Name(); name != "" {
+		return "pool " + name
+	}
+	return "pool"
+}
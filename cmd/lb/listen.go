@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-load-balance/lib"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Listeners (--listen, repeatable): each spec is an address followed by
+// comma-separated attributes, e.g. "0.0.0.0:8443,tls,cert=lb.crt,key=lb.key"
+// or "127.0.0.1:8080,admin,metrics". "tls" serves HTTPS with the cert and
+// key files given. "proxy", "admin" and "metrics" choose the routes served:
+// the pools, /stats and /admin/*, and /metrics; /health goes with proxy and
+// admin. A listener naming none of them serves everything when it is the
+// only one, and only the proxy otherwise, so an added public listener never
+// exposes admin endpoints by default. Every listener shares the same pools.
+// --admin-port N adds a listener on port N serving the operational routes
+// (/health, /stats, /admin/*, /metrics) and takes them off every proxy
+// listener; --disable-inline-admin only takes them off.
+
+// listenAddr is where lb accepts connections: a TCP address, a unix
+// socket path (--listen unix:///var/run/lb.sock), or a socket systemd
+// passed (--listen systemd, or systemd:NAME for the one a .socket unit's
+// FileDescriptorName=NAME names; see lib/systemd.go).
+type listenAddr struct {
+	network, addr string
+	mode          fs.FileMode // unix socket permissions
+}
+
+// parseListen parses --listen, falling back to all interfaces on port.
+func parseListen(spec string, port int, mode string) (listenAddr, error) {
+	if spec == "" {
+		return listenAddr{network: "tcp", addr: fmt.Sprintf(":%d", port)}, nil
+	}
+	if spec == "systemd" {
+		return listenAddr{network: "systemd"}, nil
+	}
+	if name, ok := strings.CutPrefix(spec, "systemd:"); ok {
+		if name == "" || strings.ContainsAny(name, ": ") {
+			return listenAddr{}, fmt.Errorf("invalid listen address %q: want systemd or systemd:NAME", spec)
+		}
+		return listenAddr{network: "systemd", addr: name}, nil
+	}
+	if path, ok := strings.CutPrefix(spec, "unix://"); ok {
+		if !strings.HasPrefix(path, "/") {
+			return listenAddr{}, fmt.Errorf("invalid listen address %q: want unix:///path/to/socket", spec)
+		}
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0o777 {
+			return listenAddr{}, fmt.Errorf("invalid listen-mode %q: want octal permissions like 0660", mode)
+		}
+		return listenAddr{network: "unix", addr: path, mode: fs.FileMode(perm)}, nil
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		return listenAddr{}, fmt.Errorf("invalid listen address %q: want host:port, unix:///path/to/socket or systemd", spec)
+	}
+	return listenAddr{network: "tcp", addr: spec}, nil
+}
+
+// listenerRoutes are the route groups a listener serves.
+type listenerRoutes struct {
+	proxy, admin, metrics bool
+	// health serves /health; set with proxy or admin
+	health bool
+}
+
+// listener is one parsed --listen spec.
+type listener struct {
+	addr   listenAddr
+	routes listenerRoutes
+	// tls is set for ",tls" listeners
+	tls *tls.Config
+}
+
+// parseListeners parses the --listen specs, falling back to one listener
+// on port serving everything.
+func parseListeners(specs []string, port int, mode string) ([]listener, error) {
+	if len(specs) == 0 {
+		specs = []string{""}
+	}
+	listeners := make([]listener, 0, len(specs))
+	serving := false
+	for _, spec := range specs {
+		l, err := parseListener(spec, port, mode, len(specs) == 1)
+		if err != nil {
+			return nil, err
+		}
+		serving = serving || l.routes.proxy
+		listeners = append(listeners, l)
+	}
+	if !serving {
+		return nil, errors.New("no --listen serves the proxy: add proxy to one of them")
+	}
+	return listeners, nil
+}
+
+// parseListener parses one --listen spec; only says whether it is the only
+// one.
+func parseListener(spec string, port int, mode string, only bool) (listener, error) {
+	addrSpec, attrs, _ := strings.Cut(spec, ",")
+	addr, err := parseListen(addrSpec, port, mode)
+	if err != nil {
+		return listener{}, err
+	}
+	l := listener{addr: addr}
+	var useTLS bool
+	var cert, key string
+	if attrs != "" {
+		for attr := range strings.SplitSeq(attrs, ",") {
+			name, value, hasValue := strings.Cut(attr, "=")
+			switch {
+			case name == "tls" && !hasValue:
+				useTLS = true
+			case name == "cert" && value != "":
+				cert = value
+			case name == "key" && value != "":
+				key = value
+			case name == "proxy" && !hasValue:
+				l.routes.proxy = true
+			case name == "admin" && !hasValue:
+				l.routes.admin = true
+			case name == "metrics" && !hasValue:
+				l.routes.metrics = true
+			default:
+				return listener{}, fmt.Errorf("invalid listen attribute %q in %q: want tls, cert=PATH, key=PATH, proxy, admin or metrics", attr, spec)
+			}
+		}
+	}
+	if l.routes == (listenerRoutes{}) {
+		l.routes = listenerRoutes{proxy: true, admin: only, metrics: only}
+	}
+	l.routes.health = l.routes.proxy || l.routes.admin
+	switch {
+	case useTLS && (cert == "" || key == ""):
+		return listener{}, fmt.Errorf("listen %s: tls needs cert=PATH and key=PATH", addr)
+	case !useTLS && (cert != "" || key != ""):
+		return listener{}, fmt.Errorf("listen %s: cert and key need tls", addr)
+	case useTLS:
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return listener{}, fmt.Errorf("listen %s: %w", addr, err)
+		}
+		l.tls = &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+	}
+	return l, nil
+}
+
+func (l listener) String() string {
+	var routes []string
+	if l.routes.proxy {
+		routes = append(routes, "proxy")
+	}
+	if l.routes.admin {
+		routes = append(routes, "admin")
+	}
+	if l.routes.metrics {
+		routes = append(routes, "metrics")
+	}
+	scheme := "http"
+	if l.tls != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s (%s: %s)", l.addr, scheme, strings.Join(routes, ", "))
+}
+
+// withoutInlineAdmin takes the operational routes off the listeners
+// serving the proxy (--admin-port, --disable-inline-admin).
+func withoutInlineAdmin(listeners []listener) []listener {
+	for i, l := range listeners {
+		if l.routes.proxy {
+			listeners[i].routes = listenerRoutes{proxy: true}
+		}
+	}
+	return listeners
+}
+
+// adminListener is the --admin-port listener: every operational route, on
+// all interfaces.
+func adminListener(port int) listener {
+	return listener{
+		addr:   listenAddr{network: "tcp", addr: fmt.Sprintf(":%d", port)},
+		routes: listenerRoutes{admin: true, metrics: true, health: true},
+	}
+}
+
+// listenFlags are the flags of where and how lb accepts connections.
+type listenFlags struct {
+	listeners          []listener
+	guard              *adminGuard
+	pprof              bool
+	proxyProtocol      *lib.ProxyProtocol
+	proxyProtocolAllow []string
+	readHeaderTimeout  time.Duration
+	shutdownTimeout    time.Duration
+}
+
+func parseListenFlags(cmd *cli.Command) (listenFlags, error) {
+	f := listenFlags{
+		pprof:              cmd.Bool("enable-pprof"),
+		proxyProtocolAllow: cmd.StringSlice("proxy-protocol-allow"),
+		readHeaderTimeout:  cmd.Duration("read-header-timeout"),
+		shutdownTimeout:    cmd.Duration("shutdown-timeout"),
+	}
+	port := cmd.Int("port")
+	specs := cmd.StringSlice("listen")
+	adminPort := cmd.Int("admin-port")
+	guard, guardErr := parseAdminGuard(cmd.String("admin-basic-auth"), cmd.StringSlice("admin-allow-cidr"))
+
+	if port < 1 || port > 65535 {
+		return f, configErrorf("invalid port %d (must be 1-65535)", port)
+	}
+	listeners, err := parseListeners(specs, port, cmd.String("listen-mode"))
+	if err != nil {
+		return f, configError(err)
+	}
+	switch {
+	case adminPort < 0 || adminPort > 65535:
+		return f, configErrorf("invalid admin-port %d (must be 1-65535, or 0 for none)", adminPort)
+	case adminPort != 0 && adminPort == port && len(specs) == 0:
+		return f, configErrorf("admin-port %d is the proxy's port", adminPort)
+	case guardErr != nil:
+		return f, configError(guardErr)
+	}
+	if adminPort != 0 || cmd.Bool("disable-inline-admin") {
+		listeners = withoutInlineAdmin(listeners)
+	}
+	if adminPort != 0 {
+		listeners = append(listeners, adminListener(adminPort))
+	}
+	if guard != nil && !slices.ContainsFunc(listeners, func(l listener) bool { return l.routes.health || l.routes.metrics }) {
+		return f, configErrorf("admin-basic-auth and admin-allow-cidr guard nothing: no listener serves /health, /stats, /metrics or /admin/* (add --admin-port)")
+	}
+	if f.pprof && !slices.ContainsFunc(listeners, func(l listener) bool { return l.routes.admin && !l.routes.proxy }) {
+		return f, configErrorf("enable-pprof is served only on a listener without the proxy: add --admin-port or a --listen ADDR,admin")
+	}
+	f.listeners, f.guard = listeners, guard
+
+	if f.readHeaderTimeout <= 0 || f.shutdownTimeout <= 0 {
+		return f, configErrorf("read-header-timeout and shutdown-timeout must be positive")
+	}
+	if len(f.proxyProtocolAllow) > 0 && !cmd.Bool("proxy-protocol") {
+		return f, configErrorf("proxy-protocol-allow needs --proxy-protocol")
+	}
+	if cmd.Bool("proxy-protocol") {
+		if f.proxyProtocol, err = lib.NewProxyProtocol(f.proxyProtocolAllow, f.readHeaderTimeout, nil); err != nil {
+			return f, configError(err)
+		}
+	}
+	return f, nil
+}
+
+func (f listenFlags) log() {
+	for _, l := range f.listeners {
+		log.Printf("Listen: %s", l)
+	}
+	if f.guard != nil {
+		log.Printf("Admin endpoints: %s", f.guard)
+	}
+}
+
+// bind binds every listener, reading the PROXY protocol header first on
+// the proxy listeners with --proxy-protocol.
+func (f listenFlags) bind() ([]net.Listener, error) {
+	lns, err := listenAll(f.listeners)
+	if err != nil {
+		return nil, bindError(err)
+	}
+	if f.proxyProtocol == nil {
+		return lns, nil
+	}
+	for i, l := range f.listeners {
+		if l.routes.proxy {
+			lns[i] = f.proxyProtocol.Listener(lns[i])
+		}
+	}
+	if len(f.proxyProtocolAllow) > 0 {
+		log.Printf("PROXY protocol: required on the proxy listeners from %s, refused from other peers", strings.Join(f.proxyProtocolAllow, ", "))
+	} else {
+		log.Printf("PROXY protocol: required on the proxy listeners")
+	}
+	return lns, nil
+}
+
+// servers returns an HTTP server per listener, serving ep and proxy on the
+// listener's routes. No ReadTimeout/WriteTimeout: they would cap streamed
+// request and response bodies for every route alike. Requests are bounded
+// per route by the pools' request timeout instead.
+func (f listenFlags) servers(ep *endpoints, proxy http.Handler, registerAdmin func(*http.ServeMux), protocols *http.Protocols) []*http.Server {
+	servers := make([]*http.Server, len(f.listeners))
+	for i, l := range f.listeners {
+		servers[i] = &http.Server{
+			Handler:           l.routes.mux(ep, proxy, registerAdmin, f.guard),
+			ReadHeaderTimeout: f.readHeaderTimeout,
+			IdleTimeout:       serverIdleTimeout,
+			Protocols:         protocols,
+		}
+	}
+	return servers
+}
+
+// mux returns the handler of a listener serving routes: proxy serves every
+// path the others do not, registerAdmin adds the /admin/* endpoints, and
+// guard checks every path but the proxied ones — all of them on a listener
+// without the proxy. Only such a listener serves the diagnostics (see
+// diagnostics.go).
+func (r listenerRoutes) mux(ep *endpoints, proxy http.Handler, registerAdmin func(*http.ServeMux), guard *adminGuard) http.Handler {
+	ops := http.NewServeMux()
+	if r.health {
+		ops.HandleFunc("/health", ep.handleHealth)
+	}
+	if r.admin {
+		ops.HandleFunc("/stats", ep.handleStats)
+		registerAdmin(ops)
+		if ep.diagnostics != nil && !r.proxy {
+			ep.diagnostics.register(ops)
+		}
+	}
+	if r.metrics {
+		ops.HandleFunc("/metrics", ep.handleMetrics)
+	}
+	if !r.proxy {
+		return guard.wrap(ops)
+	}
+	guarded := guard.wrap(ops)
+	mux := http.NewServeMux()
+	if r.health {
+		mux.Handle("/health", guarded)
+	}
+	if r.admin {
+		mux.Handle("/stats", guarded)
+		mux.Handle("/admin/", guarded)
+	}
+	if r.metrics {
+		mux.Handle("/metrics", guarded)
+	}
+	mux.Handle("/", proxy)
+	return mux
+}
+
+// serve serves s on ln, over TLS for a tls listener.
+func (l listener) serve(s *http.Server, ln net.Listener) error {
+	if l.tls == nil {
+		return s.Serve(ln)
+	}
+	s.TLSConfig = l.tls
+	return s.ServeTLS(ln, "", "")
+}
+
+// systemdListeners returns the sockets systemd passed; a variable for
+// tests.
+var systemdListeners = lib.SystemdListeners
+
+// listenAll binds every listener, closing the ones already bound when one
+// fails. systemd listeners take the passed sockets: by name for
+// systemd:NAME, the others in order.
+func listenAll(listeners []listener) ([]net.Listener, error) {
+	lns := make([]net.Listener, len(listeners))
+	var passed []lib.SystemdListener
+	var taken []bool
+	fail := func(err error) ([]net.Listener, error) {
+		for _, bound := range lns {
+			if bound != nil {
+				bound.Close()
+			}
+		}
+		for i, p := range passed {
+			if !taken[i] {
+				p.Close()
+			}
+		}
+		return nil, err
+	}
+	if slices.ContainsFunc(listeners, func(l listener) bool { return l.addr.network == "systemd" }) {
+		var err error
+		if passed, err = systemdListeners(); err != nil {
+			return nil, fmt.Errorf("listen systemd: %w", err)
+		}
+		taken = make([]bool, len(passed))
+	}
+	take := func(a listenAddr) (net.Listener, error) {
+		for i, p := range passed {
+			if !taken[i] && (a.addr == "" || p.Name == a.addr) {
+				taken[i] = true
+				return p.Listener, nil
+			}
+		}
+		if a.addr != "" {
+			return nil, fmt.Errorf("listen %s: systemd passed no socket named %q", a, a.addr)
+		}
+		return nil, fmt.Errorf("listen %s: more --listen systemd than the %d socket(s) systemd passed", a, len(passed))
+	}
+	// Named sockets first, so an unnamed listener cannot take one.
+	for _, named := range []bool{true, false} {
+		for i, l := range listeners {
+			if l.addr.network != "systemd" || (l.addr.addr != "") != named {
+				continue
+			}
+			ln, err := take(l.addr)
+			if err != nil {
+				return fail(err)
+			}
+			lns[i] = ln
+		}
+	}
+	for i, p := range passed {
+		if !taken[i] {
+			log.Printf("[SYSTEMD] closing unused socket %s (%q)", p.Addr(), p.Name)
+			p.Close()
+		}
+	}
+	for i, l := range listeners {
+		if lns[i] != nil {
+			continue
+		}
+		ln, err := l.addr.listen()
+		if err != nil {
+			return fail(err)
+		}
+		lns[i] = ln
+	}
+	return lns, nil
+}
+
+func (a listenAddr) String() string {
+	switch {
+	case a.network == "unix":
+		return "unix://" + a.addr
+	case a.network == "systemd" && a.addr != "":
+		return "systemd:" + a.addr
+	case a.network == "systemd":
+		return "systemd"
+	}
+	return a.addr
+}
+
+// staleSocketDialTimeout bounds the probe of an existing socket file.
+const staleSocketDialTimeout = time.Second
+
+// listen binds a. A unix socket file left by a previous run is removed
+// first, unless a live server still accepts on it; any other file at the
+// path is left alone and fails the bind. The socket is removed again when
+// the listener closes.
+func (a listenAddr) listen() (net.Listener, error) {
+	if a.network != "unix" {
+		return net.Listen(a.network, a.addr)
+	}
+	if fi, err := os.Lstat(a.addr); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen %s: file exists and is not a socket", a)
+		}
+		if conn, err := net.DialTimeout("unix", a.addr, staleSocketDialTimeout); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen %s: address already in use", a)
+		}
+		if err := os.Remove(a.addr); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("listen %s: removing stale socket: %w", a, err)
+		}
+	}
+	ln, err := net.Listen("unix", a.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(a.addr, a.mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("listen %s: %w", a, err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-load-balance/lib"
+)
+
+// socketDir returns a directory short enough for unix socket paths.
+func socketDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestParseListen(t *testing.T) {
+	for _, tc := range []struct {
+		spec, mode string
+		want       listenAddr
+	}{
+		{"", "0660", listenAddr{network: "tcp", addr: ":8080"}},
+		{"127.0.0.1:9000", "0660", listenAddr{network: "tcp", addr: "127.0.0.1:9000"}},
+		{"unix:///run/lb.sock", "0600", listenAddr{network: "unix", addr: "/run/lb.sock", mode: 0o600}},
+		{"systemd", "0660", listenAddr{network: "systemd"}},
+		{"systemd:admin", "0660", listenAddr{network: "systemd", addr: "admin"}},
+	} {
+		got, err := parseListen(tc.spec, 8080, tc.mode)
+		if err != nil || got != tc.want {
+			t.Errorf("parseListen(%q, %q) = %+v, %v; want %+v", tc.spec, tc.mode, got, err, tc.want)
+		}
+	}
+	for _, spec := range []string{"8080", "unix://run/lb.sock", "systemd:", "systemd:a:b"} {
+		if _, err := parseListen(spec, 8080, "0660"); err == nil {
+			t.Errorf("parseListen(%q) accepted", spec)
+		}
+	}
+	if _, err := parseListen("unix:///run/lb.sock", 8080, "rw"); err == nil {
+		t.Error("non-octal listen-mode accepted")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(socketDir(t), "lb.sock")
+	addr := listenAddr{network: "unix", addr: path, mode: 0o600}
+
+	// A socket file nobody listens on any more is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := addr.listen()
+	if err != nil {
+		t.Fatalf("over a stale socket: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) { return net.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://lb/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// A live one is not.
+	if _, err := addr.listen(); err == nil {
+		t.Error("bound over a live socket")
+	}
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind on close: %v", err)
+	}
+
+	// Nor is anything else.
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addr.listen(); err == nil {
+		t.Error("bound over a regular file")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode()&fs.ModeSocket != 0 {
+		t.Errorf("regular file replaced: %v", err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key,
+// returning their paths.
+func writeTestCert(t *testing.T) (cert, key string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lb test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cert, key = filepath.Join(dir, "lb.crt"), filepath.Join(dir, "lb.key")
+	if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestParseListeners(t *testing.T) {
+	all := listenerRoutes{proxy: true, admin: true, metrics: true, health: true}
+	ls, err := parseListeners(nil, 8080, "0660")
+	if err != nil || len(ls) != 1 || ls[0].addr.addr != ":8080" || ls[0].routes != all {
+		t.Errorf("default listener = %+v, %v", ls, err)
+	}
+	ls, err = parseListeners([]string{"127.0.0.1:9000"}, 8080, "0660")
+	if err != nil || ls[0].routes != all {
+		t.Errorf("a single listener serves everything: %+v, %v", ls, err)
+	}
+
+	cert, key := writeTestCert(t)
+	ls, err = parseListeners([]string{"0.0.0.0:8443,tls,cert=" + cert + ",key=" + key, "127.0.0.1:8080,admin,metrics"}, 8080, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls[0].tls == nil || ls[0].routes != (listenerRoutes{proxy: true, health: true}) {
+		t.Errorf("public listener = %v", ls[0])
+	}
+	if ls[1].tls != nil || ls[1].routes != (listenerRoutes{admin: true, metrics: true, health: true}) {
+		t.Errorf("internal listener = %v", ls[1])
+	}
+	if got := ls[1].String(); got != "127.0.0.1:8080 (http: admin, metrics)" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for _, specs := range [][]string{
+		{"127.0.0.1:8080,admin"},
+		{"127.0.0.1:8080,metrics", "127.0.0.1:8081,admin"},
+		{"127.0.0.1:8443,tls"},
+		{"127.0.0.1:8443,tls,cert=" + cert},
+		{"127.0.0.1:8443,cert=" + cert + ",key=" + key},
+		{"127.0.0.1:8443,tls,cert=" + key + ",key=" + key},
+		{"127.0.0.1:8080,public"},
+		{"127.0.0.1:8080,admin=yes"},
+		{"8080,admin"},
+	} {
+		if _, err := parseListeners(specs, 8080, "0660"); err == nil {
+			t.Errorf("parseListeners(%q) accepted", specs)
+		}
+	}
+}
+
+func TestListenersRestrictRoutes(t *testing.T) {
+	pool, err := lib.NewPool([]string{"http://gpu-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &endpoints{pools: []*lib.Pool{pool}, poolsByName: map[string]*lib.Pool{"default": pool}}
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot) // stands in for the pools
+	})
+	registerAdmin := func(mux *http.ServeMux) { registerBackendAdmin(mux, []*lib.Pool{pool}) }
+	public := httptest.NewServer(listenerRoutes{proxy: true, health: true}.mux(ep, proxy, registerAdmin, nil))
+	defer public.Close()
+	internal := httptest.NewServer(listenerRoutes{admin: true, metrics: true, health: true}.mux(ep, proxy, registerAdmin, nil))
+	defer internal.Close()
+
+	status := func(method, u string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, u, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	drain := "/admin/backends/" + url.PathEscape("http://gpu-0") + "/drain"
+	for _, tc := range []struct {
+		srv          *httptest.Server
+		method, path string
+		want         int
+	}{
+		{public, "GET", "/v1/models", http.StatusTeapot},
+		{public, "GET", "/health", http.StatusOK},
+		{public, "GET", "/stats", http.StatusTeapot},
+		{public, "GET", "/metrics", http.StatusTeapot},
+		{public, "POST", drain, http.StatusTeapot},
+		{internal, "GET", "/v1/models", http.StatusNotFound},
+		{internal, "GET", "/health", http.StatusOK},
+		{internal, "GET", "/stats", http.StatusOK},
+		{internal, "GET", "/metrics", http.StatusOK},
+		{internal, "POST", drain, http.StatusOK},
+	} {
+		if got := status(tc.method, tc.srv.URL+tc.path); got != tc.want {
+			name := "public"
+			if tc.srv == internal {
+				name = "internal"
+			}
+			t.Errorf("%s %s on the %s listener = %d, want %d", tc.method, tc.path, name, got, tc.want)
+		}
+	}
+	if !pool.GetBackends()[0].Drained() {
+		t.Error("drain through the admin listener did not apply")
+	}
+}
+
+func TestListenerServesTLS(t *testing.T) {
+	cert, key := writeTestCert(t)
+	ls, err := parseListeners([]string{"127.0.0.1:0,tls,cert=" + cert + ",key=" + key}, 8080, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns, err := listenAll(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	})}
+	go ls[0].serve(srv, lns[0])
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}} // #nosec G402 -- self-signed test certificate
+	resp, err := client.Get("https://" + lns[0].Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.TLS == nil {
+		t.Error("served without TLS")
+	}
+
+	// One listener that cannot bind fails them all.
+	taken := lns[0].Addr().String()
+	free, err := parseListeners([]string{"127.0.0.1:0", taken}, 8080, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAll(free); err == nil {
+		t.Error("bound an address in use")
+	}
+}
+
+func TestListenSystemd(t *testing.T) {
+	// passSockets stubs the sockets systemd passes, named by names.
+	passSockets := func(names ...string) []lib.SystemdListener {
+		passed := make([]lib.SystemdListener, len(names))
+		for i, name := range names {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			passed[i] = lib.SystemdListener{Listener: ln, Name: name}
+		}
+		systemdListeners = func() ([]lib.SystemdListener, error) { return passed, nil }
+		return passed
+	}
+	defer func() { systemdListeners = lib.SystemdListeners }()
+	accepting := func(addr string) bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}
+
+	passed := passSockets("proxy", "admin", "spare")
+	ls, err := parseListeners([]string{"systemd", "systemd:admin,admin", "127.0.0.1:0,metrics"}, 8080, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns, err := listenAll(ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// systemd:admin took its socket by name, systemd the first one left.
+	if lns[0] != passed[0].Listener || lns[1] != passed[1].Listener || lns[2] == nil {
+		t.Errorf("listeners %v, passed %v", lns, passed)
+	}
+	if ls[1].String() != "systemd:admin (http: admin)" {
+		t.Errorf("listener %s", ls[1])
+	}
+	if accepting(passed[2].Addr().String()) {
+		t.Error("unused passed socket left open")
+	}
+	for _, ln := range lns {
+		ln.Close()
+	}
+
+	for name, specs := range map[string][]string{
+		"unknown name":    {"systemd:metrics"},
+		"too few sockets": {"systemd", "systemd,admin", "systemd,metrics"},
+	} {
+		passed := passSockets("proxy", "admin")
+		ls, err := parseListeners(specs, 8080, "0660")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := listenAll(ls); err == nil {
+			t.Errorf("%s: bound", name)
+		}
+		for _, p := range passed {
+			if accepting(p.Addr().String()) {
+				t.Errorf("%s: passed socket %s left open after the failure", name, p.Name)
+			}
+		}
+	}
+
+	systemdListeners = func() ([]lib.SystemdListener, error) { return nil, lib.ErrNotSocketActivated }
+	ls, _ = parseListeners([]string{"systemd"}, 8080, "0660")
+	if _, err := listenAll(ls); !errors.Is(err, lib.ErrNotSocketActivated) {
+		t.Errorf("not activated: %v", err)
+	}
+}
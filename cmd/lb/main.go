@@ -2,14 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"go-load-balance/lib"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,36 +20,238 @@ import (
 // version is stamped by goreleaser via -ldflags "-X main.version=..."
 var version = "dev"
 
+// defaultPoolName names the --backends pool when a config file adds more.
+const defaultPoolName = "default"
+
+// serverIdleTimeout closes idle client keep-alive connections; without a
+// ReadTimeout the server would otherwise keep them forever.
+const serverIdleTimeout = 2 * time.Minute
+
+// usageText is the synopsis in --help; the options are listed below it.
+const usageText = `lb --backends <url>[,key=value...] [--backends <url> ...] [options]
+lb --config <path> [options]
+lb [options] <url> ...
+lb validate [options] [url ...]
+lb bench [options] <url>
+
+Backend attributes: priority, timeout, check, check_cmd, health, max_conns,
+upstream_key, prefix, max_mbps, family, proxy, send_proxy, decorator and
+labels (any other key=value).`
+
 func main() {
-	app := &cli.Command{
-		Name:      "lb",
-		Usage:     "A simple load balancer",
-		Version:   version,
-		UsageText: "lb --backends <url1> [--backends <url2> ...] [--port <port>] [--timeout <duration>] [--health-check-interval <duration>] [--routing <mode>] [--max-conns <n>] [--affinity-ttl <duration>] [--log-to <path>] [--verbose]",
+	if err := newApp().Run(context.Background(), os.Args); err != nil {
+		exit(err)
+	}
+}
+
+func newApp() *cli.Command {
+	return &cli.Command{
+		Name:        "lb",
+		Usage:       "A simple load balancer",
+		Version:     version,
+		Description: exitCodesHelp,
+		UsageText:   usageText,
 		Flags: []cli.Flag{
 			&cli.StringSliceFlag{
-				Name:     "backends",
-				Usage:    "Backend URLs (required)",
-				Required: true,
+				Name:  "backends",
+				Usage: "Backend URLs, each optionally suffixed \",priority=N\" to use it only when every lower-numbered tier is down or at --max-conns, \",timeout=D\" to bound each request's time at it, \",max_mbps=N\" to skip it while its responses exceed N megabits per second, \",family=ipv4|ipv6\" to dial it over one address family only, \",proxy=URL\" to reach it through a forward proxy, \",send_proxy=v1|v2\" to open its connections with a PROXY protocol header naming the client, and \",key=value\" labels such as zone=us-east-1a; dns+http://name:port discovers one backend per address the name resolves to (required unless --config defines pools)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "backends-source",
+				Usage: "Backend sources to read, comma-separated: flag (--backends), args (positional), env ($LB_BACKENDS), config, discovery (dns+ backends); default all",
+			},
+			&cli.DurationFlag{
+				Name:  "dns-refresh",
+				Usage: "How often dns+ backends are re-resolved",
+				Value: 30 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "JSON config file with named pools and path routes (see README)",
 			},
 			&cli.IntFlag{
 				Name:  "port",
 				Usage: "Port to listen on",
 				Value: 8080,
 			},
+			&cli.StringSliceFlag{
+				Name:  "listen",
+				Usage: "Address to listen on instead of --port: host:port, unix:///path/to/socket (a stale socket file is replaced), or systemd[:NAME] for a socket-activated one, with attributes ,tls,cert=PATH,key=PATH and the routes served ,proxy ,admin ,metrics (repeatable; see README)",
+			},
+			&cli.StringFlag{
+				Name:  "listen-mode",
+				Usage: "Permissions of --listen unix sockets, in octal",
+				Value: "0660",
+			},
+			&cli.IntFlag{
+				Name:  "admin-port",
+				Usage: "Serve /health, /stats, /metrics and /admin/* on this port only, taking them off the proxy listeners (0 = serve them as --listen says)",
+			},
+			&cli.StringFlag{
+				Name:  "admin-basic-auth",
+				Usage: "Answer 401 to requests to /health, /stats, /metrics and /admin/* without these basic auth credentials, as user:password; the proxy never asks",
+			},
+			&cli.StringSliceFlag{
+				Name:  "admin-allow-cidr",
+				Usage: "Answer 403 to requests to /health, /stats, /metrics and /admin/* from peers outside this CIDR or address, IPv4 or IPv6 (repeatable; checked before --admin-basic-auth)",
+			},
+			&cli.BoolFlag{
+				Name:  "disable-inline-admin",
+				Usage: "Take /health, /stats, /metrics and /admin/* off the listeners serving the proxy (implied by --admin-port)",
+			},
+			&cli.BoolFlag{
+				Name:  "enable-pprof",
+				Usage: "Serve net/http/pprof under /debug/pprof/ and GET /admin/runtime (goroutines, heap, GC pauses, open files, backend connections), only on the listeners without the proxy (needs --admin-port or a --listen ADDR,admin)",
+			},
+			&cli.BoolFlag{
+				Name:  "proxy-protocol",
+				Usage: "Read a PROXY protocol v1 or v2 header on every connection to the listeners serving the proxy and take the client's address from it; connections without a valid one are closed",
+			},
+			&cli.StringSliceFlag{
+				Name:  "proxy-protocol-allow",
+				Usage: "Only peers in this CIDR or address may send a PROXY header, and must; others are served with their own address (repeatable; needs --proxy-protocol)",
+			},
 			&cli.DurationFlag{
-				Name:  "timeout",
-				Usage: "Request timeout duration (e.g. 500ms, 30s, 5m, 2h, 1h30m)",
-				Value: 4 * time.Hour,
+				Name:    "request-timeout",
+				Aliases: []string{"timeout"},
+				Usage:   "Per-request timeout, overridable per route in --config; over it the client gets 504 (e.g. 500ms, 30s, 5m, 2h, 1h30m; 0 = none)",
+				Value:   4 * time.Hour,
+			},
+			&cli.StringFlag{
+				Name:  "deadline-header",
+				Usage: "Send each proxied request's remaining time in ms to the backend in this header, e.g. X-Request-Deadline-Ms (off when unset)",
+			},
+			&cli.StringFlag{
+				Name:  "error-format",
+				Usage: "Body of lb's own error responses: openai (JSON the OpenAI SDKs parse) or plain (text)",
+				Value: string(lib.ErrorFormatOpenAI),
+			},
+			&cli.DurationFlag{
+				Name:  "read-header-timeout",
+				Usage: "Max time for a client to send the request headers (slowloris protection)",
+				Value: 10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Usage: "Max time to drain in-flight requests on SIGINT/SIGTERM",
+				Value: 10 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "drain-timeout",
+				Usage: "Max time requests in flight on a backend replaced through PUT /admin/backends/{id} may run before they are cut off (0 = no limit)",
+				Value: 5 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:  "max-request-age",
+				Usage: "Cut off a request that has been at its backend this long, closing the backend connection and answering 504, so hung backends cannot hold requests until --request-timeout; list them at GET /admin/inflight-requests (0 = off)",
+			},
+			&cli.StringFlag{
+				Name:  "drain-signal-header",
+				Usage: "Drain a backend whose response carries this header (any value but false or 0), e.g. X-Backend-Draining, until a health check passes without it (off when unset)",
 			},
 			&cli.DurationFlag{
 				Name:  "health-check-interval",
-				Usage: "Health check interval (e.g. 500ms, 30s, 5m, 2h, 1h30m)",
+				Usage: "Health check interval of healthy backends (e.g. 500ms, 30s, 5m, 2h, 1h30m)",
 				Value: 30 * time.Second,
 			},
+			&cli.DurationFlag{
+				Name:  "unhealthy-check-interval",
+				Usage: "Health check interval of unhealthy backends, for noticing recovery (at most --health-check-interval)",
+				Value: lib.DefaultUnhealthyCheckInterval,
+			},
+			&cli.DurationFlag{
+				Name:  "health-check-timeout",
+				Usage: "Health probe timeout (0 = derived from the interval: interval - 0.5s, clamped to 4.5s-10s)",
+			},
+			&cli.IntFlag{
+				Name:  "health-check-concurrency",
+				Usage: "Max backends probed at once per pool",
+				Value: 10,
+			},
+			&cli.IntFlag{
+				Name:  "unhealthy-threshold",
+				Usage: "Consecutive failures (failed health checks, and proxy errors and 5xx responses) that mark a backend unhealthy; any success in between clears them",
+				Value: lib.DefaultUnhealthyThreshold,
+			},
+			&cli.IntFlag{
+				Name:  "healthy-threshold",
+				Usage: "Consecutive passing health checks that bring an unhealthy backend back",
+				Value: lib.DefaultHealthyThreshold,
+			},
+			&cli.DurationFlag{
+				Name:  "health-latency-warn",
+				Usage: "Log and count a health check that passes but takes longer than this (0 = off)",
+			},
+			&cli.DurationFlag{
+				Name:  "health-latency-unhealthy",
+				Usage: "Count a health check that passes but takes longer than this as failed, so --unhealthy-threshold slow checks in a row mark the backend unhealthy (0 = off)",
+			},
+			&cli.FloatFlag{
+				Name:  "health-check-jitter",
+				Usage: "Vary each backend's probe interval randomly by up to this fraction (0-0.5) and spread the first probes over an interval, so probes from one or many lbs do not arrive in bursts (0 = probe every backend at once, on the interval)",
+				Value: 0.1,
+			},
+			&cli.StringFlag{
+				Name:  "strip-prefix",
+				Usage: "Remove this leading path (at a segment boundary) from requests before proxying them; a backend suffixed \",prefix=PATH\" gets PATH prepended",
+			},
+			&cli.StringFlag{
+				Name:  "health-path",
+				Usage: "Path probed under each backend's URL; a backend suffixed \",health=URL\" is probed there instead",
+				Value: lib.DefaultHealthPath,
+			},
+			&cli.StringFlag{
+				Name:  "health-check",
+				Usage: "Probe kind: http (GET the health path), tcp (connect only) or grpc (grpc.health.v1.Health/Check); a backend suffixed \",check=KIND\" overrides it",
+				Value: lib.HealthCheckHTTP,
+			},
+			&cli.StringFlag{
+				Name:  "health-grpc-service",
+				Usage: "Service name grpc probes ask about (\"\" = the server as a whole)",
+			},
+			&cli.BoolFlag{
+				Name:  "disable-exec-checks",
+				Usage: "Never run config file backends' check_cmd= health check commands: ignore check_cmd=, and probe check=exec backends with --health-check",
+			},
+			&cli.DurationFlag{
+				Name:  "startup-grace",
+				Usage: "How long after being added a backend may answer health checks as not ready (loading weights) while shown as starting, with quiet logs and no ejection penalties (0 = off)",
+				Value: 15 * time.Minute,
+			},
+			&cli.IntFlag{
+				Name:  "startup-not-ready-status",
+				Usage: "Startup grace: health check status that means the backend is still starting",
+				Value: http.StatusServiceUnavailable,
+			},
+			&cli.StringFlag{
+				Name:  "startup-not-ready-body",
+				Usage: "Startup grace: a failed health check whose body contains this also means still starting",
+			},
+			&cli.BoolFlag{
+				Name:  "wait-ready",
+				Usage: "Probe all backends before serving, and serve only once --min-healthy of each pool's have passed",
+			},
+			&cli.IntFlag{
+				Name:  "min-healthy",
+				Usage: "Wait ready: backends per pool that must pass a health check",
+				Value: 1,
+			},
+			&cli.DurationFlag{
+				Name:  "startup-timeout",
+				Usage: "Wait ready: how long to wait before serving degraded (or exiting, with --startup-timeout-exit)",
+				Value: 2 * time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:  "startup-timeout-exit",
+				Usage: "Wait ready: exit non-zero instead of serving degraded when --startup-timeout passes",
+			},
+			&cli.BoolFlag{
+				Name:  "prewarm",
+				Usage: "Wait ready: open a keep-alive connection to each healthy backend before serving",
+			},
 			&cli.StringFlag{
 				Name:  "routing",
-				Usage: "Routing mode: least-conn or cache-aware (prefix-affinity routing for KV cache reuse)",
+				Usage: "Routing mode: least-conn, cache-aware (prefix-affinity routing for KV cache reuse), least-tokens (by reported usage tokens/sec), prefix-hash (consistent hash of the prompt's start), least-reported-load (by the load backends report in health responses) or outstanding-bytes (by response bytes still in flight)",
 				Value: "least-conn",
 			},
 			&cli.IntFlag{
@@ -56,180 +259,875 @@ func main() {
 				Usage: "Hard limit on concurrent requests per backend, 0 = unlimited (required > 0 for cache-aware routing)",
 				Value: 0,
 			},
+			&cli.IntFlag{
+				Name:  "queue-size",
+				Usage: "At --max-conns, queue up to this many requests for a free slot instead of rejecting them with 429 (0 = no queue)",
+			},
+			&cli.DurationFlag{
+				Name:  "queue-timeout",
+				Usage: "Longest a queued request waits for a slot before getting 429",
+				Value: 30 * time.Second,
+			},
+			&cli.StringSliceFlag{
+				Name:  "queue-progress-path",
+				Usage: "Send keepalives (SSE comments, or whitespace for JSON) to requests queued under this path prefix; commits the status to 200 early (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "queue-tenant-header",
+				Usage: "Queue each tenant (this header's value) separately and hand freed slots to tenants in turn, so every waiting tenant gets an equal share (requires --queue-size)",
+			},
+			&cli.IntFlag{
+				Name:  "queue-tenant-size",
+				Usage: "With --queue-tenant-header, queue at most this many requests per tenant and answer the rest 429 (0 = only --queue-size)",
+			},
+			&cli.StringFlag{
+				Name:  "priority-header",
+				Usage: "Request header claiming a priority, high, normal (default) or low, e.g. X-Request-Priority: queued requests are dispatched by priority and load is shed low first",
+			},
+			&cli.StringSliceFlag{
+				Name:  "priority-high-allow",
+				Usage: "With --priority-header, clients allowed to claim high: an address, a CIDR or an API key hash sha256:<12 hex>; others' claims count as normal (repeatable; default: anyone)",
+			},
+			&cli.DurationFlag{
+				Name:  "priority-promote-after",
+				Usage: "With --priority-header, a request queued this long competes as high, so lower priorities are not starved (0 = never)",
+				Value: 10 * time.Second,
+			},
 			&cli.DurationFlag{
 				Name:  "affinity-ttl",
 				Usage: "Cache-aware routing: sliding lifetime of prefix-affinity entries",
 				Value: time.Hour,
 			},
+			&cli.StringSliceFlag{
+				Name:  "prefix-hash-field",
+				Usage: "Prefix-hash routing: JSON field path whose text is hashed, e.g. messages[0].content; the first present is used (repeatable)",
+				Value: slices.Clone(lib.DefaultPrefixHashFields),
+			},
+			&cli.IntFlag{
+				Name:  "prefix-hash-bytes",
+				Usage: "Prefix-hash routing: bytes of the field's text hashed",
+				Value: lib.DefaultPrefixHashBytes,
+			},
+			&cli.Int64Flag{
+				Name:  "prefix-hash-max-body",
+				Usage: "Prefix-hash routing: largest request body read for its key; larger ones are routed least-conn",
+				Value: lib.DefaultPrefixHashMaxBody,
+			},
+			&cli.StringFlag{
+				Name:  "reported-load-pointer",
+				Usage: "Least-reported-load routing: JSON pointer (RFC 6901) of the load in health check responses",
+				Value: lib.DefaultReportedLoadPointer,
+			},
+			&cli.IntFlag{
+				Name:  "max-inflight",
+				Usage: "Shed proxied requests with 503 while this many are in flight across all pools (0 = unlimited); health, metrics and admin are never shed",
+			},
+			&cli.IntFlag{
+				Name:  "shed-goroutines",
+				Usage: "Shed a share of new proxied requests with 503 once lb runs more goroutines than this, all of them at twice it (0 = off)",
+			},
+			&cli.IntFlag{
+				Name:  "max-inflight-per-client",
+				Usage: "Reject a client's requests with 429 while it has this many in flight (0 = unlimited); usage at GET /admin/inflight",
+			},
+			&cli.StringFlag{
+				Name:  "concurrency-key",
+				Usage: "Max inflight per client: header identifying the client, e.g. Authorization or X-Api-Key (default and fallback: client IP)",
+			},
+			&cli.BoolFlag{
+				Name:  "validate-requests",
+				Usage: "Answer 400 to POSTs to /v1/completions and /v1/chat/completions that are not JSON objects with a model and prompt or messages, before selecting a backend",
+			},
+			&cli.IntFlag{
+				Name:  "validate-max-body",
+				Usage: "Request validation: larger bodies are proxied unvalidated",
+				Value: lib.DefaultValidateMaxBody,
+			},
+			&cli.StringSliceFlag{
+				Name:  "allowed-models",
+				Usage: "Request validation: answer 400 to requests for any other model (repeatable or comma-separated)",
+			},
+			&cli.StringFlag{
+				Name:  "api-keys-file",
+				Usage: "Answer 401 to requests without an Authorization: Bearer key listed in this file (one per line; re-read when it changes and on SIGHUP); a backend's \",upstream_key=KEY\" replaces the client's key on its requests",
+			},
 			&cli.StringFlag{
 				Name:  "log-to",
 				Usage: "Append each request/response pair as one JSON object per line (JSONL) to this file",
 			},
+			&cli.DurationFlag{
+				Name:  "slow-request-threshold",
+				Usage: "Log a [SLOW] line for each request taking longer than this, arrival to end of response, with its method, path, backend and status (0 = off)",
+			},
+			&cli.BoolFlag{
+				Name:  "hash-client-ids",
+				Usage: "Record client IPs, API keys and the request \"user\" field in the --log-to file only as salted HMAC hashes",
+			},
+			&cli.DurationFlag{
+				Name:  "hash-salt-rotation",
+				Usage: "How often the --hash-client-ids salt is replaced (periods aligned to UTC)",
+				Value: 24 * time.Hour,
+			},
+			&cli.BoolFlag{
+				Name:  "debug-headers",
+				Usage: "Add X-LB-Backend, X-LB-Strategy and X-LB-Duration-Ms to every response and serve the last routing decisions at GET /admin/last-requests",
+			},
+			&cli.IntFlag{
+				Name:  "debug-last-requests",
+				Usage: "Debug headers: routing decisions kept for /admin/last-requests",
+				Value: 100,
+			},
+			&cli.BoolFlag{
+				Name:  "load-hints",
+				Usage: "Add load headers to every response for clients with adaptive concurrency — X-LB-Healthy-Backends (backends in rotation), X-LB-Total-Inflight (requests on them) and X-LB-Load-Factor (in-flight over their connection caps, 0-1; 1 with none in rotation, absent when any is uncapped) — and give 429s and 503s for lack of capacity a Retry-After of the expected wait for a slot (queue depth and recent average service time, 1-60s) instead of 1; values refresh every 250ms",
+			},
+			&cli.BoolFlag{
+				Name:  "compress",
+				Usage: "Gzip responses for clients that accept it when of a --compress-types type and at least --compress-min-bytes long; never server-sent events or responses already encoded",
+			},
+			&cli.IntFlag{
+				Name:  "compress-min-bytes",
+				Usage: "Compression: the smallest response compressed; a streamed response flushed before this many bytes goes out as is",
+				Value: lib.DefaultCompressMinBytes,
+			},
+			&cli.StringSliceFlag{
+				Name:  "compress-types",
+				Usage: "Compression: media types compressed, \"text/*\" for a whole type (default " + strings.Join(lib.DefaultCompressTypes, ", ") + ")",
+			},
+			&cli.BoolFlag{
+				Name:  "force-decompress",
+				Usage: "Decompress gzipped backend responses for clients whose Accept-Encoding does not take gzip",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cors-allow-origins",
+				Usage: "CORS: origins allowed to call lb from a browser, e.g. https://app.example.com, https://*.example.com or * (repeatable); preflights are answered by lb (or \"cors\" in --config)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cors-allow-methods",
+				Usage: "CORS: methods a preflight may request (repeatable; default " + strings.Join(lib.DefaultCORSMethods, ", ") + ")",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cors-allow-headers",
+				Usage: "CORS: request headers a preflight may request, * for any (repeatable; default " + strings.Join(lib.DefaultCORSHeaders, ", ") + ")",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cors-expose-headers",
+				Usage: "CORS: response headers scripts may read besides the safelisted ones (repeatable)",
+			},
+			&cli.DurationFlag{
+				Name:  "cors-max-age",
+				Usage: "CORS: how long browsers may cache a preflight answer (0 = the browser's default)",
+			},
+			&cli.BoolFlag{
+				Name:  "cors-allow-credentials",
+				Usage: "CORS: allow cookies and HTTP auth on cross-origin requests (not with * origins or headers)",
+			},
+			&cli.DurationFlag{
+				Name:  "connect-timeout",
+				Usage: "Timeout for dialing a backend, separate from the request timeout (0 = none)",
+				Value: lib.DefaultTransportConfig().ConnectTimeout,
+			},
+			&cli.DurationFlag{
+				Name:  "idle-conn-timeout",
+				Usage: "Close idle backend connections after this long; keep below the backends' keep-alive (vLLM: 5s)",
+				Value: lib.DefaultTransportConfig().IdleConnTimeout,
+			},
+			&cli.DurationFlag{
+				Name:  "backend-conn-max-lifetime",
+				Usage: "Retire backend connections this long after they were dialed, at their next use or while parked (0 = never)",
+			},
+			&cli.DurationFlag{
+				Name:  "backend-conn-max-idle",
+				Usage: "Retire backend connections idle this long, e.g. below a NAT's idle timeout when --idle-conn-timeout is raised (0 = never)",
+			},
+			&cli.IntFlag{
+				Name:  "max-idle-conns-per-host",
+				Usage: "Idle connections kept open per backend for reuse",
+				Value: lib.DefaultTransportConfig().MaxIdleConnsPerHost,
+			},
+			&cli.DurationFlag{
+				Name:  "response-header-timeout",
+				Usage: "Max wait for backend response headers, 0 = none (long prefills before the first streamed token are normal)",
+				Value: lib.DefaultTransportConfig().ResponseHeaderTimeout,
+			},
+			&cli.StringFlag{
+				Name:  "backend-proxy",
+				Usage: "Forward proxy to reach backends through: http://, https:// or socks5://[user:pass@]host:port (a backend's proxy= overrides it; default: HTTP_PROXY and friends)",
+			},
+			&cli.DurationFlag{
+				Name:  "keep-alive",
+				Usage: "TCP keep-alive probe period for backend connections (0 = system default)",
+				Value: lib.DefaultTransportConfig().KeepAlive,
+			},
+			&cli.Int64Flag{
+				Name:  "max-request-body",
+				Usage: "Reject request bodies larger than this many bytes with 413 (0 = unlimited)",
+			},
+			&cli.Int64Flag{
+				Name:  "max-response-body",
+				Usage: "Reject backend responses larger than this many bytes with 502; streamed responses are cut off at the limit (0 = unlimited)",
+			},
+			&cli.Int64Flag{
+				Name:  "replay-buffer-bytes",
+				Usage: "Body replay: bytes of each request body recorded in memory; the rest goes to a temp file",
+				Value: lib.DefaultReplayMemoryBytes,
+			},
+			&cli.Int64Flag{
+				Name:  "replay-max-bytes",
+				Usage: "Record request bodies up to this many bytes so a request whose reused backend connection closed can be resent; larger bodies stream unreplayable (0 = off)",
+				Value: lib.DefaultReplayMaxBytes,
+			},
+			&cli.StringFlag{
+				Name:  "replay-temp-dir",
+				Usage: "Body replay: directory for request bodies past --replay-buffer-bytes (default: the system temp directory)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "strip-request-header",
+				Usage: "Remove this header from client requests before proxying, e.g. an internal auth header (repeatable)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "strip-response-header",
+				Usage: "Remove this header from backend responses before returning them (repeatable)",
+			},
+			&cli.IntFlag{
+				Name:  "max-response-header-bytes",
+				Usage: "Limit on the total size of a backend response's headers (0 = unlimited)",
+			},
+			&cli.IntFlag{
+				Name:  "max-response-headers",
+				Usage: "Limit on the number of header lines in a backend response (0 = unlimited)",
+			},
+			&cli.IntFlag{
+				Name:  "max-response-header-value",
+				Usage: "Limit on the length of any single response header value (0 = unlimited)",
+			},
+			&cli.StringFlag{
+				Name:  "response-header-limit-action",
+				Usage: "What to do with a response over the header limits: truncate (drop the offending headers) or reject (502)",
+				Value: "truncate",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cache-path",
+				Usage: "Cache GET responses under this path prefix per the backend's Cache-Control/ETag; append \",public\" to also cache requests with Authorization (repeatable)",
+			},
+			&cli.IntFlag{
+				Name:  "cache-max-entries",
+				Usage: "Response cache: max number of cached responses",
+				Value: 1000,
+			},
+			&cli.IntFlag{
+				Name:  "cache-max-bytes",
+				Usage: "Response cache: max total bytes of cached bodies",
+				Value: 64 << 20,
+			},
+			&cli.IntFlag{
+				Name:  "cache-max-entry-bytes",
+				Usage: "Response cache: max bytes of one cached body; larger responses stream through uncached",
+				Value: 1 << 20,
+			},
+			&cli.DurationFlag{
+				Name:  "cache-default-ttl",
+				Usage: "Response cache: freshness of responses without a max-age (0 = cache those only with an ETag, revalidated every time)",
+			},
+			&cli.StringFlag{
+				Name:  "cache-bypass-header",
+				Usage: "Response cache: a request carrying this header skips the cached copy and refreshes it",
+			},
+			&cli.StringSliceFlag{
+				Name:  "coalesce-path",
+				Usage: "Share one backend request between identical concurrent GETs (same path, query and Authorization) under this path prefix (repeatable)",
+			},
+			&cli.IntFlag{
+				Name:  "coalesce-max-bytes",
+				Usage: "Request coalescing: max bytes of a shared response; a larger one stops its requests being coalesced",
+				Value: 1 << 20,
+			},
+			&cli.FloatFlag{
+				Name:  "panic-mode-threshold",
+				Usage: "Below this percentage of healthy backends, select among all backends regardless of health (0 = off)",
+			},
+			&cli.BoolFlag{
+				Name:  "outlier-detection",
+				Usage: "Temporarily eject healthy backends whose success rate or latency is far worse than the pool median",
+			},
+			&cli.DurationFlag{
+				Name:  "outlier-ejection-time",
+				Usage: "Outlier detection: how long an outlier is kept out of selection",
+				Value: lib.DefaultOutlierConfig().EjectionTime,
+			},
+			&cli.Float64Flag{
+				Name:  "outlier-max-ejection",
+				Usage: "Outlier detection: max fraction of backends ejected at once (0-1)",
+				Value: lib.DefaultOutlierConfig().MaxEjectionFraction,
+			},
+			&cli.DurationFlag{
+				Name:  "slow-start",
+				Usage: "Ramp a recovered, readmitted or restarted backend's share of new requests up over this window (0 = off)",
+			},
+			&cli.DurationFlag{
+				Name:  "failure-half-life",
+				Usage: "Failure memory: steer new requests away from backends in proportion to their recent 5xx and proxy errors, decaying with this half-life, instead of marking them unhealthy on a 5xx (0 = off)",
+			},
+			&cli.BoolFlag{
+				Name:  "adaptive-conns",
+				Usage: "Discover each backend's concurrency limit (AIMD): grow it while responses beat --adaptive-latency-target, cut it on upstream 429/503s, slow responses and timeouts; --max-conns is the ceiling",
+			},
+			&cli.IntFlag{
+				Name:  "adaptive-conns-floor",
+				Usage: "Adaptive concurrency: starting and lowest per-backend limit",
+				Value: 1,
+			},
+			&cli.DurationFlag{
+				Name:  "adaptive-latency-target",
+				Usage: "Adaptive concurrency: time to response headers above which a backend counts as overloaded",
+				Value: 2 * time.Second,
+			},
+			&cli.BoolFlag{
+				Name:  "weight-tuning",
+				Usage: "Tune each backend's selection weight to its observed success rate over median latency, relative to the pool, at most 10% per adjustment; see GET /admin/weights",
+			},
+			&cli.DurationFlag{
+				Name:  "weight-tuning-interval",
+				Usage: "Weight tuning: time between adjustments, each judging the requests since the last",
+				Value: lib.DefaultWeightTuningConfig().Interval,
+			},
+			&cli.Float64Flag{
+				Name:  "weight-tuning-min",
+				Usage: "Weight tuning: lowest effective weight, as a multiple of the static weight",
+				Value: lib.DefaultWeightTuningConfig().MinMultiplier,
+			},
+			&cli.Float64Flag{
+				Name:  "weight-tuning-max",
+				Usage: "Weight tuning: highest effective weight, as a multiple of the static weight",
+				Value: lib.DefaultWeightTuningConfig().MaxMultiplier,
+			},
+			&cli.Float64Flag{
+				Name:  "weight-tuning-log-threshold",
+				Usage: "Weight tuning: log a backend's weight once it has moved by this fraction since last logged",
+				Value: lib.DefaultWeightTuningConfig().LogThreshold,
+			},
+			&cli.StringFlag{
+				Name:  "zone",
+				Usage: "This lb's zone: prefer backends labeled zone=<this> within each priority tier, crossing zones only when too few are selectable or all are at capacity",
+			},
+			&cli.Float64Flag{
+				Name:  "zone-spill-threshold",
+				Usage: "Zone preference: fraction of same-zone backends that must be selectable to keep traffic in the zone (0-1)",
+				Value: lib.DefaultZoneSpillThreshold,
+			},
+			&cli.StringFlag{
+				Name:  "mirror",
+				Usage: "Also send a sample of requests to this URL (e.g. a canary), asynchronously; its responses are discarded and counted in /stats",
+			},
+			&cli.Float64Flag{
+				Name:  "mirror-percent",
+				Usage: "Mirroring: percentage of requests copied to --mirror (0-100)",
+				Value: 100,
+			},
+			&cli.Int64Flag{
+				Name:  "mirror-max-body",
+				Usage: "Mirroring: largest request body copied, in bytes; larger requests are not mirrored",
+				Value: 1 << 20,
+			},
+			&cli.IntFlag{
+				Name:  "mirror-max-concurrent",
+				Usage: "Mirroring: copies in flight per pool; samples beyond this are skipped",
+				Value: 16,
+			},
+			&cli.DurationFlag{
+				Name:  "hedge-after",
+				Usage: "Also send a GET, HEAD or OPTIONS request to a second backend if the first has not sent response headers within this long; the first to respond wins (0 = off)",
+			},
+			&cli.Float64Flag{
+				Name:  "hedge-budget",
+				Usage: "Hedging: max percentage of requests hedged per second (0-100)",
+				Value: 10,
+			},
+			&cli.StringFlag{
+				Name:  "notify-webhook",
+				Usage: "POST a JSON notification to this URL on every backend health transition",
+			},
+			&cli.DurationFlag{
+				Name:  "notify-dedupe-window",
+				Usage: "Webhook: after a notification, hold back the backend's transitions this long and send only the latest",
+				Value: lib.DefaultWebhookConfig().DedupeWindow,
+			},
+			&cli.StringFlag{
+				Name:  "otlp-endpoint",
+				Usage: "Export trace spans of proxied requests and health checks to this OTLP/HTTP collector, e.g. http://collector:4318 (off when unset)",
+			},
+			&cli.StringFlag{
+				Name:  "otlp-service-name",
+				Usage: "Tracing: service.name of the exported spans",
+				Value: "go-load-balance",
+			},
+			&cli.DurationFlag{
+				Name:  "status-interval",
+				Usage: "How often to log the [STATUS] line (0 = never)",
+				Value: 30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "metrics-scrape-timeout",
+				Usage: "Stop rendering a /metrics scrape after this long and return the partial payload, marked by lb_metrics_truncated 1",
+				Value: 5 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:  "report-path",
+				Usage: "On graceful shutdown, write a JSON report (uptime, requests, per-backend counters and latency, transition history, final pool state) to this file, or - for stdout",
+			},
+			&cli.BoolFlag{
+				Name:  "report-on-sigusr1",
+				Usage: "Also write the --report-path report on SIGUSR1, without exiting",
+			},
+			&cli.IntFlag{
+				Name:  "transition-history",
+				Usage: "How many health transitions each pool remembers for the report",
+				Value: lib.DefaultTransitionHistory,
+			},
+			&cli.StringFlag{
+				Name:    "state-store",
+				Aliases: []string{"state-file"},
+				Usage:   "Persist token buckets, outlier ejections and backend health across restarts: a file path, or redis://host:port/hash?instance=name in builds with -tags redis",
+			},
+			&cli.DurationFlag{
+				Name:  "state-flush-interval",
+				Usage: "How often to flush state to --state-store (also flushed at shutdown)",
+				Value: 30 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "state-health-ttl",
+				Usage: "Restore backends stored as unhealthy only from a snapshot younger than this (0 = never)",
+				Value: lib.DefaultStateHealthTTL,
+			},
+			&cli.StringSliceFlag{
+				Name:  "peers",
+				Usage: "Other lb replicas to share backend health transitions with over UDP, as host:port of their --peer-listen (repeatable or comma-separated); their reports are advisory",
+			},
+			&cli.StringFlag{
+				Name:  "peer-listen",
+				Usage: "Peers: UDP address to receive peer reports on",
+				Value: ":7946",
+			},
+			&cli.StringFlag{
+				Name:  "peer-id",
+				Usage: "Peers: this replica's name, unique among them (default hostname:port of --peer-listen)",
+			},
+			&cli.StringFlag{
+				Name:  "peer-secret",
+				Usage: "Peers: sign reports with this shared secret and drop unsigned ones",
+			},
 			&cli.BoolFlag{
 				Name:  "verbose",
 				Usage: "Enable verbose logging",
 			},
 		},
-		Action: func(ctx context.Context, cmd *cli.Command) error {
-			backends := cmd.StringSlice("backends")
-			// Remaining positional args are also backends (supports bash expansion:
-			// lb --backends http://localhost:800{0..2})
-			backends = append(backends, cmd.Args().Slice()...)
-
-			port := cmd.Int("port")
-			timeout := cmd.Duration("timeout")
-			healthCheckInterval := cmd.Duration("health-check-interval")
-			routing := cmd.String("routing")
-			maxConns := cmd.Int("max-conns")
-			affinityTTL := cmd.Duration("affinity-ttl")
-			logTo := cmd.String("log-to")
-			verbose := cmd.Bool("verbose")
-
-			// Add http:// to backends without a scheme
-			for i, b := range backends {
-				if !strings.Contains(b, "://") {
-					backends[i] = "http://" + b
-				}
-			}
+		Action: run,
+		Commands: []*cli.Command{{
+			Name:      "validate",
+			Usage:     "Check the backend sources and config file, and print each pool's backends with their origins",
+			UsageText: "lb validate [--backends <url> ...] [--config <path>] [--backends-source <sources>] [url ...]",
+			Action:    validate,
 
-			if port < 1 || port > 65535 {
-				return fmt.Errorf("invalid port %d (must be 1-65535)", port)
-			}
+			DisableSliceFlagSeparator: true,
+		}, {
+			Name:      "bench",
+			Usage:     "Drive load at a URL and report throughput, latency quantiles, status codes and, against lb with --debug-headers, requests per backend",
+			UsageText: "lb bench [--concurrency <n>] [--duration <duration>] [--method <method>] [--body-file <path>] [--header <name: value> ...] [--stream] [--client-timeout <duration>] [--output text|json] <url>",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "Requests in flight at once",
+					Value: 10,
+				},
+				&cli.DurationFlag{
+					Name:  "duration",
+					Usage: "How long to drive load; requests still running then are left out",
+					Value: 10 * time.Second,
+				},
+				&cli.StringFlag{
+					Name:  "method",
+					Usage: "Request method (default GET, or POST with --body-file)",
+				},
+				&cli.StringFlag{
+					Name:  "body-file",
+					Usage: "File whose contents are every request's body (Content-Type application/json unless --header sets one)",
+				},
+				&cli.StringSliceFlag{
+					Name:  "header",
+					Usage: "Request header \"Name: value\" (repeatable)",
+				},
+				&cli.BoolFlag{
+					Name:  "stream",
+					Usage: "Read responses as OpenAI-style SSE streams and report time to first token and chunks (the body must ask for \"stream\": true)",
+				},
+				&cli.DurationFlag{
+					Name:  "client-timeout",
+					Usage: "Give up on a request after this long (0 = never)",
+					Value: time.Minute,
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Report format: text or json",
+					Value: "text",
+				},
+			},
+			Action: bench,
 
-			if timeout < 0 {
-				return fmt.Errorf("timeout cannot be negative")
-			}
+			DisableSliceFlagSeparator: true,
+		}},
 
-			if healthCheckInterval < 5*time.Second {
-				return fmt.Errorf("health-check-interval must be at least 5s, got %v", healthCheckInterval)
-			}
+		// Values carry comma-separated attributes (",priority=N", ",public");
+		// repeat a flag to give several.
+		DisableSliceFlagSeparator: true,
+	}
+}
 
-			if routing != "least-conn" && routing != "cache-aware" {
-				return fmt.Errorf("routing must be least-conn or cache-aware, got %q", routing)
-			}
+func run(ctx context.Context, cmd *cli.Command) error {
+	startedAt := time.Now()
+	cfg, set, err := loadBackends(cmd)
+	if err != nil {
+		return err
+	}
+	ln, err := parseListenFlags(cmd)
+	if err != nil {
+		return err
+	}
+	dnsRefresh := cmd.Duration("dns-refresh")
+	if dnsRefresh <= 0 {
+		return configErrorf("dns-refresh must be positive, got %v", dnsRefresh)
+	}
+	px, err := parseProxyFlags(cmd, set)
+	if err != nil {
+		return err
+	}
+	hc, err := parseHealthFlags(cmd)
+	if err != nil {
+		return err
+	}
+	sel, err := parseSelectionFlags(cmd)
+	if err != nil {
+		return err
+	}
+	adm, err := parseAdmissionFlags(cmd, px.errorFormat)
+	if err != nil {
+		return err
+	}
+	resp, err := parseResponseFlags(cmd, cfg, px.errorFormat)
+	if err != nil {
+		return err
+	}
+	st, err := parseStateFlags(cmd)
+	if err != nil {
+		return err
+	}
+	obs, err := parseObservabilityFlags(cmd)
+	if err != nil {
+		return err
+	}
 
-			if maxConns < 0 {
-				return fmt.Errorf("max-conns cannot be negative")
-			}
+	// Print startup configuration
+	log.Printf("Starting go-load-balance %s", version)
+	ln.log()
+	log.Printf("Timeouts: request %v, read header %v, shutdown %v", px.requestTimeout, ln.readHeaderTimeout, ln.shutdownTimeout)
+	px.log()
+	hc.log()
+	sel.log()
+	adm.log()
+	resp.log()
+	st.log()
+	obs.log()
+	logBackends(set, cfg, cmd.String("config"))
 
-			if routing == "cache-aware" {
-				if maxConns == 0 {
-					return fmt.Errorf("cache-aware routing requires --max-conns > 0 (its load guard and cache retention are scaled by it)")
-				}
-				if affinityTTL <= 0 {
-					return fmt.Errorf("affinity-ttl must be positive, got %v", affinityTTL)
-				}
-			}
+	transport := lib.NewTransport(px.transport)
+	pools, poolsByName, err := newPools(set, cfg, sel, transport)
+	defer func() {
+		for _, pool := range pools {
+			pool.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
 
-			// Print startup configuration
-			log.Printf("Starting go-load-balance %s", version)
-			log.Printf("Port: %d", port)
-			log.Printf("Timeout: %v", timeout)
-			log.Printf("Health check interval: %v", healthCheckInterval)
-			log.Printf("Routing: %s", routing)
-			if maxConns > 0 {
-				log.Printf("Max conns per backend: %d", maxConns)
-			}
-			if routing == "cache-aware" {
-				log.Printf("Affinity TTL: %v", affinityTTL)
-			}
-			if logTo != "" {
-				log.Printf("Request log: %s", logTo)
-			}
-			log.Printf("Verbose: %v", verbose)
-			log.Printf("Backends:")
-			for _, backend := range backends {
-				log.Printf("  - %s", backend)
-			}
+	var decorators lib.Decorators
+	if cfg != nil {
+		if decorators, err = lib.NewDecorators(cfg.Decorators); err != nil {
+			return configError(err)
+		}
+	}
+	// Failure injection rules are only ever added at /admin/chaos.
+	chaos := lib.NewChaos()
+	for _, pool := range pools {
+		if err := pool.SetDecorators(decorators); err != nil {
+			return configError(err)
+		}
+		pool.SetResponseRewrite(resp.rewrite)
+		pool.SetChaos(chaos)
+		if err := px.apply(pool); err != nil {
+			return err
+		}
+		if err := hc.apply(pool); err != nil {
+			return err
+		}
+		sel.apply(pool)
+		adm.apply(pool)
+		obs.apply(pool)
+	}
+	reqLog, err := obs.openRequestLog(pools)
+	if err != nil {
+		return err
+	}
+	if reqLog != nil {
+		defer reqLog.Close()
+	}
+	rt, err := newPoolRouting(cfg, pools, poolsByName, len(set.cli) > 0, px.errorFormat)
+	if err != nil {
+		return err
+	}
 
-			// Create backend pool
-			pool, err := lib.NewPool(backends)
-			if err != nil {
-				log.Fatalf("Failed to create backend pool: %v", err)
-			}
-			if routing == "cache-aware" {
-				pool.EnableCacheAware(affinityTTL, int(maxConns))
-			} else if maxConns > 0 {
-				pool.SetMaxConns(int(maxConns))
-			}
-			if logTo != "" {
-				reqLog, err := lib.NewRequestLog(logTo)
-				if err != nil {
-					log.Fatalf("Failed to open --log-to file: %v", err)
-				}
-				defer reqLog.Close()
-				pool.SetRequestLog(reqLog)
-			}
+	// Bind before starting background work, so an address in use fails
+	// fast with its own exit code.
+	lns, err := ln.bind()
+	if err != nil {
+		return err
+	}
+	sdNotifier := lib.NewSdNotifier()
+	if sdNotifier != nil {
+		log.Printf("[SYSTEMD] notifying readiness on $NOTIFY_SOCKET")
+	}
 
-			// Create context for graceful shutdown
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
-
-			// Start health checker
-			healthChecker := lib.NewHealthChecker(pool, healthCheckInterval)
-			go healthChecker.Start(ctx)
-
-			// Start status logger
-			statusLogger := lib.NewStatusLogger(pool, healthCheckInterval, verbose)
-			go statusLogger.Start(ctx)
-
-			// Create mux with health endpoint
-			mux := http.NewServeMux()
-			mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-				totalActive, healthyCount, totalCount := pool.GetStatus()
-				status := map[string]any{
-					"status":           "ok",
-					"healthy_backends": healthyCount,
-					"total_backends":   totalCount,
-					"active_conns":     totalActive,
-				}
-				if healthyCount == 0 {
-					status["status"] = "degraded"
-					w.WriteHeader(http.StatusServiceUnavailable)
-				}
-				w.Header().Set("Content-Type", "application/json")
-				_ = json.NewEncoder(w).Encode(status)
-			})
-			mux.Handle("/", pool)
-
-			// Create HTTP server
-			server := &http.Server{
-				Addr:         fmt.Sprintf(":%d", port),
-				Handler:      mux,
-				ReadTimeout:  timeout,
-				WriteTimeout: timeout,
-			}
+	// Resolve dns+ backends once before serving (and before restoring state,
+	// which is keyed by backend); a failed lookup leaves the pool to the
+	// periodic re-resolution.
+	var discoverers []*lib.Discoverer
+	for _, pool := range pools {
+		for _, d := range pool.Discoverers(dnsRefresh) {
+			_ = d.Resolve(ctx)
+			discoverers = append(discoverers, d)
+		}
+	}
+
+	var limiter *lib.TokenLimiter
+	if cfg != nil && len(cfg.Tenants) > 0 {
+		limiter = lib.NewTokenLimiter(cfg.Tenants)
+		limiter.SetErrorFormat(px.errorFormat)
+	}
+	persister, err := st.openPersister(limiter, poolsByName)
+	if err != nil {
+		return err
+	}
+	peerSync, err := st.joinPeers(poolsByName)
+	if err != nil {
+		return err
+	}
 
-			// Handle graceful shutdown
-			go func() { // #nosec G118 -- shutdown must outlive the action context to drain in-flight requests
-				sigChan := make(chan os.Signal, 1)
-				signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-				<-sigChan
+	// Create context for graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if persister != nil {
+		go persister.Start(ctx)
+	}
+	if peerSync != nil {
+		go peerSync.Start(ctx)
+	}
+	decorators.Start(ctx)
+	adm.start(ctx)
+	obs.start(ctx, pools, startedAt)
+	for _, d := range discoverers {
+		go d.Start(ctx)
+	}
+	if reaper := lib.NewConnReaper(transport); reaper != nil {
+		go reaper.Start(ctx)
+	}
 
-				log.Println("Shutting down...")
-				cancel()
+	// A backend in several pools is probed once for all of them.
+	probeShare := lib.NewProbeShare()
+	healthCheckers := make([]*lib.HealthChecker, len(pools))
+	for i, pool := range pools {
+		healthCheckers[i] = hc.checker(pool, probeShare)
+		sel.start(ctx, pool)
+		px.start(ctx, pool)
+	}
 
-				shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-				defer shutdownCancel()
+	// Health, stats and admin endpoints, mounted per listener
+	ep := &endpoints{pools: pools, poolsByName: poolsByName, router: rt.router, cache: resp.cache, coalescer: resp.coalescer, splitter: rt.splitter, tenants: rt.tenants, apiKeys: adm.apiKeys, validator: adm.validator, metricsTimeout: obs.metricsTimeout}
+	if ln.pprof {
+		ep.diagnostics = &diagnostics{pools: pools}
+		log.Printf("Diagnostics: /debug/pprof/ and /admin/runtime on the listeners without the proxy")
+	}
+	registerAdmin := func(mux *http.ServeMux) {
+		registerBackendAdmin(mux, pools)
+		registerHealthAdmin(mux, pools, healthCheckers)
+		registerChaosAdmin(mux, chaos, pools)
+		registerQueueAdmin(mux, pools)
+		registerInflightRequestsAdmin(mux, pools)
+		registerWeightsAdmin(mux, pools)
+		if obs.hasher != nil {
+			registerIdentityAdmin(mux, obs.hasher)
+		}
+		if rt.router != nil {
+			registerRouteAdmin(mux, rt.router)
+		}
+		if rt.splitter != nil {
+			registerSplitAdmin(mux, rt.splitter)
+		}
+		if obs.decisions != nil {
+			registerDebugAdmin(mux, obs.decisions)
+		}
+		if adm.inflight != nil {
+			registerInflightAdmin(mux, adm.inflight, obs.hasher)
+		}
+		if peerSync != nil {
+			registerPeerAdmin(mux, peerSync)
+		}
+	}
+	handler := proxyHandler(rt, limiter, adm, resp)
 
-				if err := server.Shutdown(shutdownCtx); err != nil {
-					log.Printf("Server shutdown error: %v", err)
-				}
-			}()
+	// gRPC clients speak HTTP/2 without TLS (h2c) as well.
+	var protocols *http.Protocols
+	if slices.ContainsFunc(pools, (*lib.Pool).HasGRPC) {
+		protocols = new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		log.Printf("gRPC backends: accepting h2c on every listener")
+	}
+	servers := ln.servers(ep, handler, registerAdmin, protocols)
+
+	// A signal, or one server failing, stops them all.
+	failed := make(chan struct{})
+	drained := shutdownOn(failed, servers, ln.shutdownTimeout, sdNotifier, cancel)
+
+	if interval, ok := lib.SystemdWatchdog(); ok && sdNotifier != nil {
+		log.Printf("[SYSTEMD] watchdog: pinging every %v", interval/2)
+		go sdNotifier.Watchdog(ctx, interval, log.Default())
+	}
 
-			// Start HTTP server
-			log.Printf("Load balancer listening on :%d", port)
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				log.Fatalf("Server failed: %v", err)
+	if err := hc.awaitBackends(ctx, pools, healthCheckers, sdNotifier); err != nil {
+		return err
+	}
+	for _, healthChecker := range healthCheckers {
+		go healthChecker.Start(ctx)
+	}
+
+	// Start the HTTP servers
+	errs := make(chan error, len(servers))
+	for i, server := range servers {
+		l := ln.listeners[i]
+		log.Printf("Load balancer listening on %s", l)
+		go func() {
+			err := l.serve(server, lns[i])
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			if err != nil {
+				err = fmt.Errorf("server on %s failed: %w", l.addr, err)
 			}
+			errs <- err
+		}()
+	}
+	if err := sdNotifier.Ready(readyStatus(pools, len(servers))); err != nil {
+		log.Printf("[SYSTEMD] %v", err)
+	}
+	var serveErr error
+	for range servers {
+		if err := <-errs; err != nil && serveErr == nil {
+			serveErr = err
+			close(failed)
+		}
+	}
+	if serveErr != nil {
+		return runtimeError(serveErr)
+	}
 
-			log.Println("Server stopped")
-			return nil
-		},
+	if persister != nil || obs.exporter != nil || obs.reportPath != "" {
+		<-drained
+	}
+	if obs.reportPath != "" {
+		writeReport(obs.reportPath, "shutdown", startedAt, pools)
+	}
+	if persister != nil {
+		// Flush once the last requests have settled their token debits.
+		if err := persister.Flush(); err != nil {
+			log.Printf("[STATE] final flush failed: %v", err)
+		}
+	}
+	if obs.exporter != nil {
+		obs.exporter.Flush() // the spans of the requests drained at shutdown
 	}
+	log.Println("Server stopped")
+	return nil
+}
 
-	if err := app.Run(context.Background(), os.Args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// proxyHandler wraps the routing to the pools in the middleware every
+// proxied request goes through.
+func proxyHandler(rt poolRouting, limiter *lib.TokenLimiter, adm admissionFlags, resp responseFlags) http.Handler {
+	handler := rt.handler
+	// Coalescing inside the cache: only its misses share a request.
+	if resp.coalescer != nil {
+		handler = resp.coalescer.Handler(handler)
+	}
+	if resp.cache != nil {
+		handler = resp.cache.Handler(handler)
+	}
+	if limiter != nil {
+		handler = limiter.Handler(handler)
+	}
+	if adm.inflight != nil {
+		handler = adm.inflight.Handler(handler)
+	}
+	if rt.router != nil {
+		handler = rt.router.StreamingUploads(handler)
+	}
+	if adm.validator != nil {
+		handler = adm.validator.Handler(handler)
 	}
+	if adm.apiKeys != nil {
+		handler = adm.apiKeys.Handler(handler)
+	}
+	if resp.compressor != nil {
+		handler = resp.compressor.Handler(handler)
+	}
+	// Outermost: preflights are answered before API keys are asked for, and
+	// every response of the chain, errors included, gets CORS headers.
+	if resp.cors != nil {
+		handler = resp.cors.Handler(handler)
+	}
+	return handler
+}
+
+// shutdownOn shuts servers down on SIGINT or SIGTERM, or once failed is
+// closed, telling systemd and cancelling the background work first. The
+// returned channel is closed once the servers have drained, or timeout
+// ran out.
+func shutdownOn(failed <-chan struct{}, servers []*http.Server, timeout time.Duration, sd *lib.SdNotifier, cancel context.CancelFunc) <-chan struct{} {
+	drained := make(chan struct{})
+	go func() { // #nosec G118 -- shutdown must outlive the action context to drain in-flight requests
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sigChan:
+			log.Println("Shutting down...")
+		case <-failed:
+		}
+		if err := sd.Stopping(); err != nil {
+			log.Printf("[SYSTEMD] %v", err)
+		}
+		cancel()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+		defer shutdownCancel()
+
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Go(func() {
+				if err := server.Shutdown(shutdownCtx); err != nil {
+					log.Printf("Server shutdown error: %v", err)
+				}
+			})
+		}
+		wg.Wait()
+		close(drained)
+	}()
+	return drained
 }
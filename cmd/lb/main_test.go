@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+// runApp runs the lb command with args and returns its error, with cli
+// usage output discarded.
+func runApp(t *testing.T, args ...string) error {
+	t.Helper()
+	app := newApp()
+	app.Writer = io.Discard
+	app.ErrWriter = io.Discard
+	return app.Run(context.Background(), append([]string{"lb"}, args...))
+}
+
+func assertExit(t *testing.T, err error, wantCode int, wantClass string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected an error with exit code %d", wantCode)
+	}
+	if code, class := exitStatus(err); code != wantCode || class != wantClass {
+		t.Fatalf("exitStatus(%v) = (%d, %s), want (%d, %s)", err, code, class, wantCode, wantClass)
+	}
+}
+
+func TestExitInvalidBackend(t *testing.T) {
+	err := runApp(t, "--backends", "http://[::1")
+	assertExit(t, err, exitConfig, "config")
+}
+
+func TestExitFlagParseErrors(t *testing.T) {
+	assertExit(t, runApp(t, "--backends", "http://a", "--no-such-flag"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--timeout", "forever"), exitConfig, "config")
+	assertExit(t, runApp(t), exitConfig, "config") // --backends is required
+}
+
+func TestSliceFlagsKeepAttributes(t *testing.T) {
+	app := newApp()
+	var backends, cachePaths []string
+	app.Action = func(_ context.Context, cmd *cli.Command) error {
+		backends, cachePaths = cmd.StringSlice("backends"), cmd.StringSlice("cache-path")
+		return nil
+	}
+	if err := app.Run(context.Background(), []string{"lb", "--backends", "http://a", "--backends", "http://b,priority=1", "--cache-path", "/v1/models,public"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(backends) != 2 || backends[1] != "http://b,priority=1" || len(cachePaths) != 1 || cachePaths[0] != "/v1/models,public" {
+		t.Errorf("backends %q, cache paths %q: attributes split off their values", backends, cachePaths)
+	}
+}
+
+func TestExitValidationErrors(t *testing.T) {
+	assertExit(t, runApp(t, "--backends", "http://a", "--port", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--routing", "cache-aware"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--health-path", "healthz"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--health-check", "icmp"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,check=udp"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,health=a:9000/healthz"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--prewarm"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--wait-ready", "--min-healthy", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--max-inflight-per-client", "-1"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--max-request-age", "-1s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--listen", "unix://relative.sock"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--concurrency-key", "X-Api-Key"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--otlp-endpoint", "collector:4318"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--routing", "prefix-hash", "--prefix-hash-bytes", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,timeout=0s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--deadline-header", "X-Deadline: ms"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--error-format", "html"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--max-inflight", "-1"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--failure-half-life", "-10s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--slow-request-threshold", "-1s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--strip-prefix", "api"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,prefix=serve"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--queue-tenant-header", "X-Tenant"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--drain-timeout", "-1s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--admin-port", "70000"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--admin-port", "8080"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--admin-port", "9090", "--admin-basic-auth", "ops"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--admin-port", "9090", "--admin-allow-cidr", "10.0.0.0/40"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--disable-inline-admin", "--admin-basic-auth", "ops:pass"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--proxy-protocol-allow", "10.0.0.0/8"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--enable-pprof"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--proxy-protocol", "--proxy-protocol-allow", "10.0.0.0/40"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,send_proxy=v3"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--queue-size", "10", "--queue-tenant-size", "2"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--queue-size", "10", "--queue-tenant-header", "X-Tenant", "--priority-header", "X-Request-Priority"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--priority-header", "X-Request-Priority", "--priority-promote-after", "-1s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--priority-header", "X-Request-Priority", "--priority-high-allow", "not-an-address"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--priority-high-allow", "10.0.0.0/8"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--priority-header", "X Priority"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--weight-tuning", "--weight-tuning-interval", "0s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--weight-tuning", "--weight-tuning-min", "1.5"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--weight-tuning", "--weight-tuning-max", "0.5"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--api-keys-file", filepath.Join(t.TempDir(), "missing")), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,upstream_key=sk-1,decorator=x"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--unhealthy-check-interval", "500ms"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--health-check-jitter", "0.6"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--unhealthy-threshold", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--healthy-threshold", "-1"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--health-latency-warn", "-1s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--compress-min-bytes", "-1"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--cors-allow-origins", "*", "--cors-allow-credentials"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--cors-allow-origins", "app.example.com"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--cors-max-age", "1m"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--backend-conn-max-lifetime", "-1s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--backend-conn-max-idle", "10s"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--allowed-models", "llama-3"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--validate-requests", "--validate-max-body", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--peers", "lb-2"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--replay-temp-dir", "/no/such/dir"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--backend-proxy", "ftp://proxy:21"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,family=ipv4", "--backend-proxy", "socks5://proxy:1080"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--report-on-sigusr1"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--report-path", "/no/such/dir/report.json"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--transition-history", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--coalesce-path", "v1/models"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--coalesce-path", "/v1/models", "--coalesce-max-bytes", "0"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a,check_cmd=/bin/true"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--health-check", "exec"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--drain-signal-header", "X-Backend-Draining: true"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--state-file", "state.json", "--state-health-ttl", "-1m"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--routing", "prefix-hash", "--prefix-hash-field", "messages[first]"), exitConfig, "config")
+	assertExit(t, runApp(t, "--backends", "http://a", "--routing", "least-reported-load", "--reported-load-pointer", "num_requests_waiting"), exitConfig, "config")
+}
+
+func TestExitBindFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	err = runApp(t, "--backends", "http://127.0.0.1:1", "--port", port)
+	assertExit(t, err, exitBind, "bind")
+
+	notSocket := filepath.Join(t.TempDir(), "lb.sock")
+	if err := os.WriteFile(notSocket, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err = runApp(t, "--backends", "http://127.0.0.1:1", "--listen", "unix://"+notSocket)
+	assertExit(t, err, exitBind, "bind")
+
+	t.Setenv("LISTEN_FDS", "")
+	err = runApp(t, "--backends", "http://127.0.0.1:1", "--listen", "systemd")
+	assertExit(t, err, exitBind, "bind")
+}
+
+func TestExitNotReady(t *testing.T) {
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(free.Addr().(*net.TCPAddr).Port)
+	_ = free.Close()
+
+	err = runApp(t, "--backends", "http://127.0.0.1:1", "--port", port,
+		"--wait-ready", "--startup-timeout", "200ms", "--startup-timeout-exit")
+	assertExit(t, err, exitRuntime, "runtime")
+}
+
+func TestExitStatusRuntime(t *testing.T) {
+	assertExit(t, runtimeError(io.ErrUnexpectedEOF), exitRuntime, "runtime")
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"go-load-balance/lib"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// observabilityFlags are the flags of what lb tells about its traffic: the
+// request log, debug headers, status lines, reports, health notifications
+// and tracing.
+type observabilityFlags struct {
+	logTo             string
+	slowRequests      time.Duration
+	hasher            *lib.IdentityHasher
+	hashRotation      time.Duration
+	decisions         *lib.DecisionLog
+	lastRequests      int
+	statusInterval    time.Duration
+	verbose           bool
+	metricsTimeout    time.Duration
+	reportPath        string
+	reportOnSIGUSR1   bool
+	transitionHistory int
+	webhook           lib.WebhookConfig
+	notifier          *lib.WebhookNotifier
+	otlpEndpoint      string
+	otlpService       string
+	exporter          *lib.OTLPExporter
+	tracer            *lib.Tracer
+}
+
+func parseObservabilityFlags(cmd *cli.Command) (observabilityFlags, error) {
+	f := observabilityFlags{
+		logTo:             cmd.String("log-to"),
+		slowRequests:      cmd.Duration("slow-request-threshold"),
+		hashRotation:      cmd.Duration("hash-salt-rotation"),
+		lastRequests:      cmd.Int("debug-last-requests"),
+		statusInterval:    cmd.Duration("status-interval"),
+		verbose:           cmd.Bool("verbose"),
+		metricsTimeout:    cmd.Duration("metrics-scrape-timeout"),
+		reportPath:        cmd.String("report-path"),
+		reportOnSIGUSR1:   cmd.Bool("report-on-sigusr1"),
+		transitionHistory: cmd.Int("transition-history"),
+		webhook:           lib.DefaultWebhookConfig(),
+		otlpEndpoint:      cmd.String("otlp-endpoint"),
+		otlpService:       cmd.String("otlp-service-name"),
+	}
+	f.webhook.URL = cmd.String("notify-webhook")
+	f.webhook.DedupeWindow = cmd.Duration("notify-dedupe-window")
+
+	if cmd.Bool("hash-client-ids") {
+		if f.hashRotation <= 0 {
+			return f, configErrorf("hash-salt-rotation must be positive, got %v", f.hashRotation)
+		}
+		f.hasher = lib.NewIdentityHasher(f.hashRotation)
+	}
+	if cmd.Bool("debug-headers") {
+		if f.lastRequests < 1 {
+			return f, configErrorf("debug-last-requests must be at least 1, got %d", f.lastRequests)
+		}
+		f.decisions = lib.NewDecisionLog(f.lastRequests)
+	}
+	if f.metricsTimeout <= 0 {
+		return f, configErrorf("metrics-scrape-timeout must be positive, got %v", f.metricsTimeout)
+	}
+	if f.reportOnSIGUSR1 && f.reportPath == "" {
+		return f, configErrorf("report-on-sigusr1 requires --report-path")
+	}
+	if f.reportPath != "" && f.reportPath != "-" {
+		if info, err := os.Stat(filepath.Dir(f.reportPath)); err != nil || !info.IsDir() {
+			return f, configErrorf("report-path %q: directory %q does not exist", f.reportPath, filepath.Dir(f.reportPath))
+		}
+	}
+	if f.transitionHistory < 1 {
+		return f, configErrorf("transition-history must be at least 1, got %d", f.transitionHistory)
+	}
+	if f.statusInterval < 0 {
+		return f, configErrorf("status-interval cannot be negative, got %v", f.statusInterval)
+	}
+	if f.slowRequests < 0 {
+		return f, configErrorf("slow-request-threshold cannot be negative, got %v", f.slowRequests)
+	}
+
+	if f.webhook.URL != "" {
+		if u, err := url.Parse(f.webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return f, configErrorf("notify-webhook must be an http(s) URL, got %q", f.webhook.URL)
+		}
+		if f.webhook.DedupeWindow < 0 {
+			return f, configErrorf("notify-dedupe-window cannot be negative, got %v", f.webhook.DedupeWindow)
+		}
+		f.notifier = lib.NewWebhookNotifier(f.webhook)
+	}
+	if f.otlpEndpoint != "" {
+		var err error
+		if f.exporter, err = lib.NewOTLPExporter(f.otlpEndpoint, f.otlpService); err != nil {
+			return f, configError(err)
+		}
+		f.tracer = lib.NewTracer(f.exporter)
+	}
+	return f, nil
+}
+
+func (f observabilityFlags) log() {
+	if f.logTo != "" {
+		log.Printf("Request log: %s", f.logTo)
+	}
+	if f.slowRequests > 0 {
+		log.Printf("Slow requests: logged over %v", f.slowRequests)
+	}
+	if f.hasher != nil {
+		log.Printf("Client identifiers: hashed, salt rotates every %v", f.hashRotation)
+	}
+	if f.decisions != nil {
+		log.Printf("Debug headers: on, last %d decisions at /admin/last-requests", f.lastRequests)
+	}
+	if f.notifier != nil {
+		shown := f.webhook.URL
+		if u, err := url.Parse(f.webhook.URL); err == nil {
+			shown = u.Redacted()
+		}
+		log.Printf("Notifications: health transitions to %s (dedupe window %v)", shown, f.webhook.DedupeWindow)
+	}
+	if f.exporter != nil {
+		log.Printf("Tracing: spans to %s as service %s", f.otlpEndpoint, f.otlpService)
+	}
+	log.Printf("Verbose: %v", f.verbose)
+}
+
+// apply sets what pool records and reports.
+func (f observabilityFlags) apply(pool *lib.Pool) {
+	pool.SetTransitionHistory(f.transitionHistory)
+	pool.SetTracer(f.tracer)
+	pool.SetSlowRequestThreshold(f.slowRequests)
+	if f.decisions != nil {
+		pool.SetDebug(f.decisions)
+	}
+	if f.notifier != nil {
+		pool.OnStateChange(f.notifier.Notify)
+	}
+}
+
+// openRequestLog opens --log-to for pools, or returns nil without it.
+func (f observabilityFlags) openRequestLog(pools []*lib.Pool) (*lib.RequestLog, error) {
+	if f.logTo == "" {
+		return nil, nil
+	}
+	reqLog, err := lib.NewRequestLog(f.logTo)
+	if err != nil {
+		return nil, configErrorf("failed to open --log-to file: %w", err)
+	}
+	if f.hasher != nil {
+		reqLog.SetIdentityHasher(f.hasher)
+	}
+	for _, pool := range pools {
+		pool.SetRequestLog(reqLog)
+	}
+	return reqLog, nil
+}
+
+// start runs the span exporter, the SIGUSR1 report and the pools' status
+// loggers until ctx ends.
+func (f observabilityFlags) start(ctx context.Context, pools []*lib.Pool, startedAt time.Time) {
+	if f.exporter != nil {
+		go f.exporter.Start(ctx)
+	}
+	if f.reportOnSIGUSR1 {
+		go func() {
+			usr1 := make(chan os.Signal, 1)
+			signal.Notify(usr1, syscall.SIGUSR1)
+			defer signal.Stop(usr1)
+			for {
+				select {
+				case <-usr1:
+					writeReport(f.reportPath, "SIGUSR1", startedAt, pools)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	if f.statusInterval > 0 {
+		for _, pool := range pools {
+			go lib.NewStatusLogger(pool, f.statusInterval, f.verbose).Start(ctx)
+		}
+	}
+}
+
+// writeReport writes the report of pools to path, logging the outcome.
+func writeReport(path, trigger string, startedAt time.Time, pools []*lib.Pool) {
+	if err := lib.NewReport(trigger, startedAt, time.Now(), pools).WriteFile(path); err != nil {
+		log.Printf("[REPORT] %s report failed: %v", trigger, err)
+		return
+	}
+	if path != "-" {
+		log.Printf("[REPORT] %s report written to %s", trigger, path)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"cmp"
+	"go-load-balance/lib"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// logBackends logs the backends of set and what cfg (read from path, nil
+// without --config) does with them.
+func logBackends(set *backendSet, cfg *lib.Config, path string) {
+	if len(set.cli) > 0 {
+		log.Printf("Backends:")
+		for _, sb := range set.cli {
+			log.Printf("  - %s (%s)", lib.RedactBackendSpec(sb.spec), sb.origin())
+		}
+	}
+	if cfg != nil {
+		log.Printf("Config: %s", path)
+		for _, name := range slices.Sorted(maps.Keys(set.config)) {
+			log.Printf("Pool %s:", name)
+			for _, sb := range set.config[name] {
+				log.Printf("  - %s (%s)", lib.RedactBackendSpec(sb.spec), sb.origin())
+			}
+		}
+		for _, r := range cfg.Routes {
+			log.Printf("Route %s: %s -> %v", r.ID, r.Prefix, r.Targets)
+		}
+		if s := cfg.Split; s != nil {
+			log.Printf("Split: %v (by %s, fallback %v)", s.Groups, cmp.Or(s.By, lib.SplitByRandom), s.Fallback)
+		}
+		if tr := cfg.TenantRouting; tr != nil {
+			for _, name := range slices.Sorted(maps.Keys(tr.Tenants)) {
+				log.Printf("Tenant routing: %s -> pool %s (key prefixes %d)", name, tr.Tenants[name].Pool, len(tr.Tenants[name].KeyPrefixes))
+			}
+			unmapped := "default group"
+			if tr.Strict {
+				unmapped = "403 (strict)"
+			}
+			log.Printf("Tenant routing: header %q, unmapped requests get the %s", tr.Header, unmapped)
+		}
+		for _, name := range slices.Sorted(maps.Keys(cfg.Tenants)) {
+			log.Printf("Tenant %s: %d keys, tokens/min %v", name, len(cfg.Tenants[name].Keys), cfg.Tenants[name].TokensPerMinute)
+		}
+		for _, name := range slices.Sorted(maps.Keys(cfg.Decorators)) {
+			log.Printf("Decorator %s: %s", name, cfg.Decorators[name].Type)
+		}
+	}
+	for _, ib := range set.ignored {
+		log.Printf("Ignoring backend %s from %s: %s", lib.RedactBackendSpec(ib.spec), sourceNames[ib.source], ib.reason)
+	}
+}
+
+// newPools creates the backend pools: the --backends pool (named "default"
+// when a config file adds more) plus the config file's named pools, in
+// name order, all sharing transport. On error, the pools created are
+// returned for closing.
+func newPools(set *backendSet, cfg *lib.Config, sel selectionFlags, transport *http.Transport) ([]*lib.Pool, map[string]*lib.Pool, error) {
+	var pools []*lib.Pool
+	byName := make(map[string]*lib.Pool)
+	if len(set.cli) > 0 {
+		pool, err := lib.NewPool(specs(set.cli), append(sel.poolOptions(), lib.WithTransport(transport))...)
+		if err != nil {
+			return pools, nil, configErrorf("failed to create backend pool: %w", err)
+		}
+		if cfg != nil {
+			pool.SetName(defaultPoolName)
+		}
+		pools = append(pools, pool)
+		byName[defaultPoolName] = pool
+	}
+	if cfg == nil {
+		return pools, byName, nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		if _, taken := byName[name]; taken {
+			return pools, nil, configErrorf("pool name %q is reserved for the --backends pool", name)
+		}
+		pc := cfg.Pools[name]
+		pc.Backends = specs(set.config[name])
+		pool, err := pc.NewPool(lib.WithTransport(transport))
+		if err != nil {
+			return pools, nil, configErrorf("pool %q: %w", name, err)
+		}
+		pool.SetName(name)
+		pools = append(pools, pool)
+		byName[name] = pool
+	}
+	return pools, byName, nil
+}
+
+// poolRouting is how a request reaches its pool.
+type poolRouting struct {
+	handler  http.Handler
+	router   *lib.Router
+	splitter *lib.Splitter
+	tenants  *lib.TenantRouter
+}
+
+// newPoolRouting routes requests to pools. Without a config file the single
+// pool serves every path; with one, a router picks the pool by path prefix,
+// with the --backends pool (if cliPool), the config's default pool or its
+// split (if any) catching everything unmatched. Tenant routing, if
+// configured, picks a tenant's pool ahead of the router.
+func newPoolRouting(cfg *lib.Config, pools []*lib.Pool, byName map[string]*lib.Pool, cliPool bool, errorFormat lib.ErrorFormat) (poolRouting, error) {
+	rt := poolRouting{handler: pools[0]}
+	if cfg == nil {
+		return rt, nil
+	}
+	routes := cfg.Routes
+	fallback := cfg.Default
+	if cliPool {
+		if fallback != "" {
+			return rt, configErrorf("config sets default pool %q, but --backends already form the default pool", fallback)
+		}
+		if cfg.Split != nil {
+			return rt, configErrorf("config sets a split, but --backends already form the default pool")
+		}
+		fallback = defaultPoolName
+	}
+	if fallback != "" {
+		routes = append(routes, lib.RouteConfig{ID: defaultPoolName, Prefix: "/", Targets: []lib.RouteTarget{{Pool: fallback, Weight: 1}}})
+	}
+	var err error
+	if rt.router, err = lib.NewRouter(routes, byName); err != nil {
+		return rt, configError(err)
+	}
+	rt.router.SetErrorFormat(errorFormat)
+	if cfg.Split != nil {
+		if rt.splitter, err = lib.NewSplitter(*cfg.Split, byName); err != nil {
+			return rt, configError(err)
+		}
+		rt.router.SetFallback(rt.splitter)
+	}
+	rt.handler = rt.router
+	if cfg.TenantRouting != nil {
+		if rt.tenants, err = lib.NewTenantRouter(*cfg.TenantRouting, byName); err != nil {
+			return rt, configError(err)
+		}
+		rt.tenants.SetErrorFormat(errorFormat)
+		rt.handler = rt.tenants.Handler(rt.handler)
+	}
+	return rt, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-load-balance/lib"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// proxyFlags are the flags of how a request is forwarded to its backend:
+// time limits, the backend transport, body and header limits, mirroring
+// and hedging.
+type proxyFlags struct {
+	requestTimeout    time.Duration
+	deadlineHeader    string
+	errorFormat       lib.ErrorFormat
+	drainTimeout      time.Duration
+	maxRequestAge     time.Duration
+	drainSignalHeader string
+	stripPrefix       string
+	transport         lib.TransportConfig
+	policy            lib.ProxyPolicy
+	replay            lib.BodyReplayConfig
+	loadHints         bool
+	forceDecompress   bool
+	mirror            lib.MirrorConfig
+	hedge             lib.HedgeConfig
+}
+
+// parseProxyFlags parses the proxy flags; set is checked against
+// --backend-proxy.
+func parseProxyFlags(cmd *cli.Command, set *backendSet) (proxyFlags, error) {
+	f := proxyFlags{
+		requestTimeout:    cmd.Duration("request-timeout"),
+		deadlineHeader:    cmd.String("deadline-header"),
+		drainTimeout:      cmd.Duration("drain-timeout"),
+		maxRequestAge:     cmd.Duration("max-request-age"),
+		drainSignalHeader: cmd.String("drain-signal-header"),
+		stripPrefix:       cmd.String("strip-prefix"),
+		transport: lib.TransportConfig{
+			ConnectTimeout:        cmd.Duration("connect-timeout"),
+			KeepAlive:             cmd.Duration("keep-alive"),
+			IdleConnTimeout:       cmd.Duration("idle-conn-timeout"),
+			MaxIdleConnsPerHost:   cmd.Int("max-idle-conns-per-host"),
+			ResponseHeaderTimeout: cmd.Duration("response-header-timeout"),
+			ConnMaxLifetime:       cmd.Duration("backend-conn-max-lifetime"),
+			ConnMaxIdle:           cmd.Duration("backend-conn-max-idle"),
+		},
+		policy: lib.ProxyPolicy{
+			MaxRequestBody:       cmd.Int64("max-request-body"),
+			MaxResponseBody:      cmd.Int64("max-response-body"),
+			StripRequestHeaders:  cmd.StringSlice("strip-request-header"),
+			StripResponseHeaders: cmd.StringSlice("strip-response-header"),
+
+			MaxResponseHeaderBytes: cmd.Int("max-response-header-bytes"),
+			MaxResponseHeaders:     cmd.Int("max-response-headers"),
+			MaxResponseHeaderValue: cmd.Int("max-response-header-value"),
+		},
+		replay: lib.BodyReplayConfig{
+			MemoryBytes: cmd.Int64("replay-buffer-bytes"),
+			MaxBytes:    cmd.Int64("replay-max-bytes"),
+			TempDir:     cmd.String("replay-temp-dir"),
+		},
+		loadHints:       cmd.Bool("load-hints"),
+		forceDecompress: cmd.Bool("force-decompress"),
+		mirror: lib.MirrorConfig{
+			Target:        cmd.String("mirror"),
+			Percent:       cmd.Float64("mirror-percent"),
+			MaxBody:       cmd.Int64("mirror-max-body"),
+			MaxConcurrent: cmd.Int("mirror-max-concurrent"),
+		},
+		hedge: lib.HedgeConfig{
+			After:         cmd.Duration("hedge-after"),
+			BudgetPercent: cmd.Float64("hedge-budget"),
+		},
+	}
+	var err error
+	if f.requestTimeout < 0 {
+		return f, configErrorf("request-timeout cannot be negative")
+	}
+	if strings.ContainsAny(f.deadlineHeader, " \t:") {
+		return f, configErrorf("deadline-header must be a header name, got %q", f.deadlineHeader)
+	}
+	if strings.ContainsAny(f.drainSignalHeader, " \t:") {
+		return f, configErrorf("drain-signal-header must be a header name, got %q", f.drainSignalHeader)
+	}
+	if f.errorFormat, err = lib.ParseErrorFormat(cmd.String("error-format")); err != nil {
+		return f, configError(err)
+	}
+	if f.drainTimeout < 0 {
+		return f, configErrorf("drain-timeout cannot be negative")
+	}
+	if f.maxRequestAge < 0 {
+		return f, configErrorf("max-request-age cannot be negative")
+	}
+
+	t := &f.transport
+	if t.ConnectTimeout < 0 || t.KeepAlive < 0 || t.IdleConnTimeout < 0 || t.ResponseHeaderTimeout < 0 {
+		return f, configErrorf("connect-timeout, keep-alive, idle-conn-timeout and response-header-timeout cannot be negative")
+	}
+	if t.ConnMaxLifetime < 0 || t.ConnMaxIdle < 0 {
+		return f, configErrorf("backend-conn-max-lifetime and backend-conn-max-idle cannot be negative")
+	}
+	if t.ConnMaxIdle > 0 && t.IdleConnTimeout > 0 && t.ConnMaxIdle >= t.IdleConnTimeout {
+		return f, configErrorf("backend-conn-max-idle %v has no effect: --idle-conn-timeout %v closes idle connections first (raise it, or 0 to disable it)",
+			t.ConnMaxIdle, t.IdleConnTimeout)
+	}
+	if t.MaxIdleConnsPerHost < 1 {
+		return f, configErrorf("max-idle-conns-per-host must be at least 1, got %d", t.MaxIdleConnsPerHost)
+	}
+	if raw := cmd.String("backend-proxy"); raw != "" {
+		u, err := lib.ParseProxyURL(raw)
+		if err != nil {
+			return f, configErrorf("backend-proxy: %v", err)
+		}
+		t.Proxy = u
+		if spec, ok := set.familyPinned(); ok {
+			return f, configErrorf("backend %s: family= does not apply through --backend-proxy, which resolves the backend's name", lib.RedactBackendSpec(spec))
+		}
+	}
+
+	if f.policy.MaxRequestBody < 0 || f.policy.MaxResponseBody < 0 {
+		return f, configErrorf("max-request-body and max-response-body cannot be negative")
+	}
+	if f.replay.MemoryBytes < 0 || f.replay.MaxBytes < 0 {
+		return f, configErrorf("replay-buffer-bytes and replay-max-bytes cannot be negative")
+	}
+	if f.replay.TempDir != "" {
+		if info, err := os.Stat(f.replay.TempDir); err != nil || !info.IsDir() {
+			return f, configErrorf("replay-temp-dir %q is not a directory", f.replay.TempDir)
+		}
+	}
+	if f.policy.MaxResponseHeaderBytes < 0 || f.policy.MaxResponseHeaders < 0 || f.policy.MaxResponseHeaderValue < 0 {
+		return f, configErrorf("max-response-header-bytes, max-response-headers and max-response-header-value cannot be negative")
+	}
+	switch action := cmd.String("response-header-limit-action"); action {
+	case "truncate", "reject":
+		f.policy.RejectOversizedHeaders = action == "reject"
+	default:
+		return f, configErrorf("response-header-limit-action must be truncate or reject, got %q", action)
+	}
+
+	if f.mirror.Target != "" {
+		if !strings.Contains(f.mirror.Target, "://") {
+			f.mirror.Target = "http://" + f.mirror.Target
+		}
+		if f.mirror.Percent <= 0 || f.mirror.Percent > 100 {
+			return f, configErrorf("mirror-percent must be in (0, 100], got %v", f.mirror.Percent)
+		}
+		if f.mirror.MaxBody <= 0 {
+			return f, configErrorf("mirror-max-body must be positive, got %d", f.mirror.MaxBody)
+		}
+		if f.mirror.MaxConcurrent < 1 {
+			return f, configErrorf("mirror-max-concurrent must be at least 1, got %d", f.mirror.MaxConcurrent)
+		}
+	}
+	if f.hedge.After < 0 {
+		return f, configErrorf("hedge-after cannot be negative, got %v", f.hedge.After)
+	}
+	if f.hedge.After > 0 && (f.hedge.BudgetPercent <= 0 || f.hedge.BudgetPercent > 100) {
+		return f, configErrorf("hedge-budget must be in (0, 100], got %v", f.hedge.BudgetPercent)
+	}
+	return f, nil
+}
+
+func (f proxyFlags) log() {
+	if f.deadlineHeader != "" {
+		log.Printf("Deadline header: %s", f.deadlineHeader)
+	}
+	if f.maxRequestAge > 0 {
+		log.Printf("Max request age: %v", f.maxRequestAge)
+	}
+	if f.drainSignalHeader != "" {
+		log.Printf("Drain signal header: %s", f.drainSignalHeader)
+	}
+	if f.stripPrefix != "" {
+		log.Printf("Stripping path prefix %s before proxying", f.stripPrefix)
+	}
+	t := f.transport
+	log.Printf("Backend transport: connect %v, idle %v, %d idle conns/host, response header timeout %v",
+		t.ConnectTimeout, t.IdleConnTimeout, t.MaxIdleConnsPerHost, t.ResponseHeaderTimeout)
+	if t.Proxy != nil {
+		log.Printf("Backend proxy: %s", t.Proxy.Redacted())
+	}
+	if t.ConnMaxLifetime > 0 || t.ConnMaxIdle > 0 {
+		log.Printf("Backend connection rotation: max lifetime %v, max idle %v", t.ConnMaxLifetime, t.ConnMaxIdle)
+	}
+	if f.loadHints {
+		log.Printf("Load hints: on")
+	}
+	if f.forceDecompress {
+		log.Printf("Forced decompression: on")
+	}
+	if f.mirror.Target != "" {
+		log.Printf("Mirroring: %g%% of requests to %s (bodies up to %d bytes, %d in flight per pool)", f.mirror.Percent, f.mirror.Target, f.mirror.MaxBody, f.mirror.MaxConcurrent)
+	}
+	if f.hedge.After > 0 {
+		log.Printf("Hedging: GET/HEAD/OPTIONS after %v without response headers, at most %g%% of requests", f.hedge.After, f.hedge.BudgetPercent)
+	}
+}
+
+// apply sets how pool forwards requests.
+func (f proxyFlags) apply(pool *lib.Pool) error {
+	pool.SetProxyPolicy(f.policy)
+	if f.replay.MaxBytes > 0 {
+		pool.SetBodyReplay(f.replay)
+	}
+	if err := pool.SetStripPrefix(f.stripPrefix); err != nil {
+		return configError(fmt.Errorf("strip-prefix: %w", err))
+	}
+	pool.SetDrainTimeout(f.drainTimeout)
+	if f.loadHints {
+		pool.SetLoadHints()
+	}
+	if f.forceDecompress {
+		pool.SetForceDecompress()
+	}
+	pool.SetRequestTimeout(f.requestTimeout)
+	pool.SetDeadlineHeader(f.deadlineHeader)
+	pool.SetDrainSignalHeader(f.drainSignalHeader)
+	pool.SetErrorFormat(f.errorFormat)
+	if f.mirror.Target != "" {
+		if err := pool.SetMirror(f.mirror); err != nil {
+			return configError(err)
+		}
+	}
+	if f.hedge.After > 0 {
+		pool.SetHedging(f.hedge)
+	}
+	return nil
+}
+
+// start runs pool's request reaper until ctx ends, with --max-request-age.
+func (f proxyFlags) start(ctx context.Context, pool *lib.Pool) {
+	if f.maxRequestAge > 0 {
+		go lib.NewRequestReaper(pool, f.maxRequestAge).Start(ctx)
+	}
+}
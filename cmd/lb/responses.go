@@ -0,0 +1,140 @@
+package main
+
+import (
+	"go-load-balance/lib"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// corsFlags are the --cors-* flags, which --config's "cors" replaces.
+var corsFlags = []string{"cors-allow-origins", "cors-allow-methods", "cors-allow-headers", "cors-expose-headers", "cors-max-age", "cors-allow-credentials"}
+
+// responseFlags are the flags of what lb does to responses on their way
+// back: caching, coalescing, CORS, rewriting and compression.
+type responseFlags struct {
+	cacheRoutes   []lib.CacheRoute
+	cacheTTL      time.Duration
+	cache         *lib.ResponseCache
+	coalescePaths []string
+	coalescer     *lib.Coalescer
+	corsCfg       lib.CORSConfig
+	cors          *lib.CORS
+	rewrite       *lib.ResponseRewrite
+	rewriteCfg    *lib.ResponseRewriteConfig
+	compressor    *lib.Compressor
+	compressMin   int
+}
+
+// parseResponseFlags parses the response flags, with cfg's CORS and
+// response rewrite (cfg may be nil). Coalescing errors are written in
+// errorFormat.
+func parseResponseFlags(cmd *cli.Command, cfg *lib.Config, errorFormat lib.ErrorFormat) (responseFlags, error) {
+	f := responseFlags{
+		cacheTTL:      cmd.Duration("cache-default-ttl"),
+		coalescePaths: cmd.StringSlice("coalesce-path"),
+		compressMin:   cmd.Int("compress-min-bytes"),
+	}
+	for _, spec := range cmd.StringSlice("cache-path") {
+		route, err := parseCachePath(spec)
+		if err != nil {
+			return f, configError(err)
+		}
+		f.cacheRoutes = append(f.cacheRoutes, route)
+	}
+	cacheMaxEntries := cmd.Int("cache-max-entries")
+	cacheMaxBytes := cmd.Int("cache-max-bytes")
+	cacheMaxEntryBytes := cmd.Int("cache-max-entry-bytes")
+	coalesceMaxBytes := cmd.Int("coalesce-max-bytes")
+	corsCfg := lib.CORSConfig{
+		AllowOrigins:     cmd.StringSlice("cors-allow-origins"),
+		AllowMethods:     cmd.StringSlice("cors-allow-methods"),
+		AllowHeaders:     cmd.StringSlice("cors-allow-headers"),
+		ExposeHeaders:    cmd.StringSlice("cors-expose-headers"),
+		MaxAge:           lib.Duration(cmd.Duration("cors-max-age")),
+		AllowCredentials: cmd.Bool("cors-allow-credentials"),
+	}
+	corsFlagSet := slices.ContainsFunc(corsFlags, cmd.IsSet)
+
+	if len(f.cacheRoutes) > 0 && (cacheMaxEntries < 1 || cacheMaxBytes < 1) {
+		return f, configErrorf("cache-max-entries and cache-max-bytes must be positive")
+	}
+	if f.compressMin < 0 {
+		return f, configErrorf("compress-min-bytes must not be negative, got %d", f.compressMin)
+	}
+	if cfg != nil && cfg.CORS != nil {
+		if corsFlagSet {
+			return f, configErrorf("CORS is configured in --config; drop the --cors-* flags")
+		}
+		corsCfg = *cfg.CORS
+	}
+	var err error
+	if len(corsCfg.AllowOrigins) > 0 {
+		if f.cors, err = lib.NewCORS(corsCfg); err != nil {
+			return f, configError(err)
+		}
+		f.corsCfg = corsCfg
+	} else if corsFlagSet || cfg != nil && cfg.CORS != nil {
+		return f, configErrorf("CORS requires allowed origins: --cors-allow-origins or \"allow_origins\" in --config")
+	}
+	if cfg != nil && cfg.ResponseRewrite != nil {
+		if f.rewrite, err = lib.NewResponseRewrite(*cfg.ResponseRewrite); err != nil {
+			return f, configError(err)
+		}
+		f.rewriteCfg = cfg.ResponseRewrite
+	}
+	if cacheMaxEntryBytes < 1 {
+		return f, configErrorf("cache-max-entry-bytes must be positive, got %d", cacheMaxEntryBytes)
+	}
+	if f.cacheTTL < 0 {
+		return f, configErrorf("cache-default-ttl cannot be negative, got %v", f.cacheTTL)
+	}
+	for _, prefix := range f.coalescePaths {
+		if !strings.HasPrefix(prefix, "/") {
+			return f, configErrorf("coalesce-path %q must start with /", prefix)
+		}
+	}
+	if coalesceMaxBytes < 1 {
+		return f, configErrorf("coalesce-max-bytes must be positive, got %d", coalesceMaxBytes)
+	}
+
+	if len(f.cacheRoutes) > 0 {
+		f.cache = lib.NewResponseCache(f.cacheRoutes, cacheMaxEntries, int64(cacheMaxBytes))
+		f.cache.SetMaxEntryBytes(int64(cacheMaxEntryBytes))
+		f.cache.SetDefaultTTL(f.cacheTTL)
+		f.cache.SetBypassHeader(cmd.String("cache-bypass-header"))
+	}
+	if len(f.coalescePaths) > 0 {
+		f.coalescer = lib.NewCoalescer(f.coalescePaths)
+		f.coalescer.SetMaxBytes(int64(coalesceMaxBytes))
+		f.coalescer.SetErrorFormat(errorFormat)
+	}
+	if cmd.Bool("compress") {
+		f.compressor = lib.NewCompressor(lib.CompressionConfig{MinBytes: int64(f.compressMin), Types: cmd.StringSlice("compress-types")})
+	}
+	return f, nil
+}
+
+func (f responseFlags) log() {
+	if f.compressor != nil {
+		log.Printf("Compression: gzip, %d bytes and up", f.compressMin)
+	}
+	if f.cors != nil {
+		log.Printf("CORS: origins %s, credentials %v", strings.Join(f.corsCfg.AllowOrigins, ", "), f.corsCfg.AllowCredentials)
+	}
+	if rr := f.rewriteCfg; rr != nil {
+		log.Printf("Response rewrite: strip headers %v, replace headers %d, remove fields %v, redact addresses %v", rr.StripHeaders, len(rr.ReplaceHeaders), rr.RemoveFields, rr.RedactAddresses)
+	}
+	for _, r := range f.cacheRoutes {
+		log.Printf("Response cache: GET %s (public: %v)", r.Prefix, r.Public)
+	}
+	if len(f.cacheRoutes) > 0 && f.cacheTTL > 0 {
+		log.Printf("Response cache: default TTL %v", f.cacheTTL)
+	}
+	for _, prefix := range f.coalescePaths {
+		log.Printf("Request coalescing: GET %s", prefix)
+	}
+}
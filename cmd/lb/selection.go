@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"go-load-balance/lib"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// selectionFlags are the flags of how a pool picks a backend: the routing
+// strategy and its settings, concurrency caps and the backends' weights.
+type selectionFlags struct {
+	routing             string
+	maxConns            int
+	affinityTTL         time.Duration
+	prefixHash          lib.PrefixHashConfig
+	reportedLoadPointer string
+	outlierDetection    bool
+	outlier             lib.OutlierConfig
+	weightTuning        bool
+	tuning              lib.WeightTuningConfig
+	slowStart           time.Duration
+	failureHalfLife     time.Duration
+	panicThreshold      float64
+	adaptiveConns       bool
+	adaptive            lib.AdaptiveConnsConfig
+	zone                string
+	zoneSpillThreshold  float64
+}
+
+func parseSelectionFlags(cmd *cli.Command) (selectionFlags, error) {
+	f := selectionFlags{
+		routing:     cmd.String("routing"),
+		maxConns:    cmd.Int("max-conns"),
+		affinityTTL: cmd.Duration("affinity-ttl"),
+		prefixHash: lib.PrefixHashConfig{
+			Fields:      cmd.StringSlice("prefix-hash-field"),
+			PrefixBytes: cmd.Int("prefix-hash-bytes"),
+			MaxBody:     cmd.Int64("prefix-hash-max-body"),
+		},
+		reportedLoadPointer: cmd.String("reported-load-pointer"),
+		outlierDetection:    cmd.Bool("outlier-detection"),
+		outlier:             lib.DefaultOutlierConfig(),
+		weightTuning:        cmd.Bool("weight-tuning"),
+		tuning:              lib.DefaultWeightTuningConfig(),
+		slowStart:           cmd.Duration("slow-start"),
+		failureHalfLife:     cmd.Duration("failure-half-life"),
+		panicThreshold:      cmd.Float("panic-mode-threshold"),
+		adaptiveConns:       cmd.Bool("adaptive-conns"),
+		adaptive: lib.AdaptiveConnsConfig{
+			Floor:         cmd.Int("adaptive-conns-floor"),
+			LatencyTarget: cmd.Duration("adaptive-latency-target"),
+		},
+		zone:               cmd.String("zone"),
+		zoneSpillThreshold: cmd.Float64("zone-spill-threshold"),
+	}
+	f.outlier.EjectionTime = cmd.Duration("outlier-ejection-time")
+	f.outlier.MaxEjectionFraction = cmd.Float64("outlier-max-ejection")
+	f.tuning.Interval = cmd.Duration("weight-tuning-interval")
+	f.tuning.MinMultiplier = cmd.Float64("weight-tuning-min")
+	f.tuning.MaxMultiplier = cmd.Float64("weight-tuning-max")
+	f.tuning.LogThreshold = cmd.Float64("weight-tuning-log-threshold")
+
+	switch f.routing {
+	case "least-conn", "cache-aware", "least-tokens", "prefix-hash", "least-reported-load", "outstanding-bytes":
+	default:
+		return f, configErrorf("routing must be least-conn, cache-aware, least-tokens, prefix-hash, least-reported-load or outstanding-bytes, got %q", f.routing)
+	}
+	if f.maxConns < 0 {
+		return f, configErrorf("max-conns cannot be negative")
+	}
+
+	if f.weightTuning {
+		if f.tuning.Interval <= 0 {
+			return f, configErrorf("weight-tuning-interval must be positive, got %v", f.tuning.Interval)
+		}
+		if f.tuning.MinMultiplier <= 0 || f.tuning.MinMultiplier > 1 || f.tuning.MaxMultiplier < 1 {
+			return f, configErrorf("weight-tuning-min must be in (0, 1] and weight-tuning-max at least 1, got %v and %v", f.tuning.MinMultiplier, f.tuning.MaxMultiplier)
+		}
+		if f.tuning.LogThreshold <= 0 {
+			return f, configErrorf("weight-tuning-log-threshold must be positive, got %v", f.tuning.LogThreshold)
+		}
+	}
+	if f.outlierDetection {
+		if f.outlier.EjectionTime <= 0 {
+			return f, configErrorf("outlier-ejection-time must be positive, got %v", f.outlier.EjectionTime)
+		}
+		if f.outlier.MaxEjectionFraction < 0 || f.outlier.MaxEjectionFraction > 1 {
+			return f, configErrorf("outlier-max-ejection must be between 0 and 1, got %v", f.outlier.MaxEjectionFraction)
+		}
+	}
+
+	if f.slowStart < 0 {
+		return f, configErrorf("slow-start cannot be negative, got %v", f.slowStart)
+	}
+	if f.failureHalfLife < 0 {
+		return f, configErrorf("failure-half-life cannot be negative, got %v", f.failureHalfLife)
+	}
+	if f.panicThreshold < 0 || f.panicThreshold > 100 {
+		return f, configErrorf("panic-mode-threshold must be between 0 and 100, got %v", f.panicThreshold)
+	}
+	if f.adaptiveConns {
+		if f.adaptive.Floor < 1 {
+			return f, configErrorf("adaptive-conns-floor must be at least 1, got %d", f.adaptive.Floor)
+		}
+		if f.maxConns > 0 && f.adaptive.Floor > f.maxConns {
+			return f, configErrorf("adaptive-conns-floor (%d) cannot exceed max-conns (%d)", f.adaptive.Floor, f.maxConns)
+		}
+		if f.adaptive.LatencyTarget <= 0 {
+			return f, configErrorf("adaptive-latency-target must be positive, got %v", f.adaptive.LatencyTarget)
+		}
+	}
+	if f.zoneSpillThreshold < 0 || f.zoneSpillThreshold > 1 {
+		return f, configErrorf("zone-spill-threshold must be between 0 and 1, got %v", f.zoneSpillThreshold)
+	}
+
+	switch f.routing {
+	case "prefix-hash":
+		if f.prefixHash.PrefixBytes < 1 {
+			return f, configErrorf("prefix-hash-bytes must be at least 1, got %d", f.prefixHash.PrefixBytes)
+		}
+		if f.prefixHash.MaxBody < 1 {
+			return f, configErrorf("prefix-hash-max-body must be at least 1, got %d", f.prefixHash.MaxBody)
+		}
+	case "cache-aware":
+		if f.maxConns == 0 {
+			return f, configErrorf("cache-aware routing requires --max-conns > 0 (its load guard and cache retention are scaled by it)")
+		}
+		if f.affinityTTL <= 0 {
+			return f, configErrorf("affinity-ttl must be positive, got %v", f.affinityTTL)
+		}
+	}
+	return f, nil
+}
+
+func (f selectionFlags) log() {
+	log.Printf("Routing: %s", f.routing)
+	if f.maxConns > 0 {
+		log.Printf("Max conns per backend: %d", f.maxConns)
+	}
+	switch f.routing {
+	case "cache-aware":
+		log.Printf("Affinity TTL: %v", f.affinityTTL)
+	case "prefix-hash":
+		log.Printf("Prefix hash: first %d bytes of %s, bodies up to %d bytes", f.prefixHash.PrefixBytes, strings.Join(f.prefixHash.Fields, " or "), f.prefixHash.MaxBody)
+	case "least-reported-load":
+		log.Printf("Reported load: %s in health responses, fresh for 2 check intervals", f.reportedLoadPointer)
+	}
+	if f.outlierDetection {
+		log.Printf("Outlier detection: eject for %v, at most %.0f%% of backends", f.outlier.EjectionTime, f.outlier.MaxEjectionFraction*100)
+	}
+	if f.weightTuning {
+		log.Printf("Weight tuning: every %v, between x%g and x%g of the static weight", f.tuning.Interval, f.tuning.MinMultiplier, f.tuning.MaxMultiplier)
+	}
+	if f.slowStart > 0 {
+		log.Printf("Slow start: %v", f.slowStart)
+	}
+	if f.failureHalfLife > 0 {
+		log.Printf("Failure memory: half-life %v", f.failureHalfLife)
+	}
+	if f.panicThreshold > 0 {
+		log.Printf("Panic mode: below %v%% healthy backends, route regardless of health", f.panicThreshold)
+	}
+	if f.adaptiveConns {
+		log.Printf("Adaptive concurrency: floor %d, latency target %v", f.adaptive.Floor, f.adaptive.LatencyTarget)
+	}
+	if f.zone != "" {
+		log.Printf("Zone: %s (spill to other zones below %.0f%% selectable)", f.zone, f.zoneSpillThreshold*100)
+	}
+}
+
+// poolOptions are the options of the --backends pool; config pools bring
+// their own.
+func (f selectionFlags) poolOptions() []lib.Option {
+	return []lib.Option{
+		lib.WithStrategy(lib.Strategy(f.routing)),
+		lib.WithMaxConns(f.maxConns),
+		lib.WithAffinityTTL(f.affinityTTL),
+		lib.WithPrefixHash(f.prefixHash),
+		lib.WithReportedLoadPointer(f.reportedLoadPointer),
+	}
+}
+
+// apply sets how pool weighs its backends.
+func (f selectionFlags) apply(pool *lib.Pool) {
+	pool.SetSlowStart(f.slowStart)
+	pool.SetFailureMemory(f.failureHalfLife)
+	pool.SetPanicThreshold(f.panicThreshold)
+	if f.adaptiveConns {
+		pool.SetAdaptiveConns(f.adaptive)
+	}
+	if f.zone != "" {
+		pool.SetZone(f.zone, f.zoneSpillThreshold)
+	}
+}
+
+// start runs pool's outlier detector and weight tuner, if enabled, until
+// ctx ends.
+func (f selectionFlags) start(ctx context.Context, pool *lib.Pool) {
+	if f.outlierDetection {
+		go lib.NewOutlierDetector(pool, f.outlier).Start(ctx)
+	}
+	if f.weightTuning {
+		go lib.NewWeightTuner(pool, f.tuning).Start(ctx)
+	}
+}
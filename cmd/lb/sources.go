@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-load-balance/lib"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Backend sources. The --backends pool takes its backends from the
+// --backends flag, then positional arguments, then $LB_BACKENDS
+// (whitespace-separated); each config file pool from its "backends". A
+// "dns+" spec from any of them is a discovery source. A backend given twice
+// for the same pool, from the same source or another, is kept from the first
+// in that order and the later one is logged as ignored, naming the source
+// that won; an address a discoverer resolves that is also given statically
+// stays the static backend. --backends-source restricts which sources are
+// read, e.g. "flag,config" to ignore a stray $LB_BACKENDS. lb validate
+// prints the merged backends with their sources.
+
+// backendsEnv is the environment variable source.
+const backendsEnv = "LB_BACKENDS"
+
+const (
+	sourceFlag      = "flag"
+	sourceArgs      = "args"
+	sourceEnv       = "env"
+	sourceConfig    = "config"
+	sourceDiscovery = "discovery"
+)
+
+// backendSources lists the sources in merge order.
+var backendSources = []string{sourceFlag, sourceArgs, sourceEnv, sourceConfig, sourceDiscovery}
+
+// sourceNames are the sources as shown in logs and lb validate.
+var sourceNames = map[string]string{
+	sourceFlag:   "--backends",
+	sourceArgs:   "arguments",
+	sourceEnv:    "$" + backendsEnv,
+	sourceConfig: "config",
+}
+
+// parseBackendSources reads --backends-source values, each a
+// comma-separated list of sources. None means every source.
+func parseBackendSources(values []string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, v := range values {
+		for name := range strings.SplitSeq(v, ",") {
+			if !slices.Contains(backendSources, name) {
+				return nil, fmt.Errorf("unknown backend source %q (want %s)", name, strings.Join(backendSources, ", "))
+			}
+			allowed[name] = true
+		}
+	}
+	if len(allowed) == 0 {
+		for _, name := range backendSources {
+			allowed[name] = true
+		}
+	}
+	return allowed, nil
+}
+
+// backendInputs are the specs each source gave.
+type backendInputs struct {
+	flag, args, env []string
+	// config is the config file's pools' backends, by pool
+	config map[string][]string
+}
+
+// sourcedBackend is a merged backend spec and the source it came from.
+type sourcedBackend struct {
+	spec   string
+	source string
+}
+
+// origin describes where the backend came from, e.g. "--backends" or
+// "config, discovery".
+func (sb sourcedBackend) origin() string {
+	if strings.HasPrefix(sb.spec, "dns+") {
+		return sourceNames[sb.source] + ", " + sourceDiscovery
+	}
+	return sourceNames[sb.source]
+}
+
+// ignoredBackend is a spec the merge left out, and why.
+type ignoredBackend struct {
+	sourcedBackend
+	reason string
+}
+
+// backendSet is the merged backends.
+type backendSet struct {
+	// cli is the --backends pool's, config each config pool's
+	cli     []sourcedBackend
+	config  map[string][]sourcedBackend
+	ignored []ignoredBackend
+}
+
+// familyPinned returns the spec of a backend pinned to an address family
+// (family=), if any.
+func (set backendSet) familyPinned() (string, bool) {
+	all := slices.Concat(set.cli, slices.Concat(slices.Collect(maps.Values(set.config))...))
+	for _, sb := range all {
+		s, err := lib.ParseBackendSpec(strings.TrimPrefix(sb.spec, "dns+"))
+		if err == nil && s.Family != "" {
+			return sb.spec, true
+		}
+	}
+	return "", false
+}
+
+// cliCheckCmd returns a --backends pool backend with a check_cmd=, if any:
+// only a config file may give one (see lib/execprobe.go).
+func (set backendSet) cliCheckCmd() (sourcedBackend, bool) {
+	for _, sb := range set.cli {
+		s, err := lib.ParseBackendSpec(strings.TrimPrefix(sb.spec, "dns+"))
+		if err == nil && s.CheckCmd != "" {
+			return sb, true
+		}
+	}
+	return sourcedBackend{}, false
+}
+
+// specs returns the backends' specs, for NewPool.
+func specs(backends []sourcedBackend) []string {
+	out := make([]string, len(backends))
+	for i, sb := range backends {
+		out[i] = sb.spec
+	}
+	return out
+}
+
+// mergeBackends merges the sources in allowed into each pool's backends.
+func mergeBackends(in backendInputs, allowed map[string]bool) (*backendSet, error) {
+	set := &backendSet{config: make(map[string][]sourcedBackend)}
+	var err error
+	set.cli, err = set.mergePool(allowed,
+		[]string{sourceFlag, sourceArgs, sourceEnv},
+		[][]string{withScheme(in.flag), withScheme(in.args), withScheme(in.env)})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(in.config)) {
+		backends, err := set.mergePool(allowed, []string{sourceConfig}, [][]string{in.config[name]})
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		if len(backends) == 0 {
+			return nil, fmt.Errorf("pool %q: no backends left from the sources --backends-source allows", name)
+		}
+		set.config[name] = backends
+	}
+	return set, nil
+}
+
+// mergePool merges one pool's sources, given in order with their specs.
+func (set *backendSet) mergePool(allowed map[string]bool, sources []string, given [][]string) ([]sourcedBackend, error) {
+	var backends []sourcedBackend
+	// first holds the backend kept for each normalized URL
+	first := make(map[string]sourcedBackend)
+	for i, source := range sources {
+		for _, spec := range given[i] {
+			sb := sourcedBackend{spec: spec, source: source}
+			discovery := strings.HasPrefix(spec, "dns+")
+			switch {
+			case !allowed[source]:
+				set.ignored = append(set.ignored, ignoredBackend{sb, "--backends-source excludes " + source})
+				continue
+			case discovery && !allowed[sourceDiscovery]:
+				set.ignored = append(set.ignored, ignoredBackend{sb, "--backends-source excludes " + sourceDiscovery})
+				continue
+			}
+			key, err := backendKey(spec)
+			if err != nil {
+				return nil, fmt.Errorf("backend %q from %s: %w", lib.RedactBackendSpec(spec), sourceNames[source], err)
+			}
+			if kept, dup := first[key]; dup {
+				set.ignored = append(set.ignored, ignoredBackend{sb, fmt.Sprintf("duplicate of %q from %s", lib.RedactBackendSpec(kept.spec), sourceNames[kept.source])})
+				continue
+			}
+			first[key] = sb
+			backends = append(backends, sb)
+		}
+	}
+	return backends, nil
+}
+
+// backendKey is the spec's normalized URL, which identifies a backend in its
+// pool whatever its attributes.
+func backendKey(spec string) (string, error) {
+	rest, discovery := strings.CutPrefix(spec, "dns+")
+	s, err := lib.ParseBackendSpec(rest)
+	if err != nil {
+		return "", err
+	}
+	id, err := lib.NormalizeBackendURL(withScheme([]string{s.URL})[0])
+	if err != nil {
+		return "", err
+	}
+	if discovery {
+		id = "dns+" + id
+	}
+	return id, nil
+}
+
+// loadBackends reads the config file, if any, and merges the backend
+// sources.
+func loadBackends(cmd *cli.Command) (*lib.Config, *backendSet, error) {
+	allowed, err := parseBackendSources(cmd.StringSlice("backends-source"))
+	if err != nil {
+		return nil, nil, configError(err)
+	}
+	in := backendInputs{
+		flag: cmd.StringSlice("backends"),
+		// Positional arguments support bash expansion:
+		// lb --backends http://localhost:800{0..2}
+		args: cmd.Args().Slice(),
+		env:  strings.Fields(os.Getenv(backendsEnv)),
+	}
+	var cfg *lib.Config
+	if path := cmd.String("config"); path != "" {
+		if cfg, err = lib.LoadConfig(path); err != nil {
+			return nil, nil, configError(err)
+		}
+		in.config = make(map[string][]string, len(cfg.Pools))
+		for name, pc := range cfg.Pools {
+			in.config[name] = pc.Backends
+		}
+	}
+	set, err := mergeBackends(in, allowed)
+	if err != nil {
+		return nil, nil, configError(err)
+	}
+	if len(set.cli) == 0 && len(set.config) == 0 {
+		return nil, nil, configErrorf("--backends is required unless --config defines pools")
+	}
+	if sb, ok := set.cliCheckCmd(); ok {
+		return nil, nil, configErrorf("backend %s from %s: check_cmd= is only accepted in a --config file", lib.RedactBackendSpec(sb.spec), sb.origin())
+	}
+	return cfg, set, nil
+}
+
+// validate is lb validate: it checks the backend sources and the config
+// file, and prints each pool's backends with their origins, redacted as
+// in the logs.
+func validate(_ context.Context, cmd *cli.Command) error {
+	cfg, set, err := loadBackends(cmd)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.Root().Writer, 0, 4, 2, ' ', 0)
+	if len(set.cli) > 0 {
+		if _, err := lib.NewPool(specs(set.cli)); err != nil {
+			return configError(err)
+		}
+		fmt.Fprintln(w, "--backends pool:")
+		for _, sb := range set.cli {
+			fmt.Fprintf(w, "  %s\t%s\n", lib.RedactBackendSpec(sb.spec), sb.origin())
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(set.config)) {
+		pc := cfg.Pools[name]
+		pc.Backends = specs(set.config[name])
+		if _, err := pc.NewPool(); err != nil {
+			return configErrorf("pool %q: %w", name, err)
+		}
+		fmt.Fprintf(w, "pool %s:\n", name)
+		for _, sb := range set.config[name] {
+			fmt.Fprintf(w, "  %s\t%s\n", lib.RedactBackendSpec(sb.spec), sb.origin())
+		}
+	}
+	if len(set.ignored) > 0 {
+		fmt.Fprintln(w, "ignored:")
+		for _, ib := range set.ignored {
+			fmt.Fprintf(w, "  %s\t%s: %s\n", lib.RedactBackendSpec(ib.spec), sourceNames[ib.source], ib.reason)
+		}
+	}
+	return w.Flush()
+}
+
+// withScheme adds http:// to specs without a scheme.
+func withScheme(specs []string) []string {
+	out := make([]string, len(specs))
+	for i, spec := range specs {
+		if !strings.Contains(spec, "://") {
+			spec = "http://" + spec
+		}
+		out[i] = spec
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"go-load-balance/lib"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v3"
+)
+
+// stateFlags are the flags of the state lb keeps beyond one process: the
+// state store restored at startup and the peers health is shared with.
+type stateFlags struct {
+	store         string
+	flushInterval time.Duration
+	healthTTL     time.Duration
+	peers         []string
+	peerListen    string
+	peerID        string
+	peerSecret    string
+}
+
+func parseStateFlags(cmd *cli.Command) (stateFlags, error) {
+	f := stateFlags{
+		store:         cmd.String("state-store"),
+		flushInterval: cmd.Duration("state-flush-interval"),
+		healthTTL:     cmd.Duration("state-health-ttl"),
+		peers:         cmd.StringSlice("peers"),
+		peerListen:    cmd.String("peer-listen"),
+		peerID:        cmd.String("peer-id"),
+		peerSecret:    cmd.String("peer-secret"),
+	}
+	for _, peer := range f.peers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return f, configErrorf("peers: %q is not host:port", peer)
+		}
+	}
+	if f.store != "" && f.flushInterval <= 0 {
+		return f, configErrorf("state-flush-interval must be positive, got %v", f.flushInterval)
+	}
+	if f.healthTTL < 0 {
+		return f, configErrorf("state-health-ttl cannot be negative, got %v", f.healthTTL)
+	}
+	return f, nil
+}
+
+func (f stateFlags) log() {
+	if f.store != "" {
+		shown := f.store
+		if u, err := url.Parse(f.store); err == nil && u.User != nil {
+			shown = u.Redacted()
+		}
+		log.Printf("State store: %s, flushed every %v", shown, f.flushInterval)
+	}
+}
+
+// openPersister opens --state-store and restores the token buckets of
+// limiter (if any) and the backends of pools from it, or returns nil
+// without a store.
+func (f stateFlags) openPersister(limiter *lib.TokenLimiter, pools map[string]*lib.Pool) (*lib.StatePersister, error) {
+	if f.store == "" {
+		return nil, nil
+	}
+	store, err := lib.OpenStateStore(f.store)
+	if err != nil {
+		return nil, configError(err)
+	}
+	persister := lib.NewStatePersister(store, f.flushInterval)
+	persister.SetHealthTTL(f.healthTTL)
+	if limiter != nil {
+		persister.TrackTokens(limiter)
+	}
+	for name, pool := range pools {
+		persister.TrackPool(name, pool)
+	}
+	if err := persister.Restore(); err != nil {
+		return nil, runtimeError(fmt.Errorf("failed to restore state from %s: %w", f.store, err))
+	}
+	return persister, nil
+}
+
+// joinPeers binds --peer-listen to share the health of pools' backends
+// with --peers, or returns nil without peers.
+func (f stateFlags) joinPeers(pools map[string]*lib.Pool) (*lib.PeerSync, error) {
+	if len(f.peers) == 0 {
+		return nil, nil
+	}
+	conn, err := net.ListenPacket("udp", f.peerListen)
+	if err != nil {
+		return nil, bindError(fmt.Errorf("peer-listen: %w", err))
+	}
+	id := f.peerID
+	if id == "" {
+		host, _ := os.Hostname()
+		_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+		id = net.JoinHostPort(host, port)
+	}
+	peerSync := lib.NewPeerSync(id, conn, f.peers)
+	if f.peerSecret != "" {
+		peerSync.SetSecret(f.peerSecret)
+	}
+	for name, pool := range pools {
+		peerSync.TrackPool(name, pool)
+	}
+	log.Printf("Peers: %s", peerSync)
+	return peerSync, nil
+}
@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Adaptive concurrency (--adaptive-conns): instead of one static --max-conns
+// guess, each backend gets its own limit discovered AIMD-style. The limit
+// starts at the floor and grows by one per limit's worth of requests that
+// came back within the latency target while the backend was using its whole
+// limit; a pressure signal — an upstream 429 or 503, time to response headers
+// over the target, or a timeout — cuts it by adaptiveBackoff. Only requests
+// started after the last cut can cut again, so one overload burst backs off
+// once rather than once per request in flight. --max-conns, when set, is the
+// ceiling. An admin pin (POST /admin/backends/conn-limit) freezes the limit
+// until released.
+
+// adaptiveBackoff is the multiplicative decrease on pressure.
+const adaptiveBackoff = 0.9
+
+var errAdaptiveConnsOff = errors.New("adaptive concurrency is not enabled")
+
+// AdaptiveConnsConfig tunes per-backend concurrency limit discovery.
+type AdaptiveConnsConfig struct {
+	// Floor is the starting and lowest limit.
+	Floor int
+	// LatencyTarget is the time to response headers above which a backend
+	// counts as overloaded.
+	LatencyTarget time.Duration
+}
+
+// connLimiter is one backend's adaptive concurrency limit.
+type connLimiter struct {
+	// current is int(limit), read by selection without the lock
+	current atomic.Int64
+
+	mu             sync.Mutex
+	limit          float64
+	floor, ceiling int // ceiling 0 = none
+	target         time.Duration
+	pinned         bool
+	lastDecrease   time.Time
+	reason         string
+	adjusted       time.Time
+	clock          Clock
+}
+
+// SetAdaptiveConns gives every backend an adaptive concurrency limit between
+// cfg.Floor and the pool's max-conns (if set), so call it after SetMaxConns
+// or EnableCacheAware. Call before serving traffic.
+func (p *Pool) SetAdaptiveConns(cfg AdaptiveConnsConfig) {
+	p.adaptive = &cfg
+	for _, b := range p.GetBackends() {
+		b.connLimit = p.newConnLimiter()
+	}
+}
+
+// newConnLimiter returns a limit starting at the floor.
+func (p *Pool) newConnLimiter() *connLimiter {
+	floor := max(1, p.adaptive.Floor)
+	if p.maxConns > 0 {
+		floor = min(floor, p.maxConns)
+	}
+	l := &connLimiter{limit: float64(floor), floor: floor, ceiling: p.maxConns, target: p.adaptive.LatencyTarget, clock: p.clock}
+	l.current.Store(int64(floor))
+	return l
+}
+
+// connCap returns the backend's concurrency cap: its adaptive limit, or the
+// static one — its own max_conns, else the pool's maxConns (0 = unlimited).
+// A max_conns also bounds the adaptive limit.
+func (b *Backend) connCap(maxConns int) int {
+	if b.maxConns > 0 {
+		maxConns = b.maxConns
+	}
+	if b.connLimit != nil {
+		limit := int(b.connLimit.current.Load())
+		if b.maxConns > 0 {
+			limit = min(limit, b.maxConns)
+		}
+		return limit
+	}
+	return maxConns
+}
+
+// observeConnLimit feeds a final upstream response to the adaptive limit.
+// inflight includes this request.
+func (b *Backend) observeConnLimit(status int, latency time.Duration, start time.Time, inflight int) {
+	l := b.connLimit
+	if l == nil || start.IsZero() {
+		return
+	}
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		l.decrease(start, fmt.Sprintf("upstream %d", status))
+	case status >= 400:
+		// Neither a sign of capacity nor of overload
+	case latency > l.target:
+		l.decrease(start, fmt.Sprintf("latency %v over target %v", latency.Round(time.Millisecond), l.target))
+	default:
+		l.increase(inflight)
+	}
+}
+
+// increase adds 1/limit, i.e. one per limit's worth of good responses. A
+// backend below its limit was not limited by it, so its good latency says
+// nothing about a higher one.
+func (l *connLimiter) increase(inflight int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pinned || inflight < int(l.limit) {
+		return
+	}
+	limit := l.limit + 1/l.limit
+	if l.ceiling > 0 {
+		limit = min(limit, float64(l.ceiling))
+	}
+	l.setLocked(limit, "increase: latency within target")
+}
+
+// decrease cuts the limit for a pressure signal on a request that started
+// at start.
+func (l *connLimiter) decrease(start time.Time, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pinned || !start.After(l.lastDecrease) {
+		return
+	}
+	l.lastDecrease = l.clock.Now()
+	l.setLocked(max(float64(l.floor), l.limit*adaptiveBackoff), "decrease: "+reason)
+}
+
+// setLocked sets the limit, recording the reason when the whole-number
+// limit changes. Caller must hold l.mu.
+func (l *connLimiter) setLocked(limit float64, reason string) {
+	prev := int(l.limit)
+	l.limit = limit
+	if int(limit) != prev {
+		l.current.Store(int64(limit))
+		l.reason, l.adjusted = reason, l.clock.Now()
+	}
+}
+
+// notePressure feeds a timeout of r to the adaptive limit.
+func (b *Backend) notePressure(r *http.Request, reason string) {
+	if start, ok := r.Context().Value(proxyStartKey{}).(time.Time); ok && b.connLimit != nil {
+		b.connLimit.decrease(start, reason)
+	}
+}
+
+// PinConnLimit pins the adaptive concurrency limit of the backend with the
+// given URL (matched like ExpectRestart's); limit 0 releases the pin and
+// the controller resumes from the pinned value, clamped to floor and ceiling.
+func (p *Pool) PinConnLimit(rawURL string, limit int) error {
+	if limit < 0 {
+		return errors.New("limit cannot be negative")
+	}
+	target, err := NormalizeBackendURL(withDefaultScheme([]string{rawURL})[0])
+	if err != nil {
+		return fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+	}
+	for _, b := range p.GetBackends() {
+		if b.ID() != target {
+			continue
+		}
+		l := b.connLimit
+		if l == nil {
+			return errAdaptiveConnsOff
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if limit > 0 {
+			l.pinned, l.limit, l.reason = true, float64(limit), "pinned by admin"
+		} else {
+			l.pinned, l.reason = false, "pin released"
+			l.limit = max(float64(l.floor), l.limit)
+			if l.ceiling > 0 {
+				l.limit = min(l.limit, float64(l.ceiling))
+			}
+		}
+		l.current.Store(int64(l.limit))
+		l.adjusted = l.clock.Now()
+		return nil
+	}
+	return fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+}
+
+// ConnLimitStats is a backend's adaptive concurrency limit in /stats.
+type ConnLimitStats struct {
+	Limit   int  `json:"limit"`
+	Floor   int  `json:"floor"`
+	Ceiling int  `json:"ceiling,omitempty"`
+	Pinned  bool `json:"pinned,omitempty"`
+	// LastAdjustment says why the limit last changed, e.g. "decrease:
+	// upstream 429".
+	LastAdjustment string     `json:"last_adjustment,omitempty"`
+	LastAdjusted   *time.Time `json:"last_adjusted,omitempty"`
+}
+
+func (l *connLimiter) stats() *ConnLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &ConnLimitStats{Limit: int(l.limit), Floor: l.floor, Ceiling: l.ceiling, Pinned: l.pinned, LastAdjustment: l.reason}
+	if !l.adjusted.IsZero() {
+		adjusted := l.adjusted
+		s.LastAdjusted = &adjusted
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestAdaptiveConnsConvergesOnCapacity drives a modelled backend whose
+// latency degrades past knee concurrent requests, with more clients than it
+// can take so it always runs at its limit; the limit must settle near the
+// knee, well under the ceiling.
+func TestAdaptiveConnsConvergesOnCapacity(t *testing.T) {
+	const knee, base = 4, 20 * time.Millisecond
+	clock := newFakeClock(time.Unix(1_000_000, 0))
+	pool, err := NewPool([]string{"http://a"}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetMaxConns(32)
+	pool.SetAdaptiveConns(AdaptiveConnsConfig{Floor: 1, LatencyTarget: 30 * time.Millisecond})
+	b := pool.GetBackends()[0]
+
+	// Each round the backend takes a limit's worth of requests at once and
+	// answers them all after the latency that many cost it.
+	round := func() {
+		n := b.connCap(0)
+		latency := base
+		if n > knee {
+			latency += time.Duration(n-knee) * base
+		}
+		start := clock.Now()
+		clock.advance(latency)
+		for range n {
+			b.observeConnLimit(http.StatusOK, latency, start, n)
+		}
+	}
+	for range 50 {
+		round()
+	}
+	var samples []int
+	for range 20 {
+		round()
+		samples = append(samples, b.connCap(0))
+	}
+
+	sum := 0
+	for _, s := range samples {
+		sum += s
+	}
+	if avg := float64(sum) / float64(len(samples)); avg < knee-1.5 || avg > knee+1.5 {
+		t.Errorf("limit averaged %.1f (samples %v), want near %d", avg, samples, knee)
+	}
+	if s := pool.Stats().Backends[0].ConnLimit; s == nil || s.Floor != 1 || s.Ceiling != 32 || s.LastAdjustment == "" {
+		t.Errorf("conn_limit stats = %+v", s)
+	}
+}
+
+func TestAdaptiveConnsBacksOffOncePerBurst(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetAdaptiveConns(AdaptiveConnsConfig{Floor: 2, LatencyTarget: time.Second})
+	b := pool.GetBackends()[0]
+	l := b.connLimit
+	l.limit = 20
+	l.current.Store(20)
+
+	// A burst of 429s from requests that started together cuts once.
+	start := time.Now()
+	for range 10 {
+		b.observeConnLimit(http.StatusTooManyRequests, 10*time.Millisecond, start, 20)
+	}
+	if got := b.connCap(0); got != 18 {
+		t.Errorf("after one burst: limit %d, want 18", got)
+	}
+	if s := l.stats(); s.LastAdjustment != "decrease: upstream 429" {
+		t.Errorf("last adjustment = %q", s.LastAdjustment)
+	}
+
+	// Later requests cut again, down to the floor and no further.
+	for range 50 {
+		b.observeConnLimit(http.StatusOK, 2*time.Second, time.Now(), 20)
+	}
+	if got := b.connCap(0); got != 2 {
+		t.Errorf("sustained slow responses: limit %d, want the floor 2", got)
+	}
+
+	// Good responses below the limit do not raise it.
+	for range 50 {
+		b.observeConnLimit(http.StatusOK, 10*time.Millisecond, time.Now(), 1)
+	}
+	if got := b.connCap(0); got != 2 {
+		t.Errorf("under-used backend: limit %d, want 2", got)
+	}
+}
+
+func TestPinConnLimit(t *testing.T) {
+	pool, err := NewPool([]string{"http://gpu-0:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.PinConnLimit("gpu-0:8000", 5); err != errAdaptiveConnsOff {
+		t.Errorf("pin without adaptive conns: err = %v", err)
+	}
+	pool.SetMaxConns(8)
+	pool.SetAdaptiveConns(AdaptiveConnsConfig{Floor: 1, LatencyTarget: time.Second})
+	b := pool.GetBackends()[0]
+
+	if err := pool.PinConnLimit("gpu-0:8000", 12); err != nil {
+		t.Fatal(err)
+	}
+	b.observeConnLimit(http.StatusServiceUnavailable, 0, time.Now(), 12)
+	if s := b.connLimit.stats(); s.Limit != 12 || !s.Pinned || s.LastAdjustment != "pinned by admin" {
+		t.Errorf("pinned: %+v, want 12 unchanged by a 503", s)
+	}
+
+	if err := pool.PinConnLimit("http://gpu-0:8000", 0); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.connLimit.stats(); s.Limit != 8 || s.Pinned {
+		t.Errorf("released: %+v, want clamped to the ceiling 8", s)
+	}
+	if err := pool.PinConnLimit("http://gpu-9:8000", 3); !IsUnknownBackend(err) {
+		t.Errorf("unknown backend: err = %v", err)
+	}
+}
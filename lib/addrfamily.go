@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Address family pinning (family=ipv4|ipv6): a backend named by a host with
+// both A and AAAA records is dialed on whichever address answers first
+// (net.Dialer's Happy Eyeballs), so with one family firewalled, health
+// checks and traffic can land on different addresses and a working backend
+// flaps. A backend given ",family=ipv4" is only ever dialed on its host's
+// IPv4 addresses (",family=ipv6": IPv6). The pin belongs to the backend's
+// host:port — and its health= URL's — in a table the dialer of every
+// transport NewTransport builds consults, and proxied requests, health
+// checks, tcp and grpc probes and prewarming all dial through the pool's
+// transport, so they cannot disagree. Unpinned hosts keep Happy Eyeballs.
+// Two backends pinning one host:port to different families are an error.
+// IPv6 literals are written bracketed, http://[fd00::1]:8000, and shown so
+// in logs, stats and admin IDs; a literal's family= must match it. A "dns+"
+// spec's family= keeps only the discovered addresses of that family.
+
+// Address families of family=.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// familyPins maps a lowercase dial address (host:port) to its family.
+var familyPins sync.Map
+
+// validFamily checks a family= value.
+func validFamily(family string) error {
+	if family != FamilyIPv4 && family != FamilyIPv6 {
+		return fmt.Errorf("family must be %s or %s, got %q", FamilyIPv4, FamilyIPv6, family)
+	}
+	return nil
+}
+
+// ipOfFamily reports whether the IP literal ip is of family.
+func ipOfFamily(ip, family string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && (parsed.To4() != nil) == (family == FamilyIPv4)
+}
+
+// dialAddress returns the host:port u is dialed at, with the scheme's
+// default port.
+func dialAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// pinFamily pins the backend's dial addresses — its URL's and its health=
+// URL's — to its family, if it has one.
+func (b *Backend) pinFamily() error {
+	if b.family == "" {
+		return nil
+	}
+	if b.socket != "" {
+		return fmt.Errorf("backend %s: family= needs a tcp backend", b.id)
+	}
+	addrs := []*url.URL{b.URL}
+	if b.healthURL != "" {
+		if u, err := url.Parse(b.healthURL); err == nil {
+			addrs = append(addrs, u)
+		}
+	}
+	for _, u := range addrs {
+		if host := u.Hostname(); net.ParseIP(host) != nil && !ipOfFamily(host, b.family) {
+			return fmt.Errorf("backend %s: %s is not an %s address", b.id, host, b.family)
+		}
+		addr := strings.ToLower(dialAddress(u))
+		if was, loaded := familyPins.LoadOrStore(addr, b.family); loaded && was != b.family {
+			return fmt.Errorf("backend %s: %s is already pinned to %s", b.id, addr, was)
+		}
+	}
+	return nil
+}
+
+// dialFamilies wraps dial to connect an address pinned to a family over
+// that family only, resolving it through resolver.
+func dialFamilies(resolver Resolver, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		family, ok := familyPins.Load(strings.ToLower(addr))
+		if !ok || network != "tcp" {
+			return dial(ctx, network, addr)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := familyAddrs(ctx, resolver, host, family.(string))
+		if err != nil {
+			return nil, err
+		}
+		network = "tcp4"
+		if family == FamilyIPv6 {
+			network = "tcp6"
+		}
+		var errs []error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// familyAddrs resolves host to its addresses of family.
+func familyAddrs(ctx context.Context, resolver Resolver, host, family string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	resolved, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, ip := range resolved {
+		if ipOfFamily(ip, family) {
+			ips = append(ips, ip)
+		}
+	}
+	if ips == nil {
+		return nil, fmt.Errorf("%s has no %s address (resolved %s)", host, family, strings.Join(resolved, ", "))
+	}
+	return ips, nil
+}
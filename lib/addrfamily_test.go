@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIPv6LiteralBackends(t *testing.T) {
+	pool, err := NewPool([]string{"http://[FD00::1]:8000,family=ipv6,zone=a", "http://[fd00::2]:80/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backendIDs(pool); !slices.Equal(got, []string{"http://[fd00::1]:8000", "http://[fd00::2]"}) {
+		t.Errorf("IDs = %v", got)
+	}
+	b, err := pool.Backend("[fd00::1]:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, addr, _ := pool.probeTarget(b); addr != "[fd00::1]:8000" || pool.HealthURL(b) != "http://[fd00::1]:8000/v1/models" {
+		t.Errorf("probe target %s, health URL %s", addr, pool.HealthURL(b))
+	}
+	if s := pool.Stats().Backends[0]; s.URL != "http://[fd00::1]:8000" {
+		t.Errorf("stats URL = %s", s.URL)
+	}
+
+	s, err := ParseBackendSpec("http://[fd00::1]:8000,family=ipv6,zone=a")
+	if err != nil || s.URL != "http://[fd00::1]:8000" || s.Family != FamilyIPv6 || s.String() != "http://[fd00::1]:8000,family=ipv6,zone=a" {
+		t.Errorf("spec = %+v, %v", s, err)
+	}
+	for _, bad := range []string{"http://[fd00::3]:8000,family=ipv4", "http://10.0.0.9,family=ipv6", "http://a,family=ipv5", "unix:///tmp/x.sock,family=ipv4"} {
+		if _, err := NewPool([]string{bad}); err == nil {
+			t.Errorf("%s: want an error", bad)
+		}
+	}
+}
+
+func TestFamilyPinnedDial(t *testing.T) {
+	if _, err := NewPool([]string{"http://dual-v6.test:8000,family=ipv6", "https://dual-v4.test,family=ipv4,health=http://dual-v4.test:9000/health"}); err != nil {
+		t.Fatal(err)
+	}
+	res := &fakeResolver{hosts: map[string][]string{
+		"dual-v6.test": {"10.0.0.1", "fd00::1"},
+		"dual-v4.test": {"fd00::2", "10.0.0.2", "10.0.0.3"},
+	}}
+	var dialed []string
+	dial := dialFamilies(res, func(_ context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		if addr == "10.0.0.2:443" {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	})
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		addr string
+		want []string
+	}{
+		{"dual-v6.test:8000", []string{"tcp6 [fd00::1]:8000"}},
+		{"dual-v4.test:443", []string{"tcp4 10.0.0.2:443", "tcp4 10.0.0.3:443"}}, // first refused
+		{"dual-v4.test:9000", []string{"tcp4 10.0.0.2:9000"}},                    // the health= URL
+		{"dual-v6.test:9000", []string{"tcp dual-v6.test:9000"}},                 // another port: not pinned
+	} {
+		dialed = nil
+		if _, err := dial(ctx, "tcp", c.addr); err != nil {
+			t.Errorf("%s: %v", c.addr, err)
+		}
+		if !slices.Equal(dialed, c.want) {
+			t.Errorf("%s dialed %v, want %v", c.addr, dialed, c.want)
+		}
+	}
+
+	res.hosts["dual-v6.test"] = []string{"10.0.0.1"}
+	dialed = nil
+	if _, err := dial(ctx, "tcp", "dual-v6.test:8000"); err == nil || !strings.Contains(err.Error(), "no ipv6 address") || dialed != nil {
+		t.Errorf("v6-pinned host with only A records: %v, dialed %v", err, dialed)
+	}
+
+	if _, err := NewPool([]string{"http://dual-v6.test:8000,family=ipv4"}); err == nil || !strings.Contains(err.Error(), "already pinned to ipv6") {
+		t.Errorf("conflicting pin: %v", err)
+	}
+}
+
+func TestFamilyPinnedProxy(t *testing.T) {
+	addrs, err := net.DefaultResolver.LookupHost(context.Background(), "localhost")
+	if err != nil || !slices.ContainsFunc(addrs, func(ip string) bool { return ipOfFamily(ip, FamilyIPv4) }) {
+		t.Skip("localhost has no IPv4 address")
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(backend.Close)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	pool, err := NewPool([]string{"http://localhost:" + port + ",family=ipv4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+)
+
+// Error responses: the errors lb answers itself (no healthy backend, a
+// proxy error, a timeout, every backend at capacity, a body over its limit,
+// a rate limit) are written in the OpenAI error format the SDKs parse,
+//
+//	{"error": {"message": "...", "type": "upstream_unavailable",
+//	           "code": "no_healthy_backends", "request_id": "..."}}
+//
+// with Content-Type application/json, or as plain text with
+// --error-format plain, for deployments whose clients are not LLM SDKs.
+// request_id is the request's X-Request-Id, else its trace ID when tracing,
+// and is left out without either. Once a response has started, an error
+// writes nothing: the client sees the response cut off instead.
+
+// ErrorFormat is how lb writes its own error responses.
+type ErrorFormat string
+
+// Error formats.
+const (
+	ErrorFormatOpenAI ErrorFormat = "openai"
+	ErrorFormatPlain  ErrorFormat = "plain"
+)
+
+// ParseErrorFormat parses --error-format.
+func ParseErrorFormat(s string) (ErrorFormat, error) {
+	switch f := ErrorFormat(s); f {
+	case ErrorFormatOpenAI, ErrorFormatPlain:
+		return f, nil
+	}
+	return "", fmt.Errorf("error format must be openai or plain, got %q", s)
+}
+
+// Error types, the "type" of the OpenAI envelope.
+const (
+	errTypeUnavailable    = "upstream_unavailable"
+	errTypeTimeout        = "upstream_timeout"
+	errTypeUpstream       = "upstream_error"
+	errTypeRateLimit      = "rate_limit_error"
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypePermission     = "permission_error"
+)
+
+// apiError is one of lb's error responses.
+type apiError struct {
+	status  int
+	typ     string
+	code    string
+	message string
+	// fields are added to the JSON error object (param, limit, ...)
+	fields map[string]any
+}
+
+// bodyTooLargeError answers a request body over its limit.
+var bodyTooLargeError = apiError{http.StatusRequestEntityTooLarge, errTypeInvalidRequest, "request_too_large", "request body too large", nil}
+
+// requestID identifies r in error bodies: its X-Request-Id, else its trace
+// ID, "" without either.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	if span := spanFromContext(r.Context()); span != nil {
+		return span.TraceID.String()
+	}
+	return ""
+}
+
+// responseStarted reports whether w, if a statusWriter, has sent its
+// response headers.
+func responseStarted(w http.ResponseWriter) bool {
+	sw, ok := w.(*statusWriter)
+	return ok && sw.status != 0
+}
+
+// write answers r with e in format f, unless its response has started.
+func (e apiError) write(w http.ResponseWriter, r *http.Request, f ErrorFormat) {
+	if responseStarted(w) {
+		return
+	}
+	if f == ErrorFormatPlain {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	obj := map[string]any{"message": e.message, "type": e.typ, "code": e.code}
+	maps.Copy(obj, e.fields)
+	if id := requestID(r); id != "" {
+		obj["request_id"] = id
+	}
+	body, _ := json.Marshal(map[string]any{"error": obj})
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(body)
+}
+
+// SetErrorFormat sets how the pool and its backends write their error
+// responses (default openai). Call before serving traffic.
+func (p *Pool) SetErrorFormat(f ErrorFormat) {
+	p.errorFormat = f
+	for _, b := range p.GetBackends() {
+		b.errorFormat = f
+	}
+}
+
+// SetErrorFormat sets how the router answers paths without a route (default
+// openai). Call before serving traffic.
+func (rt *Router) SetErrorFormat(f ErrorFormat) {
+	rt.errorFormat = f
+}
+
+// SetErrorFormat sets how the limiter writes its 429s (default openai).
+// Call before serving traffic.
+func (l *InflightLimiter) SetErrorFormat(f ErrorFormat) {
+	l.errorFormat = f
+}
+
+// SetErrorFormat sets how the limiter writes its 429s and body errors
+// (default openai). Call before serving traffic.
+func (l *TokenLimiter) SetErrorFormat(f ErrorFormat) {
+	l.errorFormat = f
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sdkError is the error envelope as the OpenAI SDKs decode it.
+type sdkError struct {
+	Error struct {
+		Message   string `json:"message"`
+		Type      string `json:"type"`
+		Code      string `json:"code"`
+		RequestID string `json:"request_id"`
+	} `json:"error"`
+}
+
+// decodeSDKError checks rec is a JSON error with status and returns it.
+func decodeSDKError(t *testing.T, rec *httptest.ResponseRecorder, status int) sdkError {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status %d, want %d: %s", rec.Code, status, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	var e sdkError
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.Error.Message == "" {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+	return e
+}
+
+func TestErrorResponsesOpenAIFormat(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		setup    func(*Pool)
+		body     string
+		status   int
+		typ      string
+		code     string
+		retryHdr bool
+	}{
+		{"no healthy backends", "http://a", func(p *Pool) { p.GetBackends()[0].MarkUnhealthy() }, "", http.StatusServiceUnavailable, errTypeUnavailable, "no_healthy_backends", false},
+		{"bad gateway", dead.URL, nil, "", http.StatusBadGateway, errTypeUpstream, "bad_gateway", false},
+		{"timeout", slow.URL, func(p *Pool) { p.SetRequestTimeout(20 * time.Millisecond) }, "", http.StatusGatewayTimeout, errTypeTimeout, "request_timeout", false},
+		{"at capacity", "http://a", func(p *Pool) { p.SetMaxConns(1); p.GetBackends()[0].IncrementConns() }, "", http.StatusTooManyRequests, errTypeRateLimit, "", true},
+		{"body too large", slow.URL, func(p *Pool) { p.SetProxyPolicy(ProxyPolicy{MaxRequestBody: 4}) }, "0123456789", http.StatusRequestEntityTooLarge, errTypeInvalidRequest, "request_too_large", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, err := NewPool([]string{tc.url})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.setup != nil {
+				tc.setup(pool)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tc.body))
+			r.Header.Set("X-Request-Id", "req-42")
+			rec := httptest.NewRecorder()
+			pool.ServeHTTP(rec, r)
+			e := decodeSDKError(t, rec, tc.status)
+			if e.Error.Type != tc.typ || (tc.code != "" && e.Error.Code != tc.code) {
+				t.Errorf("type %q code %q, want %q %q", e.Error.Type, e.Error.Code, tc.typ, tc.code)
+			}
+			if e.Error.RequestID != "req-42" {
+				t.Errorf("request_id %q, want req-42", e.Error.RequestID)
+			}
+			if got := rec.Header().Get("Retry-After") != ""; got != tc.retryHdr {
+				t.Errorf("Retry-After %q", rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestInflightRejectionOpenAIFormat(t *testing.T) {
+	l := NewInflightLimiter(3, "")
+	rec := httptest.NewRecorder()
+	l.reject(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", nil))
+	e := decodeSDKError(t, rec, http.StatusTooManyRequests)
+	if e.Error.Code != "rate_limit_exceeded" || e.Error.RequestID != "" {
+		t.Errorf("error %+v", e.Error)
+	}
+	if !strings.Contains(rec.Body.String(), `"limit":3`) {
+		t.Errorf("limit missing from %s", rec.Body)
+	}
+}
+
+func TestRouterNotFoundOpenAIFormat(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewRouter([]RouteConfig{{ID: "v1", Prefix: "/v1/", Targets: []RouteTarget{{Pool: "p", Weight: 1}}}}, map[string]*Pool{"p": pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/models", nil))
+	if e := decodeSDKError(t, rec, http.StatusNotFound); e.Error.Code != "not_found" {
+		t.Errorf("code %q", e.Error.Code)
+	}
+}
+
+func TestErrorFormatPlain(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetErrorFormat(ErrorFormatPlain)
+	pool.GetBackends()[0].MarkUnhealthy()
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if json.Valid(rec.Body.Bytes()) {
+		t.Errorf("plain body is JSON: %s", rec.Body)
+	}
+}
+
+func TestErrorAfterResponseStartedWritesNothing(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusOK)
+	_, _ = rec.WriteString("data: partial\n\n")
+	sw := &statusWriter{ResponseWriter: rec, status: http.StatusOK}
+	pool.GetBackends()[0].GetProxy().ErrorHandler(sw, httptest.NewRequest(http.MethodPost, "/v1/completions", nil), http.ErrHandlerTimeout)
+	if got := rec.Body.String(); got != "data: partial\n\n" {
+		t.Errorf("body after error %q", got)
+	}
+}
@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// API key validation (--api-keys-file): requests without a known bearer key
+// are answered 401 before they are queued, rate limited or given a backend.
+// The file lists one key per line (blank lines and # comments ignored); it
+// is re-read when its modification time changes and on SIGHUP, and a file
+// that can no longer be read, or lists no keys, keeps the previous keys.
+// /stats counts requests per key, identified by a hash prefix
+// (sha256:<12 hex>, the same on every restart, so operators can find their
+// own); keys are never logged or shown raw. The client's key is passed
+// through to backends, except to those given an upstream_key=, which get
+// Authorization: Bearer <upstream key> in its place, so clients never learn
+// backend credentials.
+
+// apiKeysPoll is how often the keys file's modification time is checked.
+const apiKeysPoll = 5 * time.Second
+
+// APIKeys validates client API keys against a keys file.
+type APIKeys struct {
+	path   string
+	clock  Clock
+	logger Logger
+	// errorFormat is how rejections are written (see apierror.go)
+	errorFormat ErrorFormat
+
+	mu      sync.Mutex
+	keys    map[string]*atomic.Uint64 // requests by key
+	modTime time.Time
+	loaded  time.Time
+
+	missing, unknown atomic.Uint64
+}
+
+// NewAPIKeys loads the keys file at path. It is an error for the file to be
+// unreadable or list no keys.
+func NewAPIKeys(path string, opts ...Option) (*APIKeys, error) {
+	k := &APIKeys{path: path, clock: clockFrom(systemClock{}, opts), logger: loggerFrom(defaultLogger(), opts)}
+	if _, err := k.reload(true); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SetErrorFormat sets how rejections are written (default openai). Call
+// before serving traffic.
+func (k *APIKeys) SetErrorFormat(f ErrorFormat) {
+	k.errorFormat = f
+}
+
+// parseAPIKeys reads one key per line, skipping blank lines and comments.
+func parseAPIKeys(data []byte) []string {
+	var keys []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// reload re-reads the file, if it changed or force is set, and reports
+// whether the keys were replaced. Request counts carry over for keys still
+// listed.
+func (k *APIKeys) reload(force bool) (bool, error) {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return false, err
+	}
+	k.mu.Lock()
+	unchanged := fi.ModTime().Equal(k.modTime)
+	k.mu.Unlock()
+	if unchanged && !force {
+		return false, nil
+	}
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return false, err
+	}
+	list := parseAPIKeys(data)
+	if len(list) == 0 {
+		return false, fmt.Errorf("%s lists no keys", k.path)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := make(map[string]*atomic.Uint64, len(list))
+	for _, key := range list {
+		if n, ok := k.keys[key]; ok {
+			keys[key] = n
+		} else {
+			keys[key] = new(atomic.Uint64)
+		}
+	}
+	k.keys, k.modTime, k.loaded = keys, fi.ModTime(), k.clock.Now()
+	return true, nil
+}
+
+// Reload re-reads the keys file now (on SIGHUP), logging the outcome.
+func (k *APIKeys) Reload() {
+	k.logReload(k.reload(true))
+}
+
+func (k *APIKeys) logReload(replaced bool, err error) {
+	switch {
+	case err != nil:
+		k.logger.Printf("[AUTH] keeping the current keys: %v", err)
+	case replaced:
+		k.logger.Printf("[AUTH] loaded %d API keys from %s", k.Len(), k.path)
+	}
+}
+
+// Start re-reads the keys file whenever it changes until ctx is done.
+func (k *APIKeys) Start(ctx context.Context) {
+	ticker := k.clock.NewTicker(apiKeysPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			k.logReload(k.reload(false))
+		}
+	}
+}
+
+// Len returns the number of keys loaded.
+func (k *APIKeys) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.keys)
+}
+
+var (
+	errMissingAPIKey = errors.New("missing API key")
+	errUnknownAPIKey = errors.New("unknown API key")
+)
+
+// check validates r's bearer key, counting the request against it.
+func (k *APIKeys) check(r *http.Request) error {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		k.missing.Add(1)
+		return errMissingAPIKey
+	}
+	k.mu.Lock()
+	n, ok := k.keys[key]
+	k.mu.Unlock()
+	if !ok {
+		k.unknown.Add(1)
+		return errUnknownAPIKey
+	}
+	n.Add(1)
+	return nil
+}
+
+// Handler wraps next with key validation.
+func (k *APIKeys) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := k.check(r); err != nil {
+			k.reject(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (k *APIKeys) reject(w http.ResponseWriter, r *http.Request, err error) {
+	message := "Incorrect API key provided."
+	if errors.Is(err, errMissingAPIKey) {
+		message = "You didn't provide an API key. Provide it in the Authorization header (Authorization: Bearer YOUR_KEY)."
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	apiError{http.StatusUnauthorized, errTypeInvalidRequest, "invalid_api_key", message, nil}.write(w, r, k.errorFormat)
+}
+
+// apiKeyHash identifies a key in /stats without revealing it.
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// APIKeyStats reports key validation in /stats: the keys loaded and when,
+// accepted requests by key hash, and requests rejected without a key or
+// with an unknown one since start.
+type APIKeyStats struct {
+	Keys          int               `json:"keys"`
+	LoadedAt      time.Time         `json:"loaded_at"`
+	Requests      map[string]uint64 `json:"requests"`
+	RejectMissing uint64            `json:"rejected_missing"`
+	RejectUnknown uint64            `json:"rejected_unknown"`
+}
+
+// Stats returns the validation counters.
+func (k *APIKeys) Stats() *APIKeyStats {
+	k.mu.Lock()
+	keys := maps.Clone(k.keys)
+	s := &APIKeyStats{Keys: len(keys), LoadedAt: k.loaded}
+	k.mu.Unlock()
+	s.Requests = make(map[string]uint64, len(keys))
+	for key, n := range keys {
+		s.Requests[apiKeyHash(key)] = n.Load()
+	}
+	s.RejectMissing, s.RejectUnknown = k.missing.Load(), k.unknown.Load()
+	return s
+}
+
+// RedactBackendSpec returns spec with its upstream_key, if any, replaced,
+// and its proxy's password masked, for logs and errors.
+func RedactBackendSpec(spec string) string {
+	if !strings.Contains(spec, ",upstream_key=") && !strings.Contains(spec, ",proxy=") {
+		return spec
+	}
+	parts := strings.Split(spec, ",")
+	for i, attr := range parts[1:] {
+		if strings.HasPrefix(attr, "upstream_key=") {
+			parts[i+1] = "upstream_key=REDACTED"
+		}
+		if raw, ok := strings.CutPrefix(attr, "proxy="); ok {
+			if u, err := url.Parse(raw); err == nil {
+				parts[i+1] = "proxy=" + u.Redacted()
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// setUpstreamKey makes the backend's requests carry key instead of the
+// client's. Before serving traffic.
+func (b *Backend) setUpstreamKey(key string) {
+	if key != "" {
+		b.decorator = staticHeader{"Authorization", "Bearer " + key}
+	}
+}
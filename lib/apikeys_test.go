@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeys writes a keys file with the given modification time.
+func writeKeys(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeysAllowDenyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	t0 := time.Now().Add(-time.Hour)
+	writeKeys(t, path, "# team a\nsk-alpha\n\n  sk-beta  \n", t0)
+	logs := &lineLogger{}
+	keys, err := NewAPIKeys(path, WithLogger(logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reached := 0
+	h := keys.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached++ }))
+	do := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for _, auth := range []string{"Bearer sk-alpha", "Bearer sk-beta", "Bearer sk-alpha"} {
+		if rec := do(auth); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d", auth, rec.Code)
+		}
+	}
+	for _, auth := range []string{"", "Bearer ", "Basic c2stYWxwaGE=", "Bearer sk-gamma"} {
+		rec := do(auth)
+		if e := decodeSDKError(t, rec, http.StatusUnauthorized); e.Error.Code != "invalid_api_key" || e.Error.Type != errTypeInvalidRequest {
+			t.Errorf("%q: error %+v", auth, e.Error)
+		}
+		if rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%q: WWW-Authenticate %q", auth, rec.Header().Get("WWW-Authenticate"))
+		}
+		if strings.Contains(rec.Body.String(), "sk-gamma") {
+			t.Errorf("rejection echoes the key: %s", rec.Body)
+		}
+	}
+	if reached != 3 {
+		t.Errorf("handler reached %d times, want 3", reached)
+	}
+	s := keys.Stats()
+	if s.Keys != 2 || s.Requests[apiKeyHash("sk-alpha")] != 2 || s.Requests[apiKeyHash("sk-beta")] != 1 || s.RejectMissing != 3 || s.RejectUnknown != 1 {
+		t.Errorf("stats %+v", s)
+	}
+	for h := range s.Requests {
+		if !strings.HasPrefix(h, "sha256:") || len(h) != len("sha256:")+12 {
+			t.Errorf("key shown as %q", h)
+		}
+	}
+
+	// An unchanged file is not re-read; a changed one replaces the keys and
+	// keeps the counts of keys still listed.
+	writeKeys(t, path, "sk-beta\nsk-gamma\n", t0)
+	if replaced, err := keys.reload(false); replaced || err != nil {
+		t.Errorf("unchanged mtime: replaced %v, %v", replaced, err)
+	}
+	writeKeys(t, path, "sk-beta\nsk-gamma\n", t0.Add(time.Minute))
+	if replaced, err := keys.reload(false); !replaced || err != nil {
+		t.Fatalf("changed mtime: replaced %v, %v", replaced, err)
+	}
+	if rec := do("Bearer sk-alpha"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("removed key: status %d", rec.Code)
+	}
+	if rec := do("Bearer sk-gamma"); rec.Code != http.StatusOK {
+		t.Errorf("added key: status %d", rec.Code)
+	}
+	if s := keys.Stats(); s.Keys != 2 || s.Requests[apiKeyHash("sk-beta")] != 1 {
+		t.Errorf("stats after reload %+v", s)
+	}
+
+	// An empty file keeps the previous keys.
+	writeKeys(t, path, "# nobody\n", t0.Add(2*time.Minute))
+	keys.Reload()
+	if rec := do("Bearer sk-gamma"); rec.Code != http.StatusOK {
+		t.Errorf("after empty reload: status %d", rec.Code)
+	}
+	if got := logs.String(); !strings.Contains(got, "[AUTH] keeping the current keys") || strings.Contains(got, "sk-") {
+		t.Errorf("logs %q", got)
+	}
+	if _, err := NewAPIKeys(path); err == nil {
+		t.Error("NewAPIKeys accepted a file with no keys")
+	}
+}
+
+func TestUpstreamKeySwap(t *testing.T) {
+	seen := make(chan string, 2)
+	backend := func() *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen <- r.Header.Get("Authorization")
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	swapped, passed := backend(), backend()
+	for _, tc := range []struct {
+		spec, want string
+	}{
+		{swapped.URL + ",upstream_key=sk-backend", "Bearer sk-backend"},
+		{passed.URL, "Bearer sk-client"},
+	} {
+		pool, err := NewPool([]string{tc.spec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+		r.Header.Set("Authorization", "Bearer sk-client")
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", tc.spec, rec.Code)
+		}
+		if got := <-seen; got != tc.want {
+			t.Errorf("%s: backend saw Authorization %q, want %q", RedactBackendSpec(tc.spec), got, tc.want)
+		}
+	}
+}
+
+func TestRedactBackendSpec(t *testing.T) {
+	for spec, want := range map[string]string{
+		"http://a:8000":                                  "http://a:8000",
+		"http://a:8000,upstream_key=sk-1,zone=a":         "http://a:8000,upstream_key=REDACTED,zone=a",
+		"dns+http://llm:8000,priority=1,upstream_key=sk": "dns+http://llm:8000,priority=1,upstream_key=REDACTED",
+	} {
+		if got := RedactBackendSpec(spec); got != want {
+			t.Errorf("RedactBackendSpec(%q) = %q, want %q", spec, got, want)
+		}
+	}
+	_, err := ParseBackendSpec("http://a,upstream_key=sk-1,decorator=aws")
+	if err == nil || strings.Contains(err.Error(), "sk-1") {
+		t.Errorf("upstream_key with decorator: %v", err)
+	}
+}
@@ -1,11 +1,16 @@
 package lib
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,72 +20,403 @@ import (
 // responds but whose real requests fail from flapping in and out of the pool.
 const healthyThreshold = 2
 
-// backendIdleConnTimeout must stay below the backends' server-side keep-alive
-// timeout (vLLM's OpenAI server hardcodes uvicorn's TIMEOUT_KEEP_ALIVE at 5s).
-// Reusing a connection the server is concurrently closing surfaces as spurious
-// EOF/reset proxy errors — ejecting healthy backends — or, on unlucky
-// interleavings, a protocol-level 400 from uvicorn's HTTP parser.
-const backendIdleConnTimeout = 3 * time.Second
-
-// backendTransport is shared by all backend proxies.
-var backendTransport = func() *http.Transport {
-	t := http.DefaultTransport.(*http.Transport).Clone()
-	t.IdleConnTimeout = backendIdleConnTimeout
-	return t
-}()
-
 // Backend represents a single backend server
 type Backend struct {
-	URL         *url.URL
-	proxy       *httputil.ReverseProxy
-	mu          sync.Mutex
-	healthy     bool
-	activeConns int
+	// URL is the normalized backend URL; its string form is the backend's ID.
+	// A unix socket backend's is the placeholder its requests are sent to
+	// instead (see unixsock.go).
+	URL *url.URL
+	id  string
+	// socket is a unix socket backend's path
+	socket string
+	// grpc is set for a grpc:// or grpcs:// backend (see grpcbackend.go)
+	grpc    bool
+	proxy   *httputil.ReverseProxy
+	mu      sync.Mutex
+	healthy bool
+	// activeConns is atomic rather than guarded by mu: it changes twice per
+	// request, and selection reads it for every backend.
+	activeConns atomic.Int64
+	// requests counts every request sent to the backend (slots reserved)
+	requests atomic.Uint64
 	// consecutive successful health checks since the last failure
 	successStreak int
+	// strikes are consecutive failures since the last success,
+	// passiveStrikes those from proxied requests; the thresholds are the
+	// pool's, 0 for the defaults (see hysteresis.go)
+	strikes, passiveStrikes              int
+	unhealthyThreshold, healthyThreshold int
+	// lastProbeOK is when a health check last passed; peerDown is set while
+	// the backend is unhealthy only on a peer's word (see peers.go)
+	lastProbeOK time.Time
+	peerDown    bool
+	// changedAt is when healthy last changed, changeReason why (see
+	// transition.go)
+	changedAt    time.Time
+	changeReason string
 	// epoch increments on every healthy->unhealthy transition; cache-aware
 	// routing stores it in affinity entries so a backend that went down (and
 	// possibly relaunched at the same URL) invalidates its old pins at once.
 	epoch uint64
+	// passive outcome stats since the outlier detector's last sweep, plus a
+	// latency EWMA across sweeps (see outlier.go)
+	successes, failures uint64
+	latencyEWMA         time.Duration
+	// ejected backends are healthy but excluded from selection by the
+	// outlier detector until ejectedUntil
+	ejected      bool
+	ejectedUntil time.Time
+	ejections    uint64
+	// final upstream responses by status class (index 1 = 1xx ... 5 = 5xx);
+	// atomic, like the other counters, so stats and metrics read them
+	// without the lock
+	responses [6]atomic.Uint64
+	// headerViolations counts responses over the header limits
+	headerViolations atomic.Uint64
+	// timeout is the spec's timeout=, 0 for none; timeouts counts requests
+	// over their deadline; deadlineHeader is the pool's (see timeout.go)
+	timeout        time.Duration
+	timeouts       atomic.Uint64
+	deadlineHeader string
+	// errorFormat is the pool's (see apierror.go)
+	errorFormat ErrorFormat
+	// forceDecompress is the pool's (see compress.go)
+	forceDecompress bool
+	// policy is the pool's response-side limits and header stripping
+	policy ProxyPolicy
+	// rewrite is the pool's (see rewrite.go)
+	rewrite *poolRewrite
+	// warmingSince starts the slow-start ramp (see slowstart.go)
+	warmingSince time.Time
+	// failMem is non-nil with --failure-half-life (see failmemory.go)
+	failMem *failureMemory
+	// outcomeOK and outcomeFailed count passive outcomes since start, and
+	// tuned is the weight multiplier a WeightTuner set (see weighttune.go)
+	outcomeOK, outcomeFailed atomic.Uint64
+	tuned                    atomic.Pointer[tunedWeight]
+	// connsOpened, connsRotated and connResetRetries count connection
+	// churn (see connrotate.go)
+	connsOpened, connsRotated, connResetRetries atomic.Uint64
+	// connsOpen and connsActive count the connections counted toward the
+	// backend and those its requests hold (see connpool.go)
+	connsOpen, connsActive atomic.Int64
+	// latency counts the durations of requests the backend served (see
+	// latency.go)
+	latency latencyHistogram
+	// cancelled counts the requests their clients cancelled, by how long
+	// the backend had been serving them (see cancel.go)
+	cancelled latencyHistogram
+	// traffic counts the bytes the backend is sent and sends back;
+	// maxMbps is the spec's max_mbps=, 0 for no limit (see bandwidth.go)
+	traffic backendTraffic
+	maxMbps float64
+	// pathPrefix is the spec's prefix=, stripPrefix the pool's
+	// --strip-prefix, both escaped (see pathrewrite.go)
+	pathPrefix, stripPrefix string
+	// family is the spec's family=, "" for either (see addrfamily.go)
+	family string
+	// expected-restart window (see restart.go); restartSeenDown is set once
+	// the backend has gone down inside it
+	restartUntil    time.Time
+	restartSeenDown bool
+	// manualUntil ends a manual health override (see override.go)
+	manualUntil time.Time
+	// drained is set by an operator for maintenance (see drain.go);
+	// signalDrained by the backend's drain signal, drainSignals counting the
+	// responses that carried it, and drainSignal is the pool's header (see
+	// drainsignal.go)
+	drained       bool
+	signalDrained bool
+	drainSignals  uint64
+	drainSignal   string
+	// startup state (see startup.go): addedAt starts the startupGrace; ready
+	// is set by the first passing health check; starting while probes say
+	// not ready inside the grace, startupFailed once the grace ran out
+	addedAt        time.Time
+	startupGrace   time.Duration
+	ready          bool
+	starting       bool
+	startingLogged time.Time
+	startupFailed  bool
+	// spec is the spec the backend was built from, its URL the one given
+	// (see newSpecBackend)
+	spec BackendSpec
+	// priority is the backend's tier, lower preferred (see priority.go)
+	priority int
+	// maxConns is the spec's max_conns, overriding the pool's when > 0
+	maxConns int
+	// healthURL is the spec's health=, "" to probe the pool's health path
+	// (see healthcheck.go)
+	healthURL string
+	// check is the spec's check=, "" for the pool's probe kind (see
+	// prober.go)
+	check string
+	// labels are the spec's key=value attributes, fixed at creation (see
+	// locality.go)
+	labels map[string]string
+	// connLimit is non-nil with --adaptive-conns (see adaptive.go)
+	connLimit *connLimiter
+	// share scales a discovered backend's selection weight by its SRV
+	// weight, in (0, 1]; 0 means 1 (see discovery.go)
+	share float64
+	// removed is set once the backend has left its pool (RemoveBackend)
+	removed bool
+	// onRotation is its pool's refreshSnapshot, called after the backend
+	// enters or leaves rotation (see snapshot.go); nil outside a pool
+	onRotation func()
+	// retired ends the requests in flight on a replaced backend whose drain
+	// timed out (see replace.go)
+	retired context.Context
+	retire  context.CancelCauseFunc
+	// discoveredBy is the "dns+" spec whose discoverer owns the backend, ""
+	// for a static one (see discovery.go)
+	discoveredBy string
+	// decorator adds credentials to the backend's requests, decoratorName
+	// is the spec's decorator=; degraded is why it last failed, "" when it
+	// did not (see decorator.go)
+	decorator     RequestDecorator
+	decoratorName string
+	degraded      string
+	// hooks are the pool's state change hooks, nil without any (see
+	// notify.go)
+	hooks *stateHooks
+	// checkCmd is the check_cmd exec probes run; execSince is when the
+	// running one started, 0 while none is (see execprobe.go)
+	checkCmd  []string
+	execSince atomic.Int64
+	// history is the pool's transition history, nil for a backend outside
+	// a pool (see report.go)
+	history *transitionHistory
+	// tokens is non-nil in least-tokens routing mode (see tokenload.go)
+	tokens *tokenGauge
+	// outBytes is non-nil in outstanding-bytes routing mode (see
+	// outbytes.go)
+	outBytes *atomic.Int64
+	// viaProxy is the backend's own forward proxy (proxy=), transport the
+	// one derived for it from the pool's, both nil without (see
+	// fwdproxy.go)
+	viaProxy  *url.URL
+	transport *http.Transport
+	// probeLatency is the backend's recent probe durations (see
+	// probelatency.go)
+	probeLatency probeLatency
+	// sendProxy is the spec's send_proxy=, "" for none (see proxyproto.go)
+	sendProxy string
+	// reported is the load the backend last reported at reportedAt;
+	// reportMissing is set while its health responses carry none (see
+	// reportedload.go)
+	reported      float64
+	reportedAt    time.Time
+	reportMissing bool
+	// nextProbe is when the health checker next probes the backend;
+	// probing is set while a probe runs (see healthcheck.go)
+	nextProbe time.Time
+	probing   bool
+	// tracer is the pool's, nil without tracing (see trace.go)
+	tracer *Tracer
+	// clock is the pool's (see clock.go)
+	clock Clock
+	// logger is the pool's (see options.go)
+	logger Logger
+}
+
+// ID identifies the backend in logs, stats and admin requests: its
+// normalized URL.
+func (b *Backend) ID() string {
+	return b.id
+}
+
+// latencyEWMAAlpha weights each new response-header latency sample.
+const latencyEWMAAlpha = 0.1
+
+// proxyStartKey carries the proxy start time to ModifyResponse.
+type proxyStartKey struct{}
+
+// NormalizeBackendURL returns the canonical form of a backend URL, which is
+// also the backend's ID: lowercase scheme and host, no default port, no
+// trailing slash. A path is kept and prefixes every proxied request and
+// health check (http://h/api proxies /v1/models to /api/v1/models). Only
+// absolute http(s) URLs with a host are accepted, without a query string or
+// fragment, unix:// URLs of an absolute socket path (see unixsock.go), and
+// grpc(s)://host:port URLs without a path (see grpcbackend.go).
+func NormalizeBackendURL(rawURL string) (string, error) {
+	s := strings.TrimSpace(rawURL)
+	if s == "" {
+		return "", errors.New("empty backend URL")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid backend URL %q: %w", rawURL, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "unix" {
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+			return "", fmt.Errorf("invalid backend URL %q: want unix:///path/to/socket", rawURL)
+		}
+		return "unix://" + path.Clean(u.Path), nil
+	}
+	grpc := scheme == "grpc" || scheme == "grpcs"
+	if scheme != "http" && scheme != "https" && !grpc {
+		return "", fmt.Errorf("invalid backend URL %q: scheme must be http, https, grpc, grpcs or unix", rawURL)
+	}
+	if grpc && (u.Port() == "" || strings.Trim(u.Path, "/") != "") {
+		return "", fmt.Errorf("invalid backend URL %q: want %s://host:port", rawURL, scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid backend URL %q: missing host", rawURL)
+	}
+	if u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", fmt.Errorf("invalid backend URL %q: query strings and fragments are not allowed", rawURL)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+	if port := u.Port(); port != "" && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+	return scheme + "://" + host + strings.TrimRight(u.EscapedPath(), "/"), nil
 }
 
 // NewBackend creates a new Backend instance
-func NewBackend(urlStr string) (*Backend, error) {
-	u, err := url.Parse(urlStr)
+func NewBackend(urlStr string, opts ...Option) (*Backend, error) {
+	id, err := NormalizeBackendURL(urlStr)
 	if err != nil {
 		return nil, err
 	}
+	u, err := url.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	var socket string
+	grpc := false
+	switch u.Scheme {
+	case "unix":
+		socket = u.Path
+		u = &url.URL{Scheme: "http", Host: unixSocketHost(socket)}
+	case "grpc":
+		grpc, u = true, &url.URL{Scheme: "http", Host: u.Host}
+	case "grpcs":
+		grpc, u = true, &url.URL{Scheme: "https", Host: u.Host}
+	}
 
 	b := &Backend{
 		URL:     u,
+		id:      id,
+		socket:  socket,
+		grpc:    grpc,
 		proxy:   httputil.NewSingleHostReverseProxy(u),
 		healthy: true, // Start as healthy, health checker will update
+		clock:   clockFrom(systemClock{}, opts),
+		logger:  loggerFrom(defaultLogger(), opts),
+	}
+	b.addedAt = b.clock.Now()
+	b.changedAt = b.addedAt
+	b.retired, b.retire = context.WithCancelCause(context.Background())
+	b.setTransport(defaultTransport, defaultUploadTransport)
+	director := b.proxy.Director
+	b.proxy.Director = func(r *http.Request) {
+		escaped := r.URL.EscapedPath()
+		director(r)
+		b.rewritePath(r.URL, escaped)
+		b.setDeadlineHeader(r)
+		if b.tracer != nil {
+			spanFromContext(r.Context()).inject(r.Header) // the attempt's client span
+		}
 	}
-	b.proxy.Transport = backendTransport
 
 	// Mark backend unhealthy immediately on proxy error, but only if the
-	// error is from the backend (not the client dropping the connection).
+	// error is from the backend (not the client dropping the connection or
+	// a body limit being hit, see failclass.go).
 	b.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		if r.Context().Err() != nil {
-			// Client cancelled — not the backend's fault
-			log.Printf("[PROXY] %s client disconnected: %v", u.String(), err)
-			return
+		if b.tracer != nil {
+			spanFromContext(r.Context()).recordError(err)
 		}
-		if b.MarkUnhealthy() {
-			log.Printf("[HEALTH] %s marked as unhealthy (proxy error: %v)", u.String(), err)
+		class := ClassifyFailure(err, nil, r.Context())
+		switch class {
+		case FailureRequestTimeout:
+			// Over the request timeout — not a backend failure either
+			b.logger.Printf("[PROXY] %s request timed out after %v", id, requestElapsed(r, b.clock.Now()))
+			b.timeouts.Add(1)
+			b.notePressure(r, "request timeout")
+			apiError{http.StatusGatewayTimeout, errTypeTimeout, "request_timeout", "Gateway Timeout: request timeout exceeded", nil}.write(w, r, b.errorFormat)
+		case FailureClientCancelled:
+			switch cause := context.Cause(r.Context()); {
+			case errors.Is(cause, errHedgeLost):
+				// the other attempt answered the client (see hedge.go)
+			case errors.Is(cause, errBackendRetired):
+				b.logger.Printf("[PROXY] %s request cut off: %v", id, errBackendRetired)
+				apiError{http.StatusServiceUnavailable, errTypeUnavailable, "backend_replaced", "Service Unavailable: backend replaced", nil}.write(w, r, b.errorFormat)
+			default:
+				// Client cancelled — not the backend's fault; counted in
+				// Pool.proxy (see cancel.go)
+				b.logger.Printf("[PROXY] %s client disconnected after %v: %v", id, requestElapsed(r, b.clock.Now()), err)
+			}
+		case FailureClient4xx:
+			bodyTooLargeError.write(w, r, b.errorFormat)
+		case FailureRejected:
+			b.logger.Printf("[PROXY] %s %v", id, err)
+			if errors.Is(err, errResponseTooLarge) {
+				apiError{http.StatusBadGateway, errTypeUpstream, "response_too_large", "Bad Gateway: backend response body too large", nil}.write(w, r, b.errorFormat)
+				return
+			}
+			// No credentials: the backend was never asked, and is already
+			// degraded
+			apiError{http.StatusBadGateway, errTypeUpstream, "upstream_credentials", "Bad Gateway: no credentials for the backend", nil}.write(w, r, b.errorFormat)
+		case FailureBackend5xx:
+			// Response headers over the limits, already counted as a
+			// failed outcome by ModifyResponse.
+			b.strike(err.Error(), true)
+			apiError{http.StatusBadGateway, errTypeUpstream, "response_headers_too_large", "Bad Gateway: backend response headers too large", nil}.write(w, r, b.errorFormat)
+		default:
+			if isTimeout(err) {
+				b.notePressure(r, "timeout")
+			}
+			if class.CountsAsFailure() {
+				b.recordOutcome(false, 0)
+			}
+			if class.FlipsHealth() {
+				b.strike("proxy error: "+rootCause(err), true)
+			}
+			apiError{http.StatusBadGateway, errTypeUpstream, "bad_gateway", "Bad Gateway: backend unreachable or failed", nil}.write(w, r, b.errorFormat)
 		}
-		w.WriteHeader(http.StatusBadGateway)
 	}
 
-	// Mark backend unhealthy on 5xx responses. 4xx (including 429) are the
-	// client's or the rate limiter's business, not a sign the backend is down.
+	// Mark backend unhealthy on 5xx responses (with failure memory, count them
+	// against its score instead, see failmemory.go). 4xx (including 429) are
+	// the client's or the rate limiter's business, not a sign the backend is
+	// down, and 3xx are successes. ModifyResponse only sees the final
+	// response: 1xx interim responses (100 Continue, 103 Early Hints) are
+	// forwarded to the client by ReverseProxy as they arrive.
 	b.proxy.ModifyResponse = func(resp *http.Response) error {
-		if resp.StatusCode >= 500 {
-			if b.MarkUnhealthy() {
-				log.Printf("[HEALTH] %s marked as unhealthy (status: %d)", u.String(), resp.StatusCode)
-			}
+		var latency time.Duration
+		start, ok := resp.Request.Context().Value(proxyStartKey{}).(time.Time)
+		if ok {
+			latency = b.clock.Now().Sub(start)
+		}
+		b.watchDrainSignal(resp.Header)
+		headersOK, err := b.applyResponsePolicy(resp)
+		b.countResponse(resp.StatusCode)
+		b.observeConnLimit(resp.StatusCode, latency, start, b.GetActiveConns())
+		if headersOK && b.watchGRPCStatus(resp, latency) {
+			return err
+		}
+		class := ClassifyFailure(err, resp, resp.Request.Context())
+		b.recordOutcome(!class.CountsAsFailure() && headersOK, latency)
+		if class.FlipsHealth() && resp.StatusCode >= 500 {
+			// other failures go on to the ErrorHandler, which flips
+			b.failedResponse(fmt.Sprintf("status: %d", resp.StatusCode))
+		}
+		if err == nil {
+			err = b.rewriteResponse(resp)
+		}
+		if err == nil {
+			b.decompress(resp)
+			b.watchUsage(resp)
+			b.watchOutstanding(resp)
 		}
-		return nil
+		return err
 	}
 
 	return b, nil
@@ -98,16 +434,70 @@ func (b *Backend) IsHealthy() bool {
 // state transition worth logging.
 func (b *Backend) MarkUnhealthy() bool {
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	wasHealthy := b.markUnhealthyLocked(b.clock.Now(), "marked unhealthy")
+	b.mu.Unlock()
+	if wasHealthy {
+		b.rotationChanged()
+	}
+	return wasHealthy
+}
+
+// markUnhealthyLocked is MarkUnhealthy, for reason. Caller must hold b.mu.
+func (b *Backend) markUnhealthyLocked(now time.Time, reason string) bool {
 	wasHealthy := b.healthy
 	b.healthy = false
 	b.successStreak = 0
+	b.peerDown = false
 	if wasHealthy {
 		b.epoch++
+		b.setTransitionLocked(now, reason)
+	}
+	if b.restartingLocked(now) {
+		b.restartSeenDown = true
 	}
 	return wasHealthy
 }
 
+// strike counts a failure, passive for a proxied request's, and marks the
+// backend unhealthy and logs the transition when its strikes reach the
+// unhealthy threshold (see hysteresis.go). Inside an expected-restart
+// window the outage was announced, so it is logged as such rather than as a
+// failure; a backend that has yet to pass a health check inside its startup
+// grace is left for the health checker to report (see startup.go).
+func (b *Backend) strike(reason string, passive bool) {
+	b.mu.Lock()
+	now := b.clock.Now()
+	if b.overriddenLocked(now) {
+		b.mu.Unlock()
+		return // see override.go
+	}
+	b.strikes++
+	if passive {
+		b.passiveStrikes++
+	}
+	if unhealthy, _ := b.thresholdsLocked(); b.healthy && b.strikes < unhealthy {
+		b.mu.Unlock()
+		return
+	}
+	reason = strikesReason(reason, b.strikes, b.passiveStrikes)
+	wasHealthy := b.markUnhealthyLocked(now, reason)
+	restarting, awaiting := b.restartingLocked(now), b.awaitingStartupLocked(now)
+	b.mu.Unlock()
+	if wasHealthy {
+		b.rotationChanged()
+	}
+	switch {
+	case !wasHealthy, awaiting:
+		return
+	case restarting:
+		b.logger.Printf("[HEALTH] %s down for expected restart (%s)", b.ID(), reason)
+		b.hooks.fire(b, false, "expected restart: "+reason)
+		return
+	}
+	b.logger.Printf("[HEALTH] %s marked as unhealthy (%s)", b.ID(), reason)
+	b.hooks.fire(b, false, reason)
+}
+
 // Epoch returns the backend's current health epoch.
 func (b *Backend) Epoch() uint64 {
 	b.mu.Lock()
@@ -115,42 +505,140 @@ func (b *Backend) Epoch() uint64 {
 	return b.epoch
 }
 
-// RecordCheckSuccess records a successful health check. An unhealthy backend
-// becomes healthy again only after healthyThreshold consecutive successes.
-// It returns true if this call transitioned the backend to healthy.
+// RecordCheckSuccess records a successful health check, which clears the
+// backend's strikes. An unhealthy backend becomes healthy again only after
+// its healthy threshold of consecutive successes (one, if only a peer
+// reported it down), and then rejoins through slow start; recovering ends an
+// expected-restart window early, and a starting backend's startup. It returns
+// true if this call transitioned the backend to healthy.
 func (b *Backend) RecordCheckSuccess() bool {
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	recovered := b.recordCheckSuccessLocked()
+	b.mu.Unlock()
+	if recovered {
+		b.rotationChanged()
+	}
+	return recovered
+}
+
+// recordCheckSuccessLocked is RecordCheckSuccess. Caller must hold b.mu.
+func (b *Backend) recordCheckSuccessLocked() bool {
+	now := b.clock.Now()
+	b.lastProbeOK = now
+	b.clearStrikesLocked()
 	if b.healthy {
+		b.ready = true
 		return false
 	}
 	b.successStreak++
-	if b.successStreak < healthyThreshold {
+	// Down on a peer's word only: one local pass outweighs it.
+	if _, healthy := b.thresholdsLocked(); b.successStreak < healthy && !b.peerDown {
 		return false
 	}
-	b.healthy = true
+	b.healthy, b.peerDown = true, false
+	if b.starting {
+		b.setTransitionLocked(now, "ready")
+	} else {
+		b.setTransitionLocked(now, "health checks passing")
+	}
+	b.ready, b.starting, b.startupFailed = true, false, false
+	b.startSlowStartLocked(now)
+	if b.restartingLocked(now) && b.restartSeenDown {
+		b.restartUntil = time.Time{}
+	}
 	return true
 }
 
 // GetActiveConns returns the number of active connections
 func (b *Backend) GetActiveConns() int {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.activeConns
+	return int(b.activeConns.Load())
 }
 
 // IncrementConns increments the active connection count
 func (b *Backend) IncrementConns() {
+	b.activeConns.Add(1)
+	b.requests.Add(1)
+}
+
+// TotalRequests returns the number of requests sent to the backend.
+func (b *Backend) TotalRequests() uint64 {
+	return b.requests.Load()
+}
+
+// DecrementConns decrements the active connection count. A count going
+// negative means a slot was released twice — a bug: it is logged and the
+// count clamped to zero so selection is not skewed toward this backend.
+func (b *Backend) DecrementConns() {
+	if n := b.activeConns.Add(-1); n < 0 {
+		b.logger.Printf("[BUG] %s active connection count went negative (%d); clamping to 0", b.ID(), n)
+		b.activeConns.CompareAndSwap(n, 0)
+	}
+}
+
+// serveProxy proxies r to the backend, stamping the start time so
+// ModifyResponse can measure time to response headers, and counting its
+// bytes (see bandwidth.go).
+func (b *Backend) serveProxy(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), proxyStartKey{}, b.clock.Now()))
+	if b.sendProxy != "" {
+		r = withProxyClient(r)
+	}
+	w = b.countTraffic(w, r)
+	// The ErrorHandler writes nothing once the response has started.
+	b.proxy.ServeHTTP(&statusWriter{ResponseWriter: w}, r)
+}
+
+// recordOutcome records a passive success (with its response-header
+// latency) or failure for outlier detection. Outcomes inside an expected
+// restart window, or before the backend first passed a health check inside
+// its startup grace, are not its steady-state behavior and are dropped.
+func (b *Backend) recordOutcome(ok bool, latency time.Duration) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.activeConns++
+	now := b.clock.Now()
+	if ok {
+		b.clearStrikesLocked()
+	}
+	if b.restartingLocked(now) || b.awaitingStartupLocked(now) {
+		return
+	}
+	b.failMem.record(ok, now)
+	if !ok {
+		b.outcomeFailed.Add(1)
+		b.failures++
+		return
+	}
+	b.outcomeOK.Add(1)
+	b.successes++
+	if latency <= 0 {
+		return
+	}
+	if b.latencyEWMA == 0 {
+		b.latencyEWMA = latency
+	} else {
+		b.latencyEWMA += time.Duration(latencyEWMAAlpha * float64(latency-b.latencyEWMA))
+	}
 }
 
-// DecrementConns decrements the active connection count
-func (b *Backend) DecrementConns() {
+// countResponse counts a final upstream response in its status class.
+func (b *Backend) countResponse(code int) {
+	if class := code / 100; class >= 1 && class <= 5 {
+		b.responses[class].Add(1)
+	}
+}
+
+// available reports whether the backend may be selected: healthy, not ejected
+// as an outlier, not drained for an expected restart, for maintenance or by
+// its drain signal, not degraded by its request decorator, and still in its
+// pool.
+func (b *Backend) available() bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.activeConns--
+	return b.availableLocked(b.clock.Now())
+}
+
+func (b *Backend) availableLocked(now time.Time) bool {
+	return b.healthy && !b.ejected && !b.restartingLocked(now) && !b.drained && !b.signalDrained && b.degraded == "" && !b.removed
 }
 
 // GetProxy returns the reverse proxy for this backend
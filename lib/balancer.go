@@ -1,11 +1,17 @@
 package lib
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math"
-	"math/rand"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -17,30 +23,192 @@ var (
 // backpressure, not an outage, so it is reported as a provider-style 429 —
 // crucially a 4xx, which an upstream lb (two-tier deployments) passes through
 // without marking this instance's node unhealthy. No healthy backends is a
-// real outage: 503.
-func writeSelectError(w http.ResponseWriter, err error) {
+// real outage: 503. Retry-After is 1s, or with load hints the expected wait
+// for a slot (see loadhints.go).
+func (p *Pool) writeSelectError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errResponded) {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return // the client gave up while queued; nobody is listening
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		apiError{http.StatusGatewayTimeout, errTypeTimeout, "queue_timeout", "Gateway Timeout: request timeout exceeded while queued", nil}.write(w, r, p.errorFormat)
+		return
+	}
+	if errors.Is(err, errTenantQueueFull) {
+		w.Header().Set("Retry-After", p.retryAfter())
+		apiError{http.StatusTooManyRequests, errTypeRateLimit, "rate_limit_exceeded", "Rate limit reached: too many of your requests are already queued, please retry later.", nil}.write(w, r, p.errorFormat)
+		return
+	}
 	if errors.Is(err, errAtCapacity) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Retry-After", "1")
-		w.WriteHeader(http.StatusTooManyRequests)
-		_, _ = w.Write([]byte(`{"error":{"message":"Rate limit reached: all backends at max concurrent requests, please retry later.","type":"rate_limit_error","code":"rate_limit_exceeded"}}`))
+		w.Header().Set("Retry-After", p.retryAfter())
+		apiError{http.StatusTooManyRequests, errTypeRateLimit, "rate_limit_exceeded", "Rate limit reached: all backends at max concurrent requests, please retry later.", nil}.write(w, r, p.errorFormat)
 		return
 	}
-	http.Error(w, "Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+	if p.hints != nil {
+		w.Header().Set("Retry-After", p.retryAfter())
+	}
+	apiError{http.StatusServiceUnavailable, errTypeUnavailable, "no_healthy_backends", "Service Unavailable: " + err.Error(), nil}.write(w, r, p.errorFormat)
 }
 
 // Pool manages a collection of backends
 type Pool struct {
-	backends []*Backend
-	mu       sync.RWMutex
+	// snap is what selection reads (see snapshot.go); mu serializes its
+	// rebuilds and membership changes
+	snap atomic.Pointer[poolSnapshot]
+	mu   sync.Mutex
 	// maxConns caps concurrent proxied requests per backend (0 = unlimited).
 	// Backends at the cap are skipped by selection; if every healthy backend
-	// is at the cap the request is rejected with 503 (hard limit, no queue).
+	// is at the cap the request is rejected with 429, or waits in the queue.
 	maxConns int
+	// queue is non-nil when --queue-size is set (see queue.go)
+	queue *admissionQueue
 	// affinity is non-nil in cache-aware routing mode (see cacheaware.go)
 	affinity *affinityState
+	// tokens is non-nil in least-tokens routing mode (see tokenload.go)
+	tokens *tokenLoad
+	// prefixHash is non-nil in prefix-hash routing mode (see prefixhash.go)
+	prefixHash *prefixHash
+	// reported is non-nil in least-reported-load routing mode (see
+	// reportedload.go)
+	reported *reportedLoad
+	// outBytes is set in outstanding-bytes routing mode (see outbytes.go)
+	outBytes bool
 	// reqlog is non-nil when --log-to is set (see reqlog.go)
 	reqlog *RequestLog
+	// debug is non-nil when --debug-headers is set (see debug.go)
+	debug *DecisionLog
+	// hints is non-nil when --load-hints is set (see loadhints.go)
+	hints *loadHints
+	// startup recognizes backends still starting (see startup.go)
+	startup StartupConfig
+	// transport is shared by the backend proxies and the health checker
+	transport *http.Transport
+	// uploadTransport is transport's clone for streaming uploads
+	uploadTransport *http.Transport
+	// name identifies the pool in logs when a config file defines several
+	name string
+	// policy bounds bodies and strips headers (see policy.go)
+	policy ProxyPolicy
+	// slowStart is the ramp-up window for recovered backends (0 = off)
+	slowStart time.Duration
+	// failureHalfLife is the decay of backends' failure scores (0 = off,
+	// see failmemory.go)
+	failureHalfLife time.Duration
+	// slowThreshold logs slower requests, 0 for none (see latency.go)
+	slowThreshold time.Duration
+	// stripPrefix is removed from request paths before proxying (see
+	// pathrewrite.go)
+	stripPrefix string
+	// drainTimeout bounds a replaced backend's requests in flight, 0 for
+	// none (see replace.go)
+	drainTimeout time.Duration
+	// requestTimeout bounds each request unless its route overrides it
+	// (0 = unlimited; see timeout.go)
+	requestTimeout time.Duration
+	// deadlineHeader carries a request's remaining time to the backend, ""
+	// for none (see timeout.go)
+	deadlineHeader string
+	// drainSignal is the response header a backend drains itself with, ""
+	// for none (see drainsignal.go)
+	drainSignal string
+	// errorFormat is how lb's own errors are written (see apierror.go)
+	errorFormat ErrorFormat
+	// forceDecompress decompresses gzipped responses for clients that do
+	// not accept gzip (see compress.go)
+	forceDecompress bool
+	// unhealthyThreshold and healthyThreshold are the backends' (see
+	// hysteresis.go)
+	unhealthyThreshold, healthyThreshold int
+	// rewrite redacts backend identity from responses, nil for none (see
+	// rewrite.go)
+	rewrite *poolRewrite
+	// tiered is set when backends have different priorities; activeTier is
+	// the priority the last selection picked from. Both are atomic: tiered
+	// is written under mu, activeTier swapped by selections (see
+	// priority.go).
+	tiered     atomic.Bool
+	activeTier atomic.Int64
+	// adaptive is non-nil with --adaptive-conns, for backends added later
+	adaptive *AdaptiveConnsConfig
+	// discovery holds the "dns+" backend specs (see discovery.go)
+	discovery []string
+	// zone is lb's own zone with --zone, zoneSpill the selectable fraction
+	// of its backends below which traffic spills to other zones;
+	// zoneSpilling is swapped by selections and atomic for stats (see
+	// locality.go)
+	zone         string
+	zoneSpill    float64
+	zoneSpilling atomic.Bool
+	// panicThreshold is the healthy percentage below which selection
+	// ignores health; panicking is written under mu and atomic for stats
+	// (see panic.go)
+	panicThreshold float64
+	panicking      atomic.Bool
+	// mirror is non-nil with --mirror (see mirror.go)
+	mirror *mirror
+	// hedge is non-nil with --hedge-after (see hedge.go)
+	hedge *hedging
+	// replay is non-nil when request bodies are recorded for replay (see
+	// replay.go)
+	replay *bodyReplay
+	// shedder is shared by the pools, nil without load shedding (see
+	// shed.go)
+	shedder *Shedder
+	// priorities is shared by the pools, nil without request priorities
+	// (see reqpriority.go)
+	priorities *RequestPriorities
+	// chaos is shared by the pools, nil without failure injection (see
+	// chaos.go)
+	chaos *Chaos
+	// healthPath is probed under each backend's URL, "" for
+	// DefaultHealthPath (see healthcheck.go)
+	healthPath string
+	// healthCheck is the probe kind of backends without their own, "" for
+	// http; grpcService is the service grpc probes ask about (see
+	// prober.go)
+	healthCheck, grpcService string
+	// decorators are the request decorators by name, for backends added
+	// later (see decorator.go)
+	decorators Decorators
+	// hooks is non-nil once a state change hook is registered (see
+	// notify.go)
+	hooks *stateHooks
+	// noExec turns exec probes off (see execprobe.go)
+	noExec bool
+	// tracker holds the requests in flight at the backends (see reaper.go)
+	tracker requestTracker
+	// rescheduleChecks wakes the pool's health checkers after a manual
+	// override moved a probe (see override.go)
+	rescheduleChecks []func()
+	// history remembers the backends' last health transitions (see
+	// report.go)
+	history *transitionHistory
+	// headerRoutes is non-nil with config header_routes (see
+	// headerroute.go)
+	headerRoutes *headerRouting
+	// tracer is non-nil with --otlp-endpoint (see trace.go)
+	tracer *Tracer
+	// clock is the time source of the pool and its backends (see clock.go)
+	clock Clock
+	// logger receives the log lines of the pool and its backends (see
+	// options.go)
+	logger Logger
+	// lifetime is cancelled by Close, stopping the pool's background
+	// goroutines (see options.go)
+	lifetime context.Context
+	close    context.CancelFunc
+}
+
+// SetName names the pool for status logging. Call before serving traffic.
+func (p *Pool) SetName(name string) {
+	p.name = name
+}
+
+// Name returns the pool's name, "" for an unnamed pool.
+func (p *Pool) Name() string {
+	return p.name
 }
 
 // SetRequestLog enables request/response pair logging (--log-to).
@@ -55,124 +223,502 @@ func (p *Pool) SetMaxConns(n int) {
 	p.maxConns = n
 }
 
-// NewPool creates a new backend pool
-func NewPool(backendURLs []string) (*Pool, error) {
+// NewPool creates a new backend pool from backend URLs, each optionally
+// suffixed with ",priority=N" and ",key=value" labels (see ParseBackendSpec).
+// A "dns+" URL is a discovery spec: its
+// backends are added once a Discoverer resolves it (see discovery.go). The
+// pool's clock and logger are also its backends' and the default of the
+// components built on it (health checker, status logger, outlier
+// detector). opts may also set its strategy, per-backend cap and transport
+// (see options.go).
+func NewPool(backendURLs []string, opts ...Option) (*Pool, error) {
 	if len(backendURLs) == 0 {
 		return nil, errors.New("at least one backend is required")
 	}
 
+	p := &Pool{
+		transport:       defaultTransport,
+		uploadTransport: defaultUploadTransport,
+		clock:           clockFrom(systemClock{}, opts),
+		logger:          loggerFrom(defaultLogger(), opts),
+		history:         newTransitionHistory(DefaultTransitionHistory),
+	}
+	p.lifetime, p.close = context.WithCancel(context.Background())
 	backends := make([]*Backend, 0, len(backendURLs))
-	for _, urlStr := range backendURLs {
-		backend, err := NewBackend(urlStr)
+	seen := make(map[string]string, len(backendURLs))
+	for _, spec := range backendURLs {
+		if strings.HasPrefix(spec, discoveryPrefix) {
+			if _, err := parseDiscoverySpec(spec); err != nil {
+				return nil, err
+			}
+			p.discovery = append(p.discovery, spec)
+			continue
+		}
+		s, err := ParseBackendSpec(spec)
 		if err != nil {
 			return nil, err
 		}
+		backend, err := newSpecBackend(s, p.clock, p.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.attachTransport(backend)
+		backend.history = p.history
+		// A duplicate would get twice the traffic and count twice toward
+		// capacity.
+		if first, dup := seen[backend.ID()]; dup {
+			p.logger.Printf("Ignoring duplicate backend %q (same as %q)", s.URL, first)
+			continue
+		}
+		seen[backend.ID()] = s.URL
+		backend.onRotation = p.refreshSnapshot
 		backends = append(backends, backend)
 	}
+	p.publishLocked(backends)
+	p.refreshTiersLocked(backends)
+	if err := p.applyPoolOptions(applyOptions(opts)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// refreshTiersLocked recomputes tiered after the backend set changed to
+// backends, resetting the active tier to the lowest when there is only one.
+// Callers must hold p.mu (or own an unshared pool).
+func (p *Pool) refreshTiersLocked(backends []*Backend) {
+	tiered, lowest := false, 0
+	for i, b := range backends {
+		if i == 0 || b.priority < lowest {
+			lowest = b.priority
+		}
+		tiered = tiered || b.priority != backends[0].priority
+	}
+	p.tiered.Store(tiered)
+	if !tiered {
+		p.activeTier.Store(int64(lowest))
+	}
+}
+
+// AddBackend adds a backend (a spec as for NewPool) to a pool that may already be
+// serving. It gets the pool's transport, proxy policy and adaptive limit,
+// and joins through slow start. A backend already in the pool is an error.
+func (p *Pool) AddBackend(spec string) (*Backend, error) {
+	s, err := ParseBackendSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return p.addBackend(s, true, "")
+}
+
+// addBackend adds a backend owned by the discoverer of the spec discoveredBy,
+// or a static one when it is "".
+func (p *Pool) addBackend(s BackendSpec, warm bool, discoveredBy string) (*Backend, error) {
+	b, err := p.newBackend(s, discoveredBy)
+	if err != nil {
+		return nil, err
+	}
+	if warm {
+		b.startSlowStartLocked(p.clock.Now()) // not shared yet: no lock needed
+	}
 
-	return &Pool{
-		backends: backends,
-	}, nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.snapshot().backends
+	for _, existing := range current {
+		if existing.ID() == b.ID() {
+			return nil, fmt.Errorf("backend %q is already in the pool", b.ID())
+		}
+	}
+	// Copy on write: GetBackends callers keep iterating the old slice.
+	backends := append(slices.Clip(current), b)
+	p.publishLocked(backends)
+	p.refreshTiersLocked(backends)
+	p.prefixHash.rebuildLocked(backends)
+	return b, nil
+}
+
+// newSpecBackend creates a backend with s's attributes, and nothing of a
+// pool's: every backend is built here, so each attribute a spec can carry
+// is set in one place, and a replacement (see replace.go) or discovered
+// backend gets all of them.
+func newSpecBackend(s BackendSpec, clock Clock, logger Logger) (*Backend, error) {
+	b, err := NewBackend(s.URL, WithClock(clock), WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	b.spec = s
+	b.priority, b.labels, b.maxConns = s.Priority, s.Labels, s.MaxConns
+	b.healthURL, b.check, b.timeout = s.Health, s.Check, s.Timeout
+	b.checkCmd = strings.Fields(s.CheckCmd)
+	b.decoratorName = s.Decorator
+	b.setUpstreamKey(s.UpstreamKey)
+	b.pathPrefix, b.maxMbps, b.family = s.Prefix, s.MaxMbps, s.Family
+	if err := b.pinFamily(); err != nil {
+		return nil, err
+	}
+	if err := b.setForwardProxy(s.Proxy); err != nil {
+		return nil, err
+	}
+	b.sendProxy = s.SendProxy
+	return b, nil
 }
 
-// leastConnLocked returns the healthy backend with the fewest active
-// connections (random tie-break) and its index, skipping backends at the
-// maxConns cap. Callers must hold p.mu.
-func (p *Pool) leastConnLocked() (*Backend, int, error) {
-	minConns := math.MaxInt
-	var least []*Backend
-	var leastIdx []int
+// newBackend creates a backend for s with the pool's settings, not yet in
+// the pool.
+func (p *Pool) newBackend(s BackendSpec, discoveredBy string) (*Backend, error) {
+	b, err := newSpecBackend(s, p.clock, p.logger)
+	if err != nil {
+		return nil, err
+	}
+	b.discoveredBy = discoveredBy
+	b.deadlineHeader = p.deadlineHeader
+	b.drainSignal = p.drainSignal
+	b.errorFormat = p.errorFormat
+	b.forceDecompress = p.forceDecompress
+	b.startupGrace = p.startup.Grace
+	b.stripPrefix = p.stripPrefix
+	if err := b.attachDecorator(p.decorators); err != nil {
+		return nil, err
+	}
+	b.policy, b.rewrite = p.policy, p.rewrite
+	b.unhealthyThreshold, b.healthyThreshold = p.unhealthyThreshold, p.healthyThreshold
+	b.hooks, b.history = p.hooks, p.history
+	b.tracer = p.tracer
+	if p.tokens != nil {
+		b.tokens = &tokenGauge{load: p.tokens}
+	}
+	if p.outBytes {
+		b.outBytes = &atomic.Int64{}
+	}
+	b.failMem = newFailureMemory(p.failureHalfLife)
+	b.onRotation = p.refreshSnapshot
+	p.attachTransport(b)
+	if p.adaptive != nil {
+		b.connLimit = p.newConnLimiter()
+	}
+	return b, nil
+}
+
+// RemoveBackend takes the backend with the given URL (matched like
+// ExpectRestart's) out of the pool and returns it. New requests stop going
+// to it at once; requests in flight on it finish. A backend discovery added
+// is left to its discoverer (see discovery.go).
+func (p *Pool) RemoveBackend(rawURL string) (*Backend, error) {
+	return p.removeBackend(rawURL, "")
+}
+
+// removeBackend removes a backend owned by discoveredBy, as for addBackend.
+func (p *Pool) removeBackend(rawURL, discoveredBy string) (*Backend, error) {
+	target, err := NormalizeBackendURL(withDefaultScheme([]string{rawURL})[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.snapshot().backends
+	i := slices.IndexFunc(current, func(b *Backend) bool { return b.ID() == target })
+	if i < 0 {
+		return nil, fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+	}
+	b := current[i]
+	if b.discoveredBy != discoveredBy {
+		if b.discoveredBy != "" {
+			return nil, fmt.Errorf("backend %s is managed by discovery (%s)", b.ID(), b.discoveredBy)
+		}
+		return nil, fmt.Errorf("backend %s was not added by %s", b.ID(), discoveredBy)
+	}
+	b.mu.Lock()
+	b.removed = true // for holders of the old slice and cache-aware pins
+	b.mu.Unlock()
+	backends := slices.Delete(slices.Clone(current), i, i+1)
+	p.publishLocked(backends)
+	p.refreshTiersLocked(backends)
+	p.prefixHash.rebuildLocked(backends)
+	if a := p.affinity; a != nil {
+		a.forget(b)
+	}
+	return b, nil
+}
+
+// leastConn returns the healthy backend in s with the fewest active
+// connections (random tie-break), skipping backends at their cap: the
+// pool's maxConns or their own max_conns, their adaptive limit (see
+// adaptive.go), or their max_mbps= (see bandwidth.go). Only the lowest
+// priority tier with such a backend is considered (see priority.go), and
+// with --zone only its backends in lb's zone unless traffic spills (see
+// locality.go). Backends in slow-start, discovered backends with a lower
+// SRV weight and backends with recent failures count as more loaded and
+// have a proportionally lower cap (see slowstart.go, discovery.go,
+// failmemory.go). In outstanding-bytes routing the pick is the better of two
+// candidates drawn at random (see outbytes.go). except, if non-nil, is not
+// considered, nor are backends without every label of match (see
+// headerroute.go). Nothing is reserved: the pick carries the active count to
+// reserve it at.
+func (p *Pool) leastConn(s *poolSnapshot, except *Backend, match map[string]string) (pick, error) {
+	now := p.clock.Now()
+	var least pick
+	ties := 0
+	two := p.newTwoChoice()
 	anyHealthy := false
-	for i, b := range p.backends {
-		if !b.IsHealthy() {
+	tier, healthyTier := math.MaxInt, math.MaxInt
+	candidates := p.candidates(s)
+	for i := range candidates {
+		e := &candidates[i]
+		b := e.b
+		if b == except || !b.hasLabels(match) {
+			continue
+		}
+		ok, count, load := p.load(e, now)
+		if !ok {
 			continue
 		}
 		anyHealthy = true
-		c := b.GetActiveConns()
-		if p.maxConns > 0 && c >= p.maxConns {
+		healthyTier = min(healthyTier, b.priority)
+		if math.IsInf(load, 1) || b.priority > tier {
 			continue
 		}
-		switch {
-		case c < minConns:
-			minConns = c
-			least = append(least[:0], b)
-			leastIdx = append(leastIdx[:0], i)
-		case c == minConns:
-			least = append(least, b)
-			leastIdx = append(leastIdx, i)
+		if b.priority < tier {
+			tier, least, ties = b.priority, pick{}, 0
+			two.reset()
 		}
+		least.consider(b, count, load, &ties)
+		two.consider(pick{b, count, load})
 	}
 
-	if len(least) == 0 {
+	if least.b == nil {
 		if anyHealthy {
-			return nil, -1, errAtCapacity
+			return pick{}, errAtCapacity
 		}
-		return nil, -1, errNoHealthyBackends
+		return pick{}, errNoHealthyBackends
 	}
 
-	k := rand.Intn(len(least)) // #nosec G404 -- tie-break among equally loaded backends, not security-sensitive
-	return least[k], leastIdx[k], nil
+	least = two.choose(least)
+	p.noteTier(tier, tier > healthyTier)
+	if p.zone != "" {
+		if local, ok := p.localLeast(s, now, tier, except, match); ok {
+			least = local
+		}
+	}
+	return least, nil
+}
+
+// load reports whether e's backend is selectable (never while blackholed,
+// see chaos.go, or restarting) and, if so, its active count and its load
+// with one more request: active connections (plus reported tokens or load,
+// see tokenload.go and reportedload.go) over its slow-start, SRV,
+// failure-memory and tuned weight, or +Inf at its cap or over its
+// max_mbps=.
+func (p *Pool) load(e *selectEntry, now time.Time) (bool, int, float64) {
+	b := e.b
+	if p.chaos.blackholed(b, true) || e.restarting(now) {
+		return false, 0, 0
+	}
+	weight := e.weight(now, p.slowStart) * b.failMem.weight(now) * b.weightMultiplier()
+	c := b.GetActiveConns()
+	if limit := b.connCap(p.maxConns); limit > 0 && c >= slowStartCap(limit, weight) {
+		return true, c, math.Inf(1)
+	}
+	if b.overBandwidth(now) {
+		return true, c, math.Inf(1)
+	}
+	if p.tokens != nil {
+		if load, ok := p.tokens.tokenLoadOf(b, c, now); ok {
+			return true, c, load / weight
+		}
+	}
+	if p.reported != nil {
+		if load, ok := p.reported.reportOf(b, now); ok {
+			return true, c, (load + float64(c+1)) / weight
+		}
+	}
+	return true, c, float64(c+1) / weight
 }
 
 // SelectBackend selects the healthy backend with the fewest active
 // connections, breaking ties randomly, and reserves a connection slot on it
-// before returning. Selection and increment happen under the pool lock, so
-// concurrent selections each see the previous pick's slot and a simultaneous
-// burst distributes within ±1 instead of herding onto one idle backend.
+// before returning. It takes no lock: selection reads the pool's snapshot
+// (see snapshot.go) and reserves the slot only if the backend's count is
+// still the one it read, selecting again otherwise, so concurrent
+// selections each see the previous pick's slot and a simultaneous burst
+// distributes within ±1 instead of herding onto one idle backend.
 // The caller must release the slot with DecrementConns when done.
 func (p *Pool) SelectBackend() (*Backend, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	return p.selectBackendExcept(nil, nil)
+}
 
-	backend, _, err := p.leastConnLocked()
-	if err != nil {
-		return nil, err
+// selectBackendExcept is SelectBackend without considering except, nor
+// backends without every label of match.
+func (p *Pool) selectBackendExcept(except *Backend, match map[string]string) (*Backend, error) {
+	for {
+		least, err := p.leastConn(p.snapshot(), except, match)
+		if err != nil {
+			return nil, err
+		}
+		if least.b.reserveConn(least.count) {
+			return least.b, nil
+		}
 	}
-	backend.IncrementConns()
-	return backend, nil
 }
 
 // ServeHTTP implements http.Handler interface
 func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.tracer != nil {
+		var span *Span
+		span, r = p.tracer.startServer(r, r.Method,
+			Attribute{"http.request.method", r.Method}, Attribute{"url.path", r.URL.Path}, Attribute{"lb.pool", metricsPoolName(p)})
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			if sw.status != 0 {
+				span.setHTTPStatus(sw.status)
+			}
+			span.end()
+		}()
+	}
+	timing, w := p.beginTiming(w, r)
+	defer timing.finish()
+	var dbg *debugRecord
+	if p.debug != nil {
+		dbg, w = p.beginDebug(w, r)
+		defer dbg.finish()
+	}
+	if p.hints != nil {
+		w = p.hints.writer(w)
+	}
 	var rec *reqLogCapture
 	if p.reqlog != nil {
 		rec, w = p.reqlog.begin(w, r)
 		defer rec.finish()
 	}
 
-	if p.affinity != nil {
-		p.serveCacheAware(w, r, rec)
+	prio := PriorityNormal
+	if p.priorities != nil {
+		prio = p.priorities.classify(r)
+		r = r.WithContext(withPriority(r.Context(), prio))
+	}
+	if !p.shedder.admit(prio) {
+		p.writeShed(w, r)
+		return
+	}
+	defer p.shedder.done()
+	if !p.applyRequestPolicy(w, r) {
 		return
 	}
+	if rules := p.chaos.active(); rules != nil && !p.injectChaos(w, r, rules, rec, timing) {
+		return
+	}
+	_, upload := streamingUpload(r)
+	if upload {
+		r.GetBody = nil // never replayed (see upload.go)
+	} else {
+		cleanup := p.recordBody(r)
+		defer cleanup()
+		p.mirrorRequest(r)
+	}
+
+	ctx, cancel := p.requestContext(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
 
-	backend, err := p.SelectBackend()
+	p.hedge.count()
+	if p.affinity != nil && !upload {
+		p.serveCacheAware(w, r, rec, dbg, timing)
+		return
+	}
+
+	route := p.headerRoutes.match(r)
+	selectBackend := p.selectFor(route)
+	if p.prefixHash != nil && !upload {
+		key, ok, err := p.prefixHash.key(r)
+		if err != nil {
+			writeBodyError(w, r, p.errorFormat, err)
+			return
+		}
+		if ok {
+			selectBackend = p.selectHashed(key, route, selectBackend)
+		}
+	}
+	backend, err := p.admit(w, r, selectBackend)
 	if err != nil {
-		writeSelectError(w, err)
+		p.writeSelectError(w, r, err)
 		return
 	}
 	rec.setBackend(backend)
+	dbg.setBackend(backend)
+	timing.setBackend(backend)
 
 	// Connection slot was reserved by SelectBackend
-	defer backend.DecrementConns()
+	if p.hedge != nil && !upload && hedgeable(r) {
+		p.serveHedged(w, r, backend, route.labels(), rec, dbg, timing)
+		return
+	}
+	p.proxy(w, r, backend, 1)
+}
 
-	// Proxy the request
-	backend.GetProxy().ServeHTTP(w, r)
+// proxy serves r on backend, whose connection slot the caller reserved, and
+// releases the slot exactly once, also when the proxy panics. ReverseProxy
+// panics with http.ErrAbortHandler to abort a response whose body copy
+// failed; any other panic is logged with its stack. Either way the panic is
+// passed on as http.ErrAbortHandler, so the server drops the connection
+// without logging it a second time. attempt counts the request's attempts
+// at a backend, hedges included, for its trace span.
+func (p *Pool) proxy(w http.ResponseWriter, r *http.Request, backend *Backend, attempt int) {
+	if p.tracer != nil {
+		_, upload := streamingUpload(r)
+		span, ctx := p.tracer.start(r.Context(), r.Method, SpanKindClient,
+			Attribute{"lb.backend", backend.ID()}, Attribute{"lb.strategy", p.strategy(upload)}, Attribute{"lb.attempt", int64(attempt)},
+			Attribute{"http.request.method", r.Method}, Attribute{"url.path", r.URL.Path})
+		r = r.WithContext(ctx)
+		sw := &statusWriter{ResponseWriter: w}
+		w = sw
+		defer func() {
+			if sw.status != 0 {
+				span.setHTTPStatus(sw.status)
+			}
+			span.end()
+		}()
+	}
+	ctx, cancel := backend.requestContext(r.Context())
+	defer cancel()
+	r, release := p.track(r.WithContext(ctx), backend)
+	defer release()
+	start := p.clock.Now()
+	defer func() {
+		backend.DecrementConns()
+		p.wakeQueued()
+		elapsed := p.clock.Now().Sub(start)
+		cancelled := clientCancelled(r.Context())
+		if cancelled {
+			backend.noteCancelled(elapsed)
+		}
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				p.logger.Printf("[PROXY] %s panic: %v\n%s", backend.ID(), v, debug.Stack())
+			} else if cancelled {
+				p.logger.Printf("[PROXY] %s client disconnected mid-response after %v", backend.ID(), elapsed.Round(time.Millisecond))
+			} else if timedOut(r.Context()) {
+				backend.timeouts.Add(1)
+				p.logger.Printf("[PROXY] %s request timed out mid-response after %v", backend.ID(), elapsed.Round(time.Millisecond))
+			} else if errors.Is(context.Cause(r.Context()), errBackendRetired) {
+				p.logger.Printf("[PROXY] %s request cut off mid-response: %v", backend.ID(), errBackendRetired)
+			}
+			panic(http.ErrAbortHandler)
+		}
+	}()
+	backend.serveProxy(w, r)
 }
 
-// GetBackends returns all backends (for health checking and status logging)
+// GetBackends returns all backends (for health checking and status
+// logging). The slice is shared: never modify it.
 func (p *Pool) GetBackends() []*Backend {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	return p.backends
+	return p.snapshot().backends
 }
 
 // GetStatus returns current pool status
 func (p *Pool) GetStatus() (totalActive int, healthyCount int, totalCount int) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-
-	totalCount = len(p.backends)
-	for _, b := range p.backends {
+	backends := p.GetBackends()
+	totalCount = len(backends)
+	for _, b := range backends {
 		if b.IsHealthy() {
 			healthyCount++
 		}
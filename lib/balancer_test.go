@@ -0,0 +1,324 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestActiveConnsReturnToZero hammers a pool with thousands of concurrent
+// requests, mixing successes, backend 5xx, responses aborted mid-body (the
+// proxy panics with http.ErrAbortHandler) and backends dropping the
+// connection (ErrorHandler). Every reserved slot must be released exactly
+// once. Run with -race.
+func TestActiveConnsReturnToZero(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("kind") {
+		case "5xx":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "abort":
+			_ = http.NewResponseController(w).Flush()
+			_, _ = w.Write([]byte("partial"))
+			panic(http.ErrAbortHandler)
+		case "drop":
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	})
+	var urls []string
+	for range 3 {
+		backend := httptest.NewServer(handler)
+		defer backend.Close()
+		urls = append(urls, backend.URL)
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pool.GetBackends()); n != 3 {
+		t.Fatalf("pool has %d backends, want 3", n)
+	}
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	// Failures mark backends unhealthy; keep them selectable so every
+	// request reaches the proxy.
+	revive := func() {
+		for _, b := range pool.GetBackends() {
+			b.mu.Lock()
+			b.healthy = true
+			b.mu.Unlock()
+		}
+	}
+
+	kinds := []string{"ok", "ok", "5xx", "abort", "drop"}
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 200}}
+	defer client.CloseIdleConnections()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 200)
+	for i := range 3000 {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			if i%50 == 0 {
+				revive()
+			}
+			resp, err := client.Get(lb.URL + "/v1/completions?kind=" + kinds[i%len(kinds)])
+			if err == nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+		})
+	}
+	wg.Wait()
+
+	for _, b := range pool.GetBackends() {
+		if n := b.GetActiveConns(); n != 0 {
+			t.Errorf("%s: %d active connections after all requests finished", b.URL, n)
+		}
+	}
+}
+
+func TestDecrementConnsClampsAtZero(t *testing.T) {
+	b, err := NewBackend("http://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.IncrementConns()
+	b.DecrementConns()
+	b.DecrementConns() // double release
+	if n := b.GetActiveConns(); n != 0 {
+		t.Fatalf("active conns = %d after a double release, want clamped to 0", n)
+	}
+	b.IncrementConns()
+	if n := b.GetActiveConns(); n != 1 {
+		t.Fatalf("active conns = %d, want 1", n)
+	}
+}
+
+func TestNormalizeBackendURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"http://HOST:80/":            "http://host",
+		"http://host":                "http://host",
+		"HTTPS://Gpu-1:443":          "https://gpu-1",
+		"http://gpu-1:8000//":        "http://gpu-1:8000",
+		"https://gpu-1:80":           "https://gpu-1:80",
+		"http://[::1]:80":            "http://[::1]",
+		"http://[::1]:8000":          "http://[::1]:8000",
+		" http://host/api/ ":         "http://host/api",
+		"http://host/Case/Sensitive": "http://host/Case/Sensitive",
+		"UNIX:///var/run//vllm.sock": "unix:///var/run/vllm.sock",
+		"GRPC://Gpu-1:50051/":        "grpc://gpu-1:50051",
+		"grpcs://gpu-1:443":          "grpcs://gpu-1:443",
+	} {
+		got, err := NormalizeBackendURL(raw)
+		if err != nil || got != want {
+			t.Errorf("NormalizeBackendURL(%q) = %q, %v; want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "  ", "http://", "http://:8000", "ftp://host", "host:8000", "/v1", "http://host/?x=1", "http://host?", "http://host#frag", "http://host:port",
+		"unix://var/run/vllm.sock", "unix:vllm.sock", "unix:///var/run/vllm.sock?x=1", "grpc://gpu-1", "grpc://gpu-1:50051/pkg.Service"} {
+		if got, err := NormalizeBackendURL(raw); err == nil {
+			t.Errorf("NormalizeBackendURL(%q) = %q, want an error", raw, got)
+		}
+	}
+}
+
+func TestNewPoolDeduplicates(t *testing.T) {
+	out := captureLog(t)
+	pool, err := NewPool([]string{"http://HOST:80/", "http://other", "http://host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, b := range pool.GetBackends() {
+		ids = append(ids, b.ID())
+	}
+	if len(ids) != 2 || ids[0] != "http://host" || ids[1] != "http://other" {
+		t.Errorf("backends = %v, want [http://host http://other]", ids)
+	}
+	if !strings.Contains(out.String(), `duplicate backend "http://host"`) {
+		t.Errorf("duplicate not logged:\n%s", out)
+	}
+
+	if _, err := NewPool([]string{"http://a", "http://"}); err == nil {
+		t.Error("NewPool accepted http://")
+	}
+}
+
+// TestPerBackendMaxConnsNeverExceeded sends a burst far over two backends'
+// max_conns at once. Slots are reserved at selection, so the backends never
+// see more than their caps, the first fills and overflows to the second, and
+// the rest get 429 without reaching either.
+func TestPerBackendMaxConnsNeverExceeded(t *testing.T) {
+	gate := make(chan struct{})
+	capped := func(inFlight, peak *atomic.Int64) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			<-gate
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	var inA, peakA, inB, peakB atomic.Int64
+	a, b := capped(&inA, &peakA), capped(&inB, &peakB)
+	pool, err := NewPool([]string{a.URL + ",max_conns=2", b.URL + ",max_conns=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetMaxConns(100) // the backends' own caps win
+
+	const n = 50
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			rec := httptest.NewRecorder()
+			pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes <- rec.Code
+		})
+	}
+	rejected := 0
+	for rejected < n-5 {
+		if code := <-codes; code != http.StatusTooManyRequests {
+			t.Fatalf("got %d before the admitted requests finished, want 429", code)
+		}
+		rejected++
+	}
+	for inA.Load()+inB.Load() < 5 {
+		runtime.Gosched() // the admitted requests are still on their way
+	}
+	for _, bs := range pool.Stats().Backends {
+		if bs.State != "at capacity" {
+			t.Errorf("%s state %q with every slot taken, want at capacity", bs.URL, bs.State)
+		}
+	}
+	out := captureLog(t)
+	NewStatusLogger(pool, time.Second, true).logStatus()
+	if !strings.Contains(out.String(), " - at capacity, 2 active") || !strings.Contains(out.String(), " - at capacity, 3 active") {
+		t.Errorf("verbose status does not show the backends at capacity:\n%s", out)
+	}
+	close(gate)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("admitted request got %d", code)
+		}
+	}
+	if peakA.Load() != 2 || peakB.Load() != 3 {
+		t.Errorf("peak concurrency a=%d b=%d, want exactly the caps 2 and 3", peakA.Load(), peakB.Load())
+	}
+}
+
+// TestSelectBackendDistribution checks the random tie-break among equally
+// loaded backends: each gets its share within 5%, pools of two included,
+// and backends with more connections get none until the others catch up.
+func TestSelectBackendDistribution(t *testing.T) {
+	const picks = 30000
+	count := func(pool *Pool) map[string]int {
+		counts := map[string]int{}
+		for range picks {
+			b, err := pool.SelectBackend()
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[b.ID()]++
+			b.DecrementConns()
+		}
+		return counts
+	}
+	for _, urls := range [][]string{
+		{"http://a", "http://b"},
+		{"http://a", "http://b", "http://c", "http://d"},
+	} {
+		pool, err := NewPool(urls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := picks / len(urls)
+		for id, n := range count(pool) {
+			if n < want*95/100 || n > want*105/100 {
+				t.Errorf("%d backends: %s selected %d times, want %d ±5%%", len(urls), id, n, want)
+			}
+		}
+	}
+
+	pool, err := NewPool([]string{"http://a", "http://b", "http://c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := pool.GetBackends()[0]
+	loaded.IncrementConns()
+	counts := count(pool)
+	if counts[loaded.ID()] != 0 || counts["http://b"] < picks*45/100 || counts["http://c"] < picks*45/100 {
+		t.Errorf("with one backend busy: %v", counts)
+	}
+}
+
+func BenchmarkSelectBackend(b *testing.B) {
+	urls := make([]string, 8)
+	for i := range urls {
+		urls[i] = "http://gpu-" + strconv.Itoa(i)
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			backend, err := pool.SelectBackend()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			backend.DecrementConns()
+		}
+	})
+}
+
+// stubTransport answers every request with an empty 200 without dialing.
+type stubTransport struct{}
+
+func (stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	urls := make([]string, 8)
+	for i := range urls {
+		urls[i] = "http://gpu-" + strconv.Itoa(i)
+	}
+	pool, err := NewPool(urls, WithLogger(&lineLogger{}))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, backend := range pool.GetBackends() {
+		backend.proxy.Transport = stubTransport{}
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+			if w.Code != http.StatusOK {
+				b.Errorf("status %d", w.Code)
+				return
+			}
+		}
+	})
+}
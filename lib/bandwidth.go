@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bandwidth accounting (always on) and throughput limits (a backend's
+// max_mbps=): a request count says nothing about payload size, and a
+// backend behind a thin link can be swamped by a few large responses. Each
+// backend counts the body bytes it is sent (request bodies, as the proxy
+// reads them) and the body bytes it sends back (responses, as they are
+// written to the client, streamed or not), by wrapping the reader and
+// writer the proxy already copies through, so no buffer is copied an extra
+// time. Each direction also keeps a bytes-per-second gauge decaying with
+// time constant bandwidthWindow. A backend whose response throughput is
+// over its max_mbps= (megabits per second) is skipped by selection, like
+// one at its max_conns, until the gauge decays back under the limit.
+
+// bandwidthWindow is the time constant of the throughput gauges.
+const bandwidthWindow = 10 * time.Second
+
+// byteGauge is a decaying bytes-per-second rate.
+type byteGauge struct {
+	mu   sync.Mutex
+	rate float64 // as of last
+	last time.Time
+}
+
+// decayedLocked returns the rate at now. Caller must hold g.mu.
+func (g *byteGauge) decayedLocked(now time.Time) float64 {
+	if g.last.IsZero() {
+		return 0
+	}
+	return g.rate * math.Exp(-now.Sub(g.last).Seconds()/bandwidthWindow.Seconds())
+}
+
+func (g *byteGauge) add(n int, now time.Time) {
+	g.mu.Lock()
+	g.rate = g.decayedLocked(now) + float64(n)/bandwidthWindow.Seconds()
+	g.last = now
+	g.mu.Unlock()
+}
+
+// Rate returns the bytes per second at now.
+func (g *byteGauge) Rate(now time.Time) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.decayedLocked(now)
+}
+
+// backendTraffic is one backend's byte counts and throughput each way.
+type backendTraffic struct {
+	sent, received         atomic.Uint64
+	sentRate, receivedRate byteGauge
+}
+
+func (t *backendTraffic) addSent(n int, now time.Time) {
+	if n > 0 {
+		t.sent.Add(uint64(n))
+		t.sentRate.add(n, now)
+	}
+}
+
+func (t *backendTraffic) addReceived(n int, now time.Time) {
+	if n > 0 {
+		t.received.Add(uint64(n))
+		t.receivedRate.add(n, now)
+	}
+}
+
+// mbps converts bytes per second to megabits per second.
+func mbps(bytesPerSec float64) float64 {
+	return bytesPerSec * 8 / 1e6
+}
+
+// overBandwidth reports whether the backend's response throughput is over
+// its max_mbps= at now.
+func (b *Backend) overBandwidth(now time.Time) bool {
+	return b.maxMbps > 0 && mbps(b.traffic.receivedRate.Rate(now)) > b.maxMbps
+}
+
+// countTraffic wraps w and r's body to count the bytes the backend is sent
+// and sends back. r must be the caller's own copy.
+func (b *Backend) countTraffic(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &trafficReader{ReadCloser: r.Body, b: b}
+	}
+	return &trafficWriter{ResponseWriter: w, b: b}
+}
+
+// trafficReader counts the request body bytes the proxy sends the backend.
+type trafficReader struct {
+	io.ReadCloser
+	b *Backend
+}
+
+func (r *trafficReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.b.traffic.addSent(n, r.b.clock.Now())
+	return n, err
+}
+
+// trafficWriter counts the response body bytes the backend sends back.
+type trafficWriter struct {
+	http.ResponseWriter
+	b *Backend
+}
+
+func (w *trafficWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.b.traffic.addReceived(n, w.b.clock.Now())
+	return n, err
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's
+// Flush, so streamed responses are flushed as before.
+func (w *trafficWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TrafficStats is a backend's bandwidth in /stats: body bytes sent to it
+// and received from it since start, their recent rates, and its max_mbps=,
+// if any.
+type TrafficStats struct {
+	BytesSent           uint64  `json:"bytes_sent"`
+	BytesReceived       uint64  `json:"bytes_received"`
+	SentBytesPerSec     float64 `json:"sent_bytes_per_sec"`
+	ReceivedBytesPerSec float64 `json:"received_bytes_per_sec"`
+	MaxMbps             float64 `json:"max_mbps,omitempty"`
+}
+
+func (b *Backend) trafficStats(now time.Time) TrafficStats {
+	return TrafficStats{
+		BytesSent:           b.traffic.sent.Load(),
+		BytesReceived:       b.traffic.received.Load(),
+		SentBytesPerSec:     b.traffic.sentRate.Rate(now),
+		ReceivedBytesPerSec: b.traffic.receivedRate.Rate(now),
+		MaxMbps:             b.maxMbps,
+	}
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestBandwidthAccounting(t *testing.T) {
+	_, pool, lb := mockCluster(t, 1, mockbackend.Config{ResponseSize: 256 << 10, StreamDelay: time.Millisecond})
+	var sent, received int
+	for i, req := range []struct{ path, body string }{
+		{"/v1/completions", `{"prompt":"hi"}`},
+		{"/v1/completions", `{"prompt":"` + strings.Repeat("x", 64<<10) + `"}`},
+		{"/v1/chat/completions", `{"messages":[{"role":"user","content":"hi"}],"stream":true}`},
+	} {
+		resp, err := http.Post(lb.URL+req.path, "application/json", strings.NewReader(req.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d, %v", i, resp.StatusCode, err)
+		}
+		sent += len(req.body)
+		received += len(body)
+	}
+
+	got := pool.Stats().Backends[0].Traffic
+	if got.BytesSent != uint64(sent) || got.BytesReceived != uint64(received) {
+		t.Errorf("traffic = %d sent, %d received; want %d, %d", got.BytesSent, got.BytesReceived, sent, received)
+	}
+	if received < 256<<10 {
+		t.Errorf("received %d bytes, want large responses", received)
+	}
+	if got.SentBytesPerSec <= 0 || got.ReceivedBytesPerSec <= got.SentBytesPerSec {
+		t.Errorf("rates = %v sent, %v received per second", got.SentBytesPerSec, got.ReceivedBytesPerSec)
+	}
+	if got.MaxMbps != 0 {
+		t.Errorf("max_mbps = %v, want none", got.MaxMbps)
+	}
+}
+
+func TestBandwidthLimitDeprioritizes(t *testing.T) {
+	cfg := mockbackend.Config{ResponseSize: 128 << 10}
+	open, limited := mockbackend.Start(t, cfg), mockbackend.Start(t, cfg)
+	// One 128 KiB response is ~100 kbit/s over the gauge's window, far
+	// over a 0.01 Mbps limit until it has decayed for tens of seconds.
+	pool, err := NewPool([]string{open.URL, limited.URL + ",max_mbps=0.01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+
+	const n = 20
+	statuses, ports := drive(t, lb, n, 1)
+	if statuses[http.StatusOK] != n {
+		t.Fatalf("statuses %v, want %d 200s", statuses, n)
+	}
+	if got := ports[port(t, limited)]; got > 1 {
+		t.Errorf("limited backend served %d of %d requests, want at most 1 (%v)", got, n, ports)
+	}
+
+	// Once it has served, the limited backend is skipped until its gauge
+	// decays.
+	b := pool.GetBackends()[1]
+	if ports[port(t, limited)] == 0 {
+		b.traffic.addReceived(128<<10, pool.clock.Now())
+	}
+	stats := pool.Stats().Backends[1]
+	if stats.State != "at capacity" || stats.Traffic.MaxMbps != 0.01 {
+		t.Errorf("limited backend state %q, max_mbps %v; want at capacity, 0.01", stats.State, stats.Traffic.MaxMbps)
+	}
+	if !b.overBandwidth(pool.clock.Now()) || b.overBandwidth(pool.clock.Now().Add(time.Minute)) {
+		t.Error("want the limit to hold now and lapse as the gauge decays")
+	}
+}
+
+func TestMaxMbpsSpec(t *testing.T) {
+	s, err := ParseBackendSpec("http://a,max_mbps=2.5")
+	if err != nil || s.MaxMbps != 2.5 || s.String() != "http://a,max_mbps=2.5" {
+		t.Errorf("got %+v, %v", s, err)
+	}
+	for _, bad := range []string{"0", "-1", "fast", "+Inf"} {
+		if _, err := ParseBackendSpec("http://a,max_mbps=" + bad); err == nil {
+			t.Errorf("max_mbps=%s: want an error", bad)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package lib
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -42,7 +41,7 @@ const (
 // affinityEntry pins one chain hash to a backend. epoch must still match the
 // backend's health epoch for the pin to be valid.
 type affinityEntry struct {
-	backend  int
+	backend  *Backend
 	epoch    uint64
 	lastSeen time.Time
 }
@@ -59,11 +58,10 @@ type affinityState struct {
 	maxConns int
 
 	mu    sync.Mutex
-	now   func() time.Time // injectable for tests
 	table map[[16]byte]affinityEntry
 	// per-backend FIFO of recent requests, capped at maxConns *
 	// affinityRetentionFactor records
-	records map[int][]requestRecord
+	records map[*Backend][]requestRecord
 
 	// counters since the last status line
 	warm, cold, overflow uint64
@@ -78,9 +76,8 @@ func (p *Pool) EnableCacheAware(ttl time.Duration, maxConns int) {
 	p.affinity = &affinityState{
 		ttl:      ttl,
 		maxConns: maxConns,
-		now:      time.Now,
 		table:    make(map[[16]byte]affinityEntry),
-		records:  make(map[int][]requestRecord),
+		records:  make(map[*Backend][]requestRecord),
 	}
 }
 
@@ -185,9 +182,10 @@ func affinityChain(body []byte) [][16]byte {
 }
 
 // selectCacheAware picks a backend for the given chain and reserves a
-// connection slot on it. Runs under the pool lock like SelectBackend, keeping
-// the ±1 burst guarantee. nil chain means "no derivable key" and places by
-// least-connections without touching the table.
+// connection slot on it. Runs under the pool lock, which keeps the table
+// consistent and the ±1 burst guarantee among cache-aware selections. nil
+// chain means "no derivable key" and places by least-connections without
+// touching the table.
 func (p *Pool) selectCacheAware(chain [][16]byte) (*Backend, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -196,37 +194,39 @@ func (p *Pool) selectCacheAware(chain [][16]byte) (*Backend, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	now := a.now()
-	least, leastIdx, leastErr := p.leastConnLocked()
+	now := p.clock.Now()
+	leastPick, leastErr := p.leastConn(p.snapshot(), nil, nil)
+	least := leastPick.b
 
 	// Walk the chain deepest-first for the longest still-valid pin.
-	pinnedIdx := -1
+	var pinned *Backend
 	for i := len(chain) - 1; i >= 0; i-- {
 		e, ok := a.table[chain[i]]
 		if !ok {
 			continue
 		}
-		b := p.backends[e.backend]
+		b := e.backend
 		if now.Sub(e.lastSeen) > a.ttl || e.epoch != b.Epoch() {
 			delete(a.table, chain[i]) // expired or backend went down since
 			continue
 		}
-		if !b.IsHealthy() {
+		if !b.available() || p.chaos.blackholed(b, true) {
 			continue
 		}
-		pinnedIdx = e.backend
+		if leastErr == nil && b.priority > least.priority {
+			continue // a lower tier has room again: leave the spillover pin
+		}
+		pinned = b
 		break
 	}
 
 	var winner *Backend
-	winnerIdx := -1
-	if pinnedIdx >= 0 {
-		pinned := p.backends[pinnedIdx]
+	if pinned != nil {
 		pc := pinned.GetActiveConns()
 		// Load guard: overflow to least-connections when the pinned node is
-		// at the hard cap, or its lead over the least-loaded node exceeds
-		// affinityOverflowFraction of the cap.
-		over := pc >= a.maxConns
+		// at its cap or over its max_mbps=, or its lead over the
+		// least-loaded node exceeds affinityOverflowFraction of the cap.
+		over := pc >= pinned.connCap(a.maxConns) || pinned.overBandwidth(p.clock.Now())
 		if !over && leastErr == nil {
 			gap := pc - least.GetActiveConns()
 			over = float64(gap) > affinityOverflowFraction*float64(a.maxConns)
@@ -235,45 +235,57 @@ func (p *Pool) selectCacheAware(chain [][16]byte) (*Backend, error) {
 			if leastErr != nil {
 				return nil, leastErr
 			}
-			winner, winnerIdx = least, leastIdx
+			winner = least
 			a.overflow++
 		} else {
-			winner, winnerIdx = pinned, pinnedIdx
+			winner = pinned
 			a.warm++
 		}
 	} else {
 		if leastErr != nil {
 			return nil, leastErr
 		}
-		winner, winnerIdx = least, leastIdx
+		winner = least
 		a.cold++
 	}
 
 	winner.IncrementConns()
 
 	if len(chain) > 0 {
-		a.upsertLocked(chain, winnerIdx, winner.Epoch(), now)
+		a.upsertLocked(chain, winner, winner.Epoch(), now)
 	}
 	return winner, nil
 }
 
+// forget drops a removed backend's pins.
+func (a *affinityState) forget(b *Backend) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for h, e := range a.table {
+		if e.backend == b {
+			delete(a.table, h)
+		}
+	}
+	delete(a.records, b)
+}
+
 // upsertLocked re-points every chain hash at the backend that actually
 // serves the request (pin-follows-reality) and applies per-backend retention.
 // Caller must hold a.mu.
-func (a *affinityState) upsertLocked(chain [][16]byte, idx int, epoch uint64, now time.Time) {
+func (a *affinityState) upsertLocked(chain [][16]byte, b *Backend, epoch uint64, now time.Time) {
 	for _, h := range chain {
-		a.table[h] = affinityEntry{backend: idx, epoch: epoch, lastSeen: now}
+		a.table[h] = affinityEntry{backend: b, epoch: epoch, lastSeen: now}
 	}
-	a.records[idx] = append(a.records[idx], requestRecord{hashes: chain, at: now})
+	a.records[b] = append(a.records[b], requestRecord{hashes: chain, at: now})
 
 	limit := a.maxConns * affinityRetentionFactor
-	for len(a.records[idx]) > limit {
-		old := a.records[idx][0]
-		a.records[idx] = a.records[idx][1:]
+	for len(a.records[b]) > limit {
+		old := a.records[b][0]
+		a.records[b] = a.records[b][1:]
 		for _, h := range old.hashes {
 			// Only drop hashes this backend still owns and that no newer
 			// request has refreshed since.
-			if e, ok := a.table[h]; ok && e.backend == idx && !e.lastSeen.After(old.at) {
+			if e, ok := a.table[h]; ok && e.backend == b && !e.lastSeen.After(old.at) {
 				delete(a.table, h)
 			}
 		}
@@ -285,19 +297,15 @@ func (a *affinityState) upsertLocked(chain [][16]byte, idx int, epoch uint64, no
 // r.GetBody, letting the transport transparently retry a request that failed
 // on a reused connection. rec is the request-log capture (nil when --log-to
 // is off); reading the body here goes through its tee, so the capture stays
-// complete even though the proxy later reads the buffered copy.
-func (p *Pool) serveCacheAware(w http.ResponseWriter, r *http.Request, rec *reqLogCapture) {
+// complete even though the proxy later reads the buffered copy. dbg is the
+// debug record (nil without --debug-headers).
+func (p *Pool) serveCacheAware(w http.ResponseWriter, r *http.Request, rec *reqLogCapture, dbg *debugRecord, timing *requestTiming) {
 	var chain [][16]byte
 	if r.Body != nil && r.Body != http.NoBody {
 		r.Body = http.MaxBytesReader(w, r.Body, affinityMaxBody)
 		raw, err := io.ReadAll(r.Body)
 		if err != nil {
-			var tooLarge *http.MaxBytesError
-			if errors.As(err, &tooLarge) {
-				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
-			} else {
-				http.Error(w, "failed to read request body", http.StatusBadRequest)
-			}
+			writeBodyError(w, r, p.errorFormat, err)
 			return
 		}
 		chain = affinityChain(raw)
@@ -308,15 +316,15 @@ func (p *Pool) serveCacheAware(w http.ResponseWriter, r *http.Request, rec *reqL
 		r.ContentLength = int64(len(raw))
 	}
 
-	backend, err := p.selectCacheAware(chain)
+	backend, err := p.admit(w, r, func() (*Backend, error) { return p.selectCacheAware(chain) })
 	if err != nil {
-		writeSelectError(w, err)
+		p.writeSelectError(w, r, err)
 		return
 	}
 	rec.setBackend(backend)
-	defer backend.DecrementConns()
-
-	backend.GetProxy().ServeHTTP(w, r)
+	dbg.setBackend(backend)
+	timing.setBackend(backend)
+	p.proxy(w, r, backend, 1)
 }
 
 // affinityStatsLine reports and resets the routing counters since the last
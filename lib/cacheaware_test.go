@@ -26,20 +26,19 @@ func msg(role, content string) map[string]any {
 
 // newCacheAwarePool builds a pool of n backends with cache-aware routing
 // enabled and a controllable clock. Backends are never dialed in unit tests.
-func newCacheAwarePool(t *testing.T, n, maxConns int, ttl time.Duration) (*Pool, *time.Time) {
+func newCacheAwarePool(t *testing.T, n, maxConns int, ttl time.Duration) (*Pool, *fakeClock) {
 	t.Helper()
 	urls := make([]string, n)
 	for i := range n {
 		urls[i] = fmt.Sprintf("http://backend-%d", i)
 	}
-	pool, err := NewPool(urls)
+	clock := newFakeClock(time.Unix(1_000_000, 0))
+	pool, err := NewPool(urls, WithClock(clock))
 	if err != nil {
 		t.Fatal(err)
 	}
 	pool.EnableCacheAware(ttl, maxConns)
-	clock := time.Unix(1_000_000, 0)
-	pool.affinity.now = func() time.Time { return clock }
-	return pool, &clock
+	return pool, clock
 }
 
 // selectAndRelease routes one request and immediately releases its slot, so
@@ -174,12 +173,12 @@ func TestAffinityChainContentFields(t *testing.T) {
 
 func TestCacheAwareColdPlacesLeastConn(t *testing.T) {
 	pool, _ := newCacheAwarePool(t, 3, 10, time.Hour)
-	pool.backends[0].activeConns = 5
-	pool.backends[1].activeConns = 0
-	pool.backends[2].activeConns = 3
+	pool.GetBackends()[0].activeConns.Store(5)
+	pool.GetBackends()[1].activeConns.Store(0)
+	pool.GetBackends()[2].activeConns.Store(3)
 
 	b := selectAndRelease(t, pool, chatBody(t, msg("user", "fresh")))
-	if b != pool.backends[1] {
+	if b != pool.GetBackends()[1] {
 		t.Errorf("cold key should place on least-loaded backend, got %s", b.URL)
 	}
 	if _, cold, _ := counters(pool); cold != 1 {
@@ -194,7 +193,7 @@ func TestCacheAwareWarmSticksAndExtends(t *testing.T) {
 
 	// Same conversation extended by later turns still routes home even when
 	// other backends are idle and home is (mildly) busier.
-	home.activeConns = 1
+	home.activeConns.Store(1)
 	longer := chatBody(t, msg("system", "S"), msg("user", "u1"), msg("assistant", "a1"), msg("user", "u2"))
 	for range 3 {
 		if b := selectAndRelease(t, pool, longer); b != home {
@@ -211,7 +210,7 @@ func TestCacheAwareGuardMaxConns(t *testing.T) {
 	conv := chatBody(t, msg("user", "pin me"))
 	home := selectAndRelease(t, pool, conv)
 
-	home.activeConns = 10 // at the hard cap
+	home.activeConns.Store(10) // at the hard cap
 	b := selectAndRelease(t, pool, conv)
 	if b == home {
 		t.Error("pinned backend at max-conns must overflow")
@@ -221,7 +220,7 @@ func TestCacheAwareGuardMaxConns(t *testing.T) {
 	}
 
 	// Pin follows reality: with home relieved, the key now lives on b.
-	home.activeConns = 0
+	home.activeConns.Store(0)
 	if again := selectAndRelease(t, pool, conv); again != b {
 		t.Error("pin should have re-pointed to the overflow target")
 	}
@@ -231,18 +230,19 @@ func TestCacheAwareGuardGapFraction(t *testing.T) {
 	pool, _ := newCacheAwarePool(t, 2, 10, time.Hour) // 0.2 * 10 = gap threshold 2
 	conv := chatBody(t, msg("user", "gap test"))
 	home := selectAndRelease(t, pool, conv)
-	other := pool.backends[0]
+	other := pool.GetBackends()[0]
 	if home == other {
-		other = pool.backends[1]
+		other = pool.GetBackends()[1]
 	}
 
 	// gap == 2: not over the threshold -> warm
-	home.activeConns, other.activeConns = 2, 0
+	home.activeConns.Store(2)
+	other.activeConns.Store(0)
 	if b := selectAndRelease(t, pool, conv); b != home {
 		t.Error("gap equal to 0.2*maxConns should NOT overflow")
 	}
 	// gap == 3: over -> overflow
-	home.activeConns = 3
+	home.activeConns.Store(3)
 	if b := selectAndRelease(t, pool, conv); b == home {
 		t.Error("gap above 0.2*maxConns should overflow")
 	}
@@ -250,16 +250,16 @@ func TestCacheAwareGuardGapFraction(t *testing.T) {
 
 func TestCacheAwareAllAtCapacity(t *testing.T) {
 	pool, _ := newCacheAwarePool(t, 2, 1, time.Hour)
-	pool.backends[0].activeConns = 1
-	pool.backends[1].activeConns = 1
+	pool.GetBackends()[0].activeConns.Store(1)
+	pool.GetBackends()[1].activeConns.Store(1)
 	_, err := pool.selectCacheAware(affinityChain(chatBody(t, msg("user", "x"))))
 	if !errors.Is(err, errAtCapacity) {
 		t.Errorf("expected errAtCapacity when all healthy backends are full, got %v", err)
 	}
 
 	// Distinct from a real outage: no healthy backends at all.
-	pool.backends[0].healthy = false
-	pool.backends[1].healthy = false
+	pool.GetBackends()[0].MarkUnhealthy()
+	pool.GetBackends()[1].MarkUnhealthy()
 	_, err = pool.selectCacheAware(affinityChain(chatBody(t, msg("user", "x"))))
 	if !errors.Is(err, errNoHealthyBackends) {
 		t.Errorf("expected errNoHealthyBackends, got %v", err)
@@ -270,26 +270,26 @@ func TestCacheAwareTTLExpiry(t *testing.T) {
 	pool, clock := newCacheAwarePool(t, 2, 10, time.Minute)
 	conv := chatBody(t, msg("user", "expiring"))
 	home := selectAndRelease(t, pool, conv)
-	other := pool.backends[0]
+	other := pool.GetBackends()[0]
 	if home == other {
-		other = pool.backends[1]
+		other = pool.GetBackends()[1]
 	}
 
 	// Within TTL: still warm despite other being idle.
-	*clock = clock.Add(50 * time.Second)
-	home.activeConns = 1
+	clock.advance(50 * time.Second)
+	home.activeConns.Store(1)
 	if b := selectAndRelease(t, pool, conv); b != home {
 		t.Error("entry within sliding TTL should stay pinned")
 	}
 
 	// The hit above refreshed lastSeen (sliding): +50s more is still warm.
-	*clock = clock.Add(50 * time.Second)
+	clock.advance(50 * time.Second)
 	if b := selectAndRelease(t, pool, conv); b != home {
 		t.Error("sliding TTL should refresh on hit")
 	}
 
 	// Past TTL with no hits: entry expires, placement is by load again.
-	*clock = clock.Add(2 * time.Minute)
+	clock.advance(2 * time.Minute)
 	if b := selectAndRelease(t, pool, conv); b != other {
 		t.Error("expired entry should re-place by least-connections")
 	}
@@ -321,9 +321,9 @@ func TestCacheAwareUnhealthyPinRePlaces(t *testing.T) {
 	pool, _ := newCacheAwarePool(t, 2, 10, time.Hour)
 	conv := chatBody(t, msg("user", "failover"))
 	home := selectAndRelease(t, pool, conv)
-	other := pool.backends[0]
+	other := pool.GetBackends()[0]
 	if home == other {
-		other = pool.backends[1]
+		other = pool.GetBackends()[1]
 	}
 
 	home.MarkUnhealthy()
@@ -365,7 +365,7 @@ func TestCacheAwareRetentionKeepsReownedHashes(t *testing.T) {
 	for i := range 3 {
 		selectAndRelease(t, pool, chatBody(t, msg("user", fmt.Sprintf("filler-%d", i))))
 	}
-	*clock = clock.Add(time.Second)
+	clock.advance(time.Second)
 	selectAndRelease(t, pool, keeper) // re-owned with newer lastSeen (record 5)
 	for i := range 3 {
 		selectAndRelease(t, pool, chatBody(t, msg("user", fmt.Sprintf("late-%d", i))))
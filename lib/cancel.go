@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"context"
+	"time"
+)
+
+// Client cancellations: a client that gives up on a request — its own
+// timeout on a long generation, a closed connection — cancels the request's
+// context. That is not the backend's failure: it neither marks the backend
+// unhealthy nor counts against it. It is counted per backend, with how long
+// the backend had been serving the request, in /stats "cancelled" and the
+// lb_backend_client_cancellations_total and
+// lb_backend_cancelled_request_duration_seconds metrics; the pool's share
+// of requests cancelled is /stats "cancellation_rate" and the
+// lb_pool_cancellation_ratio gauge. A request is counted once, in
+// Pool.proxy when its attempt returns, whether the cancellation reached the
+// ErrorHandler (before response headers) or cut the response off
+// mid-body. An attempt that lost a hedge race, ran out of time or was cut
+// off by a backend replacement was not cancelled by its client.
+//
+// The outgoing request carries the incoming request's context:
+// ReverseProxy clones it with r.Context(), and every context lb layers on
+// the way (request timeout, backend replacement, hedging) derives from the
+// client's, so the backend's connection is closed — and a model server
+// stops generating — as soon as the client's is.
+
+// clientCancelled reports whether ctx ended because the client went away.
+func clientCancelled(ctx context.Context) bool {
+	return ctx.Err() != nil && context.Cause(ctx) == context.Canceled
+}
+
+// noteCancelled counts a request its client cancelled after d on b.
+func (b *Backend) noteCancelled(d time.Duration) {
+	b.cancelled.observe(d)
+}
+
+// cancellationRate is the share of the backends' requests their clients
+// cancelled.
+func cancellationRate(backends []*Backend) float64 {
+	var requests, cancelled uint64
+	for _, b := range backends {
+		requests += b.TotalRequests()
+		cancelled += b.cancelled.count.Load()
+	}
+	if requests == 0 {
+		return 0
+	}
+	return float64(cancelled) / float64(requests)
+}
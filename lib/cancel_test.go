@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestClientCancellation(t *testing.T) {
+	// A stream that would run 10s, and 10s to first token once slow.
+	backends, pool, lb := mockCluster(t, 1, mockbackend.Config{StreamChunks: 100, StreamDelay: 100 * time.Millisecond})
+	mock, backend := backends[0], pool.GetBackends()[0]
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !done(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	stream := func(ctx context.Context) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, lb.URL+"/v1/chat/completions", strings.NewReader(`{"stream":true}`))
+		return http.DefaultClient.Do(req)
+	}
+
+	// Mid-stream: the client reads the first chunk and hangs up.
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := stream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	_ = resp.Body.Close()
+	// The backend stops generating long before the stream would end.
+	waitFor("the backend to see the disconnect", func() bool { return mock.Stats().Disconnects == 1 })
+	waitFor("the cancellation to be counted", func() bool { return backend.cancelled.count.Load() == 1 })
+
+	// Before response headers: the client gives up waiting for them.
+	mock.SetDelay(10 * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := stream(ctx); err == nil {
+		t.Fatal("request outlived the client's timeout")
+	}
+	waitFor("the cancellation to be counted", func() bool { return backend.cancelled.count.Load() == 2 })
+	waitFor("the connection slot to be released", func() bool { return backend.GetActiveConns() == 0 })
+
+	s := pool.Stats()
+	if !s.Backends[0].Healthy {
+		t.Error("a client cancellation marked the backend unhealthy")
+	}
+	if c := s.Backends[0].Cancelled; c == nil || c.Count != 2 || c.MaxMs < 100 || c.MaxMs > 2000 {
+		t.Errorf("cancelled = %+v, want 2 after 0.1-2s", c)
+	}
+	if s.CancellationRate != 1 {
+		t.Errorf("cancellation_rate = %v, want 1", s.CancellationRate)
+	}
+}
+
+func TestClientCancelledCause(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if clientCancelled(ctx) {
+		t.Error("live context reported cancelled")
+	}
+	cancel(errHedgeLost)
+	if clientCancelled(ctx) {
+		t.Error("a lost hedge counted as a client cancellation")
+	}
+	parent, cancelClient := context.WithCancel(context.Background())
+	child, cancelChild := context.WithCancelCause(parent)
+	defer cancelChild(nil)
+	cancelClient()
+	if !clientCancelled(child) {
+		t.Error("the client's cancellation did not reach the attempt")
+	}
+	timeout, cancelTimeout := context.WithTimeoutCause(context.Background(), 0, errRequestTimeout)
+	defer cancelTimeout()
+	if clientCancelled(timeout) {
+		t.Error("a request timeout counted as a client cancellation")
+	}
+}
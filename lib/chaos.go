@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Failure injection (POST /admin/chaos): for game days, failures are
+// injected at lb without touching the backends. A rule delays a percentage
+// of proxied requests, answers a percentage 503, or blackholes a backend —
+// selection treats it as unhealthy while its health checks carry on
+// unchanged. Every rule expires after its duration, and DELETE /admin/chaos
+// clears them all. The rules are shared by every pool and kept as an
+// immutable list behind one atomic pointer, so a request pays a single
+// atomic load while there are none. Injected behavior is tagged so it is
+// never mistaken for a real failure: request log entries get "chaos", [SLOW]
+// lines say so, delayed requests are left out of the backend's latency
+// histogram, an injected 503 has the code chaos_injected and no backend, and
+// /stats counts what each rule did.
+
+// Chaos rule kinds.
+const (
+	ChaosLatency   = "latency"
+	ChaosError     = "error"
+	ChaosBlackhole = "blackhole"
+)
+
+// ChaosSpec is a rule to add, as posted to /admin/chaos: latency delays
+// Percent of requests by Latency, error answers Percent of requests 503,
+// blackhole takes Backend out of selection; each for Duration.
+type ChaosSpec struct {
+	Kind     string  `json:"kind"`
+	Percent  float64 `json:"percent"`
+	Latency  string  `json:"latency"`
+	Backend  string  `json:"backend"`
+	Duration string  `json:"duration"`
+}
+
+// ChaosRule is an active rule, as listed at GET /admin/chaos. Injected
+// counts the requests it delayed or failed, or the selections that skipped
+// its backend.
+type ChaosRule struct {
+	ID       int       `json:"id"`
+	Kind     string    `json:"kind"`
+	Percent  float64   `json:"percent,omitempty"`
+	Latency  string    `json:"latency,omitempty"`
+	Backend  string    `json:"backend,omitempty"`
+	Expires  time.Time `json:"expires"`
+	Injected uint64    `json:"injected"`
+}
+
+// chaosRule is an active rule; only injected changes once it is listed.
+type chaosRule struct {
+	id       int
+	kind     string
+	percent  float64
+	latency  time.Duration
+	backend  string // normalized
+	expires  time.Time
+	injected atomic.Uint64
+}
+
+// Chaos holds the failure injection rules of the pools it is set on.
+type Chaos struct {
+	clock  Clock
+	logger Logger
+
+	// rules is nil while there are none; a new list replaces it on every
+	// change (under mu)
+	rules  atomic.Pointer[[]*chaosRule]
+	mu     sync.Mutex
+	nextID int
+
+	delayed, failed, skipped atomic.Uint64
+}
+
+// NewChaos returns a Chaos without rules.
+func NewChaos(opts ...Option) *Chaos {
+	return &Chaos{clock: clockFrom(systemClock{}, opts), logger: loggerFrom(defaultLogger(), opts)}
+}
+
+// SetChaos makes the pool apply c's rules. Call before serving traffic.
+func (p *Pool) SetChaos(c *Chaos) {
+	p.chaos = c
+}
+
+// parse validates s into a rule expiring after its duration from now.
+func (s ChaosSpec) parse(now time.Time) (*chaosRule, error) {
+	d, err := time.ParseDuration(s.Duration)
+	if err != nil || d <= 0 {
+		return nil, errors.New("duration must be a positive duration like 5m")
+	}
+	r := &chaosRule{kind: s.Kind, expires: now.Add(d)}
+	switch s.Kind {
+	case ChaosLatency, ChaosError:
+		if s.Percent <= 0 || s.Percent > 100 {
+			return nil, errors.New("percent must be in (0, 100]")
+		}
+		r.percent = s.Percent
+		if s.Kind == ChaosLatency {
+			if r.latency, err = time.ParseDuration(s.Latency); err != nil || r.latency <= 0 {
+				return nil, errors.New("latency must be a positive duration like 2s")
+			}
+		}
+	case ChaosBlackhole:
+		if r.backend, err = NormalizeBackendURL(withDefaultScheme([]string{s.Backend})[0]); err != nil {
+			return nil, fmt.Errorf("backend: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("kind must be %s, %s or %s, got %q", ChaosLatency, ChaosError, ChaosBlackhole, s.Kind)
+	}
+	return r, nil
+}
+
+func (r *chaosRule) String() string {
+	switch r.kind {
+	case ChaosLatency:
+		return fmt.Sprintf("rule %d: delay %g%% of requests by %v", r.id, r.percent, r.latency)
+	case ChaosError:
+		return fmt.Sprintf("rule %d: fail %g%% of requests with 503", r.id, r.percent)
+	}
+	return fmt.Sprintf("rule %d: blackhole %s", r.id, r.backend)
+}
+
+func (r *chaosRule) public() ChaosRule {
+	out := ChaosRule{ID: r.id, Kind: r.kind, Percent: r.percent, Backend: r.backend, Expires: r.expires, Injected: r.injected.Load()}
+	if r.latency > 0 {
+		out.Latency = r.latency.String()
+	}
+	return out
+}
+
+// Add installs the rule s describes.
+func (c *Chaos) Add(s ChaosSpec) (ChaosRule, error) {
+	now := c.clock.Now()
+	r, err := s.parse(now)
+	if err != nil {
+		return ChaosRule{}, err
+	}
+	c.mu.Lock()
+	c.nextID++
+	r.id = c.nextID
+	rules := append(c.liveLocked(now), r)
+	c.rules.Store(&rules)
+	c.mu.Unlock()
+	c.logger.Printf("[CHAOS] %v until %s", r, r.expires.Format(time.RFC3339))
+	return r.public(), nil
+}
+
+// Clear removes every rule, returning how many there were.
+func (c *Chaos) Clear() int {
+	c.mu.Lock()
+	n := len(c.liveLocked(c.clock.Now()))
+	c.rules.Store(nil)
+	c.mu.Unlock()
+	if n > 0 {
+		c.logger.Printf("[CHAOS] cleared %d rules", n)
+	}
+	return n
+}
+
+// Rules returns the active rules, oldest first.
+func (c *Chaos) Rules() []ChaosRule {
+	out := []ChaosRule{}
+	for _, r := range c.active() {
+		out = append(out, r.public())
+	}
+	return out
+}
+
+// liveLocked returns a copy of the rules that have not expired at now,
+// logging the ones that have. Caller must hold c.mu.
+func (c *Chaos) liveLocked(now time.Time) []*chaosRule {
+	var live []*chaosRule
+	if rules := c.rules.Load(); rules != nil {
+		for _, r := range *rules {
+			if now.Before(r.expires) {
+				live = append(live, r)
+			} else {
+				c.logger.Printf("[CHAOS] %v expired (injected %d)", r, r.injected.Load())
+			}
+		}
+	}
+	return live
+}
+
+// active returns the rules in force, nil when there are none, dropping
+// expired ones. Nil-safe.
+func (c *Chaos) active() []*chaosRule {
+	if c == nil {
+		return nil
+	}
+	rules := c.rules.Load()
+	if rules == nil {
+		return nil
+	}
+	now := c.clock.Now()
+	if !slices.ContainsFunc(*rules, func(r *chaosRule) bool { return !now.Before(r.expires) }) {
+		return *rules
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	live := c.liveLocked(now)
+	if live == nil {
+		c.rules.Store(nil)
+	} else {
+		c.rules.Store(&live)
+	}
+	return live
+}
+
+// blackholed reports whether a rule blackholes b, counting the skip when
+// count is set. Nil-safe.
+func (c *Chaos) blackholed(b *Backend, count bool) bool {
+	for _, r := range c.active() {
+		if r.kind == ChaosBlackhole && r.backend == b.ID() {
+			if count {
+				r.injected.Add(1)
+				c.skipped.Add(1)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// injectChaos applies the latency and error rules to r, tagging what it
+// injects on the request's log entry and timing. It reports whether the
+// request is still to be proxied.
+func (p *Pool) injectChaos(w http.ResponseWriter, r *http.Request, rules []*chaosRule, rec *reqLogCapture, timing *requestTiming) bool {
+	var tags []string
+	defer func() {
+		if tags != nil {
+			tag := strings.Join(tags, ", ")
+			rec.setChaos(tag)
+			timing.setChaos(tag)
+		}
+	}()
+	for _, rule := range rules {
+		if rule.kind == ChaosBlackhole || rand.Float64()*100 >= rule.percent { // #nosec G404 -- sampling, not security-sensitive
+			continue
+		}
+		rule.injected.Add(1)
+		switch rule.kind {
+		case ChaosLatency:
+			p.chaos.delayed.Add(1)
+			tags = append(tags, "latency "+rule.latency.String())
+			select {
+			case <-p.chaos.clock.After(rule.latency):
+			case <-r.Context().Done():
+				return false
+			}
+		case ChaosError:
+			p.chaos.failed.Add(1)
+			tags = append(tags, "error")
+			apiError{http.StatusServiceUnavailable, errTypeUnavailable, "chaos_injected", "Service Unavailable: failure injected for chaos testing", nil}.write(w, r, p.errorFormat)
+			return false
+		}
+	}
+	return true
+}
+
+// ChaosStats is failure injection in /stats, while rules are active or
+// once any has injected: the active rules, and the requests delayed and
+// failed and the selections that skipped a blackholed backend since start.
+type ChaosStats struct {
+	Rules   []ChaosRule `json:"rules"`
+	Delayed uint64      `json:"delayed"`
+	Failed  uint64      `json:"failed"`
+	Skipped uint64      `json:"blackhole_skips"`
+}
+
+func (c *Chaos) stats() *ChaosStats {
+	s := &ChaosStats{Rules: c.Rules(), Delayed: c.delayed.Load(), Failed: c.failed.Load(), Skipped: c.skipped.Load()}
+	if len(s.Rules) == 0 && s.Delayed == 0 && s.Failed == 0 && s.Skipped == 0 {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chaosPool returns a logged pool of two backends answering with their
+// name, sharing a fake-clocked Chaos.
+func chaosPool(t *testing.T) (*Pool, *Chaos, *fakeClock, string) {
+	t.Helper()
+	named := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	pool, path := newLoggedPool(t, named("a"))
+	if _, err := pool.AddBackend(named("b")); err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock(time.Now())
+	chaos := NewChaos(WithClock(clock), WithLogger(&lineLogger{}))
+	pool.SetChaos(chaos)
+	return pool, chaos, clock, path
+}
+
+func serveChaos(pool *Pool) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"prompt":"hi"}`)))
+	return rec
+}
+
+func TestChaosErrorRuleAndExpiry(t *testing.T) {
+	pool, chaos, clock, path := chaosPool(t)
+	rule, err := chaos.Add(ChaosSpec{Kind: ChaosError, Percent: 100, Duration: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.ID != 1 || !rule.Expires.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("rule = %+v", rule)
+	}
+
+	rec := serveChaos(pool)
+	var body struct {
+		Error struct{ Code string } `json:"error"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusServiceUnavailable || body.Error.Code != "chaos_injected" {
+		t.Fatalf("got %d %s, want an injected 503", rec.Code, rec.Body)
+	}
+	if e := readLogEntries(t, path, 1)[0]; e.Chaos != "error" || e.Backend != "" || e.Status != http.StatusServiceUnavailable {
+		t.Errorf("log entry = %+v, want tagged chaos error without a backend", e)
+	}
+	s := pool.Stats().Chaos
+	if s == nil || s.Failed != 1 || len(s.Rules) != 1 || s.Rules[0].Injected != 1 {
+		t.Errorf("chaos stats = %+v", s)
+	}
+	for _, b := range pool.Stats().Backends {
+		if b.Requests != 0 {
+			t.Errorf("%s got %d requests, want none", b.URL, b.Requests)
+		}
+	}
+
+	clock.advance(time.Minute)
+	if rec := serveChaos(pool); rec.Code != http.StatusOK {
+		t.Errorf("after expiry: %d %s", rec.Code, rec.Body)
+	}
+	if e := readLogEntries(t, path, 2)[1]; e.Chaos != "" {
+		t.Errorf("after expiry the entry is tagged %q", e.Chaos)
+	}
+	if rules := chaos.Rules(); len(rules) != 0 {
+		t.Errorf("rules after expiry = %+v", rules)
+	}
+	if chaos.rules.Load() != nil {
+		t.Error("want the rule list dropped once every rule expired")
+	}
+}
+
+func TestChaosLatencyRule(t *testing.T) {
+	pool, chaos, clock, path := chaosPool(t)
+	if _, err := chaos.Add(ChaosSpec{Kind: ChaosLatency, Percent: 100, Latency: "2s", Duration: "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serveChaos(pool) }()
+	clock.blockUntil(t, 1)
+	select {
+	case rec := <-done:
+		t.Fatalf("answered %d before the injected latency", rec.Code)
+	default:
+	}
+	clock.advance(2 * time.Second)
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	if e := readLogEntries(t, path, 1)[0]; e.Chaos != "latency 2s" || e.Backend == "" {
+		t.Errorf("log entry = %+v, want tagged latency 2s with a backend", e)
+	}
+	st := pool.Stats()
+	if st.Chaos == nil || st.Chaos.Delayed != 1 {
+		t.Errorf("chaos stats = %+v", st.Chaos)
+	}
+	for _, b := range st.Backends {
+		if b.Latency != nil {
+			t.Errorf("%s recorded a chaos-delayed request: %+v", b.URL, b.Latency)
+		}
+	}
+	if n := chaos.Clear(); n != 1 || len(chaos.Rules()) != 0 {
+		t.Errorf("Clear = %d, rules %v", n, chaos.Rules())
+	}
+}
+
+func TestChaosBlackhole(t *testing.T) {
+	pool, chaos, clock, _ := chaosPool(t)
+	a := pool.GetBackends()[0]
+	if _, err := chaos.Add(ChaosSpec{Kind: ChaosBlackhole, Backend: a.ID(), Duration: "30s"}); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		if rec := serveChaos(pool); rec.Body.String() != "b" {
+			t.Fatalf("served by %q, want b while a is blackholed", rec.Body)
+		}
+	}
+	st := pool.Stats()
+	if st.Backends[0].State != "blackholed (chaos)" || !st.Backends[0].Healthy {
+		t.Errorf("a: state %q healthy %v, want blackholed but healthy", st.Backends[0].State, st.Backends[0].Healthy)
+	}
+	if st.Chaos == nil || st.Chaos.Skipped == 0 {
+		t.Errorf("chaos stats = %+v", st.Chaos)
+	}
+
+	clock.advance(30 * time.Second)
+	served := map[string]int{}
+	for range 20 {
+		served[serveChaos(pool).Body.String()]++
+	}
+	if served["a"] == 0 {
+		t.Errorf("a served nothing after the blackhole expired: %v", served)
+	}
+}
+
+func TestChaosSpecValidation(t *testing.T) {
+	for _, s := range []ChaosSpec{
+		{Kind: ChaosError, Percent: 10},
+		{Kind: ChaosError, Percent: 0, Duration: "1m"},
+		{Kind: ChaosError, Percent: 101, Duration: "1m"},
+		{Kind: ChaosLatency, Percent: 10, Duration: "1m"},
+		{Kind: ChaosBlackhole, Duration: "1m"},
+		{Kind: "fire", Duration: "1m"},
+	} {
+		if _, err := NewChaos().Add(s); err == nil {
+			t.Errorf("%+v: want an error", s)
+		}
+	}
+}
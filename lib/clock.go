@@ -0,0 +1,47 @@
+package lib
+
+import "time"
+
+// Clock is the time source of lb's time-dependent components: health
+// checks, status lines, slow start, expected-restart windows, outlier
+// ejections, the admission queue, token buckets, salt rotation, cache
+// freshness and state flushes. It defaults to the system clock; tests pass
+// a fake one with WithClock and step it instead of sleeping. Request
+// timeouts (context deadlines), the /metrics scrape deadline and I/O
+// deadlines stay on the system clock: they bound real waiting.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the part of *time.Ticker a Clock hands out.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// WithClock makes a component use c instead of the system clock.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// clockFrom returns the clock opts give, def without one.
+func clockFrom(def Clock, opts []Option) Clock {
+	if c := applyOptions(opts).clock; c != nil {
+		return c
+	}
+	return def
+}
+
+// systemClock is the real clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) NewTicker(d time.Duration) Ticker       { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Request coalescing (--coalesce-path): identical GETs arriving together —
+// every client polling /v1/models at once — share one backend request.
+// Requests are identical when they have the same path and query, the same
+// caller (Authorization and Cookie, compared as a hash) and the same
+// Accept-Encoding. The first starts the shared request; the others wait for
+// it, and each gets its own copy of the response. The shared request runs
+// apart from every client: a client that goes away, the first included,
+// stops waiting without cancelling it for the rest. The response is
+// buffered whole, up to --coalesce-max-bytes: a larger one is abandoned,
+// every waiter sends its own request instead, and that key is not coalesced
+// again (the last coalesceMaxSkipped such keys are remembered). A failed
+// shared request fails its waiters alike: they get the backend's error
+// response, or a 502 when the response broke off.
+
+// coalesceMaxBytes is the default bound on a shared response body.
+const coalesceMaxBytes = 1 << 20 // 1 MiB
+
+// coalesceMaxSkipped bounds the keys remembered as too large to coalesce.
+const coalesceMaxSkipped = 1024
+
+// errFlightTooLarge stops a shared response over the size bound.
+var errFlightTooLarge = errors.New("coalesced response too large")
+
+// Coalescer shares one backend request between identical concurrent GETs
+// under its path prefixes.
+type Coalescer struct {
+	routes      []*coalesceRoute
+	maxBytes    int64
+	errorFormat ErrorFormat
+
+	mu      sync.Mutex
+	flights map[string]*flight
+	skipped map[string]struct{}
+}
+
+type coalesceRoute struct {
+	prefix                           string
+	requests, coalesced, uncoalesced atomic.Uint64
+}
+
+// CoalesceRouteStats reports one coalesced prefix's counters in /stats:
+// Requests started a shared backend request, Coalesced joined one, and
+// Uncoalesced went to a backend on their own because their key's response
+// is too large to share.
+type CoalesceRouteStats struct {
+	Prefix      string `json:"prefix"`
+	Requests    uint64 `json:"requests"`
+	Coalesced   uint64 `json:"coalesced"`
+	Uncoalesced uint64 `json:"uncoalesced"`
+}
+
+// flight is one shared backend request. Its response fields are set before
+// done is closed.
+type flight struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	// tooLarge is set when the response exceeded the bound, failed when it
+	// broke off
+	tooLarge, failed bool
+}
+
+// NewCoalescer creates a coalescer for GETs under prefixes.
+func NewCoalescer(prefixes []string) *Coalescer {
+	c := &Coalescer{
+		maxBytes: coalesceMaxBytes,
+		flights:  make(map[string]*flight),
+		skipped:  make(map[string]struct{}),
+	}
+	for _, p := range prefixes {
+		c.routes = append(c.routes, &coalesceRoute{prefix: p})
+	}
+	return c
+}
+
+// SetMaxBytes bounds a shared response body (default 1 MiB). Call before
+// serving traffic.
+func (c *Coalescer) SetMaxBytes(n int64) {
+	c.maxBytes = n
+}
+
+// SetErrorFormat sets how the 502 of a broken-off shared response is
+// written (default openai). Call before serving traffic.
+func (c *Coalescer) SetErrorFormat(f ErrorFormat) {
+	c.errorFormat = f
+}
+
+// Stats returns per-prefix counters.
+func (c *Coalescer) Stats() []CoalesceRouteStats {
+	out := make([]CoalesceRouteStats, 0, len(c.routes))
+	for _, r := range c.routes {
+		out = append(out, CoalesceRouteStats{
+			Prefix:      r.prefix,
+			Requests:    r.requests.Load(),
+			Coalesced:   r.coalesced.Load(),
+			Uncoalesced: r.uncoalesced.Load(),
+		})
+	}
+	return out
+}
+
+func (c *Coalescer) route(path string) *coalesceRoute {
+	var best *coalesceRoute
+	for _, r := range c.routes {
+		if pathHasPrefix(path, r.prefix) && (best == nil || len(r.prefix) > len(best.prefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// coalesceKey identifies the requests r's response may be shared with.
+func coalesceKey(r *http.Request) string {
+	caller := sha256.Sum256([]byte(r.Header.Get("Authorization") + "\x00" + r.Header.Get("Cookie")))
+	return r.Method + " " + r.URL.RequestURI() + "\x00" + hex.EncodeToString(caller[:]) + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+// Handler wraps next with coalescing.
+func (c *Coalescer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := c.route(r.URL.Path)
+		if r.Method != http.MethodGet || rt == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := coalesceKey(r)
+		c.mu.Lock()
+		if _, skip := c.skipped[key]; skip {
+			c.mu.Unlock()
+			rt.uncoalesced.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		f, joined := c.flights[key]
+		if joined {
+			rt.coalesced.Add(1)
+		} else {
+			rt.requests.Add(1)
+			f = &flight{done: make(chan struct{})}
+			c.flights[key] = f
+			go c.fly(key, f, next, r)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return // the shared request carries on for the others
+		}
+		if f.tooLarge {
+			rt.uncoalesced.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if f.failed {
+			apiError{http.StatusBadGateway, errTypeUpstream, "bad_gateway", "Bad Gateway: backend unreachable or failed", nil}.write(w, r, c.errorFormat)
+			return
+		}
+		h := w.Header()
+		for k, v := range f.header {
+			h[k] = v
+		}
+		w.WriteHeader(f.status)
+		_, _ = w.Write(f.body)
+	})
+}
+
+// fly sends the shared request for key, made from the first request r,
+// under a context no client can cancel, and records its response in f.
+func (c *Coalescer) fly(key string, f *flight, next http.Handler, r *http.Request) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	rec := &flightRecorder{header: make(http.Header), maxBytes: c.maxBytes, cancel: cancel}
+	defer func() {
+		cancel()
+		c.mu.Lock()
+		delete(c.flights, key)
+		if f.tooLarge {
+			if len(c.skipped) >= coalesceMaxSkipped {
+				clear(c.skipped)
+			}
+			c.skipped[key] = struct{}{}
+		}
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	// A response that breaks off panics with http.ErrAbortHandler, here
+	// on a goroutine of ours rather than the server's.
+	defer func() {
+		if v := recover(); v != nil {
+			f.tooLarge, f.failed = rec.tooLarge, !rec.tooLarge
+		}
+	}()
+	next.ServeHTTP(rec, r.Clone(ctx))
+	f.status, f.header, f.body = cmp.Or(rec.status, http.StatusOK), rec.header, rec.buf.Bytes()
+	f.tooLarge = rec.tooLarge
+}
+
+// flightRecorder buffers a shared response, up to maxBytes of body.
+type flightRecorder struct {
+	header   http.Header
+	status   int
+	buf      bytes.Buffer
+	maxBytes int64
+	tooLarge bool
+	cancel   context.CancelFunc
+}
+
+func (fr *flightRecorder) Header() http.Header {
+	return fr.header
+}
+
+func (fr *flightRecorder) WriteHeader(code int) {
+	if isInterim(code) || fr.status != 0 {
+		return
+	}
+	fr.status = code
+}
+
+func (fr *flightRecorder) Write(p []byte) (int, error) {
+	if fr.status == 0 {
+		fr.WriteHeader(http.StatusOK)
+	}
+	if fr.tooLarge || int64(fr.buf.Len()+len(p)) > fr.maxBytes {
+		fr.tooLarge = true
+		fr.cancel() // no one will read the rest
+		return 0, errFlightTooLarge
+	}
+	return fr.buf.Write(p)
+}
+
+// Flush is a no-op: the response is delivered whole.
+func (fr *flightRecorder) Flush() {}
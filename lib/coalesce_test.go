@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// gatedBackend serves h once gate is closed.
+func gatedBackend(t *testing.T, h http.Handler) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	gate := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-gate:
+		case <-r.Context().Done():
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s, gate
+}
+
+func coalescingLB(t *testing.T, c *Coalescer, backend string) *httptest.Server {
+	t.Helper()
+	pool, err := NewPool([]string{backend}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(c.Handler(pool))
+	t.Cleanup(func() { lb.Close(); _ = pool.Close() })
+	return lb
+}
+
+type result struct {
+	status int
+	body   string
+}
+
+// getAll sends n concurrent GETs for path, with header set on each.
+func getAll(t *testing.T, url string, n int, header http.Header) (chan result, *sync.WaitGroup) {
+	results := make(chan result, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			results <- result{resp.StatusCode, string(body)}
+		})
+	}
+	return results, &wg
+}
+
+func TestCoalesceIdenticalGETs(t *testing.T) {
+	mock := mockbackend.New(mockbackend.DefaultConfig())
+	t.Cleanup(mock.Close)
+	backend, gate := gatedBackend(t, mock)
+	c := NewCoalescer([]string{"/v1/models"})
+	lb := coalescingLB(t, c, backend.URL)
+
+	results, wg := getAll(t, lb.URL+"/v1/models", 100, nil)
+	waitFor(t, "99 requests to join the first", func() bool { return c.Stats()[0].Coalesced == 99 })
+	close(gate)
+	wg.Wait()
+	close(results)
+
+	var first string
+	for res := range results {
+		if res.status != http.StatusOK || !strings.Contains(res.body, "mock-model") {
+			t.Fatalf("response %d %q", res.status, res.body)
+		}
+		if first == "" {
+			first = res.body
+		} else if res.body != first {
+			t.Errorf("responses differ: %q and %q", res.body, first)
+		}
+	}
+	if n := mock.Stats().Paths["/v1/models"]; n != 1 {
+		t.Errorf("backend saw %d requests, want 1", n)
+	}
+	if s := c.Stats()[0]; s.Requests != 1 || s.Coalesced != 99 || s.Uncoalesced != 0 {
+		t.Errorf("stats %+v", s)
+	}
+
+	// Other callers are not answered with this caller's response.
+	results, wg = getAll(t, lb.URL+"/v1/models", 1, http.Header{"Authorization": {"Bearer other"}})
+	wg.Wait()
+	if res := <-results; res.status != http.StatusOK {
+		t.Errorf("other caller got %d", res.status)
+	}
+	if n := mock.Stats().Paths["/v1/models"]; n != 2 {
+		t.Errorf("backend saw %d requests, want 2", n)
+	}
+}
+
+func TestCoalesceWaiterCancellation(t *testing.T) {
+	mock := mockbackend.New(mockbackend.DefaultConfig())
+	t.Cleanup(mock.Close)
+	backend, gate := gatedBackend(t, mock)
+	c := NewCoalescer([]string{"/v1/"})
+	lb := coalescingLB(t, c, backend.URL)
+
+	// The first client, whose request the backend is answering, gives up.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, lb.URL+"/v1/models", nil)
+	firstDone := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		firstDone <- err
+	}()
+	waitFor(t, "the shared request", func() bool { return c.Stats()[0].Requests == 1 })
+	results, wg := getAll(t, lb.URL+"/v1/models", 3, nil)
+	waitFor(t, "3 requests to join", func() bool { return c.Stats()[0].Coalesced == 3 })
+	cancel()
+	if err := <-firstDone; err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+	close(gate)
+	wg.Wait()
+	close(results)
+	for res := range results {
+		if res.status != http.StatusOK {
+			t.Errorf("waiter got %d %q", res.status, res.body)
+		}
+	}
+	if n := mock.Stats().Paths["/v1/models"]; n != 1 {
+		t.Errorf("backend saw %d requests, want 1", n)
+	}
+}
+
+func TestCoalesceFailurePropagates(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"error status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}, http.StatusServiceUnavailable},
+		{"broken off", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			_, _ = io.WriteString(w, "partial")
+			panic(http.ErrAbortHandler)
+		}, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend, gate := gatedBackend(t, tc.handler)
+			c := NewCoalescer([]string{"/v1/models"})
+			lb := coalescingLB(t, c, backend.URL)
+			results, wg := getAll(t, lb.URL+"/v1/models", 5, nil)
+			waitFor(t, "4 requests to join", func() bool { return c.Stats()[0].Coalesced == 4 })
+			close(gate)
+			wg.Wait()
+			close(results)
+			for res := range results {
+				if res.status != tc.want {
+					t.Errorf("waiter got %d %q, want %d", res.status, res.body, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalesceTooLarge(t *testing.T) {
+	body := strings.Repeat("x", 64)
+	var mu sync.Mutex
+	seen := 0
+	backend, gate := gatedBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen++
+		mu.Unlock()
+		_, _ = io.WriteString(w, body)
+	}))
+	c := NewCoalescer([]string{"/v1/models"})
+	c.SetMaxBytes(16)
+	lb := coalescingLB(t, c, backend.URL)
+
+	results, wg := getAll(t, lb.URL+"/v1/models", 3, nil)
+	waitFor(t, "2 requests to join", func() bool { return c.Stats()[0].Coalesced == 2 })
+	close(gate)
+	wg.Wait()
+	// The key is no longer coalesced.
+	more, wg := getAll(t, lb.URL+"/v1/models", 1, nil)
+	wg.Wait()
+	close(results)
+	close(more)
+	for _, ch := range []chan result{results, more} {
+		for res := range ch {
+			if res.status != http.StatusOK || res.body != body {
+				t.Errorf("response %d %q", res.status, res.body)
+			}
+		}
+	}
+	// The abandoned shared request, then one per request.
+	mu.Lock()
+	defer mu.Unlock()
+	if seen != 5 {
+		t.Errorf("backend saw %d requests, want 5", seen)
+	}
+	if s := c.Stats()[0]; s.Requests != 1 || s.Uncoalesced != 4 {
+		t.Errorf("stats %+v", s)
+	}
+}
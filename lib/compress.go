@@ -0,0 +1,325 @@
+package lib
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response compression (--compress): a response to a client that accepts
+// gzip is compressed on its way out when it is not encoded already, is of a
+// compressible Content-Type, and is at least MinBytes long — by its
+// Content-Length, or, without one, once that many bytes have been written.
+// The body streams through the compressor; a handler that flushes before
+// MinBytes (anything streaming) is passed through as is, and a flush of a
+// compressed response flushes the compressor too. Server-sent events, HEAD
+// responses, 204/304 and partial content are never compressed. The
+// Compressor wraps the whole handler chain, so the response cache, request
+// log and token metering inside it see the plain body. Only gzip is
+// offered: the standard library has no zstd encoder, so a client accepting
+// only zstd gets the response unencoded.
+//
+// Forced decompression (--force-decompress): a backend that gzips whatever
+// it is asked has its response decompressed for a client whose
+// Accept-Encoding does not take gzip (identity, br, zstd), with
+// Content-Encoding and Content-Length removed. A client sending no
+// Accept-Encoding needs neither: the backend transport then asks for gzip
+// itself and decompresses.
+
+// DefaultCompressMinBytes is the smallest response compressed by default.
+const DefaultCompressMinBytes = 1024
+
+// DefaultCompressTypes are the media types compressed by default; a
+// trailing /* matches a whole type.
+var DefaultCompressTypes = []string{"application/json", "application/javascript", "application/xml", "text/*"}
+
+// CompressionConfig configures response compression.
+type CompressionConfig struct {
+	// MinBytes is the smallest body compressed.
+	MinBytes int64
+	// Types are the compressible media types ("text/*" for all text).
+	Types []string
+}
+
+// Compressor gzips responses for clients that accept it.
+type Compressor struct {
+	cfg     CompressionConfig
+	writers sync.Pool // *gzip.Writer
+}
+
+// NewCompressor returns a compressor for cfg; no Types takes
+// DefaultCompressTypes, and a MinBytes of 0 compresses every body.
+func NewCompressor(cfg CompressionConfig) *Compressor {
+	cfg.MinBytes = max(cfg.MinBytes, 0)
+	if len(cfg.Types) == 0 {
+		cfg.Types = DefaultCompressTypes
+	}
+	return &Compressor{cfg: cfg}
+}
+
+// Handler wraps next with compression.
+func (c *Compressor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, accepts: acceptsGzip(r.Header)}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
+
+// compressible reports whether a response with header h may be compressed.
+func (c *Compressor) compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, t := range c.cfg.Types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding in h takes gzip: named, or
+// covered by *, with a non-zero q.
+func acceptsGzip(h http.Header) bool {
+	gzipQ, starQ := "", ""
+	for _, v := range h.Values("Accept-Encoding") {
+		for coding := range strings.SplitSeq(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			q := "1"
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q = value
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip":
+				gzipQ = q
+			case "*":
+				starQ = q
+			}
+		}
+	}
+	q := gzipQ
+	if q == "" {
+		q = starQ
+	}
+	weight, err := strconv.ParseFloat(q, 64)
+	return err == nil && weight > 0
+}
+
+// compressWriter compresses a response once it qualifies (see above).
+type compressWriter struct {
+	http.ResponseWriter
+	c       *Compressor
+	accepts bool
+
+	status int
+	// decided is set once the response goes out compressed (gz) or not;
+	// until then, a response of unknown length is held in buf
+	decided bool
+	buf     []byte
+	gz      *gzip.Writer
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	if isInterim(code) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	h := w.Header()
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent || !w.c.compressible(h) {
+		w.passThrough()
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if !w.accepts {
+		w.passThrough()
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err != nil || n < w.c.cfg.MinBytes {
+			w.passThrough()
+		} else {
+			w.compress()
+		}
+	}
+	// Unknown length: decided by the first MinBytes written.
+}
+
+// passThrough sends the response as the handler writes it.
+func (w *compressWriter) passThrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// compress sends the response gzipped.
+func (w *compressWriter) compress() {
+	w.decided = true
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	// A strong validator names these exact bytes; the gzipped ones differ.
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if gz, ok := w.c.writers.Get().(*gzip.Writer); ok {
+		gz.Reset(w.ResponseWriter)
+		w.gz = gz
+	} else {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if int64(len(w.buf)) < w.c.cfg.MinBytes {
+			return len(p), nil
+		}
+		w.compress()
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// flushBuf writes the held body out.
+func (w *compressWriter) flushBuf() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// FlushError sends what was written so far: a response still undecided
+// goes out uncompressed, being streamed.
+func (w *compressWriter) FlushError() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.passThrough()
+	}
+	if err := w.flushBuf(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		if err := w.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// finish ends the response: a body shorter than MinBytes goes out as is,
+// a compressed one gets its gzip trailer.
+func (w *compressWriter) finish() {
+	if w.status == 0 {
+		return // nothing written; the server answers 200 with no body
+	}
+	if !w.decided {
+		w.passThrough()
+	}
+	_ = w.flushBuf()
+	if w.gz != nil {
+		_ = w.gz.Close()
+		w.gz.Reset(io.Discard)
+		w.c.writers.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's
+// deadline methods.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// SetForceDecompress decompresses gzipped backend responses for clients
+// that do not accept gzip (see above). Call before serving traffic.
+func (p *Pool) SetForceDecompress() {
+	p.forceDecompress = true
+	for _, b := range p.GetBackends() {
+		b.forceDecompress = true
+	}
+}
+
+// decompress replaces a gzipped body the client did not ask for with its
+// decompressed bytes, streaming.
+func (b *Backend) decompress(resp *http.Response) {
+	if !b.forceDecompress || resp.Body == nil || resp.Body == http.NoBody ||
+		!strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") ||
+		acceptsGzip(resp.Request.Header) {
+		return
+	}
+	resp.Body = &gunzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// gunzipBody decompresses body, opening the gzip stream on the first read
+// so a slow backend does not hold up the response headers.
+type gunzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+}
+
+func (g *gunzipBody) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, err
+		}
+		g.zr = zr
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gunzipBody) Close() error {
+	return g.body.Close()
+}
@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// compressGet requests path from a compressing server with Accept-Encoding
+// ae and returns the response with its raw (still encoded) body.
+func compressGet(t *testing.T, srv *httptest.Server, path, ae string) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if ae != "" {
+		req.Header.Set("Accept-Encoding", ae)
+	}
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestCompressor(t *testing.T) {
+	big := strings.Repeat(`{"choices":[{"text":"hello"}]}`, 100)
+	small := `{"ok":true}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sized", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(big)))
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, big)
+	})
+	mux.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(small)))
+		_, _ = io.WriteString(w, small)
+	})
+	// Unknown lengths, written in pieces: compressed once past the
+	// threshold, as is when it ends below it.
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		for range n {
+			_, _ = io.WriteString(w, "0123456789")
+		}
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, strings.Repeat("data: {}\n\n", 200))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = io.WriteString(w, big)
+	})
+	mux.HandleFunc("/encoded", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = io.WriteString(w, big)
+	})
+	srv := httptest.NewServer(NewCompressor(CompressionConfig{MinBytes: 1024}).Handler(mux))
+	defer srv.Close()
+
+	resp, body := compressGet(t, srv, "/sized", "br, gzip;q=0.8")
+	h := resp.Header
+	// The server may count the gzipped bytes; never the plain ones.
+	if h.Get("Content-Encoding") != "gzip" || resp.ContentLength != -1 && resp.ContentLength != int64(len(body)) ||
+		h.Get("Vary") != "Accept-Encoding" || h.Get("ETag") != `W/"v1"` {
+		t.Errorf("compressed headers: %v", h)
+	}
+	if got := gunzip(t, body); got != big {
+		t.Errorf("decompressed %d bytes, want %d", len(got), len(big))
+	}
+	if len(body) >= len(big) {
+		t.Errorf("compressed to %d bytes from %d", len(body), len(big))
+	}
+
+	for _, c := range []struct {
+		path, ae, want string
+		gzipped        bool
+	}{
+		{"/sized", "", big, false},
+		{"/sized", "identity", big, false},
+		{"/sized", "zstd", big, false},
+		{"/sized", "gzip;q=0", big, false},
+		{"/sized", "*", big, true},
+		{"/sized", "*, gzip;q=0", big, false},
+		{"/small", "gzip", small, false},
+		{"/chunked?n=103", "gzip", strings.Repeat("0123456789", 103), true},
+		{"/chunked?n=103", "", strings.Repeat("0123456789", 103), false},
+		{"/chunked?n=50", "gzip", strings.Repeat("0123456789", 50), false},
+		{"/chunked?n=0", "gzip", "", false},
+		{"/events", "gzip", strings.Repeat("data: {}\n\n", 200), false},
+		{"/image", "gzip", big, false},
+	} {
+		resp, body := compressGet(t, srv, c.path, c.ae)
+		got := string(body)
+		if c.gzipped {
+			if resp.Header.Get("Content-Encoding") != "gzip" {
+				t.Errorf("%s (%q): not compressed: %v", c.path, c.ae, resp.Header)
+				continue
+			}
+			got = gunzip(t, body)
+		} else if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s (%q): compressed: %v", c.path, c.ae, resp.Header)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s (%q): got %d bytes, want %d", c.path, c.ae, len(got), len(c.want))
+		}
+	}
+	if resp, _ := compressGet(t, srv, "/small", "gzip"); resp.Header.Get("Content-Length") != strconv.Itoa(len(small)) || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("small response headers: %v", resp.Header)
+	}
+	if resp, _ := compressGet(t, srv, "/events", "gzip"); resp.Header.Get("Vary") != "" {
+		t.Errorf("event stream headers: %v", resp.Header)
+	}
+	if resp, body := compressGet(t, srv, "/encoded", "gzip"); resp.Header.Get("Content-Encoding") != "br" || string(body) != big {
+		t.Errorf("already encoded response re-encoded: %v", resp.Header)
+	}
+}
+
+func TestCompressorStreams(t *testing.T) {
+	chunk := strings.Repeat("x", 600)
+	next := make(chan struct{})
+	srv := httptest.NewServer(NewCompressor(CompressionConfig{MinBytes: 1024}).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for range 4 {
+			_, _ = io.WriteString(w, chunk)
+			http.NewResponseController(w).Flush()
+			<-next
+		}
+	})))
+	defer srv.Close()
+	defer close(next)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The first flush came before 1024 bytes: the response streams as is.
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("response flushed below the threshold compressed: %v", resp.Header)
+	}
+	buf := make([]byte, len(chunk))
+	for i := range 4 {
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if i < 3 {
+			next <- struct{}{}
+		}
+	}
+}
+
+func TestCompressorFlushesGzip(t *testing.T) {
+	chunk := strings.Repeat("y", 2048)
+	next := make(chan struct{})
+	srv := httptest.NewServer(NewCompressor(CompressionConfig{MinBytes: 1024}).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for range 3 {
+			_, _ = io.WriteString(w, chunk)
+			http.NewResponseController(w).Flush()
+			<-next
+		}
+	})))
+	defer srv.Close()
+	defer close(next)
+
+	// Past the threshold, each flush reaches the client as a gzip block
+	// it can decompress before the body ends.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("not compressed: %v", resp.Header)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(chunk))
+	for i := range 3 {
+		if _, err := io.ReadFull(zr, buf); err != nil || string(buf) != chunk {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if i < 2 {
+			next <- struct{}{}
+		}
+	}
+}
+
+func TestForceDecompress(t *testing.T) {
+	body := strings.Repeat(`{"delta":"hi"}`, 200)
+	// The backend gzips whatever it is asked.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"b1"`)
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = io.WriteString(zw, body)
+		_ = zw.Close()
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer backend.Close()
+	pool, err := NewPool([]string{backend.URL}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	resp, raw := compressGet(t, lb, "/", "identity")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("without --force-decompress: %v", resp.Header)
+	}
+	if gunzip(t, raw) != body {
+		t.Error("gzipped body passed through altered")
+	}
+
+	pool.SetForceDecompress()
+	for _, ae := range []string{"identity", "zstd, br", "gzip;q=0"} {
+		resp, raw := compressGet(t, lb, "/", ae)
+		h := resp.Header
+		if h.Get("Content-Encoding") != "" || h.Get("Content-Length") != "" || h.Get("ETag") != `W/"b1"` {
+			t.Errorf("%q: headers %v", ae, h)
+		}
+		if string(raw) != body {
+			t.Errorf("%q: got %d bytes, want %d decompressed", ae, len(raw), len(body))
+		}
+	}
+	// A client that takes gzip still gets it as sent.
+	if resp, raw := compressGet(t, lb, "/", "gzip"); resp.Header.Get("Content-Encoding") != "gzip" || gunzip(t, raw) != body {
+		t.Errorf("gzip client: %v", resp.Header)
+	}
+}
@@ -0,0 +1,294 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON file given with --config. Flags describe a
+// single pool; the file adds named pools and the routes between them.
+type Config struct {
+	Pools  map[string]PoolConfig `json:"pools"`
+	Routes []RouteConfig         `json:"routes"`
+	// Default names the pool serving paths no route matches; without one
+	// (and without --backends) unmatched paths get 404.
+	Default string `json:"default"`
+	// Split, instead of a default pool, divides the paths no route matches
+	// between pools by percentage (see split.go).
+	Split *SplitConfig `json:"split"`
+	// Tenants are API-key holders with per-model token rate limits (see
+	// tokenlimit.go).
+	Tenants map[string]TenantConfig `json:"tenants"`
+	// Decorators are request decorators by name, for backends given with
+	// decorator=NAME (see decorator.go).
+	Decorators map[string]DecoratorConfig `json:"decorators"`
+	// CORS configures CORS instead of the --cors-* flags (see cors.go).
+	CORS *CORSConfig `json:"cors"`
+	// ResponseRewrite redacts backend identity from every pool's responses
+	// (see rewrite.go).
+	ResponseRewrite *ResponseRewriteConfig `json:"response_rewrite"`
+	// TenantRouting sends each tenant's requests to its own pool (see
+	// tenantroute.go).
+	TenantRouting *TenantRoutingConfig `json:"tenant_routing"`
+}
+
+// PoolConfig describes one named pool. Fields mirror the cmd/lb flags of the
+// same names.
+type PoolConfig struct {
+	Backends    []string `json:"backends"`
+	Routing     string   `json:"routing"`
+	MaxConns    int      `json:"max_conns"`
+	AffinityTTL Duration `json:"affinity_ttl"`
+	// HeaderRoutes send requests by header to labeled backends (see
+	// headerroute.go).
+	HeaderRoutes []HeaderRouteConfig `json:"header_routes"`
+	// PrefixHash configures routing "prefix-hash" (see prefixhash.go).
+	PrefixHash PrefixHashConfig `json:"prefix_hash"`
+	// ReportedLoadPointer is the JSON pointer routing
+	// "least-reported-load" reads from health responses (see
+	// reportedload.go).
+	ReportedLoadPointer string `json:"reported_load_pointer"`
+}
+
+// RouteConfig maps a path prefix to one or more pools. With several
+// targets, requests are split across them by weight.
+type RouteConfig struct {
+	ID      string        `json:"id"`
+	Prefix  string        `json:"prefix"`
+	Targets []RouteTarget `json:"targets"`
+	// FollowRedirects has lb follow up to this many redirects from a backend
+	// to itself instead of returning them to the client (bodiless requests
+	// only). 0 passes every redirect through.
+	FollowRedirects int `json:"follow_redirects"`
+	// Timeout overrides --request-timeout for requests on this route, e.g.
+	// hours for a completions route while the rest get seconds. 0 keeps the
+	// pool's timeout.
+	Timeout Duration `json:"timeout"`
+	// StreamingUpload streams request bodies to the backend without
+	// buffering, mirroring or retries, for large uploads (see upload.go).
+	StreamingUpload bool `json:"streaming_upload"`
+	// MaxUploadBytes caps a streaming upload's body instead of
+	// --max-request-body. 0 keeps the pool's limit.
+	MaxUploadBytes int64 `json:"max_upload_bytes"`
+}
+
+// RouteTarget is one weighted pool of a route.
+type RouteTarget struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// Duration is a time.Duration that reads from JSON as a Go duration string
+// ("30s", "1h").
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads and validates the config file at path. Unknown fields are
+// rejected, so a typo fails at startup instead of being silently ignored.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path is the operator's --config flag
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func (c *Config) validate() error {
+	for name, pc := range c.Pools {
+		if err := pc.validate(); err != nil {
+			return fmt.Errorf("pool %q: %w", name, err)
+		}
+	}
+	if _, ok := c.Pools[c.Default]; c.Default != "" && !ok {
+		return fmt.Errorf("default: unknown pool %q", c.Default)
+	}
+	if c.Split != nil {
+		if c.Default != "" {
+			return errors.New("default and split cannot both be set: the split serves unmatched paths")
+		}
+		if err := c.Split.validate(c.Pools); err != nil {
+			return fmt.Errorf("split: %w", err)
+		}
+	}
+	if c.TenantRouting != nil {
+		if err := c.TenantRouting.validate(c.Pools); err != nil {
+			return fmt.Errorf("tenant_routing: %w", err)
+		}
+	}
+	keys := make(map[string]string)
+	for name, tc := range c.Tenants {
+		if err := tc.validate(); err != nil {
+			return fmt.Errorf("tenant %q: %w", name, err)
+		}
+		for _, k := range tc.Keys {
+			if other, dup := keys[k]; dup {
+				return fmt.Errorf("tenants %q and %q share a key", other, name)
+			}
+			keys[k] = name
+		}
+	}
+	for name, dc := range c.Decorators {
+		if err := dc.validate(); err != nil {
+			return fmt.Errorf("decorator %q: %w", name, err)
+		}
+	}
+	if c.CORS != nil {
+		if _, err := NewCORS(*c.CORS); err != nil {
+			return err
+		}
+	}
+	if c.ResponseRewrite != nil {
+		if _, err := NewResponseRewrite(*c.ResponseRewrite); err != nil {
+			return err
+		}
+	}
+	ids := make(map[string]bool)
+	prefixes := make(map[string]string)
+	for _, r := range c.Routes {
+		if r.ID == "" {
+			return errors.New("every route needs an id")
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate route id %q", r.ID)
+		}
+		ids[r.ID] = true
+		if len(r.Prefix) == 0 || r.Prefix[0] != '/' {
+			return fmt.Errorf("route %q: prefix must start with /", r.ID)
+		}
+		// Only one of two routes with the same prefix could ever match.
+		if other, dup := prefixes[r.Prefix]; dup {
+			return fmt.Errorf("routes %q and %q share prefix %q", other, r.ID, r.Prefix)
+		}
+		prefixes[r.Prefix] = r.ID
+		if len(r.Targets) == 0 {
+			return fmt.Errorf("route %q: at least one target is required", r.ID)
+		}
+		targets := make(map[string]bool, len(r.Targets))
+		for _, t := range r.Targets {
+			if _, ok := c.Pools[t.Pool]; !ok {
+				return fmt.Errorf("route %q: unknown pool %q", r.ID, t.Pool)
+			}
+			// SetWeights reweights targets by pool name.
+			if targets[t.Pool] {
+				return fmt.Errorf("route %q: pool %q is a target twice", r.ID, t.Pool)
+			}
+			targets[t.Pool] = true
+		}
+		if err := validateWeights(r.Targets); err != nil {
+			return fmt.Errorf("route %q: %w", r.ID, err)
+		}
+		if r.FollowRedirects < 0 || r.FollowRedirects > maxFollowRedirects {
+			return fmt.Errorf("route %q: follow_redirects must be between 0 and %d", r.ID, maxFollowRedirects)
+		}
+		if r.Timeout < 0 {
+			return fmt.Errorf("route %q: timeout cannot be negative", r.ID)
+		}
+		if r.MaxUploadBytes < 0 {
+			return fmt.Errorf("route %q: max_upload_bytes cannot be negative", r.ID)
+		}
+		if r.MaxUploadBytes > 0 && !r.StreamingUpload {
+			return fmt.Errorf("route %q: max_upload_bytes needs streaming_upload", r.ID)
+		}
+	}
+	return nil
+}
+
+func (pc PoolConfig) validate() error {
+	if len(pc.Backends) == 0 {
+		return errors.New("at least one backend is required")
+	}
+	if pc.MaxConns < 0 {
+		return errors.New("max_conns cannot be negative")
+	}
+	if err := validateHeaderRoutes(pc.HeaderRoutes); err != nil {
+		return err
+	}
+	switch pc.Routing {
+	case "", "least-conn", "least-tokens", "outstanding-bytes":
+	case "prefix-hash":
+		if err := pc.PrefixHash.validate(); err != nil {
+			return fmt.Errorf("prefix_hash: %w", err)
+		}
+	case "least-reported-load":
+		if pc.ReportedLoadPointer != "" {
+			if _, err := parseJSONPointer(pc.ReportedLoadPointer); err != nil {
+				return fmt.Errorf("reported_load_pointer: %w", err)
+			}
+		}
+	case "cache-aware":
+		if len(pc.HeaderRoutes) > 0 {
+			return errors.New("header_routes are not supported with cache-aware routing")
+		}
+		if pc.MaxConns == 0 {
+			return errors.New("cache-aware routing requires max_conns > 0 (its load guard and cache retention are scaled by it)")
+		}
+		if pc.AffinityTTL < 0 {
+			return fmt.Errorf("affinity_ttl must be positive, got %v", time.Duration(pc.AffinityTTL))
+		}
+	default:
+		return fmt.Errorf("routing must be least-conn, cache-aware, least-tokens, prefix-hash, least-reported-load or outstanding-bytes, got %q", pc.Routing)
+	}
+	return nil
+}
+
+// NewPool validates pc and builds its pool. Backend URLs without a scheme
+// get http://, as on the command line. pc's routing, max_conns,
+// affinity_ttl, prefix_hash and reported_load_pointer override any strategy
+// options in opts.
+func (pc PoolConfig) NewPool(opts ...Option) (*Pool, error) {
+	if err := pc.validate(); err != nil {
+		return nil, err
+	}
+	opts = append(slices.Clip(opts), WithStrategy(Strategy(pc.Routing)), WithMaxConns(pc.MaxConns), WithAffinityTTL(time.Duration(pc.AffinityTTL)), WithPrefixHash(pc.PrefixHash), WithReportedLoadPointer(pc.ReportedLoadPointer))
+	pool, err := NewPool(withDefaultScheme(pc.Backends), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.SetHeaderRoutes(pc.HeaderRoutes); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// withDefaultScheme returns urls with http:// added where no scheme is given.
+func withDefaultScheme(urls []string) []string {
+	out := make([]string, len(urls))
+	for i, u := range urls {
+		if !strings.Contains(u, "://") {
+			u = "http://" + u
+		}
+		out[i] = u
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lb.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"pools": {
+			"gpu": {"backends": ["gpu-0:8000", "http://gpu-1:8000"], "routing": "cache-aware", "max_conns": 4, "affinity_ttl": "10m"},
+			"cpu": {"backends": ["http://cpu-0:8000"]}
+		},
+		"routes": [{"id": "emb", "prefix": "/v1/embeddings", "targets": [{"pool": "cpu", "weight": 1}]}]
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(cfg.Pools["gpu"].AffinityTTL) != 10*time.Minute {
+		t.Errorf("affinity_ttl = %v", time.Duration(cfg.Pools["gpu"].AffinityTTL))
+	}
+	pool, err := cfg.Pools["gpu"].NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.affinity == nil || pool.maxConns != 4 || pool.GetBackends()[0].URL.String() != "http://gpu-0:8000" {
+		t.Errorf("gpu pool not built from its config: maxConns=%d url=%s", pool.maxConns, pool.GetBackends()[0].URL)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	for name, body := range map[string]string{
+		"unknown field":            `{"pools": {"a": {"backend": ["http://a"]}}}`,
+		"no backends":              `{"pools": {"a": {}}}`,
+		"bad routing":              `{"pools": {"a": {"backends": ["http://a"], "routing": "random"}}}`,
+		"cache-aware cap":          `{"pools": {"a": {"backends": ["http://a"], "routing": "cache-aware"}}}`,
+		"bad duration":             `{"pools": {"a": {"backends": ["http://a"], "affinity_ttl": 5}}}`,
+		"unknown pool":             `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r", "prefix": "/", "targets": [{"pool": "b", "weight": 1}]}]}`,
+		"zero weights":             `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r", "prefix": "/", "targets": [{"pool": "a", "weight": 0}]}]}`,
+		"relative prefix":          `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r", "prefix": "v1", "targets": [{"pool": "a", "weight": 1}]}]}`,
+		"duplicate route":          `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r", "prefix": "/a", "targets": [{"pool": "a", "weight": 1}]}, {"id": "r", "prefix": "/b", "targets": [{"pool": "a", "weight": 1}]}]}`,
+		"duplicate route prefix":   `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r1", "prefix": "/a", "targets": [{"pool": "a", "weight": 1}]}, {"id": "r2", "prefix": "/a", "targets": [{"pool": "a", "weight": 1}]}]}`,
+		"duplicate route target":   `{"pools": {"a": {"backends": ["http://a"]}, "b": {"backends": ["http://b"]}}, "routes": [{"id": "r", "prefix": "/", "targets": [{"pool": "a", "weight": 1}, {"pool": "b", "weight": 1}, {"pool": "a", "weight": 2}]}]}`,
+		"unknown default":          `{"pools": {"a": {"backends": ["http://a"]}}, "default": "b"}`,
+		"follow redirects":         `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r", "prefix": "/", "targets": [{"pool": "a", "weight": 1}], "follow_redirects": 6}]}`,
+		"negative timeout":         `{"pools": {"a": {"backends": ["http://a"]}}, "routes": [{"id": "r", "prefix": "/", "targets": [{"pool": "a", "weight": 1}], "timeout": "-1s"}]}`,
+		"header route id":          `{"pools": {"a": {"backends": ["http://a"], "header_routes": [{"header": "X-Model-Version", "value": "v2", "labels": {"version": "v2"}}]}}}`,
+		"header no labels":         `{"pools": {"a": {"backends": ["http://a"], "header_routes": [{"id": "v2", "header": "X-Model-Version", "value": "v2"}]}}}`,
+		"header route cache-aware": `{"pools": {"a": {"backends": ["http://a"], "routing": "cache-aware", "max_conns": 4, "header_routes": [{"id": "v2", "labels": {"version": "v2"}}]}}}`,
+		"tenant no keys":           `{"tenants": {"t": {"tokens_per_minute": {"m": 1000}}}}`,
+		"tenant zero rate":         `{"tenants": {"t": {"keys": ["k"], "tokens_per_minute": {"m": 0}}}}`,
+		"shared key":               `{"tenants": {"t": {"keys": ["k"], "tokens_per_minute": {"m": 1}}, "u": {"keys": ["k"], "tokens_per_minute": {"m": 1}}}}`,
+		"cors credentials for *":   `{"cors": {"allow_origins": ["*"], "allow_credentials": true}}`,
+		"cors no origins":          `{"cors": {"max_age": "1m"}}`,
+		"rewrite field path":       `{"response_rewrite": {"remove_fields": ["errors[0]"]}}`,
+		"rewrite strip all":        `{"response_rewrite": {"strip_headers": ["*"]}}`,
+		"rewrite content type":     `{"response_rewrite": {"replace_headers": {"content-type": "text/plain"}}}`,
+		"tenant routing pool":      `{"pools": {"a": {"backends": ["http://a"]}}, "tenant_routing": {"tenants": {"t": {"pool": "b", "key_prefixes": ["sk-t-"]}}}}`,
+		"not json":                 `pools: {}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, body)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.Contains(err.Error(), "lb.json") {
+			t.Errorf("%s: error should name the file: %v", name, err)
+		}
+	}
+}
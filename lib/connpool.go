@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// Connection pool counts (GET /admin/runtime with --enable-pprof): the
+// transport keeps no per-host counts of its own, so lb keeps them per
+// backend. A proxied request holds a connection from the transport's
+// GotConn hook until its response body is closed (or it fails, or the
+// connection is upgraded away from the pool): that is the backend's
+// active count. A connection NewTransport dialed belongs to the first
+// backend a request used it for, and counts toward its open connections
+// until it closes; idle is open minus active. Connections only health
+// probes have used belong to no backend, and an HTTP/2 connection serving
+// several requests at once counts each as active, so idle never goes below
+// zero but open can be under active.
+
+// connOwner records which backend a tracked connection is counted for.
+type connOwner struct {
+	mu      sync.Mutex
+	backend *Backend
+	closed  bool
+}
+
+// claim counts the connection toward b, unless it is counted already or
+// closed.
+func (o *connOwner) claim(b *Backend) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.backend == nil && !o.closed {
+		o.backend = b
+		b.connsOpen.Add(1)
+	}
+}
+
+// release uncounts the connection as it closes.
+func (o *connOwner) release() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	if o.backend != nil {
+		o.backend.connsOpen.Add(-1)
+	}
+}
+
+// connHold is one proxied request's hold on a connection.
+type connHold struct {
+	b    *Backend
+	held atomic.Bool
+}
+
+// trace returns req with hooks counting the connection it gets. Every
+// attempt of the request (see connRetryTransport) shares the hold.
+func (h *connHold) trace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if h.held.CompareAndSwap(false, true) {
+				h.b.connsActive.Add(1)
+			}
+			if c := trackedConnOf(info.Conn); c != nil {
+				c.owner.claim(h.b)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// done releases the hold once resp's body is closed, or now if there is no
+// body to wait for.
+func (h *connHold) done(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		h.release()
+		return resp, err
+	}
+	resp.Body = &connHoldBody{ReadCloser: resp.Body, hold: h}
+	return resp, nil
+}
+
+func (h *connHold) release() {
+	if h.held.CompareAndSwap(true, false) {
+		h.b.connsActive.Add(-1)
+	}
+}
+
+// connHoldBody releases its request's connection hold when closed.
+type connHoldBody struct {
+	io.ReadCloser
+	hold *connHold
+}
+
+func (b *connHoldBody) Close() error {
+	defer b.hold.release()
+	return b.ReadCloser.Close()
+}
+
+// trackedConnOf returns the tracked connection under conn, nil for an
+// untracked one.
+func trackedConnOf(conn net.Conn) *rotatingConn {
+	if u, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = u.NetConn()
+	}
+	c, _ := conn.(*rotatingConn)
+	return c
+}
+
+// ConnPoolStats is a backend's connections in GET /admin/runtime.
+type ConnPoolStats struct {
+	Pool    string `json:"pool"`
+	Backend string `json:"backend"`
+	Open    int64  `json:"open"`
+	Active  int64  `json:"active"`
+	Idle    int64  `json:"idle"`
+}
+
+// ConnPoolStats returns the connection counts of the pool's backends.
+func (p *Pool) ConnPoolStats() []ConnPoolStats {
+	backends := p.GetBackends()
+	out := make([]ConnPoolStats, 0, len(backends))
+	for _, b := range backends {
+		open, active := b.connsOpen.Load(), b.connsActive.Load()
+		out = append(out, ConnPoolStats{Pool: metricsPoolName(p), Backend: b.ID(), Open: open, Active: active, Idle: max(0, open-active)})
+	}
+	return out
+}
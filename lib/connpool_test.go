@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestConnPoolStats(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.DefaultConfig())
+	mock.SetDelay(200 * time.Millisecond)
+	pool, err := NewPool([]string{mock.URL}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetTransport(NewTransport(DefaultTransportConfig()))
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			resp, err := http.Post(lb.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model":"m","messages":[]}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		})
+	}
+	waitFor(t, "three requests holding connections", func() bool {
+		s := pool.ConnPoolStats()[0]
+		return s.Active == 3 && s.Open == 3 && s.Idle == 0
+	})
+	wg.Wait()
+	s := pool.ConnPoolStats()[0]
+	if s.Pool != "default" || s.Backend != pool.GetBackends()[0].ID() || s.Active != 0 || s.Open != 3 || s.Idle != 3 {
+		t.Errorf("after the requests: %+v", s)
+	}
+
+	pool.transport.CloseIdleConnections()
+	waitFor(t, "idle connections closed", func() bool { return pool.ConnPoolStats()[0].Open == 0 })
+}
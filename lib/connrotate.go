@@ -0,0 +1,327 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection rotation (--backend-conn-max-lifetime, --backend-conn-max-idle):
+// a keep-alive connection parked in the transport's pool can be dead
+// without lb knowing — a load balancer or NAT between lb and the backend
+// dropped the idle flow silently — and the request next written on it gets
+// a reset, which would mark a healthy backend unhealthy. NewTransport wraps
+// every connection it dials to track its age and when bytes last moved on
+// it. A proxied request handed a reused HTTP/1 connection over either limit
+// retires it before writing a byte: the first write closes the connection
+// and fails, which net/http takes as nothing written and retries on another
+// connection, or a new one. Only a request whose body can be resent (none,
+// or replayable, see replay.go) retires a connection; any other uses it as
+// is. A ConnReaper also closes parked connections over the limits, every
+// half limit, with CloseIdleConnections on every transport sharing the
+// dialer. That never touches a connection serving a request, but closes the
+// other parked connections with the stale ones, a dial each at most per
+// interval. A connection a flush leaves open (in use, or HTTP/2) is not
+// counted as stale again until bytes move on it.
+//
+// Independently of the limits, a request that fails with a retryable
+// connection error (a reset or EOF, see failclass.go) on a reused
+// connection before any response byte arrived is retried once, on
+// a new connection, when its body can be resent, and the first failure
+// does not count against the backend. net/http itself retries only
+// idempotent requests there, and a POST is what lb mostly proxies. gRPC
+// backends (HTTP/2) are left alone.
+
+// errConnRetired fails the first write on a retired connection.
+var errConnRetired = errors.New("backend connection retired")
+
+// connRotation tracks the connections a transport (and the transports
+// derived from it) dialed, and the limits they are rotated by.
+type connRotation struct {
+	maxLifetime, maxIdle time.Duration
+	clock                Clock
+
+	mu    sync.Mutex
+	conns map[*rotatingConn]struct{}
+	// transports share the dialer; the reaper flushes their idle pools
+	transports map[*http.Transport]struct{}
+}
+
+func newConnRotation(maxLifetime, maxIdle time.Duration) *connRotation {
+	return &connRotation{
+		maxLifetime: maxLifetime,
+		maxIdle:     maxIdle,
+		clock:       systemClock{},
+		conns:       make(map[*rotatingConn]struct{}),
+		transports:  make(map[*http.Transport]struct{}),
+	}
+}
+
+// addTransport registers a transport dialing through r.
+func (r *connRotation) addTransport(t *http.Transport) {
+	r.mu.Lock()
+	r.transports[t] = struct{}{}
+	r.mu.Unlock()
+}
+
+// wrap tracks a newly dialed connection.
+func (r *connRotation) wrap(conn net.Conn) net.Conn {
+	now := r.clock.Now()
+	c := &rotatingConn{Conn: conn, rot: r, dialed: now}
+	c.lastUsed.Store(now.UnixNano())
+	r.mu.Lock()
+	r.conns[c] = struct{}{}
+	r.mu.Unlock()
+	return c
+}
+
+// reapInterval is how often a ConnReaper checks for stale connections.
+func (r *connRotation) reapInterval() time.Duration {
+	d := r.maxIdle
+	if d == 0 || r.maxLifetime > 0 && r.maxLifetime < d {
+		d = r.maxLifetime
+	}
+	return d / 2
+}
+
+// reap flushes the idle pools of r's transports if a parked connection is
+// over a limit.
+func (r *connRotation) reap() {
+	now := r.clock.Now()
+	quiet := r.reapInterval()
+	r.mu.Lock()
+	stale := false
+	for c := range r.conns {
+		if c.stale(now, quiet) {
+			stale = true
+			break
+		}
+	}
+	transports := make([]*http.Transport, 0, len(r.transports))
+	for t := range r.transports {
+		transports = append(transports, t)
+	}
+	r.mu.Unlock()
+	if !stale {
+		return
+	}
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.conns {
+		if c.stale(now, quiet) {
+			c.survived.Store(true)
+		}
+	}
+}
+
+// rotatingConn is a backend connection tracked for rotation.
+type rotatingConn struct {
+	net.Conn
+	rot    *connRotation
+	dialed time.Time
+	// lastUsed is when bytes last moved (unix nanoseconds); lastRead is
+	// set when they were read, as they are last on a parked connection
+	lastUsed atomic.Int64
+	lastRead atomic.Bool
+	// retiring fails the next write; survived is set when a flush left
+	// the connection open while it looked stale
+	retiring, survived atomic.Bool
+	closeOnce          sync.Once
+	// owner is the backend the connection is counted for (see connpool.go)
+	owner connOwner
+}
+
+func (c *rotatingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch(true)
+	}
+	return n, err
+}
+
+func (c *rotatingConn) Write(p []byte) (int, error) {
+	if c.retiring.Load() {
+		_ = c.Close()
+		return 0, errConnRetired
+	}
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch(false)
+	}
+	return n, err
+}
+
+func (c *rotatingConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.rot.mu.Lock()
+		delete(c.rot.conns, c)
+		c.rot.mu.Unlock()
+		c.owner.release()
+	})
+	return c.Conn.Close()
+}
+
+func (c *rotatingConn) touch(read bool) {
+	c.lastUsed.Store(c.rot.clock.Now().UnixNano())
+	c.lastRead.Store(read)
+	c.survived.Store(false)
+}
+
+// due reports whether the connection is over a limit at now.
+func (c *rotatingConn) due(now time.Time) bool {
+	idle := now.Sub(time.Unix(0, c.lastUsed.Load()))
+	return c.rot.maxLifetime > 0 && now.Sub(c.dialed) >= c.rot.maxLifetime ||
+		c.rot.maxIdle > 0 && idle >= c.rot.maxIdle
+}
+
+// stale reports whether the connection looks parked over a limit: its last
+// bytes were read, a response's end, and have been quiet for at least
+// quiet (or the idle limit).
+func (c *rotatingConn) stale(now time.Time, quiet time.Duration) bool {
+	if !c.lastRead.Load() || c.survived.Load() {
+		return false
+	}
+	return now.Sub(time.Unix(0, c.lastUsed.Load())) >= quiet && c.due(now)
+}
+
+// rotatingConnOf returns the tracked connection under conn, nil for an
+// untracked or HTTP/2 one.
+func rotatingConnOf(conn net.Conn) *rotatingConn {
+	if tc, ok := conn.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+		return nil
+	}
+	return trackedConnOf(conn)
+}
+
+// ConnReaper closes parked backend connections over the rotation limits.
+type ConnReaper struct {
+	rot *connRotation
+}
+
+// NewConnReaper returns a reaper for the connections of t, a transport
+// NewTransport built, or nil when t has no rotation limits.
+func NewConnReaper(t *http.Transport) *ConnReaper {
+	d, ok := transportDialers.Load(t)
+	if !ok {
+		return nil
+	}
+	rot := d.(*proxyDialer).rot
+	if rot == nil || rot.maxLifetime == 0 && rot.maxIdle == 0 {
+		return nil
+	}
+	return &ConnReaper{rot: rot}
+}
+
+// Start reaps until ctx is done.
+func (r *ConnReaper) Start(ctx context.Context) {
+	ticker := r.rot.clock.NewTicker(r.rot.reapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			r.rot.reap()
+		}
+	}
+}
+
+// ConnStats is a backend's connection churn.
+type ConnStats struct {
+	// Opened counts new connections requests were sent on, Rotated reused
+	// ones retired before use, ResetRetries requests retried after a reset
+	// on a reused connection.
+	Opened       uint64 `json:"opened"`
+	Rotated      uint64 `json:"rotated"`
+	ResetRetries uint64 `json:"reset_retries"`
+}
+
+// connStats returns b's connection churn, nil before its first connection.
+func (b *Backend) connStats() *ConnStats {
+	s := ConnStats{Opened: b.connsOpened.Load(), Rotated: b.connsRotated.Load(), ResetRetries: b.connResetRetries.Load()}
+	if s == (ConnStats{}) {
+		return nil
+	}
+	return &s
+}
+
+// connRetryTransport retires reused connections over the rotation limits
+// and retries a request reset on a reused connection once (see above).
+type connRetryTransport struct {
+	base http.RoundTripper
+	b    *Backend
+}
+
+func (t *connRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hold := &connHold{b: t.b}
+	return hold.done(t.roundTrip(hold.trace(req)))
+}
+
+func (t *connRetryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.b.grpc {
+		return t.base.RoundTrip(req)
+	}
+	resp, reset, err := t.attempt(req, false)
+	if !reset {
+		return resp, err
+	}
+	retry, rerr := rewound(req)
+	if rerr != nil {
+		return nil, err
+	}
+	t.b.connResetRetries.Add(1)
+	t.b.logger.Printf("[PROXY] %s %s on a reused connection, retrying on a new one", t.b.ID(), rootCause(err))
+	resp, _, err = t.attempt(retry, true)
+	return resp, err
+}
+
+// attempt sends req once. With fresh, every reused connection it is handed
+// is retired, so it goes out on a new one. reset reports a failure on a
+// reused connection before any response byte, for a resendable request.
+func (t *connRetryTransport) attempt(req *http.Request, fresh bool) (resp *http.Response, reset bool, err error) {
+	resendable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	var reused, responded atomic.Bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused.Store(info.Reused)
+			if !info.Reused {
+				t.b.connsOpened.Add(1)
+				return
+			}
+			if c := rotatingConnOf(info.Conn); c != nil && resendable && (fresh || c.due(c.rot.clock.Now())) {
+				c.retiring.Store(true)
+				t.b.connsRotated.Add(1)
+			}
+		},
+		GotFirstResponseByte: func() { responded.Store(true) },
+	}
+	resp, err = t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil {
+		return resp, false, nil
+	}
+	retry := resendable && reused.Load() && !responded.Load() && ClassifyFailure(err, nil, req.Context()).Retryable()
+	return nil, retry, err
+}
+
+// rewound returns req with its body rewound for a resend.
+func rewound(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.Body = body
+	return r, nil
+}
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idleKillingBackend serves HTTP/1.1 keep-alive, but like a NAT dropping
+// idle flows, resets a connection whose next request comes more than
+// killAfter after its last response. It returns the URL and the number of
+// connections reset.
+func idleKillingBackend(t *testing.T, killAfter time.Duration) (string, *atomic.Int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var killed atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				last := time.Now()
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					body, _ := io.ReadAll(req.Body)
+					if time.Since(last) > killAfter {
+						killed.Add(1)
+						_ = conn.(*net.TCPConn).SetLinger(0)
+						return
+					}
+					if _, err := io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body)); err != nil {
+						return
+					}
+					last = time.Now()
+				}
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String(), &killed
+}
+
+// rotationPool returns a pool over url on a transport with the given
+// limits and no idle timeout of its own, and its lb server.
+func rotationPool(t *testing.T, url string, cfg TransportConfig) (*Pool, *httptest.Server) {
+	t.Helper()
+	cfg.ConnectTimeout, cfg.MaxIdleConnsPerHost = time.Second, 4
+	tr := NewTransport(cfg)
+	t.Cleanup(tr.CloseIdleConnections)
+	pool, err := NewPool([]string{url}, WithTransport(tr), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	if r := NewConnReaper(tr); r != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go r.Start(ctx)
+	}
+	return pool, lb
+}
+
+func postAfter(t *testing.T, lb *httptest.Server, pause time.Duration) int {
+	t.Helper()
+	time.Sleep(pause)
+	resp, err := http.Post(lb.URL+"/v1/completions", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK && string(body) != `{"prompt":"hi"}` {
+		t.Errorf("body %q", body)
+	}
+	return resp.StatusCode
+}
+
+func TestConnMaxIdleAvoidsResets(t *testing.T) {
+	url, killed := idleKillingBackend(t, 300*time.Millisecond)
+
+	// Without rotation, a POST written on a connection the network dropped
+	// fails, and takes the backend down with it.
+	pool, lb := rotationPool(t, url, TransportConfig{})
+	if code := postAfter(t, lb, 0); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := postAfter(t, lb, 400*time.Millisecond); code != http.StatusBadGateway || pool.GetBackends()[0].IsHealthy() {
+		t.Fatalf("request on a dropped connection: %d, healthy %v", code, pool.GetBackends()[0].IsHealthy())
+	}
+
+	// With --backend-conn-max-idle below the drop, the reaper closes the
+	// parked connection first.
+	killed.Store(0)
+	pool, lb = rotationPool(t, url, TransportConfig{ConnMaxIdle: 100 * time.Millisecond})
+	for i := range 3 {
+		if code := postAfter(t, lb, 400*time.Millisecond); code != http.StatusOK {
+			t.Fatalf("request %d: %d", i, code)
+		}
+	}
+	b := pool.GetBackends()[0]
+	if killed.Load() != 0 || !b.IsHealthy() {
+		t.Errorf("%d connections reset, healthy %v", killed.Load(), b.IsHealthy())
+	}
+	if s := b.connStats(); s == nil || s.Opened != 3 {
+		t.Errorf("connection stats %+v, want 3 opened", s)
+	}
+}
+
+func TestConnResetRetriedOnce(t *testing.T) {
+	url, killed := idleKillingBackend(t, 200*time.Millisecond)
+	pool, lb := rotationPool(t, url, TransportConfig{})
+	pool.SetBodyReplay(BodyReplayConfig{MemoryBytes: 1 << 10, MaxBytes: 1 << 10})
+	for _, pause := range []time.Duration{0, 300 * time.Millisecond} {
+		if code := postAfter(t, lb, pause); code != http.StatusOK {
+			t.Fatalf("after %v: %d", pause, code)
+		}
+	}
+	b := pool.GetBackends()[0]
+	if s := b.connStats(); killed.Load() != 1 || !b.IsHealthy() || s == nil || s.ResetRetries != 1 || s.Opened != 2 || s.Rotated != 0 {
+		t.Errorf("%d reset, healthy %v, connection stats %+v", killed.Load(), b.IsHealthy(), s)
+	}
+	if got := b.outcomeFailed.Load(); got != 0 {
+		t.Errorf("%d failures recorded for the retried request", got)
+	}
+}
+
+func TestConnMaxLifetimeRotates(t *testing.T) {
+	var dialed atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	backend.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			dialed.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+	pool, lb := rotationPool(t, backend.URL, TransportConfig{ConnMaxLifetime: 100 * time.Millisecond})
+	pool.SetBodyReplay(BodyReplayConfig{MemoryBytes: 1 << 10, MaxBytes: 1 << 10})
+	for range 35 {
+		if code := postAfter(t, lb, 10*time.Millisecond); code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+	}
+	s := pool.GetBackends()[0].connStats()
+	if s == nil || s.Opened < 3 || s.Opened > 6 || s.Rotated < 2 || dialed.Load() != int64(s.Opened) {
+		t.Errorf("connection stats %+v, backend saw %d connections", s, dialed.Load())
+	}
+}
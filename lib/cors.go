@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS (--cors-allow-origins, or "cors" in the config file): browsers
+// calling lb directly need Access-Control-* headers that model servers do
+// not send, and a preflight (OPTIONS with Access-Control-Request-Method) is
+// no business of a backend's. The CORS handler wraps the whole proxy chain.
+// It answers every preflight itself with 204, never selecting a backend,
+// and puts the CORS headers on the responses to requests from allowed
+// origins, replacing any a backend sent so a browser never sees two.
+// An origin that is not allowed gets the same responses without CORS
+// headers, which the browser blocks; lb answers it no error of its own.
+// Origins are listed exactly (https://app.example.com), with a wildcard
+// first label (https://*.example.com), or as "*" for any. A response
+// depending on the origin carries Vary: Origin, and a preflight also
+// varies on the requested method and headers. Credentials are never
+// combined with a wildcard: credentialed requests need the origin echoed,
+// which for "*" would let any site act with the user's cookies, so that
+// configuration is refused.
+
+// CORSConfig configures CORS.
+type CORSConfig struct {
+	// AllowOrigins are the allowed origins: exact, https://*.example.com
+	// for any subdomain, or "*" for any origin.
+	AllowOrigins []string `json:"allow_origins"`
+	// AllowMethods are the methods a preflight may request (default GET,
+	// HEAD, POST).
+	AllowMethods []string `json:"allow_methods"`
+	// AllowHeaders are the request headers a preflight may request, "*"
+	// for any (default Authorization, Content-Type).
+	AllowHeaders []string `json:"allow_headers"`
+	// ExposeHeaders are the response headers scripts may read besides the
+	// safelisted ones.
+	ExposeHeaders []string `json:"expose_headers"`
+	// MaxAge is how long a browser may cache a preflight's answer (0 = the
+	// browser's default).
+	MaxAge Duration `json:"max_age"`
+	// AllowCredentials lets requests carry cookies and HTTP auth.
+	AllowCredentials bool `json:"allow_credentials"`
+}
+
+// Default allowed CORS methods and headers.
+var (
+	DefaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	DefaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORS adds CORS headers to responses and answers preflights.
+type CORS struct {
+	cfg CORSConfig
+	// anyOrigin is set by "*"; exact holds the listed origins and suffixes
+	// the wildcard ones as scheme and host suffix, e.g. "https", ".example.com"
+	anyOrigin bool
+	exact     map[string]bool
+	suffixes  [][2]string
+	anyHeader bool
+	methods   string // joined, for preflight responses
+}
+
+// NewCORS validates cfg and returns its handler.
+func NewCORS(cfg CORSConfig) (*CORS, error) {
+	if len(cfg.AllowOrigins) == 0 {
+		return nil, errors.New("cors: no allowed origins")
+	}
+	if len(cfg.AllowMethods) == 0 {
+		cfg.AllowMethods = DefaultCORSMethods
+	}
+	if len(cfg.AllowHeaders) == 0 {
+		cfg.AllowHeaders = DefaultCORSHeaders
+	}
+	if cfg.MaxAge < 0 {
+		return nil, errors.New("cors: max age cannot be negative")
+	}
+	c := &CORS{cfg: cfg, exact: make(map[string]bool)}
+	for _, origin := range cfg.AllowOrigins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return nil, fmt.Errorf("cors: origin %q: want scheme://host[:port], e.g. https://app.example.com", origin)
+		}
+		if host, ok := strings.CutPrefix(u.Host, "*."); ok {
+			if strings.Contains(host, "*") {
+				return nil, fmt.Errorf("cors: origin %q: only the first label may be *", origin)
+			}
+			c.suffixes = append(c.suffixes, [2]string{strings.ToLower(u.Scheme), "." + strings.ToLower(host)})
+			continue
+		}
+		if strings.Contains(u.Host, "*") {
+			return nil, fmt.Errorf("cors: origin %q: only the first label may be *", origin)
+		}
+		c.exact[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	if c.anyOrigin && cfg.AllowCredentials {
+		return nil, errors.New("cors: credentials cannot be allowed for any origin (*); list the origins")
+	}
+	cfg.AllowMethods = slices.Clone(cfg.AllowMethods)
+	for i, m := range cfg.AllowMethods {
+		cfg.AllowMethods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	for _, h := range cfg.AllowHeaders {
+		if strings.TrimSpace(h) == "*" {
+			c.anyHeader = true
+		}
+	}
+	if c.anyHeader && cfg.AllowCredentials {
+		return nil, errors.New("cors: credentials cannot be allowed with any header (*); list the headers")
+	}
+	c.methods = strings.Join(cfg.AllowMethods, ", ")
+	return c, nil
+}
+
+// allowed reports whether origin may call lb.
+func (c *CORS) allowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	if origin == "" {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	if c.exact[origin] {
+		return true
+	}
+	for _, s := range c.suffixes {
+		if host, ok := strings.CutPrefix(origin, s[0]+"://"); ok && strings.HasSuffix(host, s[1]) && len(host) > len(s[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed reports whether a preflight's comma-separated
+// Access-Control-Request-Headers are all allowed.
+func (c *CORS) headersAllowed(requested string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for h := range strings.SplitSeq(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if !slices.ContainsFunc(c.cfg.AllowHeaders, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler wraps next with CORS.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r, origin)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, c: c, origin: origin, allowed: c.allowed(origin)}, r)
+	})
+}
+
+// preflight answers a preflight request.
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	requested := r.Header.Get("Access-Control-Request-Headers")
+	if c.allowed(origin) && slices.Contains(c.cfg.AllowMethods, method) && c.headersAllowed(requested) {
+		c.setOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", c.methods)
+		if requested != "" {
+			// Echoed: the browser asked for exactly these, and "*" does
+			// not cover Authorization.
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+		if c.cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.cfg.MaxAge)/time.Second)))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setOrigin sets Access-Control-Allow-Origin for an allowed origin, and
+// the credentials header.
+func (c *CORS) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.cfg.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsWriter replaces a response's CORS headers as it is written.
+type corsWriter struct {
+	http.ResponseWriter
+	c       *CORS
+	origin  string
+	allowed bool
+	done    bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+// apply sets the CORS headers once, before the final response's header is
+// written.
+func (w *corsWriter) apply() {
+	if w.done {
+		return
+	}
+	w.done = true
+	h := w.Header()
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+	// With "*" every response is the same; otherwise even one to a request
+	// without an Origin must not be cached for one with.
+	if !w.c.anyOrigin && !slices.ContainsFunc(h.Values("Vary"), func(v string) bool {
+		return slices.ContainsFunc(strings.Split(v, ","), func(t string) bool { return strings.EqualFold(strings.TrimSpace(t), "Origin") })
+	}) {
+		h.Add("Vary", "Origin")
+	}
+	if !w.allowed {
+		return
+	}
+	w.c.setOrigin(h, w.origin)
+	if len(w.c.cfg.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(w.c.cfg.ExposeHeaders, ", "))
+	}
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's Flush,
+// Hijack and deadline methods.
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
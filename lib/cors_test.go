@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// corsProxy returns a pool over a counting backend behind a CORS handler
+// for cfg, and the backend's request count. The backend sends CORS headers
+// of its own, which lb must replace.
+func corsProxy(t *testing.T, cfg CORSConfig) (http.Handler, func() int64) {
+	t.Helper()
+	var n atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://backend.example")
+		w.Header().Set("X-Request-Id", "abc")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(backend.Close)
+	pool, err := NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cors, err := NewCORS(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cors.Handler(pool), n.Load
+}
+
+func corsRequest(h http.Handler, method, origin string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/v1/chat/completions", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h, requests := corsProxy(t, CORSConfig{
+		AllowOrigins: []string{"https://app.example.com", "https://*.tools.example.com"},
+		MaxAge:       Duration(10 * time.Minute),
+	})
+	for _, origin := range []string{"https://app.example.com", "https://ui.tools.example.com"} {
+		rec := corsRequest(h, http.MethodOptions, origin, "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "authorization, content-type")
+		got := rec.Header()
+		if rec.Code != http.StatusNoContent || got.Get("Access-Control-Allow-Origin") != origin || got.Get("Access-Control-Allow-Methods") != "GET, HEAD, POST" ||
+			got.Get("Access-Control-Allow-Headers") != "authorization, content-type" || got.Get("Access-Control-Max-Age") != "600" || got.Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("preflight from %s: %d %v", origin, rec.Code, got)
+		}
+		if vary := got.Values("Vary"); !slices.Contains(vary, "Origin") || !slices.Contains(vary, "Access-Control-Request-Headers") {
+			t.Errorf("preflight Vary %v", vary)
+		}
+	}
+
+	// Disallowed origins, methods and headers get a bare 204.
+	for _, header := range [][]string{
+		{"Origin", "https://evil.example", "Access-Control-Request-Method", "POST"},
+		{"Origin", "https://tools.example.com", "Access-Control-Request-Method", "POST"},
+		{"Origin", "http://app.example.com", "Access-Control-Request-Method", "POST"},
+		{"Origin", "https://app.example.com", "Access-Control-Request-Method", "DELETE"},
+		{"Origin", "https://app.example.com", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "x-secret"},
+	} {
+		rec := corsRequest(h, http.MethodOptions, "", header...)
+		if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("preflight %v: %d %v", header, rec.Code, rec.Header())
+		}
+	}
+	if n := requests(); n != 0 {
+		t.Errorf("%d preflights reached the backend", n)
+	}
+	// An OPTIONS request that is not a preflight is proxied.
+	if rec := corsRequest(h, http.MethodOptions, "https://app.example.com"); rec.Code != http.StatusOK || requests() != 1 {
+		t.Errorf("plain OPTIONS: %d, backend requests %d", rec.Code, requests())
+	}
+}
+
+func TestCORSSimpleRequests(t *testing.T) {
+	h, requests := corsProxy(t, CORSConfig{AllowOrigins: []string{"https://a.example", "https://b.example"}, ExposeHeaders: []string{"X-Request-Id"}})
+	for _, origin := range []string{"https://a.example", "https://B.example"} {
+		rec := corsRequest(h, http.MethodPost, origin)
+		got := rec.Header()
+		if rec.Code != http.StatusOK || got.Values("Access-Control-Allow-Origin")[0] != origin || len(got.Values("Access-Control-Allow-Origin")) != 1 ||
+			got.Get("Access-Control-Expose-Headers") != "X-Request-Id" || got.Get("Vary") != "Origin" {
+			t.Errorf("from %s: %d %v", origin, rec.Code, got)
+		}
+	}
+	// A disallowed origin, or none, gets the response without CORS headers,
+	// not an error, and without the backend's either.
+	for _, origin := range []string{"https://c.example", ""} {
+		rec := corsRequest(h, http.MethodPost, origin)
+		if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Vary") != "Origin" || rec.Body.String() != "{}" {
+			t.Errorf("from %q: %d %v", origin, rec.Code, rec.Header())
+		}
+	}
+	if n := requests(); n != 4 {
+		t.Errorf("backend requests %d, want 4", n)
+	}
+
+	wildcard, _ := corsProxy(t, CORSConfig{AllowOrigins: []string{"*"}})
+	for _, origin := range []string{"https://anywhere.example", ""} {
+		rec := corsRequest(wildcard, http.MethodGet, origin)
+		if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Vary") != "" {
+			t.Errorf("* from %q: %v", origin, rec.Header())
+		}
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	h, _ := corsProxy(t, CORSConfig{AllowOrigins: []string{"https://app.example.com"}, AllowCredentials: true, AllowHeaders: []string{"Authorization", "X-Org"}})
+	rec := corsRequest(h, http.MethodOptions, "https://app.example.com", "Access-Control-Request-Method", "POST", "Access-Control-Request-Headers", "X-Org")
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "true" || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rec.Header().Get("Access-Control-Allow-Headers") != "X-Org" {
+		t.Errorf("credentialed preflight: %v", rec.Header())
+	}
+	rec = corsRequest(h, http.MethodPost, "https://app.example.com", "Cookie", "session=1")
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "true" || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("credentialed request: %v", rec.Header())
+	}
+	if rec := corsRequest(h, http.MethodPost, "https://evil.example"); rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("credentials for a disallowed origin: %v", rec.Header())
+	}
+
+	for _, cfg := range []CORSConfig{
+		{},
+		{AllowOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowOrigins: []string{"https://a.example"}, AllowHeaders: []string{"*"}, AllowCredentials: true},
+		{AllowOrigins: []string{"app.example.com"}},
+		{AllowOrigins: []string{"https://a.example/path"}},
+		{AllowOrigins: []string{"https://*.*.example"}},
+		{AllowOrigins: []string{"https://a.example"}, MaxAge: Duration(-time.Second)},
+	} {
+		if _, err := NewCORS(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
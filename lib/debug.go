@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Debug mode (--debug-headers): every response a pool serves carries
+//
+//	X-LB-Backend: the backend URL (absent when none was chosen, e.g. a 429)
+//	X-LB-Strategy: least-conn, cache-aware, least-tokens, prefix-hash,
+//	least-reported-load or outstanding-bytes
+//	X-LB-Duration-Ms: time from lb receiving the request to the response
+//	headers; the body may stream for much longer
+//
+// set before the response headers are written, so they also reach clients
+// of streamed responses. Each request's routing decision is also kept in a
+// DecisionLog, served at GET /admin/last-requests.
+
+// Debug response headers.
+const (
+	debugBackendHeader  = "X-LB-Backend"
+	debugStrategyHeader = "X-LB-Strategy"
+	debugDurationHeader = "X-LB-Duration-Ms"
+)
+
+// Decision is one request's routing decision.
+type Decision struct {
+	Time     time.Time `json:"time"`
+	Pool     string    `json:"pool,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Backend  string    `json:"backend"`
+	Strategy string    `json:"strategy"`
+	Status   int       `json:"status"`
+	// LatencyMs is the whole request, response body included.
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// DecisionLog keeps the last routing decisions in a fixed ring. Recording
+// is one atomic add and one atomic store, so it costs the request path no
+// lock.
+type DecisionLog struct {
+	slots []atomic.Pointer[Decision]
+	next  atomic.Uint64
+}
+
+// NewDecisionLog returns a log of the last n decisions.
+func NewDecisionLog(n int) *DecisionLog {
+	return &DecisionLog{slots: make([]atomic.Pointer[Decision], max(n, 1))}
+}
+
+func (l *DecisionLog) record(d *Decision) {
+	i := l.next.Add(1) - 1
+	l.slots[i%uint64(len(l.slots))].Store(d)
+}
+
+// Last returns the logged decisions, newest first. Decisions recorded while
+// it reads may replace older ones.
+func (l *DecisionLog) Last() []Decision {
+	n := l.next.Load()
+	size := uint64(len(l.slots))
+	out := make([]Decision, 0, min(n, size))
+	for k := uint64(0); k < min(n, size); k++ {
+		if d := l.slots[(n-1-k)%size].Load(); d != nil {
+			out = append(out, *d)
+		}
+	}
+	return out
+}
+
+// SetDebug turns on debug headers for the pool's responses and records its
+// decisions in l, which several pools may share. Call before serving
+// traffic.
+func (p *Pool) SetDebug(l *DecisionLog) {
+	p.debug = l
+}
+
+// strategy names the pool's routing mode for the X-LB-Strategy header.
+func (p *Pool) strategy(upload bool) string {
+	if p.affinity != nil && !upload {
+		return "cache-aware"
+	}
+	if p.tokens != nil {
+		return "least-tokens"
+	}
+	if p.prefixHash != nil && !upload {
+		return "prefix-hash"
+	}
+	if p.reported != nil {
+		return "least-reported-load"
+	}
+	if p.outBytes {
+		return "outstanding-bytes"
+	}
+	return "least-conn"
+}
+
+// debugRecord accumulates one request's decision. Methods are nil-safe so
+// call sites don't branch on whether debug mode is on.
+type debugRecord struct {
+	log   *DecisionLog
+	clock Clock
+	start time.Time
+	d     Decision
+}
+
+// beginDebug starts r's record; the returned writer adds the debug headers.
+// The caller must defer finish() on the returned record.
+func (p *Pool) beginDebug(w http.ResponseWriter, r *http.Request) (*debugRecord, http.ResponseWriter) {
+	now := p.clock.Now()
+	_, upload := streamingUpload(r)
+	rec := &debugRecord{
+		log:   p.debug,
+		clock: p.clock,
+		start: now,
+		d:     Decision{Time: now, Pool: p.name, Method: r.Method, Path: r.URL.Path, Strategy: p.strategy(upload)},
+	}
+	return rec, &debugResponseWriter{ResponseWriter: w, rec: rec}
+}
+
+// setBackend records the chosen backend.
+func (rec *debugRecord) setBackend(b *Backend) {
+	if rec == nil {
+		return
+	}
+	rec.d.Backend = b.ID()
+}
+
+// finish logs the decision.
+func (rec *debugRecord) finish() {
+	if rec == nil {
+		return
+	}
+	if rec.d.Status == 0 {
+		rec.d.Status = http.StatusOK // nothing written; net/http sends 200
+	}
+	rec.d.LatencyMs = rec.clock.Now().Sub(rec.start).Milliseconds()
+	rec.log.record(&rec.d)
+}
+
+// debugResponseWriter adds the debug headers to the final response's
+// headers and records its status.
+type debugResponseWriter struct {
+	http.ResponseWriter
+	rec *debugRecord
+}
+
+func (w *debugResponseWriter) WriteHeader(code int) {
+	if w.rec.d.Status == 0 && !isInterim(code) {
+		w.rec.d.Status = code
+		h := w.Header()
+		if w.rec.d.Backend != "" {
+			h.Set(debugBackendHeader, w.rec.d.Backend)
+		}
+		h.Set(debugStrategyHeader, w.rec.d.Strategy)
+		h.Set(debugDurationHeader, strconv.FormatInt(w.rec.clock.Now().Sub(w.rec.start).Milliseconds(), 10))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *debugResponseWriter) Write(p []byte) (int, error) {
+	if w.rec.d.Status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's Flush
+// and deadline methods, which ReverseProxy needs to stream SSE responses.
+func (w *debugResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// portBackend answers like cmd/mock-backend, with its port in backend_port.
+func portBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"backend_port": port})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDebugHeadersNameTheServingBackend(t *testing.T) {
+	var urls []string
+	for range 3 {
+		urls = append(urls, portBackend(t).URL)
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decisions := NewDecisionLog(4)
+	pool.SetDebug(decisions)
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	const n = 10
+	for range n {
+		resp, err := http.Get(lb.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			BackendPort int `json:"backend_port"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(resp.Header.Get("X-LB-Backend"))
+		if err != nil || u.Port() != strconv.Itoa(body.BackendPort) {
+			t.Errorf("X-LB-Backend %q, but backend_port %d served it", resp.Header.Get("X-LB-Backend"), body.BackendPort)
+		}
+		if s := resp.Header.Get("X-LB-Strategy"); s != "least-conn" {
+			t.Errorf("X-LB-Strategy %q", s)
+		}
+		if _, err := strconv.Atoi(resp.Header.Get("X-LB-Duration-Ms")); err != nil {
+			t.Errorf("X-LB-Duration-Ms %q", resp.Header.Get("X-LB-Duration-Ms"))
+		}
+	}
+
+	last := decisions.Last()
+	if len(last) != 4 {
+		t.Fatalf("%d decisions kept, want the ring's 4", len(last))
+	}
+	for _, d := range last {
+		if d.Path != "/v1/models" || d.Status != http.StatusOK || d.Strategy != "least-conn" || d.Backend == "" {
+			t.Errorf("decision %+v", d)
+		}
+	}
+}
+
+func TestDecisionLogRing(t *testing.T) {
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	pool, err := NewPool([]string{"http://backend-0"}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetMaxConns(1)
+	decisions := NewDecisionLog(3)
+	pool.SetDebug(decisions)
+	pool.GetBackends()[0].IncrementConns() // at capacity: every request is a 429
+
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("X-LB-Backend") != "" || rec.Header().Get("X-LB-Strategy") != "least-conn" {
+			t.Fatalf("%s: %d %v", path, rec.Code, rec.Header())
+		}
+		clock.advance(time.Second)
+	}
+	var paths []string
+	for _, d := range decisions.Last() {
+		if d.Backend != "" || d.Status != http.StatusTooManyRequests {
+			t.Errorf("decision %+v", d)
+		}
+		paths = append(paths, d.Path)
+	}
+	if len(paths) != 3 || paths[0] != "/e" || paths[1] != "/d" || paths[2] != "/c" {
+		t.Errorf("last decisions %v, want [/e /d /c]", paths)
+	}
+}
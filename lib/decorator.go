@@ -0,0 +1,371 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request decorators add credentials to everything lb sends a backend:
+// proxied requests and health probes. A backend given as
+// "https://bedrock-proxy:443,decorator=aws" uses the decorator named "aws"
+// from the config file's "decorators". Built-in types:
+//
+//   - "header": a static header.
+//   - "bearer-file": Authorization: Bearer <file contents>, re-read every
+//     refresh when the file changes (e.g. a projected service account token).
+//   - "exec": Authorization: Bearer <command stdout>, the command re-run
+//     every refresh. A failed run keeps the last token until ttl after it
+//     was fetched.
+//
+// Library users can attach their own RequestDecorator (e.g. a SigV4 signer)
+// under any name with Pool.SetDecorators. A decorator runs in the backend's
+// transport, after every other header change, and on every redirect hop. A
+// decorator that fails leaves the backend degraded — out of selection, with
+// the reason in /stats — rather than sending the request without
+// credentials; the next health check that decorates its probe clears it.
+
+const (
+	defaultDecoratorRefresh = time.Minute
+	// execTokenTimeout bounds one run of an exec token command.
+	execTokenTimeout = 30 * time.Second
+)
+
+var errDecorator = errors.New("request decorator failed")
+
+// RequestDecorator adds credentials to a request bound for a backend. It
+// returns an error when it has none to add.
+type RequestDecorator interface {
+	Decorate(r *http.Request) error
+}
+
+// DecoratorConfig is a named decorator in the config file.
+type DecoratorConfig struct {
+	// Type is "header", "bearer-file" or "exec".
+	Type string `json:"type"`
+	// Header is the header set. bearer-file and exec default to
+	// Authorization with a "Bearer " prefix; a named header gets the bare
+	// token.
+	Header string `json:"header"`
+	// Value is the header type's value.
+	Value string `json:"value"`
+	// File is bearer-file's token file.
+	File string `json:"file"`
+	// Command is exec's argv; its trimmed stdout is the token.
+	Command []string `json:"command"`
+	// Refresh is how often bearer-file re-reads and exec re-runs (default
+	// 1m).
+	Refresh Duration `json:"refresh"`
+	// TTL is how long an exec token is used without a successful refresh
+	// (default twice the refresh).
+	TTL Duration `json:"ttl"`
+}
+
+func (dc DecoratorConfig) validate() error {
+	switch dc.Type {
+	case "header":
+		if dc.Header == "" {
+			return errors.New("header decorator needs a header")
+		}
+	case "bearer-file":
+		if dc.File == "" {
+			return errors.New("bearer-file decorator needs a file")
+		}
+	case "exec":
+		if len(dc.Command) == 0 {
+			return errors.New("exec decorator needs a command")
+		}
+	default:
+		return fmt.Errorf("unknown decorator type %q (header, bearer-file or exec)", dc.Type)
+	}
+	if dc.Refresh < 0 || dc.TTL < 0 {
+		return errors.New("refresh and ttl cannot be negative")
+	}
+	return nil
+}
+
+// Decorators are request decorators by name.
+type Decorators map[string]RequestDecorator
+
+// NewDecorators builds the config file's decorators. An exec decorator runs
+// its command once here; a failure is logged, and the backends using it stay
+// degraded until a later run succeeds.
+func NewDecorators(cfgs map[string]DecoratorConfig, opts ...Option) (Decorators, error) {
+	ds := make(Decorators, len(cfgs))
+	for _, name := range slices.Sorted(maps.Keys(cfgs)) {
+		dc := cfgs[name]
+		if err := dc.validate(); err != nil {
+			return nil, fmt.Errorf("decorator %q: %w", name, err)
+		}
+		refresh := time.Duration(dc.Refresh)
+		if refresh == 0 {
+			refresh = defaultDecoratorRefresh
+		}
+		header, prefix := dc.Header, ""
+		if header == "" {
+			header, prefix = "Authorization", "Bearer "
+		}
+		clock, logger := clockFrom(systemClock{}, opts), loggerFrom(defaultLogger(), opts)
+		switch dc.Type {
+		case "header":
+			ds[name] = staticHeader{dc.Header, dc.Value}
+		case "bearer-file":
+			ft := &fileToken{name: name, path: dc.File, header: header, prefix: prefix, refresh: refresh, clock: clock, logger: logger}
+			if err := ft.reload(); err != nil {
+				return nil, fmt.Errorf("decorator %q: %w", name, err)
+			}
+			ds[name] = ft
+		case "exec":
+			ttl := time.Duration(dc.TTL)
+			if ttl == 0 {
+				ttl = 2 * refresh
+			}
+			et := &execToken{name: name, command: dc.Command, header: header, prefix: prefix, refresh: refresh, ttl: ttl, clock: clock, logger: logger}
+			et.run(context.Background())
+			ds[name] = et
+		}
+	}
+	return ds, nil
+}
+
+// Start refreshes the decorators that need it until ctx is done.
+func (ds Decorators) Start(ctx context.Context) {
+	for _, d := range ds {
+		if r, ok := d.(interface{ Start(context.Context) }); ok {
+			go r.Start(ctx)
+		}
+	}
+}
+
+// SetDecorators attaches to each backend the decorator its spec names, also
+// for backends added later. A name missing from ds is an error. Call before
+// serving traffic.
+func (p *Pool) SetDecorators(ds Decorators) error {
+	for _, b := range p.GetBackends() {
+		if err := b.attachDecorator(ds); err != nil {
+			return err
+		}
+	}
+	p.decorators = ds
+	return nil
+}
+
+func (b *Backend) attachDecorator(ds Decorators) error {
+	if b.decoratorName == "" {
+		return nil
+	}
+	d, ok := ds[b.decoratorName]
+	if !ok {
+		return fmt.Errorf("backend %s: unknown decorator %q", b.ID(), b.decoratorName)
+	}
+	b.decorator = d
+	return nil
+}
+
+// decorate applies the backend's decorator to r, leaving the backend
+// degraded when it fails.
+func (b *Backend) decorate(r *http.Request) error {
+	if b.decorator == nil {
+		return nil
+	}
+	if err := b.decorator.Decorate(r); err != nil {
+		err = fmt.Errorf("%w: %q: %w", errDecorator, b.decoratorName, err)
+		b.setDegraded(err.Error())
+		return err
+	}
+	return nil
+}
+
+// setDegraded records why the backend cannot be sent requests ("" when it
+// can), logging transitions.
+func (b *Backend) setDegraded(reason string) {
+	b.mu.Lock()
+	prev := b.degraded
+	b.degraded = reason
+	b.mu.Unlock()
+	if (prev == "") != (reason == "") {
+		b.rotationChanged()
+	}
+	switch {
+	case prev == "" && reason != "":
+		b.logger.Printf("[HEALTH] %s degraded: %s", b.ID(), reason)
+	case prev != "" && reason == "":
+		b.logger.Printf("[HEALTH] %s no longer degraded: decorator %q recovered", b.ID(), b.decoratorName)
+	}
+}
+
+// decoratingTransport applies the backend's decorator to each request it
+// sends, on a copy: a RoundTripper must not modify its request.
+type decoratingTransport struct {
+	base http.RoundTripper
+	b    *Backend
+}
+
+func (t *decoratingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.b.decorator == nil {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if err := t.b.decorate(req); err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// setTransport sends the backend's proxied requests through base, or upload
+// for streaming uploads, following redirects (see redirect.go), decorating
+// every hop and rotating its connections (see connrotate.go).
+func (b *Backend) setTransport(base, upload http.RoundTripper) {
+	if b.grpc {
+		base, upload = grpcTransport(base), grpcTransport(upload)
+	}
+	b.proxy.Transport = &redirectTransport{base: &decoratingTransport{base: &connRetryTransport{base: &uploadTransport{base: base, upload: upload}, b: b}, b: b}}
+}
+
+type staticHeader struct{ name, value string }
+
+func (h staticHeader) Decorate(r *http.Request) error {
+	r.Header.Set(h.name, h.value)
+	return nil
+}
+
+// fileToken is the bearer-file decorator.
+type fileToken struct {
+	name, path     string
+	header, prefix string
+	refresh        time.Duration
+	clock          Clock
+	logger         Logger
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+func (f *fileToken) Decorate(r *http.Request) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.Header.Set(f.header, f.prefix+f.token)
+	return nil
+}
+
+// reload re-reads the file if it changed. A file that cannot be read, or is
+// empty, keeps the previous token.
+func (f *fileToken) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	unchanged := fi.ModTime().Equal(f.modTime)
+	f.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("%s is empty", f.path)
+	}
+	f.mu.Lock()
+	f.token, f.modTime = token, fi.ModTime()
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fileToken) Start(ctx context.Context) {
+	ticker := f.clock.NewTicker(f.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if err := f.reload(); err != nil {
+				f.logger.Printf("[DECORATOR] %s: keeping the current token: %v", f.name, err)
+			}
+		}
+	}
+}
+
+// execToken is the exec decorator.
+type execToken struct {
+	name           string
+	command        []string
+	header, prefix string
+	refresh, ttl   time.Duration
+	clock          Clock
+	logger         Logger
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+	lastErr error
+}
+
+func (e *execToken) Decorate(r *http.Request) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case e.token == "":
+		return fmt.Errorf("no token yet: %w", e.lastErr)
+	case e.clock.Now().Sub(e.fetched) > e.ttl:
+		return fmt.Errorf("token older than %v: %w", e.ttl, e.lastErr)
+	}
+	r.Header.Set(e.header, e.prefix+e.token)
+	return nil
+}
+
+// run runs the command once, caching its output as the token.
+func (e *execToken) run(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, execTokenTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...) // #nosec G204 -- the operator's configured command
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	token := strings.TrimSpace(stdout.String())
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%s: %w: %s", e.command[0], err, strings.TrimSpace(stderr.String()))
+	case token == "":
+		err = fmt.Errorf("%s printed no token", e.command[0])
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		e.lastErr = err
+		e.logger.Printf("[DECORATOR] %s: token refresh failed: %v", e.name, err)
+		return
+	}
+	e.token, e.fetched, e.lastErr = token, e.clock.Now(), nil
+}
+
+func (e *execToken) Start(ctx context.Context) {
+	ticker := e.clock.NewTicker(e.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			e.run(ctx)
+		}
+	}
+}
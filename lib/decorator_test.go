@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authEcho answers with the request's Authorization header.
+func authEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// refreshOnce advances the clock by the refresh interval and waits for the
+// exec decorator's run, successful or not, to finish.
+func refreshOnce(t *testing.T, clock *fakeClock, et *execToken) {
+	t.Helper()
+	et.mu.Lock()
+	fetched, lastErr := et.fetched, et.lastErr
+	et.mu.Unlock()
+	clock.advance(et.refresh)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		et.mu.Lock()
+		done := !et.fetched.Equal(fetched) || et.lastErr != lastErr
+		et.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("exec decorator did not refresh")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExecDecoratorRefreshTTLAndRecovery(t *testing.T) {
+	out := captureLog(t)
+	srv := authEcho(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeToken := func(token string) {
+		if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeToken("one")
+
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	decs, err := NewDecorators(map[string]DecoratorConfig{
+		"tok": {Type: "exec", Command: []string{"sh", "-c", "cat " + tokenFile}, Refresh: Duration(time.Minute)},
+	}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool([]string{srv.URL + ",decorator=tok"}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetDecorators(decs); err != nil {
+		t.Fatal(err)
+	}
+	get := func() (int, string) {
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+		return rec.Code, rec.Body.String()
+	}
+	if code, auth := get(); code != http.StatusOK || auth != "Bearer one" {
+		t.Fatalf("first token: %d %q", code, auth)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	decs.Start(ctx)
+	clock.blockUntil(t, 1)
+	et := decs["tok"].(*execToken)
+
+	writeToken("two")
+	refreshOnce(t, clock, et)
+	if code, auth := get(); code != http.StatusOK || auth != "Bearer two" {
+		t.Fatalf("refreshed token: %d %q", code, auth)
+	}
+
+	// Failed refreshes keep the token until the 2m default TTL is over.
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	refreshOnce(t, clock, et)
+	refreshOnce(t, clock, et)
+	if code, auth := get(); code != http.StatusOK || auth != "Bearer two" {
+		t.Fatalf("within TTL: %d %q", code, auth)
+	}
+	refreshOnce(t, clock, et)
+	if code, _ := get(); code != http.StatusBadGateway {
+		t.Fatalf("expired token: %d, want 502", code)
+	}
+	bs := pool.Stats().Backends[0]
+	if bs.State != "degraded" || !strings.Contains(bs.Degraded, "token older than 2m0s") {
+		t.Errorf("expired token: state %q, degraded %q", bs.State, bs.Degraded)
+	}
+	if code, _ := get(); code == http.StatusOK {
+		t.Error("a degraded backend was selected")
+	}
+
+	// A fresh token is used once a health check probes with it.
+	writeToken("three")
+	refreshOnce(t, clock, et)
+	NewHealthChecker(pool, WithInterval(time.Second)).checkBackend(ctx, pool.GetBackends()[0])
+	if code, auth := get(); code != http.StatusOK || auth != "Bearer three" {
+		t.Fatalf("after recovery: %d %q", code, auth)
+	}
+	for _, want := range []string{"degraded: request decorator failed", "no longer degraded"} {
+		if strings.Count(out.String(), want) != 1 {
+			t.Errorf("want one %q log line:\n%s", want, out)
+		}
+	}
+}
+
+func TestDecoratorConfig(t *testing.T) {
+	srv := authEcho(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("projected\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	decs, err := NewDecorators(map[string]DecoratorConfig{
+		"static": {Type: "header", Header: "Authorization", Value: "Basic dXNlcg=="},
+		"sa":     {Type: "bearer-file", File: tokenFile},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"static": "Basic dXNlcg==", "sa": "Bearer projected"} {
+		pool, err := NewPool([]string{srv.URL + ",decorator=" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pool.SetDecorators(decs); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Body.String() != want {
+			t.Errorf("%s: backend got %q, want %q", name, rec.Body, want)
+		}
+	}
+
+	pool, err := NewPool([]string{srv.URL + ",decorator=missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetDecorators(decs); err == nil || !strings.Contains(err.Error(), `unknown decorator "missing"`) {
+		t.Errorf("unknown decorator: %v", err)
+	}
+	if _, err := NewDecorators(map[string]DecoratorConfig{"sa": {Type: "bearer-file", File: tokenFile + ".missing"}}); err == nil {
+		t.Error("a missing token file was accepted")
+	}
+	if _, err := NewDecorators(map[string]DecoratorConfig{"x": {Type: "sigv4"}}); err == nil {
+		t.Error("an unknown decorator type was accepted")
+	}
+}
@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS discovery: a backend given as "dns+http://my-service.ns.svc:8000" (e.g.
+// a headless Kubernetes service) stands for every address its name resolves
+// to. A Discoverer re-resolves it every --dns-refresh and reconciles the
+// pool: new addresses join through slow start, vanished ones stop getting new
+// requests while their in-flight requests finish. A discoverer only ever
+// removes backends it added, and RemoveBackend refuses them: an address also
+// given statically stays the static backend, and a static change (an admin
+// call, a future config reload) cannot drop what discovery owns. SRV records,
+// when the name has them, give each target's port, priority (added to the
+// spec's own, see priority.go) and weight; a plain name is looked up for
+// A/AAAA records and uses the spec's port. A failed lookup, or one returning
+// no addresses, keeps the last known set.
+
+const (
+	discoveryPrefix = "dns+"
+	// discoveryTimeout bounds one resolution.
+	discoveryTimeout = 10 * time.Second
+)
+
+// Resolver is the subset of *net.Resolver discovery needs; tests inject a
+// fake.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// discoverySpec is a parsed "dns+" backend spec.
+type discoverySpec struct {
+	scheme, host, port, path string
+	// backend is the spec's attributes, given to every discovered backend
+	// with its URL and priority set; its family also keeps only the
+	// addresses of that family (see addrfamily.go)
+	backend BackendSpec
+}
+
+func parseDiscoverySpec(spec string) (discoverySpec, error) {
+	s, err := ParseBackendSpec(strings.TrimPrefix(spec, discoveryPrefix))
+	if err != nil {
+		return discoverySpec{}, err
+	}
+	if s.Health != "" {
+		return discoverySpec{}, fmt.Errorf("discovery backend %q: health= would probe one URL for every discovered backend; use --health-path", spec)
+	}
+	id, err := NormalizeBackendURL(s.URL)
+	if err != nil {
+		return discoverySpec{}, fmt.Errorf("discovery backend %q: %w", spec, err)
+	}
+	u, _ := url.Parse(id)
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	return discoverySpec{scheme: u.Scheme, host: u.Hostname(), port: port, path: u.EscapedPath(), backend: s}, nil
+}
+
+// Discoverer keeps a pool's backends in line with one "dns+" spec.
+type Discoverer struct {
+	pool     *Pool
+	spec     string
+	target   discoverySpec
+	refresh  time.Duration
+	resolver Resolver
+	// known holds the backends this discoverer added, by ID
+	known map[string]discovered
+	// conflicts holds addresses already in the pool from elsewhere, logged
+	// once
+	conflicts map[string]bool
+	resolved  bool
+}
+
+// Discoverers returns a Discoverer for each of the pool's "dns+" specs,
+// re-resolving every refresh with net.DefaultResolver.
+func (p *Pool) Discoverers(refresh time.Duration) []*Discoverer {
+	var ds []*Discoverer
+	for _, spec := range p.discovery {
+		target, _ := parseDiscoverySpec(spec) // validated by NewPool
+		ds = append(ds, &Discoverer{
+			pool: p, spec: RedactBackendSpec(spec), target: target, refresh: refresh, resolver: net.DefaultResolver,
+			known: make(map[string]discovered), conflicts: make(map[string]bool),
+		})
+	}
+	return ds
+}
+
+// SetResolver replaces the resolver. Call before Resolve.
+func (d *Discoverer) SetResolver(r Resolver) {
+	d.resolver = r
+}
+
+// Start re-resolves every refresh interval until ctx is done or the pool is
+// closed. Call Resolve once first, before serving traffic.
+func (d *Discoverer) Start(ctx context.Context) {
+	ctx, cancel := d.pool.bind(ctx)
+	defer cancel()
+	ticker := d.pool.clock.NewTicker(d.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			_ = d.Resolve(ctx)
+		}
+	}
+}
+
+// discovered is one resolved backend.
+type discovered struct {
+	priority int
+	share    float64
+}
+
+// Resolve looks the name up and reconciles the pool. On failure it logs a
+// warning, keeps the last known set and returns the error. Backends added by
+// the first call skip slow start: lb is not serving yet.
+func (d *Discoverer) Resolve(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	want, err := d.lookup(ctx)
+	if err == nil && len(want) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		d.pool.logger.Printf("[DISCOVERY] %s: lookup failed, keeping the %d known backends: %v", d.spec, len(d.known), err)
+		return err
+	}
+	warm := d.resolved
+	d.resolved = true
+
+	// A changed SRV priority moves the backend to another tier: re-add it.
+	for id, old := range d.known {
+		if t, ok := want[id]; ok && t.priority == old.priority {
+			continue
+		}
+		delete(d.known, id)
+		b, err := d.pool.removeBackend(id, d.spec)
+		if err != nil {
+			continue
+		}
+		d.pool.logger.Printf("[DISCOVERY] %s: removed %s (%d requests in flight finish)", d.spec, id, b.GetActiveConns())
+	}
+	for id, t := range want {
+		if old, ok := d.known[id]; ok {
+			if t.share != old.share {
+				d.setShare(id, t.share)
+				d.known[id] = t
+			}
+			continue
+		}
+		s := d.target.backend
+		s.URL, s.Priority = id, t.priority
+		b, err := d.pool.addBackend(s, warm, d.spec)
+		if err != nil {
+			if !d.conflicts[id] {
+				d.conflicts[id] = true
+				d.pool.logger.Printf("[DISCOVERY] %s: not adding %s: %v", d.spec, id, err)
+			}
+			continue
+		}
+		b.mu.Lock()
+		b.share = t.share
+		b.mu.Unlock()
+		b.rotationChanged()
+		d.known[id] = t
+		d.pool.logger.Printf("[DISCOVERY] %s: added %s", d.spec, id)
+	}
+	return nil
+}
+
+// setShare applies a known backend's changed SRV weight.
+func (d *Discoverer) setShare(id string, share float64) {
+	for _, b := range d.pool.GetBackends() {
+		if b.ID() == id {
+			b.mu.Lock()
+			b.share = share
+			b.mu.Unlock()
+			b.rotationChanged()
+			return
+		}
+	}
+}
+
+// lookup resolves the spec to backend IDs: through SRV records when the name
+// has them, otherwise its addresses with the spec's port.
+func (d *Discoverer) lookup(ctx context.Context) (map[string]discovered, error) {
+	t := d.target
+	want := make(map[string]discovered)
+	add := func(ip, port string, priority int, share float64) {
+		if t.backend.Family != "" && !ipOfFamily(ip, t.backend.Family) {
+			return
+		}
+		if id, err := NormalizeBackendURL(t.scheme + "://" + net.JoinHostPort(ip, port) + t.path); err == nil {
+			want[id] = discovered{t.backend.Priority + priority, share}
+		}
+	}
+
+	if _, srvs, err := d.resolver.LookupSRV(ctx, "", "", t.host); err == nil && len(srvs) > 0 {
+		var maxWeight uint16
+		for _, s := range srvs {
+			maxWeight = max(maxWeight, s.Weight)
+		}
+		for _, s := range srvs {
+			ips, err := d.resolver.LookupHost(ctx, strings.TrimSuffix(s.Target, "."))
+			if err != nil {
+				return nil, fmt.Errorf("SRV target %s: %w", s.Target, err)
+			}
+			share := 1.0
+			if maxWeight > 0 {
+				share = float64(max(s.Weight, 1)) / float64(maxWeight)
+			}
+			for _, ip := range ips {
+				add(ip, strconv.Itoa(int(s.Port)), int(s.Priority), share)
+			}
+		}
+		return want, nil
+	}
+
+	ips, err := d.resolver.LookupHost(ctx, t.host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		add(ip, t.port, 0, 1)
+	}
+	return want, nil
+}
+
+// shareLocked returns the backend's SRV weight share. Caller must hold b.mu.
+func (b *Backend) shareLocked() float64 {
+	if b.share <= 0 {
+		return 1
+	}
+	return b.share
+}
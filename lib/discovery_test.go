@@ -0,0 +1,223 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from fixed tables; a name missing from hosts fails.
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (f *fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if srvs, ok := f.srv[name]; ok {
+		return name, srvs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+func (f *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if ips, ok := f.hosts[host]; ok {
+		return ips, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func backendIDs(pool *Pool) []string {
+	var ids []string
+	for _, b := range pool.GetBackends() {
+		ids = append(ids, b.ID())
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func discoveredPool(t *testing.T, specs ...string) (*Pool, *Discoverer, *fakeResolver) {
+	t.Helper()
+	pool, err := NewPool(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := pool.Discoverers(time.Minute)
+	if len(ds) != 1 {
+		t.Fatalf("%d discoverers, want 1", len(ds))
+	}
+	res := &fakeResolver{hosts: map[string][]string{}, srv: map[string][]*net.SRV{}}
+	ds[0].SetResolver(res)
+	return pool, ds[0], res
+}
+
+func TestDiscoveryReconcilesAddresses(t *testing.T) {
+	out := captureLog(t)
+	pool, d, res := discoveredPool(t, "http://static:9000", "dns+http://vllm.ml.svc:8000,zone=a")
+	ctx := context.Background()
+
+	res.hosts["vllm.ml.svc"] = []string{"10.0.0.1", "10.0.0.2"}
+	if err := d.Resolve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://static:9000"}
+	if got := backendIDs(pool); !slices.Equal(got, want) {
+		t.Fatalf("backends %v, want %v", got, want)
+	}
+	if zone := pool.GetBackends()[1].Labels()["zone"]; zone != "a" {
+		t.Errorf("discovered backend zone label %q, want the spec's a", zone)
+	}
+
+	// A pod is replaced while a request to the old one is in flight.
+	i := slices.IndexFunc(pool.GetBackends(), func(b *Backend) bool { return b.ID() == "http://10.0.0.1:8000" })
+	old := pool.GetBackends()[i]
+	old.IncrementConns()
+	res.hosts["vllm.ml.svc"] = []string{"10.0.0.2", "10.0.0.3"}
+	if err := d.Resolve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(backendIDs(pool), old.ID()) || old.available() {
+		t.Errorf("%s still selectable after vanishing from DNS", old.ID())
+	}
+	if !slices.Contains(backendIDs(pool), "http://10.0.0.3:8000") || len(pool.GetBackends()) != 3 {
+		t.Errorf("backends after change: %v", backendIDs(pool))
+	}
+	if !strings.Contains(out.String(), "removed "+old.ID()+" (1 requests in flight finish)") {
+		t.Errorf("removal not logged:\n%s", out)
+	}
+	old.DecrementConns()
+	if old.GetActiveConns() != 0 {
+		t.Error("in-flight slot on the removed backend not released")
+	}
+
+	// Failures and empty answers keep the last known set.
+	before := backendIDs(pool)
+	delete(res.hosts, "vllm.ml.svc")
+	if err := d.Resolve(ctx); err == nil {
+		t.Error("failed lookup returned nil")
+	}
+	res.hosts["vllm.ml.svc"] = nil
+	if err := d.Resolve(ctx); err == nil {
+		t.Error("empty lookup returned nil")
+	}
+	if got := backendIDs(pool); !slices.Equal(got, before) {
+		t.Errorf("failed lookups changed the pool: %v, want %v", got, before)
+	}
+	if !strings.Contains(out.String(), "lookup failed, keeping the 2 known backends") {
+		t.Errorf("failure not logged:\n%s", out)
+	}
+}
+
+func TestDiscoverySRVPortsWeightsAndPriorities(t *testing.T) {
+	pool, d, res := discoveredPool(t, "dns+http://_http._tcp.vllm.ml.svc")
+	res.srv["_http._tcp.vllm.ml.svc"] = []*net.SRV{
+		{Target: "a.vllm.ml.svc.", Port: 8000, Weight: 100},
+		{Target: "b.vllm.ml.svc.", Port: 8001, Weight: 50},
+		{Target: "burst.vllm.ml.svc.", Port: 8000, Priority: 1, Weight: 100},
+	}
+	res.hosts["a.vllm.ml.svc"] = []string{"10.0.0.1"}
+	res.hosts["b.vllm.ml.svc"] = []string{"10.0.0.2"}
+	res.hosts["burst.vllm.ml.svc"] = []string{"10.0.1.1"}
+	if err := d.Resolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := map[string]BackendStats{}
+	for _, bs := range pool.Stats().Backends {
+		stats[bs.URL] = bs
+	}
+	for id, want := range map[string]struct {
+		priority int
+		share    float64
+	}{
+		"http://10.0.0.1:8000": {0, 1},
+		"http://10.0.0.2:8001": {0, 0.5},
+		"http://10.0.1.1:8000": {1, 1},
+	} {
+		bs, ok := stats[id]
+		if !ok || bs.Priority != want.priority || bs.Share != want.share {
+			t.Errorf("%s: %+v, want priority %d share %v", id, bs, want.priority, want.share)
+		}
+	}
+
+	// Least-conn splits 2:1 by weight, and never touches the backup tier.
+	got := make(map[string]int)
+	var held []*Backend
+	for range 3 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, b)
+		got[b.ID()]++
+	}
+	if got["http://10.0.0.1:8000"] != 2 || got["http://10.0.0.2:8001"] != 1 {
+		t.Errorf("weighted picks %v, want 2:1", got)
+	}
+	for _, b := range held {
+		b.DecrementConns()
+	}
+}
+
+func TestDiscoveredBackendsServe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+
+	pool, d, res := discoveredPool(t, "dns+http://svc.local:"+port+"/api")
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before resolution: %d, want 503", rec.Code)
+	}
+
+	res.hosts["svc.local"] = []string{host}
+	if err := d.Resolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "/api/v1/models" {
+		t.Errorf("after resolution: %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestDiscoveryOwnsItsBackends(t *testing.T) {
+	pool, d, res := discoveredPool(t, "http://10.0.0.1:8000,zone=static", "dns+http://vllm.ml.svc:8000")
+	ctx := context.Background()
+	res.hosts["vllm.ml.svc"] = []string{"10.0.0.1", "10.0.0.2"}
+	if err := d.Resolve(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address also given statically stays the static backend.
+	for _, bs := range pool.Stats().Backends {
+		want := map[string]string{"http://10.0.0.1:8000": "", "http://10.0.0.2:8000": "dns+http://vllm.ml.svc:8000"}[bs.URL]
+		if bs.DiscoveredBy != want {
+			t.Errorf("%s discovered by %q, want %q", bs.URL, bs.DiscoveredBy, want)
+		}
+	}
+
+	// A static removal cannot take a discovered backend, and discovery
+	// does not remove the static one when its record goes.
+	if _, err := pool.RemoveBackend("http://10.0.0.2:8000"); err == nil || !strings.Contains(err.Error(), "managed by discovery") {
+		t.Errorf("RemoveBackend of a discovered backend: %v", err)
+	}
+	res.hosts["vllm.ml.svc"] = []string{"10.0.0.2"}
+	if err := d.Resolve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := backendIDs(pool), []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000"}; !slices.Equal(got, want) {
+		t.Errorf("backends %v, want %v", got, want)
+	}
+	if _, err := pool.RemoveBackend("http://10.0.0.1:8000"); err != nil {
+		t.Errorf("RemoveBackend of a static backend: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+)
+
+// Maintenance drain (POST /admin/backends/{id}/drain): an operator takes a
+// backend out of rotation before rebooting it. A drained backend gets no new
+// requests while its in-flight ones finish; it is still health checked, but
+// no health transition puts it back — only Enable does, and it then rejoins
+// through slow start. Draining is separate from expected restarts (see
+// restart.go), which end by themselves.
+
+// Backend returns the pool's backend with the given URL, which may omit the
+// scheme and is matched after normalization (see NormalizeBackendURL).
+func (p *Pool) Backend(rawURL string) (*Backend, error) {
+	target, err := NormalizeBackendURL(withDefaultScheme([]string{rawURL})[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+	}
+	for _, b := range p.GetBackends() {
+		if b.ID() == target {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+}
+
+// Drain stops new selections of the backend with the given URL until Enable.
+func (p *Pool) Drain(rawURL string) (*Backend, error) {
+	b, err := p.Backend(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	was := b.drained
+	b.drained = true
+	b.mu.Unlock()
+	if !was {
+		b.rotationChanged()
+		p.logger.Printf("[ADMIN] %s draining for maintenance (%d active)", b.ID(), b.GetActiveConns())
+	}
+	return b, nil
+}
+
+// Enable returns a drained backend with the given URL to rotation and
+// clears its failure score (see failmemory.go).
+func (p *Pool) Enable(rawURL string) (*Backend, error) {
+	b, err := p.Backend(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b.failMem.reset()
+	b.mu.Lock()
+	was := b.drained
+	b.drained = false
+	if was && b.healthy {
+		b.startSlowStartLocked(b.clock.Now())
+	}
+	healthy := b.healthy
+	b.mu.Unlock()
+	if was {
+		b.rotationChanged()
+		p.logger.Printf("[ADMIN] %s enabled (%s)", b.ID(), stateName(healthy))
+	}
+	return b, nil
+}
+
+// Drained reports whether the backend is drained for maintenance.
+func (b *Backend) Drained() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.drained
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Backend-signalled drain (--drain-signal-header): a backend about to shut
+// down — vLLM on SIGTERM, behind a wrapper that says so — announces it in a
+// response header, e.g. X-Backend-Draining: true. lb then drains it as for
+// maintenance: no new requests while its in-flight ones finish, without
+// marking it unhealthy. Any value but "false" or "0" is a drain signal; the
+// header is read on proxied responses and on HTTP health probes. A passing
+// health check clears the drain, through slow start, once no response has
+// carried the signal since the check began — for an HTTP probe, its own
+// response included. A backend that closes its connections instead
+// (Connection: close) needs nothing from lb: the transport does not reuse a
+// connection whose response said so.
+
+// SetDrainSignalHeader drains backends whose responses carry the header name
+// ("" = off). Call before serving traffic.
+func (p *Pool) SetDrainSignalHeader(name string) {
+	p.drainSignal = http.CanonicalHeaderKey(name)
+	for _, b := range p.GetBackends() {
+		b.drainSignal = p.drainSignal
+	}
+}
+
+// watchDrainSignal drains b if h, a response's header, carries the drain
+// signal.
+func (b *Backend) watchDrainSignal(h http.Header) {
+	if b.drainSignal == "" {
+		return
+	}
+	v := strings.TrimSpace(h.Get(b.drainSignal))
+	if v == "" || strings.EqualFold(v, "false") || v == "0" {
+		return
+	}
+	b.mu.Lock()
+	b.drainSignals++
+	was := b.signalDrained
+	b.signalDrained = true
+	b.mu.Unlock()
+	if !was {
+		b.rotationChanged()
+		b.logger.Printf("[HEALTH] %s draining: backend sent %s: %s (%d active)", b.ID(), b.drainSignal, v, b.GetActiveConns())
+	}
+}
+
+// drainSignalCount returns how many responses have carried b's drain
+// signal, for a health check to tell whether any did while it ran.
+func (b *Backend) drainSignalCount() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.drainSignals
+}
+
+// endDrainSignal returns b to rotation after a passing health check, if it
+// was drained by its signal and no response has carried it since seen.
+func (b *Backend) endDrainSignal(seen uint64) {
+	b.mu.Lock()
+	if !b.signalDrained || b.drainSignals != seen {
+		b.mu.Unlock()
+		return
+	}
+	b.signalDrained = false
+	if b.healthy && !b.drained {
+		b.startSlowStartLocked(b.clock.Now())
+	}
+	b.mu.Unlock()
+	b.rotationChanged()
+	b.logger.Printf("[HEALTH] %s no longer signalling drain; back in rotation", b.ID())
+}
+
+// SignalDrained reports whether the backend is drained by its drain signal.
+func (b *Backend) SignalDrained() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.signalDrained
+}
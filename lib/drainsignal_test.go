@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// drainingMock serves a mock backend whose responses carry
+// X-Backend-Draining: true while draining is set.
+func drainingMock(t *testing.T, draining *atomic.Bool) (*httptest.Server, *mockbackend.Handler) {
+	t.Helper()
+	mock := mockbackend.New(mockbackend.DefaultConfig())
+	t.Cleanup(mock.Close)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.Header().Set("X-Backend-Draining", "true")
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s, mock
+}
+
+func TestDrainSignal(t *testing.T) {
+	var draining atomic.Bool
+	a, mockA := drainingMock(t, &draining)
+	b, mockB := drainingMock(t, new(atomic.Bool))
+	pool, err := NewPool([]string{a.URL, b.URL}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetDrainSignalHeader("x-backend-draining")
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	hc := NewHealthChecker(pool, WithInterval(time.Minute), WithProbeTimeout(time.Second))
+	backendA := pool.GetBackends()[0]
+	get := func(n int) {
+		t.Helper()
+		for range n {
+			resp, err := http.Get(lb.URL + "/v1/models")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	served := func() (uint64, uint64) {
+		return mockA.Stats().Paths["/v1/models"], mockB.Stats().Paths["/v1/models"]
+	}
+	// untilA sends requests until a has served one more (ties between idle
+	// backends are broken randomly).
+	untilA := func() bool {
+		t.Helper()
+		before, _ := served()
+		for range 64 {
+			get(1)
+			if after, _ := served(); after > before {
+				return true
+			}
+		}
+		return false
+	}
+
+	draining.Store(true)
+	untilA()
+	if !backendA.SignalDrained() || !backendA.IsHealthy() {
+		t.Fatalf("after the signal: drained %v, healthy %v", backendA.SignalDrained(), backendA.IsHealthy())
+	}
+	if s := pool.Stats().Backends[0]; s.State != "draining" || !s.DrainSignalled {
+		t.Errorf("stats state %q, drain_signalled %v", s.State, s.DrainSignalled)
+	}
+	beforeA, beforeB := served()
+	get(4)
+	if afterA, afterB := served(); afterA != beforeA || afterB != beforeB+4 {
+		t.Errorf("drained backend served %d more, the other %d more", afterA-beforeA, afterB-beforeB)
+	}
+
+	// A passing health check while the header is still sent keeps it drained.
+	hc.checkBackend(context.Background(), backendA)
+	if !backendA.SignalDrained() {
+		t.Fatal("health check cleared the drain while the backend still signals it")
+	}
+
+	draining.Store(false)
+	hc.checkBackend(context.Background(), backendA)
+	if backendA.SignalDrained() {
+		t.Fatal("drain not cleared after the signal stopped")
+	}
+	if !untilA() {
+		t.Error("backend not selected again after its drain cleared")
+	}
+}
+
+func TestDrainSignalValues(t *testing.T) {
+	b, err := NewBackend("http://b:8000", WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.drainSignal = "X-Backend-Draining"
+	for _, v := range []string{"", "false", "FALSE", "0", " "} {
+		b.watchDrainSignal(http.Header{"X-Backend-Draining": {v}})
+		if b.SignalDrained() {
+			t.Fatalf("%q drained the backend", v)
+		}
+	}
+	b.watchDrainSignal(http.Header{"X-Other": {"true"}})
+	if b.SignalDrained() {
+		t.Fatal("another header drained the backend")
+	}
+	b.watchDrainSignal(http.Header{"X-Backend-Draining": {"shutdown"}})
+	if !b.SignalDrained() {
+		t.Fatal("signal ignored")
+	}
+}
+
+func TestConnectionCloseNotReused(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		close bool
+		want  int64
+	}{
+		{"keep-alive", false, 1},
+		{"close", true, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var conns atomic.Int64
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.close {
+					w.Header().Set("Connection", "close")
+				}
+				_, _ = io.WriteString(w, "ok")
+			}))
+			backend.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+				if s == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			backend.Start()
+			defer backend.Close()
+			pool, err := NewPool([]string{backend.URL}, WithLogger(&lineLogger{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb := httptest.NewServer(pool)
+			defer lb.Close()
+			for range 3 {
+				resp, err := http.Get(lb.URL + "/v1/models")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if n := conns.Load(); n != tc.want {
+				t.Errorf("backend saw %d connections, want %d", n, tc.want)
+			}
+		})
+	}
+}
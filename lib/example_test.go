@@ -0,0 +1,60 @@
+package lib_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"go-load-balance/lib"
+)
+
+// A pool is an http.Handler: embed it in your own server.
+func ExampleNewPool() {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello from the backend")
+	}))
+	defer backend.Close()
+
+	pool, err := lib.NewPool([]string{backend.URL},
+		lib.WithStrategy(lib.StrategyLeastConn),
+		lib.WithMaxConns(64),
+		lib.WithLogger(log.New(os.Stderr, "lb: ", 0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+
+	front := httptest.NewServer(pool)
+	defer front.Close()
+	resp, err := http.Get(front.URL + "/v1/models")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(resp.StatusCode, string(body))
+	// Output: 200 hello from the backend
+}
+
+// Health checking runs until its context is cancelled or the pool is
+// closed.
+func ExampleNewHealthChecker() {
+	pool, err := lib.NewPool([]string{"http://10.0.0.1:8000", "http://10.0.0.2:8000"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+
+	checker := lib.NewHealthChecker(pool,
+		lib.WithInterval(10*time.Second),
+		lib.WithProbeTimeout(2*time.Second),
+		lib.WithPath("/health"))
+	go checker.Start(context.Background())
+
+	log.Fatal(http.ListenAndServe(":8080", pool))
+}
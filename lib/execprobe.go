@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Exec health checks: a backend running beside lb can be checked by a
+// command as well as over the network — a script asking nvidia-smi about
+// its GPU, or checking its server's PID file. The command is the backend's
+// check_cmd=, split at spaces and run without a shell, accepted from a
+// config file only: lb refuses it from the command line, the environment
+// and the admin API, which would let their users run commands as lb. It
+// runs with the probe timeout, in addition to the backend's usual probe, or
+// instead of it with check=exec. Exit status 0 passes; any other, or the
+// timeout, fails the probe, with the command's stderr in the reason. A
+// command still running from an earlier probe — hung past its timeout and
+// not yet reaped — is not started again: the probe is skipped, and the
+// backend keeps the state the earlier one left it in. --disable-exec-checks
+// turns exec probes off: check_cmd is then ignored, and check=exec backends
+// get the pool's probe kind.
+
+// execWaitDelay bounds the wait for a killed command's output pipes, held
+// open by any children it left behind.
+const execWaitDelay = time.Second
+
+// execMaxStderr bounds the stderr kept for a failure reason.
+const execMaxStderr = 1 << 10
+
+// DisableExecChecks turns exec probes off for the pool's backends. Call
+// before serving traffic.
+func (p *Pool) DisableExecChecks() {
+	p.noExec = true
+}
+
+// execError is a check command that exited unsuccessfully.
+type execError struct {
+	status string
+	stderr string
+}
+
+func (e *execError) Error() string {
+	if e.stderr == "" {
+		return "check_cmd " + e.status
+	}
+	return "check_cmd " + e.status + ": " + e.stderr
+}
+
+// stderrTail keeps the first execMaxStderr bytes written to it.
+type stderrTail struct {
+	buf []byte
+}
+
+func (w *stderrTail) Write(p []byte) (int, error) {
+	if room := execMaxStderr - len(w.buf); room > 0 {
+		w.buf = append(w.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// execProber runs the backend's check_cmd.
+type execProber struct {
+	hc *HealthChecker
+}
+
+func (p execProber) Probe(ctx context.Context, b *Backend) error {
+	if len(b.checkCmd) == 0 {
+		return errors.New("no check_cmd")
+	}
+	now := p.hc.clock.Now()
+	if !b.execSince.CompareAndSwap(0, now.UnixNano()) {
+		since := time.Unix(0, b.execSince.Load())
+		p.hc.logger.Printf("[HEALTH] %s check_cmd still running after %v; not started again", b.ID(), now.Sub(since).Round(time.Second))
+		return fmt.Errorf("%w: check_cmd still running", errProbeSkipped)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.hc.timeout)
+	cmd := exec.CommandContext(ctx, b.checkCmd[0], b.checkCmd[1:]...) // #nosec G204 -- check_cmd comes from the config file only
+	cmd.WaitDelay = execWaitDelay
+	stderr := &stderrTail{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		b.execSince.Store(0)
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			err = fmt.Errorf("check_cmd: %w", ctx.Err())
+		case errors.As(err, &exitErr):
+			err = &execError{status: exitErr.Error(), stderr: strings.Join(strings.Fields(string(stderr.buf)), " ")}
+		}
+		b.execSince.Store(0)
+		done <- err // before cancel, for the select below
+		cancel()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		// Killed, but not exited: leave the reaping to Wait.
+		return fmt.Errorf("check_cmd: %w", ctx.Err())
+	}
+}
+
+// runExecAlso runs b's check_cmd after a passing probe of another kind, if
+// it has one and exec probes are on.
+func (hc *HealthChecker) runExecAlso(ctx context.Context, b *Backend, kind string, err error) error {
+	if err != nil || kind == HealthCheckExec || len(b.checkCmd) == 0 || hc.pool.noExec {
+		return err
+	}
+	return hc.probers[HealthCheckExec].Probe(ctx, b)
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkScript writes a shell script and returns a check_cmd= running it.
+func checkScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return "/bin/sh " + path
+}
+
+// execPool returns a health checker over one backend given as spec.
+func execPool(t *testing.T, spec string, timeout time.Duration) (*HealthChecker, *Backend) {
+	t.Helper()
+	pool, err := NewPool([]string{spec}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute), WithProbeTimeout(timeout))
+	return hc, pool.GetBackends()[0]
+}
+
+func TestExecProbeSuccessAndFailure(t *testing.T) {
+	ok := checkScript(t, "exit 0")
+	hc, b := execPool(t, "http://127.0.0.1:1,check=exec,check_cmd="+ok, time.Second)
+	b.MarkUnhealthy()
+	for range healthyThreshold {
+		hc.checkBackend(context.Background(), b)
+	}
+	if !b.IsHealthy() {
+		t.Fatal("passing check_cmd left the backend unhealthy")
+	}
+	if got := hc.pool.Stats().Backends[0].HealthURL; got != "exec:"+ok {
+		t.Errorf("health URL shown as %q", got)
+	}
+
+	failing := checkScript(t, "echo 'GPU 0 has fallen off the bus' >&2\nexit 3")
+	hc, b = execPool(t, "http://127.0.0.1:1,check=exec,check_cmd="+failing, time.Second)
+	reason := failUntilUnhealthy(t, hc, b)
+	if reason != "probe error: check_cmd exit status 3: GPU 0 has fallen off the bus" {
+		t.Errorf("reason %q", reason)
+	}
+}
+
+func TestExecProbeTimeout(t *testing.T) {
+	hc, b := execPool(t, "http://127.0.0.1:1,check=exec,check_cmd="+checkScript(t, "sleep 10"), 200*time.Millisecond)
+	start := time.Now()
+	reason := failUntilUnhealthy(t, hc, b)
+	if reason != "probe timeout" {
+		t.Errorf("reason %q", reason)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("timed out probe took %v", d)
+	}
+}
+
+func TestExecProbeNotOverlapped(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	cmd := checkScript(t, "echo run >> "+runs+"\nsleep 0.5")
+	hc, b := execPool(t, "http://127.0.0.1:1,check=exec,check_cmd="+cmd, 5*time.Second)
+	prober := hc.probers[HealthCheckExec]
+
+	errs := make([]error, 4)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Go(func() { errs[i] = prober.Probe(context.Background(), b) })
+	}
+	wg.Wait()
+	passed, skipped := 0, 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			passed++
+		case errors.Is(err, errProbeSkipped):
+			skipped++
+		default:
+			t.Errorf("probe: %v", err)
+		}
+	}
+	data, _ := os.ReadFile(runs)
+	if n := strings.Count(string(data), "run"); n != 1 || passed != 1 || skipped != 3 {
+		t.Errorf("command ran %d times; %d probes passed, %d skipped", n, passed, skipped)
+	}
+	// Once it has finished, the next probe runs it again.
+	if err := prober.Probe(context.Background(), b); err != nil {
+		t.Errorf("probe after the first finished: %v", err)
+	}
+}
+
+func TestExecProbeWithHTTPAndDisabled(t *testing.T) {
+	backend := okBackend(t)
+	failing := checkScript(t, "echo 'pid file missing' >&2\nexit 1")
+
+	// check_cmd without check=exec runs after the HTTP probe passes.
+	hc, b := execPool(t, backend.URL+",check_cmd="+failing, time.Second)
+	if reason := failUntilUnhealthy(t, hc, b); !strings.Contains(reason, "pid file missing") {
+		t.Errorf("reason %q", reason)
+	}
+
+	// Disabled: check_cmd is ignored, and check=exec falls back to http.
+	for _, spec := range []string{backend.URL + ",check_cmd=" + failing, backend.URL + ",check=exec,check_cmd=" + failing} {
+		hc, b := execPool(t, spec, time.Second)
+		hc.pool.DisableExecChecks()
+		for range 3 {
+			hc.checkBackend(context.Background(), b)
+		}
+		if !b.IsHealthy() {
+			_, _, reason := b.HealthTransition()
+			t.Errorf("%s: unhealthy with exec checks disabled: %s", spec, reason)
+		}
+	}
+}
+
+func TestCheckCmdSpec(t *testing.T) {
+	s, err := ParseBackendSpec("http://b:8000,check=exec,check_cmd=/usr/local/bin/gpu-ok --index 0,zone=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CheckCmd != "/usr/local/bin/gpu-ok --index 0" || s.String() != "http://b:8000,check=exec,check_cmd=/usr/local/bin/gpu-ok --index 0,zone=a" {
+		t.Errorf("parsed %+v, formatted %q", s, s.String())
+	}
+	for _, bad := range []string{"http://b:8000,check=exec", "http://b:8000,check_cmd= "} {
+		if _, err := ParseBackendSpec(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+	pool, err := NewPool([]string{"http://b:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHealthCheck(HealthCheckExec, ""); err == nil {
+		t.Error("pool-wide exec probe accepted")
+	}
+}
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Failure classification: whether a proxied request or a health probe
+// failed, and whose fault it was, is decided in one place. ClassifyFailure
+// sorts an attempt's error, response and context into a FailureClass, and
+// the class alone decides the effects: whether connRetryTransport may
+// resend the request, whether it counts as a failed outcome against the
+// backend (failure memory, outlier detection, weight tuning), and whether it
+// marks the backend unhealthy. The proxy's ErrorHandler, ModifyResponse, the
+// reset retry (see connrotate.go) and the health checker all ask it.
+//
+// A done request context decides before the error it caused: lb's request
+// timeout running out is a RequestTimeout, any other end (the client went
+// away, a hedge lost, the backend was retired, lb is shutting down) is
+// ClientCancelled, and neither is held against the backend. A network
+// timeout while connecting is a BackendConnError like a refused or reset
+// connection; one after (the response header timeout, a probe's timeout)
+// is a BackendTimeout, which is not resent. A 4xx response, 429 included,
+// is the client's or a rate limiter's business; a 5xx, or a response whose
+// headers are over the limits, is the backend's. A health probe answered
+// with any failing status is a ProbeFailed: a 404 to a proxied request is
+// the client asking for something wrong, a 404 from the health endpoint is
+// the backend's answer to lb's own question.
+
+// FailureClass is the kind of failure of a proxied request or probe.
+type FailureClass int
+
+const (
+	// FailureNone is a success: no error, and a 1xx, 2xx or 3xx response.
+	FailureNone FailureClass = iota
+	// FailureClientCancelled is a request whose context was cancelled.
+	FailureClientCancelled
+	// FailureRequestTimeout is a request over its request timeout.
+	FailureRequestTimeout
+	// FailureClient4xx is a 4xx response, or a request body over the limit.
+	FailureClient4xx
+	// FailureRejected is lb refusing the exchange itself: no credentials
+	// for the backend, a response body over the limit, a probe skipped.
+	FailureRejected
+	// FailureBackendConnError is a backend that could not be reached or
+	// dropped the connection: refused, reset, EOF, a dial timeout.
+	FailureBackendConnError
+	// FailureBackendTimeout is a backend that did not answer in time on an
+	// established connection.
+	FailureBackendTimeout
+	// FailureBackend5xx is a 5xx response, or response headers over the
+	// limits.
+	FailureBackend5xx
+	// FailureProbeFailed is a health probe answered with a failing status.
+	FailureProbeFailed
+)
+
+// failureEffects is what each class does.
+var failureEffects = [...]struct {
+	name                     string
+	retryable, counts, flips bool
+}{
+	FailureNone:             {name: "ok"},
+	FailureClientCancelled:  {name: "client_cancelled"},
+	FailureRequestTimeout:   {name: "request_timeout"},
+	FailureClient4xx:        {name: "client_4xx"},
+	FailureRejected:         {name: "rejected"},
+	FailureBackendConnError: {name: "backend_conn_error", retryable: true, counts: true, flips: true},
+	FailureBackendTimeout:   {name: "backend_timeout", counts: true, flips: true},
+	FailureBackend5xx:       {name: "backend_5xx", counts: true, flips: true},
+	FailureProbeFailed:      {name: "probe_failed", flips: true},
+}
+
+func (c FailureClass) String() string {
+	return failureEffects[c].name
+}
+
+// Retryable reports whether a request failing so may be resent, on a new
+// connection, when nothing of the response arrived and its body can be
+// resent.
+func (c FailureClass) Retryable() bool {
+	return failureEffects[c].retryable
+}
+
+// CountsAsFailure reports whether the failure is a failed outcome for the
+// backend.
+func (c FailureClass) CountsAsFailure() bool {
+	return failureEffects[c].counts
+}
+
+// FlipsHealth reports whether the failure marks the backend unhealthy (or,
+// with failure memory, counts against its score).
+func (c FailureClass) FlipsHealth() bool {
+	return failureEffects[c].flips
+}
+
+// ClassifyFailure classifies an attempt that ended with err and resp under
+// reqCtx; err and resp may be nil. With both a response and an error, a 5xx
+// status decides; otherwise the error does.
+func ClassifyFailure(err error, resp *http.Response, reqCtx context.Context) FailureClass {
+	if resp != nil && (err == nil || resp.StatusCode >= 500) {
+		switch {
+		case resp.StatusCode >= 500:
+			return FailureBackend5xx
+		case resp.StatusCode >= 400:
+			return FailureClient4xx
+		}
+		return FailureNone
+	}
+	if err == nil {
+		return FailureNone
+	}
+	if reqCtx != nil && reqCtx.Err() != nil {
+		if timedOut(reqCtx) || errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+			return FailureRequestTimeout
+		}
+		return FailureClientCancelled
+	}
+	var tooLarge *http.MaxBytesError
+	var status *probeStatusError
+	switch {
+	case errors.Is(err, errProbeSkipped), errors.Is(err, errDecorator), errors.Is(err, errResponseTooLarge):
+		return FailureRejected
+	case errors.As(err, &tooLarge):
+		return FailureClient4xx
+	case errors.Is(err, errResponseHeadersTooLarge):
+		return FailureBackend5xx
+	case errors.As(err, &status):
+		return FailureProbeFailed
+	case isTimeout(err) && !dialFailure(err):
+		return FailureBackendTimeout
+	}
+	return FailureBackendConnError
+}
+
+// dialFailure reports whether err failed connecting to the backend.
+func dialFailure(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutErr is a net.Error timing out.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestClassifyFailure(t *testing.T) {
+	live := context.Background()
+	cancelled, cancel := context.WithCancel(live)
+	cancel()
+	expired, cancelExpired := context.WithTimeoutCause(live, -time.Second, errRequestTimeout)
+	defer cancelExpired()
+	deadline, cancelDeadline := context.WithTimeout(live, -time.Second)
+	defer cancelDeadline()
+	hedged, cancelHedge := context.WithCancelCause(live)
+	cancelHedge(errHedgeLost)
+	// A backend's context under an expired pool request timeout.
+	inner, cancelInner := context.WithCancelCause(expired)
+	defer cancelInner(nil)
+
+	urlErr := func(err error) error { return &url.Error{Op: "Post", URL: "http://b:8000/v1/completions", Err: err} }
+	dialErr := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	readErr := func(err error) error { return &net.OpError{Op: "read", Net: "tcp", Err: err} }
+	status := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+
+	tests := []struct {
+		name string
+		err  error
+		resp *http.Response
+		ctx  context.Context
+		want FailureClass
+	}{
+		{"nothing", nil, nil, live, FailureNone},
+		{"100", nil, status(100), live, FailureNone},
+		{"200", nil, status(200), live, FailureNone},
+		{"204 cancelled after", nil, status(204), cancelled, FailureNone},
+		{"304", nil, status(304), live, FailureNone},
+		{"400", nil, status(400), live, FailureClient4xx},
+		{"404", nil, status(404), live, FailureClient4xx},
+		{"429", nil, status(429), live, FailureClient4xx},
+		{"499", nil, status(499), live, FailureClient4xx},
+		{"500", nil, status(500), live, FailureBackend5xx},
+		{"503", nil, status(503), cancelled, FailureBackend5xx},
+		{"599", nil, status(599), live, FailureBackend5xx},
+		{"503 body too large", errResponseTooLarge, status(503), live, FailureBackend5xx},
+		{"200 body too large", fmt.Errorf("%w: 9 bytes, limit 8", errResponseTooLarge), status(200), live, FailureRejected},
+		{"200 headers too large", errResponseHeadersTooLarge, status(200), live, FailureBackend5xx},
+
+		{"cancelled", urlErr(context.Canceled), nil, cancelled, FailureClientCancelled},
+		{"cancelled mid-read", urlErr(readErr(syscall.ECONNRESET)), nil, cancelled, FailureClientCancelled},
+		{"hedge lost", context.Canceled, nil, hedged, FailureClientCancelled},
+		{"request timeout", urlErr(context.DeadlineExceeded), nil, expired, FailureRequestTimeout},
+		{"request timeout inherited", context.Canceled, nil, inner, FailureRequestTimeout},
+		{"deadline", urlErr(context.DeadlineExceeded), nil, deadline, FailureRequestTimeout},
+		{"no context", io.EOF, nil, nil, FailureBackendConnError},
+
+		{"refused", urlErr(dialErr(os.NewSyscallError("connect", syscall.ECONNREFUSED))), nil, live, FailureBackendConnError},
+		{"dial timeout", urlErr(dialErr(timeoutErr{})), nil, live, FailureBackendConnError},
+		{"reset", urlErr(readErr(os.NewSyscallError("read", syscall.ECONNRESET))), nil, live, FailureBackendConnError},
+		{"broken pipe", fmt.Errorf("write: %w", syscall.EPIPE), nil, live, FailureBackendConnError},
+		{"eof", urlErr(io.EOF), nil, live, FailureBackendConnError},
+		{"unexpected eof", io.ErrUnexpectedEOF, nil, live, FailureBackendConnError},
+		{"dns", urlErr(dialErr(&net.DNSError{Err: "no such host", Name: "b", IsNotFound: true})), nil, live, FailureBackendConnError},
+		{"idle closed", errors.New("http: server closed idle connection"), nil, live, FailureBackendConnError},
+		{"header timeout", urlErr(readErr(timeoutErr{})), nil, live, FailureBackendTimeout},
+		{"probe deadline", urlErr(context.DeadlineExceeded), nil, live, FailureBackendTimeout},
+
+		{"body too large", &http.MaxBytesError{Limit: 8}, nil, live, FailureClient4xx},
+		{"no credentials", fmt.Errorf("%w: token command failed", errDecorator), nil, live, FailureRejected},
+		{"probe skipped", fmt.Errorf("%w: check_cmd still running", errProbeSkipped), nil, live, FailureRejected},
+		{"probe 404", &probeStatusError{code: 404}, nil, live, FailureProbeFailed},
+		{"probe 503", &probeStatusError{code: 503}, nil, live, FailureProbeFailed},
+	}
+	for _, tt := range tests {
+		if got := ClassifyFailure(tt.err, tt.resp, tt.ctx); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFailureEffects(t *testing.T) {
+	tests := []struct {
+		class                    FailureClass
+		retryable, counts, flips bool
+	}{
+		{FailureNone, false, false, false},
+		{FailureClientCancelled, false, false, false},
+		{FailureRequestTimeout, false, false, false},
+		{FailureClient4xx, false, false, false},
+		{FailureRejected, false, false, false},
+		{FailureBackendConnError, true, true, true},
+		{FailureBackendTimeout, false, true, true},
+		{FailureBackend5xx, false, true, true},
+		{FailureProbeFailed, false, false, true},
+	}
+	if len(tests) != len(failureEffects) {
+		t.Fatalf("%d classes tested, %d defined", len(tests), len(failureEffects))
+	}
+	for _, tt := range tests {
+		if tt.class.Retryable() != tt.retryable || tt.class.CountsAsFailure() != tt.counts || tt.class.FlipsHealth() != tt.flips {
+			t.Errorf("%v: retryable %v, counts %v, flips %v", tt.class, tt.class.Retryable(), tt.class.CountsAsFailure(), tt.class.FlipsHealth())
+		}
+		if tt.class.String() == "" {
+			t.Errorf("class %d has no name", tt.class)
+		}
+	}
+}
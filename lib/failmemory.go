@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Failure memory (--failure-half-life): instead of the binary verdict of a
+// 5xx marking a backend unhealthy, each backend keeps a failure score, its
+// failed outcomes (5xx, proxy errors, failed RPCs) decaying over the
+// half-life, alongside its outcomes decaying the same way. Selection
+// divides its load by a weight of one minus its recent failure rate, as for
+// slow start: a backend failing half its requests gets about half the share
+// of its peers, and never less than failMemoryMinWeight, so it keeps
+// getting enough traffic to earn its way back. With failure memory on, a
+// 5xx no longer marks the backend unhealthy; proxy errors still do, and
+// health checks still take down a backend that stops answering them. An
+// admin enable clears the score.
+
+const (
+	// failMemoryMinWeight is the weight of a backend failing everything.
+	failMemoryMinWeight = 0.1
+	// failMemoryPrior counts as that many extra successes in the failure
+	// rate, so one failure on a quiet backend does not cost it most of its
+	// share, and the penalty fades as the score decays.
+	failMemoryPrior = 10
+)
+
+// failureMemory is one backend's decaying failure score.
+type failureMemory struct {
+	halfLife time.Duration
+
+	mu                 sync.Mutex
+	failures, outcomes float64 // as of last
+	last               time.Time
+}
+
+// SetFailureMemory makes selection avoid backends in proportion to their
+// recent failures, decaying over halfLife (0 = off, 5xx responses mark the
+// backend unhealthy). Call before serving traffic.
+func (p *Pool) SetFailureMemory(halfLife time.Duration) {
+	p.failureHalfLife = halfLife
+	for _, b := range p.GetBackends() {
+		b.failMem = newFailureMemory(halfLife)
+	}
+}
+
+func newFailureMemory(halfLife time.Duration) *failureMemory {
+	if halfLife <= 0 {
+		return nil
+	}
+	return &failureMemory{halfLife: halfLife}
+}
+
+// decayLocked brings the counts forward to now. Caller must hold m.mu.
+func (m *failureMemory) decayLocked(now time.Time) {
+	if !m.last.IsZero() {
+		f := math.Exp2(-now.Sub(m.last).Seconds() / m.halfLife.Seconds())
+		m.failures *= f
+		m.outcomes *= f
+	}
+	m.last = now
+}
+
+// record counts an outcome. Nil-safe.
+func (m *failureMemory) record(ok bool, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decayLocked(now)
+	m.outcomes++
+	if !ok {
+		m.failures++
+	}
+}
+
+// weight returns the selection weight at now, in [failMemoryMinWeight, 1].
+// Nil-safe.
+func (m *failureMemory) weight(now time.Time) float64 {
+	if m == nil {
+		return 1
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decayLocked(now)
+	return m.weightLocked()
+}
+
+func (m *failureMemory) weightLocked() float64 {
+	return max(failMemoryMinWeight, 1-m.failures/(m.outcomes+failMemoryPrior))
+}
+
+// reset forgets the backend's failures. Nil-safe.
+func (m *failureMemory) reset() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.failures, m.outcomes = 0, 0
+	m.mu.Unlock()
+}
+
+// failedResponse handles a response that counts as a failure: with failure
+// memory the score (already recorded by recordOutcome) does the work,
+// without it the response is a strike against the backend.
+func (b *Backend) failedResponse(reason string) {
+	if b.failMem == nil {
+		b.strike(reason, true)
+	}
+}
+
+// FailureMemoryStats is a backend's failure score in /stats: its failed
+// outcomes decayed over the half-life, and the selection weight they leave
+// it.
+type FailureMemoryStats struct {
+	Score  float64 `json:"score"`
+	Weight float64 `json:"weight"`
+}
+
+func (m *failureMemory) stats(now time.Time) *FailureMemoryStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decayLocked(now)
+	return &FailureMemoryStats{Score: m.failures, Weight: m.weightLocked()}
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestFailureMemoryWeight(t *testing.T) {
+	m := newFailureMemory(10 * time.Second)
+	t0 := time.Unix(1000, 0)
+	if w := m.weight(t0); w != 1 {
+		t.Errorf("fresh weight %v, want 1", w)
+	}
+	for i := range 1000 {
+		m.record(i%2 == 0, t0)
+	}
+	if w := m.weight(t0); w < 0.45 || w > 0.55 {
+		t.Errorf("weight at 50%% failures %v, want about 0.5", w)
+	}
+	m.reset()
+	for range 1000 {
+		m.record(false, t0)
+	}
+	if w := m.weight(t0); w != failMemoryMinWeight {
+		t.Errorf("weight failing everything %v, want %v", w, failMemoryMinWeight)
+	}
+	// Without new outcomes the score decays and the penalty fades.
+	if s := m.stats(t0.Add(10 * time.Second)); s.Score < 499 || s.Score > 501 {
+		t.Errorf("score after one half-life %v, want 500", s.Score)
+	}
+	if w := m.weight(t0.Add(5 * time.Minute)); w < 0.99 {
+		t.Errorf("weight after 30 half-lives %v, want about 1", w)
+	}
+	if (*failureMemory)(nil).weight(t0) != 1 {
+		t.Error("nil memory weight")
+	}
+}
+
+func TestFailureMemoryAvoidsFlakyBackend(t *testing.T) {
+	backends, pool, lb := mockCluster(t, 3, mockbackend.Config{Delay: 5 * time.Millisecond})
+	pool.SetFailureMemory(10 * time.Second)
+	backends[0].SetMode(mockbackend.ModeFlaky)
+	backends[0].SetFailureRate(0.5)
+	flaky := pool.GetBackends()[0]
+
+	const n = 600
+	drive(t, lb, n, 8)
+	stats := pool.Stats().Backends
+	got := stats[0].Requests
+	peers := (stats[1].Requests + stats[2].Requests) / 2
+	if got == 0 || 10*got > 7*peers {
+		t.Errorf("flaky backend served %d requests, peers %d each, want substantially fewer but some", got, peers)
+	}
+	if !flaky.IsHealthy() {
+		t.Error("flaky backend was ejected")
+	}
+	fm := stats[0].FailureMemory
+	if fm == nil || fm.Score == 0 || fm.Weight >= 0.8 {
+		t.Errorf("flaky backend failure memory %+v", fm)
+	}
+
+	if _, err := pool.Enable(flaky.URL.String()); err != nil {
+		t.Fatal(err)
+	}
+	if fm := pool.Stats().Backends[0].FailureMemory; fm.Score != 0 || fm.Weight != 1 {
+		t.Errorf("failure memory after enable %+v", fm)
+	}
+}
@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"container/list"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Fair queuing (--queue-tenant-header): with one FIFO, a tenant sending ten
+// times the requests of another fills the admission queue and gets ten times
+// the freed slots. With a tenant header, each tenant (the header's value)
+// queues in its own FIFO, and each freed slot goes to the next tenant in
+// round-robin order that has requests waiting, so every waiting tenant gets
+// an equal share of the capacity however much it offers. A served tenant
+// with more requests waiting goes to the back of the rotation, and a tenant
+// joining it goes ahead of every tenant served since, behind the other
+// newcomers: one that only ever has a request waiting, sending the next as
+// soon as the last is answered, would otherwise rejoin behind a busier
+// tenant every time and get half its share. QueueConfig.TenantSize bounds
+// each tenant's waiting requests, so one tenant cannot fill the shared
+// queue; beyond it its requests get 429 at once. Everything else — the queue
+// timeout, keepalives, cancellation and the queue position headers, which
+// count the requests the rotation dispatches first — works as for the
+// plain queue. An Authorization header is hashed (sha256:<12 hex>) before
+// it is used as a tenant name, so keys never show up in /admin/queues.
+
+// queueNoTenant is the tenant of requests without the tenant header.
+const queueNoTenant = "(none)"
+
+// errTenantQueueFull rejects a request whose tenant has TenantSize
+// requests waiting.
+var errTenantQueueFull = fmt.Errorf("%w: tenant queue full", errAtCapacity)
+
+// fair reports whether the queue dispatches round-robin across tenants.
+func (q *admissionQueue) fair() bool {
+	return q.tenants != nil
+}
+
+// tenantOf returns r's tenant, "" without fair queuing.
+func (q *admissionQueue) tenantOf(r *http.Request) string {
+	if !q.fair() {
+		return ""
+	}
+	v := strings.TrimSpace(r.Header.Get(q.cfg.TenantHeader))
+	switch {
+	case v == "":
+		return queueNoTenant
+	case http.CanonicalHeaderKey(q.cfg.TenantHeader) == "Authorization":
+		return apiKeyHash(v)
+	}
+	return v
+}
+
+// tenantFullLocked reports whether tenant has TenantSize requests waiting.
+// Caller must hold q.mu.
+func (q *admissionQueue) tenantFullLocked(tenant string) bool {
+	return q.fair() && q.cfg.TenantSize > 0 && q.tenants[tenant] != nil && q.tenants[tenant].Len() >= q.cfg.TenantSize
+}
+
+// pushLocked queues waiter. Caller must hold q.mu.
+func (q *admissionQueue) pushLocked(waiter *queueWaiter) *list.Element {
+	el := q.waiters.PushBack(waiter)
+	if q.prioritized() {
+		waiter.inClass = q.classes[waiter.priority].PushBack(el)
+		return el
+	}
+	if !q.fair() {
+		return el
+	}
+	fifo, ok := q.tenants[waiter.tenant]
+	if !ok {
+		fifo = list.New()
+		q.tenants[waiter.tenant] = fifo
+		q.turns = slices.Insert(q.turns, q.fresh, waiter.tenant)
+		q.fresh++
+	}
+	waiter.inTenant = fifo.PushBack(el)
+	return el
+}
+
+// headLocked returns the waiter to dispatch next, nil when none waits.
+// Caller must hold q.mu.
+func (q *admissionQueue) headLocked() *list.Element {
+	if q.prioritized() {
+		return q.priorityHeadLocked()
+	}
+	if !q.fair() {
+		return q.waiters.Front()
+	}
+	if len(q.turns) == 0 {
+		return nil
+	}
+	return q.tenants[q.turns[0]].Front().Value.(*list.Element)
+}
+
+// removeLocked takes el out of the queue; admitted means it was the head,
+// and its tenant's turn is over. Caller must hold q.mu.
+func (q *admissionQueue) removeLocked(el *list.Element, admitted bool) {
+	waiter := el.Value.(*queueWaiter)
+	q.waiters.Remove(el)
+	if q.prioritized() {
+		q.classes[waiter.priority].Remove(waiter.inClass)
+		return
+	}
+	if !q.fair() {
+		return
+	}
+	fifo := q.tenants[waiter.tenant]
+	fifo.Remove(waiter.inTenant)
+	i := slices.Index(q.turns, waiter.tenant)
+	if fifo.Len() > 0 && !admitted {
+		return
+	}
+	q.turns = slices.Delete(q.turns, i, i+1)
+	if i < q.fresh {
+		q.fresh--
+	}
+	if fifo.Len() == 0 {
+		delete(q.tenants, waiter.tenant)
+	} else {
+		q.turns = append(q.turns, waiter.tenant)
+	}
+}
+
+// positionLocked returns el's 1-based place in dispatch order. Caller must
+// hold q.mu.
+func (q *admissionQueue) positionLocked(el *list.Element) int {
+	if q.prioritized() {
+		return q.priorityPositionLocked(el)
+	}
+	if !q.fair() {
+		n := 1
+		for e := q.waiters.Front(); e != nil && e != el; e = e.Next() {
+			n++
+		}
+		return n
+	}
+	// el goes in its tenant's k-th turn from now; each other tenant gets k
+	// turns before it if its turn comes first, else k-1.
+	waiter := el.Value.(*queueWaiter)
+	k := 1
+	for e := q.tenants[waiter.tenant].Front(); e != waiter.inTenant; e = e.Next() {
+		k++
+	}
+	mine := slices.Index(q.turns, waiter.tenant)
+	pos := k
+	for i, tenant := range q.turns {
+		if tenant == waiter.tenant {
+			continue
+		}
+		ahead := k - 1
+		if i < mine {
+			ahead = k
+		}
+		pos += min(q.tenants[tenant].Len(), ahead)
+	}
+	return pos
+}
+
+// QueueStats is a pool's admission queue at /admin/queues: requests
+// waiting, the queue's size, with fair queuing the tenant header,
+// per-tenant cap and requests waiting per tenant, and by priority the
+// requests waiting per priority.
+type QueueStats struct {
+	Pool         string         `json:"pool"`
+	Depth        int            `json:"depth"`
+	Size         int            `json:"size"`
+	TenantHeader string         `json:"tenant_header,omitempty"`
+	TenantSize   int            `json:"tenant_size,omitempty"`
+	Tenants      map[string]int `json:"tenants,omitempty"`
+	Priorities   map[string]int `json:"priorities,omitempty"`
+}
+
+// QueueStats returns the pool's admission queue, nil without one.
+func (p *Pool) QueueStats() *QueueStats {
+	q := p.queue
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := &QueueStats{Pool: metricsPoolName(p), Depth: q.waiters.Len(), Size: q.cfg.Size, TenantHeader: q.cfg.TenantHeader, TenantSize: q.cfg.TenantSize}
+	if q.fair() {
+		s.Tenants = make(map[string]int, len(q.tenants))
+		for _, tenant := range slices.Sorted(maps.Keys(q.tenants)) {
+			s.Tenants[tenant] = q.tenants[tenant].Len()
+		}
+	}
+	if q.prioritized() {
+		s.Priorities = make(map[string]int, numPriorities)
+		for prio, fifo := range q.classes {
+			s.Priorities[RequestPriority(prio).String()] = fifo.Len()
+		}
+	}
+	return s
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFairQueueRotation(t *testing.T) {
+	q := &admissionQueue{waiters: list.New(), tenants: make(map[string]*list.List)}
+	push := func(tenant string) *list.Element {
+		return q.pushLocked(&queueWaiter{tenant: tenant})
+	}
+	a1, a2, a3, b1 := push("a"), push("a"), push("a"), push("b")
+	c1 := push("c")
+	for el, want := range map[*list.Element]int{a1: 1, b1: 2, c1: 3, a2: 4, a3: 5} {
+		if got := q.positionLocked(el); got != want {
+			t.Errorf("tenant %s: position %d, want %d", el.Value.(*queueWaiter).tenant, got, want)
+		}
+	}
+
+	// c gives up; the rest are dispatched in turn, d joining ahead of a,
+	// which has been served, but behind b, which has not.
+	q.removeLocked(c1, false)
+	var order []string
+	for head := q.headLocked(); head != nil; head = q.headLocked() {
+		order = append(order, head.Value.(*queueWaiter).tenant)
+		q.removeLocked(head, true)
+		if len(order) == 1 {
+			push("d")
+		}
+	}
+	if got := strings.Join(order, " "); got != "a b d a a" {
+		t.Errorf("dispatch order %q, want a b d a a", got)
+	}
+	if len(q.tenants) != 0 || len(q.turns) != 0 || q.waiters.Len() != 0 {
+		t.Errorf("queue not empty: %v %v %d", q.tenants, q.turns, q.waiters.Len())
+	}
+}
+
+// tenantGet sends a GET as tenant and returns its status, 0 on error.
+func tenantGet(ctx context.Context, url, tenant string) int {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if tenant != "" {
+		req.Header.Set("X-Tenant", tenant)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestFairQueueEqualShares(t *testing.T) {
+	_, lb := queuedPool(t, 5*time.Millisecond, QueueConfig{Size: 100, Timeout: 10 * time.Second, TenantHeader: "X-Tenant"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Tenant a offers ten times b's load to a backend with one slot.
+	var served [2]atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 11 {
+		tenant := min(i/10, 1) // ten workers for a, one for b
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				if tenantGet(ctx, lb.URL+"/v1/completions", []string{"a", "b"}[tenant]) == http.StatusOK {
+					served[tenant].Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	a, b := served[0].Load(), served[1].Load()
+	if a+b < 20 {
+		t.Fatalf("served only %d requests", a+b)
+	}
+	if ratio := float64(a) / float64(b); ratio < 0.6 || ratio > 1.6 {
+		t.Errorf("served a=%d b=%d, want roughly equal shares", a, b)
+	}
+}
+
+func TestFairQueueTenantCapAndCancel(t *testing.T) {
+	pool, lb := queuedPool(t, 300*time.Millisecond, QueueConfig{Size: 10, Timeout: 5 * time.Second, TenantHeader: "X-Tenant", TenantSize: 1})
+	done := occupy(t, pool, lb.URL+"/v1/completions")
+	defer func() { <-done }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan int)
+	go func() { queued <- tenantGet(ctx, lb.URL+"/v1/completions", "a") }()
+	for pool.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if code := tenantGet(context.Background(), lb.URL+"/v1/completions", "a"); code != http.StatusTooManyRequests {
+		t.Errorf("a's second queued request: status %d, want 429", code)
+	}
+	bDone := make(chan int)
+	go func() { bDone <- tenantGet(context.Background(), lb.URL+"/v1/completions", "") }()
+	for pool.QueueDepth() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	s := pool.QueueStats()
+	if s.Depth != 2 || s.Tenants["a"] != 1 || s.Tenants[queueNoTenant] != 1 || s.TenantHeader != "X-Tenant" {
+		t.Errorf("queue stats = %+v", s)
+	}
+
+	// A cancelled request leaves the queue and its tenant the rotation.
+	cancel()
+	<-queued
+	for pool.QueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if s := pool.QueueStats(); len(s.Tenants) != 1 {
+		t.Errorf("tenants after cancel = %v, want only %s", s.Tenants, queueNoTenant)
+	}
+	if code := <-bDone; code != http.StatusOK {
+		t.Errorf("untenanted request: status %d, want 200", code)
+	}
+}
+
+func TestFairQueueHashesAuthorization(t *testing.T) {
+	q := &admissionQueue{cfg: QueueConfig{TenantHeader: "authorization"}, tenants: make(map[string]*list.List)}
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer sk-secret")
+	if got := q.tenantOf(r); got != apiKeyHash("Bearer sk-secret") {
+		t.Errorf("tenant = %q, want the key's hash", got)
+	}
+}
@@ -0,0 +1,402 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Forward proxies (--backend-proxy, proxy=): backends reachable only
+// through a corporate HTTP proxy or an SSH-forwarded SOCKS5 endpoint. The
+// global proxy goes into the transport NewTransport builds; a backend's
+// proxy= gets it a transport of its own, cloned from the pool's with the
+// proxy swapped, so proxied requests, uploads, health checks of every kind
+// and prewarming all take the same way. The proxy is the transport's
+// DialContext, whatever its kind: each backend connection is a CONNECT
+// tunnel through an http:// or https:// proxy, or a SOCKS5 CONNECT, and
+// everything else about the request — its Host header, TLS to an https
+// backend, HTTP/2 — is as without a proxy. (Sending plain http requests to
+// an HTTP proxy in absolute form would address them by the Host header,
+// which lb passes through from the client.) The proxy is sent the
+// backend's host name to resolve, as an SSH -D endpoint expects, so
+// family= does not apply through a proxy. Credentials in the URL
+// (user:pass@) are sent as Basic Proxy-Authorization or SOCKS5
+// username/password, and never logged. Unix socket backends are always
+// dialed directly. A proxy that cannot be reached, refuses the
+// credentials or cannot reach the backend fails the connection with an
+// error naming the proxy, which the backend's health reason shows rather
+// than a bare dial error.
+
+// socks5DefaultPort is the port of a socks5:// proxy URL without one.
+const socks5DefaultPort = "1080"
+
+// ParseProxyURL parses a forward proxy URL: http://, https:// or
+// socks5://, host required, with optional user:pass@.
+func ParseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy URL: %w", err)
+	}
+	shown := u.Redacted()
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("proxy %q: scheme must be http, https or socks5", shown)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q: needs a host", shown)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("proxy %q: must not have a path or query", shown)
+	}
+	u.Path = ""
+	return u, nil
+}
+
+// proxyError is a failure of the forward proxy rather than the backend
+// behind it.
+type proxyError struct {
+	// proxy is the proxy URL, password redacted
+	proxy string
+	err   error
+}
+
+func (e *proxyError) Error() string { return "proxy " + e.proxy + ": " + e.err.Error() }
+func (e *proxyError) Unwrap() error { return e.err }
+
+func proxyErr(proxy *url.URL, err error) error {
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &proxyError{proxy: proxy.Redacted(), err: err}
+}
+
+// proxyAddr returns the host:port the proxy listens on.
+func proxyAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": socks5DefaultPort}[u.Scheme]
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+type dialFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyDialer is the dial layer of a transport NewTransport builds (or
+// withProxy derives): direct connects (and reaches unix sockets, see
+// unixsock.go), through proxy if set.
+type proxyDialer struct {
+	direct dialFunc
+	proxy  *url.URL
+	// tlsConfig is for an https proxy, nil for the defaults
+	tlsConfig *tls.Config
+	// rot tracks the connections dialed (see connrotate.go)
+	rot *connRotation
+}
+
+// transportDialers maps each transport NewTransport builds or withProxy
+// derives to its dial layer, so a derived transport swaps the proxy rather
+// than stacking a second one on top.
+var transportDialers sync.Map // *http.Transport → *proxyDialer
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil || d.rot == nil {
+		return conn, err
+	}
+	return d.rot.wrap(conn), nil
+}
+
+func (d *proxyDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, unix := unixSocketPath(addr); unix || d.proxy == nil {
+		return dialUnixSockets(d.direct)(ctx, network, addr)
+	}
+	conn, err := d.direct(ctx, "tcp", proxyAddr(d.proxy))
+	if err != nil {
+		return nil, proxyErr(d.proxy, err)
+	}
+	if d.proxy.Scheme == "https" {
+		cfg := &tls.Config{}
+		if d.tlsConfig != nil {
+			cfg = d.tlsConfig.Clone()
+		}
+		cfg.ServerName = d.proxy.Hostname()
+		conn = tls.Client(conn, cfg)
+	}
+	err = withDeadline(ctx, conn, func() error {
+		if d.proxy.Scheme == "socks5" {
+			return socks5Connect(conn, d.proxy, addr)
+		}
+		var err error
+		conn, err = httpConnect(conn, d.proxy, addr)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, proxyErr(d.proxy, err)
+	}
+	return conn, nil
+}
+
+// applyProxy makes t reach backends through proxy (nil for directly, or
+// for HTTP_PROXY and friends from the environment when useEnv) with
+// direct as its underlying dialer, tracking connections with rot.
+func applyProxy(t *http.Transport, direct dialFunc, proxy *url.URL, useEnv bool, rot *connRotation) {
+	d := &proxyDialer{direct: direct, proxy: proxy, tlsConfig: t.TLSClientConfig, rot: rot}
+	if rot != nil {
+		rot.addTransport(t)
+	}
+	t.DialContext = d.DialContext
+	t.Proxy = nil
+	if proxy == nil && useEnv {
+		t.Proxy = bypassProxyForUnixSockets(http.ProxyFromEnvironment)
+	}
+	transportDialers.Store(t, d)
+}
+
+// withProxy returns a clone of t reaching backends through proxy instead
+// of t's proxy.
+func withProxy(t *http.Transport, proxy *url.URL) *http.Transport {
+	c := t.Clone()
+	direct := t.DialContext
+	var rot *connRotation
+	if d, ok := transportDialers.Load(t); ok {
+		direct, rot = d.(*proxyDialer).direct, d.(*proxyDialer).rot
+	}
+	if direct == nil {
+		direct = (&net.Dialer{}).DialContext
+	}
+	applyProxy(c, direct, proxy, false, rot)
+	return c
+}
+
+// setForwardProxy gives b its own proxy, overriding the transport's. Its
+// transport is derived when the pool's is set (see attachTransport).
+func (b *Backend) setForwardProxy(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := ParseProxyURL(raw)
+	if err != nil {
+		return fmt.Errorf("backend %s: %w", b.id, err)
+	}
+	b.viaProxy = u
+	return nil
+}
+
+// attachTransport points b's proxy at the pool's transport, or at one
+// derived from it for b's own forward proxy or PROXY header (see
+// proxyproto.go).
+func (p *Pool) attachTransport(b *Backend) {
+	if b.viaProxy == nil && b.sendProxy == "" {
+		b.transport = nil
+		b.setTransport(p.transport, p.uploadTransport)
+		return
+	}
+	t := p.transport
+	if b.viaProxy != nil {
+		t = withProxy(t, b.viaProxy)
+	}
+	if b.sendProxy != "" {
+		t = withSendProxy(t, b.sendProxy)
+	}
+	b.transport = t
+	b.setTransport(t, newUploadTransport(t))
+}
+
+// transportOf returns the transport b is proxied to and probed through.
+func (p *Pool) transportOf(b *Backend) *http.Transport {
+	if b.transport != nil {
+		return b.transport
+	}
+	return p.transport
+}
+
+// withDeadline runs a handshake on conn bounded by ctx.
+func withDeadline(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	err := handshake()
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// httpConnect opens a CONNECT tunnel to addr on conn, an HTTP proxy
+// connection, and returns the tunnel.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if auth := proxyAuthorization(proxy); auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return conn, fmt.Errorf("CONNECT %s: %w", addr, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return conn, errors.New("credentials rejected (407 Proxy Authentication Required)")
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return conn, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a tunnel whose first bytes were read along with the
+// proxy's answer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// proxyAuthorization is the Basic Proxy-Authorization for proxy's
+// credentials, "" without.
+func proxyAuthorization(proxy *url.URL) string {
+	if proxy.User == nil {
+		return ""
+	}
+	pass, _ := proxy.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+pass))
+}
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929).
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPass     = 2
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+// socks5Replies names the CONNECT reply codes.
+var socks5Replies = []string{
+	"succeeded", "general failure", "connection not allowed by ruleset", "network unreachable",
+	"host unreachable", "connection refused", "TTL expired", "command not supported",
+	"address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect it to addr.
+func socks5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %q", portStr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if proxy.User != nil {
+		methods = []byte{socks5UserPass}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("SOCKS5 greeting: %w", err)
+	}
+	switch {
+	case reply[0] != socks5Version:
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", reply[0])
+	case reply[1] == socks5NoAcceptable && proxy.User == nil:
+		return errors.New("proxy requires credentials")
+	case reply[1] == socks5NoAcceptable:
+		return errors.New("proxy does not accept username/password authentication")
+	case reply[1] == socks5UserPass:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 username and password are limited to 255 bytes")
+		}
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return fmt.Errorf("SOCKS5 authentication: %w", err)
+		}
+		if reply[1] != 0 {
+			return errors.New("credentials rejected")
+		}
+	case reply[1] != socks5NoAuth:
+		return fmt.Errorf("proxy chose unsupported SOCKS5 method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	switch ip := net.ParseIP(host); {
+	case ip.To4() != nil:
+		req = append(append(req, socks5IPv4), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, socks5IPv6), ip.To16()...)
+	case len(host) > 255:
+		return fmt.Errorf("host name %q too long for SOCKS5", host)
+	default:
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return fmt.Errorf("SOCKS5 CONNECT %s: %w", addr, err)
+	}
+	if head[1] != 0 {
+		reason := "reply " + strconv.Itoa(int(head[1]))
+		if int(head[1]) < len(socks5Replies) {
+			reason = socks5Replies[head[1]]
+		}
+		return fmt.Errorf("SOCKS5 CONNECT %s: %s", addr, reason)
+	}
+	// Skip the bound address and port.
+	var skip int
+	switch head[3] {
+	case socks5IPv4:
+		skip = net.IPv4len + 2
+	case socks5IPv6:
+		skip = net.IPv6len + 2
+	case socks5Domain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return fmt.Errorf("SOCKS5 CONNECT %s: bad address type %d", addr, head[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip))
+	return err
+}
@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy is a minimal forward proxy: SOCKS5 with optional
+// username/password, or HTTP with CONNECT tunnels and absolute-form
+// requests and optional Basic credentials. It records the targets it
+// connected to.
+type testProxy struct {
+	ln         net.Listener
+	user, pass string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newTestProxy(t *testing.T, socks bool, user, pass string) *testProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testProxy{ln: ln, user: user, pass: pass}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if socks {
+				go tp.serveSOCKS5(conn)
+			} else {
+				go tp.serveHTTP(conn)
+			}
+		}
+	}()
+	return tp
+}
+
+// url returns the proxy's URL with the given credentials.
+func (tp *testProxy) url(scheme, user, pass string) string {
+	auth := ""
+	if user != "" {
+		auth = user + ":" + pass + "@"
+	}
+	return scheme + "://" + auth + tp.ln.Addr().String()
+}
+
+func (tp *testProxy) traversed() []string {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]string(nil), tp.targets...)
+}
+
+// connect dials target for conn's client and pipes the two together.
+func (tp *testProxy) connect(client net.Conn, target string, ok []byte) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	tp.mu.Lock()
+	tp.targets = append(tp.targets, target)
+	tp.mu.Unlock()
+	if _, err := client.Write(ok); err != nil {
+		return
+	}
+	go func() { _, _ = io.Copy(upstream, client) }()
+	_, _ = io.Copy(client, upstream)
+}
+
+func (tp *testProxy) serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	want := byte(socks5NoAuth)
+	if tp.user != "" {
+		want = socks5UserPass
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return
+	}
+	_, _ = conn.Write([]byte{socks5Version, want})
+	if tp.user != "" {
+		br := bufio.NewReader(conn)
+		readField := func() string {
+			n, _ := br.ReadByte()
+			b := make([]byte, n)
+			_, _ = io.ReadFull(br, b)
+			return string(b)
+		}
+		_, _ = br.ReadByte()
+		user, pass := readField(), readField()
+		if user != tp.user || pass != tp.pass {
+			_, _ = conn.Write([]byte{1, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case socks5IPv4:
+		ip := make([]byte, 4)
+		_, _ = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5Domain:
+		var n [1]byte
+		_, _ = io.ReadFull(conn, n[:])
+		name := make([]byte, n[0])
+		_, _ = io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	_, _ = io.ReadFull(conn, port[:])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	tp.connect(conn, target, []byte{socks5Version, 0, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+}
+
+func (tp *testProxy) serveHTTP(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if tp.user != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(tp.user+":"+tp.pass)) {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			continue
+		}
+		if req.Method == http.MethodConnect {
+			tp.connect(conn, req.Host, []byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return
+		}
+		tp.mu.Lock()
+		tp.targets = append(tp.targets, req.URL.Host)
+		tp.mu.Unlock()
+		req.RequestURI = ""
+		req.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			continue
+		}
+		_ = resp.Write(conn)
+		resp.Body.Close()
+	}
+}
+
+func okBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// failUntilUnhealthy probes b until it is marked unhealthy and returns the
+// reason.
+func failUntilUnhealthy(t *testing.T, hc *HealthChecker, b *Backend) string {
+	t.Helper()
+	for range 5 {
+		hc.checkBackend(context.Background(), b)
+		if healthy, _, reason := b.HealthTransition(); !healthy {
+			return reason
+		}
+	}
+	t.Fatalf("%s still healthy", b.ID())
+	return ""
+}
+
+func TestForwardProxyGlobal(t *testing.T) {
+	for _, socks := range []bool{true, false} {
+		scheme := map[bool]string{true: "socks5", false: "http"}[socks]
+		t.Run(scheme, func(t *testing.T) {
+			backend := okBackend(t)
+			tp := newTestProxy(t, socks, "alice", "s3cret")
+			proxy, err := ParseProxyURL(tp.url(scheme, "alice", "s3cret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := DefaultTransportConfig()
+			cfg.Proxy = proxy
+			pool, err := NewPool([]string{backend.URL}, WithTransport(NewTransport(cfg)), WithLogger(&lineLogger{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb := httptest.NewServer(pool)
+			defer lb.Close()
+
+			resp, err := http.Get(lb.URL + "/v1/models")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "ok" {
+				t.Fatalf("response %d %q", resp.StatusCode, body)
+			}
+			hc := NewHealthChecker(pool, WithInterval(time.Minute))
+			hc.checkAll(context.Background())
+			if b := pool.GetBackends()[0]; !b.IsHealthy() {
+				t.Errorf("unhealthy through the proxy")
+			}
+			// A tcp probe opens a tunnel too.
+			if err := pool.SetHealthCheck(HealthCheckTCP, ""); err != nil {
+				t.Fatal(err)
+			}
+			before := len(tp.traversed())
+			if err := probe(hc); err != nil {
+				t.Errorf("tcp probe: %v", err)
+			}
+			addr := backend.Listener.Addr().String()
+			got := tp.traversed()
+			if before == 0 || len(got) != before+1 {
+				t.Errorf("proxy connected %d times, then %d after a tcp probe", before, len(got))
+			}
+			for _, target := range got {
+				if target != addr {
+					t.Errorf("proxy connected to %s, want %s", target, addr)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardProxyPerBackend(t *testing.T) {
+	direct, proxied := okBackend(t), okBackend(t)
+	tp := newTestProxy(t, false, "", "")
+	pool, err := NewPool([]string{direct.URL, proxied.URL + ",proxy=" + tp.url("http", "", "")}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The override survives the pool's transport being replaced.
+	pool.SetTransport(NewTransport(DefaultTransportConfig()))
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	for range 4 {
+		resp, err := http.Get(lb.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	hc.checkAll(context.Background())
+
+	want := proxied.Listener.Addr().String()
+	got := tp.traversed()
+	if len(got) == 0 {
+		t.Fatal("nothing went through the proxy")
+	}
+	for _, target := range got {
+		if target != want {
+			t.Errorf("proxy reached %s, want only %s", target, want)
+		}
+	}
+	for _, b := range pool.GetBackends() {
+		if !b.IsHealthy() {
+			t.Errorf("%s unhealthy", b.ID())
+		}
+	}
+}
+
+func TestForwardProxyFailureReasons(t *testing.T) {
+	backend := okBackend(t)
+	socks := newTestProxy(t, true, "alice", "s3cret")
+	httpProxy := newTestProxy(t, false, "alice", "s3cret")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	for _, tc := range []struct {
+		name, proxy string
+		want        []string
+	}{
+		{"socks wrong password", socks.url("socks5", "alice", "wrong"),
+			[]string{"proxy socks5://alice:xxxxx@", "credentials rejected"}},
+		{"socks without credentials", socks.url("socks5", "", ""),
+			[]string{"proxy socks5://127.0.0.1", "requires credentials"}},
+		{"http wrong password", httpProxy.url("http", "alice", "wrong"),
+			[]string{"proxy http://alice:xxxxx@", "credentials rejected (407"}},
+		{"unreachable", "socks5://" + closed.Addr().String(),
+			[]string{"proxy socks5://" + closed.Addr().String(), "connection refused"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, err := NewPool([]string{backend.URL + ",proxy=" + tc.proxy}, WithLogger(&lineLogger{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hc := NewHealthChecker(pool, WithInterval(time.Minute))
+			reason := failUntilUnhealthy(t, hc, pool.GetBackends()[0])
+			for _, w := range tc.want {
+				if !strings.Contains(reason, w) {
+					t.Errorf("reason %q lacks %q", reason, w)
+				}
+			}
+			if strings.Contains(reason, "wrong") {
+				t.Errorf("reason %q shows the password", reason)
+			}
+		})
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"socks5://u:p@proxy:1080": "",
+		"http://proxy:3128/":      "",
+		"https://proxy":           "",
+		"ftp://proxy":             "scheme must be",
+		"socks5://":               "needs a host",
+		"http://proxy/path":       "path",
+	} {
+		_, err := ParseProxyURL(raw)
+		if (err == nil) != (want == "") || (err != nil && !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: error %v, want %q", raw, err, want)
+		}
+	}
+	if _, err := ParseBackendSpec("http://b:8000,family=ipv4,proxy=socks5://p:1080"); err == nil {
+		t.Error("family= with proxy= accepted")
+	}
+	if got := RedactBackendSpec("http://b:8000,proxy=http://u:pw@p:3128"); got != "http://b:8000,proxy=http://u:xxxxx@p:3128" {
+		t.Errorf("redacted %q", got)
+	}
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// gRPC backends (grpc://host:port, grpcs://host:port): model servers that
+// only speak gRPC are proxied over HTTP/2 by the same ReverseProxy, with a
+// transport that speaks only HTTP/2 (cleartext h2c for grpc://, TLS for
+// grpcs://) and carries trailers through: lb's listeners accept h2c when a
+// pool has one, and the client gets the backend's trailers, declared or
+// not. Selection, connection counts (one per RPC, for as long as it
+// streams) and the other per-request features apply unchanged. Such a
+// backend is probed with the gRPC health protocol unless its check= says
+// otherwise. Its outcome is the RPC's grpc-status, read from the trailers
+// when the stream ends (or the headers of a trailers-only response) instead
+// of the HTTP status, which is 200 either way: UNKNOWN, INTERNAL,
+// UNAVAILABLE and DATA_LOSS count as failures and mark the backend
+// unhealthy (or add to its failure score, see failmemory.go), like a 5xx;
+// the other codes are the caller's business, like a 4xx. A stream the
+// client abandons gets no verdict.
+
+// grpcFailures are the grpc-status codes that count against the backend.
+var grpcFailures = map[string]string{"2": "UNKNOWN", "13": "INTERNAL", "14": "UNAVAILABLE", "15": "DATA_LOSS"}
+
+// grpcTransports caches the HTTP/2-only clone of each base transport, so
+// a pool's gRPC backends share one.
+var grpcTransports sync.Map // *http.Transport -> *http.Transport
+
+// grpcTransport returns base's HTTP/2-only clone: h2c for http:// targets,
+// h2 over TLS for https:// ones. Other round trippers are returned as is.
+func grpcTransport(base http.RoundTripper) http.RoundTripper {
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return base
+	}
+	if h2, ok := grpcTransports.Load(t); ok {
+		return h2.(*http.Transport)
+	}
+	h2 := t.Clone()
+	h2.Protocols = new(http.Protocols)
+	h2.Protocols.SetHTTP2(true)
+	h2.Protocols.SetUnencryptedHTTP2(true)
+	actual, _ := grpcTransports.LoadOrStore(t, h2)
+	return actual.(*http.Transport)
+}
+
+// HasGRPC reports whether any of the pool's backends is a gRPC backend, so
+// its listeners must accept h2c.
+func (p *Pool) HasGRPC() bool {
+	for _, b := range p.GetBackends() {
+		if b.grpc {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcOutcome records the outcome of an RPC from its grpc-status; a stream
+// that ended without one failed, as gRPC clients see it.
+func (b *Backend) grpcOutcome(status string, latency time.Duration) {
+	name, failed := grpcFailures[status]
+	b.recordOutcome(!failed && status != "", latency)
+	switch {
+	case status == "":
+		b.failedResponse("grpc-status missing")
+	case failed:
+		b.failedResponse(fmt.Sprintf("grpc-status: %s (%s)", status, name))
+	}
+}
+
+// watchGRPCStatus arranges for resp's RPC outcome to be recorded, now for a
+// trailers-only response and when its body ends otherwise. It reports
+// whether resp is an RPC the caller must not record itself.
+func (b *Backend) watchGRPCStatus(resp *http.Response, latency time.Duration) bool {
+	if !b.grpc || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if status := resp.Header.Get("Grpc-Status"); status != "" {
+		b.grpcOutcome(status, latency)
+		return true
+	}
+	resp.Body = &grpcStatusReader{ReadCloser: resp.Body, resp: resp, b: b, latency: latency}
+	return true
+}
+
+// grpcStatusReader records an RPC's outcome from its trailers at the end
+// of its response body.
+type grpcStatusReader struct {
+	io.ReadCloser
+	resp    *http.Response
+	b       *Backend
+	latency time.Duration
+	done    bool
+}
+
+func (r *grpcStatusReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.b.grpcOutcome(r.resp.Trailer.Get("Grpc-Status"), r.latency)
+	}
+	return n, err
+}
@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// grpcFrame length-prefixes a gRPC message.
+func grpcFrame(msg string) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...)
+}
+
+// h2cServer starts an httptest server accepting HTTP/1 and h2c.
+func h2cServer(t *testing.T, h http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// grpcEcho is an echo service answering /echo.Echo/Say with the request
+// message and undeclared trailers, grpc-status status and its name, and
+// the gRPC health check with SERVING.
+func grpcEcho(t *testing.T, name string, status *atomic.Value) *httptest.Server {
+	return h2cServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("%s: %s request with Content-Type %q", name, r.Proto, r.Header.Get("Content-Type"))
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		switch r.URL.Path {
+		case grpcHealthPath:
+			_, _ = w.Write(grpcFrame("\x08\x01"))
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		case "/echo.Echo/Say":
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write(body)
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", status.Load().(string))
+			w.Header().Set(http.TrailerPrefix+"X-Echo-Backend", name)
+		default:
+			w.Header().Set("Grpc-Status", "12") // UNIMPLEMENTED, trailers-only
+		}
+	}))
+}
+
+func TestGRPCBackends(t *testing.T) {
+	var okStatus, failingStatus atomic.Value
+	okStatus.Store("0")
+	failingStatus.Store("0")
+	a := grpcEcho(t, "a", &okStatus)
+	b := grpcEcho(t, "b", &failingStatus)
+	pool, err := NewPool([]string{strings.Replace(a.URL, "http", "grpc", 1), strings.Replace(b.URL, "http", "grpc", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool)
+	hc.checkAll(t.Context())
+	for _, bs := range pool.Stats().Backends {
+		if bs.State != "healthy" || !strings.HasPrefix(bs.HealthURL, "grpc://") {
+			t.Errorf("%s: %s, probed at %s; want healthy by the gRPC health protocol", bs.URL, bs.State, bs.HealthURL)
+		}
+	}
+	lb := h2cServer(t, pool)
+	h2c := &http.Transport{Protocols: new(http.Protocols)}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: h2c}
+	call := func(msg string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, lb.URL+"/echo.Echo/Say", bytes.NewReader(grpcFrame(msg)))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	// Calls are balanced, and the trailers reach the client.
+	served := map[string]int{}
+	for i := range 20 {
+		resp, body := call("hello")
+		if resp.ProtoMajor != 2 || !bytes.Equal(body, grpcFrame("hello")) {
+			t.Fatalf("call %d: %s, body %q", i, resp.Proto, body)
+		}
+		if resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Fatalf("call %d: trailers %v", i, resp.Trailer)
+		}
+		served[resp.Trailer.Get("X-Echo-Backend")]++
+	}
+	if served["a"] == 0 || served["b"] == 0 {
+		t.Errorf("calls served %v, want both backends", served)
+	}
+	for _, bs := range pool.Stats().Backends {
+		if bs.State != "healthy" {
+			t.Errorf("%s %s after successful calls", bs.URL, bs.State)
+		}
+	}
+
+	// UNAVAILABLE in the trailers, behind HTTP 200, marks the backend
+	// unhealthy; the client still gets the status.
+	failingStatus.Store("14")
+	for range 50 {
+		if resp, _ := call("hello"); resp.Trailer.Get("X-Echo-Backend") == "b" {
+			if got := resp.Trailer.Get("Grpc-Status"); got != "14" {
+				t.Errorf("client got grpc-status %q, want 14", got)
+			}
+			break
+		}
+	}
+	bs := pool.Stats().Backends[1]
+	if bs.Healthy || bs.Reason != "grpc-status: 14 (UNAVAILABLE)" {
+		t.Errorf("after UNAVAILABLE: healthy %v, reason %q", bs.Healthy, bs.Reason)
+	}
+
+	// Other codes are the caller's business: a trailers-only UNIMPLEMENTED
+	// leaves the backend healthy.
+	req, _ := http.NewRequest(http.MethodPost, lb.URL+"/echo.Echo/Missing", bytes.NewReader(grpcFrame("")))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Grpc-Status") != "12" || !pool.GetBackends()[0].IsHealthy() {
+		t.Errorf("UNIMPLEMENTED: grpc-status %q, backend a healthy %v", resp.Header.Get("Grpc-Status"), pool.GetBackends()[0].IsHealthy())
+	}
+}
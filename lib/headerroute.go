@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Header routing (config "header_routes" of a pool): a request whose header
+// matches a rule ("X-Model-Version: v2") is served only by the backends
+// carrying all of the rule's labels ("version": "v2"), the pool's routing
+// strategy picking among them as usual. Rules are tried in order and the
+// first match wins; a rule without a header matches every request, so a last
+// one catches the rest. When none of a rule's backends is healthy the
+// request gets 503 naming the labels, unless the rule sets fallback: then
+// the whole pool serves it. A hedge stays within the rule's backends.
+// Requests matching no rule are served by the whole pool. Counts per rule
+// are in /stats.
+
+// HeaderRouteConfig is one header routing rule.
+type HeaderRouteConfig struct {
+	ID string `json:"id"`
+	// Header and Value select the requests the rule applies to; without a
+	// header it applies to every request.
+	Header string `json:"header"`
+	Value  string `json:"value"`
+	// Labels are the key=value backend labels the requests are served by.
+	Labels map[string]string `json:"labels"`
+	// Fallback serves requests from the whole pool when no backend with
+	// the labels is healthy, instead of answering 503.
+	Fallback bool `json:"fallback"`
+}
+
+func (hc HeaderRouteConfig) validate() error {
+	if hc.ID == "" {
+		return errors.New("every header route needs an id")
+	}
+	if hc.Header == "" && hc.Value != "" {
+		return fmt.Errorf("header route %q: value needs a header", hc.ID)
+	}
+	if len(hc.Labels) == 0 {
+		return fmt.Errorf("header route %q: at least one label is required", hc.ID)
+	}
+	for name := range hc.Labels {
+		if err := validLabel(name); err != nil {
+			return fmt.Errorf("header route %q: %w", hc.ID, err)
+		}
+	}
+	return nil
+}
+
+// validateHeaderRoutes checks each rule and that their ids are unique.
+func validateHeaderRoutes(routes []HeaderRouteConfig) error {
+	ids := make(map[string]bool, len(routes))
+	for _, hc := range routes {
+		if err := hc.validate(); err != nil {
+			return err
+		}
+		if ids[hc.ID] {
+			return fmt.Errorf("duplicate header route id %q", hc.ID)
+		}
+		ids[hc.ID] = true
+	}
+	return nil
+}
+
+type headerRoute struct {
+	HeaderRouteConfig
+	// selector is Labels as "k=v,k2=v2", for the 503 message
+	selector                  string
+	matched, fellBack, failed atomic.Uint64
+}
+
+// headerRouting is a pool's header routing rules.
+type headerRouting struct {
+	routes    []*headerRoute
+	unmatched atomic.Uint64
+}
+
+// SetHeaderRoutes routes requests by header to labeled backends (see
+// above). Not supported with cache-aware routing. Call before serving
+// traffic.
+func (p *Pool) SetHeaderRoutes(routes []HeaderRouteConfig) error {
+	if err := validateHeaderRoutes(routes); err != nil {
+		return err
+	}
+	if len(routes) > 0 && p.affinity != nil {
+		return errors.New("header routes are not supported with cache-aware routing")
+	}
+	if len(routes) == 0 {
+		p.headerRoutes = nil
+		return nil
+	}
+	hr := &headerRouting{}
+	for _, hc := range routes {
+		pairs := make([]string, 0, len(hc.Labels))
+		for _, k := range slices.Sorted(maps.Keys(hc.Labels)) {
+			pairs = append(pairs, k+"="+hc.Labels[k])
+		}
+		hr.routes = append(hr.routes, &headerRoute{HeaderRouteConfig: hc, selector: strings.Join(pairs, ",")})
+	}
+	p.headerRoutes = hr
+	return nil
+}
+
+// match returns the first rule matching r, counting it, or nil.
+func (hr *headerRouting) match(r *http.Request) *headerRoute {
+	if hr == nil {
+		return nil
+	}
+	for _, rt := range hr.routes {
+		if rt.Header == "" || r.Header.Get(rt.Header) == rt.Value {
+			rt.matched.Add(1)
+			return rt
+		}
+	}
+	hr.unmatched.Add(1)
+	return nil
+}
+
+// labels returns the labels a rule's requests are served by, nil for the
+// whole pool.
+func (rt *headerRoute) labels() map[string]string {
+	if rt == nil {
+		return nil
+	}
+	return rt.Labels
+}
+
+// selectFor returns the selection of requests matching rt (nil: no rule).
+func (p *Pool) selectFor(rt *headerRoute) func() (*Backend, error) {
+	if rt == nil {
+		return p.SelectBackend
+	}
+	return func() (*Backend, error) {
+		b, err := p.selectBackendExcept(nil, rt.Labels)
+		if !errors.Is(err, errNoHealthyBackends) {
+			return b, err
+		}
+		if !rt.Fallback {
+			rt.failed.Add(1)
+			return nil, fmt.Errorf("%w with label %s", errNoHealthyBackends, rt.selector)
+		}
+		if b, err = p.SelectBackend(); err == nil {
+			rt.fellBack.Add(1)
+		}
+		return b, err
+	}
+}
+
+// HeaderRoutingStats is the pool's header routing in /stats.
+type HeaderRoutingStats struct {
+	Routes []HeaderRouteStats `json:"routes"`
+	// Unmatched counts requests matching no rule.
+	Unmatched uint64 `json:"unmatched"`
+}
+
+// HeaderRouteStats counts one rule's requests: Matched, all of them;
+// Fallback, those the whole pool served; Unavailable, those answered 503.
+type HeaderRouteStats struct {
+	ID          string `json:"id"`
+	Matched     uint64 `json:"matched"`
+	Fallback    uint64 `json:"fallback,omitempty"`
+	Unavailable uint64 `json:"unavailable,omitempty"`
+}
+
+func (hr *headerRouting) stats() *HeaderRoutingStats {
+	s := &HeaderRoutingStats{Routes: make([]HeaderRouteStats, len(hr.routes)), Unmatched: hr.unmatched.Load()}
+	for i, rt := range hr.routes {
+		s.Routes[i] = HeaderRouteStats{
+			ID:          rt.ID,
+			Matched:     rt.matched.Load(),
+			Fallback:    rt.fellBack.Load(),
+			Unavailable: rt.failed.Load(),
+		}
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// versionedPool has backends v1a and v1b labeled version=v1 and v2 labeled
+// version=v2, each answering with its name.
+func versionedPool(t *testing.T, routes ...HeaderRouteConfig) (*Pool, map[string]*Backend) {
+	t.Helper()
+	var specs []string
+	names := make(map[string]string)
+	for _, name := range []string{"v1a", "v1b", "v2"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		specs = append(specs, srv.URL+",version="+name[:2])
+		names[srv.URL] = name
+	}
+	pool, err := NewPool(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHeaderRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*Backend)
+	for _, b := range pool.GetBackends() {
+		byName[names[b.ID()]] = b
+	}
+	return pool, byName
+}
+
+// serveVersion sends a request with X-Model-Version: version ("" for none).
+func serveVersion(pool *Pool, version string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	if version != "" {
+		req.Header.Set("X-Model-Version", version)
+	}
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, req)
+	return w
+}
+
+var abRoutes = []HeaderRouteConfig{
+	{ID: "v2", Header: "X-Model-Version", Value: "v2", Labels: map[string]string{"version": "v2"}},
+	{ID: "default", Labels: map[string]string{"version": "v1"}},
+}
+
+func TestHeaderRouteMatched(t *testing.T) {
+	pool, _ := versionedPool(t, abRoutes...)
+	for range 10 {
+		if w := serveVersion(pool, "v2"); w.Code != http.StatusOK || w.Body.String() != "v2" {
+			t.Fatalf("v2 request: %d %q", w.Code, w.Body)
+		}
+		for _, version := range []string{"", "v1", "v3"} {
+			if w := serveVersion(pool, version); w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "v1") {
+				t.Fatalf("version %q request: %d %q, want a v1 backend", version, w.Code, w.Body)
+			}
+		}
+	}
+	got := pool.Stats().HeaderRouting
+	if got == nil || len(got.Routes) != 2 || got.Routes[0].Matched != 10 || got.Routes[1].Matched != 30 || got.Unmatched != 0 {
+		t.Errorf("stats %+v", got)
+	}
+}
+
+func TestHeaderRouteUnmatched(t *testing.T) {
+	pool, _ := versionedPool(t, abRoutes[0])
+	served := make(map[string]int)
+	for range 30 {
+		w := serveVersion(pool, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		served[w.Body.String()]++
+	}
+	if len(served) != 3 {
+		t.Errorf("requests matching no rule served by %v, want the whole pool", served)
+	}
+	if got := pool.Stats().HeaderRouting; got.Routes[0].Matched != 0 || got.Unmatched != 30 {
+		t.Errorf("stats %+v", got)
+	}
+}
+
+func TestHeaderRouteNoHealthyMatch(t *testing.T) {
+	pool, backends := versionedPool(t, abRoutes...)
+	backends["v2"].MarkUnhealthy()
+
+	w := serveVersion(pool, "v2")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "version=v2") {
+		t.Errorf("v2 request with v2 down: %d %q, want 503 naming the label", w.Code, w.Body)
+	}
+	if w := serveVersion(pool, ""); w.Code != http.StatusOK {
+		t.Errorf("v1 request with v2 down: %d", w.Code)
+	}
+	if got := pool.Stats().HeaderRouting.Routes[0]; got.Matched != 1 || got.Unavailable != 1 || got.Fallback != 0 {
+		t.Errorf("stats %+v", got)
+	}
+}
+
+func TestHeaderRouteFallback(t *testing.T) {
+	v2 := abRoutes[0]
+	v2.Fallback = true
+	pool, backends := versionedPool(t, v2)
+	backends["v2"].MarkUnhealthy()
+
+	w := serveVersion(pool, "v2")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "v1") {
+		t.Errorf("v2 request with v2 down: %d %q, want a v1 backend", w.Code, w.Body)
+	}
+	for !backends["v2"].RecordCheckSuccess() {
+	}
+	if w := serveVersion(pool, "v2"); w.Body.String() != "v2" {
+		t.Errorf("v2 request with v2 back: %q", w.Body)
+	}
+	if got := pool.Stats().HeaderRouting.Routes[0]; got.Matched != 2 || got.Fallback != 1 || got.Unavailable != 0 {
+		t.Errorf("stats %+v", got)
+	}
+}
+
+func TestSetHeaderRoutesRejects(t *testing.T) {
+	pool, _ := versionedPool(t)
+	for name, routes := range map[string][]HeaderRouteConfig{
+		"no id":        {{Header: "X-Model-Version", Value: "v2", Labels: map[string]string{"version": "v2"}}},
+		"no labels":    {{ID: "v2", Header: "X-Model-Version", Value: "v2"}},
+		"bad label":    {{ID: "v2", Labels: map[string]string{"model-version": "v2"}}},
+		"value only":   {{ID: "v2", Value: "v2", Labels: map[string]string{"version": "v2"}}},
+		"duplicate id": {abRoutes[0], abRoutes[0]},
+	} {
+		if err := pool.SetHeaderRoutes(routes); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -1,91 +1,401 @@
 package lib
 
 import (
+	"cmp"
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Health URLs: a backend is probed at the pool's health path (--health-path,
+// default /v1/models) under its own URL, or at the URL its spec gives with
+// ",health=http://b1:9000/healthz" when it serves health on another port.
+
+// defaultCheckConcurrency bounds how many probes a sweep runs at once.
+const defaultCheckConcurrency = 10
+
+// DefaultHealthPath is the path probed under each backend's URL unless the
+// pool or the backend sets another.
+const DefaultHealthPath = "/v1/models"
+
+// validHealthURL checks a backend's health= URL: absolute http(s) with a
+// host, and no fragment.
+func validHealthURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme != "http" && u.Scheme != "https":
+		return errors.New("scheme must be http or https")
+	case u.Hostname() == "":
+		return errors.New("missing host")
+	case u.Fragment != "":
+		return errors.New("fragments are not allowed")
+	}
+	return nil
+}
+
+// SetHealthPath sets the path probed under each backend's URL (default
+// /v1/models); a backend's health= URL overrides it. Call before serving
+// traffic.
+func (p *Pool) SetHealthPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("health path %q must start with /", path)
+	}
+	p.healthPath = path
+	return nil
+}
+
+// HealthURL returns the URL the backend is probed at in pool p.
+func (p *Pool) HealthURL(b *Backend) string {
+	if b.healthURL != "" {
+		return b.healthURL
+	}
+	path := p.healthPath
+	if path == "" {
+		path = DefaultHealthPath
+	}
+	return b.URL.String() + path
+}
+
+// Probe scheduling: each backend is probed on its own schedule rather than
+// in sweeps of the whole pool, every interval while healthy (or not yet
+// checked) and every unhealthy interval while down, so recovery is noticed
+// within seconds without probing dozens of healthy backends as often. A
+// probe schedules the next from its own start, by the state it left the
+// backend in; a transition from elsewhere (a failed request) brings the
+// next probe forward at once. Probes run concurrently, at most concurrency
+// at a time, and a slow one delays no other backend's.
+//
+// Jitter (--health-check-jitter): with a jitter fraction j, each backend's
+// first probe is at a random offset within its interval instead of all at
+// Start, and every later one an interval times a random factor in
+// [1-j, 1+j] after the last, so neither the backends of one lb nor the lbs
+// sharing a backend stay in step. The factor averages 1, keeping the probe
+// rate; j is at most 0.5, so a backend is probed at least every 1.5
+// intervals. Backends added later are still probed at once.
+
 // HealthChecker performs periodic health checks on backends
 type HealthChecker struct {
 	pool     *Pool
 	interval time.Duration
-	client   *http.Client
+	// unhealthyInterval is the interval for unhealthy backends, at most
+	// interval
+	unhealthyInterval time.Duration
+	// wake interrupts Start's wait to reschedule: a probe finished or a
+	// backend changed state
+	wake        chan struct{}
+	client      *http.Client
+	timeout     time.Duration
+	probers     map[string]Prober
+	concurrency int
+	// jitter is the fraction intervals vary by, 0 for none
+	jitter float64
+	// latencyWarn and latencyUnhealthy are the slow probe thresholds, 0
+	// for off (see probelatency.go)
+	latencyWarn, latencyUnhealthy time.Duration
+	// share is the probes shared with other pools' checkers, nil for none
+	// (see probeshare.go)
+	share  *ProbeShare
+	clock  Clock
+	logger Logger
 }
 
-// NewHealthChecker creates a new health checker
-func NewHealthChecker(pool *Pool, interval time.Duration) *HealthChecker {
+// NewHealthChecker creates a new health checker, on the pool's clock and
+// logger unless opts give others. opts may also set its interval (default
+// 30s), probe timeout and health path (see options.go); an invalid path
+// panics.
+func NewHealthChecker(pool *Pool, opts ...Option) *HealthChecker {
+	o := applyOptions(opts)
+	if o.path != "" {
+		if err := pool.SetHealthPath(o.path); err != nil {
+			panic("lib: WithPath: " + err.Error())
+		}
+	}
+	interval := cmp.Or(o.interval, DefaultHealthCheckInterval)
 	// Probe timeout: generous enough that a busy backend's slow /v1/models
 	// response is not mistaken for an outage, but always finishing before the
 	// next sweep is due, so short check intervals keep their cadence.
 	// cmd/lb enforces interval >= 5s; the 4.5s floor covers direct lib users.
 	timeout := min(10*time.Second, max(4500*time.Millisecond, interval-500*time.Millisecond))
-	return &HealthChecker{
-		pool:     pool,
-		interval: interval,
+	if o.probeTimeout > 0 {
+		timeout = o.probeTimeout
+	}
+	hc := &HealthChecker{
+		pool:              pool,
+		interval:          interval,
+		unhealthyInterval: min(interval, cmp.Or(o.unhealthyInterval, DefaultUnhealthyCheckInterval)),
+		wake:              make(chan struct{}, 1),
 		client: &http.Client{
 			Timeout:   timeout,
-			Transport: backendTransport,
+			Transport: pool.transport,
 		},
+		timeout:     timeout,
+		concurrency: defaultCheckConcurrency,
+		clock:       clockFrom(pool.clock, opts),
+		logger:      loggerFrom(pool.logger, opts),
 	}
+	pool.reported.setInterval(interval)
+	pool.OnStateChange(func(*Backend, bool, string) { hc.poke() })
+	pool.rescheduleChecks = append(pool.rescheduleChecks, hc.poke)
+	hc.probers = map[string]Prober{
+		HealthCheckHTTP: httpProber{hc},
+		HealthCheckTCP:  tcpProber{hc},
+		HealthCheckGRPC: newGRPCProber(hc),
+		HealthCheckExec: execProber{hc},
+	}
+	return hc
 }
 
-// Start begins periodic health checking in a background goroutine
-func (hc *HealthChecker) Start(ctx context.Context) {
-	ticker := time.NewTicker(hc.interval)
-	defer ticker.Stop()
+// clientFor returns the client b's HTTP probes use: the shared one, or one
+// on b's own transport (see fwdproxy.go).
+func (hc *HealthChecker) clientFor(b *Backend) *http.Client {
+	if b.transport == nil {
+		return hc.client
+	}
+	return &http.Client{Timeout: hc.client.Timeout, Transport: b.transport}
+}
 
-	// Run initial health check immediately
-	hc.checkAll()
+// SetTimeout overrides the probe timeout, as WithProbeTimeout. Call before
+// Start.
+func (hc *HealthChecker) SetTimeout(d time.Duration) {
+	hc.client.Timeout, hc.timeout = d, d
+}
+
+// SetConcurrency bounds how many backends are probed at once (default 10).
+// Call before Start.
+func (hc *HealthChecker) SetConcurrency(n int) {
+	hc.concurrency = n
+}
+
+// SetJitter varies probe intervals by the fraction j (at most 0.5) and
+// spreads the first probes over an interval (see above). Call before
+// Start.
+func (hc *HealthChecker) SetJitter(j float64) {
+	hc.jitter = min(max(j, 0), 0.5)
+}
+
+// Start probes every backend at once (spread over an interval with jitter),
+// then each on its schedule (see above), until ctx is done or the pool is
+// closed. Run it in a goroutine of its own.
+func (hc *HealthChecker) Start(ctx context.Context) {
+	ctx, cancel := hc.pool.bind(ctx)
+	defer cancel()
+	sem := make(chan struct{}, max(1, hc.concurrency))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	hc.spreadFirstProbes(hc.clock.Now())
 
 	for {
+		now := hc.clock.Now()
+		wait := hc.interval
+		for _, b := range hc.pool.GetBackends() {
+			b.mu.Lock()
+			if !b.probing {
+				// Bring the next probe forward if the state changed since
+				// it was scheduled: the state's longest interval has
+				// passed.
+				if limit := now.Add(hc.maxIntervalLocked(b)); limit.Before(b.nextProbe) {
+					b.nextProbe = now.Add(hc.jitteredLocked(b))
+				}
+				// A manual override ends with a probe (see override.go).
+				if b.overriddenLocked(now) && b.manualUntil.Before(b.nextProbe) {
+					b.nextProbe = b.manualUntil
+				}
+			}
+			due := !b.probing && !b.nextProbe.After(now)
+			if due {
+				b.probing = true
+			} else if !b.probing {
+				wait = min(wait, b.nextProbe.Sub(now))
+			}
+			b.mu.Unlock()
+			if !due {
+				continue
+			}
+			wg.Go(func() {
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					hc.scheduleNext(b, now)
+					return
+				}
+				defer func() { <-sem }()
+				hc.probe(ctx, b)
+				hc.pool.mu.Lock()
+				hc.pool.notePanicLocked(hc.pool.snapshot(), hc.clock.Now())
+				hc.pool.mu.Unlock()
+				hc.poke()
+			})
+		}
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			hc.checkAll()
+		case <-hc.clock.After(wait):
+		case <-hc.wake:
 		}
 	}
 }
 
-// checkAll checks health of all backends concurrently, so a handful of
-// timing-out backends cannot make the sweep overrun the check interval.
-func (hc *HealthChecker) checkAll() {
-	backends := hc.pool.GetBackends()
+// poke wakes Start to reschedule, without blocking.
+func (hc *HealthChecker) poke() {
+	select {
+	case hc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// intervalLocked is the probe interval for b's current state. Caller must
+// hold b.mu.
+func (hc *HealthChecker) intervalLocked(b *Backend) time.Duration {
+	if b.healthy && b.strikes == 0 {
+		return hc.interval
+	}
+	return hc.unhealthyInterval
+}
+
+// maxIntervalLocked is the longest jittered interval for b's current state.
+// Caller must hold b.mu.
+func (hc *HealthChecker) maxIntervalLocked(b *Backend) time.Duration {
+	return time.Duration(float64(hc.intervalLocked(b)) * (1 + hc.jitter))
+}
+
+// jitteredLocked is the interval for b's current state times a random
+// factor in [1-jitter, 1+jitter]. Caller must hold b.mu.
+func (hc *HealthChecker) jitteredLocked(b *Backend) time.Duration {
+	interval := hc.intervalLocked(b)
+	if hc.jitter == 0 {
+		return interval
+	}
+	factor := 1 + hc.jitter*(2*rand.Float64()-1) // #nosec G404 -- probe spreading, not security-sensitive
+	return time.Duration(float64(interval) * factor)
+}
+
+// spreadFirstProbes schedules the first probe of each backend not yet
+// scheduled at a random offset within its interval after now, with jitter.
+func (hc *HealthChecker) spreadFirstProbes(now time.Time) {
+	if hc.jitter == 0 {
+		return
+	}
+	for _, b := range hc.pool.GetBackends() {
+		b.mu.Lock()
+		if b.nextProbe.IsZero() && !b.probing {
+			offset := rand.Float64() * float64(hc.intervalLocked(b)) // #nosec G404 -- probe spreading, not security-sensitive
+			b.nextProbe = now.Add(time.Duration(offset))
+		}
+		b.mu.Unlock()
+	}
+}
+
+// probe checks b and schedules its next probe.
+func (hc *HealthChecker) probe(ctx context.Context, b *Backend) {
+	start := hc.clock.Now()
+	hc.checkBackend(ctx, b)
+	hc.scheduleNext(b, start)
+}
+
+// scheduleNext schedules b's next probe an interval for its state after
+// start, jittered.
+func (hc *HealthChecker) scheduleNext(b *Backend, start time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextProbe = start.Add(hc.jitteredLocked(b))
+	b.probing = false
+}
+
+// checkAll checks health of all backends concurrently, at most concurrency
+// at a time, and waits for every probe. Cancelling ctx aborts in-flight
+// probes.
+func (hc *HealthChecker) checkAll(ctx context.Context) {
+	hc.checkBackends(ctx, hc.pool.GetBackends())
+	// Panic mode follows the sweep's verdicts even without traffic.
+	hc.pool.mu.Lock()
+	hc.pool.notePanicLocked(hc.pool.snapshot(), hc.clock.Now())
+	hc.pool.mu.Unlock()
+}
+
+// checkBackends is checkAll for the given backends.
+func (hc *HealthChecker) checkBackends(ctx context.Context, backends []*Backend) {
+	sem := make(chan struct{}, max(1, hc.concurrency))
 	var wg sync.WaitGroup
 	for _, backend := range backends {
-		wg.Go(func() { hc.checkBackend(backend) })
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			hc.probe(ctx, backend)
+		})
 	}
 	wg.Wait()
 }
 
-// checkBackend checks health of a single backend
-func (hc *HealthChecker) checkBackend(backend *Backend) {
-	// Health check endpoint: /v1/models
-	healthURL := backend.URL.String() + "/v1/models"
+// checkBackend checks health of a single backend and returns the probe's
+// error.
+func (hc *HealthChecker) checkBackend(ctx context.Context, backend *Backend) error {
+	backend.expireRestart(hc.clock.Now())
+	backend.expireOverride(hc.clock.Now())
 
-	resp, err := hc.client.Get(healthURL)
-	if err != nil {
-		// Connection error
-		if backend.MarkUnhealthy() {
-			log.Printf("[HEALTH] %s marked as unhealthy (error: %v)", backend.URL.String(), err)
-		}
-		return
-	}
-	defer resp.Body.Close()
+	span, ctx := hc.pool.tracer.start(ctx, "health check", SpanKindClient,
+		Attribute{"lb.backend", backend.ID()}, Attribute{"url.full", hc.pool.shownHealthURL(backend)})
+	defer span.end()
 
-	// 2xx passes; so does 429 — a saturated backend (e.g. a node-level lb
-	// whose ranks are all at --max-conns) is alive, and ejecting it would
-	// shift load onto the rest and cascade. Anything else is unhealthy.
-	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusTooManyRequests {
-		if backend.RecordCheckSuccess() {
-			log.Printf("[HEALTH] %s marked as healthy", backend.URL.String())
+	kind := hc.pool.healthCheckOf(backend)
+	prober, ok := hc.probers[kind]
+	if !ok {
+		hc.logger.Printf("[BUG] no prober for health check %q", kind)
+		return fmt.Errorf("no prober for health check %q", kind)
+	}
+	signals := backend.drainSignalCount()
+	elapsed, shared, err := hc.runProbe(ctx, backend, kind, prober)
+	if shared {
+		span.SetAttributes(Attribute{"lb.health_check.shared", true})
+	}
+	span.recordError(err)
+	skipped := err != nil && !ClassifyFailure(err, nil, ctx).FlipsHealth()
+	if !skipped {
+		backend.recordProbeLatency(elapsed, err == nil, hc.latencyWarn)
+	}
+	if err == nil && hc.latencyWarn > 0 && elapsed > hc.latencyWarn {
+		hc.logger.Printf("[HEALTH] %s health check passed but took %v (warning over %v)", backend.ID(), roundLatency(elapsed), hc.latencyWarn)
+	}
+	var status *probeStatusError
+	switch {
+	case skipped:
+		// skipped, or shutting down: not the backend's fault
+	case backend.overridden(hc.clock.Now()):
+		// The operator's verdict stands until it expires (see override.go).
+		if err == nil {
+			backend.endDrainSignal(signals)
 		}
-	} else {
-		if backend.MarkUnhealthy() {
-			log.Printf("[HEALTH] %s marked as unhealthy (status: %d)", backend.URL.String(), resp.StatusCode)
+	case errors.As(err, &status):
+		// A failure with the not-ready signature inside the startup grace
+		// leaves the backend starting (see startup.go).
+		backend.probeFailed(status.Error(), status.notReady)
+	case err != nil:
+		backend.probeFailed(probeFailure(err), false)
+	case hc.tooSlow(backend, elapsed):
+		backend.probeFailed(fmt.Sprintf("slow health check: %v over %v", roundLatency(elapsed), hc.latencyUnhealthy), false)
+	default:
+		starting := backend.Starting()
+		switch {
+		case !backend.RecordCheckSuccess():
+		case starting:
+			after := hc.clock.Now().Sub(backend.addedAt).Round(time.Second)
+			hc.logger.Printf("[HEALTH] %s ready after %v; marked as healthy", backend.ID(), after)
+			backend.hooks.fire(backend, true, fmt.Sprintf("ready after %v", after))
+		case backend.passes() > 1:
+			hc.logger.Printf("[HEALTH] %s marked as healthy after %d passing checks", backend.ID(), backend.passes())
+			backend.hooks.fire(backend, true, "health checks passing")
+		default:
+			hc.logger.Printf("[HEALTH] %s marked as healthy", backend.ID())
+			backend.hooks.fire(backend, true, "health checks passing")
 		}
+		backend.endDrainSignal(signals)
 	}
+	return err
 }
@@ -1,8 +1,13 @@
 package lib
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -21,15 +26,15 @@ func probeStatus(t *testing.T, status int, startHealthy bool) bool {
 	if err != nil {
 		t.Fatal(err)
 	}
-	backend := pool.backends[0]
+	backend := pool.GetBackends()[0]
 	if !startHealthy {
 		backend.MarkUnhealthy()
 		// recovery hysteresis: one passing probe is not enough, so run two
 	}
 
-	hc := NewHealthChecker(pool, 5*time.Second)
-	hc.checkBackend(backend)
-	hc.checkBackend(backend)
+	hc := NewHealthChecker(pool, WithInterval(5*time.Second))
+	hc.checkBackend(context.Background(), backend)
+	hc.checkBackend(context.Background(), backend)
 	return backend.IsHealthy()
 }
 
@@ -56,9 +61,9 @@ func TestHealthProbeConnectionError(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	hc := NewHealthChecker(pool, 5*time.Second)
-	hc.checkBackend(pool.backends[0])
-	if pool.backends[0].IsHealthy() {
+	hc := NewHealthChecker(pool, WithInterval(5*time.Second))
+	hc.checkBackend(context.Background(), pool.GetBackends()[0])
+	if pool.GetBackends()[0].IsHealthy() {
 		t.Error("connection-refused probe should mark a backend unhealthy")
 	}
 }
@@ -87,8 +92,370 @@ func TestHealthCheckSweepIsConcurrent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	NewHealthChecker(pool, 5*time.Second).checkAll()
+	NewHealthChecker(pool, WithInterval(5*time.Second)).checkAll(context.Background())
 	if peak.Load() < 2 {
 		t.Errorf("expected concurrent probes, peak in-flight was %d", peak.Load())
 	}
 }
+
+func TestHealthCheckSweepTimeoutAndCancel(t *testing.T) {
+	// Backends that never answer, like the mock backend's timeout mode.
+	var inFlight, peak atomic.Int32
+	hang := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			old := peak.Load()
+			if cur <= old || peak.CompareAndSwap(old, cur) {
+				break
+			}
+		}
+		<-r.Context().Done()
+	})
+	var urls []string
+	for range 6 {
+		srv := httptest.NewServer(hang)
+		defer srv.Close()
+		urls = append(urls, srv.URL)
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A full round takes about one probe timeout, not six.
+	hc := NewHealthChecker(pool, WithInterval(5*time.Second))
+	hc.SetTimeout(200 * time.Millisecond)
+	start := time.Now()
+	hc.checkAll(context.Background())
+	if d := time.Since(start); d > 600*time.Millisecond {
+		t.Errorf("round over 6 hanging backends took %v, want ~one 200ms probe timeout", d)
+	}
+	for i, b := range pool.GetBackends() {
+		if b.IsHealthy() {
+			t.Errorf("backend %d: timed-out probe left it healthy", i)
+		}
+	}
+
+	// The concurrency bound holds.
+	peak.Store(0)
+	hc.SetConcurrency(2)
+	hc.checkAll(context.Background())
+	if p := peak.Load(); p > 2 {
+		t.Errorf("peak in-flight probes %d, want at most 2", p)
+	}
+
+	// Cancelling the context (shutdown) aborts hung probes at once, without
+	// blaming the backends.
+	for _, b := range pool.GetBackends() {
+		b.mu.Lock()
+		b.healthy = true
+		b.mu.Unlock()
+	}
+	hc.SetTimeout(time.Minute)
+	hc.SetConcurrency(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	hc.checkAll(ctx)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled round took %v", d)
+	}
+	for i, b := range pool.GetBackends() {
+		if !b.IsHealthy() {
+			t.Errorf("backend %d marked unhealthy by a probe cancelled on shutdown", i)
+		}
+	}
+}
+
+func TestHealthCheckCadenceFollowsState(t *testing.T) {
+	var goodProbes, badProbes atomic.Int32
+	var badUp atomic.Bool
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { goodProbes.Add(1) }))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badProbes.Add(1)
+		if !badUp.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer bad.Close()
+	t0 := time.Unix(1_700_000_000, 0)
+	clock := newFakeClock(t0)
+	pool, err := NewPool([]string{good.URL, bad.URL}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(30*time.Second), WithUnhealthyInterval(5*time.Second))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hc.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	goodB, badB := pool.GetBackends()[0], pool.GetBackends()[1]
+
+	// settled waits until neither backend is being probed and both are due
+	// at the given offsets from t0.
+	settled := func(goodAt, badAt time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			goodB.mu.Lock()
+			gNext, gBusy := goodB.nextProbe, goodB.probing
+			goodB.mu.Unlock()
+			badB.mu.Lock()
+			bNext, bBusy := badB.nextProbe, badB.probing
+			badB.mu.Unlock()
+			if !gBusy && !bBusy && gNext.Equal(t0.Add(goodAt)) && bNext.Equal(t0.Add(badAt)) {
+				time.Sleep(5 * time.Millisecond) // let Start reach its wait
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("next probes at +%v, +%v; want +%v, +%v", gNext.Sub(t0), bNext.Sub(t0), goodAt, badAt)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	probes := func(wantGood, wantBad int32) {
+		t.Helper()
+		if g, b := goodProbes.Load(), badProbes.Load(); g != wantGood || b != wantBad {
+			t.Errorf("at +%v: probes %d, %d; want %d, %d", clock.Now().Sub(t0), g, b, wantGood, wantBad)
+		}
+	}
+
+	// Both are probed at once; the failing one is retried every 5s, the
+	// healthy one left for 30s.
+	settled(30*time.Second, 5*time.Second)
+	probes(1, 1)
+
+	// A transition outside a probe (a failed request) reschedules at once:
+	// 5s from now, until two probes pass.
+	goodB.strike("proxy error: EOF", true)
+	settled(5*time.Second, 5*time.Second)
+	clock.advance(5 * time.Second) // +5s
+	settled(10*time.Second, 10*time.Second)
+	clock.advance(5 * time.Second) // +10s
+	settled(40*time.Second, 15*time.Second)
+	probes(3, 3)
+	clock.advance(5 * time.Second) // +15s
+	settled(40*time.Second, 20*time.Second)
+	probes(3, 4)
+
+	// Recovered (two passing probes), it goes back to the healthy cadence.
+	badUp.Store(true)
+	clock.advance(5 * time.Second) // +20s
+	settled(40*time.Second, 25*time.Second)
+	clock.advance(5 * time.Second) // +25s
+	settled(40*time.Second, 55*time.Second)
+	if !badB.IsHealthy() || !goodB.IsHealthy() {
+		t.Fatal("backends did not recover")
+	}
+	probes(3, 6)
+}
+
+// pathRecorder answers 200 on ok paths and 500 elsewhere, recording the
+// paths it was asked for.
+type pathRecorder struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (pr *pathRecorder) server(t *testing.T, ok ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pr.mu.Lock()
+		pr.paths = append(pr.paths, r.URL.Path)
+		pr.mu.Unlock()
+		for _, p := range ok {
+			if r.URL.Path == p {
+				return
+			}
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// probeRecorder is a Prober that passes every probe and records when each
+// backend was probed.
+type probeRecorder struct {
+	clock *fakeClock
+	mu    sync.Mutex
+	at    map[*Backend][]time.Time
+}
+
+func (r *probeRecorder) Probe(_ context.Context, b *Backend) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.at[b] = append(r.at[b], r.clock.Now())
+	return nil
+}
+
+func TestHealthCheckJitter(t *testing.T) {
+	const n, interval, jitter, step = 50, 10 * time.Second, 0.2, 250 * time.Millisecond
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = "http://gpu-" + strconv.Itoa(i)
+	}
+	t0 := time.Unix(1_700_000_000, 0)
+	clock := newFakeClock(t0)
+	pool, err := NewPool(urls, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(interval))
+	hc.SetJitter(jitter)
+	rec := &probeRecorder{clock: clock, at: map[*Backend][]time.Time{}}
+	hc.probers[HealthCheckHTTP] = rec
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hc.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// settled waits until every probe due has run and been rescheduled.
+	settled := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			now, pending := clock.Now(), false
+			for _, b := range pool.GetBackends() {
+				b.mu.Lock()
+				pending = pending || b.probing || !b.nextProbe.After(now)
+				b.mu.Unlock()
+			}
+			if !pending {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("probes still pending at +%v", now.Sub(t0))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for clock.Now().Sub(t0) < 6*interval {
+		settled()
+		clock.advance(step)
+	}
+	settled()
+
+	// The first probes are spread over the first interval, a fifth of
+	// them or so in each fifth of it.
+	var buckets [5]int
+	var gaps []time.Duration
+	for _, b := range pool.GetBackends() {
+		at := rec.at[b]
+		if len(at) == 0 {
+			t.Fatalf("%s never probed", b.ID())
+		}
+		if first := at[0].Sub(t0); first >= interval+step {
+			t.Errorf("%s first probed at +%v, after an interval", b.ID(), first)
+		} else {
+			buckets[min(first*5/interval, 4)]++
+		}
+		for i := 1; i < len(at); i++ {
+			gap := at[i].Sub(at[i-1])
+			// the factor's range, give or take a clock step
+			if min := time.Duration(float64(interval)*(1-jitter)) - step; gap < min || gap > time.Duration(float64(interval)*(1+jitter))+step {
+				t.Errorf("%s probed %v after the last", b.ID(), gap)
+			}
+			gaps = append(gaps, gap)
+		}
+	}
+	for i, count := range buckets {
+		if count == 0 {
+			t.Errorf("no first probe in fifth %d of the interval: %v", i, buckets)
+		}
+	}
+	// The probe rate is the unjittered one, give or take half a clock step
+	// of lag per probe.
+	var sum time.Duration
+	for _, gap := range gaps {
+		sum += gap
+	}
+	if mean := sum / time.Duration(len(gaps)); mean < interval-step || mean > interval+step {
+		t.Errorf("mean probe interval %v, want about %v", mean, interval)
+	}
+}
+
+func TestHealthURLOverride(t *testing.T) {
+	var serving, health pathRecorder
+	srv := serving.server(t)
+	hsrv := health.server(t, "/healthz")
+	pool, err := NewPool([]string{srv.URL + ",health=" + hsrv.URL + "/healthz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[0]
+	NewHealthChecker(pool, WithInterval(5*time.Second)).checkBackend(context.Background(), b)
+	if !b.IsHealthy() || len(serving.paths) != 0 || strings.Join(health.paths, ",") != "/healthz" {
+		t.Errorf("healthy %v; serving port probed at %v, health port at %v", b.IsHealthy(), serving.paths, health.paths)
+	}
+	if got := pool.Stats().Backends[0].HealthURL; got != hsrv.URL+"/healthz" {
+		t.Errorf("stats health URL %q", got)
+	}
+
+	out := captureLog(t)
+	NewStatusLogger(pool, time.Second, true).logStatus()
+	if !strings.Contains(out.String(), "health "+hsrv.URL+"/healthz") {
+		t.Errorf("verbose status does not show the health URL:\n%s", out)
+	}
+}
+
+func TestHealthPathDefault(t *testing.T) {
+	var rec pathRecorder
+	srv := rec.server(t, "/v1/models", "/api/v1/models", "/api/ready")
+	pool, err := NewPool([]string{srv.URL, srv.URL + "/api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(5*time.Second))
+	hc.checkAll(context.Background())
+	if err := pool.SetHealthPath("/ready"); err != nil {
+		t.Fatal(err)
+	}
+	hc.checkAll(context.Background())
+	slices.Sort(rec.paths)
+	if got := strings.Join(rec.paths, ","); got != "/api/ready,/api/v1/models,/ready,/v1/models" {
+		t.Errorf("probed %s", got)
+	}
+	if h := []bool{pool.GetBackends()[0].IsHealthy(), pool.GetBackends()[1].IsHealthy()}; h[0] || !h[1] {
+		t.Errorf("after probing /ready: healthy %v, want only the /api backend", h)
+	}
+}
+
+func TestHealthURLValidation(t *testing.T) {
+	for _, spec := range []string{
+		"http://b1:8000,health=b1:9000/healthz",
+		"http://b1:8000,health=ftp://b1:9000/healthz",
+		"http://b1:8000,health=http:///healthz",
+		"http://b1:8000,health=http://b1:9000/healthz#x",
+		"http://b1:8000,health=http://[::1/healthz",
+		"dns+http://svc:8000,health=http://svc:9000/healthz",
+	} {
+		if _, err := NewPool([]string{spec}); err == nil {
+			t.Errorf("NewPool(%q) accepted", spec)
+		}
+	}
+	pool, err := NewPool([]string{"http://b1:8000,health=https://b1:9443/healthz?full=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pool.HealthURL(pool.GetBackends()[0]); got != "https://b1:9443/healthz?full=1" {
+		t.Errorf("health URL %q", got)
+	}
+	if err := pool.SetHealthPath("healthz"); err == nil {
+		t.Error("a health path without a leading / was accepted")
+	}
+}
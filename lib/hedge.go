@@ -0,0 +1,285 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request hedging (--hedge-after): a safe request (GET, HEAD, OPTIONS
+// without a body) whose backend has not sent response headers within the
+// hedge delay is also sent to a second backend, picked by least-connections
+// among the others. Whichever attempt sends headers first answers the
+// client; the other is cancelled, which is not held against its backend.
+// Each attempt holds its own connection slot for as long as it runs. The
+// hedge budget (--hedge-budget) bounds hedges to a percentage of the pool's
+// requests, counted per second (the larger of this second's and the last's),
+// so hedging cannot double the load on backends that are slow because they
+// are overloaded. A hedge is never queued: without a free backend the
+// request just keeps waiting on the first. Upgrades, streaming uploads and
+// cache-aware routing are not hedged.
+
+// errHedgeLost cancels the attempt that lost the race.
+var errHedgeLost = errors.New("hedged request answered by another backend")
+
+// HedgeConfig configures request hedging.
+type HedgeConfig struct {
+	// After is how long to wait for response headers before hedging.
+	After time.Duration
+	// BudgetPercent caps hedges at this share of the pool's requests per
+	// second, 0-100.
+	BudgetPercent float64
+}
+
+type hedging struct {
+	cfg   HedgeConfig
+	clock Clock
+
+	// hedged counts hedges sent, won those that answered the client,
+	// overBudget requests that were due a hedge but over the budget
+	hedged, won, overBudget atomic.Uint64
+
+	mu sync.Mutex
+	// window is the start of the current second; requests and hedges count
+	// within it, prevRequests within the one before
+	window                         time.Time
+	requests, hedges, prevRequests int
+}
+
+// SetHedging enables request hedging. Call before serving traffic.
+func (p *Pool) SetHedging(cfg HedgeConfig) {
+	p.hedge = &hedging{cfg: cfg, clock: p.clock}
+}
+
+// hedgeable reports whether r may be sent to two backends at once: safe,
+// bodiless and not a protocol upgrade.
+func hedgeable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return r.ContentLength == 0 && r.Header.Get("Upgrade") == ""
+}
+
+// rollLocked moves the budget window to now. Caller must hold h.mu.
+func (h *hedging) rollLocked(now time.Time) {
+	window := now.Truncate(time.Second)
+	if window.Equal(h.window) {
+		return
+	}
+	h.prevRequests = 0
+	if window.Sub(h.window) == time.Second {
+		h.prevRequests = h.requests
+	}
+	h.window, h.requests, h.hedges = window, 0, 0
+}
+
+// count counts a request against the budget. Nil-safe.
+func (h *hedging) count() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rollLocked(h.clock.Now())
+	h.requests++
+}
+
+// allow takes a hedge from the budget, if one is left.
+func (h *hedging) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rollLocked(h.clock.Now())
+	if float64(h.hedges+1) > h.cfg.BudgetPercent/100*float64(max(h.requests, h.prevRequests)) {
+		h.overBudget.Add(1)
+		return false
+	}
+	h.hedges++
+	return true
+}
+
+// hedgeRace is one client request's attempts; the first to respond writes
+// to w.
+type hedgeRace struct {
+	w      http.ResponseWriter
+	rec    *reqLogCapture
+	dbg    *debugRecord
+	timing *requestTiming
+
+	mu       sync.Mutex
+	attempts []*hedgeAttempt
+	winner   *hedgeAttempt
+}
+
+// hedgeAttempt is the response writer of one attempt. Until it wins, its
+// headers are its own; a loser's writes are discarded.
+type hedgeAttempt struct {
+	race     *hedgeRace
+	backend  *Backend
+	header   http.Header
+	cancel   context.CancelCauseFunc
+	panicked bool
+}
+
+// claim makes a the winner unless another attempt already is, cancelling
+// the others, and reports whether a won.
+func (a *hedgeAttempt) claim() bool {
+	race := a.race
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.winner == nil {
+		race.winner = a
+		for _, other := range race.attempts {
+			if other != a {
+				other.cancel(errHedgeLost)
+			}
+		}
+		race.rec.setBackend(a.backend)
+		race.dbg.setBackend(a.backend)
+		race.timing.setBackend(a.backend)
+	}
+	return race.winner == a
+}
+
+func (a *hedgeAttempt) won() bool {
+	a.race.mu.Lock()
+	defer a.race.mu.Unlock()
+	return a.race.winner == a
+}
+
+func (a *hedgeAttempt) Header() http.Header {
+	if a.won() {
+		return a.race.w.Header() // trailers are set after the headers
+	}
+	return a.header
+}
+
+func (a *hedgeAttempt) WriteHeader(code int) {
+	if code < http.StatusOK {
+		return // interim responses are not worth racing for
+	}
+	if !a.claim() {
+		return
+	}
+	h := a.race.w.Header()
+	for k, v := range a.header {
+		h[k] = v
+	}
+	a.race.w.WriteHeader(code)
+}
+
+func (a *hedgeAttempt) Write(b []byte) (int, error) {
+	if !a.won() {
+		a.WriteHeader(http.StatusOK)
+		if !a.won() {
+			return 0, errHedgeLost
+		}
+	}
+	return a.race.w.Write(b)
+}
+
+// FlushError passes flushes of streamed responses on to the client.
+func (a *hedgeAttempt) FlushError() error {
+	if !a.won() {
+		return errHedgeLost
+	}
+	return http.NewResponseController(a.race.w).Flush()
+}
+
+// start runs an attempt on backend, whose connection slot the caller
+// reserved, and sends it to done when it returns.
+func (race *hedgeRace) start(p *Pool, r *http.Request, backend *Backend, done chan<- *hedgeAttempt) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	a := &hedgeAttempt{race: race, backend: backend, header: make(http.Header), cancel: cancel}
+	race.mu.Lock()
+	race.attempts = append(race.attempts, a)
+	attempt := len(race.attempts)
+	if race.winner != nil {
+		cancel(errHedgeLost) // the other attempt responded meanwhile
+	}
+	race.mu.Unlock()
+	go func() {
+		defer func() {
+			// proxy re-panics with http.ErrAbortHandler, already logged
+			a.panicked = recover() != nil
+			cancel(nil)
+			done <- a
+		}()
+		p.proxy(a, r.WithContext(ctx), backend, attempt)
+	}()
+}
+
+// serveHedged serves r on primary, whose connection slot the caller
+// reserved, hedging it on another backend with every label of match if
+// primary has not responded within the hedge delay. It returns once every
+// attempt has.
+func (p *Pool) serveHedged(w http.ResponseWriter, r *http.Request, primary *Backend, match map[string]string, rec *reqLogCapture, dbg *debugRecord, timing *requestTiming) {
+	h := p.hedge
+	race := &hedgeRace{w: w, rec: rec, dbg: dbg, timing: timing}
+	done := make(chan *hedgeAttempt, 2)
+	race.start(p, r, primary, done)
+	running, timer := 1, p.clock.After(h.cfg.After)
+	var finished []*hedgeAttempt
+	for running > 0 {
+		select {
+		case a := <-done:
+			running--
+			finished = append(finished, a)
+			timer = nil // the primary is done: nothing left to hedge
+		case <-timer:
+			timer = nil
+			if race.decided() || !h.allow() {
+				continue
+			}
+			hedge, err := p.selectBackendExcept(primary, match)
+			if err != nil {
+				continue
+			}
+			h.hedged.Add(1)
+			race.start(p, r, hedge, done)
+			running++
+		}
+	}
+
+	winner := race.winner
+	if winner != nil && winner.backend != primary {
+		h.won.Add(1)
+	}
+	for _, a := range finished {
+		if a.panicked && (a == winner || winner == nil) {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// decided reports whether an attempt has responded.
+func (race *hedgeRace) decided() bool {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	return race.winner != nil
+}
+
+// HedgeStats is the pool's request hedging in /stats.
+type HedgeStats struct {
+	AfterMs       float64 `json:"after_ms"`
+	BudgetPercent float64 `json:"budget_percent"`
+	// Hedged counts hedges sent; Won, those that answered the client;
+	// OverBudget, requests due a hedge that the budget did not allow.
+	Hedged     uint64 `json:"hedged"`
+	Won        uint64 `json:"won"`
+	OverBudget uint64 `json:"over_budget,omitempty"`
+}
+
+func (h *hedging) stats() *HedgeStats {
+	return &HedgeStats{
+		AfterMs:       float64(h.cfg.After) / float64(time.Millisecond),
+		BudgetPercent: h.cfg.BudgetPercent,
+		Hedged:        h.hedged.Load(),
+		Won:           h.won.Load(),
+		OverBudget:    h.overBudget.Load(),
+	}
+}
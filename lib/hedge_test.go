@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// getLatencies sends n sequential GETs through lb and returns their
+// latencies, sorted.
+func getLatencies(t *testing.T, lb *httptest.Server, n int) []time.Duration {
+	t.Helper()
+	latencies := make([]time.Duration, n)
+	for i := range latencies {
+		start := time.Now()
+		resp, err := http.Get(lb.URL + "/v1/completions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		latencies[i] = time.Since(start)
+	}
+	slices.Sort(latencies)
+	return latencies
+}
+
+func TestHedgingCutsTailLatency(t *testing.T) {
+	slow := mockbackend.Start(t, mockbackend.Config{Delay: 200 * time.Millisecond})
+	fast := mockbackend.Start(t, mockbackend.Config{})
+	const n = 20
+	// p90 rather than the max of 20 samples: on a loaded test machine one
+	// request may stall for reasons of its own.
+	p90 := func(hedge bool) (time.Duration, *Pool) {
+		pool, err := NewPool([]string{slow.URL, fast.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hedge {
+			pool.SetHedging(HedgeConfig{After: 20 * time.Millisecond, BudgetPercent: 100})
+		}
+		lb := httptest.NewServer(pool)
+		defer lb.Close()
+		latencies := getLatencies(t, lb, n)
+		return latencies[n*9/10], pool
+	}
+
+	without, _ := p90(false)
+	with, pool := p90(true)
+	if without < 80*time.Millisecond || with > 80*time.Millisecond {
+		t.Errorf("p90 %v without hedging, %v with", without, with)
+	}
+	s := pool.Stats()
+	if s.Hedging.Hedged == 0 || s.Hedging.Won == 0 {
+		t.Errorf("hedging stats %+v", *s.Hedging)
+	}
+	for _, b := range s.Backends {
+		if !b.Healthy || b.ActiveConns != 0 {
+			t.Errorf("%s: healthy %v, %d active", b.URL, b.Healthy, b.ActiveConns)
+		}
+	}
+	// Each hedge was a request to the fast backend on top of the primary's.
+	if got := s.Backends[0].Requests + s.Backends[1].Requests; got != n+s.Hedging.Hedged {
+		t.Errorf("%d backend requests for %d client requests and %d hedges", got, n, s.Hedging.Hedged)
+	}
+}
+
+func TestHedgeCancelsLoser(t *testing.T) {
+	out := captureLog(t)
+	cancelled := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	t.Cleanup(slow.Close)
+	fast := echoServer(t)
+	pool, err := NewPool([]string{slow.URL, fast.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetHedging(HedgeConfig{After: 10 * time.Millisecond, BudgetPercent: 100})
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+
+	// Until the slow backend is picked first and hedged.
+	for pool.Stats().Hedging.Hedged == 0 {
+		resp, err := http.Get(lb.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("losing attempt not cancelled")
+	}
+
+	b := pool.GetBackends()[0]
+	b.mu.Lock()
+	failures := b.failures
+	b.mu.Unlock()
+	if !b.IsHealthy() || failures != 0 || b.GetActiveConns() != 0 {
+		t.Errorf("cancelled backend: healthy %v, %d failures, %d active", b.IsHealthy(), failures, b.GetActiveConns())
+	}
+	if strings.Contains(out.String(), "client disconnected") {
+		t.Errorf("cancelled hedge logged as a client disconnect:\n%s", out)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	h := &hedging{cfg: HedgeConfig{BudgetPercent: 20}, clock: clock}
+	allowed := func() int {
+		n := 0
+		for range 10 {
+			if h.allow() {
+				n++
+			}
+		}
+		return n
+	}
+
+	for range 10 {
+		h.count()
+	}
+	if got := allowed(); got != 2 {
+		t.Errorf("20%% of 10 requests: %d hedges", got)
+	}
+	// A new second starts with the last one's allowance.
+	clock.advance(time.Second)
+	h.count()
+	if got := allowed(); got != 2 {
+		t.Errorf("next second: %d hedges", got)
+	}
+	clock.advance(2 * time.Second)
+	h.count()
+	if got := allowed(); got != 0 {
+		t.Errorf("after an idle second: %d hedges", got)
+	}
+	if got := h.stats().OverBudget; got != 26 {
+		t.Errorf("over budget %d, want 26", got)
+	}
+}
+
+func TestHedgeable(t *testing.T) {
+	for _, tt := range []struct {
+		method, body, upgrade string
+		want                  bool
+	}{
+		{http.MethodGet, "", "", true},
+		{http.MethodHead, "", "", true},
+		{http.MethodOptions, "", "", true},
+		{http.MethodPost, "", "", false},
+		{http.MethodPut, "", "", false},
+		{http.MethodGet, "x", "", false},
+		{http.MethodGet, "", "websocket", false},
+	} {
+		r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		if tt.upgrade != "" {
+			r.Header.Set("Upgrade", tt.upgrade)
+		}
+		if got := hedgeable(r); got != tt.want {
+			t.Errorf("%s body %q upgrade %q: %v", tt.method, tt.body, tt.upgrade, got)
+		}
+	}
+}
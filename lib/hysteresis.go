@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Flap damping (--unhealthy-threshold, --healthy-threshold): a single
+// failed probe or proxy error — a GC pause, a lost packet — should not take
+// a backend out of rotation, or the status log shows it toggling. Every
+// failure is a strike: a failed health check, and a proxy error or 5xx
+// that counts against the backend (see failclass.go), passive ones adding
+// to the same streak. A healthy backend goes down when its strikes reach
+// the unhealthy threshold, and any success in between — a passing check or
+// a successful proxied response — clears them. A healthy backend with
+// strikes is probed at the unhealthy interval, so its streak is settled by
+// probes rather than waiting out the healthy one. An unhealthy backend
+// rejoins after healthy-threshold consecutive passing checks (one, when
+// only a peer reported it down, see peers.go). The transition lines give
+// the streak behind them, and verbose status lines and /stats show the
+// streaks against the thresholds. A pool without thresholds set fails fast
+// on the first strike; cmd/lb's defaults are below.
+
+// Health threshold defaults cmd/lb exposes as flag values.
+const (
+	DefaultUnhealthyThreshold = 3
+	DefaultHealthyThreshold   = healthyThreshold
+)
+
+// SetHealthThresholds sets the consecutive strikes that take the pool's
+// backends down and the consecutive passing checks that bring them back.
+// Call before serving traffic.
+func (p *Pool) SetHealthThresholds(unhealthy, healthy int) error {
+	if unhealthy < 1 || healthy < 1 {
+		return errors.New("health thresholds must be at least 1")
+	}
+	p.unhealthyThreshold, p.healthyThreshold = unhealthy, healthy
+	for _, b := range p.GetBackends() {
+		b.mu.Lock()
+		b.unhealthyThreshold, b.healthyThreshold = unhealthy, healthy
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// thresholdsLocked returns the backend's unhealthy and healthy thresholds.
+// Caller must hold b.mu.
+func (b *Backend) thresholdsLocked() (unhealthy, healthy int) {
+	unhealthy, healthy = b.unhealthyThreshold, b.healthyThreshold
+	if unhealthy < 1 {
+		unhealthy = 1
+	}
+	if healthy < 1 {
+		healthy = healthyThreshold
+	}
+	return unhealthy, healthy
+}
+
+// clearStrikesLocked ends the backend's failure streak after a success.
+// Caller must hold b.mu.
+func (b *Backend) clearStrikesLocked() {
+	b.strikes, b.passiveStrikes = 0, 0
+}
+
+// strikesReason is a transition reason with the streak that caused it.
+func strikesReason(reason string, strikes, passive int) string {
+	if strikes <= 1 {
+		return reason
+	}
+	if passive == 0 {
+		return fmt.Sprintf("%s; %d strikes", reason, strikes)
+	}
+	return fmt.Sprintf("%s; %d strikes, %d from requests", reason, strikes, passive)
+}
+
+// passes returns the backend's consecutive passing checks: since it went
+// down, and the ones it came back up on.
+func (b *Backend) passes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.successStreak
+}
+
+// HealthStreakStats is a backend's streaks in /stats: its consecutive
+// strikes (Passive of them from proxied requests) and passing checks, and
+// the thresholds they flip it at.
+type HealthStreakStats struct {
+	Strikes            int `json:"strikes"`
+	Passive            int `json:"passive"`
+	Passes             int `json:"passes"`
+	UnhealthyThreshold int `json:"unhealthy_threshold"`
+	HealthyThreshold   int `json:"healthy_threshold"`
+}
+
+// streakStatsLocked returns the backend's streaks. Caller must hold b.mu.
+func (b *Backend) streakStatsLocked() HealthStreakStats {
+	unhealthy, healthy := b.thresholdsLocked()
+	s := HealthStreakStats{Strikes: b.strikes, Passive: b.passiveStrikes, UnhealthyThreshold: unhealthy, HealthyThreshold: healthy}
+	if !b.healthy {
+		s.Passes = b.successStreak
+	}
+	return s
+}
+
+// streakSummaryLocked is the verbose status line's streak, "" without one.
+// Caller must hold b.mu.
+func (b *Backend) streakSummaryLocked() string {
+	unhealthy, healthy := b.thresholdsLocked()
+	switch {
+	case b.healthy && b.strikes > 0:
+		return fmt.Sprintf(", %d/%d strikes", b.strikes, unhealthy)
+	case !b.healthy && b.successStreak > 0:
+		return fmt.Sprintf(", %d/%d passes", b.successStreak, healthy)
+	}
+	return ""
+}
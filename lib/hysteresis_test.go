@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	// Events: F a failed probe, E a proxy error, O a successful proxied
+	// response, P a passing probe. want is the health after each: H or U.
+	for _, tt := range []struct {
+		name               string
+		unhealthy, healthy int
+		events, want       string
+	}{
+		{"fail fast", 1, 2, "FPP", "UUH"},
+		{"three probe failures", 3, 2, "FFF", "HHU"},
+		{"pass in between", 3, 2, "FFPFF", "HHHHH"},
+		{"passive errors count", 3, 2, "EEF", "HHU"},
+		{"passive errors alone", 3, 2, "EEE", "HHU"},
+		{"success clears passive", 3, 2, "EEOEE", "HHHHH"},
+		{"mixed streak", 3, 2, "FEOFEF", "HHHHHU"},
+		{"recover after two", 3, 2, "FFFPP", "HHUUH"},
+		{"failure resets recovery", 3, 2, "FFFPFPP", "HHUUUUH"},
+		{"error while down resets recovery", 3, 2, "EEEPEPP", "HHUUUUH"},
+		{"requests do not recover", 3, 2, "FFFOOP", "HHUUUU"},
+		{"healthy threshold 3", 2, 3, "FFPPP", "HUUUH"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewPool([]string{"http://b:8000"}, WithLogger(&lineLogger{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pool.SetHealthThresholds(tt.unhealthy, tt.healthy); err != nil {
+				t.Fatal(err)
+			}
+			b := pool.GetBackends()[0]
+			var got strings.Builder
+			for _, e := range tt.events {
+				switch e {
+				case 'F':
+					b.probeFailed("status: 503", false)
+				case 'E':
+					b.strike("proxy error: EOF", true)
+				case 'O':
+					b.recordOutcome(true, time.Millisecond)
+				case 'P':
+					b.RecordCheckSuccess()
+				}
+				if b.IsHealthy() {
+					got.WriteByte('H')
+				} else {
+					got.WriteByte('U')
+				}
+			}
+			if got.String() != tt.want {
+				t.Errorf("%s: %s, want %s", tt.events, got.String(), tt.want)
+			}
+		})
+	}
+	pool, err := NewPool([]string{"http://b:8000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.SetHealthThresholds(0, 2) == nil || pool.SetHealthThresholds(3, 0) == nil {
+		t.Error("zero threshold accepted")
+	}
+}
+
+func TestHealthThresholdsReported(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.DefaultConfig())
+	out := &lineLogger{}
+	pool, err := NewPool([]string{mock.URL}, WithLogger(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHealthThresholds(3, 2); err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute), WithUnhealthyInterval(5*time.Second), WithLogger(out))
+	b := pool.GetBackends()[0]
+
+	mock.SetMode(mockbackend.ModeFailing)
+	hc.checkBackend(context.Background(), b)
+	b.strike("proxy error: EOF", true)
+	b.mu.Lock()
+	interval := hc.intervalLocked(b)
+	b.mu.Unlock()
+	if s := pool.Stats().Backends[0].Streak; !b.IsHealthy() || s != (HealthStreakStats{Strikes: 2, Passive: 1, UnhealthyThreshold: 3, HealthyThreshold: 2}) || interval != 5*time.Second {
+		t.Errorf("after two strikes: healthy %v, streak %+v, probe interval %v", b.IsHealthy(), s, interval)
+	}
+	hc.checkBackend(context.Background(), b)
+	if b.IsHealthy() || !strings.Contains(out.String(), "marked as unhealthy (status: 503; 3 strikes, 1 from requests)") {
+		t.Errorf("after three strikes: healthy %v\n%s", b.IsHealthy(), out)
+	}
+
+	mock.SetMode(mockbackend.ModeHealthy)
+	hc.checkBackend(context.Background(), b)
+	if s := pool.Stats().Backends[0].Streak; s.Strikes != 0 || s.Passes != 1 {
+		t.Errorf("after a pass: streak %+v", s)
+	}
+	hc.checkBackend(context.Background(), b)
+	if !b.IsHealthy() || !strings.Contains(out.String(), "marked as healthy after 2 passing checks") {
+		t.Errorf("after two passes: healthy %v\n%s", b.IsHealthy(), out)
+	}
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client identifier hashing (--hash-client-ids): the request log records who
+// sent a request — client IP, API key, the OpenAI `user` field — only as
+// HMAC-SHA256 hashes. The salt is random, held in memory only, and replaced
+// at every rotation boundary (daily by default, aligned to UTC), so hashes
+// correlate one client's requests within a period but cannot be reversed
+// or joined across periods. Routing (cache-aware affinity on `user`) keeps
+// using the raw values in memory. Operators trace a client during an
+// incident by asking for its current hash (POST /admin/identifiers/hash).
+
+// IdentityHasher pseudonymizes client identifiers under a rotating salt.
+type IdentityHasher struct {
+	rotation time.Duration
+	clock    Clock
+
+	mu     sync.Mutex
+	salt   []byte
+	period time.Time // start of the current salt's period
+}
+
+// NewIdentityHasher returns a hasher whose salt rotates every rotation.
+func NewIdentityHasher(rotation time.Duration, opts ...Option) *IdentityHasher {
+	return &IdentityHasher{rotation: rotation, clock: clockFrom(systemClock{}, opts)}
+}
+
+// Hash returns id's hash under the current salt.
+func (h *IdentityHasher) Hash(id string) string {
+	sum, _ := h.hash(id)
+	return sum
+}
+
+// HashWithExpiry returns id's hash and when the current salt expires, after
+// which the same id hashes differently.
+func (h *IdentityHasher) HashWithExpiry(id string) (string, time.Time) {
+	return h.hash(id)
+}
+
+func (h *IdentityHasher) hash(id string) (string, time.Time) {
+	h.mu.Lock()
+	period := h.clock.Now().Truncate(h.rotation)
+	if h.salt == nil || !period.Equal(h.period) {
+		h.salt = make([]byte, 32)
+		_, _ = rand.Read(h.salt) // never fails (crypto/rand docs)
+		h.period = period
+	}
+	mac := hmac.New(sha256.New, h.salt)
+	h.mu.Unlock()
+
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), period.Add(h.rotation)
+}
+
+// SetIdentityHasher makes the log record hashed client identifiers and
+// replace the `user` field of logged request bodies with its hash. Without
+// a hasher no client identifiers are logged beyond the raw bodies.
+// Call before serving traffic.
+func (l *RequestLog) SetIdentityHasher(h *IdentityHasher) {
+	l.hasher = h
+}
+
+// clientIdentifiers returns the hashed client IP and API key of r ("" when
+// absent).
+func (h *IdentityHasher) clientIdentifiers(r *http.Request) (client, key string) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = h.Hash(ip)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		key = h.Hash(token)
+	}
+	return client, key
+}
+
+// scrubUser replaces a JSON request body's top-level `user` string with its
+// hash. Other bodies are returned unchanged.
+func (h *IdentityHasher) scrubUser(body []byte) []byte {
+	if !json.Valid(body) || !strings.Contains(string(body), `"user"`) {
+		return body
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	var user string
+	if raw, ok := fields["user"]; !ok || json.Unmarshal(raw, &user) != nil {
+		return body
+	}
+	fields["user"], _ = json.Marshal(h.Hash(user))
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return out
+}
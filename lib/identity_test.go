@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdentityHasherRotates(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC))
+	h := NewIdentityHasher(24*time.Hour, WithClock(clock))
+
+	a, expires := h.HashWithExpiry("10.0.0.7")
+	if a == "10.0.0.7" || len(a) != 32 {
+		t.Fatalf("hash = %q, want 32 hex chars", a)
+	}
+	if want := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC); !expires.Equal(want) {
+		t.Errorf("expires = %v, want the next UTC midnight %v", expires, want)
+	}
+	if h.Hash("10.0.0.7") != a {
+		t.Error("same identifier hashed differently within a period")
+	}
+	if h.Hash("10.0.0.8") == a {
+		t.Error("different identifiers hashed alike")
+	}
+
+	clock.advance(time.Hour)
+	if h.Hash("10.0.0.7") == a {
+		t.Error("hash unchanged after the salt rotated")
+	}
+}
+
+func TestRequestLogHashesIdentifiers(t *testing.T) {
+	const (
+		clientIP = "127.0.0.1"
+		apiKey   = "sk-test-secret-key"
+		user     = "alice@example.com"
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer backend.Close()
+	// Address the backend by name so the client IP is the only 127.0.0.1.
+	pool, path := newLoggedPool(t, strings.Replace(backend.URL, clientIP, "localhost", 1))
+	hasher := NewIdentityHasher(24 * time.Hour)
+	pool.reqlog.SetIdentityHasher(hasher)
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	stdlog := captureLog(t)
+
+	req, _ := http.NewRequest(http.MethodPost, lb.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"m","user":"`+user+`","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	e := readLogEntries(t, path, 1)[0]
+	if e.Client != hasher.Hash(clientIP) || e.Key != hasher.Hash(apiKey) {
+		t.Errorf("client/key = %q/%q, want the hashes of the raw values", e.Client, e.Key)
+	}
+	if !jsonEqual(t, e.Request, `{"model":"m","user":"`+hasher.Hash(user)+`","messages":[]}`) {
+		t.Errorf("logged request = %v, want user replaced by its hash", e.Request)
+	}
+
+	data, err := os.ReadFile(path) // #nosec G304 -- test-owned temp path
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{clientIP, apiKey, user} {
+		if strings.Contains(string(data), raw) || strings.Contains(stdlog.String(), raw) {
+			t.Errorf("raw identifier %q in log output", raw)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"cmp"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Per-client concurrency limit (--max-inflight-per-client): unlike the
+// token rate limits, which meter throughput, this caps how many requests one
+// client has in flight at once, so a tenant holding many long generations
+// open can't occupy every backend slot. A client is the value of a
+// configured header (--concurrency-key; a Bearer token when the header is
+// Authorization), or its IP address when the header is absent. A request
+// over the cap gets 429 at once. The slot is released when the handler
+// returns, however it ends: a completed response, a proxy error, or a client
+// gone mid-stream. Counts are kept exactly in a sharded map, and a client's
+// entry is deleted when its last request ends.
+
+// inflightShards spreads clients over this many locks.
+const inflightShards = 32
+
+// InflightLimiter caps the concurrent requests of each client.
+type InflightLimiter struct {
+	max       int
+	keyHeader string
+	seed      maphash.Seed
+	shards    [inflightShards]inflightShard
+	// errorFormat is how rejections are written (see apierror.go)
+	errorFormat ErrorFormat
+}
+
+type inflightShard struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewInflightLimiter returns a limiter allowing each client max requests in
+// flight, identifying clients by keyHeader ("" = by IP address).
+func NewInflightLimiter(max int, keyHeader string) *InflightLimiter {
+	l := &InflightLimiter{max: max, keyHeader: keyHeader, seed: maphash.MakeSeed()}
+	for i := range l.shards {
+		l.shards[i].counts = make(map[string]int)
+	}
+	return l
+}
+
+// clientKey identifies r's client: "key:" and the header value, or "ip:"
+// and the remote address, so the two never collide.
+func (l *InflightLimiter) clientKey(r *http.Request) string {
+	if l.keyHeader != "" {
+		v := r.Header.Get(l.keyHeader)
+		if strings.EqualFold(l.keyHeader, "Authorization") {
+			v, _ = strings.CutPrefix(v, "Bearer ")
+		}
+		if v != "" {
+			return "key:" + v
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+func (l *InflightLimiter) shard(key string) *inflightShard {
+	return &l.shards[maphash.String(l.seed, key)%inflightShards]
+}
+
+// acquire takes one of key's slots, or reports that all are taken.
+func (l *InflightLimiter) acquire(key string) bool {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[key] >= l.max {
+		return false
+	}
+	s.counts[key]++
+	return true
+}
+
+// release returns one of key's slots, dropping the entry at zero.
+func (l *InflightLimiter) release(key string) {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.counts[key] - 1; n > 0 {
+		s.counts[key] = n
+	} else {
+		delete(s.counts, key)
+	}
+}
+
+// Handler wraps next with the per-client limit.
+func (l *InflightLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.clientKey(r)
+		if !l.acquire(key) {
+			l.reject(w, r)
+			return
+		}
+		defer l.release(key) // also on ErrAbortHandler panics
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *InflightLimiter) reject(w http.ResponseWriter, r *http.Request) {
+	apiError{
+		status:  http.StatusTooManyRequests,
+		typ:     "requests",
+		code:    "rate_limit_exceeded",
+		message: fmt.Sprintf("Too many concurrent requests: at most %d in flight per client.", l.max),
+		fields:  map[string]any{"param": "max_inflight_per_client", "limit": l.max},
+	}.write(w, r, l.errorFormat)
+}
+
+// InflightClient is one client's current usage.
+type InflightClient struct {
+	// Client is "key:<header value>" or "ip:<address>", the value or address
+	// hashed with a hasher; see Usage.
+	Client   string `json:"client"`
+	Inflight int    `json:"inflight"`
+}
+
+// Max returns the per-client cap.
+func (l *InflightLimiter) Max() int {
+	return l.max
+}
+
+// Usage returns the clients with requests in flight, busiest first. With a
+// hasher the header values and addresses are hashed (see IdentityHasher),
+// so no client identity leaves the process.
+func (l *InflightLimiter) Usage(h *IdentityHasher) []InflightClient {
+	var clients []InflightClient
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		for key, n := range s.counts {
+			clients = append(clients, InflightClient{Client: key, Inflight: n})
+		}
+		s.mu.Unlock()
+	}
+	if h != nil {
+		for i, c := range clients {
+			kind, id, _ := strings.Cut(c.Client, ":")
+			clients[i].Client = kind + ":" + h.Hash(id)
+		}
+	}
+	slices.SortFunc(clients, func(a, b InflightClient) int {
+		return cmp.Or(b.Inflight-a.Inflight, strings.Compare(a.Client, b.Client))
+	})
+	return clients
+}
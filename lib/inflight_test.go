@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestInflightLimiterCap(t *testing.T) {
+	const limit, clients, perClient = 3, 8, 50
+	l := NewInflightLimiter(limit, "X-Api-Key")
+	var current [clients]atomic.Int32
+	var exceeded atomic.Bool
+	var served, rejected atomic.Int32
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &current[r.Header.Get("X-Client")[0]-'a']
+		if c.Add(1) > limit {
+			exceeded.Store(true)
+		}
+		time.Sleep(time.Millisecond)
+		c.Add(-1)
+		served.Add(1)
+		if r.Header.Get("X-Panic") != "" {
+			panic(http.ErrAbortHandler)
+		}
+	}))
+
+	var wg sync.WaitGroup
+	for c := range clients {
+		for i := range perClient {
+			wg.Go(func() {
+				req := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+				id := string(rune('a' + c))
+				req.Header.Set("X-Api-Key", "key-"+id)
+				req.Header.Set("X-Client", id)
+				if i%10 == 0 {
+					req.Header.Set("X-Panic", "1")
+				}
+				rec := httptest.NewRecorder()
+				defer func() {
+					if v := recover(); v != nil && v != http.ErrAbortHandler {
+						t.Error(v)
+					}
+				}()
+				h.ServeHTTP(rec, req)
+				switch rec.Code {
+				case http.StatusOK:
+				case http.StatusTooManyRequests:
+					rejected.Add(1)
+				default:
+					t.Errorf("status %d", rec.Code)
+				}
+			})
+		}
+	}
+	wg.Wait()
+
+	if exceeded.Load() {
+		t.Errorf("more than %d requests of one client in flight", limit)
+	}
+	if served.Load()+rejected.Load() != clients*perClient || rejected.Load() == 0 {
+		t.Errorf("served %d, rejected %d of %d", served.Load(), rejected.Load(), clients*perClient)
+	}
+	if usage := l.Usage(nil); len(usage) != 0 {
+		t.Errorf("usage after all requests ended: %+v", usage)
+	}
+}
+
+func TestInflightLimiterReject(t *testing.T) {
+	l := NewInflightLimiter(1, "Authorization")
+	release := make(chan struct{})
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	do := func(auth, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+		req.RemoteAddr = remote
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	done := make(chan struct{})
+	go func() {
+		do("Bearer sk-1", "10.0.0.1:1000")
+		close(done)
+	}()
+	for len(l.Usage(nil)) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := do("Bearer sk-1", "10.0.0.2:1000")
+	var body struct {
+		Error struct {
+			Code  string `json:"code"`
+			Limit int    `json:"limit"`
+		} `json:"error"`
+	}
+	if rec.Code != http.StatusTooManyRequests || json.Unmarshal(rec.Body.Bytes(), &body) != nil ||
+		body.Error.Code != "rate_limit_exceeded" || body.Error.Limit != 1 {
+		t.Errorf("same key from another address = %d %s", rec.Code, rec.Body)
+	}
+	// Another key, and a keyless request by address, are separate clients.
+	go do("Bearer sk-2", "10.0.0.1:1000")
+	go do("", "10.0.0.1:1001")
+	for len(l.Usage(nil)) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	hasher := NewIdentityHasher(time.Hour)
+	usage := l.Usage(hasher)
+	want := map[string]bool{"key:" + hasher.Hash("sk-1"): true, "key:" + hasher.Hash("sk-2"): true, "ip:" + hasher.Hash("10.0.0.1"): true}
+	for _, c := range usage {
+		if !want[c.Client] || c.Inflight != 1 {
+			t.Errorf("usage %+v", usage)
+		}
+		if strings.Contains(c.Client, "10.0.0.1") || strings.Contains(c.Client, "sk-") {
+			t.Errorf("client %s left unhashed", c.Client)
+		}
+	}
+	close(release)
+	<-done
+	for len(l.Usage(nil)) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInflightLimiterReleasesOnDisconnect(t *testing.T) {
+	captureLog(t)
+	backend := mockbackend.Start(t, mockbackend.Config{StreamChunks: 100, StreamDelay: 20 * time.Millisecond})
+	pool, err := NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := NewPool([]string{"http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewInflightLimiter(1, "")
+	// The handler releases its slot just after the response ends.
+	waitIdle := func(after string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(l.Usage(nil)) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("slot not released after %s: %+v", after, l.Usage(nil))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/dead/", dead)
+	mux.Handle("/", pool)
+	lb := httptest.NewServer(l.Handler(mux))
+	t.Cleanup(lb.Close)
+
+	// A proxy error releases the slot.
+	resp, err := http.Post(lb.URL+"/dead/v1/completions", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d from a dead backend", resp.StatusCode)
+	}
+	waitIdle("a proxy error")
+
+	// So does a client leaving mid-stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, lb.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if usage := l.Usage(nil); len(usage) != 1 || usage[0].Inflight != 1 {
+		t.Errorf("usage mid-stream: %+v", usage)
+	}
+	cancel()
+	resp.Body.Close()
+	waitIdle("the client left")
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// End-to-end tests: a pool served over HTTP in front of in-process mock
+// backends, driven by concurrent clients.
+
+// mockCluster starts n mock backends with cfg and a pool over them.
+func mockCluster(t *testing.T, n int, cfg mockbackend.Config) ([]*mockbackend.Server, *Pool, *httptest.Server) {
+	t.Helper()
+	backends := make([]*mockbackend.Server, n)
+	urls := make([]string, n)
+	for i := range backends {
+		backends[i] = mockbackend.Start(t, cfg)
+		urls[i] = backends[i].URL
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	return backends, pool, lb
+}
+
+// drive sends n completions through lb from workers concurrent clients and
+// counts the responses by status and by serving backend port.
+func drive(t *testing.T, lb *httptest.Server, n, workers int) (statuses, ports map[int]int) {
+	t.Helper()
+	statuses, ports = make(map[int]int), make(map[int]int)
+	var mu sync.Mutex
+	jobs := make(chan struct{}, n)
+	for range n {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for range jobs {
+				resp, err := http.Post(lb.URL+"/v1/completions", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var body struct {
+					BackendPort int `json:"backend_port"`
+				}
+				_ = json.NewDecoder(resp.Body).Decode(&body)
+				_ = resp.Body.Close()
+				mu.Lock()
+				statuses[resp.StatusCode]++
+				if resp.StatusCode == http.StatusOK {
+					ports[body.BackendPort]++
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return statuses, ports
+}
+
+// port returns the mock backend's port, which it reports as backend_port.
+func port(t *testing.T, s *mockbackend.Server) int {
+	t.Helper()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestIntegrationDistribution(t *testing.T) {
+	backends, _, lb := mockCluster(t, 4, mockbackend.Config{Delay: 5 * time.Millisecond, ResponseSize: 64})
+	const n = 400
+	statuses, ports := drive(t, lb, n, 16)
+	if statuses[http.StatusOK] != n {
+		t.Fatalf("statuses %v, want %d 200s", statuses, n)
+	}
+	for _, b := range backends {
+		if got := ports[port(t, b)]; got < n/4/2 || got > n/4*2 {
+			t.Errorf("backend %s served %d of %d requests, want about a quarter (%v)", b.URL, got, n, ports)
+		}
+	}
+
+	// Least-conn steers load away from a slow backend.
+	backends[0].SetMode(mockbackend.ModeSlow)
+	backends[0].SetDelay(100 * time.Millisecond)
+	_, ports = drive(t, lb, n, 16)
+	slow := ports[port(t, backends[0])]
+	for _, b := range backends[1:] {
+		if fast := ports[port(t, b)]; fast <= 2*slow {
+			t.Errorf("slow backend served %d, fast %s only %d (%v)", slow, b.URL, fast, ports)
+		}
+	}
+}
+
+func TestIntegrationFailoverAndRecovery(t *testing.T) {
+	out := captureLog(t)
+	backends, pool, lb := mockCluster(t, 3, mockbackend.Config{ResponseSize: 64})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hc := NewHealthChecker(pool, WithInterval(20*time.Millisecond))
+	hc.SetTimeout(100 * time.Millisecond)
+	go hc.Start(ctx)
+
+	// A failing backend is taken out by its first 5xx: the clients see at
+	// most the requests already on their way to it fail.
+	failing := backends[1]
+	failing.SetMode(mockbackend.ModeFailing)
+	const n = 300
+	statuses, ports := drive(t, lb, n, 8)
+	if statuses[http.StatusInternalServerError] > 8 || statuses[http.StatusOK] < n-8 {
+		t.Errorf("failover: statuses %v", statuses)
+	}
+	if got := ports[port(t, failing)]; got != 0 {
+		t.Errorf("failing backend served %d requests", got)
+	}
+	if s := pool.Stats(); s.HealthyBackends != 2 {
+		t.Errorf("%d healthy backends with one failing", s.HealthyBackends)
+	}
+
+	// Healthy again, it rejoins after passing health checks.
+	failing.SetMode(mockbackend.ModeHealthy)
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Stats().HealthyBackends != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("recovered backend not readmitted:\n%s", out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	statuses, ports = drive(t, lb, n, 8)
+	if statuses[http.StatusOK] != n || ports[port(t, failing)] == 0 {
+		t.Errorf("after recovery: statuses %v, ports %v", statuses, ports)
+	}
+	if !strings.Contains(out.String(), "marked as healthy") {
+		t.Errorf("no recovery logged:\n%s", out)
+	}
+
+	// With every backend down, clients get 503 rather than a hang.
+	for _, b := range backends {
+		b.SetMode(mockbackend.ModeTimeout)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for pool.Stats().HealthyBackends != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timing-out backends still healthy")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if statuses, _ := drive(t, lb, 10, 2); statuses[http.StatusServiceUnavailable] != 10 {
+		t.Errorf("all down: statuses %v", statuses)
+	}
+}
@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Request latency (always on) and slow-request logging
+// (--slow-request-threshold): every proxied request's duration, from
+// arrival to the end of its response body, is added to a histogram of the
+// backend that served it. The histogram has fixed, log-spaced buckets from
+// 1ms to 1h, four per doubling, so a quantile read from it is within 19% of
+// the true value; each bucket is an atomic counter, so concurrent requests
+// never wait on one another to record. /stats shows p50, p90, p99 and p99.9
+// per backend, and /metrics a summary. A request slower than the threshold
+// is logged as a [SLOW] line with its method, path, backend, status and
+// duration, whether or not requests are logged. A request delayed by a
+// chaos rule is not recorded, and its [SLOW] line says so (see chaos.go).
+
+const (
+	// latencyMin is the upper bound of the first bucket.
+	latencyMin = time.Millisecond
+	// latencySubBuckets is the number of buckets per doubling.
+	latencySubBuckets = 4
+	// latencyBuckets covers 1ms to 1h (2^21.8 ms), plus one bucket above.
+	latencyBuckets = 89 + 1
+)
+
+// latencyQuantiles are the quantiles shown in /stats and /metrics.
+var latencyQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// latencyHistogram counts durations in log-spaced buckets.
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64 // nanoseconds
+	max     atomic.Int64 // nanoseconds
+}
+
+// latencyBucket returns the index of the bucket counting d.
+func latencyBucket(d time.Duration) int {
+	if d <= latencyMin {
+		return 0
+	}
+	i := int(math.Ceil(latencySubBuckets * math.Log2(float64(d)/float64(latencyMin))))
+	return min(i, latencyBuckets-1)
+}
+
+// latencyUpper returns the upper bound of bucket i, for all but the last,
+// unbounded bucket.
+func latencyUpper(i int) time.Duration {
+	return time.Duration(float64(latencyMin) * math.Exp2(float64(i)/latencySubBuckets))
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.buckets[latencyBucket(d)].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+	for m := h.max.Load(); int64(d) > m && !h.max.CompareAndSwap(m, int64(d)); m = h.max.Load() {
+	}
+}
+
+// quantiles estimates the given quantiles, each as the upper bound of the
+// bucket holding it (the maximum for the last bucket), from one pass over
+// the buckets. Buckets are read one by one while requests keep recording,
+// so the estimate is of a histogram that may be a few requests behind.
+func (h *latencyHistogram) quantiles(qs []float64) []time.Duration {
+	counts := h.counts()
+	return bucketQuantiles(&counts, time.Duration(h.max.Load()), qs)
+}
+
+// counts reads the bucket counts.
+func (h *latencyHistogram) counts() [latencyBuckets]uint64 {
+	var counts [latencyBuckets]uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+	}
+	return counts
+}
+
+// bucketQuantiles estimates quantiles from bucket counts, each as the upper
+// bound of the bucket holding it, capped at maxSeen.
+func bucketQuantiles(counts *[latencyBuckets]uint64, maxSeen time.Duration, qs []float64) []time.Duration {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	out := make([]time.Duration, len(qs))
+	if total == 0 {
+		return out
+	}
+	for j, q := range qs {
+		rank := uint64(math.Ceil(q * float64(total)))
+		var seen uint64
+		for i, n := range counts {
+			if seen += n; seen >= max(rank, 1) {
+				out[j] = maxSeen
+				if i < latencyBuckets-1 {
+					out[j] = min(latencyUpper(i), maxSeen)
+				}
+				break
+			}
+		}
+	}
+	return out
+}
+
+// LatencyStats reports a backend's request durations in /stats: requests
+// recorded, their total and longest, and quantile estimates.
+type LatencyStats struct {
+	Count  uint64  `json:"count"`
+	SumMs  float64 `json:"sum_ms"`
+	MaxMs  float64 `json:"max_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P90Ms  float64 `json:"p90_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	P999Ms float64 `json:"p999_ms"`
+}
+
+func (h *latencyHistogram) stats() *LatencyStats {
+	n := h.count.Load()
+	if n == 0 {
+		return nil
+	}
+	qs := h.quantiles(latencyQuantiles)
+	return &LatencyStats{
+		Count:  n,
+		SumMs:  durationMs(time.Duration(h.sum.Load())),
+		MaxMs:  durationMs(time.Duration(h.max.Load())),
+		P50Ms:  durationMs(qs[0]),
+		P90Ms:  durationMs(qs[1]),
+		P99Ms:  durationMs(qs[2]),
+		P999Ms: durationMs(qs[3]),
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// SetSlowRequestThreshold logs every request taking longer than d as a
+// [SLOW] line (0 = off). Call before serving traffic.
+func (p *Pool) SetSlowRequestThreshold(d time.Duration) {
+	p.slowThreshold = d
+}
+
+// requestTiming times one request through the pool.
+type requestTiming struct {
+	p       *Pool
+	r       *http.Request
+	sw      *statusWriter
+	start   time.Time
+	backend *Backend
+	// chaos is the failure injected into the request, if any
+	chaos string
+}
+
+// beginTiming starts timing r, returning the writer to serve it through.
+func (p *Pool) beginTiming(w http.ResponseWriter, r *http.Request) (*requestTiming, http.ResponseWriter) {
+	t := &requestTiming{p: p, r: r, sw: &statusWriter{ResponseWriter: w}, start: p.clock.Now()}
+	return t, t.sw
+}
+
+// setBackend records the backend serving the request. Nil-safe.
+func (t *requestTiming) setBackend(b *Backend) {
+	if t != nil {
+		t.backend = b
+	}
+}
+
+// setChaos tags the request with the failure injected into it. Nil-safe.
+func (t *requestTiming) setChaos(tag string) {
+	if t != nil {
+		t.chaos = tag
+	}
+}
+
+// finish records the request's duration in its backend's histogram and
+// logs it if slow.
+func (t *requestTiming) finish() {
+	d := t.p.clock.Now().Sub(t.start)
+	if t.backend != nil && t.chaos == "" {
+		t.backend.latency.observe(d)
+	}
+	if limit := t.p.slowThreshold; limit > 0 && d > limit {
+		backend, status := "-", "no response"
+		if t.backend != nil {
+			backend = t.backend.ID()
+		}
+		if t.sw.status != 0 {
+			status = strconv.Itoa(t.sw.status)
+		}
+		id := ""
+		if rid := requestID(t.r); rid != "" {
+			id = " request " + rid
+		}
+		if t.chaos != "" {
+			id += " (chaos: " + t.chaos + ")"
+		}
+		t.p.logger.Printf("[SLOW] %s %s via %s: %s in %v (over %v)%s", t.r.Method, t.r.URL.Path, backend, status, d.Round(time.Millisecond), limit, id)
+	}
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withinBucket reports whether estimate is got's bucket resolution (one
+// sub-bucket, 2^(1/4)) above or below want.
+func withinBucket(estimate, want time.Duration) bool {
+	const step = 1.19
+	return float64(estimate) >= float64(want)/step && float64(estimate) <= float64(want)*step
+}
+
+func TestLatencyHistogramQuantiles(t *testing.T) {
+	var h latencyHistogram
+	if h.stats() != nil {
+		t.Error("stats of an empty histogram")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	qs := h.quantiles([]float64{0.5, 0.9, 0.99, 1})
+	for i, want := range []time.Duration{500 * time.Millisecond, 900 * time.Millisecond, 990 * time.Millisecond, time.Second} {
+		if !withinBucket(qs[i], want) {
+			t.Errorf("quantile %d = %v, want about %v", i, qs[i], want)
+		}
+	}
+	s := h.stats()
+	if s.Count != 1000 || s.MaxMs != 1000 || s.SumMs != 500500 {
+		t.Errorf("stats %+v", s)
+	}
+
+	// The range ends are bounded too: under 1ms in the first bucket, over
+	// an hour reported as the longest seen.
+	var edges latencyHistogram
+	edges.observe(100 * time.Microsecond)
+	edges.observe(3 * time.Hour)
+	if q := edges.quantiles([]float64{0.5, 1}); q[0] != time.Millisecond || q[1] != 3*time.Hour {
+		t.Errorf("edge quantiles %v", q)
+	}
+	if upper := latencyUpper(latencyBuckets - 2); upper < time.Hour {
+		t.Errorf("last bounded bucket ends at %v, before 1h", upper)
+	}
+}
+
+func TestLatencyStatsAndSlowRequestLog(t *testing.T) {
+	logs := captureLog(t)
+	// Fixed delays: the mock backend's are jittered.
+	delayed := func(d time.Duration) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+		}))
+		t.Cleanup(s.Close)
+		return s.URL
+	}
+	pool, err := NewPool([]string{delayed(10 * time.Millisecond), delayed(120 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetSlowRequestThreshold(60 * time.Millisecond)
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	drive(t, lb, 30, 1)
+
+	slow := pool.GetBackends()[1]
+	var slowCount uint64
+	for _, bs := range pool.Stats().Backends {
+		l := bs.Latency
+		if l == nil || l.Count == 0 {
+			t.Fatalf("%s: no latency recorded", bs.URL)
+		}
+		want := 10 * time.Millisecond
+		if bs.URL == slow.ID() {
+			want, slowCount = 120*time.Millisecond, l.Count
+		}
+		// Proxying adds a little to the backend's delay.
+		if p50 := time.Duration(l.P50Ms * float64(time.Millisecond)); p50 < want || float64(p50) > 1.19*float64(want+5*time.Millisecond) {
+			t.Errorf("%s: p50 %v, want about %v", bs.URL, p50, want)
+		}
+	}
+
+	lines := 0
+	for line := range strings.SplitSeq(logs.String(), "\n") {
+		if !strings.Contains(line, "[SLOW]") {
+			continue
+		}
+		lines++
+		if !strings.Contains(line, "POST /v1/completions via "+slow.ID()+": 200 in ") || !strings.Contains(line, "(over 60ms)") {
+			t.Errorf("slow line %q", line)
+		}
+	}
+	if uint64(lines) != slowCount {
+		t.Errorf("%d slow lines for %d requests to the slow backend", lines, slowCount)
+	}
+}
@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Load hints (--load-hints): clients running adaptive concurrency get the
+// pool's load on every response it serves:
+//
+//	X-LB-Healthy-Backends: backends in rotation (healthy, not ejected,
+//	drained or restarting)
+//	X-LB-Total-Inflight: requests in flight on the pool's backends
+//	X-LB-Load-Factor: in-flight requests over the capacity of the backends
+//	in rotation (their max_conns, adaptive limit or --max-conns), 0 to 1;
+//	absent when one of them has no cap, 1 when none is in rotation
+//
+// and a 429 or 503 for lack of capacity gets a Retry-After of the expected
+// wait for a slot — the queued requests plus one, times the recent average
+// service time, over the capacity (or the backends in rotation when
+// uncapped) — between 1 and 60 seconds, instead of a constant 1. The values
+// are computed by a ticker every loadHintsRefresh and published behind one
+// atomic pointer, so a response pays a load and three header sets, never a
+// walk of the pool; they may be that much out of date.
+
+// Load hint headers.
+const (
+	loadHealthyHeader  = "X-LB-Healthy-Backends"
+	loadInflightHeader = "X-LB-Total-Inflight"
+	loadFactorHeader   = "X-LB-Load-Factor"
+)
+
+// loadHintsRefresh is how often the hints are recomputed.
+const loadHintsRefresh = 250 * time.Millisecond
+
+// Retry-After bounds under --load-hints, in seconds.
+const (
+	minRetryAfter = 1
+	maxRetryAfter = 60
+)
+
+// loadSnapshot is the hints as of one refresh, formatted for the headers.
+type loadSnapshot struct {
+	healthy, inflight, factor, retryAfter string
+}
+
+// loadHints publishes a pool's load summary for its responses.
+type loadHints struct {
+	pool    *Pool
+	current atomic.Pointer[loadSnapshot]
+
+	// the backends' latency totals at the last refresh and the average
+	// service time since, smoothed; only refresh touches them
+	count       uint64
+	sum         int64
+	serviceTime time.Duration
+}
+
+// SetLoadHints adds the load hint headers to the pool's responses and
+// derives Retry-After from its load. Call before serving traffic.
+func (p *Pool) SetLoadHints() {
+	h := &loadHints{pool: p}
+	h.refresh()
+	p.hints = h
+	go h.run()
+}
+
+func (h *loadHints) run() {
+	tick := h.pool.clock.NewTicker(loadHintsRefresh)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C():
+			h.refresh()
+		case <-h.pool.lifetime.Done():
+			return
+		}
+	}
+}
+
+// refresh recomputes the snapshot from the pool's current state.
+func (h *loadHints) refresh() {
+	p := h.pool
+	var healthy, inflight, capacity int
+	var count uint64
+	var sum int64
+	capped := true
+	for _, b := range p.GetBackends() {
+		inflight += b.GetActiveConns()
+		count += b.latency.count.Load()
+		sum += b.latency.sum.Load()
+		if !b.available() {
+			continue
+		}
+		healthy++
+		if limit := b.connCap(p.maxConns); limit > 0 {
+			capacity += limit
+		} else {
+			capped = false
+		}
+	}
+	// Backends leaving the pool take their totals with them; skip a
+	// sample that would go negative.
+	if count > h.count && sum >= h.sum {
+		sample := time.Duration((sum - h.sum) / int64(count-h.count))
+		if h.serviceTime == 0 {
+			h.serviceTime = sample
+		} else {
+			h.serviceTime += time.Duration(queueEWMAAlpha * float64(sample-h.serviceTime))
+		}
+	}
+	h.count, h.sum = count, sum
+
+	s := &loadSnapshot{healthy: strconv.Itoa(healthy), inflight: strconv.Itoa(inflight)}
+	slots := capacity
+	switch {
+	case healthy == 0:
+		s.factor, slots = "1", 1
+	case capped:
+		s.factor = strconv.FormatFloat(min(1, float64(inflight)/float64(capacity)), 'f', 2, 64)
+	default:
+		slots = healthy
+	}
+	wait := h.serviceTime.Seconds() * float64(p.QueueDepth()+1) / float64(slots)
+	s.retryAfter = strconv.Itoa(int(min(maxRetryAfter, max(minRetryAfter, math.Ceil(wait)))))
+	h.current.Store(s)
+}
+
+// retryAfter is the Retry-After of a response for lack of capacity.
+func (p *Pool) retryAfter() string {
+	if p.hints == nil {
+		return strconv.Itoa(minRetryAfter)
+	}
+	return p.hints.current.Load().retryAfter
+}
+
+// writer returns w adding the hint headers to the final response.
+func (h *loadHints) writer(w http.ResponseWriter) http.ResponseWriter {
+	return &loadHintsWriter{ResponseWriter: w, snapshot: h.current.Load()}
+}
+
+// loadHintsWriter adds the load hint headers to the final response's
+// headers.
+type loadHintsWriter struct {
+	http.ResponseWriter
+	snapshot *loadSnapshot
+	wrote    bool
+}
+
+func (w *loadHintsWriter) WriteHeader(code int) {
+	if !w.wrote && !isInterim(code) {
+		w.wrote = true
+		h := w.Header()
+		h.Set(loadHealthyHeader, w.snapshot.healthy)
+		h.Set(loadInflightHeader, w.snapshot.inflight)
+		if w.snapshot.factor != "" {
+			h.Set(loadFactorHeader, w.snapshot.factor)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loadHintsWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's Flush
+// and deadline methods, which ReverseProxy needs to stream SSE responses.
+func (w *loadHintsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
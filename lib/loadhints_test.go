@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestLoadHintsTrackPool(t *testing.T) {
+	release := make(chan struct{})
+	var urls []string
+	for range 2 {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hold" {
+				<-release
+			}
+			_, _ = w.Write([]byte("ok"))
+		}))
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL)
+	}
+	clock := newFakeClock(time.Now())
+	pool, err := NewPool(urls, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+	pool.SetMaxConns(2)
+	pool.SetLoadHints()
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	clock.blockUntil(t, 1)
+	refresh := func() {
+		t.Helper()
+		was := pool.hints.current.Load()
+		clock.advance(loadHintsRefresh)
+		for pool.hints.current.Load() == was {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	get := func(status int, healthy, inflight, factor string) http.Header {
+		t.Helper()
+		resp, err := http.Get(lb.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		h := resp.Header
+		if resp.StatusCode != status || h.Get(loadHealthyHeader) != healthy || h.Get(loadInflightHeader) != inflight || h.Get(loadFactorHeader) != factor {
+			t.Errorf("got %d healthy=%s inflight=%s factor=%s, want %d %s %s %s", resp.StatusCode,
+				h.Get(loadHealthyHeader), h.Get(loadInflightHeader), h.Get(loadFactorHeader), status, healthy, inflight, factor)
+		}
+		return h
+	}
+
+	get(http.StatusOK, "2", "0", "0.00")
+	refresh()
+
+	// Saturate both backends; a 12s average service time over 4 slots
+	// puts the next free one 3s away.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			if resp, err := http.Get(lb.URL + "/hold"); err == nil {
+				_ = resp.Body.Close()
+			}
+		})
+	}
+	for active, _, _ := pool.GetStatus(); active < 4; active, _, _ = pool.GetStatus() {
+		time.Sleep(time.Millisecond)
+	}
+	pool.GetBackends()[0].latency.observe(12 * time.Second)
+	refresh()
+	if h := get(http.StatusTooManyRequests, "2", "4", "1.00"); h.Get("Retry-After") != "3" {
+		t.Errorf("Retry-After = %q, want 3", h.Get("Retry-After"))
+	}
+
+	// Freed.
+	close(release)
+	wg.Wait()
+	refresh()
+	get(http.StatusOK, "2", "0", "0.00")
+
+	// No backend in rotation: a 503 with the whole service time to wait.
+	for _, b := range pool.GetBackends() {
+		b.MarkUnhealthy()
+	}
+	refresh()
+	h := get(http.StatusServiceUnavailable, "0", "0", "1")
+	if s, _ := strconv.Atoi(h.Get("Retry-After")); s < 2 || s > maxRetryAfter {
+		t.Errorf("Retry-After = %q, want the decayed service time", h.Get("Retry-After"))
+	}
+}
+
+func TestLoadHintsUncapped(t *testing.T) {
+	_, pool, lb := mockCluster(t, 2, mockbackend.Config{})
+	pool.SetLoadHints()
+	resp, err := http.Get(lb.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Header.Get(loadHealthyHeader) != "2" || resp.Header.Get(loadFactorHeader) != "" {
+		t.Errorf("headers %v, want healthy 2 and no load factor without caps", resp.Header)
+	}
+	if pool.retryAfter() != "1" {
+		t.Errorf("Retry-After = %s, want 1 before any service time", pool.retryAfter())
+	}
+}
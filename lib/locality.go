@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"time"
+)
+
+// Labels and locality: any key=value attribute of a backend spec other than
+// priority is a label ("http://b1:8000,zone=us-east-1a,gpu=a100"), shown in
+// /stats and added to the backend's Prometheus labels. With --zone set, the
+// "zone" label drives locality-aware selection: within the serving priority
+// tier, requests go to backends in lb's own zone while at least
+// --zone-spill-threshold of them are selectable, and to the least loaded
+// backend of any zone once fewer are, or once every local one is at its
+// cap. Backends without a zone label count as remote. Spilling starts and
+// stops are logged once with a [ZONE] tag.
+
+// zoneLabel is the label locality-aware selection compares with --zone.
+const zoneLabel = "zone"
+
+// DefaultZoneSpillThreshold is the default fraction of same-zone backends
+// that must be selectable to keep traffic in the zone.
+const DefaultZoneSpillThreshold = 0.7
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validLabel checks a label name: it must be a valid Prometheus label name
+// that does not collide with the ones /metrics already uses.
+func validLabel(name string) error {
+	switch {
+	case !labelNameRE.MatchString(name):
+		return fmt.Errorf("label %q: names are letters, digits and underscores, not starting with a digit", name)
+	case name == "pool" || name == "backend" || name == "class" || len(name) > 1 && name[:2] == "__":
+		return fmt.Errorf("label %q is reserved", name)
+	}
+	return nil
+}
+
+// Labels returns a copy of the backend's labels.
+func (b *Backend) Labels() map[string]string {
+	return maps.Clone(b.labels)
+}
+
+// hasLabels reports whether the backend has every label of match.
+func (b *Backend) hasLabels(match map[string]string) bool {
+	for k, v := range match {
+		if b.labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetZone enables locality-aware selection for lb running in zone (see
+// above). threshold, in [0, 1], is the selectable fraction of same-zone
+// backends below which traffic spills to other zones. Call before serving
+// traffic.
+func (p *Pool) SetZone(zone string, threshold float64) {
+	p.zone, p.zoneSpill = zone, threshold
+}
+
+// localLeast returns the least loaded selectable, uncapped backend of lb's
+// zone in tier other than except and labeled with match, as leastConn's
+// pick, or false when traffic should spill to every zone.
+func (p *Pool) localLeast(s *poolSnapshot, now time.Time, tier int, except *Backend, match map[string]string) (pick, bool) {
+	total, selectable := 0, 0
+	var least pick
+	ties := 0
+	two := p.newTwoChoice()
+	for _, b := range s.backends {
+		if b == except || !b.hasLabels(match) || b.priority != tier || b.labels[zoneLabel] != p.zone {
+			continue
+		}
+		total++
+		e := p.candidate(s, b)
+		if e == nil {
+			continue
+		}
+		ok, count, load := p.load(e, now)
+		if !ok {
+			continue
+		}
+		selectable++
+		if !math.IsInf(load, 1) {
+			least.consider(b, count, load, &ties)
+			two.consider(pick{b, count, load})
+		}
+	}
+	least = two.choose(least)
+
+	switch {
+	case total == 0:
+		p.noteSpill(fmt.Sprintf("no %s backends", p.zone))
+	case float64(selectable) < p.zoneSpill*float64(total):
+		p.noteSpill(fmt.Sprintf("%d of %d %s backends selectable", selectable, total, p.zone))
+	case least.b == nil:
+		p.noteSpill(fmt.Sprintf("%s backends at max-conns", p.zone))
+	default:
+		p.noteSpill("")
+		return least, true
+	}
+	return pick{}, false
+}
+
+// noteSpill logs a change of whether selection spills to other zones;
+// reason is empty when it stays in the zone.
+func (p *Pool) noteSpill(reason string) {
+	spilling := reason != ""
+	if p.zoneSpilling.Swap(spilling) == spilling {
+		return
+	}
+	if spilling {
+		p.logger.Printf("[ZONE] %s spilling to other zones: %s", metricsPoolName(p), reason)
+	} else {
+		p.logger.Printf("[ZONE] %s back to zone %s", metricsPoolName(p), p.zone)
+	}
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zonedPool has three backends in lb's zone a and two in zone b.
+func zonedPool(t *testing.T) *Pool {
+	t.Helper()
+	pool, err := NewPool([]string{
+		"http://a1,zone=a", "http://a2,zone=a", "http://a3,zone=a",
+		"http://b1,zone=b", "http://b2,zone=b,gpu=h100",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetZone("a", DefaultZoneSpillThreshold)
+	return pool
+}
+
+func zoneCounts(got map[string]int) (local, remote int) {
+	for id, n := range got {
+		if strings.HasPrefix(id, "http://a") {
+			local += n
+		} else {
+			remote += n
+		}
+	}
+	return local, remote
+}
+
+func TestZonePreferenceAndSpillover(t *testing.T) {
+	out := captureLog(t)
+	pool := zonedPool(t)
+	a1, a2 := pool.GetBackends()[0], pool.GetBackends()[1]
+
+	if local, remote := zoneCounts(servedBy(t, pool, 30)); remote != 0 || local != 30 {
+		t.Errorf("healthy zone: %d local, %d remote; want all local", local, remote)
+	}
+
+	// 2 of 3 local backends is under the 0.7 threshold: spill.
+	a1.MarkUnhealthy()
+	if local, remote := zoneCounts(servedBy(t, pool, 30)); remote == 0 || local == 0 {
+		t.Errorf("1 of 3 local down: %d local, %d remote; want both zones", local, remote)
+	}
+	if s := pool.Stats(); s.Zone != "a" || !s.ZoneSpilling {
+		t.Errorf("stats zone %q spilling %v, want a and spilling", s.Zone, s.ZoneSpilling)
+	}
+
+	for !a1.RecordCheckSuccess() {
+	}
+	if local, remote := zoneCounts(servedBy(t, pool, 30)); remote != 0 || local != 30 {
+		t.Errorf("zone recovered: %d local, %d remote; want all local", local, remote)
+	}
+
+	// A lower threshold keeps traffic home with a backend down.
+	pool.SetZone("a", 0.5)
+	a2.MarkUnhealthy()
+	if local, remote := zoneCounts(servedBy(t, pool, 30)); remote != 0 || local != 30 {
+		t.Errorf("threshold 0.5, 1 of 3 down: %d local, %d remote; want all local", local, remote)
+	}
+
+	logs := out.String()
+	for _, want := range []string{"[ZONE] default spilling to other zones: 2 of 3 a backends selectable", "[ZONE] default back to zone a"} {
+		if strings.Count(logs, want) != 1 {
+			t.Errorf("want one %q log line:\n%s", want, logs)
+		}
+	}
+}
+
+func TestZoneSpillsWhenLocalAtCapacity(t *testing.T) {
+	pool := zonedPool(t)
+	pool.SetMaxConns(2)
+
+	var held []*Backend
+	for range 6 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Labels()["zone"] != "a" {
+			t.Fatalf("request %d went to %s before the zone was full", len(held)+1, b.ID())
+		}
+		held = append(held, b)
+	}
+	b, err := pool.SelectBackend()
+	if err != nil || b.Labels()["zone"] != "b" {
+		t.Fatalf("zone a full: got %v, %v; want a zone b backend", b, err)
+	}
+	held = append(held, b)
+	for _, b := range held {
+		b.DecrementConns()
+	}
+}
+
+func TestZoneWithinPriorityTier(t *testing.T) {
+	pool, err := NewPool([]string{"http://remote,zone=b", "http://local-backup,zone=a,priority=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetZone("a", DefaultZoneSpillThreshold)
+	if got := servedBy(t, pool, 5); got["http://remote"] != 5 {
+		t.Errorf("picks %v: a remote primary must win over a local backup", got)
+	}
+}
+
+func TestBackendLabelsInStatsAndMetrics(t *testing.T) {
+	pool := zonedPool(t)
+	bs := pool.Stats().Backends[4]
+	if bs.Labels["zone"] != "b" || bs.Labels["gpu"] != "h100" {
+		t.Errorf("stats labels = %v", bs.Labels)
+	}
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf, []*Pool{pool}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`lb_backend_requests_total{pool="default",backend="http://b2",gpu="h100",zone="b"} 0`,
+		`lb_backend_requests_total{pool="default",backend="http://a1",zone="a"} 0`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package lib
 
 import (
 	"context"
-	"log"
 	"slices"
 	"strconv"
 	"strings"
@@ -14,40 +13,55 @@ type StatusLogger struct {
 	pool     *Pool
 	interval time.Duration
 	verbose  bool
+	clock    Clock
+	logger   Logger
+
+	// request totals at the previous status line, for rates and deltas
+	lastTick     time.Time
+	lastRequests map[*Backend]uint64
 }
 
-// NewStatusLogger creates a new status logger
-func NewStatusLogger(pool *Pool, interval time.Duration, verbose bool) *StatusLogger {
+// NewStatusLogger creates a new status logger, on the pool's clock unless
+// opts give another. An interval of 0 disables periodic logging: Start
+// returns at once.
+func NewStatusLogger(pool *Pool, interval time.Duration, verbose bool, opts ...Option) *StatusLogger {
 	return &StatusLogger{
 		pool:     pool,
 		interval: interval,
 		verbose:  verbose,
+		clock:    clockFrom(pool.clock, opts),
+		logger:   loggerFrom(pool.logger, opts),
 	}
 }
 
-// Start begins periodic status logging in a background goroutine
+// Start logs the status line periodically until ctx is done or the pool is
+// closed. Run it in a goroutine of its own.
 func (sl *StatusLogger) Start(ctx context.Context) {
+	if sl.interval <= 0 {
+		return
+	}
+	ctx, cancel := sl.pool.bind(ctx)
+	defer cancel()
+	sl.snapshotRequests(sl.clock.Now())
+
 	// Delay the first status log so the initial health check can complete.
 	initialDelay := min(sl.interval, 5*time.Second)
 
-	initialTimer := time.NewTimer(initialDelay)
-	defer initialTimer.Stop()
-
 	select {
 	case <-ctx.Done():
 		return
-	case <-initialTimer.C:
+	case <-sl.clock.After(initialDelay):
 		sl.logStatus()
 	}
 
-	ticker := time.NewTicker(sl.interval)
+	ticker := sl.clock.NewTicker(sl.interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			sl.logStatus()
 		}
 	}
@@ -79,28 +93,74 @@ func joinInts(nums []int) string {
 	return strings.Join(parts, ", ")
 }
 
+// snapshotRequests records the backends' request totals at now and returns
+// the delta since the previous snapshot per backend, with the elapsed time.
+func (sl *StatusLogger) snapshotRequests(now time.Time) (map[*Backend]uint64, time.Duration) {
+	deltas := make(map[*Backend]uint64)
+	current := make(map[*Backend]uint64)
+	for _, b := range sl.pool.GetBackends() {
+		n := b.TotalRequests()
+		current[b] = n
+		deltas[b] = n - sl.lastRequests[b]
+	}
+	elapsed := now.Sub(sl.lastTick)
+	sl.lastTick, sl.lastRequests = now, current
+	return deltas, elapsed
+}
+
 // logStatus logs current status
 func (sl *StatusLogger) logStatus() {
 	totalActive, healthyCount, totalCount := sl.pool.GetStatus()
+	deltas, elapsed := sl.snapshotRequests(sl.clock.Now())
+	var total uint64
+	for _, d := range deltas {
+		total += d
+	}
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(total) / elapsed.Seconds()
+	}
 
 	// Always log summary
 	affinitySuffix := ""
 	if sl.pool.affinity != nil {
 		affinitySuffix = " | " + sl.pool.affinityStatsLine()
 	}
-	log.Printf("[STATUS] Active: %d | Healthy: %d/%d | Conns/node: %s%s",
-		totalActive, healthyCount, totalCount, connsSummary(sl.pool.GetBackends()), affinitySuffix)
+	poolPrefix := ""
+	if sl.pool.name != "" {
+		poolPrefix = "Pool: " + sl.pool.name + " | "
+	}
+	sl.logger.Printf("[STATUS] %sActive: %d | Healthy: %d/%d | Rate: %.1f req/s | Conns/node: %s%s",
+		poolPrefix, totalActive, healthyCount, totalCount, rate, connsSummary(sl.pool.GetBackends()), affinitySuffix)
 
 	// Log per-backend breakdown if verbose
 	if sl.verbose {
 		backends := sl.pool.GetBackends()
+		now := sl.clock.Now()
 		for _, backend := range backends {
-			status := "unhealthy"
-			if backend.IsHealthy() {
-				status = "healthy"
-			}
+			backend.mu.Lock()
+			status := backend.stateLocked(now, sl.pool.slowStart, sl.pool.maxConns)
 			activeConns := backend.GetActiveConns()
-			log.Printf("[STATUS]   %s - %s, %d active", backend.URL.String(), status, activeConns)
+			transition := "healthy for " + age(now.Sub(backend.changedAt))
+			if !backend.healthy {
+				transition = "unhealthy for " + age(now.Sub(backend.changedAt))
+				if backend.changeReason != "" {
+					transition += " (" + backend.changeReason + ")"
+				}
+			}
+			transition += backend.streakSummaryLocked()
+			transition += backend.probeLatencySummaryLocked()
+			switch {
+			case backend.probing:
+				transition += ", probing"
+			case !backend.nextProbe.IsZero():
+				transition += ", next probe in " + age(backend.nextProbe.Sub(now))
+			}
+			backend.mu.Unlock()
+			if status == "draining" {
+				status = "draining (" + strconv.Itoa(activeConns) + " active)"
+			}
+			sl.logger.Printf("[STATUS]   %s - %s, %d active, +%d reqs, health %s, %s", backend.ID(), status, activeConns, deltas[backend], sl.pool.shownHealthURL(backend), transition)
 		}
 	}
 }
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a log sink safe to read while the logger goroutine writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	var out syncBuffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &out
+}
+
+func TestStatusLoggerRateAndDeltas(t *testing.T) {
+	pool, err := NewPool([]string{"http://a", "http://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureLog(t)
+	clock := newFakeClock(time.Now())
+	sl := NewStatusLogger(pool, 10*time.Second, true, WithClock(clock))
+	sl.snapshotRequests(clock.Now())
+
+	a, b := pool.GetBackends()[0], pool.GetBackends()[1]
+	a.RecordCheckSuccess() // b has not been health checked
+	for range 30 {
+		a.IncrementConns()
+		a.DecrementConns()
+	}
+	for range 20 {
+		b.IncrementConns()
+		b.DecrementConns()
+	}
+	clock.advance(10 * time.Second)
+	sl.logStatus()
+
+	got := out.String()
+	for _, want := range []string{"Rate: 5.0 req/s", "http://a - healthy, 0 active, +30 reqs", "http://b - unknown, 0 active, +20 reqs"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("status output missing %q:\n%s", want, got)
+		}
+	}
+
+	// Deltas reset at each line.
+	clock.advance(10 * time.Second)
+	sl.logStatus()
+	if last := out.String()[len(got):]; !strings.Contains(last, "Rate: 0.0 req/s") || !strings.Contains(last, "+0 reqs") {
+		t.Errorf("second line should report no new requests:\n%s", last)
+	}
+}
+
+func TestStatusLoggerInterval(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureLog(t)
+
+	// interval 0: Start returns at once without logging.
+	done := make(chan struct{})
+	go func() {
+		NewStatusLogger(pool, 0, false).Start(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start with interval 0 did not return")
+	}
+	if out.String() != "" {
+		t.Fatalf("interval 0 logged:\n%s", out)
+	}
+
+	// A 20ms interval logs about once per 20ms (first line after one
+	// interval, then on every tick).
+	ctx, cancel := context.WithTimeout(context.Background(), 110*time.Millisecond)
+	defer cancel()
+	NewStatusLogger(pool, 20*time.Millisecond, false).Start(ctx)
+	if n := strings.Count(out.String(), "[STATUS]"); n < 3 || n > 6 {
+		t.Errorf("%d status lines in 110ms at a 20ms interval, want about 5", n)
+	}
+}
@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prometheus metrics (/metrics): rendered from the same snapshot as /stats.
+// A scrape must never slow down proxying, so it reads the counters as
+// atomics, copies each backend's state fields under that backend's lock for
+// the copy only, renders into a private buffer, and writes to the scraper
+// only after every lock is released. Rendering stops at the scrape timeout:
+// the payload is then partial and lb_metrics_truncated is 1.
+
+// metricFamily is one metric rendered per backend.
+type metricFamily struct {
+	name, kind, help string
+	// samples emits the backend's samples
+	samples func(bs *BackendStats, r *metricsRenderer)
+}
+
+// metricsRenderer appends sample lines for the current family and backend.
+type metricsRenderer struct {
+	buf    []byte
+	name   string
+	labels string // `{pool="...",backend="..."[,label="..."]`
+}
+
+// emit appends one sample with extra labels (e.g. `,class="2xx"`).
+func (r *metricsRenderer) emit(extra string, v float64) {
+	r.emitSuffixed("", extra, v)
+}
+
+// emitSuffixed is emit for the family's name with suffix (e.g. "_count").
+func (r *metricsRenderer) emitSuffixed(suffix, extra string, v float64) {
+	r.buf = append(r.buf, r.name...)
+	r.buf = append(r.buf, suffix...)
+	r.buf = append(r.buf, r.labels...)
+	r.buf = append(r.buf, extra...)
+	r.buf = append(r.buf, "} "...)
+	r.buf = strconv.AppendFloat(r.buf, v, 'g', -1, 64)
+	r.buf = append(r.buf, '\n')
+}
+
+// emitSummary appends the quantiles, sum and count of l, in seconds, if
+// anything was recorded.
+func (r *metricsRenderer) emitSummary(l *LatencyStats) {
+	if l == nil {
+		return
+	}
+	for i, ms := range []float64{l.P50Ms, l.P90Ms, l.P99Ms, l.P999Ms} {
+		r.emit(`,quantile="`+strconv.FormatFloat(latencyQuantiles[i], 'g', -1, 64)+`"`, ms/1000)
+	}
+	r.emitSuffixed("_sum", "", l.SumMs/1000)
+	r.emitSuffixed("_count", "", float64(l.Count))
+}
+
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+var backendMetrics = []metricFamily{
+	{"lb_backend_up", "gauge", "Whether the backend is selectable (healthy, slow-start, at capacity or unknown).",
+		func(bs *BackendStats, r *metricsRenderer) {
+			r.emit("", boolValue(bs.State == "healthy" || bs.State == "slow-start" || bs.State == "at capacity" || bs.State == "unknown"))
+		}},
+	{"lb_backend_healthy", "gauge", "Whether the backend passes health checks.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", boolValue(bs.Healthy)) }},
+	{"lb_backend_active_connections", "gauge", "Requests in flight to the backend.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.ActiveConns)) }},
+	{"lb_backend_requests_total", "counter", "Requests sent to the backend.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.Requests)) }},
+	{"lb_backend_responses_total", "counter", "Final upstream responses by status class.",
+		func(bs *BackendStats, r *metricsRenderer) {
+			for _, class := range []string{"1xx", "2xx", "3xx", "4xx", "5xx"} {
+				if n, ok := bs.Responses[class]; ok {
+					r.emit(`,class="`+class+`"`, float64(n))
+				}
+			}
+		}},
+	{"lb_backend_latency_ewma_seconds", "gauge", "Smoothed time to response headers.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", bs.LatencyEWMAMs/1000) }},
+	{"lb_backend_request_duration_seconds", "summary", "Request durations, arrival to end of response, estimated from a log-bucketed histogram.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emitSummary(bs.Latency) }},
+	{"lb_backend_client_cancellations_total", "counter", "Requests their clients cancelled while the backend served them.",
+		func(bs *BackendStats, r *metricsRenderer) {
+			var n uint64
+			if bs.Cancelled != nil {
+				n = bs.Cancelled.Count
+			}
+			r.emit("", float64(n))
+		}},
+	{"lb_backend_cancelled_request_duration_seconds", "summary", "How long the backend had served requests their clients cancelled, estimated from a log-bucketed histogram.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emitSummary(bs.Cancelled) }},
+	{"lb_backend_sent_bytes_total", "counter", "Request body bytes sent to the backend.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.Traffic.BytesSent)) }},
+	{"lb_backend_received_bytes_total", "counter", "Response body bytes received from the backend.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.Traffic.BytesReceived)) }},
+	{"lb_backend_ejections_total", "counter", "Outlier ejections of the backend.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.Ejections)) }},
+	{"lb_backend_conn_limit", "gauge", "Adaptive concurrency limit (--adaptive-conns).",
+		func(bs *BackendStats, r *metricsRenderer) {
+			if bs.ConnLimit != nil {
+				r.emit("", float64(bs.ConnLimit.Limit))
+			}
+		}},
+	{"lb_backend_tokens_per_second", "gauge", "Decaying rate of reported usage tokens (--routing least-tokens).",
+		func(bs *BackendStats, r *metricsRenderer) {
+			if bs.TokensPerSec != nil {
+				r.emit("", *bs.TokensPerSec)
+			}
+		}},
+	{"lb_backend_reported_load", "gauge", "Load the backend last reported in its health response, while fresh (--routing least-reported-load).",
+		func(bs *BackendStats, r *metricsRenderer) {
+			if bs.ReportedLoad != nil {
+				r.emit("", *bs.ReportedLoad)
+			}
+		}},
+	{"lb_backend_outstanding_bytes", "gauge", "Response bytes still in flight to clients (--routing outstanding-bytes).",
+		func(bs *BackendStats, r *metricsRenderer) {
+			if bs.OutstandingBytes != nil {
+				r.emit("", float64(*bs.OutstandingBytes))
+			}
+		}},
+	{"lb_backend_startup_failed", "gauge", "Whether the backend did not become ready within --startup-grace (until it does).",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", boolValue(bs.StartupFailed)) }},
+	{"lb_backend_header_limit_violations_total", "counter", "Responses over the response header limits.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.HeaderLimitViolations)) }},
+	{"lb_backend_timeouts_total", "counter", "Requests that ran out of time at the backend (answered 504 or cut off).",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(bs.Timeouts)) }},
+	{"lb_backend_health_check_duration_seconds", "gauge", "Duration of the backend's last health check.",
+		func(bs *BackendStats, r *metricsRenderer) {
+			if bs.ProbeLatency != nil {
+				r.emit("", bs.ProbeLatency.LastMs/1000)
+			}
+		}},
+	{"lb_backend_slow_health_checks_total", "counter", "Passing health checks slower than --health-latency-warn.",
+		func(bs *BackendStats, r *metricsRenderer) {
+			var n uint64
+			if bs.ProbeLatency != nil {
+				n = bs.ProbeLatency.SlowChecks
+			}
+			r.emit("", float64(n))
+		}},
+	{"lb_backend_connections_opened_total", "counter", "New connections requests were sent to the backend on.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(connStat(bs).Opened)) }},
+	{"lb_backend_connections_rotated_total", "counter", "Reused connections retired before use (--backend-conn-max-lifetime, --backend-conn-max-idle, or after a reset).",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(connStat(bs).Rotated)) }},
+	{"lb_backend_connection_reset_retries_total", "counter", "Requests retried on a new connection after a reset on a reused one.",
+		func(bs *BackendStats, r *metricsRenderer) { r.emit("", float64(connStat(bs).ResetRetries)) }},
+}
+
+// connStat returns bs's connection churn, zero before its first connection.
+func connStat(bs *BackendStats) ConnStats {
+	if bs.Connections == nil {
+		return ConnStats{}
+	}
+	return *bs.Connections
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsPoolName labels an unnamed (single, --backends) pool.
+func metricsPoolName(p *Pool) string {
+	if p.name == "" {
+		return "default"
+	}
+	return p.name
+}
+
+// metricsDeadlineEvery is how many samples are rendered between deadline
+// checks.
+const metricsDeadlineEvery = 64
+
+// WriteMetrics writes the pools' metrics in the Prometheus text format,
+// giving up on rendering after timeout (0 = no limit).
+func WriteMetrics(w io.Writer, pools []*Pool, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	expired := func() bool { return !deadline.IsZero() && time.Now().After(deadline) }
+
+	truncated := false
+	type backendLabels struct {
+		bs     *BackendStats
+		labels string // `{pool="...",backend="..."[,label="..."]`
+	}
+	var backends []backendLabels
+	var queued, panicking, cancellations, reaped []string
+	for _, p := range pools {
+		if expired() {
+			truncated = true
+			break
+		}
+		s := p.Stats()
+		pool := labelEscaper.Replace(metricsPoolName(p))
+		queued = append(queued, `lb_pool_queued{pool="`+pool+`"} `+strconv.Itoa(s.Queued)+"\n")
+		panicking = append(panicking, `lb_pool_panic_mode{pool="`+pool+`"} `+strconv.Itoa(int(boolValue(s.PanicMode)))+"\n")
+		cancellations = append(cancellations, `lb_pool_cancellation_ratio{pool="`+pool+`"} `+strconv.FormatFloat(s.CancellationRate, 'g', -1, 64)+"\n")
+		reaped = append(reaped, `lb_pool_requests_reaped_total{pool="`+pool+`"} `+strconv.FormatUint(s.ReapedRequests, 10)+"\n")
+		for i := range s.Backends {
+			labels := `{pool="` + pool + `",backend="` + labelEscaper.Replace(s.Backends[i].URL) + `"`
+			for _, key := range slices.Sorted(maps.Keys(s.Backends[i].Labels)) {
+				labels += `,` + key + `="` + labelEscaper.Replace(s.Backends[i].Labels[key]) + `"`
+			}
+			backends = append(backends, backendLabels{&s.Backends[i], labels})
+		}
+	}
+
+	// ~100 bytes a sample; growing the buffer dominated the scrape cost
+	r := &metricsRenderer{buf: make([]byte, 0, 128*len(backendMetrics)*(len(backends)+1))}
+	if !truncated {
+		r.buf = append(r.buf, "# HELP lb_pool_queued Requests waiting in the admission queue.\n# TYPE lb_pool_queued gauge\n"...)
+		for _, line := range queued {
+			r.buf = append(r.buf, line...)
+		}
+		r.buf = append(r.buf, "# HELP lb_pool_panic_mode Whether selection ignores health (--panic-mode-threshold).\n# TYPE lb_pool_panic_mode gauge\n"...)
+		for _, line := range panicking {
+			r.buf = append(r.buf, line...)
+		}
+		r.buf = append(r.buf, "# HELP lb_pool_cancellation_ratio Share of the backends' requests their clients cancelled.\n# TYPE lb_pool_cancellation_ratio gauge\n"...)
+		for _, line := range cancellations {
+			r.buf = append(r.buf, line...)
+		}
+		r.buf = append(r.buf, "# HELP lb_pool_requests_reaped_total Requests cut off at a backend for exceeding --max-request-age.\n# TYPE lb_pool_requests_reaped_total counter\n"...)
+		for _, line := range reaped {
+			r.buf = append(r.buf, line...)
+		}
+	}
+	var rendered int
+	for _, f := range backendMetrics {
+		if truncated {
+			break // out of time already taking the snapshots
+		}
+		r.buf = fmt.Appendf(r.buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		r.name = f.name
+		for _, b := range backends {
+			if rendered++; rendered%metricsDeadlineEvery == 0 && expired() {
+				truncated = true
+				break
+			}
+			r.labels = b.labels
+			f.samples(b.bs, r)
+		}
+	}
+	r.buf = fmt.Appendf(r.buf, "# HELP lb_metrics_truncated Whether this scrape hit the scrape timeout and is partial.\n# TYPE lb_metrics_truncated gauge\nlb_metrics_truncated %d\n", int(boolValue(truncated)))
+
+	_, err := w.Write(r.buf)
+	return err
+}
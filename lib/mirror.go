@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request mirroring (--mirror): a sample of a pool's requests
+// (--mirror-percent) is also sent to a shadow target, e.g. a canary build,
+// from its own goroutine. The client only ever sees the primary response;
+// the mirror's is read to the end and discarded, its status class and
+// latency counted in /stats. A sampled request's body is buffered for the
+// copy, up to --mirror-max-body (a larger one is not mirrored), and put back
+// for the primary. At most --mirror-max-concurrent copies are in flight per
+// pool: a sample beyond that is skipped, never queued, so a slow canary
+// cannot pile up goroutines. Copies carry X-Mirrored: true, and a request
+// that already does is not mirrored again. The pool's request timeout, if
+// any, bounds each copy.
+
+const mirrorHeader = "X-Mirrored"
+
+// MirrorConfig configures request mirroring.
+type MirrorConfig struct {
+	// Target is the URL copies are sent to; a path prefixes the request's,
+	// as for backends.
+	Target string
+	// Percent is the share of requests mirrored, 0-100.
+	Percent float64
+	// MaxBody is the largest request body mirrored.
+	MaxBody int64
+	// MaxConcurrent bounds the copies in flight.
+	MaxConcurrent int
+}
+
+type mirror struct {
+	cfg    MirrorConfig
+	target *url.URL
+	client *http.Client
+	// slots holds a token per copy in flight
+	slots chan struct{}
+	clock Clock
+
+	sent, skipped, tooLarge, failed atomic.Uint64
+	// responses by status class, as for backends
+	responses [6]atomic.Uint64
+
+	mu          sync.Mutex
+	latencyEWMA time.Duration
+}
+
+// SetMirror enables request mirroring. Copies go through the pool's
+// transport, so call it after SetTransport. Call before serving traffic.
+func (p *Pool) SetMirror(cfg MirrorConfig) error {
+	id, err := NormalizeBackendURL(cfg.Target)
+	if err != nil {
+		return fmt.Errorf("mirror target: %w", err)
+	}
+	target, _ := url.Parse(id)
+	p.mirror = &mirror{
+		cfg:    cfg,
+		target: target,
+		client: &http.Client{
+			Transport: p.transport,
+			// Like the proxy, pass redirects through rather than follow them
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		slots: make(chan struct{}, max(1, cfg.MaxConcurrent)),
+		clock: p.clock,
+	}
+	return nil
+}
+
+// mirrorRequest sends a copy of r to the mirror if r is sampled and a slot
+// is free. Only the body buffering happens on the caller's goroutine.
+func (p *Pool) mirrorRequest(r *http.Request) {
+	m := p.mirror
+	if m == nil || r.Header.Get(mirrorHeader) != "" || rand.Float64()*100 >= m.cfg.Percent { // #nosec G404 -- sampling, not security-sensitive
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.skipped.Add(1)
+		return
+	}
+	body, ok := m.bufferBody(r)
+	if !ok {
+		<-m.slots
+		return
+	}
+
+	out := r.Clone(context.Background())
+	(&httputil.ProxyRequest{In: r, Out: out}).SetURL(m.target)
+	out.RequestURI = ""
+	out.Header.Set(mirrorHeader, "true")
+	out.Body, out.ContentLength = http.NoBody, 0
+	if len(body) > 0 {
+		out.Body, out.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+	}
+	m.sent.Add(1)
+	go m.send(out, p.requestTimeout)
+}
+
+// bufferBody reads r's body for the copy and puts it back for the primary,
+// which sees the same bytes and the same read error, if any. ok is false
+// when the body is too large to mirror or could not be read.
+func (m *mirror) bufferBody(r *http.Request) (body []byte, ok bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.cfg.MaxBody {
+		m.tooLarge.Add(1)
+		return nil, false
+	}
+	orig := r.Body
+	body, err := io.ReadAll(io.LimitReader(orig, m.cfg.MaxBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), orig), orig}
+	if int64(len(body)) > m.cfg.MaxBody {
+		m.tooLarge.Add(1)
+		return nil, false
+	}
+	return body, err == nil
+}
+
+// send performs one copy and releases its slot.
+func (m *mirror) send(req *http.Request, timeout time.Duration) {
+	defer func() { <-m.slots }()
+	ctx := req.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := m.clock.Now()
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		m.failed.Add(1)
+		return
+	}
+	latency := m.clock.Now().Sub(start)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if class := resp.StatusCode / 100; class >= 1 && class <= 5 {
+		m.responses[class].Add(1)
+	}
+	m.mu.Lock()
+	if m.latencyEWMA == 0 {
+		m.latencyEWMA = latency
+	} else {
+		m.latencyEWMA += time.Duration(latencyEWMAAlpha * float64(latency-m.latencyEWMA))
+	}
+	m.mu.Unlock()
+}
+
+// MirrorStats is the pool's request mirroring in /stats.
+type MirrorStats struct {
+	Target  string  `json:"target"`
+	Percent float64 `json:"percent"`
+	// Sent counts copies started; Skipped, samples dropped at the
+	// concurrency limit; TooLarge, samples whose body was over the cap;
+	// Errors, copies that got no response.
+	Sent     uint64 `json:"sent"`
+	Skipped  uint64 `json:"skipped,omitempty"`
+	TooLarge uint64 `json:"too_large,omitempty"`
+	Errors   uint64 `json:"errors,omitempty"`
+	InFlight int    `json:"in_flight"`
+	// Responses counts the mirror's responses by status class.
+	Responses map[string]uint64 `json:"responses,omitempty"`
+	// LatencyEWMAMs is the mirror's smoothed time to response headers.
+	LatencyEWMAMs float64 `json:"latency_ewma_ms"`
+}
+
+func (m *mirror) stats() *MirrorStats {
+	s := &MirrorStats{
+		Target:   m.target.String(),
+		Percent:  m.cfg.Percent,
+		Sent:     m.sent.Load(),
+		Skipped:  m.skipped.Load(),
+		TooLarge: m.tooLarge.Load(),
+		Errors:   m.failed.Load(),
+		InFlight: len(m.slots),
+	}
+	for class := range m.responses {
+		if n := m.responses[class].Load(); n > 0 {
+			if s.Responses == nil {
+				s.Responses = make(map[string]uint64)
+			}
+			s.Responses[strconv.Itoa(class)+"xx"] = n
+		}
+	}
+	m.mu.Lock()
+	s.LatencyEWMAMs = float64(m.latencyEWMA) / float64(time.Millisecond)
+	m.mu.Unlock()
+	return s
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoServer answers with the request path and body.
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.URL.Path + ":" + string(body)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func mirroredPool(t *testing.T, primary, canary string, cfg MirrorConfig) *Pool {
+	t.Helper()
+	pool, err := NewPool([]string{primary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Target = canary
+	if err := pool.SetMirror(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// waitMirrorIdle waits for the pool's copies in flight to finish.
+func waitMirrorIdle(t *testing.T, pool *Pool) *MirrorStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := pool.Stats().Mirror
+		if s.InFlight == 0 {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d mirrored requests still in flight", s.InFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMirrorSamplesWithoutChangingResponses(t *testing.T) {
+	primary := echoServer(t)
+	var mirrored, bad atomic.Int64
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Mirrored") != "true" || r.URL.Path != "/canary/v1/completions" || string(body) != `{"prompt":"hi"}` {
+			bad.Add(1)
+		}
+		mirrored.Add(1)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer canary.Close()
+	pool := mirroredPool(t, primary.URL, canary.URL+"/canary", MirrorConfig{Percent: 20, MaxBody: 1 << 10, MaxConcurrent: 1000})
+
+	const n = 500
+	for range n {
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"prompt":"hi"}`)))
+		if rec.Code != http.StatusOK || rec.Body.String() != `/v1/completions:{"prompt":"hi"}` {
+			t.Fatalf("primary response changed: %d %q", rec.Code, rec.Body)
+		}
+	}
+	s := waitMirrorIdle(t, pool)
+	if got := mirrored.Load(); got < n*20/100*7/10 || got > n*20/100*13/10 {
+		t.Errorf("canary got %d of %d requests, want about 20%%", got, n)
+	}
+	if bad.Load() != 0 {
+		t.Errorf("%d mirrored requests lacked the header, path or body", bad.Load())
+	}
+	if s.Sent != uint64(mirrored.Load()) || s.Responses["4xx"] != s.Sent || s.LatencyEWMAMs <= 0 {
+		t.Errorf("mirror stats %+v, canary saw %d", s, mirrored.Load())
+	}
+
+	// A request that is itself a copy is not mirrored again.
+	pool = mirroredPool(t, primary.URL, canary.URL, MirrorConfig{Percent: 100, MaxBody: 1, MaxConcurrent: 1})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Mirrored", "true")
+	pool.ServeHTTP(httptest.NewRecorder(), req)
+	if s := pool.Stats().Mirror; s.Sent != 0 {
+		t.Error("a mirrored request was mirrored again")
+	}
+}
+
+func TestMirrorNeverDelaysPrimary(t *testing.T) {
+	primary := echoServer(t)
+	release := make(chan struct{})
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer canary.Close()
+	pool := mirroredPool(t, primary.URL, canary.URL, MirrorConfig{Percent: 100, MaxBody: 1 << 10, MaxConcurrent: 2})
+
+	start := time.Now()
+	for range 5 {
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("primary: %d", rec.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("primaries took %v behind a stuck canary", elapsed)
+	}
+	if s := pool.Stats().Mirror; s.Sent != 2 || s.Skipped != 3 || s.InFlight != 2 {
+		t.Errorf("stuck canary: %+v, want 2 sent and in flight, 3 skipped", s)
+	}
+	close(release)
+	if s := waitMirrorIdle(t, pool); s.Responses["2xx"] != 2 {
+		t.Errorf("after release: %+v", s)
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	primary := echoServer(t)
+	var mirrored atomic.Int64
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored.Add(1)
+	}))
+	defer canary.Close()
+	pool := mirroredPool(t, primary.URL, canary.URL, MirrorConfig{Percent: 100, MaxBody: 8, MaxConcurrent: 4})
+
+	body := strings.Repeat("x", 100)
+	for _, length := range []int64{int64(len(body)), -1} { // declared, and chunked
+		req := httptest.NewRequest(http.MethodPost, "/big", strings.NewReader(body))
+		req.ContentLength = length
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, req)
+		if rec.Body.String() != "/big:"+body {
+			t.Errorf("content length %d: primary got %q", length, rec.Body)
+		}
+	}
+	if s := waitMirrorIdle(t, pool); s.TooLarge != 2 || s.Sent != 0 || mirrored.Load() != 0 {
+		t.Errorf("large bodies: %+v, canary saw %d", s, mirrored.Load())
+	}
+}
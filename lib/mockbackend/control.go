@@ -0,0 +1,221 @@
+package mockbackend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Introspection endpoints, for load tests that need to know what each
+// backend actually saw and to flip backends without restarting them. Their
+// own requests are not counted.
+const (
+	// StatsPath serves Stats as JSON (GET).
+	StatsPath = "/__stats"
+	// ControlPath applies a Control (POST) and answers with the new Stats.
+	ControlPath = "/__control"
+)
+
+// Stats is a mock backend's settings and request counters.
+type Stats struct {
+	Mode    string  `json:"mode"`
+	DelayMs float64 `json:"delay_ms"`
+	// HealthDelayMs is the delay of health responses.
+	HealthDelayMs float64 `json:"health_delay_ms,omitempty"`
+	FailureRate   float64 `json:"failure_rate"`
+	// Requests counts requests served, Paths the same by URL path.
+	Requests uint64            `json:"requests"`
+	Paths    map[string]uint64 `json:"paths"`
+	// Failures counts injected failures: 5xx responses and streams cut off
+	// partway. Timeouts counts requests left unanswered in timeout mode.
+	Failures uint64 `json:"failures"`
+	Timeouts uint64 `json:"timeouts"`
+	// Disconnects counts streams the client abandoned before their end.
+	Disconnects uint64 `json:"disconnects"`
+	// InFlight is the number of requests being served, MaxInFlight the
+	// most there have been at once.
+	InFlight    int `json:"in_flight"`
+	MaxInFlight int `json:"max_in_flight"`
+	// Waiting is the load health responses report, when set.
+	Waiting *int `json:"num_requests_waiting,omitempty"`
+}
+
+// Control changes a mock backend's settings; nil fields are left alone.
+type Control struct {
+	Mode *string `json:"mode,omitempty"`
+	// Delay is a duration string, e.g. "250ms".
+	Delay       *string  `json:"delay,omitempty"`
+	HealthDelay *string  `json:"health_delay,omitempty"`
+	FailureRate *float64 `json:"failure_rate,omitempty"`
+	// Waiting is reported as num_requests_waiting in health responses.
+	Waiting *int `json:"num_requests_waiting,omitempty"`
+}
+
+// counters are the request counters behind Stats.
+type counters struct {
+	mu                    sync.Mutex
+	requests              uint64
+	paths                 map[string]uint64
+	failures, timeouts    uint64
+	disconnects           uint64
+	inFlight, maxInFlight int
+}
+
+func (c *counters) begin(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths == nil {
+		c.paths = make(map[string]uint64)
+	}
+	c.requests++
+	c.paths[path]++
+	c.inFlight++
+	c.maxInFlight = max(c.maxInFlight, c.inFlight)
+}
+
+// end counts a served request's injected failure, if its status is one.
+func (c *counters) end(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	if status >= 500 {
+		c.failures++
+	}
+}
+
+// failure counts a failure injected after the status was sent.
+func (c *counters) failure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+}
+
+func (c *counters) timeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeouts++
+}
+
+func (c *counters) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnects++
+}
+
+// statusWriter records the response status for the counters.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Stats returns the backend's current settings and counters.
+func (h *Handler) Stats() Stats {
+	h.mu.Lock()
+	s := Stats{Mode: h.mode, DelayMs: float64(h.delay) / float64(time.Millisecond), HealthDelayMs: float64(h.healthDelay) / float64(time.Millisecond), FailureRate: h.failRate}
+	if h.waiting >= 0 {
+		waiting := h.waiting
+		s.Waiting = &waiting
+	}
+	h.mu.Unlock()
+
+	c := &h.counters
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.Requests, s.Failures, s.Timeouts, s.Disconnects = c.requests, c.failures, c.timeouts, c.disconnects
+	s.InFlight, s.MaxInFlight = c.inFlight, c.maxInFlight
+	s.Paths = make(map[string]uint64, len(c.paths))
+	for path, n := range c.paths {
+		s.Paths[path] = n
+	}
+	return s
+}
+
+// Apply validates ctl and then applies all of it.
+func (h *Handler) Apply(ctl Control) error {
+	if ctl.Mode != nil {
+		if err := validMode(*ctl.Mode); err != nil {
+			return err
+		}
+	}
+	var delay time.Duration
+	if ctl.Delay != nil {
+		var err error
+		if delay, err = time.ParseDuration(*ctl.Delay); err != nil || delay < 0 {
+			return fmt.Errorf("invalid delay %q", *ctl.Delay)
+		}
+	}
+	var healthDelay time.Duration
+	if ctl.HealthDelay != nil {
+		var err error
+		if healthDelay, err = time.ParseDuration(*ctl.HealthDelay); err != nil || healthDelay < 0 {
+			return fmt.Errorf("invalid health_delay %q", *ctl.HealthDelay)
+		}
+	}
+	if ctl.FailureRate != nil && (*ctl.FailureRate < 0 || *ctl.FailureRate > 1) {
+		return fmt.Errorf("failure_rate must be between 0.0 and 1.0, got %v", *ctl.FailureRate)
+	}
+	if ctl.Waiting != nil && *ctl.Waiting < 0 {
+		return fmt.Errorf("num_requests_waiting cannot be negative, got %d", *ctl.Waiting)
+	}
+
+	if ctl.Mode != nil {
+		h.SetMode(*ctl.Mode)
+	}
+	if ctl.Delay != nil {
+		h.SetDelay(delay)
+	}
+	if ctl.HealthDelay != nil {
+		h.SetHealthDelay(healthDelay)
+	}
+	if ctl.FailureRate != nil {
+		h.SetFailureRate(*ctl.FailureRate)
+	}
+	if ctl.Waiting != nil {
+		h.SetWaiting(*ctl.Waiting)
+	}
+	return nil
+}
+
+func (h *Handler) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.Stats())
+}
+
+func (h *Handler) handleControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ctl Control
+	if err := json.NewDecoder(r.Body).Decode(&ctl); err != nil {
+		http.Error(w, "invalid control request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.Apply(ctl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := h.Stats()
+	h.logf("[%d] Control: mode %s, delay %vms, failure rate %v", h.config.Port, s.Mode, s.DelayMs, s.FailureRate)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s)
+}
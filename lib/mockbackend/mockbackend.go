@@ -0,0 +1,718 @@
+// Package mockbackend is an OpenAI-compatible mock model server for testing
+// the load balancer: cmd/mock-backend serves it as a binary, and Start runs
+// it in-process for Go tests, with its mode switchable mid-test.
+//
+// Modes:
+//
+//   - "healthy": every endpoint answers normally.
+//   - "slow": the same; slowness comes from Delay (see SetDelay).
+//   - "failing": the health endpoint answers 503, everything else 500.
+//   - "flaky": like failing for a FailureRate share of requests; a failing
+//     streamed chat completion is cut off halfway instead.
+//   - "timeout": no answer until the client gives up.
+//   - "starting": every endpoint answers 503 until ReadyAfter has passed
+//     since the mode was set, then as healthy — a model server loading its
+//     weights.
+//   - "broken-health": the health endpoint answers 503, everything else
+//     normally — a broken health check on a server that still works.
+//
+// Completions and chat completions report the serving backend's port as
+// "backend_port", and how much of the request's prompt prefix it has seen
+// before (a simulated KV cache; see /prefixstats). StatsPath reports request
+// counters and ControlPath changes the mode, delay and failure rate at run
+// time.
+package mockbackend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Modes.
+const (
+	ModeHealthy      = "healthy"
+	ModeSlow         = "slow"
+	ModeFailing      = "failing"
+	ModeFlaky        = "flaky"
+	ModeTimeout      = "timeout"
+	ModeStarting     = "starting"
+	ModeBrokenHealth = "broken-health"
+)
+
+var modes = []string{ModeHealthy, ModeSlow, ModeFailing, ModeFlaky, ModeTimeout, ModeStarting, ModeBrokenHealth}
+
+// Config configures a mock backend.
+type Config struct {
+	// Port is reported as backend_port; Start sets it.
+	Port int
+	// Mode is the initial mode (default healthy).
+	Mode string
+	// Delay is the mean response delay (time to first token when
+	// streaming), jittered by 0.5-2x.
+	Delay time.Duration
+	// HealthDelay delays every health response by exactly this long.
+	HealthDelay time.Duration
+	// FailureRate is the flaky mode's share of failing requests (0-1).
+	FailureRate float64
+	// ResponseSize is the mean completion text size in bytes.
+	ResponseSize int
+	// HealthEndpoint is the health check path (default /v1/models).
+	HealthEndpoint string
+	// StreamChunks is the number of content chunks per streamed chat
+	// completion, StreamDelay the delay between them.
+	StreamChunks int
+	StreamDelay  time.Duration
+	// ReadyAfter is how long the starting mode answers 503.
+	ReadyAfter time.Duration
+	// Logf logs each request; nil logs with the standard logger.
+	Logf func(format string, args ...any)
+}
+
+// DefaultConfig returns the defaults cmd/mock-backend exposes as flag
+// values.
+func DefaultConfig() Config {
+	return Config{
+		Port:           8000,
+		Mode:           ModeHealthy,
+		FailureRate:    0.5,
+		ResponseSize:   1024,
+		HealthEndpoint: "/v1/models",
+		StreamChunks:   8,
+		StreamDelay:    50 * time.Millisecond,
+		ReadyAfter:     30 * time.Second,
+	}
+}
+
+// Validate checks the config for serving on Port.
+func (c Config) Validate() error {
+	switch {
+	case c.Port < 1 || c.Port > 65535:
+		return fmt.Errorf("invalid port %d", c.Port)
+	case c.FailureRate < 0 || c.FailureRate > 1:
+		return errors.New("failure-rate must be between 0.0 and 1.0")
+	case c.StreamChunks < 1 || c.StreamDelay < 0:
+		return errors.New("stream-chunks must be at least 1 and stream-delay non-negative")
+	}
+	return validMode(c.Mode)
+}
+
+func validMode(mode string) error {
+	for _, m := range modes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// Handler serves the mock backend's endpoints. Its mode, delay and failure
+// rate can be changed while it serves.
+type Handler struct {
+	config Config
+	mux    *http.ServeMux
+	prefix prefixTracker
+	// closed ends timeout-mode waits (Close)
+	closed    chan struct{}
+	closeOnce sync.Once
+	counters  counters
+
+	mu          sync.Mutex
+	mode        string
+	delay       time.Duration
+	healthDelay time.Duration
+	failRate    float64
+	readyAt     time.Time
+	// waiting is the load health responses report, -1 for none
+	waiting int
+}
+
+// New returns a mock backend handler for cfg, whose zero fields take
+// DefaultConfig's values.
+func New(cfg Config) *Handler {
+	def := DefaultConfig()
+	if cfg.Mode == "" {
+		cfg.Mode = def.Mode
+	}
+	if cfg.ResponseSize == 0 {
+		cfg.ResponseSize = def.ResponseSize
+	}
+	if cfg.HealthEndpoint == "" {
+		cfg.HealthEndpoint = def.HealthEndpoint
+	}
+	if cfg.StreamChunks == 0 {
+		cfg.StreamChunks = def.StreamChunks
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = log.Printf
+	}
+	h := &Handler{config: cfg, mux: http.NewServeMux(), closed: make(chan struct{}), delay: cfg.Delay, healthDelay: cfg.HealthDelay, failRate: cfg.FailureRate, waiting: -1}
+	h.SetMode(cfg.Mode)
+	h.mux.HandleFunc(cfg.HealthEndpoint, h.handleHealth)
+	h.mux.HandleFunc("/v1/completions", h.handleCompletions)
+	h.mux.HandleFunc("/v1/chat/completions", h.handleChatCompletions)
+	h.mux.HandleFunc("/prefixstats", h.handlePrefixStats)
+	h.mux.HandleFunc("/", h.handleDefault)
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case StatsPath:
+		h.handleStats(w, r)
+		return
+	case ControlPath:
+		h.handleControl(w, r)
+		return
+	}
+	h.counters.begin(r.URL.Path)
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() { h.counters.end(sw.status) }()
+	w = sw
+
+	h.mu.Lock()
+	starting, readyAt := h.mode == ModeStarting, h.readyAt
+	h.mu.Unlock()
+	if starting && time.Now().Before(readyAt) {
+		h.logf("[%d] %s: STARTING (ready in %v)", h.config.Port, r.URL.Path, time.Until(readyAt).Round(time.Second))
+		http.Error(w, "model loading", http.StatusServiceUnavailable)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// SetMode switches the mode for the next requests; setting the starting
+// mode starts its ReadyAfter anew. It panics on an unknown mode.
+func (h *Handler) SetMode(mode string) {
+	if err := validMode(mode); err != nil {
+		panic(err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mode = mode
+	if mode == ModeStarting {
+		h.readyAt = time.Now().Add(h.config.ReadyAfter)
+	}
+}
+
+// Mode returns the current mode.
+func (h *Handler) Mode() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.mode
+}
+
+// SetDelay sets the mean response delay for the next requests.
+func (h *Handler) SetDelay(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.delay = d
+}
+
+// SetHealthDelay sets the delay of the next health responses.
+func (h *Handler) SetHealthDelay(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.healthDelay = d
+}
+
+// SetWaiting makes health responses report n requests waiting, as vLLM's
+// num_requests_waiting; a negative n stops reporting.
+func (h *Handler) SetWaiting(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.waiting = max(n, -1)
+}
+
+// SetFailureRate sets the flaky mode's failure rate for the next requests.
+func (h *Handler) SetFailureRate(rate float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failRate = rate
+}
+
+// Close ends the waits of requests in timeout mode, whose connections are
+// then dropped, and cuts response delays short.
+func (h *Handler) Close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+func (h *Handler) failureRate() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failRate
+}
+
+func (h *Handler) logf(format string, args ...any) {
+	h.config.Logf(format, args...)
+}
+
+// sleep applies the jittered response delay, if any.
+func (h *Handler) sleep(r *http.Request) {
+	h.mu.Lock()
+	d := h.delay
+	h.mu.Unlock()
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-time.After(time.Duration(float64(d) * randomFactor())):
+	case <-r.Context().Done():
+	case <-h.closed:
+	}
+}
+
+// hang waits for the client to give up, or for the handler to close, which
+// drops the connection.
+func (h *Handler) hang(r *http.Request) {
+	h.counters.timeout()
+	select {
+	case <-r.Context().Done():
+	case <-h.closed:
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// Server is a mock backend running in-process.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// Start serves a mock backend for cfg on a local port until the test ends.
+// Requests are not logged unless cfg.Logf is set.
+func Start(t testing.TB, cfg Config) *Server {
+	t.Helper()
+	if cfg.Logf == nil {
+		cfg.Logf = func(string, ...any) {}
+	}
+	srv := httptest.NewUnstartedServer(nil)
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Port, _ = strconv.Atoi(port)
+	h := New(cfg)
+	srv.Config.Handler = h
+	srv.Start()
+	s := &Server{Server: srv, Handler: h}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close ends waiting requests and shuts the server down.
+func (s *Server) Close() {
+	s.Handler.Close()
+	s.Server.Close()
+}
+
+// prefixTracker simulates a prefix KV cache: it remembers the canonical text
+// of recent requests and reports how many leading characters of each new
+// request match something already "cached" on this backend. Lets tests
+// measure how well a routing mode co-locates requests that share prefixes.
+type prefixTracker struct {
+	mu           sync.Mutex
+	texts        [][]byte
+	requests     int64
+	matchedChars int64
+	totalChars   int64
+}
+
+// canonicalText mirrors the load balancer's canonicalization closely enough
+// for prefix comparison: role and content-bearing fields per message, else
+// the raw prompt, else the raw body.
+func canonicalText(body []byte) []byte {
+	var req struct {
+		Messages []struct {
+			Role             string          `json:"role"`
+			Content          json.RawMessage `json:"content"`
+			Reasoning        json.RawMessage `json:"reasoning"`
+			ReasoningContent json.RawMessage `json:"reasoning_content"`
+			ToolCalls        json.RawMessage `json:"tool_calls"`
+		} `json:"messages"`
+		Prompt json.RawMessage `json:"prompt"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body
+	}
+	if len(req.Messages) == 0 {
+		if len(req.Prompt) > 0 {
+			return req.Prompt
+		}
+		return body
+	}
+	var buf bytes.Buffer
+	for _, m := range req.Messages {
+		buf.WriteString(m.Role)
+		buf.WriteByte(0x1f)
+		if m.Reasoning != nil {
+			buf.Write(m.Reasoning)
+		} else {
+			buf.Write(m.ReasoningContent)
+		}
+		buf.WriteByte(0x1f)
+		buf.Write(m.Content)
+		buf.WriteByte(0x1f)
+		buf.Write(m.ToolCalls)
+		buf.WriteByte(0x1e)
+	}
+	return buf.Bytes()
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// observe records a request and returns how many characters of its canonical
+// text matched the longest prefix already stored here.
+func (pt *prefixTracker) observe(body []byte) (matched, total int) {
+	text := canonicalText(body)
+	total = len(text)
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for _, t := range pt.texts {
+		if n := commonPrefixLen(t, text); n > matched {
+			matched = n
+		}
+	}
+	pt.requests++
+	pt.matchedChars += int64(matched)
+	pt.totalChars += int64(total)
+	pt.texts = append(pt.texts, text)
+	if len(pt.texts) > 1024 {
+		pt.texts = pt.texts[1:]
+	}
+	return matched, total
+}
+
+// handlePrefixStats reports cumulative prefix-match statistics
+func (h *Handler) handlePrefixStats(w http.ResponseWriter, r *http.Request) {
+	h.prefix.mu.Lock()
+	requests := h.prefix.requests
+	matched := h.prefix.matchedChars
+	total := h.prefix.totalChars
+	h.prefix.mu.Unlock()
+
+	ratio := 0.0
+	if total > 0 {
+		ratio = float64(matched) / float64(total)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"requests":      requests,
+		"matched_chars": matched,
+		"total_chars":   total,
+		"ratio":         ratio,
+	})
+}
+
+// handleHealth handles health check requests
+func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	delay := h.healthDelay
+	h.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		case <-h.closed:
+		}
+	}
+
+	// Determine response based on mode
+	switch h.Mode() {
+	case "failing", "broken-health":
+		h.logf("[%d] Health check: FAILING", h.config.Port)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+
+	case "flaky":
+		if rand.Float64() < h.failureRate() { // #nosec G404 -- simulated flakiness in test backend
+			h.logf("[%d] Health check: FLAKY (failing)", h.config.Port)
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.logf("[%d] Health check: FLAKY (ok)", h.config.Port)
+
+	case "timeout":
+		h.logf("[%d] Health check: TIMEOUT (sleeping forever)", h.config.Port)
+		h.hang(r)
+		return
+
+	default:
+		h.logf("[%d] Health check: OK", h.config.Port)
+	}
+
+	// Return mock /v1/models response
+	response := map[string]any{
+		"object": "list",
+		"data": []map[string]any{
+			{
+				"id":       "mock-model",
+				"object":   "model",
+				"created":  time.Now().Unix(),
+				"owned_by": "mock-backend",
+			},
+		},
+	}
+
+	h.mu.Lock()
+	if h.waiting >= 0 {
+		response["num_requests_waiting"] = h.waiting
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// handleCompletions handles completion requests
+func (h *Handler) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	h.logf("[%d] %q %q from %s", h.config.Port, r.Method, r.URL.Path, r.RemoteAddr) // #nosec G706 -- %q escapes control characters; analyzer does not model it
+
+	body, _ := io.ReadAll(r.Body)
+	matched, total := h.prefix.observe(body)
+
+	// Apply randomized delay if configured
+	h.sleep(r)
+
+	// Determine response based on mode
+	switch h.Mode() {
+	case "failing":
+		h.logf("[%d] Completions: FAILING", h.config.Port)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+
+	case "flaky":
+		if rand.Float64() < h.failureRate() { // #nosec G404 -- simulated flakiness in test backend
+			h.logf("[%d] Completions: FLAKY (failing)", h.config.Port)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		h.logf("[%d] Completions: FLAKY (ok)", h.config.Port)
+
+	case "timeout":
+		h.logf("[%d] Completions: TIMEOUT (sleeping forever)", h.config.Port)
+		h.hang(r)
+		return
+
+	default:
+		h.logf("[%d] Completions: OK", h.config.Port)
+	}
+
+	// Generate response of randomized size
+	responseText := generateText(int(float64(h.config.ResponseSize) * randomFactor()))
+
+	response := map[string]any{
+		"id":      fmt.Sprintf("cmpl-%d", time.Now().Unix()),
+		"object":  "text_completion",
+		"created": time.Now().Unix(),
+		"model":   "mock-model",
+		"choices": []map[string]any{
+			{
+				"text":          responseText,
+				"index":         0,
+				"logprobs":      nil,
+				"finish_reason": "length",
+			},
+		},
+		"usage": map[string]int{
+			"prompt_tokens":     10,
+			"completion_tokens": len(responseText) / 4,
+			"total_tokens":      10 + len(responseText)/4,
+		},
+		"backend_port":         h.config.Port, // Include port to identify which backend responded
+		"prefix_matched_chars": matched,
+		"prefix_total_chars":   total,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// handleChatCompletions emulates the OpenAI chat endpoint. With "stream":
+// true in the body it sends stream-chunks SSE chunks stream-delay apart,
+// then "data: [DONE]"; otherwise one chat.completion object. In flaky mode a
+// failing stream sends half its chunks and then cuts the connection, so the
+// balancer's partial-response handling can be exercised.
+func (h *Handler) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	h.logf("[%d] %q %q from %s", h.config.Port, r.Method, r.URL.Path, r.RemoteAddr) // #nosec G706 -- %q escapes control characters; analyzer does not model it
+
+	body, _ := io.ReadAll(r.Body)
+	matched, total := h.prefix.observe(body)
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	_ = json.Unmarshal(body, &req)
+
+	// Apply randomized delay if configured (time to first token when streaming)
+	h.sleep(r)
+
+	cutAfter := -1 // chunk index after which a flaky stream is cut
+	switch h.Mode() {
+	case "failing":
+		h.logf("[%d] Chat: FAILING", h.config.Port)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+
+	case "flaky":
+		if rand.Float64() < h.failureRate() { // #nosec G404 -- simulated flakiness in test backend
+			if !req.Stream {
+				h.logf("[%d] Chat: FLAKY (failing)", h.config.Port)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			h.logf("[%d] Chat: FLAKY (cutting stream partway)", h.config.Port)
+			cutAfter = h.config.StreamChunks / 2
+		} else {
+			h.logf("[%d] Chat: FLAKY (ok)", h.config.Port)
+		}
+
+	case "timeout":
+		h.logf("[%d] Chat: TIMEOUT (sleeping forever)", h.config.Port)
+		h.hang(r)
+		return
+
+	default:
+		h.logf("[%d] Chat: OK", h.config.Port)
+	}
+
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	responseText := generateText(int(float64(h.config.ResponseSize) * randomFactor()))
+
+	if !req.Stream {
+		response := map[string]any{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   "mock-model",
+			"choices": []map[string]any{
+				{
+					"index":         0,
+					"message":       map[string]string{"role": "assistant", "content": responseText},
+					"finish_reason": "stop",
+				},
+			},
+			"usage": map[string]int{
+				"prompt_tokens":     10,
+				"completion_tokens": len(responseText) / 4,
+				"total_tokens":      10 + len(responseText)/4,
+			},
+			"backend_port":         h.config.Port,
+			"prefix_matched_chars": matched,
+			"prefix_total_chars":   total,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	send := func(delta map[string]string, finish any) {
+		chunk, _ := json.Marshal(map[string]any{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   "mock-model",
+			"choices": []map[string]any{
+				{"index": 0, "delta": delta, "finish_reason": finish},
+			},
+			"backend_port": h.config.Port,
+		})
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+		_ = rc.Flush()
+	}
+
+	n := h.config.StreamChunks
+	send(map[string]string{"role": "assistant"}, nil)
+	for i := range n {
+		if i == cutAfter {
+			// Abort without the terminating chunk: the client sees the
+			// connection drop mid-stream.
+			h.counters.failure()
+			panic(http.ErrAbortHandler)
+		}
+		select {
+		case <-time.After(h.config.StreamDelay):
+		case <-r.Context().Done():
+			// The client went away: stop generating, as a model server
+			// aborts the sequence.
+			h.counters.disconnect()
+			return
+		}
+		send(map[string]string{"content": responseText[i*len(responseText)/n : (i+1)*len(responseText)/n]}, nil)
+	}
+	send(map[string]string{}, "stop")
+	_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	_ = rc.Flush()
+}
+
+// handleDefault handles all other requests
+func (h *Handler) handleDefault(w http.ResponseWriter, r *http.Request) {
+	h.logf("[%d] %q %q from %s", h.config.Port, r.Method, r.URL.Path, r.RemoteAddr) // #nosec G706 -- %q escapes control characters; analyzer does not model it
+
+	// Determine response based on mode
+	switch h.Mode() {
+	case "failing":
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+
+	case "flaky":
+		if rand.Float64() < h.failureRate() { // #nosec G404 -- simulated flakiness in test backend
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+	case "timeout":
+		h.hang(r)
+		return
+	}
+
+	response := map[string]any{
+		"message":      "Mock backend server",
+		"port":         h.config.Port,
+		"path":         r.URL.Path,
+		"method":       r.Method,
+		"backend_port": h.config.Port,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// randomFactor returns a random multiplier in [0.5, 2.0].
+func randomFactor() float64 {
+	return 0.5 + rand.Float64()*1.5 // #nosec G404 -- delay jitter in test backend
+}
+
+// generateText generates text of approximately the specified size
+func generateText(size int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 "
+	result := make([]byte, size)
+	for i := range result {
+		result[i] = chars[rand.Intn(len(chars))] // #nosec G404 -- filler text in test backend
+	}
+	return string(result)
+}
@@ -0,0 +1,162 @@
+package mockbackend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// get returns the status of GET path, or 0 when the request timed out.
+func get(t *testing.T, s *Server, path string) int {
+	t.Helper()
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	resp, err := client.Get(s.URL + path)
+	if err != nil {
+		return 0
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestModes(t *testing.T) {
+	s := Start(t, Config{ReadyAfter: 100 * time.Millisecond, HealthEndpoint: "/health"})
+	for _, tt := range []struct {
+		mode                string
+		health, completions int
+	}{
+		{ModeHealthy, 200, 200},
+		{ModeSlow, 200, 200},
+		{ModeFailing, 503, 500},
+		{ModeTimeout, 0, 0},
+		{ModeBrokenHealth, 503, 200},
+		{ModeStarting, 503, 503},
+	} {
+		s.SetMode(tt.mode)
+		if got := get(t, s, "/health"); got != tt.health {
+			t.Errorf("%s: health %d, want %d", tt.mode, got, tt.health)
+		}
+		if got := get(t, s, "/v1/completions"); got != tt.completions {
+			t.Errorf("%s: completions %d, want %d", tt.mode, got, tt.completions)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := get(t, s, "/health"); got != 200 {
+		t.Errorf("starting after ReadyAfter: health %d, want 200", got)
+	}
+
+	s.SetMode(ModeFlaky)
+	s.SetFailureRate(1)
+	if got := get(t, s, "/v1/completions"); got != 500 {
+		t.Errorf("flaky at rate 1: %d, want 500", got)
+	}
+	s.SetFailureRate(0)
+	if got := get(t, s, "/v1/completions"); got != 200 {
+		t.Errorf("flaky at rate 0: %d, want 200", got)
+	}
+}
+
+func TestBackendPort(t *testing.T) {
+	s := Start(t, Config{})
+	resp, err := http.Post(s.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		BackendPort int `json:"backend_port"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(s.URL, ":"+strconv.Itoa(body.BackendPort)) {
+		t.Errorf("backend_port %d, server at %s", body.BackendPort, s.URL)
+	}
+}
+
+func TestStatsAndControl(t *testing.T) {
+	s := Start(t, Config{})
+	control := func(body string) (int, Stats) {
+		t.Helper()
+		resp, err := http.Post(s.URL+ControlPath, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var st Stats
+		_ = json.NewDecoder(resp.Body).Decode(&st)
+		return resp.StatusCode, st
+	}
+
+	get(t, s, "/v1/models")
+	get(t, s, "/v1/completions")
+	if code, st := control(`{"mode":"failing"}`); code != 200 || st.Mode != ModeFailing {
+		t.Fatalf("control: %d %+v", code, st)
+	}
+	get(t, s, "/v1/completions")
+	if code, st := control(`{"mode":"timeout","delay":"5ms","health_delay":"2ms","failure_rate":0.25,"num_requests_waiting":3}`); code != 200 || st.Mode != ModeTimeout || st.DelayMs != 5 || st.HealthDelayMs != 2 || st.FailureRate != 0.25 || st.Waiting == nil || *st.Waiting != 3 {
+		t.Fatalf("control: %d %+v", code, st)
+	}
+	get(t, s, "/v1/completions") // the client gives up after 200ms
+	for _, bad := range []string{`{"mode":"sleepy"}`, `{"delay":"soon"}`, `{"health_delay":"-1s"}`, `{"failure_rate":2}`, `{"num_requests_waiting":-1}`, `nope`} {
+		if code, _ := control(bad); code != http.StatusBadRequest {
+			t.Errorf("control %s: %d, want 400", bad, code)
+		}
+	}
+	if s.Mode() != ModeTimeout {
+		t.Errorf("a rejected control changed the mode to %s", s.Mode())
+	}
+
+	resp, err := http.Get(s.URL + StatsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st Stats
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Requests != 4 || st.Paths["/v1/completions"] != 3 || st.Paths["/v1/models"] != 1 || st.Failures != 1 || st.Timeouts != 1 || st.MaxInFlight != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	s := Start(t, Config{Delay: 50 * time.Millisecond})
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() { get(t, s, "/v1/completions") })
+	}
+	wg.Wait()
+	if st := s.Stats(); st.MaxInFlight < 2 || st.InFlight != 0 {
+		t.Errorf("in flight %d, max %d after 5 concurrent requests", st.InFlight, st.MaxInFlight)
+	}
+}
+
+func TestCloseDropsHangingRequests(t *testing.T) {
+	s := Start(t, Config{Mode: ModeTimeout})
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(s.URL + "/v1/completions")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		errc <- err
+	}()
+	for s.Stats().InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Handler.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("hanging request answered on close, want the connection dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hanging request not released by Close")
+	}
+}
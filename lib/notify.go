@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// State change hooks (Pool.OnStateChange) are told about every health
+// transition: a backend marked unhealthy by a failed request or probe, a
+// backend that did not become ready within its startup grace, and one that
+// passed enough health checks to be healthy again. Outlier ejection is not a
+// health transition (see outlier.go) and is not reported. Transitions are
+// queued and hooks run one at a time, in order, on the pool's own goroutine:
+// never under a backend lock and never on the request path. A hook that
+// falls stateEventBuffer events behind loses the newest ones.
+//
+// The webhook notifier (--notify-webhook) POSTs each transition as JSON,
+// retrying failed deliveries with exponential backoff. After a delivery, a
+// backend's further transitions within the dedupe window
+// (--notify-dedupe-window) are held back: when the window ends, only the
+// latest is sent, with the number it stands for, and nothing at all if the
+// backend flapped back to the state last sent.
+
+// stateEventBuffer is how many transitions may wait for the hooks.
+const stateEventBuffer = 1024
+
+// StateChangeFunc is a health transition hook: healthy is the backend's new
+// state, reason why it changed.
+type StateChangeFunc func(b *Backend, healthy bool, reason string)
+
+type stateEvent struct {
+	b       *Backend
+	healthy bool
+	reason  string
+}
+
+// stateHooks are a pool's hooks and the queue feeding them.
+type stateHooks struct {
+	mu     sync.Mutex
+	fns    []StateChangeFunc
+	events chan stateEvent
+	logger Logger
+}
+
+// OnStateChange registers fn to be called on every health transition of the
+// pool's backends. Call before serving traffic.
+func (p *Pool) OnStateChange(fn StateChangeFunc) {
+	if p.hooks == nil {
+		p.hooks = &stateHooks{events: make(chan stateEvent, stateEventBuffer), logger: p.logger}
+		go p.hooks.run(p.lifetime)
+		for _, b := range p.GetBackends() {
+			b.hooks = p.hooks
+		}
+	}
+	p.hooks.mu.Lock()
+	defer p.hooks.mu.Unlock()
+	p.hooks.fns = append(p.hooks.fns, fn)
+}
+
+// fire queues a transition of b for the hooks without blocking. Nil-safe.
+func (h *stateHooks) fire(b *Backend, healthy bool, reason string) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.events <- stateEvent{b, healthy, reason}:
+	default:
+		h.logger.Printf("[NOTIFY] state change hooks are behind; dropped %s -> %s", b.ID(), stateName(healthy))
+	}
+}
+
+// run calls the hooks until ctx (the pool's lifetime) is done.
+func (h *stateHooks) run(ctx context.Context) {
+	for {
+		var ev stateEvent
+		select {
+		case <-ctx.Done():
+			return
+		case ev = <-h.events:
+		}
+		h.mu.Lock()
+		fns := h.fns
+		h.mu.Unlock()
+		for _, fn := range fns {
+			h.call(fn, ev)
+		}
+	}
+}
+
+// call runs one hook, which must not take the pool down with it.
+func (h *stateHooks) call(fn StateChangeFunc, ev stateEvent) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.logger.Printf("[NOTIFY] state change hook panicked on %s: %v", ev.b.ID(), v)
+		}
+	}()
+	fn(ev.b, ev.healthy, ev.reason)
+}
+
+func stateName(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+// WebhookConfig configures the webhook notifier.
+type WebhookConfig struct {
+	// URL receives the POSTs.
+	URL string
+	// DedupeWindow holds back a backend's transitions after a delivery.
+	DedupeWindow time.Duration
+	// MaxAttempts bounds the deliveries of one notification; Backoff is the
+	// wait before the first retry, doubling after each.
+	MaxAttempts int
+	Backoff     time.Duration
+	// Timeout bounds each delivery attempt.
+	Timeout time.Duration
+}
+
+// DefaultWebhookConfig returns the defaults cmd/lb exposes as flag values.
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		DedupeWindow: time.Minute,
+		MaxAttempts:  4,
+		Backoff:      time.Second,
+		Timeout:      10 * time.Second,
+	}
+}
+
+// WebhookPayload is the JSON body of a notification.
+type WebhookPayload struct {
+	Backend   string    `json:"backend"`
+	OldState  string    `json:"old_state"`
+	NewState  string    `json:"new_state"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+	// Suppressed counts the transitions held back by the dedupe window that
+	// this one stands for.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// WebhookNotifier delivers state changes to a webhook. Its Notify is a
+// StateChangeFunc.
+type WebhookNotifier struct {
+	cfg    WebhookConfig
+	client *http.Client
+	clock  Clock
+	logger Logger
+
+	mu       sync.Mutex
+	backends map[string]*webhookBackend
+}
+
+// webhookBackend is one backend's delivery state.
+type webhookBackend struct {
+	// sent is the state last sent ("" before the first), at sentAt
+	sent   string
+	sentAt time.Time
+	// pending is the latest transition held back, standing for held
+	// transitions; flushing is set while a flush is scheduled
+	pending  *WebhookPayload
+	held     int
+	flushing bool
+}
+
+// NewWebhookNotifier returns a notifier for cfg.
+func NewWebhookNotifier(cfg WebhookConfig, opts ...Option) *WebhookNotifier {
+	return &WebhookNotifier{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		clock:    clockFrom(systemClock{}, opts),
+		logger:   loggerFrom(defaultLogger(), opts),
+		backends: make(map[string]*webhookBackend),
+	}
+}
+
+// Notify sends the transition, or holds it back inside the dedupe window.
+func (n *WebhookNotifier) Notify(b *Backend, healthy bool, reason string) {
+	now := n.clock.Now()
+	p := WebhookPayload{Backend: b.ID(), OldState: stateName(!healthy), NewState: stateName(healthy), Reason: reason, Timestamp: now}
+	n.mu.Lock()
+	s := n.backends[p.Backend]
+	if s == nil {
+		s = &webhookBackend{}
+		n.backends[p.Backend] = s
+	}
+	if s.pending == nil && (s.sent == "" || now.Sub(s.sentAt) >= n.cfg.DedupeWindow) {
+		if s.sent == p.NewState {
+			n.mu.Unlock()
+			return // the receiver already knows
+		}
+		if s.sent != "" {
+			p.OldState = s.sent
+		}
+		s.sent, s.sentAt = p.NewState, now
+		n.mu.Unlock()
+		n.send(p)
+		return
+	}
+	s.pending = &p
+	s.held++
+	if !s.flushing {
+		s.flushing = true
+		go n.flushAt(s, s.sentAt.Add(n.cfg.DedupeWindow))
+	}
+	n.mu.Unlock()
+}
+
+// flushAt sends s's latest held-back transition at t, if it changes the
+// state last sent.
+func (n *WebhookNotifier) flushAt(s *webhookBackend, t time.Time) {
+	<-n.clock.After(t.Sub(n.clock.Now()))
+	n.mu.Lock()
+	p, held := *s.pending, s.held
+	s.pending, s.held, s.flushing = nil, 0, false
+	if p.NewState == s.sent {
+		n.mu.Unlock()
+		n.logger.Printf("[NOTIFY] %s changed state %d times within %v, back to %s; not notified", p.Backend, held, n.cfg.DedupeWindow, p.NewState)
+		return
+	}
+	p.OldState, p.Suppressed = s.sent, held-1
+	s.sent, s.sentAt = p.NewState, n.clock.Now()
+	n.mu.Unlock()
+	n.send(p)
+}
+
+// send delivers p, retrying with backoff.
+func (n *WebhookNotifier) send(p WebhookPayload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		n.logger.Printf("[BUG] webhook payload for %s: %v", p.Backend, err)
+		return
+	}
+	backoff := n.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= n.cfg.MaxAttempts {
+			n.logger.Printf("[NOTIFY] webhook for %s %s -> %s failed after %d attempt(s): %v", p.Backend, p.OldState, p.NewState, attempt, err)
+			return
+		}
+		<-n.clock.After(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt. retry is false for a rejection that
+// would recur: a 4xx other than 429.
+func (n *WebhookNotifier) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return true, fmt.Errorf("status %d", resp.StatusCode)
+}
@@ -0,0 +1,183 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stateChange struct {
+	healthy bool
+	reason  string
+}
+
+func TestStateChangeHooks(t *testing.T) {
+	captureLog(t)
+	var failing atomic.Bool
+	failing.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	pool, err := NewPool([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan stateChange, 10)
+	pool.OnStateChange(func(b *Backend, healthy bool, reason string) {
+		b.IsHealthy() // would deadlock under the backend lock
+		changes <- stateChange{healthy, reason}
+	})
+	next := func() stateChange {
+		t.Helper()
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("no state change")
+			return stateChange{}
+		}
+	}
+
+	// The proxy marks it down...
+	pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if c := next(); c.healthy || c.reason != "status: 500" {
+		t.Errorf("proxy failure: %+v", c)
+	}
+	// ...and health checks bring it back.
+	failing.Store(false)
+	hc := NewHealthChecker(pool, WithInterval(time.Second))
+	b := pool.GetBackends()[0]
+	hc.checkBackend(context.Background(), b)
+	hc.checkBackend(context.Background(), b)
+	if c := next(); !c.healthy || c.reason != "health checks passing" {
+		t.Errorf("recovery: %+v", c)
+	}
+	// A backend added later is covered too.
+	added, err := pool.AddBackend("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.checkBackend(context.Background(), added)
+	if c := next(); c.healthy {
+		t.Errorf("added backend: %+v", c)
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change %+v", c)
+	default:
+	}
+}
+
+// webhookReceiver records the payloads POSTed to it, answering each with
+// the next of statuses (then 200).
+func webhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, chan WebhookPayload) {
+	t.Helper()
+	payloads := make(chan WebhookPayload, 10)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		if i := int(n.Add(1)) - 1; i < len(statuses) {
+			w.WriteHeader(statuses[i])
+			return
+		}
+		payloads <- p
+	}))
+	t.Cleanup(srv.Close)
+	return srv, payloads
+}
+
+func TestWebhookDedupe(t *testing.T) {
+	out := captureLog(t)
+	srv, payloads := webhookReceiver(t)
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	cfg := DefaultWebhookConfig()
+	cfg.URL = srv.URL
+	n := NewWebhookNotifier(cfg, WithClock(clock))
+	b, _ := NewBackend("http://gpu-1:8000")
+	expect := func(old, new, reason string, suppressed int) {
+		t.Helper()
+		select {
+		case p := <-payloads:
+			if p.Backend != b.ID() || p.OldState != old || p.NewState != new || p.Reason != reason || p.Suppressed != suppressed || p.Timestamp.IsZero() {
+				t.Errorf("payload %+v, want %s -> %s (%s), %d suppressed", p, old, new, reason, suppressed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no payload for %s -> %s", old, new)
+		}
+	}
+
+	n.Notify(b, false, "status: 503")
+	expect("healthy", "unhealthy", "status: 503", 0)
+
+	// Flapping inside the window: only the latest state, at its end.
+	n.Notify(b, true, "health checks passing")
+	n.Notify(b, false, "status: 502")
+	clock.advance(10 * time.Second)
+	n.Notify(b, true, "health checks passing")
+	clock.blockUntil(t, 1)
+	clock.advance(50 * time.Second)
+	expect("unhealthy", "healthy", "health checks passing", 2)
+
+	// Flapping back to the state last sent: nothing.
+	n.Notify(b, false, "status: 500")
+	n.Notify(b, true, "health checks passing")
+	clock.blockUntil(t, 1)
+	clock.advance(time.Minute)
+	// The flush logs the flap instead of sending: once logged, nothing can
+	// follow.
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), "changed state 2 times"); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("flap not logged:\n%s", out)
+		}
+	}
+	select {
+	case p := <-payloads:
+		t.Errorf("flap back to the sent state notified: %+v", p)
+	default:
+	}
+
+	// After a quiet window, a transition goes out at once.
+	clock.advance(time.Minute)
+	n.Notify(b, false, "status: 500")
+	expect("healthy", "unhealthy", "status: 500", 0)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	out := captureLog(t)
+	cfg := DefaultWebhookConfig()
+	cfg.Backoff = time.Millisecond
+	b, _ := NewBackend("http://gpu-1:8000")
+
+	srv, payloads := webhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	cfg.URL = srv.URL
+	NewWebhookNotifier(cfg).Notify(b, false, "status: 500")
+	select {
+	case <-payloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not delivered on the third attempt")
+	}
+
+	// A 4xx is not retried.
+	srv, payloads = webhookReceiver(t, http.StatusBadRequest)
+	cfg.URL = srv.URL
+	NewWebhookNotifier(cfg).Notify(b, false, "status: 500")
+	select {
+	case p := <-payloads:
+		t.Errorf("400 retried: %+v", p)
+	default:
+	}
+	if !strings.Contains(out.String(), "failed after 1 attempt(s): status 400") {
+		t.Errorf("rejection not logged:\n%s", out)
+	}
+}
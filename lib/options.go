@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Embedding: lib's constructors take functional options. WithClock and
+// WithLogger apply to every component; the others to the constructor they
+// are named for (WithStrategy to NewPool, WithInterval to NewHealthChecker,
+// ...) and are ignored by the rest. Components built on a pool (its
+// backends, health checker, status logger, outlier detector, discoverer)
+// default to the pool's clock and logger. Nothing in lib logs through the
+// standard logger except by default: embedders route lb's tagged lines
+// ("[HEALTH] ...", "[PROXY] ...") into their own logging with WithLogger.
+// Pool.Close stops the pool's background goroutines.
+
+// Logger receives lib's log lines. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures a component at construction.
+type Option func(*options)
+
+type options struct {
+	clock  Clock
+	logger Logger
+
+	// NewPool
+	strategy    Strategy
+	maxConns    int
+	affinityTTL time.Duration
+	prefixHash  PrefixHashConfig
+	reportedPtr string
+	transport   *http.Transport
+
+	// NewHealthChecker
+	interval          time.Duration
+	unhealthyInterval time.Duration
+	probeTimeout      time.Duration
+	path              string
+}
+
+func applyOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger makes a component log to l instead of log.Default().
+func WithLogger(l Logger) Option {
+	return func(o *options) { o.logger = l }
+}
+
+// loggerFrom returns the logger opts give, def without one.
+func loggerFrom(def Logger, opts []Option) Logger {
+	if l := applyOptions(opts).logger; l != nil {
+		return l
+	}
+	return def
+}
+
+// Strategy is how a pool picks a backend for a request.
+type Strategy string
+
+const (
+	// StrategyLeastConn picks the backend with the fewest active requests.
+	StrategyLeastConn Strategy = "least-conn"
+	// StrategyLeastTokens weighs active requests by reported token usage
+	// (see tokenload.go).
+	StrategyLeastTokens Strategy = "least-tokens"
+	// StrategyCacheAware routes by prompt prefix affinity (see
+	// cacheaware.go); it needs WithMaxConns.
+	StrategyCacheAware Strategy = "cache-aware"
+	// StrategyPrefixHash routes by a hash of the prompt's start on a
+	// consistent-hash ring (see prefixhash.go).
+	StrategyPrefixHash Strategy = "prefix-hash"
+	// StrategyLeastReportedLoad weighs active requests by the load backends
+	// report in their health responses (see reportedload.go).
+	StrategyLeastReportedLoad Strategy = "least-reported-load"
+	// StrategyOutstandingBytes prefers the backend with the fewest response
+	// bytes still in flight (see outbytes.go).
+	StrategyOutstandingBytes Strategy = "outstanding-bytes"
+)
+
+// DefaultAffinityTTL is how long cache-aware routing remembers a prefix
+// unless WithAffinityTTL gives another.
+const DefaultAffinityTTL = time.Hour
+
+// WithStrategy sets a pool's routing strategy (default least-conn).
+func WithStrategy(s Strategy) Option {
+	return func(o *options) { o.strategy = s }
+}
+
+// WithMaxConns caps each backend of a pool at n concurrent requests (0 =
+// unlimited).
+func WithMaxConns(n int) Option {
+	return func(o *options) { o.maxConns = n }
+}
+
+// WithAffinityTTL sets how long cache-aware routing remembers a prefix.
+func WithAffinityTTL(d time.Duration) Option {
+	return func(o *options) { o.affinityTTL = d }
+}
+
+// WithPrefixHash configures prefix-hash routing (default
+// PrefixHashConfig{}).
+func WithPrefixHash(cfg PrefixHashConfig) Option {
+	return func(o *options) { o.prefixHash = cfg }
+}
+
+// WithReportedLoadPointer sets the JSON pointer reported-load routing reads
+// from health responses (default DefaultReportedLoadPointer).
+func WithReportedLoadPointer(ptr string) Option {
+	return func(o *options) { o.reportedPtr = ptr }
+}
+
+// WithTransport makes a pool proxy to and probe its backends through t, as
+// Pool.SetTransport.
+func WithTransport(t *http.Transport) Option {
+	return func(o *options) { o.transport = t }
+}
+
+// applyPoolOptions sets up a new pool's strategy and transport.
+func (p *Pool) applyPoolOptions(o options) error {
+	if o.maxConns < 0 {
+		return fmt.Errorf("max conns cannot be negative, got %d", o.maxConns)
+	}
+	if o.transport != nil {
+		p.SetTransport(o.transport)
+	}
+	switch o.strategy {
+	case "", StrategyLeastConn, StrategyLeastTokens, StrategyOutstandingBytes:
+		switch o.strategy {
+		case StrategyLeastTokens:
+			p.EnableLeastTokens()
+		case StrategyOutstandingBytes:
+			p.EnableOutstandingBytes()
+		}
+		p.SetMaxConns(o.maxConns)
+	case StrategyPrefixHash:
+		if err := p.EnablePrefixHash(o.prefixHash); err != nil {
+			return err
+		}
+		p.SetMaxConns(o.maxConns)
+	case StrategyLeastReportedLoad:
+		if err := p.EnableReportedLoad(o.reportedPtr); err != nil {
+			return err
+		}
+		p.SetMaxConns(o.maxConns)
+	case StrategyCacheAware:
+		if o.maxConns == 0 {
+			return fmt.Errorf("cache-aware routing requires max conns > 0 (its load guard and cache retention are scaled by it)")
+		}
+		if o.affinityTTL < 0 {
+			return fmt.Errorf("affinity TTL must be positive, got %v", o.affinityTTL)
+		}
+		ttl := o.affinityTTL
+		if ttl == 0 {
+			ttl = DefaultAffinityTTL
+		}
+		p.EnableCacheAware(ttl, o.maxConns)
+	default:
+		return fmt.Errorf("routing must be least-conn, cache-aware, least-tokens, prefix-hash, least-reported-load or outstanding-bytes, got %q", o.strategy)
+	}
+	return nil
+}
+
+// DefaultHealthCheckInterval is how often a HealthChecker probes unless
+// WithInterval gives another.
+const DefaultHealthCheckInterval = 30 * time.Second
+
+// DefaultUnhealthyCheckInterval is how often a HealthChecker probes an
+// unhealthy backend unless WithUnhealthyInterval gives another.
+const DefaultUnhealthyCheckInterval = 5 * time.Second
+
+// WithInterval sets how often a HealthChecker probes every healthy backend.
+func WithInterval(d time.Duration) Option {
+	return func(o *options) { o.interval = d }
+}
+
+// WithUnhealthyInterval sets how often a HealthChecker probes an unhealthy
+// backend, for noticing its recovery. It is capped at the healthy interval.
+func WithUnhealthyInterval(d time.Duration) Option {
+	return func(o *options) { o.unhealthyInterval = d }
+}
+
+// WithProbeTimeout bounds each probe of a HealthChecker instead of the
+// timeout derived from its interval.
+func WithProbeTimeout(d time.Duration) Option {
+	return func(o *options) { o.probeTimeout = d }
+}
+
+// WithPath makes a HealthChecker probe path under each backend's URL, as
+// Pool.SetHealthPath. path must start with /.
+func WithPath(path string) Option {
+	return func(o *options) { o.path = path }
+}
+
+// Close stops the pool's background goroutines: its state change hooks and
+// the loops of the health checkers, status loggers, outlier detectors and
+// discoverers built on it, as if their contexts were cancelled. It does not
+// stop serving; shut the http.Server down first. Close always returns nil.
+func (p *Pool) Close() error {
+	p.close()
+	return nil
+}
+
+// bind returns a context cancelled with ctx or when the pool is closed.
+func (p *Pool) bind(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(p.lifetime, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// defaultLogger is the logger of components given none.
+func defaultLogger() Logger {
+	return log.Default()
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineLogger is a Logger keeping what it is given.
+type lineLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *lineLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *lineLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestWithLoggerReplacesStandardLogger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	std := captureLog(t)
+	var logger lineLogger
+	pool, err := NewPool([]string{srv.URL}, WithLogger(&logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	for range 3 {
+		hc.checkAll(context.Background())
+	}
+	if !strings.Contains(logger.String(), "[HEALTH]") {
+		t.Errorf("injected logger got %q, want the health check's lines", logger.String())
+	}
+	if std.String() != "" {
+		t.Errorf("standard logger got %q, want nothing", std.String())
+	}
+}
+
+func TestPoolOptions(t *testing.T) {
+	urls := []string{"http://a", "http://b"}
+	pool, err := NewPool(urls, WithStrategy(StrategyCacheAware), WithMaxConns(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.affinity == nil || pool.maxConns != 4 {
+		t.Errorf("cache-aware pool: affinity %v, max conns %d", pool.affinity, pool.maxConns)
+	}
+	transport := NewTransport(TransportConfig{})
+	if pool, err = NewPool(urls, WithTransport(transport)); err != nil {
+		t.Fatal(err)
+	}
+	if pool.transport != transport {
+		t.Error("WithTransport: pool does not use the transport")
+	}
+
+	for _, opts := range [][]Option{
+		{WithStrategy("round-robin")},
+		{WithStrategy(StrategyCacheAware)},
+		{WithMaxConns(-1)},
+	} {
+		if _, err := NewPool(urls, opts...); err == nil {
+			t.Errorf("NewPool with %d options: want an error", len(opts))
+		}
+	}
+}
+
+func TestPoolCloseStopsBackgroundLoops(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.OnStateChange(func(*Backend, bool, string) {})
+	hc := NewHealthChecker(pool, WithInterval(time.Hour))
+	done := make(chan struct{})
+	go func() {
+		hc.Start(context.Background())
+		close(done)
+	}()
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health checker still running after Close")
+	}
+}
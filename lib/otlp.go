@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OTLP/HTTP span export: spans are queued as they end and posted in
+// batches, JSON-encoded, to the collector's /v1/traces. Export is best
+// effort: a full queue drops spans, and a failed post is logged and not
+// retried, so a slow or missing collector never holds up requests.
+
+const (
+	// otlpQueueSize bounds the spans waiting for export.
+	otlpQueueSize = 4096
+	// otlpBatchSize is the most spans posted at once.
+	otlpBatchSize = 512
+	// otlpFlushInterval is the longest a span waits for its batch to fill.
+	otlpFlushInterval = 5 * time.Second
+	// otlpTimeout bounds one post.
+	otlpTimeout = 10 * time.Second
+	// otlpScope names the instrumentation in exported spans.
+	otlpScope = "go-load-balance"
+)
+
+// OTLPExporter posts spans to an OTLP/HTTP collector.
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	clock   Clock
+	logger  Logger
+	queue   chan *Span
+	dropped atomic.Uint64
+}
+
+// NewOTLPExporter returns an exporter to the collector at endpoint
+// (http://collector:4318; /v1/traces is appended unless the path already
+// ends with it), naming service as the spans' service.name.
+func NewOTLPExporter(endpoint, service string, opts ...Option) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: want http(s)://host:port", endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/v1/traces") {
+		u.Path = strings.TrimRight(u.Path, "/") + "/v1/traces"
+	}
+	return &OTLPExporter{
+		url:     u.String(),
+		service: service,
+		client:  &http.Client{Timeout: otlpTimeout},
+		clock:   clockFrom(systemClock{}, opts),
+		logger:  loggerFrom(defaultLogger(), opts),
+		queue:   make(chan *Span, otlpQueueSize),
+	}, nil
+}
+
+// ExportSpan queues s for export, or drops it if the queue is full.
+func (e *OTLPExporter) ExportSpan(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Start posts queued spans every otlpFlushInterval, or as soon as a batch
+// is full, until ctx is cancelled.
+func (e *OTLPExporter) Start(ctx context.Context) {
+	ticker := e.clock.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, otlpBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) == otlpBatchSize {
+				e.post(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C():
+			if len(batch) > 0 {
+				e.post(batch)
+				batch = batch[:0]
+			}
+			if n := e.dropped.Swap(0); n > 0 {
+				e.logger.Printf("[TRACE] dropped %d spans: export queue full", n)
+			}
+		}
+	}
+}
+
+// Flush posts every span queued so far, e.g. once the server has shut down.
+func (e *OTLPExporter) Flush() {
+	for {
+		batch := make([]*Span, 0, otlpBatchSize)
+	fill:
+		for len(batch) < otlpBatchSize {
+			select {
+			case s := <-e.queue:
+				batch = append(batch, s)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		e.post(batch)
+	}
+}
+
+func (e *OTLPExporter) post(spans []*Span) {
+	body, err := json.Marshal(otlpRequest(e.service, spans))
+	if err != nil {
+		e.logger.Printf("[BUG] OTLP export: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.logger.Printf("[TRACE] export of %d spans failed: %v", len(spans), err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		e.logger.Printf("[TRACE] export of %d spans failed: status %d", len(spans), resp.StatusCode)
+	}
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in OTLP's JSON encoding:
+// IDs in hex, 64-bit integers as strings.
+func otlpRequest(service string, spans []*Span) map[string]any {
+	out := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		span := map[string]any{
+			"traceId":           s.TraceID.String(),
+			"spanId":            s.SpanID.String(),
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+			"status":            map[string]any{"code": int(s.Status), "message": s.StatusMessage},
+		}
+		if s.ParentID != (SpanID{}) {
+			span["parentSpanId"] = s.ParentID.String()
+		}
+		out[i] = span
+	}
+	return map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": otlpAttributes([]Attribute{{"service.name", service}})},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]any{"name": otlpScope},
+			"spans": out,
+		}},
+	}}}
+}
+
+func otlpAttributes(attrs []Attribute) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]any
+		switch x := a.Value.(type) {
+		case string:
+			v = map[string]any{"stringValue": x}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		case bool:
+			v = map[string]any{"boolValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]any{"key": a.Key, "value": v})
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Outstanding-bytes routing (--routing outstanding-bytes): an embedding or
+// file backend's cost is the data it is still sending, which a connection
+// count does not see — one 200 MB transfer to a slow client counts the
+// same as a finished 2 KB answer. Each backend counts its outstanding
+// response bytes: a response with a Content-Length is charged it when its
+// headers arrive, and each chunk is taken off once the proxy has written
+// it to the client; a response without one (chunked, decompressed) is
+// charged each chunk as it is read from the backend, until it has been
+// written. Whatever is left when the body is closed — a client that went
+// away, a backend that stopped short — is settled then, so the counters
+// return exactly to zero. Selection draws two candidates at random among
+// those least-conn would consider and takes the one with fewer outstanding
+// bytes, then the one with fewer connections: drawing two rather than
+// scanning for the minimum keeps a burst, which adds no bytes until its
+// responses start, from piling onto the one idle backend.
+
+// EnableOutstandingBytes switches the pool to outstanding-bytes routing.
+// Call before serving traffic.
+func (p *Pool) EnableOutstandingBytes() {
+	p.outBytes = true
+	for _, b := range p.GetBackends() {
+		b.outBytes = &atomic.Int64{}
+	}
+}
+
+// OutstandingBytes returns the response bytes the backend still has in
+// flight to clients, 0 unless outstanding-bytes routing is on.
+func (b *Backend) OutstandingBytes() int64 {
+	if b.outBytes == nil {
+		return 0
+	}
+	return b.outBytes.Load()
+}
+
+// watchOutstanding counts resp's body against the backend's outstanding
+// bytes as the proxy copies it.
+func (b *Backend) watchOutstanding(resp *http.Response) {
+	if b.outBytes == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	ob := &outstandingBody{ReadCloser: resp.Body, n: b.outBytes, known: resp.ContentLength >= 0}
+	if ob.known {
+		ob.charged = resp.ContentLength
+		b.outBytes.Add(ob.charged)
+	}
+	resp.Body = ob
+}
+
+// outstandingBody settles a response's charge as it is read. ReverseProxy
+// writes each chunk it reads before reading the next, so a read means the
+// previous chunk has been written.
+type outstandingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+	// known is set when the body's length was charged up front
+	known bool
+
+	mu sync.Mutex
+	// charged is what the body still holds against the backend, held the
+	// part of it read but not yet written
+	charged, held int64
+	closed        bool
+}
+
+func (ob *outstandingBody) Read(p []byte) (int, error) {
+	ob.mu.Lock()
+	ob.settleLocked(ob.held)
+	ob.held = 0
+	ob.mu.Unlock()
+
+	n, err := ob.ReadCloser.Read(p)
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.closed {
+		return n, err
+	}
+	if !ob.known {
+		ob.charged += int64(n)
+		ob.n.Add(int64(n))
+	}
+	ob.held = min(int64(n), ob.charged)
+	return n, err
+}
+
+// settleLocked takes up to k bytes of the charge off the backend. Caller
+// must hold ob.mu.
+func (ob *outstandingBody) settleLocked(k int64) {
+	k = min(k, ob.charged)
+	ob.charged -= k
+	ob.n.Add(-k)
+}
+
+func (ob *outstandingBody) Close() error {
+	ob.mu.Lock()
+	ob.closed = true
+	ob.settleLocked(ob.charged)
+	ob.held = 0
+	ob.mu.Unlock()
+	return ob.ReadCloser.Close()
+}
+
+// twoChoice draws two of the candidates it is shown uniformly at random
+// (reservoir sampling) and picks the one with fewer outstanding bytes,
+// then the lower load. A nil twoChoice, when outstanding-bytes routing is
+// off, ignores them.
+type twoChoice struct {
+	seen  int
+	drawn [2]pick
+}
+
+// newTwoChoice returns a twoChoice in outstanding-bytes routing, nil
+// otherwise.
+func (p *Pool) newTwoChoice() *twoChoice {
+	if !p.outBytes {
+		return nil
+	}
+	return &twoChoice{}
+}
+
+func (t *twoChoice) consider(c pick) {
+	if t == nil {
+		return
+	}
+	t.seen++
+	if t.seen <= 2 {
+		t.drawn[t.seen-1] = c
+	} else if i := rand.IntN(t.seen); i < 2 { // #nosec G404 -- load balancing, not security-sensitive
+		t.drawn[i] = c
+	}
+}
+
+// reset forgets the candidates shown so far, as when a lower tier starts.
+func (t *twoChoice) reset() {
+	if t != nil {
+		*t = twoChoice{}
+	}
+}
+
+// choose returns the better of the two drawn, or def when t is nil or was
+// shown no candidate.
+func (t *twoChoice) choose(def pick) pick {
+	if t == nil || t.seen == 0 {
+		return def
+	}
+	a, b := t.drawn[0], t.drawn[1]
+	if t.seen == 1 {
+		return a
+	}
+	ab, bb := a.b.OutstandingBytes(), b.b.OutstandingBytes()
+	if bb < ab || (bb == ab && b.load < a.load) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+const completionBody = `{"model":"m","prompt":"hi"}`
+
+func postCompletion(t *testing.T, url string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url+"/v1/completions", "application/json", strings.NewReader(completionBody))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return resp
+}
+
+func outstandingPool(t *testing.T, urls ...string) (*Pool, *httptest.Server) {
+	t.Helper()
+	pool, err := NewPool(urls, WithStrategy(StrategyOutstandingBytes), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(func() { lb.Close(); _ = pool.Close() })
+	return pool, lb
+}
+
+func TestOutstandingBytesAvoidsBigTransfer(t *testing.T) {
+	// small answers after a delay, so its requests hold connections while
+	// it has no bytes out; big answers 8 MB at once.
+	small := mockbackend.Start(t, mockbackend.Config{ResponseSize: 1 << 10, Delay: 2 * time.Second})
+	big := mockbackend.Start(t, mockbackend.Config{ResponseSize: 8 << 20})
+	pool, lb := outstandingPool(t, small.URL, big.URL)
+	bigB, _ := pool.Backend(big.URL)
+	smallB, _ := pool.Backend(small.URL)
+
+	var wg sync.WaitGroup
+	fire := func(n int) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if resp := postCompletion(t, lb.URL); resp != nil {
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}()
+		}
+	}
+
+	// Three requests wait on small; then one starts a transfer from big
+	// that the client does not read.
+	if _, err := pool.Drain(big.URL); err != nil {
+		t.Fatal(err)
+	}
+	fire(3)
+	waitFor(t, "small to have 3 requests", func() bool { return smallB.GetActiveConns() == 3 })
+	if _, err := pool.Enable(big.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Drain(small.URL); err != nil {
+		t.Fatal(err)
+	}
+	stalled := postCompletion(t, lb.URL)
+	if stalled == nil {
+		t.FailNow()
+	}
+	defer stalled.Body.Close()
+	if _, err := pool.Enable(small.URL); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "big to have bytes out", func() bool { return bigB.OutstandingBytes() > 0 })
+
+	// By connections big is the idle one; by bytes in flight it is not.
+	before, smallBefore := bigB.TotalRequests(), smallB.TotalRequests()
+	fire(5)
+	waitFor(t, "5 new requests", func() bool {
+		return bigB.TotalRequests()+smallB.TotalRequests()-before-smallBefore == 5
+	})
+	if n := bigB.TotalRequests() - before; n != 0 {
+		t.Errorf("%d new requests went to the backend with a transfer in progress", n)
+	}
+	for _, bs := range pool.Stats().Backends {
+		if bs.URL == big.URL && (bs.OutstandingBytes == nil || *bs.OutstandingBytes <= 0) {
+			t.Errorf("stats show %v outstanding bytes on big", bs.OutstandingBytes)
+		}
+	}
+
+	body, _ := io.ReadAll(stalled.Body)
+	if len(body) < 8<<19 {
+		t.Errorf("read %d bytes from big", len(body))
+	}
+	wg.Wait()
+	waitFor(t, "the counters to settle", func() bool {
+		return bigB.OutstandingBytes() == 0 && smallB.OutstandingBytes() == 0
+	})
+}
+
+func TestOutstandingBytesExactUnderConcurrency(t *testing.T) {
+	var backends []string
+	for _, size := range []int{1 << 10, 64 << 10, 1 << 20} {
+		backends = append(backends, mockbackend.Start(t, mockbackend.Config{ResponseSize: size}).URL)
+	}
+	pool, lb := outstandingPool(t, backends...)
+
+	var wg sync.WaitGroup
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := postCompletion(t, lb.URL)
+			if resp == nil {
+				return
+			}
+			defer resp.Body.Close()
+			if i%4 == 0 {
+				// Some clients hang up part way.
+				_, _ = io.CopyN(io.Discard, resp.Body, 512)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "every counter to return to 0", func() bool {
+		for _, b := range pool.GetBackends() {
+			if b.OutstandingBytes() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestOutstandingBodyKnownLength(t *testing.T) {
+	b, err := NewBackend("http://backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.outBytes = new(atomic.Int64)
+	resp := &http.Response{Body: io.NopCloser(bytes.NewReader(make([]byte, 100))), ContentLength: 100}
+	b.watchOutstanding(resp)
+	if n := b.OutstandingBytes(); n != 100 {
+		t.Fatalf("charged %d, want the Content-Length", n)
+	}
+	buf := make([]byte, 30)
+	for _, want := range []int64{100, 70, 40} {
+		if _, err := resp.Body.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		// The chunk just read is still held until the next read.
+		if n := b.OutstandingBytes(); n != want {
+			t.Errorf("outstanding %d, want %d", n, want)
+		}
+	}
+	resp.Body.Close()
+	if n := b.OutstandingBytes(); n != 0 {
+		t.Errorf("outstanding %d after close", n)
+	}
+}
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Outlier detection: backends that pass health checks but serve much worse
+// than their peers (a degraded GPU answering 200s at 10x the latency) are
+// ejected from selection for a while. Ejection leaves health alone — it is
+// not an outage, so it neither logs a health transition nor bumps the
+// backend's epoch (cache-aware pins survive a short ejection).
+
+// outlierMinHosts is the minimum number of judged backends for a pool
+// median to mean anything.
+const outlierMinHosts = 3
+
+// OutlierConfig tunes outlier detection.
+type OutlierConfig struct {
+	// Interval between sweeps; passive counters are per sweep.
+	Interval time.Duration
+	// EjectionTime is how long an outlier stays out of selection.
+	EjectionTime time.Duration
+	// MaxEjectionFraction caps the share of the pool ejected at once, so
+	// detection can never take the whole pool out.
+	MaxEjectionFraction float64
+	// MinRequests is the number of outcomes a backend needs in a sweep
+	// interval to be judged.
+	MinRequests uint64
+	// SuccessRateDelta: eject when a backend's success rate is more than
+	// this below the pool median.
+	SuccessRateDelta float64
+	// LatencyFactor: eject when a backend's response-header latency EWMA
+	// exceeds this multiple of the pool median.
+	LatencyFactor float64
+}
+
+// DefaultOutlierConfig returns the defaults cmd/lb exposes as flag values.
+func DefaultOutlierConfig() OutlierConfig {
+	return OutlierConfig{
+		Interval:            10 * time.Second,
+		EjectionTime:        30 * time.Second,
+		MaxEjectionFraction: 0.5,
+		MinRequests:         5,
+		SuccessRateDelta:    0.3,
+		LatencyFactor:       3,
+	}
+}
+
+// OutlierDetector periodically compares backends against pool medians and
+// ejects outliers. Readmitted backends rejoin like recovered ones, through
+// slow start. Backends in an expected-restart window are not judged.
+type OutlierDetector struct {
+	pool   *Pool
+	cfg    OutlierConfig
+	clock  Clock
+	logger Logger
+}
+
+// NewOutlierDetector creates an outlier detector for pool, on the pool's
+// clock and logger unless opts give others.
+func NewOutlierDetector(pool *Pool, cfg OutlierConfig, opts ...Option) *OutlierDetector {
+	return &OutlierDetector{pool: pool, cfg: cfg, clock: clockFrom(pool.clock, opts), logger: loggerFrom(pool.logger, opts)}
+}
+
+// Start runs sweeps until ctx is done or the pool is closed.
+func (od *OutlierDetector) Start(ctx context.Context) {
+	ctx, cancel := od.pool.bind(ctx)
+	defer cancel()
+	ticker := od.clock.NewTicker(od.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			od.sweep()
+		}
+	}
+}
+
+type outlierSample struct {
+	b       *Backend
+	rate    float64
+	latency time.Duration
+}
+
+// sweep readmits backends whose ejection expired, then judges the rest
+// against the pool medians and ejects the worst outliers within the cap.
+func (od *OutlierDetector) sweep() {
+	now := od.clock.Now()
+	backends := od.pool.GetBackends()
+
+	var samples []outlierSample
+	ejected := 0
+	for _, b := range backends {
+		b.mu.Lock()
+		succ, fail := b.successes, b.failures
+		b.successes, b.failures = 0, 0
+		readmitted := b.ejected && !now.Before(b.ejectedUntil)
+		if readmitted {
+			b.ejected = false
+			b.latencyEWMA = 0 // judge the readmitted backend on fresh samples
+			b.startSlowStartLocked(now)
+		}
+		isEjected, healthy, latency := b.ejected, b.healthy && !b.restartingLocked(now), b.latencyEWMA
+		b.mu.Unlock()
+
+		if readmitted {
+			b.rotationChanged()
+			od.logger.Printf("[OUTLIER] %s readmitted", b.ID())
+		}
+		if isEjected {
+			ejected++
+			continue
+		}
+		if !healthy || succ+fail < od.cfg.MinRequests {
+			continue
+		}
+		samples = append(samples, outlierSample{b: b, rate: float64(succ) / float64(succ+fail), latency: latency})
+	}
+	if len(samples) < outlierMinHosts {
+		return
+	}
+
+	rates := make([]float64, 0, len(samples))
+	var latencies []time.Duration
+	for _, s := range samples {
+		rates = append(rates, s.rate)
+		if s.latency > 0 {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	medRate := median(rates)
+	medLatency := median(latencies)
+
+	type outlier struct {
+		outlierSample
+		severity float64
+		reason   string
+	}
+	var outliers []outlier
+	for _, s := range samples {
+		switch {
+		case s.rate < medRate-od.cfg.SuccessRateDelta:
+			// Error-rate outliers rank above any latency outlier.
+			outliers = append(outliers, outlier{s, 1e6 + (medRate - s.rate),
+				fmt.Sprintf("success rate %.0f%% vs pool median %.0f%%", s.rate*100, medRate*100)})
+		case medLatency > 0 && float64(s.latency) > od.cfg.LatencyFactor*float64(medLatency):
+			outliers = append(outliers, outlier{s, float64(s.latency) / float64(medLatency),
+				fmt.Sprintf("latency %v vs pool median %v", s.latency.Round(time.Millisecond), medLatency.Round(time.Millisecond))})
+		}
+	}
+	slices.SortFunc(outliers, func(a, b outlier) int {
+		switch {
+		case a.severity > b.severity:
+			return -1
+		case a.severity < b.severity:
+			return 1
+		}
+		return 0
+	})
+
+	budget := int(od.cfg.MaxEjectionFraction*float64(len(backends))) - ejected
+	for i, o := range outliers {
+		if i >= budget {
+			od.logger.Printf("[OUTLIER] %s is an outlier (%s) but the ejection cap is reached", o.b.ID(), o.reason)
+			continue
+		}
+		o.b.mu.Lock()
+		o.b.ejected = true
+		o.b.ejectedUntil = now.Add(od.cfg.EjectionTime)
+		o.b.ejections++
+		o.b.mu.Unlock()
+		o.b.rotationChanged()
+		od.logger.Printf("[OUTLIER] %s ejected for %v (%s)", o.b.ID(), od.cfg.EjectionTime, o.reason)
+	}
+}
+
+// median returns the median of vals (0 when empty). vals is sorted in place.
+func median[T float64 | time.Duration](vals []T) T {
+	if len(vals) == 0 {
+		return 0
+	}
+	slices.Sort(vals)
+	n := len(vals)
+	if n%2 == 1 {
+		return vals[n/2]
+	}
+	return (vals[n/2-1] + vals[n/2]) / 2
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newOutlierPool builds a pool of n backends and a detector with a
+// controllable clock.
+func newOutlierPool(t *testing.T, n int) (*Pool, *OutlierDetector, *fakeClock) {
+	t.Helper()
+	urls := make([]string, n)
+	for i := range n {
+		urls[i] = fmt.Sprintf("http://backend-%d", i)
+	}
+	clock := newFakeClock(time.Unix(1_000_000, 0))
+	pool, err := NewPool(urls, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, NewOutlierDetector(pool, DefaultOutlierConfig()), clock
+}
+
+// feed records count outcomes on b with the given latency and success ratio.
+func feed(b *Backend, count int, latency time.Duration, okRatio float64) {
+	for i := range count {
+		b.recordOutcome(float64(i) < okRatio*float64(count), latency)
+	}
+}
+
+func TestOutlierSlowBackendEjectedAndReadmitted(t *testing.T) {
+	pool, od, clock := newOutlierPool(t, 4)
+	slow := pool.GetBackends()[3]
+	for _, b := range pool.GetBackends()[:3] {
+		feed(b, 20, 100*time.Millisecond, 1)
+	}
+	feed(slow, 20, time.Second, 1)
+
+	od.sweep()
+	if !slow.ejected {
+		t.Fatal("backend at 10x the median latency should be ejected")
+	}
+	for range 10 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.DecrementConns()
+		if b == slow {
+			t.Fatal("ejected backend must not be selected")
+		}
+	}
+	if !slow.IsHealthy() {
+		t.Error("ejection must not change health")
+	}
+	if st := pool.Stats().Backends[3]; !st.Ejected || st.EjectedUntil == nil || st.Ejections != 1 {
+		t.Errorf("stats = %+v, want ejected with an expiry", st)
+	}
+
+	// Still ejected before the ejection time has passed.
+	clock.advance(od.cfg.EjectionTime - time.Second)
+	od.sweep()
+	if !slow.ejected {
+		t.Fatal("readmitted before the ejection time passed")
+	}
+
+	clock.advance(time.Second)
+	od.sweep()
+	if slow.ejected {
+		t.Fatal("backend should be readmitted after the ejection time")
+	}
+	if slow.latencyEWMA != 0 {
+		t.Error("readmitted backend should be judged on fresh latency samples")
+	}
+}
+
+func TestOutlierErrorRateEjected(t *testing.T) {
+	pool, od, _ := newOutlierPool(t, 4)
+	for _, b := range pool.GetBackends()[:3] {
+		feed(b, 20, 100*time.Millisecond, 1)
+	}
+	feed(pool.GetBackends()[3], 20, 100*time.Millisecond, 0.4)
+
+	od.sweep()
+	if !pool.GetBackends()[3].ejected {
+		t.Error("backend with 40% success vs 100% median should be ejected")
+	}
+}
+
+func TestOutlierEjectionCap(t *testing.T) {
+	pool, od, _ := newOutlierPool(t, 6)
+	for _, b := range pool.GetBackends()[:3] {
+		feed(b, 20, 100*time.Millisecond, 1)
+	}
+	// Three outliers among six backends; a cap of 2 ejects only the worst two.
+	feed(pool.GetBackends()[3], 20, 2*time.Second, 1)
+	feed(pool.GetBackends()[4], 20, 3*time.Second, 1)
+	feed(pool.GetBackends()[5], 20, 100*time.Millisecond, 0.1)
+
+	od.cfg.MaxEjectionFraction = 2.0 / 6
+	od.sweep()
+	ejected := 0
+	for _, b := range pool.GetBackends() {
+		if b.ejected {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("expected the cap to allow 2 ejections, got %d", ejected)
+	}
+	if !pool.GetBackends()[5].ejected || !pool.GetBackends()[4].ejected {
+		t.Error("the worst outliers (error rate first, then highest latency) should be ejected first")
+	}
+}
+
+func TestOutlierNeedsEnoughData(t *testing.T) {
+	pool, od, _ := newOutlierPool(t, 4)
+	for _, b := range pool.GetBackends()[:3] {
+		feed(b, 20, 100*time.Millisecond, 1)
+	}
+	feed(pool.GetBackends()[3], 2, time.Second, 1) // below MinRequests
+
+	od.sweep()
+	if pool.GetBackends()[3].ejected {
+		t.Error("backend with too few requests must not be judged")
+	}
+
+	// Two judged backends cannot define a meaningful median.
+	pool2, od2, _ := newOutlierPool(t, 2)
+	feed(pool2.GetBackends()[0], 20, 100*time.Millisecond, 1)
+	feed(pool2.GetBackends()[1], 20, time.Second, 1)
+	od2.sweep()
+	if pool2.GetBackends()[1].ejected {
+		t.Error("detection needs at least outlierMinHosts judged backends")
+	}
+}
+
+// TestOutlierDetectorTicks drives Start through the fake clock: one tick
+// ejects, the first tick after the ejection time readmits.
+func TestOutlierDetectorTicks(t *testing.T) {
+	pool, od, clock := newOutlierPool(t, 4)
+	slow := pool.GetBackends()[3]
+	for _, b := range pool.GetBackends()[:3] {
+		feed(b, 20, 100*time.Millisecond, 1)
+	}
+	feed(slow, 20, time.Second, 1)
+	slow.RecordCheckSuccess()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		od.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	clock.blockUntil(t, 1)
+	ejected := func() bool { return pool.Stats().Backends[3].Ejected }
+	wait := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if ejected() {
+		t.Fatal("ejected before the first tick")
+	}
+	clock.advance(od.cfg.Interval)
+	wait("the ejection", ejected)
+
+	clock.advance(od.cfg.EjectionTime)
+	wait("the readmission", func() bool { return !ejected() })
+	if st := pool.Stats().Backends[3]; st.State != "healthy" {
+		t.Errorf("readmitted backend state %q", st.State)
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Health on demand (POST /admin/healthcheck, POST /admin/backends/{id}/health):
+// during an incident an operator may know a backend is bad before the
+// checker does, or want its verdict at once after a fix. CheckNow probes
+// the pool's backends, or one, right away, as a scheduled probe would, and
+// returns the results. OverrideHealth forces a backend healthy or unhealthy
+// for a TTL: meanwhile probes still run and are reported, but neither they,
+// failed requests nor peers change its health, and /stats shows
+// health_source "manual". The override ends by the clock alone — every
+// check of it compares the time, so a busy process cannot keep it past its
+// TTL — and the backend's next probe is due when it ends, from which the
+// usual health logic takes over.
+
+// maxHealthOverride bounds an override's TTL.
+const maxHealthOverride = 24 * time.Hour
+
+// Health sources, as /stats shows them.
+const (
+	HealthSourceProbe  = "probe"
+	HealthSourceManual = "manual"
+)
+
+// OverrideHealth forces the health of the backend with the given URL
+// (matched like Backend's) to healthy for ttl, at most 24h, replacing any
+// override it has.
+func (p *Pool) OverrideHealth(rawURL string, healthy bool, ttl time.Duration) (*Backend, error) {
+	if ttl <= 0 || ttl > maxHealthOverride {
+		return nil, fmt.Errorf("ttl must be positive and at most %v, got %v", maxHealthOverride, ttl)
+	}
+	b, err := p.Backend(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b.overrideHealth(healthy, ttl)
+	for _, poke := range p.rescheduleChecks {
+		poke() // to probe when the override ends
+	}
+	return b, nil
+}
+
+// overrideHealth forces b's health to healthy for ttl.
+func (b *Backend) overrideHealth(healthy bool, ttl time.Duration) {
+	b.mu.Lock()
+	now := b.clock.Now()
+	b.manualUntil = now.Add(ttl)
+	changed := false
+	switch {
+	case !healthy:
+		changed = b.markUnhealthyLocked(now, "manual override")
+	case !b.healthy:
+		b.healthy, b.peerDown, b.successStreak = true, false, 0
+		b.starting, b.startupFailed = false, false
+		b.setTransitionLocked(now, "manual override")
+		b.startSlowStartLocked(now)
+		changed = true
+	}
+	b.mu.Unlock()
+	if changed {
+		b.rotationChanged()
+	}
+	b.logger.Printf("[ADMIN] %s health overridden: %s for %v (manual)", b.ID(), stateName(healthy), ttl)
+	if changed {
+		b.hooks.fire(b, healthy, "manual override")
+	}
+}
+
+// overriddenLocked reports whether b's health is manually overridden at
+// now. Caller must hold b.mu.
+func (b *Backend) overriddenLocked(now time.Time) bool {
+	return now.Before(b.manualUntil)
+}
+
+// overridden is overriddenLocked.
+func (b *Backend) overridden(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.overriddenLocked(now)
+}
+
+// expireOverride ends b's override if its TTL has run out by now.
+func (b *Backend) expireOverride(now time.Time) {
+	b.mu.Lock()
+	expired := !b.manualUntil.IsZero() && !b.overriddenLocked(now)
+	if expired {
+		b.manualUntil = time.Time{}
+	}
+	b.mu.Unlock()
+	if expired {
+		b.logger.Printf("[HEALTH] %s manual health override expired; health checks resume", b.ID())
+	}
+}
+
+// healthSourceLocked returns what decided b's health at now. Caller must
+// hold b.mu.
+func (b *Backend) healthSourceLocked(now time.Time) string {
+	if b.overriddenLocked(now) {
+		return HealthSourceManual
+	}
+	return HealthSourceProbe
+}
+
+// HealthCheckResult is one backend's outcome of CheckNow.
+type HealthCheckResult struct {
+	Backend string `json:"backend"`
+	// Passed is whether the probe passed; Error says why not
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+	// Skipped is set when the probe did not run (see errProbeSkipped)
+	Skipped bool `json:"skipped,omitempty"`
+	// Healthy, State and HealthSource are the backend's after the probe
+	Healthy      bool    `json:"healthy"`
+	State        string  `json:"state"`
+	HealthSource string  `json:"health_source"`
+	DurationMs   float64 `json:"duration_ms"`
+}
+
+// CheckNow probes the backend with the given URL (matched like Backend's),
+// or every backend for "", at once, at most the checker's concurrency at a
+// time, and returns the results in pool order.
+func (hc *HealthChecker) CheckNow(ctx context.Context, rawURL string) ([]HealthCheckResult, error) {
+	backends := hc.pool.GetBackends()
+	if rawURL != "" {
+		b, err := hc.pool.Backend(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		backends = []*Backend{b}
+	}
+	results := make([]HealthCheckResult, len(backends))
+	sem := make(chan struct{}, max(1, hc.concurrency))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			start := hc.clock.Now()
+			err := hc.checkBackend(ctx, b)
+			res := HealthCheckResult{
+				Backend:    b.ID(),
+				Passed:     err == nil,
+				Skipped:    errors.Is(err, errProbeSkipped),
+				DurationMs: float64(hc.clock.Now().Sub(start)) / float64(time.Millisecond),
+			}
+			var status *probeStatusError
+			switch {
+			case errors.As(err, &status):
+				res.Error = status.Error()
+			case err != nil:
+				res.Error = probeFailure(err)
+			}
+			now := hc.clock.Now()
+			b.mu.Lock()
+			res.Healthy = b.healthy
+			res.State = b.stateLocked(now, hc.pool.slowStart, hc.pool.maxConns)
+			res.HealthSource = b.healthSourceLocked(now)
+			b.mu.Unlock()
+			results[i] = res
+		})
+	}
+	wg.Wait()
+	hc.pool.mu.Lock()
+	hc.pool.notePanicLocked(hc.pool.snapshot(), hc.clock.Now())
+	hc.pool.mu.Unlock()
+	hc.poke()
+	return results, nil
+}
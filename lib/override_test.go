@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckNow(t *testing.T) {
+	ok := okBackend(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	pool, err := NewPool([]string{ok.URL, failing.URL}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute), WithProbeTimeout(time.Second))
+
+	results, err := hc.CheckNow(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results", len(results))
+	}
+	if r := results[0]; r.Backend != ok.URL || !r.Passed || !r.Healthy || r.State != "healthy" || r.HealthSource != HealthSourceProbe {
+		t.Errorf("passing backend: %+v", r)
+	}
+	if r := results[1]; r.Backend != failing.URL || r.Passed || r.Error != "status: 500" || r.Healthy || r.State != "unhealthy" {
+		t.Errorf("failing backend: %+v", r)
+	}
+
+	// One backend, by host:port.
+	results, err = hc.CheckNow(context.Background(), strings.TrimPrefix(ok.URL, "http://"))
+	if err != nil || len(results) != 1 || results[0].Backend != ok.URL {
+		t.Errorf("single backend: %+v, %v", results, err)
+	}
+	if _, err := hc.CheckNow(context.Background(), "http://gpu-9:8000"); !IsUnknownBackend(err) {
+		t.Errorf("unknown backend: %v", err)
+	}
+}
+
+func TestHealthOverride(t *testing.T) {
+	ok := okBackend(t)
+	t0 := time.Unix(1_700_000_000, 0)
+	clock := newFakeClock(t0)
+	pool, err := NewPool([]string{ok.URL}, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute), WithProbeTimeout(time.Second))
+	b := pool.GetBackends()[0]
+
+	if _, err := pool.OverrideHealth(ok.URL, false, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if b.IsHealthy() {
+		t.Fatal("override left the backend healthy")
+	}
+	s := pool.Stats().Backends[0]
+	if s.HealthSource != HealthSourceManual || s.ManualUntil == nil || !s.ManualUntil.Equal(t0.Add(5*time.Minute)) || s.Reason != "manual override" {
+		t.Errorf("stats: source %q, until %v, reason %q", s.HealthSource, s.ManualUntil, s.Reason)
+	}
+	// Passing probes are reported, but do not bring it back.
+	for range 3 {
+		if err := hc.checkBackend(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.IsHealthy() {
+		t.Fatal("probes overrode the manual override")
+	}
+
+	// It expires by the clock alone, before any probe notices.
+	clock.advance(5 * time.Minute)
+	if s := pool.Stats().Backends[0]; s.HealthSource != HealthSourceProbe || s.ManualUntil != nil {
+		t.Errorf("after the TTL: source %q, until %v", s.HealthSource, s.ManualUntil)
+	}
+	for range healthyThreshold {
+		hc.checkBackend(context.Background(), b)
+	}
+	if !b.IsHealthy() {
+		t.Fatal("health checks did not take over after the override")
+	}
+
+	// Forced healthy, it survives failed requests until the TTL.
+	if _, err := pool.OverrideHealth(ok.URL, true, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	b.strike("status: 500", true)
+	if !b.IsHealthy() {
+		t.Fatal("failed request overrode the manual override")
+	}
+	clock.advance(time.Minute)
+	b.strike("status: 500", true)
+	if b.IsHealthy() {
+		t.Fatal("failed request ignored after the override expired")
+	}
+
+	for _, ttl := range []time.Duration{0, -time.Minute, 25 * time.Hour} {
+		if _, err := pool.OverrideHealth(ok.URL, false, ttl); err == nil {
+			t.Errorf("ttl %v accepted", ttl)
+		}
+	}
+	if _, err := pool.OverrideHealth("http://gpu-9:8000", false, time.Minute); !IsUnknownBackend(err) {
+		t.Errorf("unknown backend: %v", err)
+	}
+}
+
+func TestHealthOverrideEndsWithProbe(t *testing.T) {
+	t0 := time.Unix(1_700_000_000, 0)
+	clock := newFakeClock(t0)
+	pool, err := NewPool([]string{"http://gpu-1:8000"}, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute), WithUnhealthyInterval(time.Minute))
+	rec := &probeRecorder{clock: clock, at: map[*Backend][]time.Time{}}
+	hc.probers[HealthCheckHTTP] = rec
+	b := pool.GetBackends()[0]
+	probes := func() []time.Time {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return append([]time.Time(nil), rec.at[b]...)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() { hc.Start(ctx) })
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	waitFor(t, "the first probe", func() bool { return len(probes()) == 1 })
+
+	if _, err := pool.OverrideHealth(b.ID(), true, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the probe to be moved to the override's end", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return !b.probing && b.nextProbe.Equal(t0.Add(10*time.Second))
+	})
+	clock.blockUntil(t, 1)
+	clock.advance(10 * time.Second)
+	waitFor(t, "the probe at the override's end", func() bool { return len(probes()) == 2 })
+	if at := probes()[1]; !at.Equal(t0.Add(10 * time.Second)) {
+		t.Errorf("probed at +%v, want +10s", at.Sub(t0))
+	}
+}
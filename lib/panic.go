@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"time"
+)
+
+// Panic routing (--panic-mode-threshold, after Envoy's panic threshold): a
+// health endpoint that breaks while serving still works would otherwise
+// take the whole pool down with "no healthy backends". While fewer than the
+// threshold percentage of a pool's backends are selectable, selection
+// ignores health instead: unhealthy, starting and ejected backends are
+// picked by load like healthy ones, since spreading requests over every
+// backend beats refusing all of them. Backends restarting, drained for
+// maintenance or degraded by their request decorator stay out. Panic mode
+// is re-evaluated whenever a backend enters or leaves rotation (see
+// snapshot.go) and after each health check; entering and leaving it are
+// logged once each.
+
+// SetPanicThreshold enables panic routing below percent healthy backends
+// (0 = off). Call before serving traffic.
+func (p *Pool) SetPanicThreshold(percent float64) {
+	p.panicThreshold = percent
+}
+
+// PanicMode reports whether selection is currently ignoring health.
+func (p *Pool) PanicMode() bool {
+	return p.panicking.Load()
+}
+
+// notePanicLocked re-evaluates panic mode from the backends in rotation in
+// s and logs transitions. Caller must hold p.mu.
+func (p *Pool) notePanicLocked(s *poolSnapshot, now time.Time) {
+	total := len(s.backends)
+	if p.panicThreshold <= 0 || total == 0 {
+		return
+	}
+	healthy := 0
+	for i := range s.rotation {
+		if !s.rotation[i].restarting(now) {
+			healthy++
+		}
+	}
+	panicking := float64(healthy)*100 < p.panicThreshold*float64(total)
+	if p.panicking.Swap(panicking) == panicking {
+		return
+	}
+	if panicking {
+		p.logger.Printf("[PANIC] %s: PANIC MODE ON: %d/%d backends healthy, below %v%%; routing to all backends regardless of health",
+			metricsPoolName(p), healthy, total, p.panicThreshold)
+	} else {
+		p.logger.Printf("[PANIC] %s: panic mode off: %d/%d backends healthy; routing to healthy backends only",
+			metricsPoolName(p), healthy, total)
+	}
+}
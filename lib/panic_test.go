@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestPanicModeRoutesDespiteHealth(t *testing.T) {
+	out := captureLog(t)
+	var urls []string
+	var backends []*mockbackend.Server
+	for range 3 {
+		s := mockbackend.Start(t, mockbackend.Config{HealthEndpoint: "/health"})
+		backends = append(backends, s)
+		urls = append(urls, s.URL)
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHealthPath("/health"); err != nil {
+		t.Fatal(err)
+	}
+	pool.SetPanicThreshold(50)
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	hc.checkAll(context.Background())
+	complete := func() int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"prompt":"hi"}`)))
+		return rec.Code
+	}
+
+	// One of three down: above the threshold, health decides.
+	backends[0].SetMode(mockbackend.ModeBrokenHealth)
+	hc.checkAll(context.Background())
+	if pool.PanicMode() {
+		t.Fatal("panic mode with 2/3 healthy")
+	}
+	for range 10 {
+		if code := complete(); code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+	}
+	if n := backends[0].Stats().Paths["/v1/completions"]; n != 0 {
+		t.Errorf("unhealthy backend served %d requests outside panic mode", n)
+	}
+
+	// All down, but still serving: requests flow to all of them.
+	for _, s := range backends {
+		s.SetMode(mockbackend.ModeBrokenHealth)
+	}
+	hc.checkAll(context.Background())
+	if !pool.PanicMode() || !pool.Stats().PanicMode {
+		t.Fatal("not in panic mode with 0/3 healthy")
+	}
+	for range 30 {
+		if code := complete(); code != http.StatusOK {
+			t.Fatalf("status %d in panic mode", code)
+		}
+	}
+	for i, s := range backends {
+		if s.Stats().Paths["/v1/completions"] == 0 {
+			t.Errorf("backend %d got no requests in panic mode", i)
+		}
+	}
+	if strings.Count(out.String(), "PANIC MODE ON") != 1 {
+		t.Errorf("panic mode not logged exactly once:\n%s", out)
+	}
+
+	// Recovery ends it, as soon as enough backends are back.
+	for _, s := range backends {
+		s.SetMode(mockbackend.ModeHealthy)
+	}
+	hc.checkAll(context.Background())
+	hc.checkAll(context.Background())
+	if pool.PanicMode() || strings.Count(out.String(), "panic mode off: 2/3 backends healthy") != 1 {
+		t.Errorf("panic mode still on after recovery:\n%s", out)
+	}
+}
+
+func TestPanicModeOff(t *testing.T) {
+	captureLog(t)
+	pool, err := NewPool([]string{"http://a", "http://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range pool.GetBackends() {
+		b.MarkUnhealthy()
+	}
+	if _, err := pool.SelectBackend(); err != errNoHealthyBackends || pool.PanicMode() {
+		t.Errorf("without a threshold: %v, panic mode %v", err, pool.PanicMode())
+	}
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Path rewriting (--strip-prefix, a backend's prefix=): clients call lb at
+// /v1/... while a backend serves the API under /serve/v1/..., or lb itself
+// is mounted under /llm/ behind another proxy. The path a backend is sent
+// is its URL's path, then its prefix=, then the client's path with the
+// pool's strip prefix removed — only at a segment boundary, so stripping
+// /api leaves /apix alone. Everything is done on the escaped path, so an
+// encoded character (%2F in a model name, say) reaches the backend as the
+// client sent it; the pieces are joined with exactly one slash between
+// them, and the query string is passed through untouched. Health probes are
+// not rewritten. The request log shows the rewritten path as upstream_path.
+
+// cleanPathPrefix validates a path prefix and returns its escaped form
+// without a trailing slash ("" for "/").
+func cleanPathPrefix(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil || !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		return "", fmt.Errorf("path prefix %q must be an absolute path, like /serve", s)
+	}
+	return strings.TrimRight(u.EscapedPath(), "/"), nil
+}
+
+// SetStripPrefix removes prefix from the start of request paths before
+// they are proxied ("" = none). Call before serving traffic.
+func (p *Pool) SetStripPrefix(prefix string) error {
+	clean, err := cleanPathPrefix(cmp.Or(prefix, "/"))
+	if err != nil {
+		return err
+	}
+	p.stripPrefix = clean
+	for _, b := range p.GetBackends() {
+		b.stripPrefix = clean
+	}
+	return nil
+}
+
+// stripEscapedPrefix removes prefix from escaped at a segment boundary.
+func stripEscapedPrefix(escaped, prefix string) string {
+	if prefix == "" {
+		return escaped
+	}
+	rest, ok := strings.CutPrefix(escaped, prefix)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return escaped
+	}
+	return rest
+}
+
+// joinEscapedPaths joins escaped path pieces with one slash between each,
+// ending in a slash when the last piece is empty or does.
+func joinEscapedPaths(pieces ...string) string {
+	joined := ""
+	for _, p := range pieces {
+		if p = strings.Trim(p, "/"); p != "" {
+			joined += "/" + p
+		}
+	}
+	if last := pieces[len(pieces)-1]; joined == "" || last == "" || strings.HasSuffix(last, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+// upstreamPath returns the escaped path the backend is sent for a client's
+// escaped path.
+func (b *Backend) upstreamPath(escaped string) string {
+	return joinEscapedPaths(b.URL.EscapedPath(), b.pathPrefix, stripEscapedPrefix(escaped, b.stripPrefix))
+}
+
+// rewritePath sets u's path to the backend's upstream path for the
+// client's escaped path.
+func (b *Backend) rewritePath(u *url.URL, escaped string) {
+	target := b.upstreamPath(escaped)
+	path, err := url.PathUnescape(target)
+	if err != nil {
+		return // cannot happen: target is made of escaped paths
+	}
+	u.Path, u.RawPath = path, target
+	if (&url.URL{Path: path}).EscapedPath() == target {
+		u.RawPath = "" // the default encoding, as url.Parse would leave it
+	}
+}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathRewriteRoundTrip(t *testing.T) {
+	got := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.RequestURI
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		name, backend, strip, request, want string
+	}{
+		{"no rewrite", backend.URL, "", "/v1/models?limit=2", "/v1/models?limit=2"},
+		{"prefix", backend.URL + ",prefix=/serve", "", "/v1/chat/completions?stream=true", "/serve/v1/chat/completions?stream=true"},
+		{"prefix trailing slash", backend.URL + ",prefix=/serve/", "", "/v1/models", "/serve/v1/models"},
+		{"no double slashes", backend.URL + ",prefix=/serve", "", "//v1/models/", "/serve/v1/models/"},
+		{"interior slashes kept", backend.URL + ",prefix=/serve", "", "/v1//models", "/serve/v1//models"},
+		{"escaped", backend.URL + ",prefix=/serve", "", "/v1/models/org%2Fmodel%20x", "/serve/v1/models/org%2Fmodel%20x"},
+		{"escaped prefix", backend.URL + ",prefix=/a%2Fb", "", "/v1", "/a%2Fb/v1"},
+		{"url path and prefix", backend.URL + "/base,prefix=/serve", "", "/v1/models", "/base/serve/v1/models"},
+		{"strip", backend.URL, "/api", "/api/v1/models?x=%2F", "/v1/models?x=%2F"},
+		{"strip whole path", backend.URL, "/api", "/api", "/"},
+		{"strip segments only", backend.URL, "/api", "/apix/v1", "/apix/v1"},
+		{"strip escaped", backend.URL, "/api", "/api%2Fv1", "/api%2Fv1"},
+		{"strip and prefix", backend.URL + ",prefix=/serve", "/llm/", "/llm/v1/models/a%2Fb", "/serve/v1/models/a%2Fb"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool, err := NewPool([]string{tc.backend})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pool.SetStripPrefix(tc.strip); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, tc.request, nil)
+			rec := httptest.NewRecorder()
+			pool.ServeHTTP(rec, r)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d", rec.Code)
+			}
+			if uri := <-got; uri != tc.want {
+				t.Errorf("%s reached the backend as %s, want %s", tc.request, uri, tc.want)
+			}
+		})
+	}
+}
+
+func TestPathRewriteInRequestLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	pool, path := newLoggedPool(t, backend.URL+",prefix=/serve")
+	if err := pool.SetStripPrefix("/api"); err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range []string{"/api/v1/models?x=1", "/v1/models"} {
+		pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, uri, nil))
+	}
+	entries := readLogEntries(t, path, 2)
+	if e := entries[0]; e.Path != "/api/v1/models?x=1" || e.UpstreamPath != "/serve/v1/models" {
+		t.Errorf("entry path %q, upstream %q", e.Path, e.UpstreamPath)
+	}
+	if e := entries[1]; e.UpstreamPath != "/serve/v1/models" {
+		t.Errorf("entry upstream path %q", e.UpstreamPath)
+	}
+}
+
+func TestPathPrefixValidation(t *testing.T) {
+	for _, spec := range []string{"http://a,prefix=serve", "http://a,prefix=//serve", "http://a,prefix=/s?x=1", "http://a,prefix=/s#f"} {
+		if _, err := ParseBackendSpec(spec); err == nil {
+			t.Errorf("ParseBackendSpec(%q) accepted", spec)
+		}
+	}
+	if s, err := ParseBackendSpec("http://a,prefix=/serve/v1/"); err != nil || s.Prefix != "/serve/v1" || s.String() != "http://a,prefix=/serve/v1" {
+		t.Errorf("prefix spec %+v, %v", s, err)
+	}
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetStripPrefix("api"); err == nil {
+		t.Error("SetStripPrefix accepted a relative path")
+	}
+}
@@ -0,0 +1,420 @@
+package lib
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Peer state sharing (--peers): replicas of lb in front of the same
+// backends tell each other about health transitions over UDP, so a
+// backend one replica sees fail is taken out of rotation by the others
+// within a second instead of each sending it doomed requests of its own.
+//
+// Every replica keeps a table of the latest transition of each backend
+// ("<pool>/<backend>"), by whichever replica observed it: healthy or not,
+// when, and why. Entries are versioned by observation time, the origin's
+// replica ID breaking ties, and the later one wins. A replica adds its own
+// transitions (the state change hooks, see notify.go) and sends the whole
+// table to every peer at once and then every peerSyncInterval, so a lost
+// datagram or a restarted peer is caught up within the interval; the
+// periodic send also carries the replica's in-flight requests per backend,
+// shown at GET /admin/peers. With a shared secret every datagram is signed
+// (HMAC-SHA256) and unsigned ones are dropped.
+//
+// Remote state is advisory. A peer's report that a backend is unhealthy
+// takes it out of rotation only if the backend is healthy here, no local
+// health check has passed since the peer's observation, and the report is
+// younger than peerEntryTTL; it is logged as a [PEER] line and fired to the
+// state change hooks like a local failure. Such a backend rejoins on its
+// first passing local health check rather than the usual streak, and a
+// peer's report that a backend is healthy never puts one back in rotation:
+// that takes a local check. Peers that cannot be reached are logged when
+// that changes and otherwise ignored; nothing on the request path waits on
+// them.
+
+const (
+	// peerSyncInterval is how often the whole table is sent to every peer.
+	peerSyncInterval = time.Second
+	// peerEntryTTL is how old a transition may be and still be applied or
+	// passed on.
+	peerEntryTTL = 5 * time.Minute
+	// peerBatch bounds the entries of one datagram.
+	peerBatch = 32
+	// peerReasonPrefix starts the reason of a transition a peer caused, so
+	// it is not announced again as this replica's own.
+	peerReasonPrefix = "peer "
+)
+
+// peerEntry is one backend's latest transition, as the table holds it.
+type peerEntry struct {
+	// Key is "<pool>/<backend>", the pool name path-escaped
+	Key     string    `json:"key"`
+	Origin  string    `json:"origin"`
+	Healthy bool      `json:"healthy"`
+	At      time.Time `json:"at"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// newer reports whether e supersedes o (last writer wins).
+func (e peerEntry) newer(o peerEntry) bool {
+	if !e.At.Equal(o.At) {
+		return e.At.After(o.At)
+	}
+	return e.Origin > o.Origin
+}
+
+// peerMessage is one datagram's JSON.
+type peerMessage struct {
+	From    string      `json:"from"`
+	Entries []peerEntry `json:"entries,omitempty"`
+	// Inflight is the sender's requests in flight by backend key
+	Inflight map[string]int `json:"inflight,omitempty"`
+}
+
+// PeerSync shares backend health with peer replicas.
+type PeerSync struct {
+	id     string
+	conn   net.PacketConn
+	peers  []string
+	secret []byte
+	pools  map[string]*Pool
+	clock  Clock
+	logger Logger
+	// kick asks the sender for an immediate send
+	kick chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]peerEntry
+	heard   map[string]*PeerStatus
+	// sendErrs is each peer address's last send error, "" when fine
+	sendErrs map[string]string
+
+	applied, dropped atomic.Uint64
+}
+
+// NewPeerSync returns a sync for replica id, exchanging datagrams with
+// peers (host:port) over conn.
+func NewPeerSync(id string, conn net.PacketConn, peers []string, opts ...Option) *PeerSync {
+	return &PeerSync{
+		id: id, conn: conn, peers: peers,
+		pools:    make(map[string]*Pool),
+		clock:    clockFrom(systemClock{}, opts),
+		logger:   loggerFrom(defaultLogger(), opts),
+		kick:     make(chan struct{}, 1),
+		entries:  make(map[string]peerEntry),
+		heard:    make(map[string]*PeerStatus),
+		sendErrs: make(map[string]string),
+	}
+}
+
+// SetSecret signs datagrams with secret and drops those not signed with
+// it. Call before Start.
+func (ps *PeerSync) SetSecret(secret string) {
+	ps.secret = []byte(secret)
+}
+
+// TrackPool shares the health of the pool's backends under name, which
+// must be the same on every replica. Call before Start.
+func (ps *PeerSync) TrackPool(name string, p *Pool) {
+	ps.pools[name] = p
+	p.OnStateChange(func(b *Backend, healthy bool, reason string) {
+		if strings.HasPrefix(reason, peerReasonPrefix) {
+			return
+		}
+		ps.observe(peerKey(name, b.ID()), healthy, reason)
+	})
+}
+
+func peerKey(pool, backend string) string {
+	return url.PathEscape(pool) + "/" + backend
+}
+
+// observe records one of this replica's transitions and sends it at once.
+func (ps *PeerSync) observe(key string, healthy bool, reason string) {
+	ps.mu.Lock()
+	ps.entries[key] = peerEntry{Key: key, Origin: ps.id, Healthy: healthy, At: ps.clock.Now(), Reason: boundReason(reason)}
+	ps.mu.Unlock()
+	select {
+	case ps.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Start receives and sends until ctx is done, then closes the connection.
+func (ps *PeerSync) Start(ctx context.Context) {
+	go ps.receive()
+	ticker := ps.clock.NewTicker(peerSyncInterval)
+	defer ticker.Stop()
+	defer ps.conn.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		case <-ps.kick:
+		}
+		ps.broadcast()
+	}
+}
+
+// receive handles datagrams until the connection is closed.
+func (ps *PeerSync) receive() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := ps.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		ps.handle(buf[:n], addr.String())
+	}
+}
+
+// sign prepends body's MAC with a secret.
+func (ps *PeerSync) sign(body []byte) []byte {
+	if ps.secret == nil {
+		return body
+	}
+	mac := hmac.New(sha256.New, ps.secret)
+	mac.Write(body)
+	return append(mac.Sum(make([]byte, 0, sha256.Size+len(body))), body...)
+}
+
+// verify returns a datagram's body, ok false if its MAC does not match.
+func (ps *PeerSync) verify(datagram []byte) (body []byte, ok bool) {
+	if ps.secret == nil {
+		return datagram, true
+	}
+	if len(datagram) < sha256.Size {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, ps.secret)
+	mac.Write(datagram[sha256.Size:])
+	return datagram[sha256.Size:], hmac.Equal(mac.Sum(nil), datagram[:sha256.Size])
+}
+
+// handle merges a datagram from addr into the table.
+func (ps *PeerSync) handle(datagram []byte, addr string) {
+	body, ok := ps.verify(datagram)
+	var msg peerMessage
+	if !ok || json.Unmarshal(body, &msg) != nil || msg.From == "" {
+		ps.dropped.Add(1)
+		return
+	}
+	if msg.From == ps.id {
+		return // our own, through a peer list naming us
+	}
+	now := ps.clock.Now()
+	var apply []peerEntry
+	ps.mu.Lock()
+	st := ps.heard[msg.From]
+	if st == nil {
+		st = &PeerStatus{ID: msg.From}
+		ps.heard[msg.From] = st
+	}
+	st.Addr, st.LastHeard = addr, now
+	if msg.Inflight != nil {
+		st.Inflight = msg.Inflight
+	}
+	for _, e := range msg.Entries {
+		if now.Sub(e.At) > peerEntryTTL {
+			continue
+		}
+		if old, ok := ps.entries[e.Key]; ok && !e.newer(old) {
+			continue
+		}
+		ps.entries[e.Key] = e
+		if !e.Healthy && e.Origin != ps.id {
+			apply = append(apply, e)
+		}
+	}
+	ps.mu.Unlock()
+	for _, e := range apply {
+		ps.apply(e)
+	}
+}
+
+// apply takes a backend a peer reports unhealthy out of rotation, if local
+// observations allow.
+func (ps *PeerSync) apply(e peerEntry) {
+	escaped, id, ok := strings.Cut(e.Key, "/")
+	name, err := url.PathUnescape(escaped)
+	if !ok || err != nil || ps.pools[name] == nil {
+		return
+	}
+	for _, b := range ps.pools[name].GetBackends() {
+		if b.ID() == id && b.peerMarkUnhealthy(e.At, peerReasonPrefix+e.Origin+": "+e.Reason) {
+			ps.applied.Add(1)
+		}
+	}
+}
+
+// peerMarkUnhealthy marks the backend unhealthy on a peer's report of a
+// failure at, unless it is unhealthy already or a health check has passed
+// here since. It reports whether it did.
+func (b *Backend) peerMarkUnhealthy(at time.Time, reason string) bool {
+	b.mu.Lock()
+	if !b.healthy || !b.lastProbeOK.IsZero() && !at.After(b.lastProbeOK) || b.overriddenLocked(b.clock.Now()) {
+		b.mu.Unlock()
+		return false
+	}
+	b.markUnhealthyLocked(b.clock.Now(), boundReason(reason))
+	b.peerDown = true
+	b.mu.Unlock()
+	b.rotationChanged()
+	b.logger.Printf("[PEER] %s marked as unhealthy (%s)", b.ID(), reason)
+	b.hooks.fire(b, false, reason)
+	return true
+}
+
+// broadcast sends the table and this replica's load to every peer.
+func (ps *PeerSync) broadcast() {
+	now := ps.clock.Now()
+	inflight := make(map[string]int)
+	for name, p := range ps.pools {
+		for _, b := range p.GetBackends() {
+			inflight[peerKey(name, b.ID())] = b.GetActiveConns()
+		}
+	}
+	ps.mu.Lock()
+	entries := make([]peerEntry, 0, len(ps.entries))
+	for key, e := range ps.entries {
+		if now.Sub(e.At) > peerEntryTTL {
+			delete(ps.entries, key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	ps.mu.Unlock()
+	slices.SortFunc(entries, func(a, b peerEntry) int { return cmp.Compare(a.Key, b.Key) })
+
+	var datagrams [][]byte
+	for i := 0; i == 0 || i < len(entries); i += peerBatch {
+		msg := peerMessage{From: ps.id, Entries: entries[i:min(i+peerBatch, len(entries))]}
+		if i == 0 {
+			msg.Inflight = inflight
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		datagrams = append(datagrams, ps.sign(body))
+	}
+	for _, peer := range ps.peers {
+		ps.noteSend(peer, ps.send(peer, datagrams))
+	}
+}
+
+// send writes datagrams to peer.
+func (ps *PeerSync) send(peer string, datagrams [][]byte) error {
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return err
+	}
+	for _, d := range datagrams {
+		if _, err := ps.conn.WriteTo(d, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noteSend records a send's outcome, logging when a peer becomes
+// unreachable or reachable again.
+func (ps *PeerSync) noteSend(peer string, err error) {
+	msg := ""
+	if err != nil {
+		msg = rootCause(err)
+	}
+	ps.mu.Lock()
+	was := ps.sendErrs[peer]
+	ps.sendErrs[peer] = msg
+	ps.mu.Unlock()
+	switch {
+	case msg == was:
+	case msg != "":
+		ps.logger.Printf("[PEER] cannot send to %s: %s", peer, msg)
+	default:
+		ps.logger.Printf("[PEER] sending to %s again", peer)
+	}
+}
+
+// PeerStatus is a replica heard from.
+type PeerStatus struct {
+	ID        string    `json:"id"`
+	Addr      string    `json:"addr"`
+	LastHeard time.Time `json:"last_heard"`
+	// Inflight is the replica's requests in flight by backend
+	Inflight map[string]int `json:"inflight,omitempty"`
+}
+
+// PeerBackendState is a backend's latest transition in the table.
+type PeerBackendState struct {
+	Backend string    `json:"backend"`
+	State   string    `json:"state"`
+	At      time.Time `json:"at"`
+	Origin  string    `json:"origin"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// PeerSyncStats is GET /admin/peers: the replica, its peers, and the table.
+type PeerSyncStats struct {
+	ID    string       `json:"id"`
+	Peers []string     `json:"peers"`
+	Heard []PeerStatus `json:"heard"`
+	// SendErrors is the peers whose last send failed, and why
+	SendErrors map[string]string  `json:"send_errors,omitempty"`
+	Backends   []PeerBackendState `json:"backends"`
+	// Applied counts peer reports that took a backend out of rotation,
+	// Dropped datagrams that failed to parse or verify
+	Applied uint64 `json:"applied"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Stats returns the sync's state.
+func (ps *PeerSync) Stats() PeerSyncStats {
+	s := PeerSyncStats{ID: ps.id, Peers: ps.peers, Heard: []PeerStatus{}, Backends: []PeerBackendState{},
+		Applied: ps.applied.Load(), Dropped: ps.dropped.Load()}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, st := range ps.heard {
+		s.Heard = append(s.Heard, *st)
+	}
+	for peer, err := range ps.sendErrs {
+		if err != "" {
+			if s.SendErrors == nil {
+				s.SendErrors = make(map[string]string)
+			}
+			s.SendErrors[peer] = err
+		}
+	}
+	for _, e := range ps.entries {
+		s.Backends = append(s.Backends, PeerBackendState{Backend: e.Key, State: stateName(e.Healthy), At: e.At, Origin: e.Origin, Reason: e.Reason})
+	}
+	slices.SortFunc(s.Heard, func(a, b PeerStatus) int { return cmp.Compare(a.ID, b.ID) })
+	slices.SortFunc(s.Backends, func(a, b PeerBackendState) int { return cmp.Compare(a.Backend, b.Backend) })
+	return s
+}
+
+// String describes the sync for the startup log.
+func (ps *PeerSync) String() string {
+	signed := "unsigned"
+	if ps.secret != nil {
+		signed = "signed"
+	}
+	return fmt.Sprintf("%s on %s, peers %s, %s", ps.id, ps.conn.LocalAddr(), strings.Join(ps.peers, ", "), signed)
+}
@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// peerPair starts two replicas' pools over the same backends, sharing
+// state through PeerSyncs on loopback UDP. a also has a peer that cannot
+// be resolved.
+func peerPair(t *testing.T) (a, b *Pool, psA, psB *PeerSync, logA *lineLogger) {
+	t.Helper()
+	var urls []string
+	for range 2 {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL)
+	}
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	connA, connB := listen(), listen()
+	logA = &lineLogger{}
+	var err error
+	if a, err = NewPool(urls, WithLogger(logA)); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = NewPool(urls, WithLogger(&lineLogger{})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = a.Close(); _ = b.Close() })
+	psA = NewPeerSync("lb-a", connA, []string{connB.LocalAddr().String(), "no-such-host.invalid:7946"}, WithLogger(logA))
+	psB = NewPeerSync("lb-b", connB, []string{connA.LocalAddr().String()}, WithLogger(&lineLogger{}))
+	for _, ps := range []*PeerSync{psA, psB} {
+		ps.SetSecret("s3cret")
+	}
+	psA.TrackPool("default", a)
+	psB.TrackPool("default", b)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go psA.Start(ctx)
+	go psB.Start(ctx)
+	return a, b, psA, psB, logA
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPeerSyncPropagatesFailure(t *testing.T) {
+	a, b, psA, psB, logA := peerPair(t)
+	failed := a.GetBackends()[0]
+	remote := b.GetBackends()[0]
+	key := peerKey("default", failed.ID())
+
+	start := time.Now()
+	failed.strike("proxy error: connection refused", true)
+	waitFor(t, "the failure to reach lb-b", func() bool { return !remote.IsHealthy() })
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("propagation took %v", took)
+	}
+	if _, _, reason := remote.HealthTransition(); reason != "peer lb-a: proxy error: connection refused" {
+		t.Errorf("reason %q", reason)
+	}
+	if !b.GetBackends()[1].IsHealthy() || !a.GetBackends()[1].IsHealthy() {
+		t.Error("the other backend went down")
+	}
+	if psB.Stats().Applied != 1 {
+		t.Errorf("applied %d", psB.Stats().Applied)
+	}
+
+	// lb-b does not announce the failure as its own, and lb-a hears from
+	// lb-b with its load.
+	waitFor(t, "lb-a to hear from lb-b", func() bool { return len(psA.Stats().Heard) == 1 })
+	heard := psA.Stats().Heard[0]
+	if heard.ID != "lb-b" || heard.Inflight[key] != 0 || len(heard.Inflight) != 2 {
+		t.Errorf("heard %+v", heard)
+	}
+	if bs := psB.Stats().Backends; len(bs) != 1 || bs[0].Backend != key || bs[0].Origin != "lb-a" || bs[0].State != "unhealthy" {
+		t.Errorf("lb-b table %+v", bs)
+	}
+
+	// The unreachable peer is reported, and changes nothing else.
+	if errs := psA.Stats().SendErrors; errs["no-such-host.invalid:7946"] == "" || len(errs) != 1 {
+		t.Errorf("send errors %v", errs)
+	}
+	if !strings.Contains(logA.String(), "[PEER] cannot send to no-such-host.invalid:7946") {
+		t.Errorf("log:\n%s", logA)
+	}
+
+	// One local pass puts a backend down on a peer's word back; lb-a,
+	// which saw the failure itself, needs its usual streak.
+	if !remote.RecordCheckSuccess() {
+		t.Error("peer-marked backend did not rejoin on a passing check")
+	}
+	if failed.RecordCheckSuccess() {
+		t.Error("locally failed backend rejoined on one check")
+	}
+	for range healthyThreshold - 1 {
+		failed.RecordCheckSuccess()
+	}
+	if !failed.IsHealthy() {
+		t.Fatal("lb-a's backend did not recover")
+	}
+	failed.hooks.fire(failed, true, "health checks passing") // as the health checker does
+	// lb-a's recovery replaces the failure in lb-b's table, without
+	// touching lb-b's backends.
+	waitFor(t, "the recovery to reach lb-b", func() bool {
+		bs := psB.Stats().Backends
+		return len(bs) == 1 && bs[0].State == "healthy"
+	})
+	if !remote.IsHealthy() {
+		t.Error("lb-b's backend went down again")
+	}
+}
+
+func TestPeerSyncAdvisory(t *testing.T) {
+	clock := newFakeClock(time.Now())
+	pool, err := NewPool([]string{"http://gpu-0", "http://gpu-1"}, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ps := NewPeerSync("lb-b", nil, nil, WithClock(clock), WithLogger(&lineLogger{}))
+	ps.SetSecret("s3cret")
+	ps.TrackPool("default", pool)
+	b0, b1 := pool.GetBackends()[0], pool.GetBackends()[1]
+	send := func(from string, entries ...peerEntry) {
+		body, _ := json.Marshal(peerMessage{From: from, Entries: entries})
+		ps.handle(ps.sign(body), "127.0.0.1:7946")
+	}
+	down := func(b *Backend, origin string, at time.Time) peerEntry {
+		return peerEntry{Key: peerKey("default", b.ID()), Origin: origin, At: at, Reason: "status: 503"}
+	}
+
+	// A local check passed after the peer's observation: it stands.
+	b0.RecordCheckSuccess()
+	send("lb-a", down(b0, "lb-a", clock.Now().Add(-time.Second)))
+	if !b0.IsHealthy() {
+		t.Error("a peer's older report overrode a local check")
+	}
+	// A later one does not.
+	clock.advance(time.Second)
+	send("lb-a", down(b0, "lb-a", clock.Now()))
+	if b0.IsHealthy() {
+		t.Error("a peer's newer report was not applied")
+	}
+	// An older report of the same backend loses to the table's entry
+	// (last writer wins), whoever sends it.
+	send("lb-c", down(b0, "lb-c", clock.Now().Add(-time.Millisecond)))
+	if e := ps.entries[peerKey("default", b0.ID())]; e.Origin != "lb-a" {
+		t.Errorf("table entry from %s, want lb-a", e.Origin)
+	}
+	// Stale reports are neither applied nor kept.
+	send("lb-a", down(b1, "lb-a", clock.Now().Add(-peerEntryTTL-time.Second)))
+	if !b1.IsHealthy() || len(ps.entries) != 1 {
+		t.Errorf("stale report applied or kept: %v", ps.entries)
+	}
+	// Reports from a peer's peers travel with its table.
+	send("lb-c", down(b1, "lb-a", clock.Now()))
+	if b1.IsHealthy() {
+		t.Error("forwarded report not applied")
+	}
+	// A peer's healthy report does not put a backend back.
+	healthy := down(b1, "lb-a", clock.Now().Add(time.Second))
+	healthy.Healthy = true
+	send("lb-a", healthy)
+	if b1.IsHealthy() {
+		t.Error("a peer's healthy report put the backend back")
+	}
+	if ps.Stats().Applied != 2 || ps.Stats().Dropped != 0 {
+		t.Errorf("stats %+v", ps.Stats())
+	}
+
+	// Unsigned or wrongly signed datagrams are dropped.
+	b0.RecordCheckSuccess()
+	clock.advance(time.Second)
+	body, _ := json.Marshal(peerMessage{From: "lb-x", Entries: []peerEntry{down(b0, "lb-x", clock.Now())}})
+	ps.handle(body, "10.0.0.9:7946")
+	other := NewPeerSync("lb-x", nil, nil)
+	other.SetSecret("guess")
+	ps.handle(other.sign(body), "10.0.0.9:7946")
+	if !b0.IsHealthy() || ps.Stats().Dropped != 2 {
+		t.Errorf("forged reports applied: healthy %v, dropped %d", b0.IsHealthy(), ps.Stats().Dropped)
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// ProxyPolicy bounds bodies and strips headers on the way through the proxy.
+// Hop-by-hop headers (Connection and the headers it lists, Keep-Alive,
+// Transfer-Encoding, ...) are always removed in both directions by
+// ReverseProxy; the Strip lists add deployment-specific ones, e.g. internal
+// auth headers clients must not inject, or backend debug headers.
+type ProxyPolicy struct {
+	// MaxRequestBody rejects larger request bodies with 413 (0 = unlimited).
+	MaxRequestBody int64
+	// MaxResponseBody rejects larger responses with 502 when the backend
+	// declares a Content-Length; a streamed response crossing the limit is
+	// aborted mid-body (0 = unlimited, streams untouched).
+	MaxResponseBody      int64
+	StripRequestHeaders  []string
+	StripResponseHeaders []string
+	// Response header limits (0 = unlimited): total bytes as on the wire,
+	// number of header lines, and the length of any single value.
+	MaxResponseHeaderBytes int
+	MaxResponseHeaders     int
+	MaxResponseHeaderValue int
+	// RejectOversizedHeaders turns an over-limit response into a 502
+	// instead of dropping the offending headers.
+	RejectOversizedHeaders bool
+}
+
+var (
+	errResponseTooLarge        = errors.New("response body too large")
+	errResponseHeadersTooLarge = errors.New("response headers over limit")
+)
+
+// protectedHeaders are never dropped by the header limits, and count
+// against them first: without them the body cannot be interpreted.
+var protectedHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding"}
+
+// SetProxyPolicy sets the pool's body limits and header stripping.
+// Call before serving traffic.
+func (p *Pool) SetProxyPolicy(pp ProxyPolicy) {
+	p.policy = pp
+	for _, b := range p.GetBackends() {
+		b.policy = pp
+	}
+}
+
+// applyRequestPolicy strips configured request headers and bounds the
+// request body. It writes a 413 and returns false when the declared
+// Content-Length is already over the limit; bodies without one are cut off
+// while streaming, which the proxy's ErrorHandler reports as 413. A
+// streaming upload's route may set its own limit.
+func (p *Pool) applyRequestPolicy(w http.ResponseWriter, r *http.Request) bool {
+	for _, h := range p.policy.StripRequestHeaders {
+		r.Header.Del(h)
+	}
+	limit := p.policy.MaxRequestBody
+	if upload, ok := streamingUpload(r); ok && upload > 0 {
+		limit = upload
+	}
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		bodyTooLargeError.write(w, r, p.errorFormat)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// applyResponsePolicy strips configured response headers and bounds the
+// response headers and body. Called from ModifyResponse; an error becomes a
+// 502. headersOK is false when the headers broke a limit, truncated or not.
+func (b *Backend) applyResponsePolicy(resp *http.Response) (headersOK bool, err error) {
+	for _, h := range b.policy.StripResponseHeaders {
+		resp.Header.Del(h)
+	}
+	if headersOK, err = b.limitResponseHeaders(resp); err != nil {
+		return false, err
+	}
+	limit := b.policy.MaxResponseBody
+	if limit <= 0 {
+		return headersOK, nil
+	}
+	if resp.ContentLength > limit {
+		return headersOK, fmt.Errorf("%w: %d bytes, limit %d", errResponseTooLarge, resp.ContentLength, limit)
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit}
+	return headersOK, nil
+}
+
+// limitedBody fails the read that would exceed the limit, so the proxy's
+// copy aborts instead of silently truncating the response.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	n, err := lb.ReadCloser.Read(p)
+	lb.remaining -= int64(n)
+	if lb.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	return n, err
+}
+
+// limitResponseHeaders enforces the response header limits. Headers are
+// kept in order — protected ones first, then by name — until a limit is
+// reached; values over the per-value limit are skipped. In reject mode any
+// violation is an error, otherwise the rest are dropped and logged. Either
+// way the violation is counted and reported as !ok, failing the response
+// for outlier detection: a backend emitting runaway headers is misbehaving.
+func (b *Backend) limitResponseHeaders(resp *http.Response) (ok bool, err error) {
+	pp := b.policy
+	if pp.MaxResponseHeaderBytes <= 0 && pp.MaxResponseHeaders <= 0 && pp.MaxResponseHeaderValue <= 0 {
+		return true, nil
+	}
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		if !slices.Contains(protectedHeaders, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	names = append(slices.Clone(protectedHeaders), names...)
+
+	kept := make(http.Header, len(resp.Header))
+	var count, size, total, dropped int
+	for _, name := range names {
+		protected := slices.Contains(protectedHeaders, name)
+		for _, v := range resp.Header[name] {
+			total++
+			n := len(name) + len(v) + len(": \r\n")
+			if !protected && (pp.MaxResponseHeaderValue > 0 && len(v) > pp.MaxResponseHeaderValue ||
+				pp.MaxResponseHeaders > 0 && count >= pp.MaxResponseHeaders ||
+				pp.MaxResponseHeaderBytes > 0 && size+n > pp.MaxResponseHeaderBytes) {
+				dropped++
+				continue
+			}
+			count++
+			size += n
+			kept[name] = append(kept[name], v)
+		}
+	}
+	if dropped == 0 {
+		return true, nil
+	}
+
+	b.headerViolations.Add(1)
+	if pp.RejectOversizedHeaders {
+		return false, fmt.Errorf("%w: %d of %d header values", errResponseHeadersTooLarge, dropped, total)
+	}
+	b.logger.Printf("[PROXY] %s %v: dropped %d of %d header values", b.ID(), errResponseHeadersTooLarge, dropped, total)
+	resp.Header = kept
+	return false, nil
+}
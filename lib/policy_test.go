@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newPolicyLB(t *testing.T, backend http.HandlerFunc, pp ProxyPolicy) (*Pool, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+	pool, err := NewPool([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetProxyPolicy(pp)
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	return pool, lb
+}
+
+func TestMaxRequestBody(t *testing.T) {
+	var served int
+	pool, lb := newPolicyLB(t, func(w http.ResponseWriter, r *http.Request) {
+		served++
+		_, _ = io.Copy(io.Discard, r.Body)
+	}, ProxyPolicy{MaxRequestBody: 16})
+
+	post := func(body io.Reader) int {
+		t.Helper()
+		resp, err := http.Post(lb.URL+"/v1/completions", "application/json", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(strings.NewReader(`{"prompt":"hi"}`)); code != http.StatusOK {
+		t.Errorf("small body = %d, want 200", code)
+	}
+	if code := post(strings.NewReader(strings.Repeat("x", 17))); code != http.StatusRequestEntityTooLarge || served != 1 {
+		t.Errorf("declared oversized body = %d (backend hit %d times), want 413 before proxying", code, served)
+	}
+	// Without a Content-Length the limit is enforced while streaming.
+	if code := post(io.MultiReader(strings.NewReader(strings.Repeat("x", 64)))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("streamed oversized body = %d, want 413", code)
+	}
+	if !pool.GetBackends()[0].IsHealthy() {
+		t.Error("oversized request marked the backend unhealthy")
+	}
+}
+
+func TestHeaderStripping(t *testing.T) {
+	var got http.Header
+	_, lb := newPolicyLB(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("X-Debug-Trace", "internal")
+		w.Header().Set("X-Request-Id", "abc")
+	}, ProxyPolicy{
+		StripRequestHeaders:  []string{"X-Internal-Auth"},
+		StripResponseHeaders: []string{"X-Debug-Trace"},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, lb.URL+"/v1/models", nil)
+	req.Header.Set("X-Internal-Auth", "forged")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Authorization", "Bearer k")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if got.Get("X-Internal-Auth") != "" || got.Get("X-Hop") != "" {
+		t.Errorf("backend saw stripped headers: %v", got)
+	}
+	if got.Get("Authorization") != "Bearer k" {
+		t.Error("unlisted request header was removed")
+	}
+	if resp.Header.Get("X-Debug-Trace") != "" || resp.Header.Get("X-Request-Id") != "abc" {
+		t.Errorf("response headers = %v, want only X-Debug-Trace removed", resp.Header)
+	}
+}
+
+func TestMaxResponseBody(t *testing.T) {
+	pool, lb := newPolicyLB(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// Flushing first forces chunked encoding: no Content-Length.
+			_ = http.NewResponseController(w).Flush()
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", 64)))
+	}, ProxyPolicy{MaxResponseBody: 32})
+
+	resp, err := http.Get(lb.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("oversized response = %d, want 502", resp.StatusCode)
+	}
+
+	if resp, err := http.Get(lb.URL + "/stream"); err == nil {
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err == nil {
+			t.Errorf("streamed oversized response read in full (%d bytes), want it cut off", len(body))
+		}
+	}
+	if !pool.GetBackends()[0].IsHealthy() {
+		t.Error("oversized response marked the backend unhealthy")
+	}
+}
+
+func TestNoResponseLimitStreamsUntouched(t *testing.T) {
+	_, lb := newPolicyLB(t, func(w http.ResponseWriter, r *http.Request) {
+		for range 4 {
+			_, _ = w.Write([]byte("data: chunk\n\n"))
+			_ = http.NewResponseController(w).Flush()
+		}
+	}, ProxyPolicy{MaxRequestBody: 1 << 20})
+
+	resp, err := http.Get(lb.URL + "/v1/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || strings.Count(string(body), "chunk") != 4 {
+		t.Errorf("stream = %q, %v; want all 4 chunks", body, err)
+	}
+}
+
+func TestResponseHeaderLimits(t *testing.T) {
+	pathological := func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for i := range 5000 {
+			h.Add("Set-Cookie", fmt.Sprintf("session%d=%s", i, strings.Repeat("x", 40)))
+		}
+		h.Set("X-Debug", strings.Repeat("d", 4096))
+		h.Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}
+	limits := ProxyPolicy{MaxResponseHeaderBytes: 8 << 10, MaxResponseHeaders: 50, MaxResponseHeaderValue: 1024}
+
+	pool, lb := newPolicyLB(t, pathological, limits)
+	resp, err := http.Get(lb.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != `{"ok":true}` {
+		t.Fatalf("truncate: status %d body %q, want the response with headers dropped", resp.StatusCode, body)
+	}
+	if n := len(resp.Header.Values("Set-Cookie")); n == 0 || n >= 50 {
+		t.Errorf("truncate: %d Set-Cookie headers forwarded, want some but under the limit", n)
+	}
+	if resp.Header.Get("X-Debug") != "" {
+		t.Error("truncate: over-long header value forwarded")
+	}
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Error("truncate: Content-Type dropped")
+	}
+	if st := pool.Stats().Backends[0]; st.HeaderLimitViolations != 1 || !st.Healthy {
+		t.Errorf("truncate: violations %d healthy %v, want 1 and still healthy", st.HeaderLimitViolations, st.Healthy)
+	}
+
+	limits.RejectOversizedHeaders = true
+	pool, lb = newPolicyLB(t, pathological, limits)
+	resp, err = http.Get(lb.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("reject: status %d, want 502 with no backend headers", resp.StatusCode)
+	}
+	if st := pool.Stats().Backends[0]; st.HeaderLimitViolations != 1 || st.Healthy {
+		t.Errorf("reject: violations %d healthy %v, want 1 and marked unhealthy", st.HeaderLimitViolations, st.Healthy)
+	}
+}
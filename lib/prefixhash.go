@@ -0,0 +1,343 @@
+package lib
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Prefix-hash routing (--routing prefix-hash): a POST to /v1/completions or
+// /v1/chat/completions is routed by a hash of the start of its prompt, so
+// requests sharing a system prompt land on the backend holding its prefix
+// cache. The body, up to a size cap, is read and re-buffered byte for byte
+// (replayable for transport retries); the first configured field path
+// present in it ("messages[0].content", then "prompt") gives the text, whose
+// first N bytes are hashed onto a consistent-hash ring of the pool's
+// backends. Adding or removing a backend only moves the keys it owns. When
+// the key's backend is unavailable or at its cap, the next one along the
+// ring serves the request. Requests over the cap, without the field, or to
+// other paths are routed least-conn; so is a key whose ring has no
+// selectable backend. Unlike cache-aware routing nothing is remembered per
+// request, and zones and priority tiers are not considered for hashed
+// requests.
+
+// Prefix-hash defaults.
+const (
+	// DefaultPrefixHashBytes is how much of the field's text is hashed.
+	DefaultPrefixHashBytes = 1024
+	// DefaultPrefixHashMaxBody is the largest body read for its key.
+	DefaultPrefixHashMaxBody = 1 << 20
+)
+
+// DefaultPrefixHashFields are the field paths tried in order: the first
+// chat message (the system prompt), then a completion's prompt.
+var DefaultPrefixHashFields = []string{"messages[0].content", "prompt"}
+
+// ringReplicas is the number of ring points per backend, evening out the
+// share of keys each owns.
+const ringReplicas = 160
+
+// PrefixHashConfig configures prefix-hash routing. Zero values take the
+// defaults above.
+type PrefixHashConfig struct {
+	// Fields are JSON field paths ("messages[0].content"): object keys
+	// separated by dots, array indexes in brackets. A string's text is
+	// hashed, any other value's JSON.
+	Fields []string `json:"fields"`
+	// PrefixBytes is how much of the field's text is hashed.
+	PrefixBytes int `json:"prefix_bytes"`
+	// MaxBody is the largest body read for its key; larger ones are routed
+	// least-conn.
+	MaxBody int64 `json:"max_body"`
+}
+
+// pathStep is one step of a field path: an object key, or an array index
+// when key is "".
+type pathStep struct {
+	key   string
+	index int
+}
+
+// parseFieldPath parses "messages[0].content".
+func parseFieldPath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	for part := range strings.SplitSeq(path, ".") {
+		key, rest, index := strings.Cut(part, "[")
+		if key == "" {
+			return nil, fmt.Errorf("invalid field path %q: empty key", path)
+		}
+		steps = append(steps, pathStep{key: key})
+		for index {
+			idx, after, ok := strings.Cut(rest, "]")
+			i, err := strconv.Atoi(idx)
+			if !ok || err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid field path %q: want key[index]", path)
+			}
+			steps = append(steps, pathStep{index: i})
+			if rest, index = strings.CutPrefix(after, "["); !index && after != "" {
+				return nil, fmt.Errorf("invalid field path %q: want key[index]", path)
+			}
+		}
+	}
+	return steps, nil
+}
+
+func (c PrefixHashConfig) validate() error {
+	for _, f := range c.Fields {
+		if _, err := parseFieldPath(f); err != nil {
+			return err
+		}
+	}
+	if c.PrefixBytes < 0 {
+		return fmt.Errorf("prefix hash bytes cannot be negative, got %d", c.PrefixBytes)
+	}
+	if c.MaxBody < 0 {
+		return fmt.Errorf("prefix hash max body cannot be negative, got %d", c.MaxBody)
+	}
+	return nil
+}
+
+// ringPoint is one of a backend's points on the ring.
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// prefixHash is a pool's prefix-hash routing state.
+type prefixHash struct {
+	paths       [][]pathStep
+	prefixBytes int
+	maxBody     int64
+	// ring is sorted by hash; rebuilt under the pool lock when the backend
+	// set changes
+	ring []ringPoint
+
+	hashed, spilled, missing, oversized atomic.Uint64
+}
+
+// EnablePrefixHash switches the pool to prefix-hash routing (see above).
+// Call before serving traffic.
+func (p *Pool) EnablePrefixHash(cfg PrefixHashConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	ph := &prefixHash{
+		prefixBytes: cmp.Or(cfg.PrefixBytes, DefaultPrefixHashBytes),
+		maxBody:     cmp.Or(cfg.MaxBody, DefaultPrefixHashMaxBody),
+	}
+	fields := cfg.Fields
+	if len(fields) == 0 {
+		fields = DefaultPrefixHashFields
+	}
+	for _, f := range fields {
+		steps, _ := parseFieldPath(f) // validated
+		ph.paths = append(ph.paths, steps)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prefixHash = ph
+	ph.rebuildLocked(p.GetBackends())
+	return nil
+}
+
+// mix64 spreads an FNV hash's bits (the splitmix64 finalizer), so ring
+// points of similar IDs and keys of similar prompts do not cluster.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return mix64(h.Sum64())
+}
+
+// rebuildLocked lays backends out on the ring. Nil-safe; callers must hold
+// the pool lock.
+func (ph *prefixHash) rebuildLocked(backends []*Backend) {
+	if ph == nil {
+		return
+	}
+	ring := make([]ringPoint, 0, len(backends)*ringReplicas)
+	for _, b := range backends {
+		for i := range ringReplicas {
+			ring = append(ring, ringPoint{hashBytes(binary.BigEndian.AppendUint32([]byte(b.ID()+"#"), uint32(i))), b})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+	ph.ring = ring
+}
+
+// prefixHashPath reports whether requests to path are routed by prefix.
+func prefixHashPath(path string) bool {
+	return path == "/v1/completions" || path == "/v1/chat/completions"
+}
+
+// key returns the ring key of r, re-buffering the body it reads; ok is
+// false when r is routed least-conn instead. err is a failure to read the
+// body, answered with writeBodyError.
+func (ph *prefixHash) key(r *http.Request) (key uint64, ok bool, err error) {
+	if r.Method != http.MethodPost || !prefixHashPath(r.URL.Path) || r.Body == nil || r.Body == http.NoBody {
+		return 0, false, nil
+	}
+	if r.ContentLength > ph.maxBody {
+		ph.oversized.Add(1)
+		return 0, false, nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, ph.maxBody+1))
+	if err != nil {
+		return 0, false, err
+	}
+	if int64(len(raw)) > ph.maxBody {
+		// A chunked body over the cap: send what was read, then the rest.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), r.Body), r.Body}
+		ph.oversized.Add(1)
+		return 0, false, nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(raw)), nil
+	}
+	r.ContentLength = int64(len(raw))
+
+	for _, path := range ph.paths {
+		if text := fieldText(raw, path); len(text) > 0 {
+			ph.hashed.Add(1)
+			return hashBytes(text[:min(len(text), ph.prefixBytes)]), true, nil
+		}
+	}
+	ph.missing.Add(1)
+	return 0, false, nil
+}
+
+// fieldText returns the text at path in the JSON document raw: a string's
+// contents, any other value's JSON, nil when absent or null.
+func fieldText(raw []byte, path []pathStep) []byte {
+	v := json.RawMessage(raw)
+	for _, step := range path {
+		if step.key != "" {
+			var obj map[string]json.RawMessage
+			if json.Unmarshal(v, &obj) != nil {
+				return nil
+			}
+			v = obj[step.key]
+		} else {
+			var arr []json.RawMessage
+			if json.Unmarshal(v, &arr) != nil || step.index >= len(arr) {
+				return nil
+			}
+			v = arr[step.index]
+		}
+		if v == nil {
+			return nil
+		}
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return []byte(s)
+	}
+	if bytes.Equal(bytes.TrimSpace(v), []byte("null")) {
+		return nil
+	}
+	return v
+}
+
+// selectHashed returns the selection of a request with key: the first
+// selectable backend along the ring with rt's labels, or def's pick when
+// there is none.
+func (p *Pool) selectHashed(key uint64, rt *headerRoute, def func() (*Backend, error)) func() (*Backend, error) {
+	return func() (*Backend, error) {
+		for {
+			p.mu.Lock()
+			b, count := p.ringBackendLocked(key, rt.labels())
+			p.mu.Unlock()
+			if b == nil {
+				return def()
+			}
+			if b.reserveConn(count) {
+				return b, nil
+			}
+		}
+	}
+}
+
+// ringBackendLocked walks the ring from key to the first selectable backend
+// with match's labels that is not at its cap, nil when there is none, with
+// the active count to reserve it at. Callers must hold p.mu.
+func (p *Pool) ringBackendLocked(key uint64, match map[string]string) (*Backend, int) {
+	ph := p.prefixHash
+	ring := ph.ring
+	if len(ring) == 0 {
+		return nil, 0
+	}
+	s := p.snapshot()
+	now := p.clock.Now()
+	start, _ := slices.BinarySearchFunc(ring, key, func(pt ringPoint, k uint64) int { return cmp.Compare(pt.hash, k) })
+	seen := make(map[*Backend]bool)
+	owner := true
+	for i := range ring {
+		b := ring[(start+i)%len(ring)].backend
+		if seen[b] || !b.hasLabels(match) {
+			continue
+		}
+		seen[b] = true
+		if e := p.candidate(s, b); e != nil {
+			if ok, count, load := p.load(e, now); ok && !math.IsInf(load, 1) {
+				if !owner {
+					ph.spilled.Add(1)
+				}
+				return b, count
+			}
+		}
+		owner = false
+	}
+	return nil, 0
+}
+
+// PrefixHashStats counts prefix-hash routing decisions in /stats: Hashed,
+// requests routed by their key; Spilled, those of them served past the
+// key's backend (unavailable or at its cap); Missing and Oversized,
+// requests routed least-conn for lack of the field or over the body cap.
+type PrefixHashStats struct {
+	Hashed    uint64 `json:"hashed"`
+	Spilled   uint64 `json:"spilled"`
+	Missing   uint64 `json:"missing"`
+	Oversized uint64 `json:"oversized"`
+}
+
+func (ph *prefixHash) stats() *PrefixHashStats {
+	return &PrefixHashStats{
+		Hashed:    ph.hashed.Load(),
+		Spilled:   ph.spilled.Load(),
+		Missing:   ph.missing.Load(),
+		Oversized: ph.oversized.Load(),
+	}
+}
+
+// writeBodyError answers a request whose body could not be read.
+func writeBodyError(w http.ResponseWriter, r *http.Request, f ErrorFormat, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		bodyTooLargeError.write(w, r, f)
+		return
+	}
+	apiError{http.StatusBadRequest, errTypeInvalidRequest, "invalid_request_body", "failed to read request body", nil}.write(w, r, f)
+}
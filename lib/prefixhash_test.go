@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	steps, err := parseFieldPath("messages[0].content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pathStep{{key: "messages"}, {index: 0}, {key: "content"}}
+	if fmt.Sprint(steps) != fmt.Sprint(want) {
+		t.Errorf("steps = %v, want %v", steps, want)
+	}
+	if steps, err := parseFieldPath("a[1][2]"); err != nil || len(steps) != 3 {
+		t.Errorf("a[1][2] = %v, %v", steps, err)
+	}
+	for _, bad := range []string{"", ".prompt", "messages[", "messages[x]", "messages[-1]", "messages[0]x", "[0]"} {
+		if _, err := parseFieldPath(bad); err == nil {
+			t.Errorf("parseFieldPath(%q): want an error", bad)
+		}
+	}
+}
+
+func TestFieldText(t *testing.T) {
+	chat := []byte(`{"model":"m","messages":[{"role":"system","content":"You are é helpful."},{"role":"user","content":"hi"}]}`)
+	parts := []byte(`{"messages":[{"role":"system","content":[{"type":"text","text":"sys"}]}]}`)
+	steps := func(path string) []pathStep {
+		s, err := parseFieldPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	for _, tc := range []struct {
+		raw  []byte
+		path string
+		want string
+	}{
+		{chat, "messages[0].content", "You are é helpful."},
+		{chat, "messages[1].role", "user"},
+		{parts, "messages[0].content", `[{"type":"text","text":"sys"}]`},
+		{[]byte(`{"prompt":"Once upon"}`), "prompt", "Once upon"},
+		{[]byte(`{"prompt":null}`), "prompt", ""},
+		{chat, "messages[2].content", ""},
+		{chat, "prompt", ""},
+		{[]byte(`not json`), "prompt", ""},
+	} {
+		if got := string(fieldText(tc.raw, steps(tc.path))); got != tc.want {
+			t.Errorf("fieldText(%s, %s) = %q, want %q", tc.raw, tc.path, got, tc.want)
+		}
+	}
+}
+
+// chatRequest is a canned chat completion request.
+func chatRequest(system, user string) string {
+	return fmt.Sprintf(`{"model":"llama","messages":[{"role":"system","content":%q},{"role":"user","content":%q}],"max_tokens":8}`, system, user)
+}
+
+func TestPrefixHashSamePrefixSameBackend(t *testing.T) {
+	backends := make([]*mockbackend.Server, 4)
+	urls := make([]string, len(backends))
+	for i := range backends {
+		backends[i] = mockbackend.Start(t, mockbackend.Config{ResponseSize: 16})
+		urls[i] = backends[i].URL
+	}
+	pool, err := NewPool(urls, WithStrategy(StrategyPrefixHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	used := make(map[int]bool)
+	for s := range 12 {
+		system := fmt.Sprintf("You are assistant %d. Answer briefly and cite sources.", s)
+		first := 0
+		for u := range 5 {
+			resp, err := http.Post(lb.URL+"/v1/chat/completions", "application/json", strings.NewReader(chatRequest(system, fmt.Sprintf("question %d", u))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body struct {
+				BackendPort int `json:"backend_port"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, %v", resp.StatusCode, err)
+			}
+			if u == 0 {
+				first = body.BackendPort
+			} else if body.BackendPort != first {
+				t.Errorf("system prompt %d: request %d served by port %d, the first by %d", s, u, body.BackendPort, first)
+			}
+		}
+		used[first] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("12 system prompts all hashed to one backend: %v", used)
+	}
+	if s := pool.Stats().PrefixHash; s == nil || s.Hashed != 60 || s.Missing != 0 {
+		t.Errorf("prefix hash stats = %+v, want 60 hashed", s)
+	}
+}
+
+func TestPrefixHashPreservesBody(t *testing.T) {
+	srv := echoServer(t)
+	pool, err := NewPool([]string{srv.URL}, WithStrategy(StrategyPrefixHash), WithPrefixHash(PrefixHashConfig{MaxBody: 256}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body io.Reader) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		pool.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", body))
+		return rec.Body.String()
+	}
+	exact := "{ \"messages\" : [ {\"role\":\"system\", \"content\":\"caf\\u00e9\"} ]\n,\t\"stream\":true }\n"
+	if got := send(strings.NewReader(exact)); got != "/v1/chat/completions:"+exact {
+		t.Errorf("hashed body arrived as %q", got)
+	}
+	if got := send(strings.NewReader(`{"input":"no prompt"}`)); got != `/v1/chat/completions:{"input":"no prompt"}` {
+		t.Errorf("body without the field arrived as %q", got)
+	}
+	// Over the cap with no Content-Length: the bytes read for the check are
+	// sent ahead of the rest.
+	large := chatRequest(strings.Repeat("long system prompt ", 30), "hi")
+	if got := send(io.MultiReader(strings.NewReader(large))); got != "/v1/chat/completions:"+large {
+		t.Errorf("oversized body arrived as %q", got)
+	}
+	if s := pool.Stats().PrefixHash; s.Hashed != 1 || s.Missing != 1 || s.Oversized != 1 {
+		t.Errorf("prefix hash stats = %+v, want one of each", s)
+	}
+}
+
+func TestPrefixHashBodyReplayable(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"}, WithStrategy(StrategyPrefixHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := chatRequest("system", "user")
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(raw))
+	if _, ok, err := pool.prefixHash.key(r); !ok || err != nil {
+		t.Fatalf("key: ok %v, err %v", ok, err)
+	}
+	for attempt := range 3 {
+		body := r.Body
+		if attempt > 0 {
+			if body, err = r.GetBody(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, _ := io.ReadAll(body); !bytes.Equal(got, []byte(raw)) {
+			t.Errorf("attempt %d sent %q", attempt, got)
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/chat/completions", strings.NewReader(raw))
+	if _, ok, _ := pool.prefixHash.key(r); ok {
+		t.Error("GET was hashed")
+	}
+	r = httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(raw))
+	if _, ok, _ := pool.prefixHash.key(r); ok {
+		t.Error("POST to /v1/embeddings was hashed")
+	}
+}
+
+func TestPrefixHashRing(t *testing.T) {
+	pool, err := NewPool([]string{"http://a", "http://b", "http://c", "http://d"}, WithStrategy(StrategyPrefixHash), WithMaxConns(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := func() map[uint64]*Backend {
+		m := make(map[uint64]*Backend)
+		for i := range 400 {
+			key := hashBytes(fmt.Appendf(nil, "prompt %d", i))
+			pool.mu.Lock()
+			m[key], _ = pool.ringBackendLocked(key, nil)
+			pool.mu.Unlock()
+		}
+		return m
+	}
+	before := owners()
+	perBackend := make(map[*Backend]int)
+	for _, b := range before {
+		perBackend[b]++
+	}
+	for _, b := range pool.GetBackends() {
+		if n := perBackend[b]; n < 50 || n > 150 {
+			t.Errorf("%s owns %d of 400 keys, want about 100", b.ID(), n)
+		}
+	}
+
+	// Removing a backend only moves its own keys.
+	removed, err := pool.RemoveBackend("http://b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, b := range owners() {
+		if was := before[key]; was != removed && b != was {
+			t.Errorf("key owned by %s moved to %s", was.ID(), b.ID())
+		}
+	}
+
+	// A key whose backend is at its cap spills to the next along the ring.
+	key := hashBytes([]byte("prompt 0"))
+	pool.mu.Lock()
+	owner, _ := pool.ringBackendLocked(key, nil)
+	owner.IncrementConns()
+	next, _ := pool.ringBackendLocked(key, nil)
+	pool.mu.Unlock()
+	if next == nil || next == owner {
+		t.Errorf("at capacity: got %v, want another backend than %s", next, owner.ID())
+	}
+	if pool.prefixHash.spilled.Load() != 1 {
+		t.Errorf("spilled = %d, want 1", pool.prefixHash.spilled.Load())
+	}
+}
@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Priority tiers: a backend given as "http://cloud:8000,priority=1" (flag or
+// config file) is only used when every backend of a lower priority number is
+// unhealthy, ejected, draining, or at --max-conns. Unmarked backends have
+// priority 0. Selection always starts from the lowest tier, so traffic
+// returns to the primaries with the first request after one recovers or
+// frees a slot. Tier changes are logged once and the serving tier is in
+// /stats.
+
+// BackendSpec is a backend as given on the command line or in a config
+// file, its URL followed by any of these attributes, in any order:
+//
+//	URL[,priority=N][,max_conns=N][,max_mbps=N][,timeout=D]
+//	   [,health=URL][,check=KIND][,check_cmd=CMD]
+//	   [,decorator=NAME][,upstream_key=KEY][,prefix=PATH]
+//	   [,family=ipv4|ipv6][,proxy=URL][,send_proxy=v1|v2][,key=value...]
+type BackendSpec struct {
+	URL      string
+	Priority int
+	// MaxConns caps the backend's concurrent requests, overriding the
+	// pool's --max-conns; 0 leaves the pool's
+	MaxConns int
+	// MaxMbps caps the backend's response throughput in megabits per
+	// second, 0 for none (see bandwidth.go)
+	MaxMbps float64
+	// Timeout bounds each request's time at the backend, 0 for none (see
+	// timeout.go)
+	Timeout time.Duration
+	// Health is the URL the backend is probed at instead of the pool's
+	// health path under its URL (see healthcheck.go)
+	Health string
+	// Check is the backend's probe kind, overriding the pool's (see
+	// prober.go)
+	Check string
+	// CheckCmd is the command exec probes run for the backend, its
+	// arguments split at spaces (see execprobe.go)
+	CheckCmd string
+	// Decorator names the backend's request decorator (see decorator.go)
+	Decorator string
+	// UpstreamKey replaces the client's bearer key on the backend's
+	// requests (see apikeys.go)
+	UpstreamKey string
+	// Prefix is prepended to the paths the backend is sent, in escaped
+	// form (see pathrewrite.go)
+	Prefix string
+	// Family pins the address family the backend is dialed over, "" for
+	// either (see addrfamily.go)
+	Family string
+	// Proxy is the forward proxy the backend is reached through instead of
+	// the transport's (see fwdproxy.go)
+	Proxy string
+	// SendProxy is the PROXY protocol version (v1 or v2) the backend's
+	// connections open with, "" for none (see proxyproto.go)
+	SendProxy string
+	// Labels are the other key=value attributes (see locality.go)
+	Labels map[string]string
+}
+
+// ParseBackendSpec splits a backend given as its URL and attributes (see
+// BackendSpec).
+func ParseBackendSpec(raw string) (BackendSpec, error) {
+	rawURL, attrs, hasAttrs := strings.Cut(raw, ",")
+	spec := RedactBackendSpec(raw) // for errors
+	s := BackendSpec{URL: rawURL}
+	if !hasAttrs {
+		return s, nil
+	}
+	for attr := range strings.SplitSeq(attrs, ",") {
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return BackendSpec{}, fmt.Errorf("backend %q: attribute %q is not key=value", spec, attr)
+		}
+		if key == "priority" {
+			priority, err := strconv.Atoi(value)
+			if err != nil || priority < 0 {
+				return BackendSpec{}, fmt.Errorf("backend %q: priority must be a non-negative integer", spec)
+			}
+			s.Priority = priority
+			continue
+		}
+		if key == "max_conns" {
+			maxConns, err := strconv.Atoi(value)
+			if err != nil || maxConns < 0 {
+				return BackendSpec{}, fmt.Errorf("backend %q: max_conns must be a non-negative integer", spec)
+			}
+			s.MaxConns = maxConns
+			continue
+		}
+		if key == "max_mbps" {
+			maxMbps, err := strconv.ParseFloat(value, 64)
+			if err != nil || maxMbps <= 0 || math.IsInf(maxMbps, 0) {
+				return BackendSpec{}, fmt.Errorf("backend %q: max_mbps must be a positive number", spec)
+			}
+			s.MaxMbps = maxMbps
+			continue
+		}
+		if key == "timeout" {
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return BackendSpec{}, fmt.Errorf("backend %q: timeout must be a positive duration like 5s", spec)
+			}
+			s.Timeout = timeout
+			continue
+		}
+		if key == "health" {
+			if err := validHealthURL(value); err != nil {
+				return BackendSpec{}, fmt.Errorf("backend %q: health URL %q: %w", spec, value, err)
+			}
+			s.Health = value
+			continue
+		}
+		if key == "check" {
+			if err := validHealthCheck(value); err != nil {
+				return BackendSpec{}, fmt.Errorf("backend %q: %w", spec, err)
+			}
+			s.Check = value
+			continue
+		}
+		if key == "check_cmd" {
+			if strings.TrimSpace(value) == "" {
+				return BackendSpec{}, fmt.Errorf("backend %q: check_cmd needs a command", spec)
+			}
+			s.CheckCmd = value
+			continue
+		}
+		if key == "decorator" {
+			if value == "" {
+				return BackendSpec{}, fmt.Errorf("backend %q: decorator needs a name", spec)
+			}
+			s.Decorator = value
+			continue
+		}
+		if key == "prefix" {
+			prefix, err := cleanPathPrefix(value)
+			if err != nil {
+				return BackendSpec{}, fmt.Errorf("backend %q: %w", spec, err)
+			}
+			s.Prefix = prefix
+			continue
+		}
+		if key == "family" {
+			if err := validFamily(value); err != nil {
+				return BackendSpec{}, fmt.Errorf("backend %q: %w", spec, err)
+			}
+			s.Family = value
+			continue
+		}
+		if key == "proxy" {
+			if _, err := ParseProxyURL(value); err != nil {
+				return BackendSpec{}, fmt.Errorf("backend %q: %w", spec, err)
+			}
+			s.Proxy = value
+			continue
+		}
+		if key == "send_proxy" {
+			if err := validSendProxy(value); err != nil {
+				return BackendSpec{}, fmt.Errorf("backend %q: %w", spec, err)
+			}
+			s.SendProxy = value
+			continue
+		}
+		if key == "upstream_key" {
+			if value == "" {
+				return BackendSpec{}, fmt.Errorf("backend %q: upstream_key needs a key", spec)
+			}
+			s.UpstreamKey = value
+			continue
+		}
+		if err := validLabel(key); err != nil {
+			return BackendSpec{}, fmt.Errorf("backend %q: %w", spec, err)
+		}
+		if s.Labels == nil {
+			s.Labels = make(map[string]string)
+		}
+		s.Labels[key] = value
+	}
+	if s.Decorator != "" && s.UpstreamKey != "" {
+		return BackendSpec{}, fmt.Errorf("backend %q: upstream_key and decorator both set the backend's credentials", spec)
+	}
+	if s.Family != "" && s.Proxy != "" {
+		return BackendSpec{}, fmt.Errorf("backend %q: family= does not apply through a proxy, which resolves the backend's name", spec)
+	}
+	if s.Check == HealthCheckExec && s.CheckCmd == "" {
+		return BackendSpec{}, fmt.Errorf("backend %q: check=exec needs a check_cmd", spec)
+	}
+	return s, nil
+}
+
+// String formats s back into a spec, labels sorted by key.
+func (s BackendSpec) String() string {
+	var b strings.Builder
+	b.WriteString(s.URL)
+	if s.Priority != 0 {
+		b.WriteString(",priority=" + strconv.Itoa(s.Priority))
+	}
+	if s.MaxConns != 0 {
+		b.WriteString(",max_conns=" + strconv.Itoa(s.MaxConns))
+	}
+	if s.MaxMbps != 0 {
+		b.WriteString(",max_mbps=" + strconv.FormatFloat(s.MaxMbps, 'g', -1, 64))
+	}
+	if s.Timeout != 0 {
+		b.WriteString(",timeout=" + s.Timeout.String())
+	}
+	if s.Health != "" {
+		b.WriteString(",health=" + s.Health)
+	}
+	if s.Check != "" {
+		b.WriteString(",check=" + s.Check)
+	}
+	if s.CheckCmd != "" {
+		b.WriteString(",check_cmd=" + s.CheckCmd)
+	}
+	if s.Decorator != "" {
+		b.WriteString(",decorator=" + s.Decorator)
+	}
+	if s.UpstreamKey != "" {
+		b.WriteString(",upstream_key=" + s.UpstreamKey)
+	}
+	if s.Prefix != "" {
+		b.WriteString(",prefix=" + s.Prefix)
+	}
+	if s.Family != "" {
+		b.WriteString(",family=" + s.Family)
+	}
+	if s.Proxy != "" {
+		b.WriteString(",proxy=" + s.Proxy)
+	}
+	if s.SendProxy != "" {
+		b.WriteString(",send_proxy=" + s.SendProxy)
+	}
+	for _, key := range slices.Sorted(maps.Keys(s.Labels)) {
+		b.WriteString("," + key + "=" + s.Labels[key])
+	}
+	return b.String()
+}
+
+// Priority returns the backend's tier; lower is preferred.
+func (b *Backend) Priority() int {
+	return b.priority
+}
+
+// noteTier logs a change of the tier serving new requests. saturated says
+// the lower tiers had healthy backends, all at the cap.
+func (p *Pool) noteTier(tier int, saturated bool) {
+	if !p.tiered.Load() {
+		return
+	}
+	prev := int(p.activeTier.Swap(int64(tier)))
+	if tier == prev {
+		return
+	}
+	switch {
+	case tier < prev:
+		p.logger.Printf("[TIER] %s back to priority %d (from %d)", metricsPoolName(p), tier, prev)
+	case saturated:
+		p.logger.Printf("[TIER] %s spilling over to priority %d: lower tiers at max-conns", metricsPoolName(p), tier)
+	default:
+		p.logger.Printf("[TIER] %s failing over to priority %d: no healthy backends in lower tiers", metricsPoolName(p), tier)
+	}
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBackendSpec(t *testing.T) {
+	for spec, want := range map[string]int{"http://a": 0, "http://a,priority=2": 2, "http://a,priority=0": 0} {
+		s, err := ParseBackendSpec(spec)
+		if err != nil || s.URL != "http://a" || s.Priority != want || s.Labels != nil {
+			t.Errorf("ParseBackendSpec(%q) = %+v, %v; want http://a, %d", spec, s, err, want)
+		}
+	}
+	s, err := ParseBackendSpec("http://a,zone=us-east-1a,priority=1,decorator=aws,max_conns=4,timeout=1m30s,gpu=a100")
+	if err != nil || s.Priority != 1 || s.MaxConns != 4 || s.Timeout != 90*time.Second || s.Decorator != "aws" || len(s.Labels) != 2 || s.Labels["zone"] != "us-east-1a" || s.Labels["gpu"] != "a100" {
+		t.Errorf("labels: %+v, %v", s, err)
+	}
+	if got := s.String(); got != "http://a,priority=1,max_conns=4,timeout=1m30s,decorator=aws,gpu=a100,zone=us-east-1a" {
+		t.Errorf("String() = %q", got)
+	}
+	for _, spec := range []string{"http://a,priority=-1", "http://a,priority=x", "http://a,weight", "http://a,", "http://a,1gpu=x", "http://a,pool=x", "http://a,__name__=x", "http://a,decorator=", "http://a,max_conns=-1", "http://a,max_conns=x", "http://a,timeout=0s", "http://a,timeout=5"} {
+		if _, err := ParseBackendSpec(spec); err == nil {
+			t.Errorf("ParseBackendSpec(%q) accepted", spec)
+		}
+	}
+}
+
+// servedBy selects n backends (releasing each slot) and counts picks by ID.
+func servedBy(t *testing.T, pool *Pool, n int) map[string]int {
+	t.Helper()
+	got := make(map[string]int)
+	for range n {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[b.ID()]++
+		b.DecrementConns()
+	}
+	return got
+}
+
+func TestPriorityFailoverAndRecovery(t *testing.T) {
+	out := captureLog(t)
+	pool, err := NewPool([]string{"http://p1", "http://p2", "http://backup,priority=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := pool.GetBackends()[0], pool.GetBackends()[1]
+
+	if got := servedBy(t, pool, 20); got["http://backup"] != 0 || got["http://p1"] == 0 || got["http://p2"] == 0 {
+		t.Errorf("with healthy primaries: %v, want only p1 and p2", got)
+	}
+	if tier := pool.Stats().ActiveTier; tier == nil || *tier != 0 {
+		t.Errorf("active tier = %v, want 0", tier)
+	}
+
+	p1.MarkUnhealthy()
+	if got := servedBy(t, pool, 10); got["http://p2"] != 10 {
+		t.Errorf("one primary down: %v, want all on p2", got)
+	}
+	p2.MarkUnhealthy()
+	if got := servedBy(t, pool, 10); got["http://backup"] != 10 {
+		t.Errorf("all primaries down: %v, want all on the backup", got)
+	}
+	if tier := pool.Stats().ActiveTier; tier == nil || *tier != 1 {
+		t.Errorf("active tier = %v, want 1", tier)
+	}
+
+	for !p1.RecordCheckSuccess() {
+	}
+	if got := servedBy(t, pool, 10); got["http://p1"] != 10 {
+		t.Errorf("primary recovered: %v, want all back on p1", got)
+	}
+
+	logs := out.String()
+	for _, want := range []string{"failing over to priority 1: no healthy backends", "back to priority 0 (from 1)"} {
+		if strings.Count(logs, want) != 1 {
+			t.Errorf("want %q logged once:\n%s", want, logs)
+		}
+	}
+}
+
+func TestPrioritySpilloverAtMaxConns(t *testing.T) {
+	out := captureLog(t)
+	pool, err := NewPool([]string{"http://p1", "http://p2", "http://burst,priority=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetMaxConns(1)
+
+	var held []*Backend
+	for range 2 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, b)
+	}
+	if held[0].Priority() != 0 || held[1].Priority() != 0 {
+		t.Fatalf("first picks %s, %s: want both primaries", held[0].ID(), held[1].ID())
+	}
+	burst, err := pool.SelectBackend()
+	if err != nil || burst.ID() != "http://burst" {
+		t.Fatalf("primaries saturated: got %v, %v; want the burst tier", burst, err)
+	}
+	if !strings.Contains(out.String(), "spilling over to priority 5: lower tiers at max-conns") {
+		t.Errorf("spillover not logged:\n%s", out)
+	}
+	if _, err := pool.SelectBackend(); err != errAtCapacity {
+		t.Errorf("every tier full: err = %v, want errAtCapacity", err)
+	}
+
+	held[0].DecrementConns()
+	if b, err := pool.SelectBackend(); err != nil || b != held[0] {
+		t.Errorf("a primary slot freed: got %v, %v; want that primary", b, err)
+	}
+}
+
+func TestPoolWithoutTiersHasNoActiveTier(t *testing.T) {
+	pool, err := NewPool([]string{"http://a,priority=3", "http://b,priority=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier := pool.Stats().ActiveTier; tier != nil {
+		t.Errorf("single-tier pool reports active tier %d", *tier)
+	}
+	if got := servedBy(t, pool, 10); got["http://a"]+got["http://b"] != 10 {
+		t.Errorf("single tier: %v", got)
+	}
+}
+
+func TestPriorityCacheAwarePinsReturnToPrimary(t *testing.T) {
+	pool, err := NewPool([]string{"http://p1", "http://backup,priority=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.EnableCacheAware(time.Hour, 4)
+	p1 := pool.GetBackends()[0]
+	chain := affinityChain(chatBody(t, msg("user", "hello")))
+	pick := func() *Backend {
+		t.Helper()
+		b, err := pool.selectCacheAware(chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.DecrementConns()
+		return b
+	}
+
+	p1.MarkUnhealthy()
+	if b := pick(); b.ID() != "http://backup" {
+		t.Fatalf("primary down: picked %s", b.ID())
+	}
+	for !p1.RecordCheckSuccess() {
+	}
+	if b := pick(); b != p1 {
+		t.Errorf("primary recovered: picked %s, want the primary over the backup's pin", b.ID())
+	}
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Probe latency (--health-latency-warn, --health-latency-unhealthy): a
+// backend that passes its health checks but takes seconds to answer them
+// is usually about to stop passing them. checkBackend times every probe
+// that reaches a verdict, exec check included, and the backend keeps the
+// last probeLatencyWindow durations: /stats shows the last and their
+// average, and so does the verbose status line. A passing probe slower
+// than the warn threshold is logged and counted (slow_checks in /stats,
+// lb_backend_slow_health_checks_total). One slower than the unhealthy
+// threshold counts as a failed check — a strike, so with
+// --unhealthy-threshold N it takes N slow probes in a row to take the
+// backend down, and the passing checks that bring it back must be fast
+// too. A backend still starting (see startup.go) may be slow without
+// striking. Both thresholds are off at 0.
+
+// probeLatencyWindow is how many probe durations a backend's average
+// covers.
+const probeLatencyWindow = 10
+
+// probeLatency is a backend's recent probe durations, a ring buffer.
+type probeLatency struct {
+	samples [probeLatencyWindow]time.Duration
+	n, next int
+	// slow counts passing probes over the warn threshold
+	slow uint64
+}
+
+func (l *probeLatency) add(d time.Duration) {
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % probeLatencyWindow
+	l.n = min(l.n+1, probeLatencyWindow)
+}
+
+func (l *probeLatency) last() time.Duration {
+	return l.samples[(l.next+probeLatencyWindow-1)%probeLatencyWindow]
+}
+
+func (l *probeLatency) avg() time.Duration {
+	if l.n == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range l.samples[:l.n] {
+		sum += d
+	}
+	return sum / time.Duration(l.n)
+}
+
+// SetLatencyThresholds sets the probe duration over which a passing health
+// check is logged as slow, and the one over which it counts as failed (0
+// for neither). Call before Start.
+func (hc *HealthChecker) SetLatencyThresholds(warn, unhealthy time.Duration) error {
+	if warn < 0 || unhealthy < 0 {
+		return errors.New("health latency thresholds cannot be negative")
+	}
+	hc.latencyWarn, hc.latencyUnhealthy = warn, unhealthy
+	return nil
+}
+
+// recordProbeLatency adds a probe's duration to the backend's window,
+// counting it as slow when it passed over warn.
+func (b *Backend) recordProbeLatency(d time.Duration, passed bool, warn time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probeLatency.add(d)
+	if passed && warn > 0 && d > warn {
+		b.probeLatency.slow++
+	}
+}
+
+// tooSlow reports whether a passing probe of backend that took d counts
+// as failed.
+func (hc *HealthChecker) tooSlow(backend *Backend, d time.Duration) bool {
+	return hc.latencyUnhealthy > 0 && d > hc.latencyUnhealthy && !backend.Starting()
+}
+
+// ProbeLatencyStats is a backend's recent probe durations in /stats.
+type ProbeLatencyStats struct {
+	LastMs float64 `json:"last_ms"`
+	AvgMs  float64 `json:"avg_ms"`
+	// Samples is how many probes AvgMs covers
+	Samples int `json:"samples"`
+	// SlowChecks counts passing probes over --health-latency-warn
+	SlowChecks uint64 `json:"slow_checks"`
+}
+
+// probeLatencyStatsLocked returns the backend's probe durations, nil
+// before its first probe. Caller must hold b.mu.
+func (b *Backend) probeLatencyStatsLocked() *ProbeLatencyStats {
+	l := &b.probeLatency
+	if l.n == 0 {
+		return nil
+	}
+	return &ProbeLatencyStats{LastMs: durationMs(l.last()), AvgMs: durationMs(l.avg()), Samples: l.n, SlowChecks: l.slow}
+}
+
+// probeLatencySummaryLocked is the verbose status line's probe durations,
+// "" before the first probe. Caller must hold b.mu.
+func (b *Backend) probeLatencySummaryLocked() string {
+	l := &b.probeLatency
+	if l.n == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", probe %v (avg %v)", roundLatency(l.last()), roundLatency(l.avg()))
+}
+
+// roundLatency rounds a probe duration for logs: to the millisecond, or
+// the microsecond under one.
+func roundLatency(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestProbeLatencyWindow(t *testing.T) {
+	var l probeLatency
+	for i := 1; i <= 12; i++ {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	// The window holds 3..12ms.
+	if l.n != probeLatencyWindow || l.last() != 12*time.Millisecond || l.avg() != 7500*time.Microsecond {
+		t.Errorf("window of %d: last %v, avg %v", l.n, l.last(), l.avg())
+	}
+}
+
+// slowProbePool is a pool of one mock backend answering health checks
+// after 60ms, probed with the latency thresholds given.
+func slowProbePool(t *testing.T, warn, unhealthy time.Duration) (*mockbackend.Server, *Pool, *HealthChecker, *lineLogger) {
+	t.Helper()
+	cfg := mockbackend.DefaultConfig()
+	cfg.HealthDelay = 60 * time.Millisecond
+	mock := mockbackend.Start(t, cfg)
+	out := &lineLogger{}
+	pool, err := NewPool([]string{mock.URL}, WithLogger(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHealthThresholds(3, 2); err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithProbeTimeout(time.Second), WithLogger(out))
+	if err := hc.SetLatencyThresholds(warn, unhealthy); err != nil {
+		t.Fatal(err)
+	}
+	return mock, pool, hc, out
+}
+
+func TestProbeLatencyWarn(t *testing.T) {
+	_, pool, hc, out := slowProbePool(t, 30*time.Millisecond, 0)
+	b := pool.GetBackends()[0]
+	for range 3 {
+		hc.checkBackend(context.Background(), b)
+	}
+	s := pool.Stats().Backends[0]
+	if !b.IsHealthy() || s.Streak.Strikes != 0 {
+		t.Errorf("slow passing checks struck the backend: healthy %v, streak %+v", b.IsHealthy(), s.Streak)
+	}
+	if l := s.ProbeLatency; l == nil || l.Samples != 3 || l.SlowChecks != 3 || l.LastMs < 60 || l.AvgMs < 60 {
+		t.Errorf("probe latency %+v", l)
+	}
+	if n := strings.Count(out.String(), "health check passed but took"); n != 3 {
+		t.Errorf("%d slow check warnings:\n%s", n, out)
+	}
+	var metrics bytes.Buffer
+	if err := WriteMetrics(&metrics, []*Pool{pool}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(metrics.String(), "lb_backend_slow_health_checks_total{pool=\"default\",backend=\""+b.ID()+"\"} 3") {
+		t.Errorf("no slow health check count in\n%s", metrics.String())
+	}
+	b.mu.Lock()
+	summary := b.probeLatencySummaryLocked()
+	b.mu.Unlock()
+	if !strings.HasPrefix(summary, ", probe ") || !strings.Contains(summary, "ms (avg ") {
+		t.Errorf("status summary %q", summary)
+	}
+}
+
+func TestProbeLatencyUnhealthy(t *testing.T) {
+	mock, pool, hc, out := slowProbePool(t, 30*time.Millisecond, 50*time.Millisecond)
+	b := pool.GetBackends()[0]
+	hc.checkBackend(context.Background(), b)
+	hc.checkBackend(context.Background(), b)
+	if s := pool.Stats().Backends[0]; !b.IsHealthy() || s.Streak.Strikes != 2 {
+		t.Fatalf("after two slow checks: healthy %v, streak %+v", b.IsHealthy(), s.Streak)
+	}
+	hc.checkBackend(context.Background(), b)
+	if b.IsHealthy() || !strings.Contains(out.String(), "over 50ms; 3 strikes)") {
+		t.Fatalf("after three slow checks: healthy %v\n%s", b.IsHealthy(), out)
+	}
+	if s := pool.Stats().Backends[0]; !strings.HasPrefix(s.Reason, "slow health check: 6") || s.ProbeLatency.SlowChecks != 3 {
+		t.Errorf("reason %q, probe latency %+v", s.Reason, s.ProbeLatency)
+	}
+
+	// Slow passes do not bring it back; fast ones do.
+	hc.checkBackend(context.Background(), b)
+	mock.SetHealthDelay(0)
+	hc.checkBackend(context.Background(), b)
+	if b.IsHealthy() {
+		t.Fatal("recovered on a slow pass")
+	}
+	hc.checkBackend(context.Background(), b)
+	if !b.IsHealthy() {
+		t.Fatalf("not recovered after two fast passes\n%s", out)
+	}
+	if hc.SetLatencyThresholds(-time.Second, 0) == nil {
+		t.Error("negative threshold accepted")
+	}
+}
@@ -0,0 +1,329 @@
+package lib
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Probe kinds (--health-check, or a backend's ",check=tcp"): "http" GETs the
+// health URL (see healthcheck.go); "tcp" only connects to its host and port
+// and closes the connection; "grpc" calls grpc.health.v1.Health/Check there
+// over HTTP/2 (cleartext for http://, TLS for https://), for the service
+// set with --health-grpc-service ("" asks about the server as a whole), and
+// passes only on SERVING. Each probe runs within the checker's timeout.
+
+// Health check probe kinds. HealthCheckExec is a backend's own only (see
+// execprobe.go).
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckGRPC = "grpc"
+	HealthCheckExec = "exec"
+)
+
+// validHealthCheck checks a backend's probe kind.
+func validHealthCheck(kind string) error {
+	switch kind {
+	case HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC, HealthCheckExec:
+		return nil
+	}
+	return fmt.Errorf("health check must be http, tcp, grpc or exec, got %q", kind)
+}
+
+// Prober checks one backend. A nil error passes the probe.
+type Prober interface {
+	Probe(ctx context.Context, b *Backend) error
+}
+
+// errProbeSkipped fails a probe that was never sent because the backend's
+// request decorator failed: the backend stays degraded and unprobed.
+var errProbeSkipped = errors.New("probe skipped")
+
+// probeStatusError is a probe answered with a failing HTTP status.
+type probeStatusError struct {
+	code int
+	// notReady is set when the response is the not-ready signature (see
+	// startup.go).
+	notReady bool
+}
+
+func (e *probeStatusError) Error() string {
+	return fmt.Sprintf("status: %d", e.code)
+}
+
+// SetHealthCheck sets the probe kind of backends without their own
+// ",check=" (default http) and the service gRPC probes ask about. Call
+// before serving traffic and before creating the pool's HealthChecker.
+func (p *Pool) SetHealthCheck(kind, grpcService string) error {
+	if kind == HealthCheckExec {
+		return errors.New("health check exec applies per backend, with its check_cmd")
+	}
+	if err := validHealthCheck(kind); err != nil {
+		return err
+	}
+	p.healthCheck, p.grpcService = kind, grpcService
+	return nil
+}
+
+// healthCheckOf returns the probe kind of b.
+func (p *Pool) healthCheckOf(b *Backend) string {
+	switch {
+	case b.check != "" && (b.check != HealthCheckExec || !p.noExec):
+		return b.check
+	case b.grpc:
+		return HealthCheckGRPC
+	case p.healthCheck != "":
+		return p.healthCheck
+	}
+	return HealthCheckHTTP
+}
+
+// SetProber replaces the prober of a probe kind. Call before Start.
+func (hc *HealthChecker) SetProber(kind string, p Prober) {
+	hc.probers[kind] = p
+}
+
+// probeTarget returns the host:port a tcp or grpc probe goes to: the health
+// URL's, with the scheme's default port.
+func (p *Pool) probeTarget(b *Backend) (*url.URL, string, error) {
+	u, err := url.Parse(p.HealthURL(b))
+	if err != nil {
+		return nil, "", err
+	}
+	return u, dialAddress(u), nil
+}
+
+// httpProber GETs the health URL: 2xx and 429 pass (see checkBackend).
+type httpProber struct {
+	hc *HealthChecker
+}
+
+func (p httpProber) Probe(ctx context.Context, b *Backend) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.hc.pool.HealthURL(b), nil)
+	if err != nil {
+		return err
+	}
+	// A probe without the backend's credentials would fail for the wrong
+	// reason: leave it degraded and unprobed until the decorator recovers.
+	if err := b.decorate(req); err != nil {
+		return fmt.Errorf("%w: %w", errProbeSkipped, err)
+	}
+	b.setDegraded("")
+	span := spanFromContext(ctx)
+	span.inject(req.Header)
+	resp, err := p.hc.clientFor(b).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	span.setHTTPStatus(resp.StatusCode)
+	b.watchDrainSignal(resp.Header)
+
+	// 2xx passes; so does 429 — a saturated backend (e.g. a node-level lb
+	// whose ranks are all at --max-conns) is alive, and ejecting it would
+	// shift load onto the rest and cascade.
+	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusTooManyRequests {
+		if rl := p.hc.pool.reported; rl != nil && resp.StatusCode != http.StatusTooManyRequests {
+			rl.record(b, resp.Body, p.hc.clock.Now())
+		}
+		return nil
+	}
+	return &probeStatusError{code: resp.StatusCode, notReady: p.hc.pool.startup.notReady(resp)}
+}
+
+// tcpProber passes when a connection to the backend opens.
+type tcpProber struct {
+	hc *HealthChecker
+}
+
+func (p tcpProber) Probe(ctx context.Context, b *Backend) error {
+	_, addr, err := p.hc.pool.probeTarget(b)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.hc.timeout)
+	defer cancel()
+	conn, err := p.hc.pool.transportOf(b).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcHealthPath is the gRPC health checking protocol's Check method.
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is HealthCheckResponse.ServingStatus SERVING.
+const grpcServing = 1
+
+// grpcServingStatuses names HealthCheckResponse.ServingStatus values.
+var grpcServingStatuses = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+// grpcMaxResponse bounds the Check response read.
+const grpcMaxResponse = 4 << 10
+
+// grpcProber calls grpc.health.v1.Health/Check, encoding the one-field
+// protobuf messages by hand.
+type grpcProber struct {
+	hc     *HealthChecker
+	client *http.Client
+	// proxied holds the clients of backends with their own transport (see
+	// fwdproxy.go), by transport
+	proxied *sync.Map
+}
+
+func newGRPCProber(hc *HealthChecker) grpcProber {
+	return grpcProber{hc: hc, client: h2cClient(hc.pool.transport), proxied: &sync.Map{}}
+}
+
+// h2cClient returns a client speaking HTTP/2, with prior knowledge over
+// plain connections, through a clone of t.
+func h2cClient(t *http.Transport) *http.Client {
+	t = t.Clone()
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: t}
+}
+
+// clientFor returns the client b is probed with.
+func (p grpcProber) clientFor(b *Backend) *http.Client {
+	if b.transport == nil {
+		return p.client
+	}
+	if c, ok := p.proxied.Load(b.transport); ok {
+		return c.(*http.Client)
+	}
+	c, _ := p.proxied.LoadOrStore(b.transport, h2cClient(b.transport))
+	return c.(*http.Client)
+}
+
+func (p grpcProber) Probe(ctx context.Context, b *Backend) error {
+	u, addr, err := p.hc.pool.probeTarget(b)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.hc.timeout)
+	defer cancel()
+
+	// HealthCheckRequest{service = 1}, length-prefixed.
+	var msg []byte
+	if service := p.hc.pool.grpcService; service != "" {
+		msg = append([]byte{0x0a}, binary.AppendUvarint(nil, uint64(len(service)))...)
+		msg = append(msg, service...)
+	}
+	body := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	body = append(body, msg...)
+
+	target := url.URL{Scheme: u.Scheme, Host: addr, Path: grpcHealthPath}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if err := b.decorate(req); err != nil {
+		return fmt.Errorf("%w: %w", errProbeSkipped, err)
+	}
+	b.setDegraded("")
+	spanFromContext(ctx).inject(req.Header)
+	resp, err := p.clientFor(b).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &probeStatusError{code: resp.StatusCode}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, grpcMaxResponse))
+	if err != nil {
+		return err
+	}
+	// grpc-status is a trailer, or a header in a trailers-only response.
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc-status %s: %s", cmp.Or(status, "missing"), message)
+	}
+	serving, err := grpcServingStatus(data)
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		name := fmt.Sprint(serving)
+		if serving < uint64(len(grpcServingStatuses)) {
+			name = grpcServingStatuses[serving]
+		}
+		return fmt.Errorf("grpc health: %s", name)
+	}
+	return nil
+}
+
+// grpcServingStatus decodes a length-prefixed HealthCheckResponse's status
+// field (1, varint), skipping any others.
+func grpcServingStatus(data []byte) (uint64, error) {
+	if len(data) < 5 || data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		return 0, errors.New("grpc health: malformed response")
+	}
+	msg := data[5:]
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("grpc health: malformed response")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("grpc health: malformed response")
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			msg = msg[n:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return 0, errors.New("grpc health: malformed response")
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0, errors.New("grpc health: malformed response")
+		}
+	}
+	return status, nil
+}
+
+// shownProbe is a tcp, grpc or exec probe's target as stats and logs show
+// it: tcp://host:port, grpc://host:port[/service], tcp+unix:///path for a
+// unix socket backend, or exec:COMMAND.
+func (p *Pool) shownProbe(kind string, b *Backend) string {
+	if kind == HealthCheckExec {
+		return "exec:" + strings.Join(b.checkCmd, " ")
+	}
+	_, addr, err := p.probeTarget(b)
+	if err != nil {
+		return kind + "://" + b.id
+	}
+	shown := kind + "://" + addr
+	if b.socket != "" && b.healthURL == "" {
+		shown = kind + "+" + b.id
+	}
+	if kind == HealthCheckGRPC && p.grpcService != "" {
+		shown += "/" + p.grpcService
+	}
+	return shown
+}
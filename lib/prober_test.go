@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probePool returns a pool of spec whose health checker probes with kind,
+// timing out after timeout.
+func probePool(t *testing.T, spec, kind string, timeout time.Duration) (*Pool, *HealthChecker) {
+	t.Helper()
+	pool, err := NewPool([]string{spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHealthCheck(kind, "inference"); err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	hc.SetTimeout(timeout)
+	return pool, hc
+}
+
+// probe runs one probe of the pool's backend and returns its error.
+func probe(hc *HealthChecker) error {
+	b := hc.pool.GetBackends()[0]
+	return hc.probers[hc.pool.healthCheckOf(b)].Probe(context.Background(), b)
+}
+
+func TestTCPProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	pool, hc := probePool(t, "http://"+ln.Addr().String(), HealthCheckTCP, time.Second)
+	if err := probe(hc); err != nil {
+		t.Errorf("listening port: %v", err)
+	}
+	<-accepted
+	if got, want := pool.Stats().Backends[0].HealthURL, "tcp://"+ln.Addr().String(); got != want {
+		t.Errorf("shown probe %q, want %q", got, want)
+	}
+
+	ln.Close()
+	if err := probe(hc); err == nil {
+		t.Error("closed port passed")
+	}
+}
+
+func TestTCPProberTimeout(t *testing.T) {
+	_, hc := probePool(t, "http://10.0.0.1:8000", HealthCheckTCP, 100*time.Millisecond)
+	tr := NewTransport(DefaultTransportConfig())
+	tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done() // a black-holed SYN
+		return nil, ctx.Err()
+	}
+	hc.pool.SetTransport(tr)
+	start := time.Now()
+	if err := probe(hc); err == nil {
+		t.Error("hung connect passed")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("hung connect took %v, want the 100ms probe timeout", d)
+	}
+}
+
+// grpcHealthServer is a cleartext HTTP/2 gRPC health server answering
+// Check with status (a HealthCheckResponse.ServingStatus), or grpc-status
+// code when non-zero, after delay. It records the service asked about.
+func grpcHealthServer(t *testing.T, status byte, code string, delay time.Duration) (*httptest.Server, chan string) {
+	t.Helper()
+	services := make(chan string, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != grpcHealthPath || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("%s %s as %s", r.Proto, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		// HealthCheckRequest: tag 0x0a, length, service.
+		if len(body) >= 7 && body[5] == 0x0a {
+			services <- string(body[7:])
+		} else {
+			services <- ""
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		if code != "0" {
+			w.Header().Set("Grpc-Status", code) // trailers-only
+			w.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		msg := []byte{0x08, status} // status = 1
+		_, _ = w.Write(append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg))), msg...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, services
+}
+
+func TestGRPCProber(t *testing.T) {
+	serving, services := grpcHealthServer(t, grpcServing, "0", 0)
+	pool, hc := probePool(t, serving.URL, HealthCheckGRPC, time.Second)
+	if err := probe(hc); err != nil {
+		t.Errorf("SERVING: %v", err)
+	}
+	if got := <-services; got != "inference" {
+		t.Errorf("asked about service %q, want inference", got)
+	}
+	if got, want := pool.Stats().Backends[0].HealthURL, "grpc://"+serving.Listener.Addr().String()+"/inference"; got != want {
+		t.Errorf("shown probe %q, want %q", got, want)
+	}
+
+	notServing, _ := grpcHealthServer(t, 2, "0", 0)
+	_, hc = probePool(t, notServing.URL, HealthCheckGRPC, time.Second)
+	if err := probe(hc); err == nil || !strings.Contains(err.Error(), "NOT_SERVING") {
+		t.Errorf("NOT_SERVING: %v", err)
+	}
+
+	unknown, _ := grpcHealthServer(t, 0, "5", 0)
+	_, hc = probePool(t, unknown.URL, HealthCheckGRPC, time.Second)
+	if err := probe(hc); err == nil || !strings.Contains(err.Error(), "grpc-status 5: unknown service") {
+		t.Errorf("NOT_FOUND: %v", err)
+	}
+}
+
+func TestGRPCProberTimeout(t *testing.T) {
+	slow, _ := grpcHealthServer(t, grpcServing, "0", time.Minute)
+	_, hc := probePool(t, slow.URL, HealthCheckGRPC, 100*time.Millisecond)
+	start := time.Now()
+	if err := probe(hc); err == nil {
+		t.Error("hung Check passed")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("hung Check took %v, want the 100ms probe timeout", d)
+	}
+}
+
+func TestHealthCheckPerBackend(t *testing.T) {
+	captureLog(t)
+	httpOnly := echoServer(t) // answers every path, speaks HTTP/1.1 only
+	grpcSrv, _ := grpcHealthServer(t, grpcServing, "0", 0)
+	pool, err := NewPool([]string{httpOnly.URL + ",check=http", grpcSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetHealthCheck(HealthCheckGRPC, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range pool.GetBackends() {
+		b.MarkUnhealthy()
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	for range healthyThreshold {
+		hc.checkAll(context.Background())
+	}
+	for _, b := range pool.GetBackends() {
+		if !b.IsHealthy() {
+			t.Errorf("%s (%s probe) did not recover", b.ID(), pool.healthCheckOf(b))
+		}
+	}
+
+	if err := pool.SetHealthCheck("icmp", ""); err == nil {
+		t.Error("unknown probe kind accepted")
+	}
+	if _, err := ParseBackendSpec("http://b1,check=udp"); err == nil {
+		t.Error("unknown check= accepted")
+	}
+	if s, err := ParseBackendSpec("http://b1,check=tcp"); err != nil || s.Check != HealthCheckTCP || s.String() != "http://b1,check=tcp" {
+		t.Errorf("check=tcp parsed as %+v, %v", s, err)
+	}
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Shared probes: one backend can be listed in several pools — tenant
+// groups sharing a replica, say (see tenantroute.go) — and each pool's
+// HealthChecker would probe it on its own schedule. Checkers given the same
+// ProbeShare probe such a backend once: a checker due to probe it takes the
+// verdict of another pool's probe still in flight, or finished within the
+// checker's own probe interval for the backend, and probes itself only
+// when there is none. Each pool applies the verdict to its own backend —
+// strikes, thresholds, probe latency, logs — so their health agrees.
+// Backends are the same when their probe kind, health URL and request
+// decorator are; exec checks are never shared. What a probe's response
+// says about its backend besides the verdict (drain signals, reported
+// load) reaches the probing pool's backend only.
+
+// ProbeShare lets health checkers of different pools share their probes of
+// the same backend.
+type ProbeShare struct {
+	mu     sync.Mutex
+	probes map[string]*sharedProbe // latest by probeShareKey
+}
+
+// sharedProbe is one probe's verdict, with done closed once it is in.
+type sharedProbe struct {
+	by   *Backend
+	done chan struct{}
+	// set before done is closed
+	err     error
+	elapsed time.Duration
+	at      time.Time
+	// skipped is set for a probe whose error was not the backend's (see
+	// checkBackend): the others probe themselves instead
+	skipped bool
+}
+
+// NewProbeShare returns an empty probe share.
+func NewProbeShare() *ProbeShare {
+	return &ProbeShare{probes: make(map[string]*sharedProbe)}
+}
+
+// SetProbeShare shares the checker's probes with the other checkers given
+// s. Call before Start.
+func (hc *HealthChecker) SetProbeShare(s *ProbeShare) {
+	hc.share = s
+}
+
+// probeShareKey identifies backend's probe across pools, "" when it is not
+// shared.
+func (hc *HealthChecker) probeShareKey(backend *Backend, kind string) string {
+	if hc.share == nil || kind == HealthCheckExec || (len(backend.checkCmd) > 0 && !hc.pool.noExec) {
+		return ""
+	}
+	return kind + " " + hc.pool.HealthURL(backend) + " " + backend.decoratorName
+}
+
+// claim returns the probe of key that b can take the verdict of: one in
+// flight for another backend, or finished for another backend within
+// maxAge. Without one it records a new probe by b, which b must run and
+// finish, and returns it with own set.
+func (s *ProbeShare) claim(key string, b *Backend, now time.Time, maxAge time.Duration) (p *sharedProbe, own bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.probes[key]; p != nil && p.by != b {
+		select {
+		case <-p.done:
+			if !p.skipped && now.Sub(p.at) < maxAge {
+				return p, false
+			}
+		default:
+			return p, false
+		}
+	}
+	p = &sharedProbe{by: b, done: make(chan struct{})}
+	s.probes[key] = p
+	return p, true
+}
+
+// finish records the verdict of a probe claim returned as own.
+func (p *sharedProbe) finish(err error, elapsed time.Duration, at time.Time, skipped bool) {
+	p.err, p.elapsed, p.at, p.skipped = err, elapsed, at, skipped
+	close(p.done)
+}
+
+// runProbe probes backend, or takes the verdict of another pool's probe of
+// it, returning the probe's error and how long it took. shared is set for
+// a verdict taken.
+func (hc *HealthChecker) runProbe(ctx context.Context, backend *Backend, kind string, prober Prober) (elapsed time.Duration, shared bool, err error) {
+	key := hc.probeShareKey(backend, kind)
+	var p *sharedProbe
+	if key != "" {
+		backend.mu.Lock()
+		maxAge := hc.intervalLocked(backend)
+		backend.mu.Unlock()
+		var own bool
+		if p, own = hc.share.claim(key, backend, hc.clock.Now(), maxAge); !own {
+			select {
+			case <-p.done:
+				if !p.skipped {
+					return p.elapsed, true, p.err
+				}
+			case <-ctx.Done():
+				return 0, false, ctx.Err()
+			}
+			// The other probe was not the backend's verdict: probe it here,
+			// without sharing.
+			p = nil
+		}
+	}
+	start := hc.clock.Now()
+	err = hc.runExecAlso(ctx, backend, kind, prober.Probe(ctx, backend))
+	elapsed = hc.clock.Now().Sub(start)
+	if p != nil {
+		p.finish(err, elapsed, hc.clock.Now(), err != nil && !ClassifyFailure(err, nil, ctx).FlipsHealth())
+	}
+	return elapsed, false, err
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestProbeShare(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.DefaultConfig())
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	share := NewProbeShare()
+	var checkers []*HealthChecker
+	var backends []*Backend
+	for range 2 {
+		pool, err := NewPool([]string{mock.URL}, WithLogger(&lineLogger{}), WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hc := NewHealthChecker(pool, WithInterval(10*time.Second), WithUnhealthyInterval(5*time.Second))
+		hc.SetProbeShare(share)
+		checkers = append(checkers, hc)
+		backends = append(backends, pool.GetBackends()[0])
+	}
+	probes := func() uint64 { return mock.Stats().Paths[DefaultHealthPath] }
+	check := func(i int) {
+		t.Helper()
+		checkers[i].checkBackend(context.Background(), backends[i])
+	}
+
+	check(0)
+	check(1)
+	if n := probes(); n != 1 {
+		t.Fatalf("two pools sent %d probes, want 1", n)
+	}
+	// A checker's own earlier probe is no verdict for its next one.
+	check(0)
+	if n := probes(); n != 2 {
+		t.Fatalf("%d probes after the first pool's second check, want 2", n)
+	}
+	check(1)
+	if n := probes(); n != 2 {
+		t.Fatalf("%d probes after the second pool's second check, want 2", n)
+	}
+
+	// A verdict older than the probe interval is probed afresh.
+	clock.advance(11 * time.Second)
+	check(1)
+	if n := probes(); n != 3 {
+		t.Fatalf("%d probes after a stale verdict, want 3", n)
+	}
+
+	// Both pools apply a shared failure to their own backend.
+	mock.SetMode(mockbackend.ModeFailing)
+	clock.advance(11 * time.Second)
+	check(0)
+	check(1)
+	for i, b := range backends {
+		if b.IsHealthy() {
+			t.Errorf("pool %d: backend still healthy after the shared failed probe", i)
+		}
+	}
+	if n := probes(); n != 4 {
+		t.Errorf("%d probes, want 4", n)
+	}
+}
+
+func TestProbeShareUnshared(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.DefaultConfig())
+	var checkers []*HealthChecker
+	share := NewProbeShare()
+	for _, path := range []string{"/v1/models", "/health"} {
+		pool, err := NewPool([]string{mock.URL}, WithLogger(&lineLogger{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hc := NewHealthChecker(pool, WithPath(path))
+		hc.SetProbeShare(share)
+		checkers = append(checkers, hc)
+	}
+	for _, hc := range checkers {
+		hc.checkBackend(context.Background(), hc.pool.GetBackends()[0])
+	}
+	// Different health URLs are different probes.
+	if s := mock.Stats(); s.Paths["/v1/models"] != 1 || s.Paths["/health"] != 1 {
+		t.Errorf("probes by path %v", s.Paths)
+	}
+}
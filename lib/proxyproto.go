@@ -0,0 +1,411 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol (--proxy-protocol, send_proxy=): behind a TCP load
+// balancer every connection comes from the balancer, so rate limits, logs
+// and hashed client IDs all see one address. An edge speaking the PROXY
+// protocol (v1 text or v2 binary, haproxy.org's proxy-protocol.txt) opens
+// each connection with a header naming the client, and a
+// ProxyProtocol listener reads it before anything else: the connection's
+// RemoteAddr, and so every request's, is the client's, LocalAddr the
+// address the client connected to. A LOCAL (v2) or UNKNOWN (v1) header —
+// the edge's own health checks — leaves the connection's addresses alone.
+// The header is read on the connection's goroutine, within the header
+// timeout, never in Accept. From the peers allowed to send it (all of
+// them without an allowlist) the header is required; a connection without
+// one, or with a malformed one, is closed. Any other peer is served with
+// its own address, and closed if it sends a header anyway, so no client
+// can claim an address. A unix socket peer counts as allowed.
+//
+// A backend given ",send_proxy=v1" or ",send_proxy=v2" expects the header
+// itself. Its transport is cloned from the pool's, like a proxy= one (see
+// fwdproxy.go), with a dialer that writes the header first on every
+// connection — through the forward proxy's tunnel if it has one, before
+// TLS — naming the client of the request that dialed it. The header
+// belongs to the connection, so the transport never reuses one: each
+// request dials its own. Health checks go the same way, with a LOCAL or
+// UNKNOWN header since they have no client.
+
+// Versions of send_proxy=.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// DefaultProxyHeaderTimeout bounds reading an inbound PROXY header when
+// NewProxyProtocol is given none.
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature opens every v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands and address families.
+const (
+	proxyV2Local   = 0x20
+	proxyV2Proxy   = 0x21
+	proxyV2Unspec  = 0x00
+	proxyV2TCP4    = 0x11
+	proxyV2TCP6    = 0x21
+	proxyV2HeadLen = 16
+	// proxyV1MaxLen is the longest v1 header, CRLF included
+	proxyV1MaxLen = 107
+)
+
+// errProxyHeader is a malformed or unexpected inbound PROXY header.
+var errProxyHeader = errors.New("PROXY header")
+
+// validSendProxy checks a send_proxy= value.
+func validSendProxy(version string) error {
+	if version != ProxyProtocolV1 && version != ProxyProtocolV2 {
+		return fmt.Errorf("send_proxy must be %s or %s, got %q", ProxyProtocolV1, ProxyProtocolV2, version)
+	}
+	return nil
+}
+
+// ProxyProtocol accepts PROXY headers on the listeners it wraps.
+type ProxyProtocol struct {
+	allow   []netip.Prefix
+	timeout time.Duration
+	logger  Logger
+}
+
+// NewProxyProtocol validates the allowlist (addresses and CIDRs; empty
+// for every peer). A header not read within timeout (0 for
+// DefaultProxyHeaderTimeout) closes the connection; rejected connections
+// are logged to logger.
+func NewProxyProtocol(allow []string, timeout time.Duration, logger Logger) (*ProxyProtocol, error) {
+	if timeout <= 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	pp := &ProxyProtocol{timeout: timeout, logger: logger}
+	if pp.logger == nil {
+		pp.logger = defaultLogger()
+	}
+	for _, entry := range allow {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil || addr.Zone() != "" {
+				return nil, fmt.Errorf("proxy protocol allowlist entry %q: want an address or a CIDR like 10.0.0.0/8", entry)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		pp.allow = append(pp.allow, prefix.Masked())
+	}
+	return pp, nil
+}
+
+// Listener wraps ln to read PROXY headers.
+func (pp *ProxyProtocol) Listener(ln net.Listener) net.Listener {
+	return &proxyProtocolListener{Listener: ln, pp: pp}
+}
+
+// allowed reports whether the peer at addr may send a header.
+func (pp *ProxyProtocol) allowed(addr net.Addr) bool {
+	if len(pp.allow) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip, _ := netip.AddrFromSlice(tcp.IP)
+	ip = ip.Unmap()
+	for _, prefix := range pp.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	pp *ProxyProtocol
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, pp: l.pp, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn is an accepted connection whose PROXY header is read
+// on first use.
+type proxyProtocolConn struct {
+	net.Conn
+	pp *ProxyProtocol
+	r  *bufio.Reader
+
+	once sync.Once
+	// err fails every read after a rejected header
+	err           error
+	remote, local net.Addr
+}
+
+// init reads the header, once.
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.pp.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		if c.pp.allowed(c.Conn.RemoteAddr()) {
+			c.remote, c.local, c.err = readProxyHeader(c.r)
+		} else if hasProxyHeader(c.r) {
+			c.err = fmt.Errorf("%w from a peer not allowed to send one", errProxyHeader)
+		}
+		if c.err != nil {
+			c.pp.logger.Printf("[PROXY] closing connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// hasProxyHeader reports whether r starts with a PROXY header, peeking no
+// further than a request line or TLS hello would go.
+func hasProxyHeader(r *bufio.Reader) bool {
+	first, err := r.Peek(1)
+	if err != nil {
+		return false
+	}
+	switch first[0] {
+	case 'P':
+		head, _ := r.Peek(6)
+		return string(head) == "PROXY "
+	case '\r':
+		head, _ := r.Peek(len(proxyV2Signature))
+		return bytes.Equal(head, proxyV2Signature)
+	}
+	return false
+}
+
+// readProxyHeader reads a v1 or v2 header off r, returning the client and
+// destination addresses it names, both nil for LOCAL and UNKNOWN.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w missing: %w", errProxyHeader, err)
+	}
+	if first[0] == '\r' {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 reads "PROXY TCP4|TCP6 src dst sport dport\r\n" or
+// "PROXY UNKNOWN ...\r\n".
+func readProxyV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: no v1 header line", errProxyHeader)
+	}
+	fields := strings.Split(text, " ")
+	switch {
+	case fields[0] != "PROXY" || len(fields) < 2:
+		return nil, nil, fmt.Errorf("%w missing", errProxyHeader)
+	case fields[1] == "UNKNOWN":
+		return nil, nil, nil
+	case (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6:
+		return nil, nil, fmt.Errorf("%w: malformed v1 header %q", errProxyHeader, text)
+	}
+	srcAddr, err1 := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	dstAddr, err2 := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, nil, fmt.Errorf("%w: malformed v1 header %q", errProxyHeader, text)
+	}
+	return srcAddr, dstAddr, nil
+}
+
+// parseProxyV1Addr parses a v1 address and port of the header's family.
+func parseProxyV1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil || ip.Is4() != v4 || ip.Zone() != "" {
+		return nil, fmt.Errorf("bad address %q", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("bad port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(n))), nil
+}
+
+// readProxyV2 reads a binary header: the signature, version and command,
+// family, length, then the addresses and any TLVs, which are skipped.
+func readProxyV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var head [proxyV2HeadLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+	if !bytes.Equal(head[:12], proxyV2Signature) {
+		return nil, nil, fmt.Errorf("%w missing", errProxyHeader)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+	switch head[12] {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("%w: bad v2 version and command 0x%02x", errProxyHeader, head[12])
+	}
+	var size int
+	switch head[13] {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// UDP, unix sockets, UNSPEC: nothing a TCP client's address can
+		// be taken from.
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("%w: v2 addresses truncated", errProxyHeader)
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:size])
+	dstIP, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort)), nil
+}
+
+// proxyClientKey carries the request's client and the address it
+// connected to into the dial of a send_proxy= backend.
+type proxyClientKey struct{}
+
+type proxyClient struct{ src, dst netip.AddrPort }
+
+// withProxyClient notes r's client for the dialer.
+func withProxyClient(r *http.Request) *http.Request {
+	src, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	c := proxyClient{src: src}
+	if tcp, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		c.dst = tcp.AddrPort()
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyClientKey{}, c))
+}
+
+// proxyHeader is the version header naming c, a LOCAL or UNKNOWN one for
+// nil (a health check) or a client whose addresses it cannot carry.
+func proxyHeader(version string, c *proxyClient) []byte {
+	var src, dst netip.AddrPort
+	if c != nil {
+		src, dst = netip.AddrPortFrom(c.src.Addr().Unmap(), c.src.Port()), netip.AddrPortFrom(c.dst.Addr().Unmap(), c.dst.Port())
+	}
+	known := src.IsValid() && dst.IsValid() && src.Addr().Is4() == dst.Addr().Is4()
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if src.Addr().Is4() {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	}
+	h := append([]byte{}, proxyV2Signature...)
+	switch {
+	case c == nil:
+		return append(h, proxyV2Local, proxyV2Unspec, 0, 0)
+	case !known:
+		return append(h, proxyV2Proxy, proxyV2Unspec, 0, 0)
+	case src.Addr().Is4():
+		h = append(h, proxyV2Proxy, proxyV2TCP4, 0, 12)
+	default:
+		h = append(h, proxyV2Proxy, proxyV2TCP6, 0, 36)
+	}
+	h = append(h, src.Addr().AsSlice()...)
+	h = append(h, dst.Addr().AsSlice()...)
+	h = binary.BigEndian.AppendUint16(h, src.Port())
+	return binary.BigEndian.AppendUint16(h, dst.Port())
+}
+
+// withSendProxy returns a clone of t writing a version header on every
+// connection it dials, and reusing none.
+func withSendProxy(t *http.Transport, version string) *http.Transport {
+	c := t.Clone()
+	c.DisableKeepAlives = true
+	dial := c.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var client *proxyClient
+		if pc, ok := ctx.Value(proxyClientKey{}).(proxyClient); ok {
+			client = &pc
+		}
+		err = withDeadline(ctx, conn, func() error {
+			_, err := conn.Write(proxyHeader(version, client))
+			return err
+		})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return c
+}
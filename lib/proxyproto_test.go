@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// v2Header is a v2 PROXY header for a TCP client src connecting to dst,
+// with tlvs after the addresses.
+func v2Header(t *testing.T, src, dst string, tlvs ...byte) []byte {
+	t.Helper()
+	s, d := net.TCPAddrFromAddrPort(mustAddrPort(t, src)), net.TCPAddrFromAddrPort(mustAddrPort(t, dst))
+	h := append([]byte{}, proxyV2Signature...)
+	ip := func(a *net.TCPAddr) []byte {
+		if v4 := a.IP.To4(); v4 != nil {
+			return v4
+		}
+		return a.IP
+	}
+	family := byte(proxyV2TCP4)
+	if len(ip(s)) == net.IPv6len {
+		family = proxyV2TCP6
+	}
+	addrs := append(append([]byte{}, ip(s)...), ip(d)...)
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+	addrs = append(addrs, tlvs...)
+	h = append(h, proxyV2Proxy, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func mustAddrPort(t *testing.T, s string) netip.AddrPort {
+	t.Helper()
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ap
+}
+
+// echoAddrServer serves on ln, answering every request with its
+// RemoteAddr and the address it reached.
+func echoAddrServer(t *testing.T, ln net.Listener) {
+	t.Helper()
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		fmt.Fprintf(w, "%s %s", r.RemoteAddr, local)
+	})}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+}
+
+// rawGet sends header and a GET on a new connection to addr, returning the
+// response body, or the error when the connection is closed on it.
+func rawGet(t *testing.T, addr string, header []byte) (string, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append(header, "GET / HTTP/1.1\r\nHost: lb\r\nConnection: close\r\n\r\n"...)); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &lineLogger{}
+	pp, err := NewProxyProtocol(nil, time.Second, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoAddrServer(t, pp.Listener(ln))
+	addr := ln.Addr().String()
+
+	for _, tt := range []struct {
+		name, header, want string
+	}{
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 198.51.100.1 51000 443\r\n", "203.0.113.7:51000 198.51.100.1:443"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::7 2001:db8::1 51000 443\r\n", "[2001:db8::7]:51000 [2001:db8::1]:443"},
+		{"v2 tcp4", string(v2Header(t, "203.0.113.7:51000", "198.51.100.1:443", 0x04, 0, 3, 'a', 'b', 'c')), "203.0.113.7:51000 198.51.100.1:443"},
+		{"v2 tcp6", string(v2Header(t, "[2001:db8::7]:51000", "[2001:db8::1]:443")), "[2001:db8::7]:51000 [2001:db8::1]:443"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "127.0.0.1:"},
+		{"v2 local", string(append(append([]byte{}, proxyV2Signature...), proxyV2Local, proxyV2Unspec, 0, 0)), "127.0.0.1:"},
+	} {
+		got, err := rawGet(t, addr, []byte(tt.header))
+		if err != nil || !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ name, header string }{
+		{"none", ""},
+		{"v1 bad family", "PROXY UDP4 203.0.113.7 198.51.100.1 51000 443\r\n"},
+		{"v1 mixed families", "PROXY TCP4 203.0.113.7 2001:db8::1 51000 443\r\n"},
+		{"v1 bad port", "PROXY TCP4 203.0.113.7 198.51.100.1 70000 443\r\n"},
+		{"v1 missing field", "PROXY TCP4 203.0.113.7 198.51.100.1 51000\r\n"},
+		{"v1 no CRLF", "PROXY TCP4 203.0.113.7 198.51.100.1 51000 443\n"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"},
+		{"v2 bad command", string(append(append([]byte{}, proxyV2Signature...), 0x22, proxyV2TCP4, 0, 0))},
+		{"v2 truncated", string(append(append([]byte{}, proxyV2Signature...), proxyV2Proxy, proxyV2TCP4, 0, 4, 1, 2, 3, 4))},
+	} {
+		if got, err := rawGet(t, addr, []byte(tt.header)); err == nil {
+			t.Errorf("%s: served %q", tt.name, got)
+		}
+	}
+	if !strings.Contains(out.String(), "[PROXY] closing connection from 127.0.0.1:") {
+		t.Errorf("rejections not logged:\n%s", out)
+	}
+}
+
+func TestProxyProtocolAllowlist(t *testing.T) {
+	if _, err := NewProxyProtocol([]string{"10.0.0.0/33"}, 0, nil); err == nil {
+		t.Error("bad CIDR accepted")
+	}
+	for _, tt := range []struct {
+		allow        string
+		plain, proxy bool // served
+	}{
+		{"127.0.0.0/8", false, true},
+		{"::ffff:127.0.0.1", false, true},
+		{"192.0.2.0/24", true, false},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pp, err := NewProxyProtocol([]string{tt.allow}, time.Second, &lineLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoAddrServer(t, pp.Listener(ln))
+		got, err := rawGet(t, ln.Addr().String(), nil)
+		if (err == nil) != tt.plain || (tt.plain && !strings.HasPrefix(got, "127.0.0.1:")) {
+			t.Errorf("allow %s, no header: %q (%v)", tt.allow, got, err)
+		}
+		got, err = rawGet(t, ln.Addr().String(), []byte("PROXY TCP4 203.0.113.7 198.51.100.1 51000 443\r\n"))
+		if (err == nil) != tt.proxy || (tt.proxy && !strings.HasPrefix(got, "203.0.113.7:51000")) {
+			t.Errorf("allow %s, header: %q (%v)", tt.allow, got, err)
+		}
+	}
+}
+
+// recordingListener keeps the bytes read off each accepted connection.
+type recordingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []*bytes.Buffer
+}
+
+type recordingConn struct {
+	net.Conn
+	l   *recordingListener
+	buf *bytes.Buffer
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf := &bytes.Buffer{}
+	l.conns = append(l.conns, buf)
+	return &recordingConn{Conn: conn, l: l, buf: buf}, nil
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.mu.Lock()
+	c.buf.Write(p[:n])
+	c.l.mu.Unlock()
+	return n, err
+}
+
+// received returns the bytes read off each connection so far.
+func (l *recordingListener) received() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var got []string
+	for _, buf := range l.conns {
+		got = append(got, buf.String())
+	}
+	return got
+}
+
+func TestSendProxy(t *testing.T) {
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		t.Run(version, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := &recordingListener{Listener: ln}
+			pp, err := NewProxyProtocol(nil, time.Second, &lineLogger{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			echoAddrServer(t, pp.Listener(rec))
+			backend := "http://" + ln.Addr().String()
+
+			pool, err := NewPool([]string{backend + ",send_proxy=" + version}, WithLogger(&lineLogger{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lb := httptest.NewServer(pool)
+			t.Cleanup(lb.Close)
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			var echoes []string
+			for range 2 {
+				resp, err := client.Get(lb.URL + "/v1/models")
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				echoes = append(echoes, string(body))
+			}
+
+			hc := NewHealthChecker(pool, WithLogger(&lineLogger{}))
+			hc.checkBackend(context.Background(), pool.GetBackends()[0])
+			if !pool.GetBackends()[0].IsHealthy() {
+				t.Fatal("health check through send_proxy failed")
+			}
+
+			got := rec.received()
+			if len(got) != 3 {
+				t.Fatalf("%d backend connections, want one per request and check: %q", len(got), got)
+			}
+			lbAddr := strings.TrimPrefix(lb.URL, "http://")
+			for i, echo := range echoes {
+				clientAddr, reached, _ := strings.Cut(echo, " ")
+				if !strings.HasPrefix(clientAddr, "127.0.0.1:") || clientAddr == lbAddr || reached != lbAddr {
+					t.Errorf("request %d reached the backend as %q", i, echo)
+				}
+				src, dst := mustAddrPort(t, clientAddr), mustAddrPort(t, lbAddr)
+				want := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", src.Port(), dst.Port())
+				if version == ProxyProtocolV2 {
+					want = string(v2Header(t, clientAddr, lbAddr))
+				}
+				want += "GET /v1/models HTTP/1.1\r\n"
+				if !strings.HasPrefix(got[i], want) {
+					t.Errorf("request %d sent %q, want %q", i, got[i][:min(len(got[i]), len(want))], want)
+				}
+			}
+			wantCheck := "PROXY UNKNOWN\r\nGET "
+			if version == ProxyProtocolV2 {
+				wantCheck = string(proxyV2Signature) + "\x20\x00\x00\x00GET "
+			}
+			if !strings.HasPrefix(got[2], wantCheck) {
+				t.Errorf("health check sent %q, want %q", got[2], wantCheck)
+			}
+		})
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	c := &proxyClient{src: mustAddrPort(t, "[::ffff:203.0.113.7]:51000"), dst: mustAddrPort(t, "198.51.100.1:443")}
+	if got := string(proxyHeader(ProxyProtocolV1, c)); got != "PROXY TCP4 203.0.113.7 198.51.100.1 51000 443\r\n" {
+		t.Errorf("mapped v1 header %q", got)
+	}
+	mixed := &proxyClient{src: mustAddrPort(t, "203.0.113.7:51000"), dst: mustAddrPort(t, "[2001:db8::1]:443")}
+	if got := string(proxyHeader(ProxyProtocolV1, mixed)); got != "PROXY UNKNOWN\r\n" {
+		t.Errorf("mixed v1 header %q", got)
+	}
+	if got := proxyHeader(ProxyProtocolV2, mixed); !bytes.Equal(got[12:], []byte{proxyV2Proxy, proxyV2Unspec, 0, 0}) {
+		t.Errorf("mixed v2 header %x", got)
+	}
+	// What we send, we read back.
+	six := &proxyClient{src: mustAddrPort(t, "[2001:db8::7]:51000"), dst: mustAddrPort(t, "[2001:db8::1]:443")}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, c := range []*proxyClient{c, six} {
+			src, dst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(version, c))))
+			want := fmt.Sprintf("%s %s", netip.AddrPortFrom(c.src.Addr().Unmap(), c.src.Port()), c.dst)
+			if err != nil || fmt.Sprintf("%s %s", src, dst) != want {
+				t.Errorf("%s round trip: %v %v (%v), want %s", version, src, dst, err, want)
+			}
+		}
+	}
+	if _, err := ParseBackendSpec("http://b:8000,send_proxy=v3"); err == nil {
+		t.Error("send_proxy=v3 accepted")
+	}
+	if s, err := ParseBackendSpec("http://b:8000,send_proxy=v2"); err != nil || s.SendProxy != ProxyProtocolV2 || s.String() != "http://b:8000,send_proxy=v2" {
+		t.Errorf("send_proxy=v2 parsed as %+v (%v)", s, err)
+	}
+}
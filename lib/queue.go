@@ -0,0 +1,356 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admission queue (--queue-size): by default a request arriving while every
+// healthy backend is at --max-conns is rejected with 429 at once. With a
+// queue it waits, FIFO, for a slot to free up — at most QueueConfig.Timeout,
+// after which it gets the same 429. Queued requests learn where they stand:
+// the response carries X-Queue-Position (requests ahead of it on arrival,
+// plus one) and X-Estimated-Wait (seconds, from the recent dequeue rate).
+//
+// Clients on long waits may time out without any bytes on the wire, so paths
+// explicitly marked as progress-capable also get keepalives while queued:
+// SSE comment lines when the client accepts text/event-stream, otherwise
+// single newlines, which JSON parsers skip as leading whitespace. Sending a
+// keepalive commits the response to 200 before a backend is chosen, so a
+// later backend error arrives in the body; that is why it is opt-in per path.
+
+// QueueConfig enables and tunes the admission queue.
+type QueueConfig struct {
+	// Size caps the number of waiting requests; beyond it requests get 429.
+	Size int
+	// Timeout bounds the wait for a slot.
+	Timeout time.Duration
+	// ProgressPaths are path prefixes whose queued requests get keepalives.
+	ProgressPaths []string
+	// ProgressInterval is the keepalive period.
+	ProgressInterval time.Duration
+	// TenantHeader, when set, queues each tenant (the header's value) in
+	// its own FIFO and dispatches round-robin across tenants (see
+	// fairqueue.go).
+	TenantHeader string
+	// TenantSize caps each tenant's waiting requests (0 = only Size).
+	TenantSize int
+	// Prioritized dispatches by request priority, then FIFO within a
+	// priority, with a request waiting PromoteAfter (0 = never) competing
+	// as high (see reqpriority.go). It excludes TenantHeader.
+	Prioritized  bool
+	PromoteAfter time.Duration
+}
+
+// queueEWMAAlpha weights each new dequeue interval sample.
+const queueEWMAAlpha = 0.2
+
+// errResponded means the queue already wrote the error response (after
+// keepalives committed the status), so the caller must not write another.
+var errResponded = errors.New("response already written")
+
+type admissionQueue struct {
+	cfg   QueueConfig
+	clock Clock
+
+	mu      sync.Mutex
+	waiters *list.List // of *queueWaiter, in arrival order
+	// tenants are each tenant's waiters (elements of waiters), FIFO, and
+	// turns the tenants with waiters in dispatch order, the first fresh of
+	// them not yet served; tenants is nil without fair queuing (see
+	// fairqueue.go)
+	tenants map[string]*list.List
+	turns   []string
+	fresh   int
+	// classes are each priority's waiters (elements of waiters), FIFO, nil
+	// unless prioritized; waits and promoted record the admitted ones
+	classes  [numPriorities]*list.List
+	waits    [numPriorities]latencyHistogram
+	promoted [numPriorities]atomic.Uint64
+	// dequeueEvery is an EWMA of the time between dequeues
+	dequeueEvery time.Duration
+	lastDequeue  time.Time
+}
+
+type queueWaiter struct {
+	wake chan struct{} // buffered: a wake-up is never lost
+	// tenant is the request's tenant and inTenant its element in the
+	// tenant's FIFO, with fair queuing
+	tenant   string
+	inTenant *list.Element
+	// priority is the request's priority, inClass its element in the
+	// priority's FIFO and queuedAt its arrival, when prioritized
+	priority RequestPriority
+	inClass  *list.Element
+	queuedAt time.Time
+}
+
+// SetQueue enables the admission queue for requests arriving at capacity.
+// Call before serving traffic.
+func (p *Pool) SetQueue(cfg QueueConfig) {
+	if cfg.ProgressInterval <= 0 {
+		cfg.ProgressInterval = 5 * time.Second
+	}
+	p.queue = &admissionQueue{cfg: cfg, clock: p.clock, waiters: list.New()}
+	switch {
+	case cfg.Prioritized:
+		for prio := range p.queue.classes {
+			p.queue.classes[prio] = list.New()
+		}
+	case cfg.TenantHeader != "":
+		p.queue.tenants = make(map[string]*list.List)
+	}
+}
+
+// admit reserves a backend through sel, waiting in the queue (if enabled)
+// while every healthy backend is at capacity.
+func (p *Pool) admit(w http.ResponseWriter, r *http.Request, sel func() (*Backend, error)) (*Backend, error) {
+	if p.queue == nil {
+		return sel()
+	}
+	return p.queue.admit(w, r, sel)
+}
+
+// wakeQueued tells the next request to dispatch that a slot was released.
+func (p *Pool) wakeQueued() {
+	if p.queue != nil {
+		p.queue.wakeHead()
+	}
+}
+
+// QueueDepth returns the number of requests waiting for a slot.
+func (p *Pool) QueueDepth() int {
+	if p.queue == nil {
+		return 0
+	}
+	p.queue.mu.Lock()
+	defer p.queue.mu.Unlock()
+	return p.queue.waiters.Len()
+}
+
+func (q *admissionQueue) admit(w http.ResponseWriter, r *http.Request, sel func() (*Backend, error)) (*Backend, error) {
+	q.mu.Lock()
+	empty := q.waiters.Len() == 0
+	q.mu.Unlock()
+	// Only try directly when nobody is waiting: arrivals must not overtake
+	// the queue.
+	if empty {
+		if b, err := sel(); !errors.Is(err, errAtCapacity) {
+			if err == nil && q.prioritized() {
+				q.waits[priorityOf(r.Context())].observe(0)
+			}
+			return b, err
+		}
+	}
+
+	tenant := q.tenantOf(r)
+	q.mu.Lock()
+	if q.waiters.Len() >= q.cfg.Size {
+		q.mu.Unlock()
+		return nil, errAtCapacity
+	}
+	if q.tenantFullLocked(tenant) {
+		q.mu.Unlock()
+		return nil, errTenantQueueFull
+	}
+	waiter := &queueWaiter{wake: make(chan struct{}, 1), tenant: tenant, priority: priorityOf(r.Context()), queuedAt: q.clock.Now()}
+	el := q.pushLocked(waiter)
+	position := q.positionLocked(el)
+	eta := time.Duration(position) * q.dequeueEvery
+	q.mu.Unlock()
+
+	h := w.Header()
+	h.Set("X-Queue-Position", strconv.Itoa(position))
+	if eta > 0 {
+		h.Set("X-Estimated-Wait", strconv.FormatFloat(eta.Seconds(), 'f', 1, 64))
+	}
+
+	var progress *queueProgress
+	if q.progressPath(r.URL.Path) {
+		progress = newQueueProgress(w, r)
+	}
+
+	timeout := q.clock.After(q.cfg.Timeout)
+	ticker := q.clock.NewTicker(q.cfg.ProgressInterval)
+	defer ticker.Stop()
+	if position == 1 {
+		waiter.wake <- struct{}{} // a slot may have freed since sel failed
+	}
+	for {
+		var failed error
+		woken := false
+		select {
+		case <-waiter.wake:
+			woken = true
+		case <-ticker.C():
+			if progress != nil {
+				progress.send(q.position(el), q.estimate(el))
+			}
+		case <-timeout:
+			failed = context.DeadlineExceeded
+		case <-r.Context().Done():
+			failed = r.Context().Err()
+		}
+		if failed != nil {
+			q.remove(el)
+			if progress != nil && progress.started {
+				progress.fail(failed)
+				return nil, errResponded
+			}
+			if r.Context().Err() != nil {
+				return nil, r.Context().Err()
+			}
+			return nil, errAtCapacity
+		}
+
+		if !q.isHead(el) {
+			if woken && q.prioritized() {
+				// The head changed since the wake-up was sent (a higher
+				// priority arrived, or a waiter aged): pass it on.
+				q.wakeHead()
+			}
+			continue
+		}
+		b, err := sel()
+		if errors.Is(err, errAtCapacity) {
+			continue // still full; wait for the next release
+		}
+		q.dequeue(el)
+		if err != nil && progress != nil && progress.started {
+			progress.fail(err)
+			return nil, errResponded
+		}
+		return b, err
+	}
+}
+
+func (q *admissionQueue) progressPath(path string) bool {
+	for _, prefix := range q.cfg.ProgressPaths {
+		if pathHasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *admissionQueue) isHead(el *list.Element) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.headLocked() == el
+}
+
+// position returns el's 1-based place in the queue.
+func (q *admissionQueue) position(el *list.Element) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.positionLocked(el)
+}
+
+func (q *admissionQueue) estimate(el *list.Element) time.Duration {
+	pos := q.position(el)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Duration(pos) * q.dequeueEvery
+}
+
+// dequeue removes the admitted head, updates the dequeue rate, and passes
+// the turn on: capacity may remain for the next waiter too.
+func (q *admissionQueue) dequeue(el *list.Element) {
+	now := q.clock.Now()
+	q.mu.Lock()
+	if q.prioritized() {
+		q.recordAdmittedLocked(el.Value.(*queueWaiter), now)
+	}
+	q.removeLocked(el, true)
+	if !q.lastDequeue.IsZero() {
+		sample := now.Sub(q.lastDequeue)
+		if q.dequeueEvery == 0 {
+			q.dequeueEvery = sample
+		} else {
+			q.dequeueEvery += time.Duration(queueEWMAAlpha * float64(sample-q.dequeueEvery))
+		}
+	}
+	q.lastDequeue = now
+	q.mu.Unlock()
+	q.wakeHead()
+}
+
+// remove drops a waiter that gave up, waking the new head if it was first.
+func (q *admissionQueue) remove(el *list.Element) {
+	q.mu.Lock()
+	wasHead := q.headLocked() == el
+	q.removeLocked(el, false)
+	q.mu.Unlock()
+	if wasHead {
+		q.wakeHead()
+	}
+}
+
+func (q *admissionQueue) wakeHead() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if front := q.headLocked(); front != nil {
+		select {
+		case front.Value.(*queueWaiter).wake <- struct{}{}:
+		default: // already has a pending wake-up
+		}
+	}
+}
+
+// queueProgress writes keepalives to a queued request on a progress path.
+type queueProgress struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	sse     bool
+	started bool
+}
+
+func newQueueProgress(w http.ResponseWriter, r *http.Request) *queueProgress {
+	return &queueProgress{
+		w:   w,
+		rc:  http.NewResponseController(w),
+		sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream"),
+	}
+}
+
+// send writes one keepalive, committing the 200 response on the first.
+func (qp *queueProgress) send(position int, eta time.Duration) {
+	if !qp.started {
+		qp.started = true
+		if qp.sse {
+			qp.w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			qp.w.Header().Set("Content-Type", "application/json")
+		}
+		qp.w.WriteHeader(http.StatusOK)
+	}
+	if qp.sse {
+		_, _ = fmt.Fprintf(qp.w, ": queued position=%d estimated_wait=%.1fs\n\n", position, eta.Seconds())
+	} else {
+		_, _ = qp.w.Write([]byte("\n"))
+	}
+	_ = qp.rc.Flush()
+}
+
+// fail ends a committed response with an error in the body: an SSE error
+// event, or a JSON error object after the whitespace keepalives.
+func (qp *queueProgress) fail(err error) {
+	msg := "Rate limit reached: timed out waiting for a free backend, please retry later."
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errAtCapacity) {
+		msg = "Service Unavailable: " + err.Error()
+	}
+	body := fmt.Sprintf(`{"error":{"message":%q,"type":"rate_limit_error","code":"rate_limit_exceeded"}}`, msg)
+	if qp.sse {
+		_, _ = fmt.Fprintf(qp.w, "event: error\ndata: %s\n\n", body)
+	} else {
+		_, _ = qp.w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queuedPool returns a pool over one backend that holds each request for
+// hold before answering with a JSON body, with one slot and a queue.
+func queuedPool(t *testing.T, hold time.Duration, cfg QueueConfig) (*Pool, *httptest.Server) {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(hold)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"chat.completion"}`))
+	}))
+	t.Cleanup(backend.Close)
+	pool, err := NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetMaxConns(1)
+	pool.SetQueue(cfg)
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	return pool, lb
+}
+
+// occupy sends a request that takes the pool's only slot and returns once
+// it is in flight; the returned channel closes when it completes.
+func occupy(t *testing.T, pool *Pool, url string) <-chan struct{} {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.Get(url); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	for pool.GetBackends()[0].GetActiveConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestQueuedRequestGetsPositionHeaders(t *testing.T) {
+	pool, lb := queuedPool(t, 50*time.Millisecond, QueueConfig{Size: 4, Timeout: 5 * time.Second})
+
+	// Build up a dequeue rate, then queue behind a busy slot.
+	for range 3 {
+		done := occupy(t, pool, lb.URL+"/v1/chat/completions")
+		resp, err := http.Get(lb.URL + "/v1/chat/completions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		<-done
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("queued request: status %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Queue-Position"); got != "1" {
+			t.Errorf("X-Queue-Position = %q, want 1", got)
+		}
+		if !json.Valid(body) {
+			t.Errorf("queued JSON response not parseable: %q", body)
+		}
+	}
+	resp, err := http.Get(lb.URL + "/v1/chat/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Header.Get("X-Queue-Position") != "" {
+		t.Error("request that was not queued has X-Queue-Position")
+	}
+
+	done := occupy(t, pool, lb.URL+"/v1/chat/completions")
+	resp, err = http.Get(lb.URL + "/v1/chat/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	<-done
+	if resp.Header.Get("X-Estimated-Wait") == "" {
+		t.Error("no X-Estimated-Wait once a dequeue rate is known")
+	}
+}
+
+func TestQueueTimeoutAndOverflow(t *testing.T) {
+	pool, lb := queuedPool(t, 300*time.Millisecond, QueueConfig{Size: 1, Timeout: 50 * time.Millisecond})
+	done := occupy(t, pool, lb.URL+"/v1/completions")
+	defer func() { <-done }()
+
+	timedOut := make(chan int)
+	go func() {
+		resp, err := http.Get(lb.URL + "/v1/completions")
+		if err != nil {
+			timedOut <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		timedOut <- resp.StatusCode
+	}()
+	for pool.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The queue holds one request; the next one is rejected at once.
+	resp, err := http.Get(lb.URL + "/v1/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("full queue: status %d, want 429", resp.StatusCode)
+	}
+	if code := <-timedOut; code != http.StatusTooManyRequests {
+		t.Errorf("queue timeout: status %d, want 429", code)
+	}
+	if n := pool.QueueDepth(); n != 0 {
+		t.Errorf("queue depth %d after timeout, want 0", n)
+	}
+}
+
+func TestQueueProgressKeepalives(t *testing.T) {
+	cfg := QueueConfig{
+		Size:             4,
+		Timeout:          5 * time.Second,
+		ProgressPaths:    []string{"/v1/chat"},
+		ProgressInterval: 10 * time.Millisecond,
+	}
+	pool, lb := queuedPool(t, 100*time.Millisecond, cfg)
+
+	get := func(path, accept string) (*http.Response, string) {
+		t.Helper()
+		done := occupy(t, pool, lb.URL+path)
+		defer func() { <-done }()
+		req, _ := http.NewRequest(http.MethodGet, lb.URL+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// JSON client on a progress path: whitespace keepalives, still valid JSON.
+	resp, body := get("/v1/chat/completions", "")
+	if !strings.HasPrefix(body, "\n") {
+		t.Errorf("no whitespace keepalive before the JSON body: %q", body)
+	}
+	var v map[string]any
+	if err := json.Unmarshal([]byte(body), &v); err != nil || v["object"] != "chat.completion" {
+		t.Errorf("JSON body after keepalives not parseable: %v (%q)", err, body)
+	}
+	if resp.Header.Get("X-Queue-Position") != "1" {
+		t.Errorf("X-Queue-Position = %q, want 1", resp.Header.Get("X-Queue-Position"))
+	}
+
+	// SSE client: comment lines carry the position.
+	_, body = get("/v1/chat/completions", "text/event-stream")
+	if !strings.HasPrefix(body, ": queued position=1 ") {
+		t.Errorf("no SSE progress comment: %q", body)
+	}
+
+	// Paths not marked for progress never get keepalives.
+	_, body = get("/v1/completions", "")
+	if body != `{"object":"chat.completion"}` {
+		t.Errorf("unmarked path body altered: %q", body)
+	}
+}
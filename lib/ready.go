@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness gate (--wait-ready): backends are selectable from the start,
+// before any health check has run, and show as "unknown" until one has
+// decided their state. cmd/lb can instead hold off serving until enough of
+// a pool's backends have passed a probe (WaitReady), and then open a
+// keep-alive connection to each of them (Prewarm) so the first requests do
+// not pay for the dial.
+
+// readyRetryInterval spaces WaitReady's probes of backends that have yet
+// to pass.
+const readyRetryInterval = time.Second
+
+// prewarmBodyLimit is how much of a probe response Prewarm reads to leave
+// its connection reusable; the connection of a longer one is dropped.
+const prewarmBodyLimit = 64 << 10
+
+// unknownLocked reports whether no health check has yet decided the
+// backend's state. Caller must hold b.mu.
+func (b *Backend) unknownLocked() bool {
+	return b.healthy && !b.ready
+}
+
+// ReadyCount returns how many of the pool's backends have passed a health
+// check and are healthy.
+func (p *Pool) ReadyCount() int {
+	n := 0
+	for _, b := range p.GetBackends() {
+		b.mu.Lock()
+		if b.healthy && b.ready {
+			n++
+		}
+		b.mu.Unlock()
+	}
+	return n
+}
+
+// WaitReady probes the pool's backends until at least minHealthy have
+// passed a health check, and returns how many have; cancelling ctx ends the
+// wait early. Backends that fail are probed again every readyRetryInterval
+// and, like any recovering backend, need healthyThreshold passing probes.
+func (hc *HealthChecker) WaitReady(ctx context.Context, minHealthy int) int {
+	ticker := hc.clock.NewTicker(readyRetryInterval)
+	defer ticker.Stop()
+	for {
+		var pending []*Backend
+		for _, b := range hc.pool.GetBackends() {
+			b.mu.Lock()
+			if !b.healthy || !b.ready {
+				pending = append(pending, b)
+			}
+			b.mu.Unlock()
+		}
+		hc.checkBackends(ctx, pending)
+		if n := hc.pool.ReadyCount(); n >= minHealthy || ctx.Err() != nil {
+			return n
+		}
+		select {
+		case <-ctx.Done():
+			return hc.pool.ReadyCount()
+		case <-ticker.C():
+		}
+	}
+}
+
+// Prewarm leaves an idle keep-alive connection to each backend that has
+// passed a health check, in the transport the proxies share, by probing it
+// again and reading the response to the end. Backends probed on another host
+// (",health=URL") or not over HTTP (see prober.go) are skipped. It returns
+// how many were warmed.
+func (hc *HealthChecker) Prewarm(ctx context.Context) int {
+	var warmed atomic.Int32
+	sem := make(chan struct{}, max(1, hc.concurrency))
+	var wg sync.WaitGroup
+	for _, b := range hc.pool.GetBackends() {
+		b.mu.Lock()
+		ok := b.healthy && b.ready && hc.pool.healthCheckOf(b) == HealthCheckHTTP
+		b.mu.Unlock()
+		health, err := url.Parse(hc.pool.HealthURL(b))
+		if !ok || err != nil || health.Scheme != b.URL.Scheme || health.Host != b.URL.Host {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			if hc.prewarm(ctx, b, health.String()) {
+				warmed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	return int(warmed.Load())
+}
+
+func (hc *HealthChecker) prewarm(ctx context.Context, b *Backend, healthURL string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
+	if err != nil || b.decorate(req) != nil {
+		return false
+	}
+	resp, err := hc.clientFor(b).Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, prewarmBodyLimit+1))
+	return err == nil && n <= prewarmBodyLimit
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	captureLog(t)
+	up := echoServer(t)
+	var failing atomic.Bool
+	failing.Store(true)
+	flapping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(flapping.Close)
+	pool, err := NewPool([]string{up.URL, flapping.URL, "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range pool.Stats().Backends {
+		if s.State != "unknown" {
+			t.Errorf("%s: %q before any health check", s.URL, s.State)
+		}
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+
+	if n := hc.WaitReady(context.Background(), 1); n != 1 {
+		t.Errorf("%d ready, want 1", n)
+	}
+	states := map[string]string{}
+	for _, s := range pool.Stats().Backends {
+		states[s.URL] = s.State
+	}
+	if states[up.URL] != "healthy" || states[flapping.URL] != "unhealthy" || states["http://127.0.0.1:1"] != "unhealthy" {
+		t.Errorf("states after the first probes: %v", states)
+	}
+
+	// The failed ones are probed again until enough pass...
+	failing.Store(false)
+	if n := hc.WaitReady(context.Background(), 2); n != 2 {
+		t.Errorf("%d ready, want 2", n)
+	}
+	// ...or the wait is cut short.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if n := hc.WaitReady(ctx, 3); n != 2 {
+		t.Errorf("%d ready at the deadline, want 2", n)
+	}
+	if b := pool.GetBackends()[2]; b.IsHealthy() {
+		t.Error("dead backend healthy")
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	captureLog(t)
+	var dials atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	pool, err := NewPool([]string{srv.URL, srv.URL + "/v2,health=http://127.0.0.1:1/health"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	if n := hc.Prewarm(context.Background()); n != 0 {
+		t.Errorf("%d warmed before any health check", n)
+	}
+	for _, b := range pool.GetBackends() {
+		b.RecordCheckSuccess()
+	}
+	if n := hc.Prewarm(context.Background()); n != 1 {
+		t.Errorf("%d warmed, want 1 (the other is probed elsewhere)", n)
+	}
+	before := dials.Load()
+	rec := httptest.NewRecorder()
+	pool.GetBackends()[0].GetProxy().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if got := dials.Load(); got != before {
+		t.Errorf("first request dialed (%d connections, %d after prewarm)", got, before)
+	}
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stuck requests: a backend that hangs (the mock's timeout mode, a wedged
+// model server) holds each request sent to it — a goroutine, a backend
+// connection and a slot of its connection count — until the request
+// timeout, hours on a completions route. Every request at a backend is
+// tracked with its start time, so GET /admin/inflight-requests?min_age=D
+// lists those older than D with their backend and path, and /stats shows
+// the oldest's age. With --max-request-age a RequestReaper sweeps the pool
+// and cancels the context of each request over the age: the transport
+// closes its backend connection (a hung connection is never reused), the
+// client gets 504 like any request over its timeout, and Pool.proxy
+// releases the connection slot as it returns. Only the time at a backend
+// counts; time queued for admission does not.
+
+// errRequestReaped is the context cause of a request cut off by the reaper.
+// It wraps errRequestTimeout: the client, the logs and the backend's
+// timeouts count treat it as a timeout.
+var errRequestReaped = fmt.Errorf("%w: over the max request age", errRequestTimeout)
+
+// requestTracker holds a pool's requests in flight at its backends.
+type requestTracker struct {
+	mu       sync.Mutex
+	requests map[*trackedRequest]struct{}
+	// reaped counts the requests cut off by a RequestReaper
+	reaped atomic.Uint64
+}
+
+type trackedRequest struct {
+	backend *Backend
+	method  string
+	path    string
+	start   time.Time
+	cancel  context.CancelCauseFunc
+}
+
+// InflightRequest is one request in flight at a backend, as
+// Pool.InflightRequests lists it.
+type InflightRequest struct {
+	Backend   string    `json:"backend"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Started   time.Time `json:"started"`
+	ElapsedMs float64   `json:"elapsed_ms"`
+}
+
+// track records r as in flight at backend until the returned release is
+// called, returning r with a context the reaper can cancel.
+func (p *Pool) track(r *http.Request, backend *Backend) (*http.Request, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	req := &trackedRequest{backend: backend, method: r.Method, path: r.URL.Path, start: p.clock.Now(), cancel: cancel}
+	t := &p.tracker
+	t.mu.Lock()
+	if t.requests == nil {
+		t.requests = make(map[*trackedRequest]struct{})
+	}
+	t.requests[req] = struct{}{}
+	t.mu.Unlock()
+	return r.WithContext(ctx), func() {
+		t.mu.Lock()
+		delete(t.requests, req)
+		t.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// InflightRequests returns the requests in flight at the pool's backends for
+// at least minAge, oldest first.
+func (p *Pool) InflightRequests(minAge time.Duration) []InflightRequest {
+	now := p.clock.Now()
+	var out []InflightRequest
+	p.tracker.mu.Lock()
+	for req := range p.tracker.requests {
+		if elapsed := now.Sub(req.start); elapsed >= minAge {
+			out = append(out, InflightRequest{
+				Backend:   req.backend.ID(),
+				Method:    req.method,
+				Path:      req.path,
+				Started:   req.start,
+				ElapsedMs: float64(elapsed) / float64(time.Millisecond),
+			})
+		}
+	}
+	p.tracker.mu.Unlock()
+	slices.SortFunc(out, func(a, b InflightRequest) int { return a.Started.Compare(b.Started) })
+	return out
+}
+
+// oldestRequest returns how long the oldest request in flight at the pool's
+// backends has been there at now, 0 with none.
+func (p *Pool) oldestRequest(now time.Time) time.Duration {
+	p.tracker.mu.Lock()
+	defer p.tracker.mu.Unlock()
+	var oldest time.Duration
+	for req := range p.tracker.requests {
+		oldest = max(oldest, now.Sub(req.start))
+	}
+	return oldest
+}
+
+// RequestReaper cancels requests that have been at a backend longer than
+// a maximum age.
+type RequestReaper struct {
+	pool   *Pool
+	maxAge time.Duration
+	clock  Clock
+	logger Logger
+}
+
+// NewRequestReaper creates a reaper cutting off the pool's requests older
+// than maxAge, on the pool's clock and logger unless opts give others.
+func NewRequestReaper(pool *Pool, maxAge time.Duration, opts ...Option) *RequestReaper {
+	return &RequestReaper{pool: pool, maxAge: maxAge, clock: clockFrom(pool.clock, opts), logger: loggerFrom(pool.logger, opts)}
+}
+
+// interval is the time between sweeps: a tenth of the max age, at most
+// 10s, so a request is cut off within 10% of it.
+func (rr *RequestReaper) interval() time.Duration {
+	return min(max(rr.maxAge/10, time.Millisecond), 10*time.Second)
+}
+
+// Start runs sweeps until ctx is done or the pool is closed.
+func (rr *RequestReaper) Start(ctx context.Context) {
+	ctx, cancel := rr.pool.bind(ctx)
+	defer cancel()
+	ticker := rr.clock.NewTicker(rr.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			rr.sweep()
+		}
+	}
+}
+
+// sweep cancels the requests over the max age and returns how many.
+func (rr *RequestReaper) sweep() int {
+	now := rr.clock.Now()
+	t := &rr.pool.tracker
+	var stuck []*trackedRequest
+	t.mu.Lock()
+	for req := range t.requests {
+		if now.Sub(req.start) >= rr.maxAge {
+			stuck = append(stuck, req)
+			delete(t.requests, req) // reaped once; release is then a no-op
+		}
+	}
+	t.mu.Unlock()
+	for _, req := range stuck {
+		t.reaped.Add(1)
+		rr.logger.Printf("[PROXY] %s reaping %s %s after %v (max request age %v)",
+			req.backend.ID(), req.method, req.path, now.Sub(req.start).Round(time.Millisecond), rr.maxAge)
+		req.cancel(errRequestReaped)
+	}
+	return len(stuck)
+}
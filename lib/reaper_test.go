@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// hangRequests sends n requests through lb in the background and returns
+// a function waiting for their status codes.
+func hangRequests(t *testing.T, lb *httptest.Server, n int) func() []int {
+	t.Helper()
+	statuses := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			resp, err := http.Post(lb.URL+"/v1/completions", "application/json", strings.NewReader(`{"prompt": "hi"}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		})
+	}
+	return func() []int {
+		wg.Wait()
+		return statuses
+	}
+}
+
+func TestRequestReaper(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.Config{Mode: mockbackend.ModeTimeout})
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	pool, err := NewPool([]string{mock.URL}, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	b := pool.GetBackends()[0]
+	reaper := NewRequestReaper(pool, time.Minute)
+
+	wait := hangRequests(t, lb, 3)
+	waitFor(t, "the requests to hang at the backend", func() bool { return mock.Stats().InFlight == 3 })
+	if got := pool.InflightRequests(0); len(got) != 3 || got[0].Backend != mock.URL || got[0].Method != http.MethodPost || got[0].Path != "/v1/completions" {
+		t.Fatalf("in flight %+v", got)
+	}
+	clock.advance(30 * time.Second)
+	if n := reaper.sweep(); n != 0 {
+		t.Fatalf("reaped %d requests under the max age", n)
+	}
+	if got := pool.InflightRequests(time.Minute); len(got) != 0 {
+		t.Errorf("%d requests listed over a minute old after 30s", len(got))
+	}
+	if s := pool.Stats(); s.OldestRequestMs != 30_000 {
+		t.Errorf("oldest request %vms, want 30000", s.OldestRequestMs)
+	}
+
+	clock.advance(30 * time.Second)
+	if got := pool.InflightRequests(time.Minute); len(got) != 3 || got[0].ElapsedMs != 60_000 {
+		t.Fatalf("zombies %+v", got)
+	}
+	if n := reaper.sweep(); n != 3 {
+		t.Fatalf("reaped %d requests, want 3", n)
+	}
+	for i, status := range wait() {
+		if status != http.StatusGatewayTimeout {
+			t.Errorf("request %d: status %d, want 504", i, status)
+		}
+	}
+	// Cutting a request off closes its backend connection, which ends the
+	// backend's handler.
+	waitFor(t, "the backend connections to close", func() bool { return mock.Stats().InFlight == 0 })
+	if n := b.GetActiveConns(); n != 0 {
+		t.Errorf("active conns %d after reaping", n)
+	}
+	if got := pool.InflightRequests(0); len(got) != 0 {
+		t.Errorf("still tracked: %+v", got)
+	}
+	s := pool.Stats()
+	if s.ReapedRequests != 3 || s.OldestRequestMs != 0 || b.Timeouts() != 3 {
+		t.Errorf("reaped %d, oldest %vms, timeouts %d", s.ReapedRequests, s.OldestRequestMs, b.Timeouts())
+	}
+	if !b.IsHealthy() {
+		t.Error("reaped requests counted against the backend's health")
+	}
+}
+
+func TestRequestReaperStart(t *testing.T) {
+	mock := mockbackend.Start(t, mockbackend.Config{Mode: mockbackend.ModeTimeout})
+	pool, err := NewPool([]string{mock.URL}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewRequestReaper(pool, 50*time.Millisecond).Start(ctx)
+
+	start := time.Now()
+	statuses := hangRequests(t, lb, 2)()
+	if statuses[0] != http.StatusGatewayTimeout || statuses[1] != http.StatusGatewayTimeout {
+		t.Errorf("statuses %v, want 504s", statuses)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("reaped after %v", elapsed)
+	}
+	waitFor(t, "the backend connections to close", func() bool { return mock.Stats().InFlight == 0 })
+	if n := pool.GetBackends()[0].GetActiveConns(); n != 0 {
+		t.Errorf("active conns %d after reaping", n)
+	}
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// Redirect following (per route, "follow_redirects" in the config file): a
+// backend that answers with a redirect to itself — e.g. /v1/models ->
+// /v1/models/ — gets the redirected request from lb directly instead of the
+// client seeing the 3xx. Redirects to other hosts are always passed through.
+
+// maxFollowRedirects bounds a route's follow_redirects setting.
+const maxFollowRedirects = 5
+
+type followRedirectsKey struct{}
+
+// withFollowRedirects lets the backend transport follow up to n same-backend
+// redirects for requests carrying ctx.
+func withFollowRedirects(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, followRedirectsKey{}, n)
+}
+
+// redirectTransport wraps the backend transport and follows same-backend
+// redirects for requests that asked for it via withFollowRedirects. Only
+// bodiless requests are followed: a streamed request body cannot be replayed.
+type redirectTransport struct {
+	base http.RoundTripper
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limit, _ := req.Context().Value(followRedirectsKey{}).(int)
+	resp, err := t.base.RoundTrip(req)
+	for hops := 0; err == nil && hops < limit; hops++ {
+		next := redirectRequest(req, resp)
+		if next == nil {
+			break
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		_ = resp.Body.Close()
+		req = next
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// redirectRequest returns the request following resp's redirect, or nil when
+// resp is not a redirect lb may follow.
+func redirectRequest(req *http.Request, resp *http.Response) *http.Request {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return nil
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	// Same backend: the backend's own address, or the client-facing Host it
+	// was addressed by (an absolute Location built from the Host header).
+	if loc.Host != req.URL.Host && loc.Host != req.Host {
+		return nil
+	}
+	next := req.Clone(req.Context())
+	next.URL.Path, next.URL.RawPath, next.URL.RawQuery = loc.Path, loc.RawPath, loc.RawQuery
+	if resp.StatusCode == http.StatusSeeOther && req.Method != http.MethodHead {
+		next.Method = http.MethodGet
+	}
+	return next
+}
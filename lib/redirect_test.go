@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestEarlyHintsPassThrough(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// Both ResponseWriter wrappers (request log and response cache) sit in
+	// front of the proxy.
+	pool, logPath := newLoggedPool(t, backend.URL)
+	cache := NewResponseCache([]CacheRoute{{Prefix: "/"}}, 10, 1<<20)
+	lb := httptest.NewServer(cache.Handler(pool))
+	defer lb.Close()
+
+	var hints []int
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+		if h.Get("Link") == "" {
+			t.Errorf("%d without the Link header", code)
+		}
+		hints = append(hints, code)
+		return nil
+	}}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(t.Context(), trace), http.MethodGet, lb.URL+"/page", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if len(hints) != 1 || hints[0] != http.StatusEarlyHints {
+		t.Errorf("interim responses = %v, want [103]", hints)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("final response = %d %q, want 200 ok", resp.StatusCode, body)
+	}
+	if e := readLogEntries(t, logPath, 1)[0]; e.Status != http.StatusOK {
+		t.Errorf("logged status = %d, want the final 200", e.Status)
+	}
+	rec := httptest.NewRecorder()
+	cache.Handler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("cached response = %d %q, want the final 200 cached", rec.Code, rec.Header().Get("X-Cache"))
+	}
+}
+
+// redirectingBackend redirects /old to /new (plus a self-loop and an
+// off-host redirect) and counts requests per method and path.
+func redirectingBackend(t *testing.T, status int) (*httptest.Server, map[string]int) {
+	t.Helper()
+	seen := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen[r.Method+" "+r.URL.Path]++
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new?x=1", status)
+		case "/loop":
+			http.Redirect(w, r, "/loop", status)
+		case "/away":
+			http.Redirect(w, r, "http://elsewhere.example/new", status)
+		default:
+			_, _ = w.Write([]byte(r.URL.RequestURI()))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, seen
+}
+
+func TestRedirectPassThrough(t *testing.T) {
+	backend, seen := redirectingBackend(t, http.StatusFound)
+	rt, pools := newTestRouter(t, []RouteConfig{
+		{ID: "all", Prefix: "/", Targets: []RouteTarget{{Pool: "a", Weight: 1}}},
+	}, map[string]string{"a": backend.URL})
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/old", nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/new?x=1" {
+		t.Fatalf("response = %d Location %q, want the 302 passed through", rec.Code, rec.Header().Get("Location"))
+	}
+	if seen["GET /new"] != 0 {
+		t.Error("lb followed the redirect without follow_redirects")
+	}
+	stats := pools["a"].Stats()
+	if !stats.Backends[0].Healthy || stats.Backends[0].Responses["3xx"] != 1 {
+		t.Errorf("backend stats = %+v, want healthy with one 3xx", stats.Backends[0])
+	}
+}
+
+func TestRedirectFollow(t *testing.T) {
+	backend, seen := redirectingBackend(t, http.StatusMovedPermanently)
+	rt, pools := newTestRouter(t, []RouteConfig{
+		{ID: "all", Prefix: "/", Targets: []RouteTarget{{Pool: "a", Weight: 1}}, FollowRedirects: 2},
+	}, map[string]string{"a": backend.URL})
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	if rec := serve(http.MethodGet, "/old"); rec.Code != http.StatusOK || rec.Body.String() != "/new?x=1" {
+		t.Errorf("GET /old = %d %q, want 200 from /new?x=1", rec.Code, rec.Body)
+	}
+	if rec := serve(http.MethodGet, "/loop"); rec.Code != http.StatusMovedPermanently || seen["GET /loop"] != 3 {
+		t.Errorf("GET /loop = %d after %d requests, want the 301 returned after 1+2 hops", rec.Code, seen["GET /loop"])
+	}
+	if rec := serve(http.MethodGet, "/away"); rec.Code != http.StatusMovedPermanently {
+		t.Errorf("GET /away = %d, want redirects to other hosts passed through", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/old", strings.NewReader("{}")))
+	if rec.Code != http.StatusMovedPermanently {
+		t.Errorf("POST /old = %d, want requests with a body passed through", rec.Code)
+	}
+
+	if r := pools["a"].Stats().Backends[0].Responses; r["2xx"] != 1 || r["3xx"] != 3 {
+		t.Errorf("responses = %v, want only final responses counted", r)
+	}
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Hot replacement (PUT /admin/backends/{id}): for blue/green node
+// replacement, a backend's URL is swapped in place, so the pool's size and
+// shape never change. The new backend takes the old one's place in the
+// pool and its configuration — priority, labels, max_conns, max_mbps,
+// timeout, health= and check=, decorator or upstream key, prefix, family,
+// proxy and send_proxy: every attribute of its spec — and starts with
+// fresh counters, healthy, without slow start, so it gets new requests at
+// once. A health= URL on the old backend's host moves to the new host. The
+// old backend leaves the pool like a removed one: no new requests, while
+// those in flight finish in the background for up to the pool's drain
+// timeout (--drain-timeout); any still running then are cut off, answered
+// 503 if nothing was sent yet. Any error leaves the pool as it was.
+// Backends discovery manages are its to replace (see discovery.go).
+
+// errBackendRetired is the context cause of a request cut off on a
+// replaced backend.
+var errBackendRetired = errors.New("backend replaced and its drain timed out")
+
+// replacedDrainPoll is how often a replaced backend's drain checks for
+// requests still in flight.
+const replacedDrainPoll = 100 * time.Millisecond
+
+// SetDrainTimeout bounds how long requests in flight on a replaced backend
+// may run (0 = until they finish). Call before serving traffic.
+func (p *Pool) SetDrainTimeout(d time.Duration) {
+	p.drainTimeout = d
+}
+
+// ReplaceBackend swaps the backend with URL oldURL (matched like
+// ExpectRestart's) for one at newURL with the same configuration, in the
+// same place in the pool, and drains the old one in the background.
+func (p *Pool) ReplaceBackend(oldURL, newURL string) error {
+	old, err := p.Backend(oldURL)
+	if err != nil {
+		return err
+	}
+	if old.discoveredBy != "" {
+		return fmt.Errorf("backend %s is managed by discovery (%s)", old.ID(), old.discoveredBy)
+	}
+	id, err := NormalizeBackendURL(withDefaultScheme([]string{newURL})[0])
+	if err != nil {
+		return err
+	}
+	b, err := p.newBackend(old.replacementSpec(id), "")
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	current := p.snapshot().backends
+	i := slices.Index(current, old)
+	if i < 0 {
+		p.mu.Unlock()
+		return fmt.Errorf("%w %q", errUnknownBackend, oldURL)
+	}
+	if slices.ContainsFunc(current, func(existing *Backend) bool { return existing.ID() == b.ID() }) {
+		p.mu.Unlock()
+		return fmt.Errorf("backend %q is already in the pool", b.ID())
+	}
+	old.mu.Lock()
+	old.removed = true // for holders of the old slice and cache-aware pins
+	old.mu.Unlock()
+	// Copy on write: GetBackends callers keep iterating the old slice.
+	backends := slices.Clone(current)
+	backends[i] = b
+	p.publishLocked(backends)
+	p.prefixHash.rebuildLocked(backends)
+	if a := p.affinity; a != nil {
+		a.forget(old)
+	}
+	p.mu.Unlock()
+
+	p.logger.Printf("[ADMIN] replaced %s with %s (%d requests in flight drain)", old.ID(), b.ID(), old.GetActiveConns())
+	go p.drainReplaced(old)
+	return nil
+}
+
+// replacementSpec returns b's configuration for a backend at id.
+func (b *Backend) replacementSpec(id string) BackendSpec {
+	s := b.spec
+	s.URL = id
+	n, _ := url.Parse(id)
+	if h, err := url.Parse(s.Health); err == nil && s.Health != "" && h.Hostname() == b.URL.Hostname() && n.Hostname() != "" {
+		if port := h.Port(); port != "" {
+			h.Host = net.JoinHostPort(n.Hostname(), port)
+		} else {
+			h.Host = n.Hostname()
+		}
+		s.Health = h.String()
+	}
+	return s
+}
+
+// drainReplaced waits for the requests in flight on a replaced backend to
+// finish, cutting off those left at the drain timeout.
+func (p *Pool) drainReplaced(old *Backend) {
+	var deadline <-chan time.Time
+	if p.drainTimeout > 0 {
+		deadline = p.clock.After(p.drainTimeout)
+	}
+	tick := p.clock.NewTicker(replacedDrainPoll)
+	defer tick.Stop()
+	start := p.clock.Now()
+	for old.GetActiveConns() > 0 {
+		select {
+		case <-tick.C():
+		case <-deadline:
+			p.logger.Printf("[ADMIN] %s drain timed out after %v: cutting off %d requests", old.ID(), p.drainTimeout, old.GetActiveConns())
+			old.retire(errBackendRetired)
+			return
+		case <-p.lifetime.Done():
+			return
+		}
+	}
+	old.retire(errBackendRetired)
+	p.logger.Printf("[ADMIN] %s drained in %v", old.ID(), p.clock.Now().Sub(start).Round(time.Millisecond))
+}
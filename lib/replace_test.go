@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// namedBackend starts a backend answering with its name after delay.
+func namedBackend(t *testing.T, name string, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte(name))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReplaceBackendUnderTraffic(t *testing.T) {
+	old, next := namedBackend(t, "old", 20*time.Millisecond), namedBackend(t, "new", 0)
+	pool, err := NewPool([]string{old.URL + ",zone=us-east"}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+
+	// A single backend: any moment without one shows up as a 503.
+	ctx, cancel := context.WithCancel(context.Background())
+	var mu sync.Mutex
+	bodies := map[string]int{}
+	var sent atomic.Int64
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				resp, err := http.Get(lb.URL + "/v1/models")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				sent.Add(1)
+				mu.Lock()
+				if resp.StatusCode != http.StatusOK {
+					bodies[resp.Status+" "+string(body)]++
+				} else {
+					bodies[string(body)]++
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	for sent.Load() < 40 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := pool.ReplaceBackend(old.URL, next.URL); err != nil {
+		t.Fatal(err)
+	}
+	for start := sent.Load(); sent.Load() < start+40; {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if len(bodies) != 2 || bodies["old"] == 0 || bodies["new"] == 0 {
+		t.Errorf("responses %v, want only 200s from old, then new", bodies)
+	}
+	backends := pool.GetBackends()
+	if len(backends) != 1 || backends[0].ID() != next.URL || backends[0].labels["zone"] != "us-east" {
+		t.Errorf("backends = %v, want only the new one, labels kept", backends)
+	}
+}
+
+func TestReplaceBackendCarriesConfig(t *testing.T) {
+	pool, err := NewPool([]string{"http://gpu-0:8000,priority=1,max_conns=3,timeout=5s,health=http://gpu-0:8001/health,zone=a", "http://gpu-1:8000"}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.GetBackends()[0].requests.Add(7)
+
+	for _, bad := range [][2]string{{"gpu-9:8000", "gpu-2:8000"}, {"gpu-0:8000", "gpu-1:8000"}, {"gpu-0:8000", "ftp://gpu-2"}} {
+		if err := pool.ReplaceBackend(bad[0], bad[1]); err == nil {
+			t.Errorf("replace %s with %s: want an error", bad[0], bad[1])
+		}
+	}
+	if id := pool.GetBackends()[0].ID(); id != "http://gpu-0:8000" {
+		t.Fatalf("a failed replace changed the pool: %s", id)
+	}
+
+	if err := pool.ReplaceBackend("gpu-0:8000", "gpu-2:9000"); err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[0]
+	if b.ID() != "http://gpu-2:9000" || b.priority != 1 || b.maxConns != 3 || b.timeout != 5*time.Second || b.labels["zone"] != "a" {
+		t.Errorf("replacement = %s priority %d max_conns %d timeout %v labels %v", b.ID(), b.priority, b.maxConns, b.timeout, b.labels)
+	}
+	if got := pool.HealthURL(b); got != "http://gpu-2:8001/health" {
+		t.Errorf("health URL = %s, want it moved to the new host", got)
+	}
+	if b.requests.Load() != 0 || !b.IsHealthy() {
+		t.Errorf("replacement requests %d healthy %v, want fresh and healthy", b.requests.Load(), b.IsHealthy())
+	}
+	if len(pool.GetBackends()) != 2 {
+		t.Errorf("pool has %d backends, want 2", len(pool.GetBackends()))
+	}
+}
+
+func TestReplaceBackendCarriesSendProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingListener{Listener: ln}
+	pp, err := NewProxyProtocol(nil, time.Second, &lineLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoAddrServer(t, pp.Listener(rec))
+	pool, err := NewPool([]string{"http://gpu-0:8000,send_proxy=v1,upstream_key=sk-up,proxy=http://user:pw@fwd:3128"}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.ReplaceBackend("gpu-0:8000", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[0]
+	if b.sendProxy != ProxyProtocolV1 || b.viaProxy == nil || b.viaProxy.Host != "fwd:3128" || b.decorator == nil {
+		t.Errorf("replacement send_proxy %q proxy %v decorator %v, want the old backend's", b.sendProxy, b.viaProxy, b.decorator)
+	}
+
+	// Without the forward proxy the replacement must reach its listener
+	// with a PROXY header first.
+	pool, err = NewPool([]string{"http://gpu-0:8000,send_proxy=v1"}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.ReplaceBackend("gpu-0:8000", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+	resp, err := http.Get(lb.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got := rec.received(); len(got) != 1 || !strings.HasPrefix(got[0], "PROXY TCP4 ") {
+		t.Errorf("replacement sent %q, want a PROXY v1 header", got)
+	}
+}
+
+func TestReplaceBackendDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(old.Close)
+	next := namedBackend(t, "new", 0)
+	logs := captureLog(t)
+	pool, err := NewPool([]string{old.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetDrainTimeout(50 * time.Millisecond)
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+
+	stuck := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(lb.URL + "/v1/models")
+		if err != nil {
+			t.Error(err)
+		}
+		stuck <- resp
+	}()
+	for pool.GetBackends()[0].GetActiveConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := pool.ReplaceBackend(old.URL, next.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp := <-stuck
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "backend_replaced") {
+		t.Errorf("cut-off request: %d %s, want 503 backend_replaced", resp.StatusCode, body)
+	}
+	if !strings.Contains(logs.String(), "drain timed out after 50ms: cutting off 1 requests") {
+		t.Errorf("log = %s", logs)
+	}
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Request body replay (--replay-buffer-bytes, --replay-max-bytes): a
+// request body is recorded as the transport reads it — the first
+// MemoryBytes in memory, the rest in a temp file — and the request gets a
+// GetBody that replays the recording and then continues from the client.
+// That lets the transport resend a request whose reused backend connection
+// closed under it (net/http retries a request with a body only when it can
+// rewind it, and a POST only with an Idempotency-Key header). Recording as
+// the transport reads rather than reading ahead keeps Expect: 100-continue
+// working end to end: the transport sends the backend the headers and
+// waits for its 100 Continue before reading the body, and reading it is
+// what makes the server send the client its own 100 Continue; a backend
+// that answers at once (413, 401) gets no body, and neither does lb. A
+// body past MaxBytes, declared or read, stops being recorded and streams
+// on unreplayable, so its request is not retried; the temp file is removed
+// when the request ends. Bodies already held in memory (validated, hashed
+// for routing, metered) replay from there, and streaming uploads are never
+// replayed (see upload.go).
+
+// Body replay defaults, as cmd/lb exposes them.
+const (
+	DefaultReplayMemoryBytes = 1 << 20  // 1 MiB
+	DefaultReplayMaxBytes    = 64 << 20 // 64 MiB
+)
+
+// errBodyNotReplayable refuses to rewind a body past the replay cap.
+var errBodyNotReplayable = errors.New("request body too large to replay")
+
+// BodyReplayConfig configures request body replay.
+type BodyReplayConfig struct {
+	// MemoryBytes of each body are kept in memory, the rest in a temp file.
+	MemoryBytes int64
+	// MaxBytes bounds a replayable body.
+	MaxBytes int64
+	// TempDir holds the temp files, "" for the system's.
+	TempDir string
+}
+
+// bodyReplay is a pool's replay configuration and counters.
+type bodyReplay struct {
+	cfg BodyReplayConfig
+	// recorded and spilled count bodies recorded and those that reached a
+	// temp file, replays rewinds, tooLarge bodies past MaxBytes
+	recorded, spilled, replays, tooLarge atomic.Uint64
+}
+
+// SetBodyReplay records request bodies so they can be replayed (see
+// above). Call before serving traffic.
+func (p *Pool) SetBodyReplay(cfg BodyReplayConfig) {
+	p.replay = &bodyReplay{cfg: cfg}
+}
+
+// recordBody makes r's body replayable if replay is on and it is not
+// already. The returned func removes the recording; call it when the
+// request ends.
+func (p *Pool) recordBody(r *http.Request) (cleanup func()) {
+	rp := p.replay
+	if rp == nil || r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return func() {}
+	}
+	if r.ContentLength > rp.cfg.MaxBytes {
+		rp.tooLarge.Add(1)
+		return func() {}
+	}
+	rec := &bodyRecorder{src: r.Body, rp: rp}
+	rp.recorded.Add(1)
+	r.Body = &replayReader{rec: rec}
+	r.GetBody = rec.rewind
+	return rec.cleanup
+}
+
+// bodyRecorder records a body as its readers read it.
+type bodyRecorder struct {
+	rp  *bodyReplay
+	src io.ReadCloser
+	// lost is set once the body passed MaxBytes or could not be spilled
+	lost atomic.Bool
+
+	mu   sync.Mutex
+	mem  []byte
+	file *os.File
+	// n is the bytes read from src, err the error that ended it (io.EOF
+	// included), replayed to readers that reach it
+	n    int64
+	err  error
+	done bool
+}
+
+// rewind is the request's GetBody.
+func (rec *bodyRecorder) rewind() (io.ReadCloser, error) {
+	if rec.lost.Load() {
+		return nil, errBodyNotReplayable
+	}
+	rec.rp.replays.Add(1)
+	return &replayReader{rec: rec}, nil
+}
+
+// recordLocked keeps p, read at the end of the body, unless the body is
+// lost. Caller must hold rec.mu.
+func (rec *bodyRecorder) recordLocked(p []byte) {
+	if rec.lost.Load() || len(p) == 0 {
+		return
+	}
+	cfg := rec.rp.cfg
+	if rec.n+int64(len(p)) > cfg.MaxBytes {
+		rec.rp.tooLarge.Add(1)
+		rec.loseLocked()
+		return
+	}
+	if room := cfg.MemoryBytes - int64(len(rec.mem)); room > 0 {
+		k := min(int64(len(p)), room)
+		rec.mem = append(rec.mem, p[:k]...)
+		p = p[k:]
+	}
+	if len(p) == 0 {
+		return
+	}
+	if rec.file == nil {
+		f, err := os.CreateTemp(cfg.TempDir, "lb-body-*")
+		if err != nil {
+			rec.loseLocked()
+			return
+		}
+		rec.file = f
+		rec.rp.spilled.Add(1)
+	}
+	if _, err := rec.file.Write(p); err != nil {
+		rec.loseLocked()
+	}
+}
+
+// loseLocked drops the recording. Caller must hold rec.mu.
+func (rec *bodyRecorder) loseLocked() {
+	rec.lost.Store(true)
+	rec.mem = nil
+	rec.removeFileLocked()
+}
+
+func (rec *bodyRecorder) removeFileLocked() {
+	if rec.file != nil {
+		_ = rec.file.Close()
+		_ = os.Remove(rec.file.Name())
+		rec.file = nil
+	}
+}
+
+// cleanup removes the recording when the request ends.
+func (rec *bodyRecorder) cleanup() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.done = true
+	rec.mem = nil
+	rec.removeFileLocked()
+}
+
+// readAtLocked reads recorded bytes at off, which is below rec.n. Caller
+// must hold rec.mu.
+func (rec *bodyRecorder) readAtLocked(p []byte, off int64) (int, error) {
+	p = p[:min(int64(len(p)), rec.n-off)]
+	if off < int64(len(rec.mem)) {
+		return copy(p, rec.mem[off:]), nil
+	}
+	n, err := rec.file.ReadAt(p, off-int64(len(rec.mem)))
+	if n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// replayReader is one attempt's body: the recording from its start, then
+// the rest of the client's body, recorded as it goes.
+type replayReader struct {
+	rec    *bodyRecorder
+	off    int64
+	closed atomic.Bool
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	if rr.closed.Load() {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	rec := rr.rec
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	switch {
+	case rr.off < rec.n && (rec.lost.Load() || rec.done):
+		return 0, errBodyNotReplayable
+	case rr.off < rec.n:
+		n, err := rec.readAtLocked(p, rr.off)
+		rr.off += int64(n)
+		return n, err
+	case rec.err != nil:
+		return 0, rec.err
+	case rec.done:
+		return 0, http.ErrBodyReadAfterClose
+	}
+	n, err := rec.src.Read(p)
+	rec.recordLocked(p[:n])
+	rec.n += int64(n)
+	rr.off += int64(n)
+	if err != nil {
+		rec.err = err
+	}
+	return n, err
+}
+
+// Close ends this attempt's reading; the client's body stays open for the
+// next (the server closes it when the request ends).
+func (rr *replayReader) Close() error {
+	rr.closed.Store(true)
+	return nil
+}
+
+// BodyReplayStats reports request body replay in /stats.
+type BodyReplayStats struct {
+	Recorded uint64 `json:"recorded"`
+	// Spilled counts the bodies that outgrew memory into a temp file.
+	Spilled uint64 `json:"spilled"`
+	// Replays counts rewinds for a resent request.
+	Replays uint64 `json:"replays"`
+	// TooLarge counts bodies past the cap, streamed unreplayable.
+	TooLarge uint64 `json:"too_large"`
+}
+
+func (rp *bodyReplay) stats() *BodyReplayStats {
+	return &BodyReplayStats{
+		Recorded: rp.recorded.Load(),
+		Spilled:  rp.spilled.Load(),
+		Replays:  rp.replays.Load(),
+		TooLarge: rp.tooLarge.Load(),
+	}
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// flakyBackend serves HTTP/1.1 by hand, recording each request body it
+// reads. On the first connection it answers one request, then reads the
+// next whole and hangs up without answering: the reused connection dying
+// under a request that the transport retries on a new one if it can.
+type flakyBackend struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func newFlakyBackend(t *testing.T) *flakyBackend {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := &flakyBackend{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for first := true; ; first = false {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fb.serve(conn, first)
+		}
+	}()
+	return fb
+}
+
+func (fb *flakyBackend) serve(conn net.Conn, hangUp bool) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for n := 0; ; n++ {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		fb.mu.Lock()
+		fb.bodies = append(fb.bodies, body)
+		fb.mu.Unlock()
+		if hangUp && n == 1 {
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%d", len(fmt.Sprint(len(body))), len(body))
+	}
+}
+
+func (fb *flakyBackend) received() [][]byte {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.bodies
+}
+
+func replayPool(t *testing.T, backend string, cfg BodyReplayConfig) (*Pool, *httptest.Server) {
+	t.Helper()
+	pool, err := NewPool([]string{backend}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetTransport(NewTransport(DefaultTransportConfig()))
+	pool.SetBodyReplay(cfg)
+	lb := httptest.NewServer(pool)
+	t.Cleanup(func() { lb.Close(); _ = pool.Close() })
+	return pool, lb
+}
+
+func randomBody(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// postAfterWarmup sends body to lb, first warming its connection to the
+// backend with a small request, and returns the response status.
+func postAfterWarmup(t *testing.T, lb string, body io.Reader) int {
+	t.Helper()
+	resp, err := http.Post(lb+"/warm", "text/plain", strings.NewReader("warm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	req, _ := http.NewRequest(http.MethodPost, lb+"/v1/completions", body)
+	req.Header.Set("Idempotency-Key", "req-1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBodyReplayRetries(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			fb := newFlakyBackend(t)
+			dir := t.TempDir()
+			pool, lb := replayPool(t, "http://"+fb.ln.Addr().String(), BodyReplayConfig{MemoryBytes: 1 << 10, MaxBytes: 1 << 20, TempDir: dir})
+			want := randomBody(t, 256<<10)
+			var body io.Reader = bytes.NewReader(want)
+			if chunked {
+				body = io.MultiReader(body) // hides the length
+			}
+			if status := postAfterWarmup(t, lb.URL, body); status != http.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			got := fb.received()
+			if len(got) != 3 {
+				t.Fatalf("backend read %d bodies, want the warmup and two attempts", len(got))
+			}
+			for i, b := range got[1:] {
+				if !bytes.Equal(b, want) {
+					t.Errorf("attempt %d: body of %d bytes differs from the %d sent", i+1, len(b), len(want))
+				}
+			}
+			if s := pool.Stats().BodyReplay; s == nil || s.Spilled != 1 || s.Replays != 1 || s.TooLarge != 0 {
+				t.Errorf("stats %+v", s)
+			}
+			waitFor(t, "the temp file to be removed", func() bool {
+				left, _ := os.ReadDir(dir)
+				return len(left) == 0
+			})
+		})
+	}
+}
+
+func TestBodyReplayTooLarge(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("chunked=%v", chunked), func(t *testing.T) {
+			fb := newFlakyBackend(t)
+			dir := t.TempDir()
+			pool, lb := replayPool(t, "http://"+fb.ln.Addr().String(), BodyReplayConfig{MemoryBytes: 1 << 10, MaxBytes: 64 << 10, TempDir: dir})
+			want := randomBody(t, 256<<10)
+			var body io.Reader = bytes.NewReader(want)
+			if chunked {
+				body = io.MultiReader(body)
+			}
+			// The body streams whole to the first attempt, which is not
+			// retried.
+			if status := postAfterWarmup(t, lb.URL, body); status != http.StatusBadGateway {
+				t.Errorf("status %d, want 502", status)
+			}
+			got := fb.received()
+			if len(got) != 2 || !bytes.Equal(got[1], want) {
+				t.Errorf("backend read %d bodies, want the warmup and one attempt with the whole body", len(got))
+			}
+			if s := pool.Stats().BodyReplay; s.TooLarge != 1 || s.Replays != 0 {
+				t.Errorf("stats %+v", s)
+			}
+			waitFor(t, "the temp file to be removed", func() bool {
+				left, _ := os.ReadDir(dir)
+				return len(left) == 0
+			})
+		})
+	}
+}
+
+func TestBodyReplayExpectContinue(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			http.Error(w, "too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+	_, lb := replayPool(t, backend.URL, BodyReplayConfig{MemoryBytes: DefaultReplayMemoryBytes, MaxBytes: DefaultReplayMaxBytes})
+
+	// send writes the request's headers and returns the first response
+	// line, sending the body after a 100 Continue.
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	send := func(path string) (first string, final *http.Response) {
+		conn, err := net.Dial("tcp", lb.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: lb\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", path)
+		br := bufio.NewReader(conn)
+		first, err = br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(first, "HTTP/1.1 100") {
+			return first, nil
+		}
+		if blank, _ := br.ReadString('\n'); blank != "\r\n" {
+			t.Fatalf("100 Continue followed by %q", blank)
+		}
+		fmt.Fprint(conn, "hello")
+		final, err = http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return first, final
+	}
+
+	// A backend that rejects at once gets no body, and neither does lb.
+	if first, _ := send("/reject"); !strings.HasPrefix(first, "HTTP/1.1 413") {
+		t.Errorf("rejected request answered %q", first)
+	}
+	// One that reads it has the client send it through lb.
+	first, final := send("/echo")
+	if final == nil {
+		t.Fatalf("accepted request answered %q", first)
+	}
+	defer final.Body.Close()
+	if body, _ := io.ReadAll(final.Body); final.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("final response %d %q", final.StatusCode, body)
+	}
+}
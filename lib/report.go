@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Transition history and the shutdown report (--report-path): every pool
+// keeps its backends' last health transitions in a ring of
+// DefaultTransitionHistory entries (--transition-history), each with the
+// backend, its new state, when and why, recorded with the transition itself
+// (see transition.go). The oldest entries are overwritten once the ring is
+// full; the ring counts how many it has dropped.
+//
+// A Report is what the process knows and would lose on exit: its uptime,
+// the requests served, every pool's /stats snapshot (per-backend counters,
+// latency quantiles, state) and transition history. lb writes one as JSON
+// on graceful shutdown, once the servers have drained, and on SIGUSR1 with
+// --report-on-sigusr1, without exiting. A file is replaced whole, through a
+// temporary file in the same directory, so a reader never sees half a
+// report.
+
+// DefaultTransitionHistory is how many transitions a pool remembers.
+const DefaultTransitionHistory = 256
+
+// Transition is a backend's health transition in a pool's history.
+type Transition struct {
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	Healthy bool      `json:"healthy"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// transitionHistory is a pool's ring of its last transitions.
+type transitionHistory struct {
+	mu   sync.Mutex
+	ring []Transition
+	// next is the slot the next transition takes once the ring is full
+	next int
+	// total counts every transition recorded
+	total uint64
+}
+
+func newTransitionHistory(n int) *transitionHistory {
+	return &transitionHistory{ring: make([]Transition, 0, max(n, 1))}
+}
+
+// record adds t, overwriting the oldest transition once the ring is full.
+// A transition restated at the same instant (a starting backend's failure,
+// given its startup reason) amends the newest entry. Nil-safe.
+func (h *transitionHistory) record(t Transition) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.ring); n > 0 {
+		last := &h.ring[(h.next+n-1)%n]
+		if last.Backend == t.Backend && last.Healthy == t.Healthy && last.Time.Equal(t.Time) {
+			last.Reason = t.Reason
+			return
+		}
+	}
+	h.total++
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, t)
+		return
+	}
+	h.ring[h.next] = t
+	h.next = (h.next + 1) % len(h.ring)
+}
+
+// snapshot returns the transitions held, oldest first, and how many were
+// overwritten.
+func (h *transitionHistory) snapshot() ([]Transition, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]Transition, 0, len(h.ring))
+	out = append(out, h.ring[h.next:]...)
+	out = append(out, h.ring[:h.next]...)
+	return out, h.total - uint64(len(h.ring))
+}
+
+// SetTransitionHistory sets how many transitions the pool remembers
+// (default DefaultTransitionHistory, at least 1), forgetting those recorded
+// so far. Call before serving traffic.
+func (p *Pool) SetTransitionHistory(n int) {
+	p.history = newTransitionHistory(n)
+	for _, b := range p.GetBackends() {
+		b.history = p.history
+	}
+}
+
+// Transitions returns the pool's remembered health transitions, oldest
+// first, and how many older ones were dropped.
+func (p *Pool) Transitions() ([]Transition, uint64) {
+	return p.history.snapshot()
+}
+
+// Report is the JSON document written at shutdown and on SIGUSR1.
+type Report struct {
+	// Trigger is what asked for the report: "shutdown" or "SIGUSR1".
+	Trigger     string    `json:"trigger"`
+	GeneratedAt time.Time `json:"generated_at"`
+	StartedAt   time.Time `json:"started_at"`
+	// Uptime is GeneratedAt - StartedAt, e.g. "3h12m5s", and in seconds.
+	Uptime        string  `json:"uptime"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	// TotalRequests is the requests sent to every pool's backends.
+	TotalRequests uint64       `json:"total_requests"`
+	Pools         []PoolReport `json:"pools"`
+}
+
+// PoolReport is one pool's entry in a Report.
+type PoolReport struct {
+	// Name is the pool's name, "" for the only pool.
+	Name          string `json:"name,omitempty"`
+	TotalRequests uint64 `json:"total_requests"`
+	// Stats is the pool's final state, as /stats shows it.
+	Stats PoolStats `json:"stats"`
+	// Transitions is the pool's transition history, oldest first;
+	// TransitionsDropped how many older ones it no longer holds.
+	Transitions        []Transition `json:"transitions"`
+	TransitionsDropped uint64       `json:"transitions_dropped"`
+}
+
+// NewReport builds the report of pools as of now for a process started at
+// startedAt, pools in name order.
+func NewReport(trigger string, startedAt, now time.Time, pools []*Pool) *Report {
+	uptime := max(0, now.Sub(startedAt))
+	r := &Report{
+		Trigger:       trigger,
+		GeneratedAt:   now,
+		StartedAt:     startedAt,
+		Uptime:        age(uptime),
+		UptimeSeconds: uptime.Seconds(),
+		Pools:         make([]PoolReport, 0, len(pools)),
+	}
+	for _, p := range pools {
+		pr := PoolReport{Name: p.Name(), Stats: p.Stats()}
+		pr.Transitions, pr.TransitionsDropped = p.Transitions()
+		for _, bs := range pr.Stats.Backends {
+			pr.TotalRequests += bs.Requests
+		}
+		r.TotalRequests += pr.TotalRequests
+		r.Pools = append(r.Pools, pr)
+	}
+	sort.SliceStable(r.Pools, func(i, j int) bool { return r.Pools[i].Name < r.Pools[j].Name })
+	return r
+}
+
+// WriteFile writes the report as indented JSON to path, or to stdout for
+// "-", replacing a file whole.
+func (r *Report) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("report: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("report: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("report: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("report: %w", err)
+	}
+	return nil
+}
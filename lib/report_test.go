@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flap takes b down and back up once, a minute apart.
+func flap(t *testing.T, clock *fakeClock, b *Backend) {
+	t.Helper()
+	clock.advance(time.Minute)
+	if !b.MarkUnhealthy() {
+		t.Fatalf("%s was not healthy", b.ID())
+	}
+	clock.advance(time.Minute)
+	for !b.RecordCheckSuccess() {
+	}
+}
+
+func TestTransitionHistoryBounded(t *testing.T) {
+	clock := newFakeClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	pool, err := NewPool([]string{"http://a", "http://b"}, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetTransitionHistory(3)
+	a, _ := pool.Backend("http://a")
+	b, _ := pool.Backend("http://b")
+	flap(t, clock, a)
+	flap(t, clock, b)
+	clock.advance(time.Minute)
+	a.MarkUnhealthy()
+
+	got, dropped := pool.Transitions()
+	if dropped != 2 {
+		t.Errorf("dropped %d, want 2", dropped)
+	}
+	want := []Transition{
+		{Backend: "http://b", Healthy: false, Reason: "marked unhealthy"},
+		{Backend: "http://b", Healthy: true, Reason: "health checks passing"},
+		{Backend: "http://a", Healthy: false, Reason: "marked unhealthy"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d transitions, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Backend != w.Backend || got[i].Healthy != w.Healthy || got[i].Reason != w.Reason {
+			t.Errorf("transition %d = %+v, want %+v", i, got[i], w)
+		}
+		if i > 0 && !got[i].Time.After(got[i-1].Time) {
+			t.Errorf("transition %d at %v, not after %v", i, got[i].Time, got[i-1].Time)
+		}
+	}
+	if !got[2].Time.Equal(clock.Now()) {
+		t.Errorf("newest transition at %v, want %v", got[2].Time, clock.Now())
+	}
+}
+
+func TestTransitionHistoryAmendsRestatement(t *testing.T) {
+	h := newTransitionHistory(4)
+	at := time.Unix(100, 0)
+	h.record(Transition{Time: at, Backend: "x", Reason: "status: 503"})
+	h.record(Transition{Time: at, Backend: "x", Reason: "not ready within startup grace: status: 503"})
+	got, dropped := h.snapshot()
+	if len(got) != 1 || dropped != 0 || got[0].Reason != "not ready within startup grace: status: 503" {
+		t.Errorf("got %+v, %d dropped", got, dropped)
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	clock := newFakeClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	pool, err := NewPool([]string{backend.URL}, WithClock(clock), WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetName("chat")
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	for range 3 {
+		resp, err := http.Get(lb.URL + "/v1/models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	flap(t, clock, pool.GetBackends()[0])
+
+	started := clock.Now().Add(-90 * time.Minute)
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := NewReport("shutdown", started, clock.Now(), []*Pool{pool}).WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The schema, as a reader without this package sees it.
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, data)
+	}
+	for key, kind := range map[string]string{
+		"trigger": "string", "generated_at": "string", "started_at": "string",
+		"uptime": "string", "uptime_seconds": "number", "total_requests": "number", "pools": "array",
+	} {
+		if got := jsonKind(doc[key]); got != kind {
+			t.Errorf("%s is %s, want %s", key, got, kind)
+		}
+	}
+	if doc["trigger"] != "shutdown" || doc["uptime"] != "1h30m0s" || doc["uptime_seconds"] != 5400.0 || doc["total_requests"] != 3.0 {
+		t.Errorf("report header %v %v %v %v", doc["trigger"], doc["uptime"], doc["uptime_seconds"], doc["total_requests"])
+	}
+	pools := doc["pools"].([]any)
+	if len(pools) != 1 {
+		t.Fatalf("%d pools", len(pools))
+	}
+	pr := pools[0].(map[string]any)
+	if pr["name"] != "chat" || pr["total_requests"] != 3.0 || pr["transitions_dropped"] != 0.0 {
+		t.Errorf("pool %v requests %v dropped %v", pr["name"], pr["total_requests"], pr["transitions_dropped"])
+	}
+	stats := pr["stats"].(map[string]any)
+	bs := stats["backends"].([]any)[0].(map[string]any)
+	if bs["requests"] != 3.0 || bs["state"] != "healthy" {
+		t.Errorf("backend requests %v state %v", bs["requests"], bs["state"])
+	}
+	latency, _ := bs["latency"].(map[string]any)
+	if latency == nil || jsonKind(latency["p99_ms"]) != "number" {
+		t.Errorf("backend latency %v", bs["latency"])
+	}
+	transitions := pr["transitions"].([]any)
+	if len(transitions) != 2 {
+		t.Fatalf("%d transitions", len(transitions))
+	}
+	for i, want := range []bool{false, true} {
+		tr := transitions[i].(map[string]any)
+		if tr["backend"] != backend.URL || tr["healthy"] != want || jsonKind(tr["time"]) != "string" || jsonKind(tr["reason"]) != "string" {
+			t.Errorf("transition %d = %v", i, tr)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d files beside the report, want none", len(entries)-1)
+	}
+}
+
+// jsonKind names the JSON type of a decoded value.
+func jsonKind(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "null"
+}
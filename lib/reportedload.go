@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reported-load routing (--routing least-reported-load): with several lb
+// instances in front of the same backends, each one's connection count
+// sees only its own share of their load. Backends that report their own in
+// their health response (vLLM-style {"num_requests_waiting": 3}) are picked
+// by that number instead: each passing HTTP probe reads the JSON value at
+// the configured pointer (RFC 6901, default /num_requests_waiting) and
+// keeps it with its time. Selection picks the least loaded backend by its
+// last report plus its requests in flight from this lb, so a burst between
+// two reports spreads instead of piling onto the lowest one. A report older
+// than twice the check interval, a body that is not JSON or lacks the
+// field, and tcp and grpc probes leave the backend counted by connections;
+// none of them affects its health.
+
+// DefaultReportedLoadPointer is the JSON pointer read from health responses
+// unless WithReportedLoadPointer gives another.
+const DefaultReportedLoadPointer = "/num_requests_waiting"
+
+// reportedLoadMaxBody bounds the health response body read for the report.
+const reportedLoadMaxBody = 64 << 10
+
+// reportedLoad is a pool's reported-load routing state.
+type reportedLoad struct {
+	pointer string
+	tokens  []string
+	// maxAge is how long a report stays fresh: twice the check interval,
+	// set by NewHealthChecker
+	maxAge atomic.Int64
+}
+
+// pointerUnescaper undoes RFC 6901's ~1 and ~0 escapes, in that order.
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parseJSONPointer splits an RFC 6901 pointer into its unescaped tokens.
+// The empty pointer, the whole document, is not a load.
+func parseJSONPointer(ptr string) ([]string, error) {
+	rest, ok := strings.CutPrefix(ptr, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", ptr)
+	}
+	var tokens []string
+	for tok := range strings.SplitSeq(rest, "/") {
+		for i := range len(tok) {
+			if tok[i] == '~' && (i+1 == len(tok) || (tok[i+1] != '0' && tok[i+1] != '1')) {
+				return nil, fmt.Errorf("invalid JSON pointer %q: ~ must be followed by 0 or 1", ptr)
+			}
+		}
+		tokens = append(tokens, pointerUnescaper.Replace(tok))
+	}
+	return tokens, nil
+}
+
+// EnableReportedLoad switches the pool to reported-load routing (see
+// above), reading the value at pointer ("" for the default). Call before
+// serving traffic and before creating the pool's HealthChecker.
+func (p *Pool) EnableReportedLoad(pointer string) error {
+	if pointer == "" {
+		pointer = DefaultReportedLoadPointer
+	}
+	tokens, err := parseJSONPointer(pointer)
+	if err != nil {
+		return err
+	}
+	rl := &reportedLoad{pointer: pointer, tokens: tokens}
+	rl.maxAge.Store(int64(2 * DefaultHealthCheckInterval))
+	p.reported = rl
+	return nil
+}
+
+// setInterval makes reports fresh for two check intervals. Nil-safe.
+func (rl *reportedLoad) setInterval(d time.Duration) {
+	if rl != nil {
+		rl.maxAge.Store(int64(2 * d))
+	}
+}
+
+// lookup returns the number at the pointer in the JSON document raw; ok is
+// false when raw is not JSON or the value is missing, not a number, or
+// negative.
+func (rl *reportedLoad) lookup(raw []byte) (float64, bool) {
+	var v any
+	if json.Unmarshal(raw, &v) != nil {
+		return 0, false
+	}
+	for _, tok := range rl.tokens {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[tok]; !ok {
+				return 0, false
+			}
+		case []any:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(node) || tok != strconv.Itoa(i) {
+				return 0, false
+			}
+			v = node[i]
+		default:
+			return 0, false
+		}
+	}
+	n, ok := v.(float64)
+	return n, ok && n >= 0
+}
+
+// record reads a passing probe's response body for b's report. A body
+// without one leaves the last report to age out, logged once until a
+// report arrives again.
+func (rl *reportedLoad) record(b *Backend, body io.Reader, now time.Time) {
+	raw, err := io.ReadAll(io.LimitReader(body, reportedLoadMaxBody+1))
+	n, ok := 0.0, false
+	if err == nil && len(raw) <= reportedLoadMaxBody {
+		n, ok = rl.lookup(raw)
+	}
+	b.mu.Lock()
+	first := !ok && !b.reportMissing
+	b.reportMissing = !ok
+	if ok {
+		b.reported, b.reportedAt = n, now
+	}
+	b.mu.Unlock()
+	if first {
+		b.logger.Printf("[HEALTH] %s: no load at %s in health response; counting connections", b.ID(), rl.pointer)
+	}
+}
+
+// reportOf returns b's last report when it is fresh at now.
+func (rl *reportedLoad) reportOf(b *Backend, now time.Time) (float64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reportedAt.IsZero() || now.Sub(b.reportedAt) > time.Duration(rl.maxAge.Load()) {
+		return 0, false
+	}
+	return b.reported, true
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestParseJSONPointer(t *testing.T) {
+	for ptr, want := range map[string][]string{
+		"/num_requests_waiting": {"num_requests_waiting"},
+		"/queue/0/waiting":      {"queue", "0", "waiting"},
+		"/a~1b/c~0d/~01":        {"a/b", "c~d", "~1"},
+		"/":                     {""},
+	} {
+		if got, err := parseJSONPointer(ptr); err != nil || !slices.Equal(got, want) {
+			t.Errorf("parseJSONPointer(%q) = %q, %v; want %q", ptr, got, err, want)
+		}
+	}
+	for _, bad := range []string{"", "num_requests_waiting", "/a~2", "/a~"} {
+		if _, err := parseJSONPointer(bad); err == nil {
+			t.Errorf("parseJSONPointer(%q): want an error", bad)
+		}
+	}
+}
+
+func TestReportedLoadLookup(t *testing.T) {
+	pool, err := NewPool([]string{"http://a"}, WithStrategy(StrategyLeastReportedLoad), WithReportedLoadPointer("/queue/1/waiting"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := pool.reported
+	for body, want := range map[string]float64{
+		`{"queue":[{"waiting":9},{"waiting":2.5}]}`:  2.5,
+		`{"queue":[{"waiting":9},{"waiting":0}]}`:    0,
+		`{"queue":[{"waiting":9},{"waiting":-1}]}`:   -1,
+		`{"queue":[{"waiting":9},{"waiting":"3"}]}`:  -1,
+		`{"queue":[{"waiting":9}]}`:                  -1,
+		`{"queue":{"1":{"waiting":4}}}`:              4,
+		`{"queue":[{"waiting":9},{"waiting":null}]}`: -1,
+		`OK`: -1,
+		``:   -1,
+	} {
+		got, ok := rl.lookup([]byte(body))
+		if (want < 0) == ok || (ok && got != want) {
+			t.Errorf("lookup(%s) = %v, %v; want %v", body, got, ok, want)
+		}
+	}
+}
+
+// completionsServed returns how many completions each mock backend served.
+func completionsServed(backends []*mockbackend.Server) []uint64 {
+	n := make([]uint64, len(backends))
+	for i, b := range backends {
+		n[i] = b.Stats().Paths["/v1/completions"]
+	}
+	return n
+}
+
+func TestLeastReportedLoadRouting(t *testing.T) {
+	backends := make([]*mockbackend.Server, 3)
+	urls := make([]string, len(backends))
+	for i := range backends {
+		backends[i] = mockbackend.Start(t, mockbackend.Config{ResponseSize: 16})
+		urls[i] = backends[i].URL
+	}
+	backends[0].SetWaiting(7)
+	backends[1].SetWaiting(0)
+	backends[2].SetWaiting(3)
+	pool, err := NewPool(urls, WithStrategy(StrategyLeastReportedLoad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Hour))
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	send := func(n int) {
+		t.Helper()
+		for range n {
+			resp, err := http.Post(lb.URL+"/v1/completions", "application/json", strings.NewReader(`{"prompt":"hi"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	hc.checkAll(context.Background())
+	send(10)
+	if got := completionsServed(backends); !slices.Equal(got, []uint64{0, 10, 0}) {
+		t.Errorf("reports 7, 0, 3: served %v", got)
+	}
+	if s := pool.Stats().Backends; s[0].ReportedLoad == nil || *s[0].ReportedLoad != 7 {
+		t.Errorf("reported_load = %v, want 7", s[0].ReportedLoad)
+	}
+
+	// The next reports move traffic, whatever this lb's own counts say.
+	backends[1].SetWaiting(12)
+	hc.checkAll(context.Background())
+	send(10)
+	if got := completionsServed(backends); !slices.Equal(got, []uint64{0, 10, 10}) {
+		t.Errorf("reports 7, 12, 3: served %v", got)
+	}
+	if got := pool.strategy(false); got != "least-reported-load" {
+		t.Errorf("strategy %q", got)
+	}
+}
+
+func TestReportedLoadFallsBackToConns(t *testing.T) {
+	out := captureLog(t)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer plain.Close()
+	reporting := mockbackend.Start(t, mockbackend.Config{})
+	reporting.SetWaiting(5)
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	pool, err := NewPool([]string{plain.URL, reporting.URL}, WithStrategy(StrategyLeastReportedLoad), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(10*time.Second))
+	hc.checkAll(context.Background())
+	hc.checkAll(context.Background())
+
+	// A body without the field does not flip health, and is logged once.
+	bs := pool.Stats().Backends
+	if !bs[0].Healthy || bs[0].ReportedLoad != nil {
+		t.Errorf("plain backend: healthy %v, reported %v", bs[0].Healthy, bs[0].ReportedLoad)
+	}
+	if n := strings.Count(out.String(), "no load at /num_requests_waiting"); n != 1 {
+		t.Errorf("logged %d times:\n%s", n, out.String())
+	}
+	plainB, reportingB := pool.GetBackends()[0], pool.GetBackends()[1]
+	load := func(b *Backend) float64 {
+		_, _, l := pool.load(pool.snapshot().entries[b], clock.Now())
+		return l
+	}
+	if got := load(plainB); got != 1 {
+		t.Errorf("plain backend load %v, want 1 (connections)", got)
+	}
+	if got := load(reportingB); got != 6 {
+		t.Errorf("reporting backend load %v, want 6", got)
+	}
+
+	// A report older than two intervals is not used.
+	clock.advance(21 * time.Second)
+	if got := load(reportingB); got != 1 {
+		t.Errorf("stale report: load %v, want 1 (connections)", got)
+	}
+	if pool.Stats().Backends[1].ReportedLoad != nil {
+		t.Error("stale report in stats")
+	}
+}
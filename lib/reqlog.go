@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"sync"
@@ -29,15 +28,18 @@ type RequestLog struct {
 	f  *os.File
 	// failed suppresses repeated write-error logging until a write succeeds
 	failed bool
+	// hasher is non-nil with --hash-client-ids (see identity.go)
+	hasher *IdentityHasher
+	logger Logger
 }
 
 // NewRequestLog opens path for appending, creating it if needed.
-func NewRequestLog(path string) (*RequestLog, error) {
+func NewRequestLog(path string, opts ...Option) (*RequestLog, error) {
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640) // #nosec G302 G304 -- path is the operator's --log-to flag; group-readable so log shippers can collect it
 	if err != nil {
 		return nil, err
 	}
-	return &RequestLog{f: f}, nil
+	return &RequestLog{f: f, logger: loggerFrom(defaultLogger(), opts)}, nil
 }
 
 // Close closes the underlying file.
@@ -54,8 +56,12 @@ type reqLogEntry struct {
 	DurationMs        int64     `json:"duration_ms"`
 	Method            string    `json:"method"`
 	Path              string    `json:"path"`
+	UpstreamPath      string    `json:"upstream_path,omitempty"`
 	Status            int       `json:"status"`
 	Backend           string    `json:"backend,omitempty"`
+	Chaos             string    `json:"chaos,omitempty"`
+	Client            string    `json:"client,omitempty"`
+	Key               string    `json:"key,omitempty"`
 	Request           any       `json:"request"`
 	RequestTruncated  bool      `json:"request_truncated,omitempty"`
 	Response          any       `json:"response"`
@@ -67,7 +73,7 @@ func (l *RequestLog) write(e *reqLogEntry) {
 	enc := json.NewEncoder(&buf)
 	enc.SetEscapeHTML(false)
 	if err := enc.Encode(e); err != nil {
-		log.Printf("[REQLOG] failed to encode entry: %v", err)
+		l.logger.Printf("[REQLOG] failed to encode entry: %v", err)
 		return
 	}
 
@@ -75,7 +81,7 @@ func (l *RequestLog) write(e *reqLogEntry) {
 	defer l.mu.Unlock()
 	if _, err := l.f.Write(buf.Bytes()); err != nil {
 		if !l.failed {
-			log.Printf("[REQLOG] failed to write entry: %v", err)
+			l.logger.Printf("[REQLOG] failed to write entry: %v", err)
 		}
 		l.failed = true
 		return
@@ -128,7 +134,16 @@ type reqLogCapture struct {
 	method  string
 	path    string
 	backend string
-	status  int
+	// escapedPath is the client's, upstreamPath what the backend was
+	// sent when it differs (see pathrewrite.go)
+	escapedPath, upstreamPath string
+	status                    int
+	// chaos is the failure injected into the request, if any (see
+	// chaos.go)
+	chaos string
+	// client and key are hashed identifiers, set only with a hasher
+	client  string
+	key     string
 	reqBuf  capBuffer
 	respBuf capBuffer
 }
@@ -143,10 +158,14 @@ type teeReadCloser struct {
 // bytes. The caller must defer finish() on the returned capture.
 func (l *RequestLog) begin(w http.ResponseWriter, r *http.Request) (*reqLogCapture, http.ResponseWriter) {
 	c := &reqLogCapture{
-		log:    l,
-		start:  time.Now(),
-		method: r.Method,
-		path:   r.URL.RequestURI(),
+		log:         l,
+		start:       time.Now(),
+		method:      r.Method,
+		path:        r.URL.RequestURI(),
+		escapedPath: r.URL.EscapedPath(),
+	}
+	if l.hasher != nil {
+		c.client, c.key = l.hasher.clientIdentifiers(r)
 	}
 	if r.Body != nil && r.Body != http.NoBody {
 		r.Body = teeReadCloser{io.TeeReader(r.Body, &c.reqBuf), r.Body}
@@ -159,7 +178,17 @@ func (c *reqLogCapture) setBackend(b *Backend) {
 	if c == nil {
 		return
 	}
-	c.backend = b.URL.String()
+	c.backend = b.ID()
+	if up := b.upstreamPath(c.escapedPath); up != c.escapedPath {
+		c.upstreamPath = up
+	}
+}
+
+// setChaos tags the entry with the failure injected into the request.
+func (c *reqLogCapture) setChaos(tag string) {
+	if c != nil {
+		c.chaos = tag
+	}
 }
 
 // finish writes the accumulated pair as one JSONL line.
@@ -174,13 +203,20 @@ func (c *reqLogCapture) finish() {
 	}
 	reqBody, reqTrunc := c.reqBuf.snapshot()
 	respBody, respTrunc := c.respBuf.snapshot()
+	if c.log.hasher != nil {
+		reqBody = c.log.hasher.scrubUser(reqBody)
+	}
 	c.log.write(&reqLogEntry{
 		Time:              c.start.UTC(),
 		DurationMs:        time.Since(c.start).Milliseconds(),
 		Method:            c.method,
 		Path:              c.path,
+		UpstreamPath:      c.upstreamPath,
 		Status:            status,
 		Backend:           c.backend,
+		Chaos:             c.chaos,
+		Client:            c.client,
+		Key:               c.key,
 		Request:           bodyValue(reqBody),
 		RequestTruncated:  reqTrunc,
 		Response:          bodyValue(respBody),
@@ -208,7 +244,7 @@ type logResponseWriter struct {
 }
 
 func (w *logResponseWriter) WriteHeader(code int) {
-	if w.c.status == 0 {
+	if w.c.status == 0 && !isInterim(code) {
 		w.c.status = code
 	}
 	w.ResponseWriter.WriteHeader(code)
@@ -222,6 +258,13 @@ func (w *logResponseWriter) Write(p []byte) (int, error) {
 	return w.ResponseWriter.Write(p)
 }
 
+// isInterim reports whether code is a 1xx interim response (100 Continue,
+// 103 Early Hints), which ResponseWriter wrappers must pass through without
+// taking it for the final status. 101 Switching Protocols is final.
+func isInterim(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
 // Unwrap lets http.NewResponseController reach the underlying writer's Flush
 // and deadline methods, which ReverseProxy needs to stream SSE responses.
 func (w *logResponseWriter) Unwrap() http.ResponseWriter {
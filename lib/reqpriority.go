@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Request priority (--priority-header): interactive and batch traffic share
+// the pools, and batch should yield when both wait. A request claims high,
+// normal or low in a header (X-Request-Priority: low); no header, or a value
+// that is none of them, is normal. Only clients on the allowlist
+// (--priority-high-allow: addresses or CIDRs, or API key hashes
+// sha256:<12 hex> as /stats shows them) may claim high; anyone else's claim
+// counts as normal, and is counted as downgraded. Priority matters only
+// under saturation. The admission queue dispatches strictly by priority,
+// FIFO within one, except that a request waiting longer than
+// --priority-promote-after competes as high, ahead of the high requests that
+// arrived after it, so a steady stream of high traffic cannot starve low
+// forever (see queue.go). Load shedding sheds low first: over
+// --max-inflight low requests are shed at 80% of the cap and normal at 90%,
+// and under goroutine pressure all low requests are shed before any normal
+// one, and normal before high (see shed.go). /stats shows, per priority,
+// the requests, the queue depth and the wait for a slot.
+
+// RequestPriority is a request's priority class, highest first.
+type RequestPriority int
+
+// Request priorities.
+const (
+	PriorityHigh RequestPriority = iota
+	PriorityNormal
+	PriorityLow
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+func (p RequestPriority) String() string {
+	return priorityNames[p]
+}
+
+// parseRequestPriority parses a priority header value, case-insensitively.
+func parseRequestPriority(v string) (RequestPriority, bool) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(strings.TrimSpace(v), name) {
+			return RequestPriority(p), true
+		}
+	}
+	return PriorityNormal, false
+}
+
+// PriorityConfig configures request priorities.
+type PriorityConfig struct {
+	// Header is the request header claiming a priority.
+	Header string
+	// HighAllow lists who may claim high: addresses or CIDRs of the client
+	// connection, or API key hashes (sha256:<12 hex>). Empty = anyone.
+	HighAllow []string
+}
+
+// RequestPriorities classifies requests by priority. One is shared by the
+// pools.
+type RequestPriorities struct {
+	header string
+	nets   []netip.Prefix
+	keys   map[string]bool
+	open   bool // no allowlist: anyone may claim high
+
+	requests   [numPriorities]atomic.Uint64
+	downgraded atomic.Uint64
+}
+
+// NewRequestPriorities validates cfg and returns its classifier.
+func NewRequestPriorities(cfg PriorityConfig) (*RequestPriorities, error) {
+	if cfg.Header == "" || strings.ContainsAny(cfg.Header, " \t:") {
+		return nil, fmt.Errorf("priority header must be a header name, got %q", cfg.Header)
+	}
+	rp := &RequestPriorities{header: http.CanonicalHeaderKey(cfg.Header), keys: make(map[string]bool), open: len(cfg.HighAllow) == 0}
+	for _, entry := range cfg.HighAllow {
+		if strings.HasPrefix(entry, "sha256:") {
+			rp.keys[entry] = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("priority high allowlist entry %q: want an address, a CIDR or an API key hash (sha256:...)", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rp.nets = append(rp.nets, prefix.Masked())
+	}
+	return rp, nil
+}
+
+// SetRequestPriorities classifies the pool's requests with rp (nil = every
+// request is normal). Call before serving traffic.
+func (p *Pool) SetRequestPriorities(rp *RequestPriorities) {
+	p.priorities = rp
+}
+
+// classify returns r's priority, counting it.
+func (rp *RequestPriorities) classify(r *http.Request) RequestPriority {
+	prio, _ := parseRequestPriority(r.Header.Get(rp.header))
+	if prio == PriorityHigh && !rp.mayClaimHigh(r) {
+		rp.downgraded.Add(1)
+		prio = PriorityNormal
+	}
+	rp.requests[prio].Add(1)
+	return prio
+}
+
+// mayClaimHigh reports whether r's client is on the high allowlist.
+func (rp *RequestPriorities) mayClaimHigh(r *http.Request) bool {
+	if rp.open {
+		return true
+	}
+	if len(rp.keys) > 0 {
+		if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && rp.keys[apiKeyHash(key)] {
+			return true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range rp.nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// prioritized reports whether the queue dispatches by priority.
+func (q *admissionQueue) prioritized() bool {
+	return q.classes[PriorityHigh] != nil
+}
+
+// effectivePriority is the priority waiter competes with at now: high once
+// it has waited PromoteAfter.
+func (q *admissionQueue) effectivePriority(waiter *queueWaiter, now time.Time) RequestPriority {
+	if q.cfg.PromoteAfter > 0 && now.Sub(waiter.queuedAt) >= q.cfg.PromoteAfter {
+		return PriorityHigh
+	}
+	return waiter.priority
+}
+
+// priorityHeadLocked returns the waiter to dispatch next by priority: of
+// the first waiter of each priority, the one with the highest effective
+// priority, the earliest on a tie. Caller must hold q.mu.
+func (q *admissionQueue) priorityHeadLocked() *list.Element {
+	now := q.clock.Now()
+	var head *list.Element
+	var headPrio RequestPriority
+	for _, fifo := range q.classes {
+		front := fifo.Front()
+		if front == nil {
+			continue
+		}
+		el := front.Value.(*list.Element)
+		waiter := el.Value.(*queueWaiter)
+		prio := q.effectivePriority(waiter, now)
+		if head == nil || prio < headPrio || prio == headPrio && waiter.queuedAt.Before(head.Value.(*queueWaiter).queuedAt) {
+			head, headPrio = el, prio
+		}
+	}
+	return head
+}
+
+// priorityPositionLocked returns el's 1-based place in dispatch order as it
+// stands: behind every waiter of a higher effective priority, and every
+// earlier one of the same. Caller must hold q.mu.
+func (q *admissionQueue) priorityPositionLocked(el *list.Element) int {
+	now := q.clock.Now()
+	prio := q.effectivePriority(el.Value.(*queueWaiter), now)
+	n, before := 1, true
+	for e := q.waiters.Front(); e != nil; e = e.Next() {
+		if e == el {
+			before = false
+			continue
+		}
+		other := q.effectivePriority(e.Value.(*queueWaiter), now)
+		if other < prio || before && other == prio {
+			n++
+		}
+	}
+	return n
+}
+
+// recordAdmittedLocked records the wait of a waiter leaving the queue for a
+// slot at now. Caller must hold q.mu.
+func (q *admissionQueue) recordAdmittedLocked(waiter *queueWaiter, now time.Time) {
+	q.waits[waiter.priority].observe(now.Sub(waiter.queuedAt))
+	if q.effectivePriority(waiter, now) < waiter.priority {
+		q.promoted[waiter.priority].Add(1)
+	}
+}
+
+type priorityKey struct{}
+
+// withPriority marks ctx's request with prio.
+func withPriority(ctx context.Context, prio RequestPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, prio)
+}
+
+// priorityOf returns the priority of ctx's request, normal if unmarked.
+func priorityOf(ctx context.Context) RequestPriority {
+	if prio, ok := ctx.Value(priorityKey{}).(RequestPriority); ok {
+		return prio
+	}
+	return PriorityNormal
+}
+
+// PriorityStats reports request priorities in /stats: the header, the high
+// claims downgraded, and per priority the requests, those queued now, the
+// wait of those admitted through the queue (0 when a slot was free), how
+// many were promoted by age, and how many shed.
+type PriorityStats struct {
+	Header     string                        `json:"header"`
+	Downgraded uint64                        `json:"downgraded"`
+	Classes    map[string]PriorityClassStats `json:"classes"`
+}
+
+// PriorityClassStats is one priority's entry in PriorityStats.
+type PriorityClassStats struct {
+	Requests uint64        `json:"requests"`
+	Queued   int           `json:"queued"`
+	Wait     *LatencyStats `json:"wait,omitempty"`
+	Promoted uint64        `json:"promoted,omitempty"`
+	Shed     uint64        `json:"shed,omitempty"`
+}
+
+// priorityStats returns the pool's PriorityStats, nil without priorities.
+func (p *Pool) priorityStats() *PriorityStats {
+	rp := p.priorities
+	if rp == nil {
+		return nil
+	}
+	s := &PriorityStats{Header: rp.header, Downgraded: rp.downgraded.Load(), Classes: make(map[string]PriorityClassStats, numPriorities)}
+	for prio := range numPriorities {
+		cs := PriorityClassStats{Requests: rp.requests[prio].Load()}
+		if q := p.queue; q != nil && q.prioritized() {
+			q.mu.Lock()
+			cs.Queued = q.classes[prio].Len()
+			q.mu.Unlock()
+			cs.Wait = q.waits[prio].stats()
+			cs.Promoted = q.promoted[prio].Load()
+		}
+		if p.shedder != nil {
+			cs.Shed = p.shedder.shedByPriority[prio].Load()
+		}
+		s.Classes[prio.String()] = cs
+	}
+	return s
+}
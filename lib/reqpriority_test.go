@@ -0,0 +1,223 @@
+package lib
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestPriorityQueueOrder(t *testing.T) {
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	q := &admissionQueue{cfg: QueueConfig{Prioritized: true, PromoteAfter: time.Minute}, clock: clock, waiters: list.New()}
+	for prio := range q.classes {
+		q.classes[prio] = list.New()
+	}
+	push := func(prio RequestPriority) *list.Element {
+		return q.pushLocked(&queueWaiter{priority: prio, queuedAt: clock.Now()})
+	}
+	low1, normal, low2, high := push(PriorityLow), push(PriorityNormal), push(PriorityLow), push(PriorityHigh)
+	for el, want := range map[*list.Element]int{high: 1, normal: 2, low1: 3, low2: 4} {
+		if got := q.positionLocked(el); got != want {
+			t.Errorf("%s: position %d, want %d", el.Value.(*queueWaiter).priority, got, want)
+		}
+	}
+	if s := (&Pool{queue: q}).QueueStats(); s.Priorities["low"] != 2 || s.Priorities["high"] != 1 {
+		t.Errorf("queue stats %+v", s)
+	}
+	dispatch := func() string {
+		var order []string
+		for head := q.headLocked(); head != nil; head = q.headLocked() {
+			order = append(order, head.Value.(*queueWaiter).priority.String())
+			q.recordAdmittedLocked(head.Value.(*queueWaiter), clock.Now())
+			q.removeLocked(head, true)
+		}
+		return strings.Join(order, " ")
+	}
+	if got := dispatch(); got != "high normal low low" {
+		t.Errorf("dispatch order %q", got)
+	}
+
+	// A low request waiting a minute goes ahead of high ones arriving
+	// after it, but not of one already waiting.
+	early := push(PriorityHigh)
+	push(PriorityLow)
+	clock.advance(time.Minute)
+	push(PriorityHigh)
+	push(PriorityNormal)
+	if got := q.positionLocked(early); got != 1 {
+		t.Errorf("earlier high at position %d", got)
+	}
+	if got := dispatch(); got != "high low high normal" {
+		t.Errorf("dispatch order with a promoted low request %q", got)
+	}
+	if q.promoted[PriorityLow].Load() != 1 || q.promoted[PriorityNormal].Load() != 0 {
+		t.Errorf("promoted low %d, normal %d", q.promoted[PriorityLow].Load(), q.promoted[PriorityNormal].Load())
+	}
+	if st := q.waits[PriorityLow].stats(); st.Count != 3 || st.MaxMs != 60_000 {
+		t.Errorf("low waits %+v", st)
+	}
+}
+
+func TestRequestPrioritiesClassify(t *testing.T) {
+	rp, err := NewRequestPriorities(PriorityConfig{Header: "x-request-priority", HighAllow: []string{"10.1.0.0/16", "192.168.0.7", apiKeyHash("sk-ops")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	classify := func(remote, value, key string) RequestPriority {
+		r := httptest.NewRequest(http.MethodPost, "/v1/completions", nil)
+		r.RemoteAddr = remote
+		if value != "" {
+			r.Header.Set("X-Request-Priority", value)
+		}
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		return rp.classify(r)
+	}
+	for _, tc := range []struct {
+		remote, value, key string
+		want               RequestPriority
+	}{
+		{"10.2.0.1:5000", "", "", PriorityNormal},
+		{"10.2.0.1:5000", "LOW", "", PriorityLow},
+		{"10.2.0.1:5000", "urgent", "", PriorityNormal},
+		{"10.1.3.4:5000", "high", "", PriorityHigh},
+		{"[::ffff:192.168.0.7]:5000", "high", "", PriorityHigh},
+		{"10.2.0.1:5000", "high", "sk-ops", PriorityHigh},
+		{"10.2.0.1:5000", "high", "", PriorityNormal},
+		{"10.2.0.1:5000", "high", "sk-other", PriorityNormal},
+	} {
+		if got := classify(tc.remote, tc.value, tc.key); got != tc.want {
+			t.Errorf("%s %q key %q: %s, want %s", tc.remote, tc.value, tc.key, got, tc.want)
+		}
+	}
+	if rp.downgraded.Load() != 2 || rp.requests[PriorityHigh].Load() != 3 || rp.requests[PriorityNormal].Load() != 4 {
+		t.Errorf("downgraded %d, high %d, normal %d", rp.downgraded.Load(), rp.requests[PriorityHigh].Load(), rp.requests[PriorityNormal].Load())
+	}
+
+	open, err := NewRequestPriorities(PriorityConfig{Header: "X-Request-Priority"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-Priority", "high")
+	if got := open.classify(r); got != PriorityHigh {
+		t.Errorf("without an allowlist: %s", got)
+	}
+	for _, cfg := range []PriorityConfig{{}, {Header: "X Priority"}, {Header: "X-P", HighAllow: []string{"10.0.0.0/40"}}} {
+		if _, err := NewRequestPriorities(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestShedByPriority(t *testing.T) {
+	s := NewShedder(ShedConfig{MaxInflight: 10, ByPriority: true})
+	for range 8 {
+		if !s.admit(PriorityNormal) {
+			t.Fatal("shed under 80% of the cap")
+		}
+	}
+	if s.admit(PriorityLow) {
+		t.Error("low admitted at 80% of the cap")
+	}
+	if !s.admit(PriorityNormal) || s.admit(PriorityNormal) {
+		t.Error("normal not shed at 90% of the cap")
+	}
+	if !s.admit(PriorityHigh) || s.admit(PriorityHigh) {
+		t.Error("high not shed at the cap")
+	}
+	if s.inflight.Load() != 10 || s.shedByPriority[PriorityLow].Load() != 1 || s.shedByPriority[PriorityNormal].Load() != 1 || s.shedByPriority[PriorityHigh].Load() != 1 {
+		t.Errorf("inflight %d, shed %d/%d/%d", s.inflight.Load(), s.shedByPriority[PriorityHigh].Load(), s.shedByPriority[PriorityNormal].Load(), s.shedByPriority[PriorityLow].Load())
+	}
+
+	// Under pressure, each priority takes its band of the share.
+	p := NewShedder(ShedConfig{MaxGoroutines: 300, ByPriority: true})
+	goroutines := 400 // a third of the way to twice the threshold
+	p.goroutines = func() int { return goroutines }
+	shed := func(prio RequestPriority) int {
+		n := 0
+		for range 1000 {
+			if p.admit(prio) {
+				p.done()
+			} else {
+				n++
+			}
+		}
+		return n
+	}
+	if low, normal, high := shed(PriorityLow), shed(PriorityNormal), shed(PriorityHigh); low != 1000 || normal != 0 || high != 0 {
+		t.Errorf("at a third: shed low %d, normal %d, high %d of 1000", low, normal, high)
+	}
+	goroutines = 450
+	if low, normal, high := shed(PriorityLow), shed(PriorityNormal), shed(PriorityHigh); low != 1000 || normal < 400 || normal > 600 || high != 0 {
+		t.Errorf("at a half: shed low %d, normal %d, high %d of 1000", low, normal, high)
+	}
+}
+
+func TestPriorityWaitsUnderLoad(t *testing.T) {
+	// Two backends of one slot each, answering in 10-40ms, offered far more
+	// than they serve: two clients sending high priority requests, eight
+	// sending low.
+	var urls []string
+	for range 2 {
+		urls = append(urls, mockbackend.Start(t, mockbackend.Config{Delay: 20 * time.Millisecond}).URL)
+	}
+	pool, err := NewPool(urls, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := NewRequestPriorities(PriorityConfig{Header: "X-Request-Priority"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetRequestPriorities(rp)
+	pool.SetMaxConns(1)
+	pool.SetQueue(QueueConfig{Size: 100, Timeout: 10 * time.Second, Prioritized: true, PromoteAfter: 5 * time.Second})
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range 10 {
+		prio := "low"
+		if i < 2 {
+			prio = "high"
+		}
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				req, _ := http.NewRequestWithContext(ctx, http.MethodPost, lb.URL+"/v1/completions", strings.NewReader(`{"prompt":"hi"}`))
+				req.Header.Set("X-Request-Priority", prio)
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	st := pool.Stats().Priorities
+	high, low := st.Classes["high"].Wait, st.Classes["low"].Wait
+	if high == nil || low == nil || high.Count < 20 || low.Count == 0 {
+		t.Fatalf("waits high %+v, low %+v", high, low)
+	}
+	// A high request waits at most for one of two slots to free up, behind
+	// the other high client's request; low requests take what is left.
+	if high.P90Ms > 100 {
+		t.Errorf("high p90 wait %vms, want under 100ms", high.P90Ms)
+	}
+	if low.P50Ms < 4*max(high.P50Ms, 1) {
+		t.Errorf("low p50 wait %vms against high %vms: low does not absorb the queueing", low.P50Ms, high.P50Ms)
+	}
+	if st.Classes["high"].Requests == 0 || st.Classes["low"].Requests == 0 || st.Classes["normal"].Requests != 0 {
+		t.Errorf("requests %+v", st.Classes)
+	}
+}
@@ -0,0 +1,420 @@
+package lib
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Response caching (--cache-path): read-heavy GET routes whose responses are
+// identical across requests (model metadata, tokenizer info) are answered
+// from memory. Freshness follows the backend's Cache-Control; stale entries
+// with an ETag are revalidated with If-None-Match, and a 304 refreshes the
+// cached copy. Responses are tee'd into the cache on their way to the client,
+// never buffered in front of it. A response with a Vary header is cached
+// for the request header values it was produced for, and only served to
+// requests with the same ones.
+
+// cacheMaxEntryBytes is the default bound on one cached body; larger
+// responses stream through uncached.
+const cacheMaxEntryBytes = 1 << 20 // 1 MiB
+
+// CacheRoute enables caching for GET requests under Prefix. Requests carrying
+// Authorization bypass the cache unless Public is set: their responses may
+// depend on who is asking.
+type CacheRoute struct {
+	Prefix string
+	Public bool
+}
+
+// ResponseCache is an LRU cache of GET responses bounded by entry count and
+// total body bytes.
+type ResponseCache struct {
+	routes     []*cacheRoute
+	maxEntries int
+	maxBytes   int64
+	clock      Clock
+	// maxEntryBytes bounds one body; defaultTTL is the freshness of
+	// responses without a max-age (0 = none); bypassHeader, when a request
+	// carries it, skips the cached copy
+	maxEntryBytes int64
+	defaultTTL    time.Duration
+	bypassHeader  string
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	bytes   int64
+}
+
+type cacheRoute struct {
+	CacheRoute
+	hits, misses, revalidations, bypasses atomic.Uint64
+}
+
+type cacheEntry struct {
+	key        string
+	status     int
+	header     http.Header
+	body       []byte
+	etag       string
+	storedAt   time.Time
+	freshUntil time.Time
+	// vary names the request headers the response varies by, variant
+	// their values in the request it answered
+	vary    []string
+	variant string
+}
+
+// CacheRouteStats reports one cached route's counters in /stats.
+type CacheRouteStats struct {
+	Prefix        string `json:"prefix"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Revalidations uint64 `json:"revalidations"`
+	Bypasses      uint64 `json:"bypasses"`
+}
+
+// NewResponseCache creates a cache for routes holding at most maxEntries
+// responses and maxBytes of bodies.
+func NewResponseCache(routes []CacheRoute, maxEntries int, maxBytes int64, opts ...Option) *ResponseCache {
+	c := &ResponseCache{
+		maxEntries:    maxEntries,
+		maxBytes:      maxBytes,
+		clock:         clockFrom(systemClock{}, opts),
+		maxEntryBytes: cacheMaxEntryBytes,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+	for _, r := range routes {
+		c.routes = append(c.routes, &cacheRoute{CacheRoute: r})
+	}
+	return c
+}
+
+// SetMaxEntryBytes bounds one cached body (default 1 MiB). Call before
+// serving traffic.
+func (c *ResponseCache) SetMaxEntryBytes(n int64) {
+	c.maxEntryBytes = n
+}
+
+// SetDefaultTTL sets how long a response without a max-age stays fresh
+// (default 0: such a response is cached only with an ETag, and revalidated
+// every time). Call before serving traffic.
+func (c *ResponseCache) SetDefaultTTL(d time.Duration) {
+	c.defaultTTL = d
+}
+
+// SetBypassHeader names a request header whose presence skips the cached
+// copy and refreshes it, like Cache-Control: no-cache. Call before serving
+// traffic.
+func (c *ResponseCache) SetBypassHeader(name string) {
+	c.bypassHeader = name
+}
+
+// Stats returns per-route counters.
+func (c *ResponseCache) Stats() []CacheRouteStats {
+	out := make([]CacheRouteStats, 0, len(c.routes))
+	for _, r := range c.routes {
+		out = append(out, CacheRouteStats{
+			Prefix:        r.Prefix,
+			Hits:          r.hits.Load(),
+			Misses:        r.misses.Load(),
+			Revalidations: r.revalidations.Load(),
+			Bypasses:      r.bypasses.Load(),
+		})
+	}
+	return out
+}
+
+func (c *ResponseCache) route(path string) *cacheRoute {
+	var best *cacheRoute
+	for _, r := range c.routes {
+		if pathHasPrefix(path, r.Prefix) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// Handler wraps next with the cache.
+func (c *ResponseCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := c.route(r.URL.Path)
+		if r.Method != http.MethodGet || rt == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" && !rt.Public {
+			rt.bypasses.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.URL.RequestURI()
+		noCache := hasDirective(r.Header.Get("Cache-Control"), "no-cache") ||
+			(c.bypassHeader != "" && len(r.Header.Values(c.bypassHeader)) > 0)
+		now := c.clock.Now()
+		var stale *cacheEntry
+		if !noCache {
+			if e := c.get(key); e != nil && e.variant == variantOf(e.vary, r.Header) {
+				if now.Before(e.freshUntil) {
+					rt.hits.Add(1)
+					e.serve(w, now, "HIT")
+					return
+				}
+				if e.etag != "" {
+					stale = e
+				}
+			}
+		} else {
+			rt.bypasses.Add(1)
+		}
+
+		// Revalidate our stale copy unless the client is running its own
+		// conditional request, whose 304 belongs to the client.
+		conditional := stale != nil && r.Header.Get("If-None-Match") == ""
+		if conditional {
+			r = r.Clone(r.Context())
+			r.Header.Set("If-None-Match", stale.etag)
+		} else if !noCache {
+			rt.misses.Add(1)
+		}
+
+		cw := &cacheWriter{ResponseWriter: w, intercept304: conditional, maxBytes: c.maxEntryBytes}
+		next.ServeHTTP(cw, r)
+
+		if cw.suppressed {
+			rt.revalidations.Add(1)
+			refreshed := stale.refresh(cw.notModified, now, c.defaultTTL)
+			c.put(refreshed)
+			clear(w.Header())
+			refreshed.serve(w, now, "REVALIDATED")
+			return
+		}
+		if conditional {
+			rt.misses.Add(1) // revalidation failed: the backend sent a full response
+		}
+		if e := cw.entry(key, r.Header, now, c.defaultTTL); e != nil {
+			c.put(e)
+		}
+	})
+}
+
+func (c *ResponseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *ResponseCache) put(e *cacheEntry) {
+	size := int64(len(e.body))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.bytes -= int64(len(el.Value.(*cacheEntry).body))
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += size
+	for c.lru.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		oldest := c.lru.Back()
+		old := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, old.key)
+		c.bytes -= int64(len(old.body))
+	}
+}
+
+// serve writes the cached response, with Age and an X-Cache marker.
+func (e *cacheEntry) serve(w http.ResponseWriter, now time.Time, state string) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.storedAt).Seconds())))
+	h.Set("X-Cache", state)
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// refresh returns a copy of e made fresh again by a 304, whose headers
+// update the stored ones (RFC 9111 §4.3.4).
+func (e *cacheEntry) refresh(notModified http.Header, now time.Time, defaultTTL time.Duration) *cacheEntry {
+	fresh := *e
+	fresh.header = e.header.Clone()
+	for k, v := range notModified {
+		fresh.header[k] = v
+	}
+	fresh.storedAt = now
+	fresh.freshUntil = now.Add(freshness(fresh.header.Get("Cache-Control"), defaultTTL))
+	return &fresh
+}
+
+// cacheWriter tees a response into memory for caching. With intercept304 set
+// it swallows a 304 answering the cache's own conditional request, so the
+// handler can serve the refreshed entry instead.
+type cacheWriter struct {
+	http.ResponseWriter
+	intercept304 bool
+	maxBytes     int64
+	suppressed   bool
+	notModified  http.Header
+	status       int
+	buf          bytes.Buffer
+	overflow     bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if isInterim(code) {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	if code == http.StatusNotModified && cw.intercept304 {
+		cw.suppressed = true
+		cw.notModified = cw.Header().Clone()
+		return
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.suppressed {
+		return len(p), nil
+	}
+	if !cw.overflow {
+		if int64(cw.buf.Len()+len(p)) > cw.maxBytes {
+			cw.overflow = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer.
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// entry builds a cache entry from the captured response to a request with
+// reqHeader, or nil when it is not cacheable: non-200, too large,
+// no-store/private, Set-Cookie, Vary: *, or neither a freshness lifetime
+// nor an ETag to revalidate with.
+func (cw *cacheWriter) entry(key string, reqHeader http.Header, now time.Time, defaultTTL time.Duration) *cacheEntry {
+	if cw.status != http.StatusOK || cw.overflow {
+		return nil
+	}
+	h := cw.Header()
+	cc := h.Get("Cache-Control")
+	if hasDirective(cc, "no-store") || hasDirective(cc, "private") || h.Get("Set-Cookie") != "" {
+		return nil
+	}
+	var vary []string
+	for _, v := range h.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil // varies by more than the request headers
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	etag := h.Get("ETag")
+	ttl := freshness(cc, defaultTTL)
+	if ttl <= 0 && etag == "" {
+		return nil
+	}
+	header := h.Clone()
+	header.Del("X-Cache")
+	return &cacheEntry{
+		key:        key,
+		status:     cw.status,
+		header:     header,
+		body:       bytes.Clone(cw.buf.Bytes()),
+		etag:       etag,
+		storedAt:   now,
+		freshUntil: now.Add(ttl),
+		vary:       vary,
+		variant:    variantOf(vary, reqHeader),
+	}
+}
+
+// variantOf returns the values of the vary headers in h, as one comparable
+// string.
+func variantOf(vary []string, h http.Header) string {
+	var b strings.Builder
+	for _, name := range vary {
+		b.WriteString(strings.Join(h.Values(name), ","))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// freshness returns how long a response with Cache-Control cc stays fresh:
+// its s-maxage or max-age, defaultTTL without either, 0 for no-cache (store,
+// but revalidate every time).
+func freshness(cc string, defaultTTL time.Duration) time.Duration {
+	switch {
+	case hasDirective(cc, "no-cache"):
+		return 0
+	case hasDirective(cc, "s-maxage") || hasDirective(cc, "max-age"):
+		return maxAge(cc)
+	}
+	return defaultTTL
+}
+
+// hasDirective reports whether a Cache-Control value contains directive.
+func hasDirective(cc, directive string) bool {
+	for d := range strings.SplitSeq(cc, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAge returns the freshness lifetime from s-maxage or max-age (0 when
+// absent).
+func maxAge(cc string) time.Duration {
+	var age time.Duration
+	for d := range strings.SplitSeq(cc, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+		n, err := strconv.Atoi(strings.Trim(val, `"`))
+		if err != nil || n < 0 {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "s-maxage":
+			return time.Duration(n) * time.Second // shared caches prefer s-maxage
+		case "max-age":
+			age = time.Duration(n) * time.Second
+		}
+	}
+	return age
+}
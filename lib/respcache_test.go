@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheFixture wraps an origin handler with a cache over /v1/models
+// (private) and /public (public) and a controllable clock.
+type cacheFixture struct {
+	cache *ResponseCache
+	h     http.Handler
+	calls atomic.Int64
+	clock *fakeClock
+}
+
+func newCacheFixture(t *testing.T, maxEntries int, maxBytes int64, origin http.HandlerFunc) *cacheFixture {
+	t.Helper()
+	f := &cacheFixture{clock: newFakeClock(time.Unix(1_000_000, 0))}
+	f.cache = NewResponseCache([]CacheRoute{{Prefix: "/v1/models"}, {Prefix: "/public", Public: true}}, maxEntries, maxBytes, WithClock(f.clock))
+	f.h = f.cache.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.calls.Add(1)
+		origin(w, r)
+	}))
+	return f
+}
+
+func (f *cacheFixture) get(path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	f.h.ServeHTTP(rec, req)
+	return rec
+}
+
+func maxAgeOrigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=60")
+	_, _ = w.Write([]byte("models:" + r.URL.Path))
+}
+
+func TestResponseCacheFreshHitAndExpiry(t *testing.T) {
+	f := newCacheFixture(t, 10, 1<<20, maxAgeOrigin)
+	f.get("/v1/models")
+	rec := f.get("/v1/models")
+	if f.calls.Load() != 1 || rec.Body.String() != "models:/v1/models" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("second GET: calls=%d body=%q x-cache=%q, want a cache hit", f.calls.Load(), rec.Body, rec.Header().Get("X-Cache"))
+	}
+
+	f.clock.advance(61 * time.Second)
+	f.get("/v1/models")
+	if f.calls.Load() != 2 {
+		t.Error("expired entry without an ETag should be fetched again")
+	}
+	if st := f.cache.Stats()[0]; st.Hits != 1 || st.Misses != 2 {
+		t.Errorf("stats = %+v, want 1 hit 2 misses", st)
+	}
+}
+
+func TestResponseCacheRevalidation(t *testing.T) {
+	var sawINM atomic.Value
+	f := newCacheFixture(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		sawINM.Store(r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("full body"))
+	})
+
+	f.get("/v1/models")
+	rec := f.get("/v1/models")
+	if sawINM.Load() != `"v1"` {
+		t.Fatalf("backend saw If-None-Match %q, want the cached ETag", sawINM.Load())
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "full body" || rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Fatalf("revalidated response = %d %q (%s), want the cached 200 body", rec.Code, rec.Body, rec.Header().Get("X-Cache"))
+	}
+	if st := f.cache.Stats()[0]; st.Revalidations != 1 {
+		t.Errorf("revalidations = %d, want 1", st.Revalidations)
+	}
+
+	// A client's own conditional request gets the backend's 304 untouched.
+	rec = f.get("/v1/models", "If-None-Match", `"v1"`)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("client conditional request = %d, want 304 passed through", rec.Code)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	f := newCacheFixture(t, 2, 1<<20, maxAgeOrigin)
+	f.get("/v1/models/a")
+	f.get("/v1/models/b")
+	f.get("/v1/models/a") // a is now most recently used
+	f.get("/v1/models/c") // evicts b
+	calls := f.calls.Load()
+	f.get("/v1/models/a")
+	f.get("/v1/models/c")
+	if f.calls.Load() != calls {
+		t.Error("recently used entries should survive eviction")
+	}
+	f.get("/v1/models/b")
+	if f.calls.Load() != calls+1 {
+		t.Error("least recently used entry should have been evicted")
+	}
+
+	// Byte bound: two 17-byte bodies do not fit in 30 bytes.
+	g := newCacheFixture(t, 10, 30, maxAgeOrigin)
+	g.get("/v1/models/x")
+	g.get("/v1/models/y")
+	g.get("/v1/models/x")
+	if g.calls.Load() != 3 {
+		t.Errorf("byte-bounded cache: calls=%d, want the older entry evicted", g.calls.Load())
+	}
+}
+
+func TestResponseCacheAuthorizationGuard(t *testing.T) {
+	f := newCacheFixture(t, 10, 1<<20, maxAgeOrigin)
+	f.get("/v1/models", "Authorization", "Bearer a")
+	f.get("/v1/models", "Authorization", "Bearer a")
+	if f.calls.Load() != 2 {
+		t.Error("requests with Authorization must bypass a non-public route")
+	}
+	if st := f.cache.Stats()[0]; st.Bypasses != 2 {
+		t.Errorf("bypasses = %d, want 2", st.Bypasses)
+	}
+
+	f.get("/public/info", "Authorization", "Bearer a")
+	f.get("/public/info", "Authorization", "Bearer b")
+	if f.calls.Load() != 3 {
+		t.Error("a public route should cache regardless of Authorization")
+	}
+}
+
+func TestResponseCacheNotCacheable(t *testing.T) {
+	for name, origin := range map[string]http.HandlerFunc{
+		"no-store": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "no-store, max-age=60")
+		},
+		"private": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		},
+		"no freshness": func(w http.ResponseWriter, r *http.Request) {},
+		"vary *": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "*")
+		},
+		"error": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+		"too large": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			_, _ = w.Write([]byte(strings.Repeat("x", cacheMaxEntryBytes+1)))
+		},
+	} {
+		f := newCacheFixture(t, 10, 1<<30, origin)
+		f.get("/v1/models")
+		f.get("/v1/models")
+		if f.calls.Load() != 2 {
+			t.Errorf("%s: response should not be cached", name)
+		}
+	}
+}
+
+func TestResponseCacheRequestNoCache(t *testing.T) {
+	f := newCacheFixture(t, 10, 1<<20, maxAgeOrigin)
+	f.get("/v1/models")
+	f.get("/v1/models", "Cache-Control", "no-cache")
+	if f.calls.Load() != 2 {
+		t.Error("request Cache-Control: no-cache must bypass the cached copy")
+	}
+	if f.get("/other").Header().Get("X-Cache") != "" || f.calls.Load() != 3 {
+		t.Error("paths outside cached routes must pass straight through")
+	}
+}
+
+func TestResponseCacheBypassHeader(t *testing.T) {
+	f := newCacheFixture(t, 10, 1<<20, maxAgeOrigin)
+	f.cache.SetBypassHeader("X-Cache-Bypass")
+	f.get("/v1/models")
+	if rec := f.get("/v1/models", "X-Cache-Bypass", "1"); rec.Header().Get("X-Cache") != "" || f.calls.Load() != 2 {
+		t.Error("the bypass header must force a miss")
+	}
+	if f.get("/v1/models"); f.calls.Load() != 2 {
+		t.Error("the refreshed copy should be served without the header")
+	}
+	if st := f.cache.Stats()[0]; st.Bypasses != 1 || st.Hits != 1 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestResponseCacheDefaultTTL(t *testing.T) {
+	f := newCacheFixture(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("age") != "" {
+			w.Header().Set("Cache-Control", "max-age="+r.URL.Query().Get("age"))
+		}
+		_, _ = w.Write([]byte("models"))
+	})
+	f.cache.SetDefaultTTL(10 * time.Second)
+	f.get("/v1/models")
+	f.get("/v1/models?age=30")
+	f.get("/v1/models?age=0")
+	f.clock.advance(5 * time.Second)
+	f.get("/v1/models")
+	f.get("/v1/models?age=30")
+	f.get("/v1/models?age=0")
+	if f.calls.Load() != 4 {
+		t.Errorf("%d backend calls, want 4: max-age=0 is not overridden by the default", f.calls.Load())
+	}
+	f.clock.advance(10 * time.Second)
+	f.get("/v1/models")
+	f.get("/v1/models?age=30")
+	if f.calls.Load() != 5 {
+		t.Errorf("%d backend calls, want 5: only the default TTL has run out", f.calls.Load())
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	f := newCacheFixture(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language, accept")
+		_, _ = w.Write([]byte("models:" + r.Header.Get("Accept-Language")))
+	})
+	f.get("/v1/models", "Accept-Language", "fr")
+	if rec := f.get("/v1/models", "Accept-Language", "fr"); rec.Body.String() != "models:fr" || f.calls.Load() != 1 {
+		t.Errorf("same variant: %q after %d calls", rec.Body, f.calls.Load())
+	}
+	if rec := f.get("/v1/models", "Accept-Language", "de"); rec.Body.String() != "models:de" || f.calls.Load() != 2 {
+		t.Errorf("other variant: %q after %d calls", rec.Body, f.calls.Load())
+	}
+	if rec := f.get("/v1/models", "Accept-Language", "de", "Accept", "text/html"); rec.Body.String() != "models:de" || f.calls.Load() != 3 {
+		t.Errorf("other Accept: %q after %d calls", rec.Body, f.calls.Load())
+	}
+}
+
+func TestResponseCacheHitsSkipBackends(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(maxAgeOrigin))
+	t.Cleanup(srv.Close)
+	pool, err := NewPool([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewResponseCache([]CacheRoute{{Prefix: "/v1/models"}}, 10, 1<<20).Handler(pool)
+	for range 5 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d", rec.Code)
+		}
+	}
+	if s := pool.Stats().Backends[0]; s.Requests != 1 || s.ActiveConns != 0 {
+		t.Errorf("backend saw %d requests (%d active) for 1 miss and 4 hits", s.Requests, s.ActiveConns)
+	}
+}
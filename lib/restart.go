@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Expected restarts (POST /admin/backends/expect-restart): orchestration
+// announces that a backend is about to restart. For the window the backend
+// is drained — in-flight requests finish, no new ones are sent — and its
+// failures are expected: they log one quiet line instead of an unhealthy
+// alarm and do not count toward outlier detection. Once it has been seen down
+// and passes health checks again it rejoins through slow start, ending the
+// window early. A window that runs out leaves the backend to the ordinary
+// health logic.
+
+var errUnknownBackend = errors.New("unknown backend")
+
+// IsUnknownBackend reports whether err is ExpectRestart's unknown-backend
+// error.
+func IsUnknownBackend(err error) bool {
+	return errors.Is(err, errUnknownBackend)
+}
+
+// ExpectRestart drains the backend with the given URL for window, treating
+// its failures as an announced restart. The URL may omit the scheme and is
+// matched after normalization (see NormalizeBackendURL).
+func (p *Pool) ExpectRestart(rawURL string, window time.Duration) error {
+	if window <= 0 {
+		return errors.New("window must be positive")
+	}
+	target, err := NormalizeBackendURL(withDefaultScheme([]string{rawURL})[0])
+	if err != nil {
+		return fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+	}
+	for _, b := range p.GetBackends() {
+		if b.ID() != target {
+			continue
+		}
+		b.mu.Lock()
+		b.restartUntil = b.clock.Now().Add(window)
+		b.restartSeenDown = !b.healthy
+		// The restarted process starts with an empty KV cache: drop
+		// cache-aware pins now rather than when it is first seen down.
+		b.epoch++
+		b.mu.Unlock()
+		b.rotationChanged()
+		b.logger.Printf("[HEALTH] %s draining for expected restart (window %v)", b.ID(), window)
+		return nil
+	}
+	return fmt.Errorf("%w %q", errUnknownBackend, rawURL)
+}
+
+// ExpectingRestart reports whether the backend is inside an expected-restart
+// window.
+func (b *Backend) ExpectingRestart() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.restartingLocked(b.clock.Now())
+}
+
+func (b *Backend) restartingLocked(now time.Time) bool {
+	return !b.restartUntil.IsZero() && now.Before(b.restartUntil)
+}
+
+// expireRestart ends a restart window that ran out, logging whether the
+// backend came back. Called by the health checker before each probe.
+func (b *Backend) expireRestart(now time.Time) {
+	b.mu.Lock()
+	expired := !b.restartUntil.IsZero() && !now.Before(b.restartUntil)
+	healthy := b.healthy
+	if expired {
+		b.restartUntil = time.Time{}
+		if healthy {
+			b.startSlowStartLocked(now)
+		}
+	}
+	b.mu.Unlock()
+	if expired {
+		b.rotationChanged()
+	}
+
+	switch {
+	case expired && healthy:
+		b.logger.Printf("[HEALTH] %s expected restart window ended; rejoining", b.ID())
+	case expired:
+		b.logger.Printf("[HEALTH] %s did not recover within its expected restart window; marked as unhealthy", b.ID())
+	}
+}
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveOn starts h on addr ("127.0.0.1:0" for a fresh port), so a backend can
+// be stopped and brought back at the same URL.
+func serveOn(t *testing.T, addr string, h http.Handler) *httptest.Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	_ = srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func backendState(p *Pool, i int) string {
+	return p.Stats().Backends[i].State
+}
+
+func TestRollingRestartWithoutClientErrors(t *testing.T) {
+	var served [3]atomic.Int64
+	handler := func(i int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/models" {
+				served[i].Add(1)
+				time.Sleep(2 * time.Millisecond)
+			}
+		})
+	}
+	var servers [3]*httptest.Server
+	var urls []string
+	for i := range servers {
+		servers[i] = serveOn(t, "127.0.0.1:0", handler(i))
+		urls = append(urls, servers[i].URL)
+	}
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Short enough that the ramp finishes within the test: at low
+	// concurrency a warming backend wins least-conn only late in the ramp.
+	pool.SetSlowStart(300 * time.Millisecond)
+	hc := NewHealthChecker(pool, WithInterval(5*time.Second))
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	// Steady client load for the whole rollout.
+	var failures atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := http.Get(lb.URL + "/v1/completions")
+				if err != nil || resp.StatusCode != http.StatusOK {
+					failures.Add(1)
+				}
+				if err == nil {
+					_ = resp.Body.Close()
+				}
+			}
+		})
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	backends := pool.GetBackends()
+	for i, b := range backends {
+		if err := pool.ExpectRestart(b.URL.String(), 30*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		waitFor("drain", func() bool { return b.GetActiveConns() == 0 })
+
+		addr := servers[i].Listener.Addr().String()
+		servers[i].Close()
+		hc.checkAll(context.Background())
+		if b.IsHealthy() || backendState(pool, i) != "restarting (expected)" {
+			t.Fatalf("backend %d: state %q after going down, want restarting (expected)", i, backendState(pool, i))
+		}
+
+		servers[i] = serveOn(t, addr, handler(i))
+		before := served[i].Load()
+		for range healthyThreshold {
+			hc.checkAll(context.Background())
+		}
+		if b.ExpectingRestart() || backendState(pool, i) != "slow-start" {
+			t.Fatalf("backend %d: state %q after recovering, want the window ended and slow-start", i, backendState(pool, i))
+		}
+		waitFor("traffic to the restarted backend", func() bool { return served[i].Load() > before })
+	}
+
+	close(stop)
+	wg.Wait()
+	if n := failures.Load(); n != 0 {
+		t.Errorf("%d client-visible failures during the rolling restart", n)
+	}
+}
+
+func TestExpectRestartWindowExpires(t *testing.T) {
+	clock := newFakeClock(time.Unix(1_000_000, 0))
+	pool, err := NewPool([]string{"http://a", "http://b"}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[0]
+	if err := pool.ExpectRestart("a", time.Hour); err != nil {
+		t.Fatalf("URL without scheme: %v", err)
+	}
+	if err := pool.ExpectRestart("HTTP://A:80/", time.Hour); err != nil {
+		t.Fatalf("unnormalized URL: %v", err)
+	}
+	if err := pool.ExpectRestart("http://c", time.Hour); !IsUnknownBackend(err) {
+		t.Errorf("unknown backend: err = %v", err)
+	}
+
+	// Drained while the window is open, even though still healthy.
+	for range 10 {
+		sel, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sel == b {
+			t.Fatal("drained backend selected")
+		}
+		sel.DecrementConns()
+	}
+
+	// Failures inside the window are not counted for outlier detection.
+	b.recordOutcome(false, 0)
+	if b.failures != 0 {
+		t.Error("failure inside the restart window was counted")
+	}
+
+	// The restart never happened: once the window runs out the backend
+	// rejoins without a health transition.
+	clock.advance(time.Hour - time.Second)
+	b.expireRestart(clock.Now())
+	if !b.ExpectingRestart() {
+		t.Fatal("window ended early")
+	}
+	clock.advance(time.Second)
+	b.expireRestart(clock.Now())
+	if b.ExpectingRestart() || !b.available() {
+		t.Error("backend not rejoining after its window ran out")
+	}
+}
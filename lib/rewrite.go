@@ -0,0 +1,296 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Response rewriting ("response_rewrite" in --config): backends leak their
+// identity to clients — Server and X-Backend-* headers, hostnames and ports
+// in error bodies, the mock's backend_port. The rewrite stage runs in
+// ModifyResponse after the response policy (see policy.go). It removes the
+// configured response headers, by name or by prefix ("X-Backend-*"), and
+// sets others to a fixed value when the backend sent them ({"Server":
+// "lb"}). A JSON error body (status 4xx or 5xx, a JSON content type, no
+// Content-Encoding, a Content-Length of at most MaxBodyBytes) is read whole
+// and has the configured fields removed — re-encoded, keys sorted, only
+// when one was present — and every host:port of the pool's backends (their
+// URLs and health URLs) replaced with Placeholder. Content-Length is set to
+// the rewritten body's. Any other body, success or streamed or too large,
+// passes byte for byte.
+
+// Response rewrite defaults.
+const (
+	DefaultRewritePlaceholder = "backend"
+	DefaultRewriteMaxBody     = 64 << 10
+)
+
+// ResponseRewriteConfig configures response rewriting.
+type ResponseRewriteConfig struct {
+	// StripHeaders are response headers removed; a trailing * matches a
+	// prefix ("X-Backend-*").
+	StripHeaders []string `json:"strip_headers"`
+	// ReplaceHeaders sets response headers the backend sent to a fixed
+	// value.
+	ReplaceHeaders map[string]string `json:"replace_headers"`
+	// RemoveFields are field paths ("backend_port", "error.host", see
+	// prefixhash.go) removed from JSON error bodies.
+	RemoveFields []string `json:"remove_fields"`
+	// RedactAddresses replaces the pool's backend addresses in JSON error
+	// bodies with Placeholder.
+	RedactAddresses bool   `json:"redact_addresses"`
+	Placeholder     string `json:"placeholder"`
+	// MaxBodyBytes is the largest error body rewritten (default 64 KiB).
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+}
+
+// ResponseRewrite is a validated response rewrite configuration.
+type ResponseRewrite struct {
+	cfg ResponseRewriteConfig
+	// strip holds the exact header names, prefixes the canonical prefixes
+	strip, prefixes []string
+	fields          [][]pathStep
+	// placeholder is JSON-escaped, for use inside a string
+	placeholder []byte
+}
+
+// NewResponseRewrite validates cfg.
+func NewResponseRewrite(cfg ResponseRewriteConfig) (*ResponseRewrite, error) {
+	if cfg.MaxBodyBytes < 0 {
+		return nil, errors.New("response_rewrite: max_body_bytes cannot be negative")
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = DefaultRewriteMaxBody
+	}
+	if cfg.Placeholder == "" {
+		cfg.Placeholder = DefaultRewritePlaceholder
+	}
+	rw := &ResponseRewrite{cfg: cfg}
+	for _, h := range cfg.StripHeaders {
+		if prefix, ok := strings.CutSuffix(h, "*"); ok {
+			if prefix == "" {
+				return nil, errors.New("response_rewrite: strip_headers: * alone would strip every header")
+			}
+			rw.prefixes = append(rw.prefixes, http.CanonicalHeaderKey(prefix))
+			continue
+		}
+		rw.strip = append(rw.strip, http.CanonicalHeaderKey(h))
+	}
+	for name := range cfg.ReplaceHeaders {
+		if slices.Contains(protectedHeaders, http.CanonicalHeaderKey(name)) {
+			return nil, fmt.Errorf("response_rewrite: replace_headers: %s describes the body and cannot be replaced", name)
+		}
+	}
+	for _, f := range cfg.RemoveFields {
+		path, err := parseFieldPath(f)
+		if err != nil {
+			return nil, fmt.Errorf("response_rewrite: remove_fields: %w", err)
+		}
+		if path[len(path)-1].key == "" {
+			return nil, fmt.Errorf("response_rewrite: remove_fields: %q must end in a key", f)
+		}
+		rw.fields = append(rw.fields, path)
+	}
+	quoted, _ := json.Marshal(cfg.Placeholder)
+	rw.placeholder = quoted[1 : len(quoted)-1]
+	return rw, nil
+}
+
+// poolRewrite is a pool's response rewrite, with the pool whose backend
+// addresses it redacts.
+type poolRewrite struct {
+	*ResponseRewrite
+	pool *Pool
+}
+
+// SetResponseRewrite rewrites the pool's responses with rw (nil for none).
+// Call before serving traffic.
+func (p *Pool) SetResponseRewrite(rw *ResponseRewrite) {
+	p.rewrite = nil
+	if rw != nil {
+		p.rewrite = &poolRewrite{ResponseRewrite: rw, pool: p}
+	}
+	for _, b := range p.GetBackends() {
+		b.rewrite = p.rewrite
+	}
+}
+
+// rewriteResponse rewrites resp's headers, and its body if it is a JSON
+// error small enough. Called from ModifyResponse; an error reading the body
+// becomes a 502.
+func (b *Backend) rewriteResponse(resp *http.Response) error {
+	rw := b.rewrite
+	if rw == nil {
+		return nil
+	}
+	for name := range resp.Header {
+		if slices.Contains(rw.strip, name) || slices.ContainsFunc(rw.prefixes, func(p string) bool { return strings.HasPrefix(name, p) }) {
+			resp.Header.Del(name)
+		}
+	}
+	for name, value := range rw.cfg.ReplaceHeaders {
+		if resp.Header.Get(name) != "" {
+			resp.Header.Set(name, value)
+		}
+	}
+	if !rw.rewritable(resp) {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = rw.rewriteBody(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewritable reports whether resp's body is a JSON error body to rewrite.
+func (rw *poolRewrite) rewritable(resp *http.Response) bool {
+	if resp.StatusCode < 400 || len(rw.fields) == 0 && !rw.cfg.RedactAddresses ||
+		resp.ContentLength <= 0 || resp.ContentLength > rw.cfg.MaxBodyBytes ||
+		resp.Header.Get("Content-Encoding") != "" && !strings.EqualFold(resp.Header.Get("Content-Encoding"), "identity") {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// rewriteBody removes the configured fields from body and redacts the
+// pool's backend addresses in it.
+func (rw *poolRewrite) rewriteBody(body []byte) []byte {
+	if len(rw.fields) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc any
+		if dec.Decode(&doc) == nil {
+			removed := false
+			for _, path := range rw.fields {
+				removed = removeField(doc, path) || removed
+			}
+			if removed {
+				var buf bytes.Buffer
+				enc := json.NewEncoder(&buf)
+				enc.SetEscapeHTML(false)
+				if enc.Encode(doc) == nil {
+					body = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+				}
+			}
+		}
+	}
+	if rw.cfg.RedactAddresses {
+		for _, addr := range rw.addresses() {
+			body = replaceAddress(body, addr, rw.placeholder)
+		}
+	}
+	return body
+}
+
+// removeField deletes the field at path from doc, reporting whether it was
+// there.
+func removeField(doc any, path []pathStep) bool {
+	for _, step := range path[:len(path)-1] {
+		switch v := doc.(type) {
+		case map[string]any:
+			if step.key == "" {
+				return false
+			}
+			doc = v[step.key]
+		case []any:
+			if step.key != "" || step.index >= len(v) {
+				return false
+			}
+			doc = v[step.index]
+		default:
+			return false
+		}
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return false
+	}
+	key := path[len(path)-1].key
+	if _, ok := obj[key]; !ok {
+		return false
+	}
+	delete(obj, key)
+	return true
+}
+
+// addresses returns the host:port of the pool's backends and their health
+// URLs, longest first so no address is cut short by one it starts with.
+func (rw *poolRewrite) addresses() [][]byte {
+	var addrs [][]byte
+	for _, b := range rw.pool.GetBackends() {
+		for _, raw := range []string{b.URL.String(), b.healthURL} {
+			host := hostPort(raw)
+			if host != "" && !slices.ContainsFunc(addrs, func(a []byte) bool { return string(a) == host }) {
+				addrs = append(addrs, []byte(host))
+			}
+		}
+	}
+	slices.SortFunc(addrs, func(a, b []byte) int { return len(b) - len(a) })
+	return addrs
+}
+
+// hostPort is the host:port of the URL raw, with the scheme's default port
+// when it has none, "" when it has no host.
+func hostPort(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return u.Host + ":443"
+	}
+	return u.Host + ":80"
+}
+
+// replaceAddress replaces each whole occurrence of addr in body: not
+// preceded by a host character, nor followed by a digit.
+func replaceAddress(body, addr, placeholder []byte) []byte {
+	var out []byte
+	rest := body
+	for {
+		i := bytes.Index(rest, addr)
+		if i < 0 {
+			break
+		}
+		end := i + len(addr)
+		whole := (i == 0 || !hostChar(rest[i-1])) && (end == len(rest) || rest[end] < '0' || rest[end] > '9')
+		out = append(out, rest[:i]...)
+		if whole {
+			out = append(out, placeholder...)
+		} else {
+			out = append(out, addr...)
+		}
+		rest = rest[end:]
+	}
+	if out == nil {
+		return body
+	}
+	return append(out, rest...)
+}
+
+// hostChar reports whether c can be part of a hostname.
+func hostChar(c byte) bool {
+	return c == '.' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
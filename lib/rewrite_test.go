@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// leakyBackend answers /error with a JSON error naming its address, /big
+// with one over the rewrite cap, and anything else with a streamed success
+// naming it too, all with identifying headers.
+func leakyBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := strings.TrimPrefix(s.URL, "http://")
+		w.Header().Set("Server", "uvicorn")
+		w.Header().Set("X-Backend-Id", "gpu-7")
+		w.Header().Set("X-Backend-Zone", "us-east-1a")
+		w.Header().Set("Via", "1.1 internal-proxy")
+		w.Header().Set("X-Request-Id", "abc")
+		switch r.URL.Path {
+		case "/error":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, `{"error":{"message":"upstream %s overloaded, try %s0 <later>","type":"overloaded","host":"%s"},"backend_port":%s}`,
+				addr, addr, addr, s.URL[strings.LastIndex(s.URL, ":")+1:])
+		case "/big":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":"%s","pad":"%s"}`, addr, strings.Repeat("x", 200))
+		default:
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := range 3 {
+				fmt.Fprintf(w, "data: {\"i\":%d,\"backend\":\"%s\",\"backend_port\":1}\n\n", i, addr)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func rewriteProxy(t *testing.T, backend string) http.Handler {
+	t.Helper()
+	rw, err := NewResponseRewrite(ResponseRewriteConfig{
+		StripHeaders:    []string{"x-backend-*", "Via"},
+		ReplaceHeaders:  map[string]string{"Server": "lb"},
+		RemoveFields:    []string{"backend_port", "error.host"},
+		RedactAddresses: true,
+		MaxBodyBytes:    200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool([]string{backend}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetResponseRewrite(rw)
+	return pool
+}
+
+func TestResponseRewriteRedactsErrors(t *testing.T) {
+	backend := leakyBackend(t)
+	addr := strings.TrimPrefix(backend.URL, "http://")
+	h := rewriteProxy(t, backend.URL)
+
+	// An error body over the cap passes untouched, but for its headers.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/big", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), addr) || rec.Header().Get("X-Backend-Id") != "" {
+		t.Errorf("oversized error %d %s %v", rec.Code, rec.Body, rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/error", nil))
+	want := fmt.Sprintf(`{"error":{"message":"upstream backend overloaded, try %s0 <later>","type":"overloaded"}}`, addr)
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != want {
+		t.Errorf("error response %d %s, want %s", rec.Code, rec.Body, want)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(want)) {
+		t.Errorf("Content-Length %q, body %d bytes", cl, len(want))
+	}
+	got := rec.Header()
+	if got.Get("Server") != "lb" || got.Get("Via") != "" || got.Get("X-Backend-Id") != "" || got.Get("X-Backend-Zone") != "" || got.Get("X-Request-Id") != "abc" {
+		t.Errorf("headers %v", got)
+	}
+}
+
+func TestResponseRewriteLeavesStreamsAlone(t *testing.T) {
+	backend := leakyBackend(t)
+	resp, err := http.Get(backend.URL + "/v1/chat/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	lb := httptest.NewServer(rewriteProxy(t, backend.URL))
+	t.Cleanup(lb.Close)
+	resp, err = http.Get(lb.URL + "/v1/chat/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(proxied, direct) || !bytes.Contains(proxied, []byte("backend_port")) {
+		t.Errorf("stream changed:\n%s\nwant\n%s", proxied, direct)
+	}
+	if resp.Header.Get("Server") != "lb" || resp.Header.Get("X-Backend-Id") != "" {
+		t.Errorf("stream headers %v", resp.Header)
+	}
+}
+
+func TestReplaceAddress(t *testing.T) {
+	for _, tt := range []struct{ body, want string }{
+		{"10.0.0.1:80", "B"},
+		{"at 10.0.0.1:80.", "at B."},
+		{"http://10.0.0.1:80/v1", "http://B/v1"},
+		{"10.0.0.1:8000", "10.0.0.1:8000"},
+		{"110.0.0.1:80", "110.0.0.1:80"},
+		{"10.0.0.1:80 and 10.0.0.1:80", "B and B"},
+	} {
+		if got := string(replaceAddress([]byte(tt.body), []byte("10.0.0.1:80"), []byte("B"))); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
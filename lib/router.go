@@ -0,0 +1,237 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Router sends each request to a pool chosen by the longest matching path
+// prefix. A route with several targets splits its traffic across pools by
+// weight; weights can be changed at runtime (PUT /admin/routes/{id}/weights).
+// Pool-level routing (least-conn, cache-aware affinity) then decides within
+// the chosen pool — affinity never reaches across pools.
+type Router struct {
+	mu     sync.RWMutex
+	routes []*route // longest prefix first
+	// errorFormat is how unmatched paths are answered (see apierror.go)
+	errorFormat ErrorFormat
+	// fallback serves unmatched paths instead, if set (see split.go)
+	fallback http.Handler
+}
+
+type route struct {
+	id              string
+	prefix          string
+	targets         []*routeTarget
+	total           int // sum of weights, guarded by Router.mu
+	followRedirects int
+	timeout         time.Duration // 0 = the pool's request timeout
+	streamingUpload bool
+	maxUploadBytes  int64 // 0 = the pool's --max-request-body
+}
+
+type routeTarget struct {
+	name   string
+	pool   *Pool
+	weight int // guarded by Router.mu
+	served atomic.Uint64
+}
+
+// RouteStats reports a route's current weights and how many requests each
+// target has served, so a split can be verified.
+type RouteStats struct {
+	ID      string             `json:"id"`
+	Prefix  string             `json:"prefix"`
+	Targets []RouteTargetStats `json:"targets"`
+}
+
+// RouteTargetStats is one target's entry in RouteStats.
+type RouteTargetStats struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+	Served uint64 `json:"served"`
+}
+
+var errUnknownRoute = errors.New("unknown route")
+
+// NewRouter builds a router from route configs over the named pools.
+func NewRouter(routes []RouteConfig, pools map[string]*Pool) (*Router, error) {
+	rt := &Router{}
+	ids := make(map[string]bool)
+	prefixes := make(map[string]string)
+	for _, rc := range routes {
+		if ids[rc.ID] {
+			return nil, fmt.Errorf("duplicate route id %q", rc.ID)
+		}
+		ids[rc.ID] = true
+		if other, dup := prefixes[rc.Prefix]; dup {
+			return nil, fmt.Errorf("routes %q and %q share prefix %q", other, rc.ID, rc.Prefix)
+		}
+		prefixes[rc.Prefix] = rc.ID
+		if err := validateWeights(rc.Targets); err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.ID, err)
+		}
+		r := &route{id: rc.ID, prefix: rc.Prefix, followRedirects: rc.FollowRedirects, timeout: time.Duration(rc.Timeout),
+			streamingUpload: rc.StreamingUpload, maxUploadBytes: rc.MaxUploadBytes}
+		for _, t := range rc.Targets {
+			pool, ok := pools[t.Pool]
+			if !ok {
+				return nil, fmt.Errorf("route %q: unknown pool %q", rc.ID, t.Pool)
+			}
+			if slices.ContainsFunc(r.targets, func(o *routeTarget) bool { return o.name == t.Pool }) {
+				return nil, fmt.Errorf("route %q: pool %q is a target twice", rc.ID, t.Pool)
+			}
+			r.targets = append(r.targets, &routeTarget{name: t.Pool, pool: pool, weight: t.Weight})
+			r.total += t.Weight
+		}
+		rt.routes = append(rt.routes, r)
+	}
+	slices.SortStableFunc(rt.routes, func(a, b *route) int { return len(b.prefix) - len(a.prefix) })
+	return rt, nil
+}
+
+// validateWeights requires non-negative weights with a positive sum.
+func validateWeights(targets []RouteTarget) error {
+	total := 0
+	for _, t := range targets {
+		if t.Weight < 0 {
+			return fmt.Errorf("weight for pool %q cannot be negative", t.Pool)
+		}
+		total += t.Weight
+	}
+	if total == 0 {
+		return errors.New("weights must sum to more than 0")
+	}
+	return nil
+}
+
+// match returns the route with the longest prefix matching path, or nil.
+func (rt *Router) match(path string) *route {
+	for _, r := range rt.routes {
+		if pathHasPrefix(path, r.prefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// pathHasPrefix matches prefix on whole path segments: /v1/chat matches
+// /v1/chat and /v1/chat/completions but not /v1/chatter.
+func pathHasPrefix(path, prefix string) bool {
+	return strings.HasPrefix(path, prefix) &&
+		(len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/')
+}
+
+// pick chooses a target by weight. Caller must hold rt.mu.
+func (r *route) pick() *routeTarget {
+	n := rand.IntN(r.total) // #nosec G404 -- traffic split, not security-sensitive
+	for _, t := range r.targets {
+		if n < t.weight {
+			return t
+		}
+		n -= t.weight
+	}
+	return r.targets[len(r.targets)-1]
+}
+
+// ServeHTTP implements http.Handler. Unmatched paths go to the fallback, if
+// set, else get 404.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mu.RLock()
+	rte := rt.match(r.URL.Path)
+	var target *routeTarget
+	if rte != nil {
+		target = rte.pick()
+	}
+	rt.mu.RUnlock()
+
+	if target == nil && rt.fallback != nil {
+		rt.fallback.ServeHTTP(w, r)
+		return
+	}
+	if target == nil {
+		apiError{http.StatusNotFound, errTypeInvalidRequest, "not_found", "no route for " + r.URL.Path, nil}.write(w, r, rt.errorFormat)
+		return
+	}
+	target.served.Add(1)
+	if rte.followRedirects > 0 {
+		r = r.WithContext(withFollowRedirects(r.Context(), rte.followRedirects))
+	}
+	if rte.timeout > 0 {
+		r = r.WithContext(withRequestTimeout(r.Context(), rte.timeout))
+	}
+	if _, marked := streamingUpload(r); rte.streamingUpload && !marked {
+		r = r.WithContext(withStreamingUpload(r.Context(), rte.maxUploadBytes))
+	}
+	target.pool.ServeHTTP(w, r)
+}
+
+// SetFallback serves the paths no route matches with h instead of a 404.
+// Call before serving traffic.
+func (rt *Router) SetFallback(h http.Handler) {
+	rt.fallback = h
+}
+
+// SetWeights replaces a route's weights, effective for the next request.
+// Every target of the route must be given; the split is unchanged on error.
+func (rt *Router) SetWeights(id string, weights map[string]int) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var r *route
+	for _, c := range rt.routes {
+		if c.id == id {
+			r = c
+		}
+	}
+	if r == nil {
+		return fmt.Errorf("%w %q", errUnknownRoute, id)
+	}
+	if len(weights) != len(r.targets) {
+		return fmt.Errorf("route %q has %d targets, got %d weights", id, len(r.targets), len(weights))
+	}
+	targets := make([]RouteTarget, 0, len(r.targets))
+	for _, t := range r.targets {
+		w, ok := weights[t.name]
+		if !ok {
+			return fmt.Errorf("route %q: missing weight for pool %q", id, t.name)
+		}
+		targets = append(targets, RouteTarget{Pool: t.name, Weight: w})
+	}
+	if err := validateWeights(targets); err != nil {
+		return fmt.Errorf("route %q: %w", id, err)
+	}
+	r.total = 0
+	for i, t := range r.targets {
+		t.weight = targets[i].Weight
+		r.total += t.weight
+	}
+	return nil
+}
+
+// IsUnknownRoute reports whether err is SetWeights' unknown-route error.
+func IsUnknownRoute(err error) bool {
+	return errors.Is(err, errUnknownRoute)
+}
+
+// Stats returns the routes in match order with weights and served counts.
+func (rt *Router) Stats() []RouteStats {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	out := make([]RouteStats, 0, len(rt.routes))
+	for _, r := range rt.routes {
+		rs := RouteStats{ID: r.id, Prefix: r.prefix}
+		for _, t := range r.targets {
+			rs.Targets = append(rs.Targets, RouteTargetStats{Pool: t.name, Weight: t.weight, Served: t.served.Load()})
+		}
+		out = append(out, rs)
+	}
+	return out
+}
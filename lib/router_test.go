@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBackend starts a backend that counts the requests it serves.
+func countingBackend(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var n atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+func newTestRouter(t *testing.T, routes []RouteConfig, urls map[string]string) (*Router, map[string]*Pool) {
+	t.Helper()
+	pools := make(map[string]*Pool)
+	for name, u := range urls {
+		p, err := NewPool([]string{u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = p
+	}
+	rt, err := NewRouter(routes, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt, pools
+}
+
+func split(a, b int) []RouteTarget {
+	return []RouteTarget{{Pool: "a", Weight: a}, {Pool: "b", Weight: b}}
+}
+
+// share returns the fraction of n picks of route id that chose pool a.
+func share(rt *Router, id string, n int) float64 {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	var r *route
+	for _, c := range rt.routes {
+		if c.id == id {
+			r = c
+		}
+	}
+	hits := 0
+	for range n {
+		if r.pick().name == "a" {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
+func TestRouterWeightedSplit(t *testing.T) {
+	rt, _ := newTestRouter(t, []RouteConfig{{ID: "c", Prefix: "/v1/completions", Targets: split(90, 10)}},
+		map[string]string{"a": "http://a", "b": "http://b"})
+	if got := share(rt, "c", 100_000); math.Abs(got-0.9) > 0.01 {
+		t.Errorf("pool a share = %.3f, want 0.90 ± 0.01", got)
+	}
+}
+
+func TestRouterSetWeightsAtRuntime(t *testing.T) {
+	rt, _ := newTestRouter(t, []RouteConfig{{ID: "c", Prefix: "/v1/completions", Targets: split(90, 10)}},
+		map[string]string{"a": "http://a", "b": "http://b"})
+
+	if err := rt.SetWeights("c", map[string]int{"a": 25, "b": 75}); err != nil {
+		t.Fatal(err)
+	}
+	if got := share(rt, "c", 100_000); math.Abs(got-0.25) > 0.01 {
+		t.Errorf("pool a share after SetWeights = %.3f, want 0.25 ± 0.01", got)
+	}
+	if err := rt.SetWeights("c", map[string]int{"a": 0, "b": 100}); err != nil {
+		t.Fatal(err)
+	}
+	if got := share(rt, "c", 10_000); got != 0 {
+		t.Errorf("weight 0 should receive no traffic, got share %.3f", got)
+	}
+
+	for name, w := range map[string]map[string]int{
+		"zero sum":     {"a": 0, "b": 0},
+		"negative":     {"a": -1, "b": 5},
+		"missing pool": {"a": 1},
+		"unknown pool": {"a": 1, "c": 1},
+	} {
+		if err := rt.SetWeights("c", w); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := rt.SetWeights("nope", map[string]int{"a": 1, "b": 1}); !IsUnknownRoute(err) {
+		t.Errorf("unknown route: got %v", err)
+	}
+	if st := rt.Stats()[0]; st.Targets[0].Weight != 0 || st.Targets[1].Weight != 100 {
+		t.Errorf("rejected SetWeights must leave the split unchanged, got %+v", st.Targets)
+	}
+}
+
+func TestNewRouterRejectsAmbiguousRoutes(t *testing.T) {
+	pools := map[string]*Pool{}
+	for _, name := range []string{"a", "b"} {
+		p, err := NewPool([]string{"http://" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = p
+	}
+	for name, tc := range map[string]struct {
+		routes []RouteConfig
+		want   string
+	}{
+		"same prefix": {[]RouteConfig{{ID: "r1", Prefix: "/v1", Targets: split(1, 1)}, {ID: "r2", Prefix: "/v1", Targets: split(1, 1)}}, `routes "r1" and "r2" share prefix "/v1"`},
+		"pool twice":  {[]RouteConfig{{ID: "r", Prefix: "/v1", Targets: append(split(1, 1), RouteTarget{Pool: "a", Weight: 1})}}, `route "r": pool "a" is a target twice`},
+	} {
+		if _, err := NewRouter(tc.routes, pools); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: err = %v, want %s", name, err, tc.want)
+		}
+	}
+}
+
+func TestRouterPathRouting(t *testing.T) {
+	srvA, hitsA := countingBackend(t)
+	srvB, hitsB := countingBackend(t)
+	rt, _ := newTestRouter(t, []RouteConfig{
+		{ID: "v1", Prefix: "/v1", Targets: split(0, 1)},
+		{ID: "emb", Prefix: "/v1/embeddings", Targets: split(1, 0)},
+	}, map[string]string{"a": srvA.URL, "b": srvB.URL})
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code
+	}
+	for range 5 {
+		get("/v1/embeddings")
+	}
+	get("/v1/completions")
+	if hitsA.Load() != 5 || hitsB.Load() != 1 {
+		t.Errorf("hits a=%d b=%d, want the longest prefix to win (a=5 b=1)", hitsA.Load(), hitsB.Load())
+	}
+	if code := get("/v2/other"); code != http.StatusNotFound {
+		t.Errorf("unmatched path = %d, want 404", code)
+	}
+	if code := get("/v1x"); code != http.StatusNotFound {
+		t.Errorf("prefix must match whole segments, /v1x got %d", code)
+	}
+
+	st := rt.Stats()
+	if st[0].ID != "emb" || st[0].Targets[0].Served != 5 || st[1].Targets[1].Served != 1 {
+		t.Errorf("served counters = %+v", st)
+	}
+}
+
+func TestRouterGroupsSeeOnlyTheirPaths(t *testing.T) {
+	type seen struct {
+		mu    sync.Mutex
+		paths map[string]int
+	}
+	group := func() (*httptest.Server, *seen) {
+		s := &seen{paths: map[string]int{}}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.mu.Lock()
+			s.paths[r.URL.Path]++
+			s.mu.Unlock()
+		}))
+		t.Cleanup(srv.Close)
+		return srv, s
+	}
+	gpuSrv, gpu := group()
+	cpuSrv, cpu := group()
+	defSrv, def := group()
+	rt, _ := newTestRouter(t, []RouteConfig{
+		{ID: "completions", Prefix: "/v1/completions", Targets: []RouteTarget{{Pool: "gpu", Weight: 1}}},
+		{ID: "embeddings", Prefix: "/v1/embeddings", Targets: []RouteTarget{{Pool: "cpu", Weight: 1}}},
+		{ID: "default", Prefix: "/", Targets: []RouteTarget{{Pool: "default", Weight: 1}}},
+	}, map[string]string{"gpu": gpuSrv.URL, "cpu": cpuSrv.URL, "default": defSrv.URL})
+
+	var wg sync.WaitGroup
+	for _, path := range []string{"/v1/completions", "/v1/embeddings", "/v1/models"} {
+		for range 10 {
+			wg.Go(func() {
+				rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+			})
+		}
+	}
+	wg.Wait()
+
+	for name, tc := range map[string]struct {
+		s    *seen
+		path string
+	}{"gpu": {gpu, "/v1/completions"}, "cpu": {cpu, "/v1/embeddings"}, "default": {def, "/v1/models"}} {
+		if len(tc.s.paths) != 1 || tc.s.paths[tc.path] != 10 {
+			t.Errorf("%s group saw %v, want only 10x %s", name, tc.s.paths, tc.path)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// Load shedding (--max-inflight, --shed-goroutines): lb protects itself
+// before it falls over. A Shedder, shared by every pool, counts proxied
+// requests in flight with one atomic; a request over --max-inflight is
+// answered 503 with Retry-After at once, before its body is read or a
+// backend selected. Under goroutine pressure (the Go runtime's count over
+// --shed-goroutines, each goroutine being a connection or request lb is
+// holding) a growing share of new requests is shed: none at the threshold,
+// all of them at twice it. Health, metrics and admin endpoints are not
+// served by pools and are never shed. With ShedConfig.ByPriority, low
+// priority requests are shed first (see reqpriority.go): over 80% of
+// --max-inflight for low and 90% for normal, and under pressure the share
+// is split into bands, low requests shed in the first third of it, normal
+// in the second, high in the last.
+
+// shedRetryAfter is the Retry-After of a shed request, in seconds.
+const shedRetryAfter = "1"
+
+// ShedConfig configures load shedding; zero values disable each check.
+type ShedConfig struct {
+	// MaxInflight caps proxied requests in flight across all pools.
+	MaxInflight int
+	// MaxGoroutines starts shedding a share of new requests once the
+	// process runs more goroutines.
+	MaxGoroutines int
+	// ByPriority sheds by request priority, low first.
+	ByPriority bool
+}
+
+// shedCapShares are the shares of MaxInflight at which each priority is
+// shed with ByPriority.
+var shedCapShares = [numPriorities]float64{1, 0.9, 0.8}
+
+// Shedder enforces a ShedConfig across the pools it is set on.
+type Shedder struct {
+	cfg ShedConfig
+	// goroutines reads the goroutine count; replaced in tests
+	goroutines func() int
+
+	inflight          atomic.Int64
+	overCap, pressure atomic.Uint64
+	// shedByPriority counts the requests shed by priority
+	shedByPriority [numPriorities]atomic.Uint64
+}
+
+// NewShedder returns a shedder enforcing cfg.
+func NewShedder(cfg ShedConfig) *Shedder {
+	return &Shedder{cfg: cfg, goroutines: runtime.NumGoroutine}
+}
+
+// SetShedder makes the pool's requests count against s. Call before
+// serving traffic.
+func (p *Pool) SetShedder(s *Shedder) {
+	p.shedder = s
+}
+
+// pressureShare is the share of new requests to shed at the current
+// goroutine count, in [0, 1].
+func (s *Shedder) pressureShare() float64 {
+	limit := s.cfg.MaxGoroutines
+	if limit <= 0 {
+		return 0
+	}
+	over := s.goroutines() - limit
+	if over <= 0 {
+		return 0
+	}
+	return min(1, float64(over)/float64(limit))
+}
+
+// priorityShare is the share of prio's requests to shed when share of all
+// requests would be: with ByPriority, low requests take the first third of
+// the pressure, normal the second and high the last.
+func (s *Shedder) priorityShare(share float64, prio RequestPriority) float64 {
+	if !s.cfg.ByPriority {
+		return share
+	}
+	return min(1, max(0, 3*share-float64(PriorityLow-prio)))
+}
+
+// inflightCap is the in-flight count over which prio's requests are shed.
+func (s *Shedder) inflightCap(prio RequestPriority) int64 {
+	if !s.cfg.ByPriority {
+		return int64(s.cfg.MaxInflight)
+	}
+	return max(1, int64(math.Ceil(shedCapShares[prio]*float64(s.cfg.MaxInflight))))
+}
+
+// admit takes an in-flight slot for a request of priority prio, returning
+// false (and counting the request as shed) when it is over the cap or
+// loses the draw under pressure. Nil-safe; a true result must be released
+// with done.
+func (s *Shedder) admit(prio RequestPriority) bool {
+	if s == nil {
+		return true
+	}
+	if share := s.priorityShare(s.pressureShare(), prio); share > 0 && rand.Float64() < share {
+		s.pressure.Add(1)
+		s.shedByPriority[prio].Add(1)
+		return false
+	}
+	if n := s.inflight.Add(1); s.cfg.MaxInflight > 0 && n > s.inflightCap(prio) {
+		s.inflight.Add(-1)
+		s.overCap.Add(1)
+		s.shedByPriority[prio].Add(1)
+		return false
+	}
+	return true
+}
+
+// done releases a slot taken by admit. Nil-safe.
+func (s *Shedder) done() {
+	if s != nil {
+		s.inflight.Add(-1)
+	}
+}
+
+// writeShed answers a shed request.
+func (p *Pool) writeShed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", shedRetryAfter)
+	apiError{http.StatusServiceUnavailable, errTypeUnavailable, "overloaded", "load balancer overloaded, please retry later", nil}.write(w, r, p.errorFormat)
+}
+
+// ShedStats reports load shedding in /stats: requests in flight across all
+// pools and the cap on them, and requests shed over the cap and under
+// goroutine pressure since start.
+type ShedStats struct {
+	Inflight      int64  `json:"inflight"`
+	MaxInflight   int    `json:"max_inflight,omitempty"`
+	ShedOverCap   uint64 `json:"shed_over_cap"`
+	Goroutines    int    `json:"goroutines"`
+	MaxGoroutines int    `json:"max_goroutines,omitempty"`
+	ShedPressure  uint64 `json:"shed_pressure"`
+}
+
+func (s *Shedder) stats() *ShedStats {
+	return &ShedStats{
+		Inflight:      s.inflight.Load(),
+		MaxInflight:   s.cfg.MaxInflight,
+		ShedOverCap:   s.overCap.Load(),
+		Goroutines:    s.goroutines(),
+		MaxGoroutines: s.cfg.MaxGoroutines,
+		ShedPressure:  s.pressure.Load(),
+	}
+}
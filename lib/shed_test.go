@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestMaxInflightHoldsUnderLoad(t *testing.T) {
+	release := make(chan struct{})
+	var arrived sync.WaitGroup
+	arrived.Add(5)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		default:
+			arrived.Done()
+			<-release
+		}
+	}))
+	defer slow.Close()
+	pool, err := NewPool([]string{slow.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shedder := NewShedder(ShedConfig{MaxInflight: 5})
+	pool.SetShedder(shedder)
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	statuses := make(chan int, 50)
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() {
+			resp, err := http.Get(lb.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		})
+	}
+	arrived.Wait()
+	// The cap is full: the next 45 are shed without reaching the backend.
+	for range 45 {
+		resp, err := http.Get(lb.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("over the cap: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+	}
+	if s := pool.Stats().Shedding; s == nil || s.Inflight != 5 || s.ShedOverCap != 45 {
+		t.Errorf("shedding stats under load = %+v, want 5 in flight, 45 shed", s)
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("admitted request: status %d", status)
+		}
+	}
+	// Load has dropped: requests are admitted again.
+	resp, err := http.Get(lb.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("after recovery: status %d", resp.StatusCode)
+	}
+	if s := pool.Stats().Shedding; s.Inflight != 0 || s.ShedOverCap != 45 {
+		t.Errorf("shedding stats after recovery = %+v", s)
+	}
+}
+
+func TestShedUnderGoroutinePressure(t *testing.T) {
+	s := NewShedder(ShedConfig{MaxGoroutines: 100})
+	goroutines := 100
+	s.goroutines = func() int { return goroutines }
+	shed := func() int {
+		n := 0
+		for range 1000 {
+			if s.admit(PriorityNormal) {
+				s.done()
+			} else {
+				n++
+			}
+		}
+		return n
+	}
+	if n := shed(); n != 0 {
+		t.Errorf("at the threshold: shed %d of 1000", n)
+	}
+	goroutines = 150
+	if n := shed(); n < 400 || n > 600 {
+		t.Errorf("halfway to twice the threshold: shed %d of 1000, want about 500", n)
+	}
+	goroutines = 250
+	if n := shed(); n != 1000 {
+		t.Errorf("over twice the threshold: shed %d of 1000", n)
+	}
+	if st := s.stats(); st.ShedPressure == 0 || st.ShedOverCap != 0 || st.Inflight != 0 {
+		t.Errorf("stats %+v", st)
+	}
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"math"
+	"time"
+)
+
+// Slow start (--slow-start): a backend that just became selectable again —
+// recovered from unhealthy, readmitted after an outlier ejection, or back
+// from an expected restart — holds no connections, so plain least-conn would
+// send it every new request until it caught up with its peers. During the
+// window its selection weight ramps linearly from slowStartMinWeight to 1:
+// least-conn compares (active+1)/weight, and the maxConns cap is scaled by
+// the weight.
+
+// slowStartMinWeight is the weight a backend re-enters with.
+const slowStartMinWeight = 0.1
+
+// SetSlowStart sets the ramp-up window for backends rejoining selection
+// (0 = off). Call before serving traffic.
+func (p *Pool) SetSlowStart(d time.Duration) {
+	p.slowStart = d
+}
+
+// startSlowStartLocked begins the ramp-up. Caller must hold b.mu.
+func (b *Backend) startSlowStartLocked(now time.Time) {
+	b.warmingSince = now
+}
+
+// slowStartWeightLocked returns the backend's selection weight in (0, 1].
+// Caller must hold b.mu.
+func (b *Backend) slowStartWeightLocked(now time.Time, window time.Duration) float64 {
+	return slowStartWeight(b.warmingSince, now, window)
+}
+
+// slowStartWeight is the weight at now of a backend warming since since.
+func slowStartWeight(since, now time.Time, window time.Duration) float64 {
+	if window <= 0 || since.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= window {
+		return 1
+	}
+	return max(slowStartMinWeight, float64(elapsed)/float64(window))
+}
+
+// slowStartCap scales the per-backend connection cap by weight, keeping at
+// least one slot so a warming backend always gets some traffic.
+func slowStartCap(maxConns int, weight float64) int {
+	if weight >= 1 {
+		return maxConns
+	}
+	return max(1, int(math.Ceil(float64(maxConns)*weight)))
+}
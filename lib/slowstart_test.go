@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowStartWeightRamp(t *testing.T) {
+	now := time.Now()
+	b := &Backend{}
+	if w := b.slowStartWeightLocked(now, time.Minute); w != 1 {
+		t.Errorf("never-recovered backend weight = %v, want 1", w)
+	}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, slowStartMinWeight},
+		{3 * time.Second, slowStartMinWeight},
+		{30 * time.Second, 0.5},
+		{time.Minute, 1},
+	} {
+		b.warmingSince = now.Add(-tc.elapsed)
+		if w := b.slowStartWeightLocked(now, time.Minute); w != tc.want {
+			t.Errorf("weight after %v = %v, want %v", tc.elapsed, w, tc.want)
+		}
+	}
+	if w := b.slowStartWeightLocked(now, 0); w != 1 {
+		t.Errorf("weight with slow start off = %v, want 1", w)
+	}
+	if got := slowStartCap(10, 0.25); got != 3 {
+		t.Errorf("slowStartCap(10, 0.25) = %d, want 3", got)
+	}
+	if got := slowStartCap(10, slowStartMinWeight/2); got != 1 {
+		t.Errorf("slowStartCap keeps at least one slot, got %d", got)
+	}
+}
+
+func TestSlowStartRecoveredBackendRampsUp(t *testing.T) {
+	clock := newFakeClock(time.Unix(1_000_000, 0))
+	pool, err := NewPool([]string{"http://a", "http://b", "http://c"}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetSlowStart(time.Minute)
+	backends := pool.GetBackends()
+	fresh := backends[0]
+	fresh.MarkUnhealthy()
+	for range healthyThreshold {
+		fresh.RecordCheckSuccess()
+	}
+
+	// Plain least-conn would hand the idle recovered backend the next
+	// several requests in a row; at weight 0.1 it gets one, then the
+	// loaded peers win until they hold 10x its connections.
+	picks := map[*Backend]int{}
+	for range 25 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[b]++
+	}
+	if picks[fresh] != 1 {
+		t.Errorf("recovered backend got %d of 25 requests, want 1 while warming", picks[fresh])
+	}
+
+	// Halfway through, at weight 0.5, it is picked until it holds half its
+	// peers' connections.
+	clock.advance(30 * time.Second)
+	for range 6 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[b]++
+	}
+	if picks[fresh] != 6 {
+		t.Errorf("half-warm backend got %d requests, want 6, half of a peer's 12", picks[fresh])
+	}
+
+	// Past the window it is an ordinary peer again.
+	clock.advance(30 * time.Second)
+	for range 12 {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[b]++
+	}
+	if picks[fresh] < 10 {
+		t.Errorf("warmed-up backend got %d requests after the window, want it to catch up", picks[fresh])
+	}
+}
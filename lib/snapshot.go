@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Selection snapshot: the request path reads the pool through one atomic
+// pointer to an immutable poolSnapshot instead of taking the pool lock.
+// A snapshot lists the pool's backends and, copied out of their locked
+// state, the ones selection may consider: in rotation (healthy, not
+// ejected, drained, degraded or removed) and, for panic mode, those only
+// health keeps out. It is rebuilt under p.mu whenever membership changes
+// and, through the backends' onRotation callback, whenever one of them
+// enters or leaves rotation or starts slow start; panic mode is
+// re-evaluated with each rebuild rather than per request. What changes
+// with time alone — restart windows, slow-start ramps — is computed from
+// the copied times; connection counts, adaptive limits, bandwidth, failure
+// scores and tuned weights are read live. A selection reserves its slot by
+// compare-and-swap on the count it read, and selects again if another
+// request took the slot first, so a burst still spreads within ±1 and a
+// cap is never overshot.
+
+// poolSnapshot is the pool as selection sees it. Never modified once
+// published.
+type poolSnapshot struct {
+	// backends is every backend, in pool order (GetBackends)
+	backends []*Backend
+	// rotation is the backends in rotation, panic the backends panic mode
+	// may pick: rotation plus the unhealthy and ejected ones
+	rotation, panic []selectEntry
+	// entries indexes panic by backend
+	entries map[*Backend]*selectEntry
+}
+
+// selectEntry is a backend with the locked state selection needs, as of
+// the snapshot.
+type selectEntry struct {
+	b                          *Backend
+	inRotation                 bool
+	restartUntil, warmingSince time.Time
+	share                      float64
+}
+
+// restarting reports whether the entry's backend is inside an expected
+// restart window at now (see restart.go).
+func (e *selectEntry) restarting(now time.Time) bool {
+	return !e.restartUntil.IsZero() && now.Before(e.restartUntil)
+}
+
+// weight is the entry's slow-start weight at now times its SRV share (see
+// slowstart.go, discovery.go).
+func (e *selectEntry) weight(now time.Time, window time.Duration) float64 {
+	return slowStartWeight(e.warmingSince, now, window) * e.share
+}
+
+// snapshot returns the current selection snapshot.
+func (p *Pool) snapshot() *poolSnapshot {
+	return p.snap.Load()
+}
+
+// publishLocked builds and publishes the snapshot of backends, then
+// re-evaluates panic mode. Callers must hold p.mu (or own an unshared
+// pool).
+func (p *Pool) publishLocked(backends []*Backend) {
+	s := &poolSnapshot{backends: backends, entries: make(map[*Backend]*selectEntry, len(backends))}
+	for _, b := range backends {
+		b.mu.Lock()
+		e := selectEntry{b: b, inRotation: b.healthy && !b.ejected, restartUntil: b.restartUntil, warmingSince: b.warmingSince, share: b.shareLocked()}
+		selectable := !b.drained && !b.signalDrained && b.degraded == "" && !b.removed
+		b.mu.Unlock()
+		if !selectable {
+			continue
+		}
+		if e.inRotation {
+			s.rotation = append(s.rotation, e)
+		}
+		s.panic = append(s.panic, e)
+	}
+	for i := range s.panic {
+		s.entries[s.panic[i].b] = &s.panic[i]
+	}
+	p.snap.Store(s)
+	p.notePanicLocked(s, p.clock.Now())
+}
+
+// refreshSnapshot republishes the snapshot after a backend's state
+// changed.
+func (p *Pool) refreshSnapshot() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.publishLocked(p.snapshot().backends)
+}
+
+// rotationChanged tells the backend's pool it entered or left rotation or
+// its selection state changed. Callers must not hold b.mu.
+func (b *Backend) rotationChanged() {
+	if f := b.onRotation; f != nil {
+		f()
+	}
+}
+
+// reserveConn takes a connection slot on b if it still has the active
+// count selection read, and reports whether it did.
+func (b *Backend) reserveConn(count int) bool {
+	if !b.activeConns.CompareAndSwap(int64(count), int64(count)+1) {
+		return false
+	}
+	b.requests.Add(1)
+	return true
+}
+
+// candidates returns the entries selection considers in s.
+func (p *Pool) candidates(s *poolSnapshot) []selectEntry {
+	if p.panicking.Load() {
+		return s.panic
+	}
+	return s.rotation
+}
+
+// candidate returns b's entry in s if selection considers it, else nil.
+func (p *Pool) candidate(s *poolSnapshot, b *Backend) *selectEntry {
+	e := s.entries[b]
+	if e == nil || !e.inRotation && !p.panicking.Load() {
+		return nil
+	}
+	return e
+}
+
+// pick is a selection's choice: a backend and the active count its load
+// was computed from, which reserveConn checks.
+type pick struct {
+	b     *Backend
+	count int
+	load  float64
+}
+
+// consider folds a candidate with load into the choice among ties, breaking
+// them uniformly at random without collecting them (reservoir sampling).
+// ties counts the candidates at the choice's load so far.
+func (c *pick) consider(b *Backend, count int, load float64, ties *int) {
+	switch {
+	case c.b == nil || load < c.load:
+		*c, *ties = pick{b, count, load}, 1
+	case load == c.load:
+		*ties++
+		if rand.IntN(*ties) == 0 { // #nosec G404 -- tie-break among equally loaded backends, not security-sensitive
+			*c = pick{b, count, load}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelectBackendAllocs(t *testing.T) {
+	pool, err := NewPool([]string{"http://gpu-0", "http://gpu-1", "http://gpu-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		b, err := pool.SelectBackend()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.DecrementConns()
+	})
+	if allocs != 0 {
+		t.Errorf("SelectBackend allocates %v times per call, want 0", allocs)
+	}
+}
+
+// TestSnapshotConcurrentMembership selects and proxies while backends are
+// added, replaced, removed, failed and recovered; run it with -race.
+func TestSnapshotConcurrentMembership(t *testing.T) {
+	var urls []string
+	for range 4 {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL)
+	}
+	pool, err := NewPool(urls[:2], WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+	pool.SetMaxConns(4)
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for !stop.Load() {
+				if b, err := pool.SelectBackend(); err == nil {
+					if n := b.GetActiveConns(); n > 4 {
+						t.Errorf("%s over its cap: %d", b.ID(), n)
+					}
+					b.DecrementConns()
+				}
+				w := httptest.NewRecorder()
+				pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+				if w.Code != http.StatusOK && w.Code != http.StatusServiceUnavailable && w.Code != http.StatusTooManyRequests {
+					t.Errorf("status %d", w.Code)
+				}
+			}
+		})
+	}
+	for range 100 {
+		if _, err := pool.AddBackend(urls[2]); err != nil {
+			t.Fatal(err)
+		}
+		first := pool.GetBackends()[0]
+		first.MarkUnhealthy()
+		for range healthyThreshold {
+			first.RecordCheckSuccess()
+		}
+		if err := pool.ReplaceBackend(urls[2], urls[3]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.RemoveBackend(urls[3]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if got := len(pool.snapshot().rotation); got != 2 {
+		t.Errorf("%d backends in rotation after the churn, want 2", got)
+	}
+	for _, b := range pool.GetBackends() {
+		if n := b.GetActiveConns(); n != 0 {
+			t.Errorf("%s: %d connections left active", b.ID(), n)
+		}
+	}
+}
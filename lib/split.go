@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Traffic splitting (config "split"): a gradual rollout sends a new group of
+// backends — a pool of its own — 5% of the traffic, then 25%, then all of
+// it. The split serves the paths no route matches, dividing them between
+// pools by percentages that sum to 100 and can be changed at runtime
+// (PUT /admin/split). A request's group is picked at random, or with
+// by "request-id" from a hash of its X-Request-Id, so a client's retries of
+// one request land in the same group (requests without one are picked at
+// random). The pool's own routing then picks the backend. With fallback, a
+// request whose group has no backend in rotation goes to the largest group
+// that has one; without, it is left to its group's pool to answer (503).
+// Each group's requests and 5xx responses are counted, so /stats can compare
+// the new group's error rate with the old one's.
+
+// Split methods.
+const (
+	SplitByRandom    = "random"
+	SplitByRequestID = "request-id"
+)
+
+// splitTolerance is how far from 100 percentages may sum, for decimals.
+const splitTolerance = 1e-6
+
+// SplitConfig is the config file's "split".
+type SplitConfig struct {
+	Groups []SplitGroup `json:"groups"`
+	// By is how a request's group is picked: "random" (default) or
+	// "request-id".
+	By string `json:"by"`
+	// Fallback sends a request whose group has no backend in rotation to
+	// another group.
+	Fallback bool `json:"fallback"`
+}
+
+// SplitGroup is one pool of a split with its share of requests.
+type SplitGroup struct {
+	Pool    string  `json:"pool"`
+	Percent float64 `json:"percent"`
+}
+
+// validate checks c against the config's pools.
+func (c *SplitConfig) validate(pools map[string]PoolConfig) error {
+	if c.By != "" && c.By != SplitByRandom && c.By != SplitByRequestID {
+		return fmt.Errorf("by must be %s or %s, got %q", SplitByRandom, SplitByRequestID, c.By)
+	}
+	if len(c.Groups) < 2 {
+		return errors.New("at least two groups are required")
+	}
+	seen := make(map[string]bool)
+	for _, g := range c.Groups {
+		if _, ok := pools[g.Pool]; !ok {
+			return fmt.Errorf("unknown pool %q", g.Pool)
+		}
+		if seen[g.Pool] {
+			return fmt.Errorf("pool %q is in two groups", g.Pool)
+		}
+		seen[g.Pool] = true
+	}
+	return validatePercents(c.Groups)
+}
+
+// validatePercents requires percentages between 0 and 100 summing to 100.
+func validatePercents(groups []SplitGroup) error {
+	total := 0.0
+	for _, g := range groups {
+		if g.Percent < 0 || g.Percent > 100 || math.IsNaN(g.Percent) {
+			return fmt.Errorf("percent for pool %q must be between 0 and 100", g.Pool)
+		}
+		total += g.Percent
+	}
+	if math.Abs(total-100) > splitTolerance {
+		return fmt.Errorf("percents must sum to 100, got %g", total)
+	}
+	return nil
+}
+
+// Splitter divides requests between pools by percentage.
+type Splitter struct {
+	mu          sync.RWMutex
+	groups      []*splitGroup
+	byRequestID bool
+	fallback    bool
+}
+
+type splitGroup struct {
+	name    string
+	pool    *Pool
+	percent float64 // guarded by Splitter.mu
+	// requests counts the requests the group served, errors their 5xx
+	// responses, and fallbacks the requests picked for it that another
+	// group served
+	requests, errors, fallbacks atomic.Uint64
+}
+
+// SplitStats reports a split's percentages and per-group counters in
+// /stats.
+type SplitStats struct {
+	By       string            `json:"by"`
+	Fallback bool              `json:"fallback"`
+	Groups   []SplitGroupStats `json:"groups"`
+}
+
+// SplitGroupStats is one group's entry in SplitStats. ErrorRate is Errors
+// over Requests.
+type SplitGroupStats struct {
+	Pool      string  `json:"pool"`
+	Percent   float64 `json:"percent"`
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Fallbacks uint64  `json:"fallbacks"`
+}
+
+// NewSplitter builds a splitter from cfg over the named pools.
+func NewSplitter(cfg SplitConfig, pools map[string]*Pool) (*Splitter, error) {
+	s := &Splitter{byRequestID: cfg.By == SplitByRequestID, fallback: cfg.Fallback}
+	if err := validatePercents(cfg.Groups); err != nil {
+		return nil, err
+	}
+	for _, g := range cfg.Groups {
+		pool, ok := pools[g.Pool]
+		if !ok {
+			return nil, fmt.Errorf("unknown pool %q", g.Pool)
+		}
+		s.groups = append(s.groups, &splitGroup{name: g.Pool, pool: pool, percent: g.Percent})
+	}
+	return s, nil
+}
+
+// point places r in [0, 100): by its request ID's hash, or at random.
+func (s *Splitter) point(r *http.Request) float64 {
+	if id := r.Header.Get("X-Request-Id"); s.byRequestID && id != "" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(id))
+		return float64(h.Sum64()>>11) / (1 << 53) * 100
+	}
+	return rand.Float64() * 100 // #nosec G404 -- traffic split, not security-sensitive
+}
+
+// pick returns the group whose share holds point. Caller must hold s.mu.
+func (s *Splitter) pick(point float64) *splitGroup {
+	var last *splitGroup
+	for _, g := range s.groups {
+		if g.percent == 0 {
+			continue
+		}
+		if point < g.percent {
+			return g
+		}
+		point -= g.percent
+		last = g
+	}
+	return last // rounding past the end
+}
+
+// fallbackFor returns the largest group other than g with a backend in
+// rotation, or nil. Caller must hold s.mu.
+func (s *Splitter) fallbackFor(g *splitGroup) *splitGroup {
+	var best *splitGroup
+	for _, o := range s.groups {
+		if o != g && o.pool.inRotation() && (best == nil || o.percent > best.percent) {
+			best = o
+		}
+	}
+	return best
+}
+
+// inRotation reports whether any of the pool's backends is in rotation.
+func (p *Pool) inRotation() bool {
+	return len(p.snapshot().rotation) > 0
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Splitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	point := s.point(r)
+	s.mu.RLock()
+	g := s.pick(point)
+	if s.fallback && !g.pool.inRotation() {
+		if other := s.fallbackFor(g); other != nil {
+			g.fallbacks.Add(1)
+			g = other
+		}
+	}
+	s.mu.RUnlock()
+
+	g.requests.Add(1)
+	sw := &statusWriter{ResponseWriter: w}
+	g.pool.ServeHTTP(sw, r)
+	if sw.status >= 500 {
+		g.errors.Add(1)
+	}
+}
+
+// SetPercents replaces the split's percentages, effective for the next
+// request. Every group must be given and the percentages must sum to 100;
+// the split is unchanged on error.
+func (s *Splitter) SetPercents(percents map[string]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(percents) != len(s.groups) {
+		return fmt.Errorf("split has %d groups, got %d percents", len(s.groups), len(percents))
+	}
+	groups := make([]SplitGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		p, ok := percents[g.name]
+		if !ok {
+			return fmt.Errorf("missing percent for pool %q", g.name)
+		}
+		groups = append(groups, SplitGroup{Pool: g.name, Percent: p})
+	}
+	if err := validatePercents(groups); err != nil {
+		return err
+	}
+	for i, g := range s.groups {
+		g.percent = groups[i].Percent
+	}
+	return nil
+}
+
+// Stats returns the groups in config order with percentages and counters.
+func (s *Splitter) Stats() SplitStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := SplitStats{By: SplitByRandom, Fallback: s.fallback}
+	if s.byRequestID {
+		out.By = SplitByRequestID
+	}
+	for _, g := range s.groups {
+		gs := SplitGroupStats{Pool: g.name, Percent: g.percent, Requests: g.requests.Load(), Errors: g.errors.Load(), Fallbacks: g.fallbacks.Load()}
+		if gs.Requests > 0 {
+			gs.ErrorRate = float64(gs.Errors) / float64(gs.Requests)
+		}
+		out.Groups = append(out.Groups, gs)
+	}
+	return out
+}
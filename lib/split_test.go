@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func newTestSplitter(t *testing.T, cfg SplitConfig, urls map[string]string) (*Splitter, map[string]*Pool) {
+	t.Helper()
+	pools := make(map[string]*Pool)
+	for name, u := range urls {
+		p, err := NewPool([]string{u}, WithLogger(&lineLogger{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = p
+	}
+	s, err := NewSplitter(cfg, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, pools
+}
+
+func canary(stable, canary float64) []SplitGroup {
+	return []SplitGroup{{Pool: "stable", Percent: stable}, {Pool: "canary", Percent: canary}}
+}
+
+// canaryShare returns the fraction of n assignments that chose canary,
+// request i with X-Request-Id id(i) if id is given.
+func canaryShare(s *Splitter, n int, id func(int) string) float64 {
+	hits := 0
+	for i := range n {
+		r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if id != nil {
+			r.Header.Set("X-Request-Id", id(i))
+		}
+		s.mu.RLock()
+		g := s.pick(s.point(r))
+		s.mu.RUnlock()
+		if g.name == "canary" {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
+func TestSplitAccuracy(t *testing.T) {
+	urls := map[string]string{"stable": "http://stable", "canary": "http://canary"}
+	for _, by := range []string{SplitByRandom, SplitByRequestID} {
+		s, _ := newTestSplitter(t, SplitConfig{Groups: canary(95, 5), By: by}, urls)
+		id := func(i int) string { return "req-" + strconv.Itoa(i) }
+		if got := canaryShare(s, 100_000, id); math.Abs(got-0.05) > 0.01 {
+			t.Errorf("by %s: canary share = %.4f, want 0.05 ± 0.01", by, got)
+		}
+	}
+
+	// By request ID, a retry lands in the same group.
+	s, _ := newTestSplitter(t, SplitConfig{Groups: canary(50, 50), By: SplitByRequestID}, urls)
+	for i := range 100 {
+		same := func(int) string { return "retry-" + strconv.Itoa(i) }
+		if got := canaryShare(s, 20, same); got != 0 && got != 1 {
+			t.Fatalf("request %d split across groups (%.2f)", i, got)
+		}
+	}
+}
+
+func TestSplitSetPercentsLive(t *testing.T) {
+	stable, stableServed := countingBackend(t)
+	canaryBackend, canaryServed := countingBackend(t)
+	s, _ := newTestSplitter(t, SplitConfig{Groups: canary(100, 0)},
+		map[string]string{"stable": stable.URL, "canary": canaryBackend.URL})
+	lb := httptest.NewServer(s)
+	defer lb.Close()
+	send := func(n int) {
+		t.Helper()
+		for range n {
+			resp, err := http.Get(lb.URL + "/v1/models")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	send(20)
+	if canaryServed.Load() != 0 {
+		t.Fatalf("canary at 0%% served %d", canaryServed.Load())
+	}
+	if err := s.SetPercents(map[string]float64{"stable": 0, "canary": 100}); err != nil {
+		t.Fatal(err)
+	}
+	before := stableServed.Load()
+	send(20)
+	if canaryServed.Load() != 20 || stableServed.Load() != before {
+		t.Errorf("after SetPercents: canary served %d, stable %d more", canaryServed.Load(), stableServed.Load()-before)
+	}
+	if err := s.SetPercents(map[string]float64{"stable": 75, "canary": 25}); err != nil {
+		t.Fatal(err)
+	}
+	if got := canaryShare(s, 100_000, nil); math.Abs(got-0.25) > 0.01 {
+		t.Errorf("canary share after SetPercents = %.4f, want 0.25 ± 0.01", got)
+	}
+
+	for name, p := range map[string]map[string]float64{
+		"sum under 100": {"stable": 50, "canary": 40},
+		"negative":      {"stable": 110, "canary": -10},
+		"missing group": {"stable": 100},
+		"unknown group": {"stable": 50, "blue": 50},
+	} {
+		if err := s.SetPercents(p); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	st := s.Stats()
+	if st.Groups[0].Percent != 75 || st.Groups[1].Percent != 25 {
+		t.Errorf("rejected SetPercents must leave the split unchanged, got %+v", st.Groups)
+	}
+	if st.Groups[0].Requests != 20 || st.Groups[1].Requests != 20 || st.By != SplitByRandom {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestSplitErrorsAndFallback(t *testing.T) {
+	stable, stableServed := countingBackend(t)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	for _, fallback := range []bool{false, true} {
+		s, pools := newTestSplitter(t, SplitConfig{Groups: canary(0, 100), Fallback: fallback},
+			map[string]string{"stable": stable.URL, "canary": failing.URL})
+		lb := httptest.NewServer(s)
+		before := stableServed.Load()
+		statuses := map[int]int{}
+		for range 10 {
+			resp, err := http.Get(lb.URL + "/v1/models")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			statuses[resp.StatusCode]++
+		}
+		lb.Close()
+		if pools["canary"].GetBackends()[0].IsHealthy() {
+			t.Fatal("failing canary still healthy")
+		}
+		st := s.Stats()
+		canaryStats, stableStats := st.Groups[1], st.Groups[0]
+		if canaryStats.Errors == 0 || canaryStats.ErrorRate != float64(canaryStats.Errors)/float64(canaryStats.Requests) {
+			t.Errorf("fallback %v: canary stats %+v", fallback, canaryStats)
+		}
+		if fallback {
+			// The first 500 takes the canary out; the rest go to stable.
+			if canaryStats.Requests != 1 || canaryStats.Fallbacks != 9 || stableStats.Requests != 9 || stableServed.Load()-before != 9 {
+				t.Errorf("with fallback: statuses %v, canary %+v, stable %+v", statuses, canaryStats, stableStats)
+			}
+		} else if canaryStats.Requests != 10 || stableStats.Requests != 0 || canaryStats.Errors != 10 {
+			t.Errorf("without fallback: statuses %v, canary %+v, stable %+v", statuses, canaryStats, stableStats)
+		}
+	}
+}
+
+func TestSplitConfig(t *testing.T) {
+	pools := `"pools": {"stable": {"backends": ["http://s"]}, "canary": {"backends": ["http://c"]}}`
+	cfg, err := LoadConfig(writeConfig(t, `{`+pools+`, "split": {"groups": [{"pool": "stable", "percent": 97.5}, {"pool": "canary", "percent": 2.5}], "by": "request-id", "fallback": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cfg.Split; s == nil || len(s.Groups) != 2 || s.Groups[1].Percent != 2.5 || s.By != SplitByRequestID || !s.Fallback {
+		t.Errorf("split %+v", cfg.Split)
+	}
+	for name, split := range map[string]string{
+		"one group":    `{"groups": [{"pool": "stable", "percent": 100}]}`,
+		"sum":          `{"groups": [{"pool": "stable", "percent": 90}, {"pool": "canary", "percent": 5}]}`,
+		"unknown pool": `{"groups": [{"pool": "stable", "percent": 90}, {"pool": "blue", "percent": 10}]}`,
+		"duplicate":    `{"groups": [{"pool": "stable", "percent": 50}, {"pool": "stable", "percent": 50}]}`,
+		"bad by":       `{"groups": [{"pool": "stable", "percent": 90}, {"pool": "canary", "percent": 10}], "by": "client"}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, `{`+pools+`, "split": `+split+`}`)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := LoadConfig(writeConfig(t, `{`+pools+`, "default": "stable", "split": {"groups": [{"pool": "stable", "percent": 90}, {"pool": "canary", "percent": 10}]}}`)); err == nil {
+		t.Error("default and split accepted together")
+	}
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Startup grace (--startup-grace): a model server accepts connections
+// minutes before it can serve, answering its health endpoint with 503 while
+// it loads weights. A backend that has not yet passed a health check and
+// was added less than the grace ago is "starting" while its probes fail with
+// the not-ready signature (--startup-not-ready-status, default 503, or a
+// body containing --startup-not-ready-body): it logs at most one line a
+// minute, its passive failures do not count toward outlier detection, and
+// it joins like any recovering backend — healthyThreshold passing probes,
+// then slow start. One still not ready when the grace runs out is marked
+// unhealthy with a "did not become ready" line and lb_backend_startup_failed.
+
+// startingLogInterval spaces a starting backend's log lines.
+const startingLogInterval = time.Minute
+
+// notReadyBodyLimit bounds how much of a probe response is searched for the
+// not-ready body marker.
+const notReadyBodyLimit = 4 << 10
+
+// StartupConfig recognizes backends that are still starting.
+type StartupConfig struct {
+	// Grace is how long after being added a backend may stay not ready
+	// (0 = off).
+	Grace time.Duration
+	// NotReadyStatus is the probe status that means not ready yet (default
+	// 503).
+	NotReadyStatus int
+	// NotReadyBody, if set, also means not ready when the probe response
+	// body contains it.
+	NotReadyBody string
+}
+
+// SetStartup sets how backends that are still starting are recognized.
+// Call before serving traffic.
+func (p *Pool) SetStartup(cfg StartupConfig) {
+	if cfg.NotReadyStatus == 0 {
+		cfg.NotReadyStatus = http.StatusServiceUnavailable
+	}
+	p.startup = cfg
+	for _, b := range p.GetBackends() {
+		b.startupGrace = cfg.Grace
+	}
+}
+
+// notReady reports whether a failed probe's response is the not-ready
+// signature. It may read resp's body.
+func (cfg StartupConfig) notReady(resp *http.Response) bool {
+	if cfg.Grace <= 0 {
+		return false
+	}
+	if resp.StatusCode == cfg.NotReadyStatus {
+		return true
+	}
+	if cfg.NotReadyBody == "" {
+		return false
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, notReadyBodyLimit))
+	return strings.Contains(string(body), cfg.NotReadyBody)
+}
+
+// awaitingStartupLocked reports whether the backend has yet to pass a
+// health check inside its startup grace. Caller must hold b.mu.
+func (b *Backend) awaitingStartupLocked(now time.Time) bool {
+	return b.startupGrace > 0 && !b.ready && now.Sub(b.addedAt) < b.startupGrace
+}
+
+// Starting reports whether the backend is starting up.
+func (b *Backend) Starting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.starting
+}
+
+// probeFailed records a failed health check; notReady is whether it failed
+// with the not-ready signature.
+func (b *Backend) probeFailed(reason string, notReady bool) {
+	now := b.clock.Now()
+	b.mu.Lock()
+	switch {
+	case notReady && b.awaitingStartupLocked(now):
+		first := !b.starting
+		b.starting = true
+		wasHealthy := b.markUnhealthyLocked(now, "starting: "+reason)
+		logNow := first || now.Sub(b.startingLogged) >= startingLogInterval
+		if logNow {
+			b.startingLogged = now
+		}
+		b.mu.Unlock()
+		if wasHealthy {
+			b.rotationChanged()
+		}
+		if logNow {
+			b.logger.Printf("[HEALTH] %s starting (%s, %v since added)", b.ID(), reason, now.Sub(b.addedAt).Round(time.Second))
+		}
+		return
+	case b.starting:
+		b.starting = false
+		b.startupFailed = !b.awaitingStartupLocked(now)
+		wasHealthy := b.markUnhealthyLocked(now, reason)
+		failed := b.startupFailed
+		if failed {
+			b.setTransitionLocked(now, "not ready within startup grace: "+reason)
+		} else {
+			b.setTransitionLocked(now, reason)
+		}
+		b.mu.Unlock()
+		if wasHealthy {
+			b.rotationChanged()
+		}
+		if failed {
+			b.logger.Printf("[HEALTH] %s did not become ready within its %v startup grace (%s); marked as unhealthy", b.ID(), b.startupGrace, reason)
+			b.hooks.fire(b, false, fmt.Sprintf("not ready within %v startup grace: %s", b.startupGrace, reason))
+		} else {
+			b.logger.Printf("[HEALTH] %s no longer starting (%s); marked as unhealthy", b.ID(), reason)
+			b.hooks.fire(b, false, reason)
+		}
+		return
+	}
+	b.mu.Unlock()
+	b.strike(reason, false)
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadingBackend is cmd/mock-backend's starting mode on clock: every
+// endpoint answers status with body until readyAt, then 200.
+func loadingBackend(t *testing.T, clock *fakeClock, readyAt time.Time, status int, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clock.Now().Before(readyAt) {
+			http.Error(w, body, status)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// probeEvery runs a health check on b every interval until d has passed.
+func probeEvery(clock *fakeClock, hc *HealthChecker, b *Backend, interval, d time.Duration) {
+	for end := clock.Now().Add(d); clock.Now().Before(end); clock.advance(interval) {
+		hc.checkBackend(context.Background(), b)
+	}
+}
+
+func TestStartingBackendLifecycle(t *testing.T) {
+	out := captureLog(t)
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	srv := loadingBackend(t, clock, clock.Now().Add(4*time.Minute), http.StatusServiceUnavailable, "model loading")
+	pool, err := NewPool([]string{srv.URL}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetStartup(StartupConfig{Grace: 15 * time.Minute})
+	pool.SetSlowStart(time.Minute)
+	b := pool.GetBackends()[0]
+	hc := NewHealthChecker(pool, WithInterval(10*time.Second))
+
+	// A request that beats the first probe is not held against the backend.
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first request: %d", rec.Code)
+	}
+
+	probeEvery(clock, hc, b, 10*time.Second, 4*time.Minute)
+	if s := pool.Stats().Backends[0]; s.State != "starting" || s.Healthy {
+		t.Fatalf("loading backend: state %q", s.State)
+	}
+	if n := strings.Count(out.String(), "starting (status: 503"); n != 4 {
+		t.Errorf("%d starting lines over 4 minutes of 10s probes, want one a minute:\n%s", n, out)
+	}
+
+	// Ready: two passing probes, then slow start.
+	hc.checkBackend(context.Background(), b)
+	if s := pool.Stats().Backends[0]; s.State != "starting" {
+		t.Errorf("after one passing probe: state %q, want starting", s.State)
+	}
+	clock.advance(10 * time.Second)
+	hc.checkBackend(context.Background(), b)
+	if s := pool.Stats().Backends[0]; s.State != "slow-start" || s.StartupFailed {
+		t.Errorf("ready backend: state %q, startup failed %v", s.State, s.StartupFailed)
+	}
+	b.mu.Lock()
+	failures, ejections := b.failures, b.ejections
+	b.mu.Unlock()
+	if failures != 0 || ejections != 0 {
+		t.Errorf("starting backend accumulated %d failures, %d ejections", failures, ejections)
+	}
+	if !strings.Contains(out.String(), "ready after 4m10s; marked as healthy") {
+		t.Errorf("no ready line:\n%s", out)
+	}
+	if strings.Contains(out.String(), "marked as unhealthy") {
+		t.Errorf("starting backend logged as unhealthy:\n%s", out)
+	}
+
+	// Once ready, failures are ordinary ones again.
+	clock.advance(time.Minute)
+	b.strike("status: 503", true)
+	if !strings.Contains(out.String(), "marked as unhealthy (status: 503)") {
+		t.Errorf("failure after startup not logged:\n%s", out)
+	}
+}
+
+func TestStartupGraceRunsOut(t *testing.T) {
+	for name, tt := range map[string]struct {
+		cfg    StartupConfig
+		status int
+		body   string
+	}{
+		"status": {StartupConfig{Grace: time.Minute}, http.StatusServiceUnavailable, "unavailable"},
+		"body":   {StartupConfig{Grace: time.Minute, NotReadyBody: "Loading model"}, http.StatusInternalServerError, "Loading model weights"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out := captureLog(t)
+			clock := newFakeClock(time.Unix(1_700_000_000, 0))
+			srv := loadingBackend(t, clock, clock.Now().Add(5*time.Minute), tt.status, tt.body)
+			pool, err := NewPool([]string{srv.URL}, WithClock(clock))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.SetStartup(tt.cfg)
+			b := pool.GetBackends()[0]
+			hc := NewHealthChecker(pool, WithInterval(10*time.Second))
+
+			probeEvery(clock, hc, b, 10*time.Second, time.Minute)
+			if s := pool.Stats().Backends[0]; s.State != "starting" {
+				t.Fatalf("inside the grace: state %q", s.State)
+			}
+			hc.checkBackend(context.Background(), b)
+			if s := pool.Stats().Backends[0]; s.State != "unhealthy" || !s.StartupFailed {
+				t.Errorf("grace over: state %q, startup failed %v", s.State, s.StartupFailed)
+			}
+			if !strings.Contains(out.String(), "did not become ready within its 1m0s startup grace") {
+				t.Errorf("no startup failure line:\n%s", out)
+			}
+
+			// Coming up late clears the failure.
+			clock.advance(4 * time.Minute)
+			hc.checkBackend(context.Background(), b)
+			clock.advance(10 * time.Second)
+			hc.checkBackend(context.Background(), b)
+			if s := pool.Stats().Backends[0]; s.State != "healthy" || s.StartupFailed {
+				t.Errorf("late recovery: state %q, startup failed %v", s.State, s.StartupFailed)
+			}
+		})
+	}
+
+	// Without a grace, a 503 is an ordinary failure.
+	out := captureLog(t)
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	srv := loadingBackend(t, clock, clock.Now().Add(time.Hour), http.StatusServiceUnavailable, "")
+	pool, err := NewPool([]string{srv.URL}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewHealthChecker(pool, WithInterval(10*time.Second)).checkBackend(context.Background(), pool.GetBackends()[0])
+	if s := pool.Stats().Backends[0]; s.State != "unhealthy" || !strings.Contains(out.String(), "marked as unhealthy") {
+		t.Errorf("no grace: state %q\n%s", s.State, out)
+	}
+}
@@ -0,0 +1,425 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State persistence (--state-store): counters that would otherwise reset on
+// every deploy — tenants' token buckets, backends' outlier ejections and
+// health — are snapshotted to a StateStore every --state-flush-interval and
+// at shutdown, and restored at startup. A snapshot is a set of keys, one per
+// bucket or backend ("tokens/<tenant>/<model>", "pool/<pool>/<backend>",
+// tenant and pool names path-escaped), each holding a small JSON value. The
+// default store is a JSON file written atomically; builds with the redis tag
+// can keep it in a Redis hash instead (see state_redis.go), which instances
+// may share, their counts adding up. Between flushes each instance counts on
+// its own, so a crash loses at most one interval. A backend stored as
+// unhealthy restarts unhealthy, needing its usual passing checks to rejoin,
+// unless the snapshot is older than the health TTL: by then a health check
+// knows better than the file.
+
+// DefaultStateHealthTTL is how old a backend's stored health may be and
+// still be restored, unless SetHealthTTL gives another.
+const DefaultStateHealthTTL = 5 * time.Minute
+
+// StateStore loads and stores per-key state snapshots.
+type StateStore interface {
+	// Load returns the stored snapshots (empty when nothing is stored).
+	Load() (map[string]json.RawMessage, error)
+	// Store saves snapshots, replacing those stored under the same keys.
+	Store(map[string]json.RawMessage) error
+}
+
+// stateStoreOpeners opens a --state-store value by URL scheme; build-tagged
+// stores add themselves.
+var stateStoreOpeners = map[string]func(string) (StateStore, error){}
+
+// OpenStateStore opens a --state-store value: a file path, or a URL whose
+// scheme a store was built in for (redis://host:port/key with -tags redis).
+func OpenStateStore(spec string) (StateStore, error) {
+	scheme, _, ok := strings.Cut(spec, "://")
+	if !ok {
+		return NewFileStateStore(spec), nil
+	}
+	open, ok := stateStoreOpeners[scheme]
+	if !ok {
+		return nil, fmt.Errorf("state store %q: this build has no %s support", spec, scheme)
+	}
+	return open(spec)
+}
+
+// FileStateStore keeps snapshots in one JSON file, replaced atomically on
+// every store. A file that fails to parse is moved aside (quarantined) and
+// the state starts empty, rather than keeping lb from starting.
+type FileStateStore struct {
+	path   string
+	clock  Clock // names quarantined files
+	logger Logger
+	mu     sync.Mutex // serializes writers of the temp file
+}
+
+// NewFileStateStore returns a store writing path.
+func NewFileStateStore(path string, opts ...Option) *FileStateStore {
+	return &FileStateStore{path: path, clock: clockFrom(systemClock{}, opts), logger: loggerFrom(defaultLogger(), opts)}
+}
+
+// Load reads the file.
+func (s *FileStateStore) Load() (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]json.RawMessage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(data, &state); err != nil {
+		quarantine := fmt.Sprintf("%s.corrupt-%d", s.path, s.clock.Now().Unix())
+		if rerr := os.Rename(s.path, quarantine); rerr != nil {
+			return nil, fmt.Errorf("state file %s is corrupt (%v) and could not be moved aside: %w", s.path, err, rerr)
+		}
+		s.logger.Printf("[STATE] %s is corrupt (%v); moved to %s, starting with empty state", s.path, err, quarantine)
+		return map[string]json.RawMessage{}, nil
+	}
+	if state == nil {
+		state = map[string]json.RawMessage{}
+	}
+	return state, nil
+}
+
+// Store replaces the file with state: written to a temp file in the same
+// directory, synced, then renamed over the old one, so a crash mid-write
+// leaves the previous snapshot intact.
+func (s *FileStateStore) Store(state map[string]json.RawMessage) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // no-op after the rename
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// StatePersister restores tracked state at startup and flushes it
+// periodically.
+type StatePersister struct {
+	store     StateStore
+	interval  time.Duration
+	healthTTL time.Duration
+	limiters  []*TokenLimiter
+	pools     map[string]*Pool
+	clock     Clock
+	logger    Logger
+}
+
+// NewStatePersister returns a persister flushing to store every interval.
+func NewStatePersister(store StateStore, interval time.Duration, opts ...Option) *StatePersister {
+	return &StatePersister{store: store, interval: interval, healthTTL: DefaultStateHealthTTL, pools: make(map[string]*Pool), clock: clockFrom(systemClock{}, opts), logger: loggerFrom(defaultLogger(), opts)}
+}
+
+// SetHealthTTL sets how old stored backend health may be and still be
+// restored (0 = never restored). Call before Restore.
+func (sp *StatePersister) SetHealthTTL(d time.Duration) {
+	sp.healthTTL = d
+}
+
+// TrackTokens persists the limiter's token buckets. Call before Restore.
+func (sp *StatePersister) TrackTokens(l *TokenLimiter) {
+	sp.limiters = append(sp.limiters, l)
+}
+
+// TrackPool persists the pool's outlier ejections and health under name. Call
+// before Restore.
+func (sp *StatePersister) TrackPool(name string, p *Pool) {
+	sp.pools[name] = p
+}
+
+// Restore loads the stored state into the tracked limiters and pools.
+// Keys for tenants, models or backends no longer configured are ignored.
+// Call before serving traffic.
+func (sp *StatePersister) Restore() error {
+	state, err := sp.store.Load()
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for key, raw := range state {
+		kind, rest, _ := strings.Cut(key, "/")
+		escaped, second, ok := strings.Cut(rest, "/")
+		first, err := url.PathUnescape(escaped)
+		if !ok || err != nil {
+			continue
+		}
+		switch kind {
+		case "tokens":
+			for _, l := range sp.limiters {
+				if l.restoreBucket(first, second, raw) {
+					restored++
+				}
+			}
+		case "pool":
+			if p := sp.pools[first]; p != nil && p.restoreBackend(second, raw, sp.healthTTL) {
+				restored++
+			}
+		}
+	}
+	sp.logger.Printf("[STATE] restored %d of %d stored entries", restored, len(state))
+	return nil
+}
+
+// Flush stores a snapshot of the tracked state.
+func (sp *StatePersister) Flush() error {
+	state := make(map[string]json.RawMessage)
+	for _, l := range sp.limiters {
+		l.snapshotBuckets(state)
+	}
+	for name, p := range sp.pools {
+		p.snapshotBackends(name, state)
+	}
+	return sp.store.Store(state)
+}
+
+// Start flushes every interval until ctx is done. The caller flushes once
+// more after in-flight requests have drained.
+func (sp *StatePersister) Start(ctx context.Context) {
+	ticker := sp.clock.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if err := sp.Flush(); err != nil {
+				sp.logger.Printf("[STATE] flush failed: %v", err)
+			}
+		}
+	}
+}
+
+// persistedBucket is a token bucket's stored snapshot. Rate lets snapshots
+// of the same bucket from several instances be added (see addSnapshots).
+type persistedBucket struct {
+	Tokens float64   `json:"tokens"`
+	Rate   float64   `json:"rate,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func (l *TokenLimiter) snapshotBuckets(state map[string]json.RawMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		state["tokens/"+url.PathEscape(key.tenant)+"/"+key.model], _ = json.Marshal(persistedBucket{Tokens: b.tokens, Rate: b.rate, At: b.last})
+	}
+}
+
+// restoreBucket restores a stored bucket if the tenant still limits the
+// model, clamped to its current rate; the downtime since the snapshot
+// refills it on first use.
+func (l *TokenLimiter) restoreBucket(tenant, model string, raw json.RawMessage) bool {
+	var rate int64
+	for _, t := range l.tenants {
+		if t.name != tenant {
+			continue
+		}
+		var ok bool
+		if rate, ok = t.rates[model]; !ok {
+			rate = t.rates[tokenAnyModel]
+		}
+	}
+	var bs persistedBucket
+	if rate == 0 || json.Unmarshal(raw, &bs) != nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets[tokenBucketKey{tenant, model}] = &tokenBucket{rate: float64(rate), tokens: min(bs.Tokens, float64(rate)), last: bs.At}
+	return true
+}
+
+// persistedBackend is a backend's stored outlier and health state. Health
+// is "healthy" or "unhealthy" as of At, "" while no check has decided it;
+// Since and Reason are its last transition.
+type persistedBackend struct {
+	Ejections    uint64     `json:"ejections"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Health       string     `json:"health,omitempty"`
+	Since        *time.Time `json:"since,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	At           time.Time  `json:"at"`
+}
+
+func (p *Pool) snapshotBackends(name string, state map[string]json.RawMessage) {
+	now := p.clock.Now()
+	for _, b := range p.GetBackends() {
+		b.mu.Lock()
+		bs := persistedBackend{Ejections: b.ejections, Reason: b.changeReason, At: now}
+		if b.ejected {
+			until := b.ejectedUntil
+			bs.EjectedUntil = &until
+		}
+		switch {
+		case !b.healthy:
+			bs.Health = "unhealthy"
+		case b.ready:
+			bs.Health = "healthy"
+		}
+		if !b.changedAt.IsZero() {
+			since := b.changedAt
+			bs.Since = &since
+		}
+		b.mu.Unlock()
+		state["pool/"+url.PathEscape(name)+"/"+b.ID()], _ = json.Marshal(bs)
+	}
+}
+
+// restoreBackend restores a stored backend's ejection count, its ejection
+// if that has not yet expired, and its unhealthy state if stored within
+// healthTTL. A healthy backend is left unknown until its first check.
+func (p *Pool) restoreBackend(id string, raw json.RawMessage, healthTTL time.Duration) bool {
+	var bs persistedBackend
+	if json.Unmarshal(raw, &bs) != nil {
+		return false
+	}
+	now := p.clock.Now()
+	for _, b := range p.GetBackends() {
+		if b.ID() != id {
+			continue
+		}
+		b.mu.Lock()
+		b.ejections = bs.Ejections
+		if bs.EjectedUntil != nil && now.Before(*bs.EjectedUntil) {
+			b.ejected, b.ejectedUntil = true, *bs.EjectedUntil
+		}
+		down := bs.Health == "unhealthy" && now.Sub(bs.At) <= healthTTL
+		_, passes := b.thresholdsLocked()
+		if down {
+			b.healthy, b.successStreak = false, 0
+			b.changedAt, b.changeReason = bs.At, bs.Reason
+			if bs.Since != nil {
+				b.changedAt = *bs.Since
+			}
+		}
+		b.mu.Unlock()
+		if down {
+			p.logger.Printf("[STATE] %s: restored as unhealthy (%s); rejoins after %d passing health checks", id, bs.Reason, passes)
+		}
+		return true
+	}
+	return false
+}
+
+// A store shared between instances (state_redis.go) keeps each instance's
+// snapshot of a key apart and adds them on Load: addSnapshots sums the
+// counts of two snapshots of key, so the tokens the instances spent from a
+// bucket and their ejections of a backend add up. What is not a count (a
+// backend's health, its ejection deadline) is the later snapshot's. When an
+// instance stores again, subtractSnapshot takes back out what it restored
+// from the others, so its own snapshot keeps only its own counts and none
+// are counted twice. Keys of other kinds are not added: the later one in
+// the caller's order is kept.
+func addSnapshots(key string, a, b json.RawMessage) json.RawMessage {
+	kind, _, _ := strings.Cut(key, "/")
+	switch kind {
+	case "tokens":
+		var ba, bb persistedBucket
+		if json.Unmarshal(a, &ba) != nil {
+			return b
+		}
+		if json.Unmarshal(b, &bb) != nil {
+			return a
+		}
+		sum := persistedBucket{Rate: max(ba.Rate, bb.Rate), At: later(ba.At, bb.At)}
+		if sum.Rate == 0 {
+			return b // spent tokens are unknown without the rate
+		}
+		sum.Tokens = sum.Rate - ba.spentAt(sum.At) - bb.spentAt(sum.At)
+		out, _ := json.Marshal(sum)
+		return out
+	case "pool":
+		var pa, pb persistedBackend
+		if json.Unmarshal(a, &pa) != nil {
+			return b
+		}
+		if json.Unmarshal(b, &pb) != nil {
+			return a
+		}
+		sum := pb
+		if pa.At.After(pb.At) {
+			sum = pa
+		}
+		sum.Ejections = pa.Ejections + pb.Ejections
+		if pa.EjectedUntil != nil && (pb.EjectedUntil == nil || pa.EjectedUntil.After(*pb.EjectedUntil)) {
+			sum.EjectedUntil = pa.EjectedUntil
+		} else {
+			sum.EjectedUntil = pb.EjectedUntil
+		}
+		out, _ := json.Marshal(sum)
+		return out
+	}
+	return b
+}
+
+// subtractSnapshot returns own less the counts of others, the other
+// instances' snapshots of key as own's instance restored them.
+func subtractSnapshot(key string, own, others json.RawMessage) json.RawMessage {
+	kind, _, _ := strings.Cut(key, "/")
+	switch kind {
+	case "tokens":
+		var bo, bx persistedBucket
+		if json.Unmarshal(own, &bo) != nil || json.Unmarshal(others, &bx) != nil || bo.Rate == 0 {
+			return own
+		}
+		bo.Tokens = bo.Rate - max(0, bo.spentAt(bo.At)-bx.spentAt(bo.At))
+		out, _ := json.Marshal(bo)
+		return out
+	case "pool":
+		var po, px persistedBackend
+		if json.Unmarshal(own, &po) != nil || json.Unmarshal(others, &px) != nil {
+			return own
+		}
+		po.Ejections -= min(po.Ejections, px.Ejections)
+		out, _ := json.Marshal(po)
+		return out
+	}
+	return own
+}
+
+// spentAt is how many tokens of the bucket are spent at t, after refilling
+// since the snapshot.
+func (bs persistedBucket) spentAt(t time.Time) float64 {
+	refilled := max(0, t.Sub(bs.At).Minutes()) * bs.Rate
+	return max(0, bs.Rate-bs.Tokens-refilled)
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,221 @@
+//go:build redis
+
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis state store (build with -tags redis): snapshots live in one Redis
+// hash, for instances without a disk of their own to keep them on, and
+// instances may share it. Each instance writes its own fields,
+// "<instance>|<key>", with HSET; Load reads every field back with HGETALL
+// and adds up the instances' snapshots of each key (addSnapshots), so a
+// restarting instance takes the tokens all of them spent and the ejections
+// all of them counted. Load remembers what came from the other instances
+// and Store takes that back out (subtractSnapshot): an instance's fields
+// hold only its own counts, however often it restores. The instance name
+// is ?instance=, by default the host name, and must stay the same across
+// restarts of one instance and differ between instances; the fields of an
+// instance gone for good keep counting until deleted. It speaks just
+// enough RESP over a plain TCP connection for AUTH, HGETALL and HSET.
+
+const redisTimeout = 5 * time.Second
+
+func init() {
+	stateStoreOpeners["redis"] = func(spec string) (StateStore, error) {
+		return NewRedisStateStore(spec)
+	}
+}
+
+// RedisStateStore keeps snapshots in a Redis hash, one field per instance
+// and key.
+type RedisStateStore struct {
+	addr, password, hash string
+	instance             string // query-escaped, so it holds no "|"
+
+	mu sync.Mutex // one command at a time
+
+	othersMu sync.Mutex
+	others   map[string]json.RawMessage // other instances' snapshots, as of Load
+}
+
+// NewRedisStateStore parses
+// redis://[:password@]host:port[/hash][?instance=name]; the hash defaults
+// to "lb:state" and the instance to the host name.
+func NewRedisStateStore(spec string) (*RedisStateStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis state store %q", spec)
+	}
+	s := &RedisStateStore{addr: u.Host, hash: strings.TrimPrefix(u.Path, "/")}
+	if s.hash == "" {
+		s.hash = "lb:state"
+	}
+	instance := u.Query().Get("instance")
+	if instance == "" {
+		if instance, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("redis state store %q: no host name for the instance (%v); set ?instance=", spec, err)
+		}
+	}
+	s.instance = url.QueryEscape(instance)
+	if pw, ok := u.User.Password(); ok {
+		s.password = pw
+	}
+	return s, nil
+}
+
+// Load reads every field of the hash, adding up the instances' snapshots
+// of each key.
+func (s *RedisStateStore) Load() (map[string]json.RawMessage, error) {
+	reply, err := s.do("HGETALL", s.hash)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]any)
+	type snapshot struct {
+		instance string
+		val      json.RawMessage
+	}
+	byKey := make(map[string][]snapshot)
+	for i := 0; i+1 < len(fields); i += 2 {
+		field, _ := fields[i].(string)
+		val, _ := fields[i+1].(string)
+		instance, key, ok := strings.Cut(field, "|")
+		if !ok || !json.Valid([]byte(val)) {
+			continue // skip, rather than fail on, a corrupt field
+		}
+		byKey[key] = append(byKey[key], snapshot{instance, json.RawMessage(val)})
+	}
+	state := make(map[string]json.RawMessage, len(byKey))
+	others := make(map[string]json.RawMessage)
+	for key, snaps := range byKey {
+		slices.SortFunc(snaps, func(a, b snapshot) int { return strings.Compare(a.instance, b.instance) })
+		for _, sn := range snaps {
+			if sum, ok := state[key]; ok {
+				state[key] = addSnapshots(key, sum, sn.val)
+			} else {
+				state[key] = sn.val
+			}
+			if sn.instance == s.instance {
+				continue
+			}
+			if sum, ok := others[key]; ok {
+				others[key] = addSnapshots(key, sum, sn.val)
+			} else {
+				others[key] = sn.val
+			}
+		}
+	}
+	s.othersMu.Lock()
+	s.others = others
+	s.othersMu.Unlock()
+	return state, nil
+}
+
+// Store writes state's keys into this instance's fields of the hash, less
+// what Load restored from the other instances.
+func (s *RedisStateStore) Store(state map[string]json.RawMessage) error {
+	if len(state) == 0 {
+		return nil
+	}
+	s.othersMu.Lock()
+	others := s.others
+	s.othersMu.Unlock()
+	args := []string{"HSET", s.hash}
+	for k, v := range state {
+		if x, ok := others[k]; ok {
+			v = subtractSnapshot(k, v, x)
+		}
+		args = append(args, s.instance+"|"+k, string(v))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// do runs one command (after AUTH when a password is set) on a fresh
+// connection: flushes are rare enough not to need a pool.
+func (s *RedisStateStore) do(args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(redisTimeout))
+	rd := bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := redisCommand(conn, rd, "AUTH", s.password); err != nil {
+			return nil, err
+		}
+	}
+	return redisCommand(conn, rd, args...)
+}
+
+func redisCommand(conn net.Conn, rd *bufio.Reader, args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return redisReply(rd)
+}
+
+// redisReply reads one RESP reply: bulk strings become string, arrays []any.
+func redisReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = redisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
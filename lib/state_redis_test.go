@@ -0,0 +1,305 @@
+//go:build redis
+
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a Redis server knowing AUTH, HSET and HGETALL, over one map
+// of hashes.
+type fakeRedis struct {
+	addr     string
+	password string
+
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	commands []string // command names, in order
+}
+
+// startFakeRedis serves a fakeRedis until the test ends.
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	f := &fakeRedis{addr: ln.Addr().String(), password: password, hashes: make(map[string]map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	rd := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		req, err := redisReply(rd)
+		if err != nil {
+			return
+		}
+		parts, _ := req.([]any)
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			args[i], _ = p.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args[0])
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			if len(args) == 2 && args[1] == f.password {
+				authed, reply = true, "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "HSET" && len(args) >= 4 && len(args)%2 == 0:
+			h := f.hashes[args[1]]
+			if h == nil {
+				h = make(map[string]string)
+				f.hashes[args[1]] = h
+			}
+			added := 0
+			for i := 2; i < len(args); i += 2 {
+				if _, ok := h[args[i]]; !ok {
+					added++
+				}
+				h[args[i]] = args[i+1]
+			}
+			reply = fmt.Sprintf(":%d\r\n", added)
+		case args[0] == "HGETALL" && len(args) == 2:
+			h := f.hashes[args[1]]
+			var b strings.Builder
+			fmt.Fprintf(&b, "*%d\r\n", 2*len(h))
+			for k, v := range h {
+				fmt.Fprintf(&b, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+			}
+			reply = b.String()
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		f.mu.Unlock()
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) set(hash, key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hashes[hash] == nil {
+		f.hashes[hash] = make(map[string]string)
+	}
+	f.hashes[hash][key] = value
+}
+
+func (f *fakeRedis) get(hash, key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.hashes[hash][key]
+	return v, ok
+}
+
+func (f *fakeRedis) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func TestRedisStateStoreRoundTrip(t *testing.T) {
+	f := startFakeRedis(t, "")
+	store, err := OpenStateStore("redis://" + f.addr + "?instance=lb-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil || len(state) != 0 {
+		t.Fatalf("empty hash loaded %v, %v", state, err)
+	}
+	want := map[string]json.RawMessage{
+		"tokens/acme/gpt-4":          json.RawMessage(`{"tokens":12.5,"at":"2026-01-02T03:04:05Z"}`),
+		"pool/default/http://a:8000": json.RawMessage(`{"ejections":2,"health":"unhealthy","at":"2026-01-02T03:04:05Z"}`),
+	}
+	if err := store.Store(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.get("lb:state", "lb-1|tokens/acme/gpt-4"); !ok {
+		t.Error("snapshot not stored in the instance's field of the default hash lb:state")
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loaded %d keys, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if string(got[k]) != string(v) {
+			t.Errorf("%s = %s, want %s", k, got[k], v)
+		}
+	}
+	if cmds := strings.Join(f.sent(), " "); cmds != "HGETALL HSET HGETALL" {
+		t.Errorf("commands %q, want no write for an empty snapshot", cmds)
+	}
+}
+
+func TestRedisStateStoreAuth(t *testing.T) {
+	f := startFakeRedis(t, "s3cret")
+	store, err := NewRedisStateStore("redis://:s3cret@" + f.addr + "/lb:state:eu?instance=lb-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store(map[string]json.RawMessage{"k": json.RawMessage(`1`)}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := f.get("lb:state:eu", "lb-1|k"); v != "1" {
+		t.Errorf("lb:state:eu lb-1|k = %q, want 1", v)
+	}
+	if cmds := strings.Join(f.sent(), " "); cmds != "AUTH HSET" {
+		t.Errorf("commands %q, want AUTH before each command", cmds)
+	}
+
+	wrong, err := NewRedisStateStore("redis://:nope@" + f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Load(); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("wrong password: err = %v, want the server's error", err)
+	}
+	unauthed, err := NewRedisStateStore("redis://" + f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthed.Load(); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("no password: err = %v, want the server's error", err)
+	}
+}
+
+func TestRedisStateStoreSkipsCorruptFields(t *testing.T) {
+	f := startFakeRedis(t, "")
+	f.set("lb:state", "lb-1|good", `{"ejections":1}`)
+	f.set("lb:state", "lb-1|bad", `{"ejections":`)
+	f.set("lb:state", "no-instance", `{"ejections":1}`)
+	store, err := NewRedisStateStore("redis://" + f.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || string(got["good"]) != `{"ejections":1}` {
+		t.Errorf("loaded %v, want only the valid field", got)
+	}
+}
+
+// Instances sharing a hash add up their counts: the tokens each spent from
+// a bucket and the ejections each counted.
+func TestRedisStateStoreSharedHashAddsCounts(t *testing.T) {
+	f := startFakeRedis(t, "")
+	a, _ := NewRedisStateStore("redis://" + f.addr + "?instance=lb-1")
+	b, _ := NewRedisStateStore("redis://" + f.addr + "?instance=lb-2")
+	snapshots := map[*RedisStateStore]map[string]json.RawMessage{
+		a: {
+			"pool/default/x": json.RawMessage(`{"ejections":3,"at":"2026-01-02T03:04:05Z"}`),
+			"tokens/acme/m":  json.RawMessage(`{"tokens":70,"rate":100,"at":"2026-01-02T03:04:05Z"}`),
+		},
+		b: {
+			"pool/default/x": json.RawMessage(`{"ejections":1,"health":"unhealthy","at":"2026-01-02T03:04:06Z"}`),
+			"tokens/acme/m":  json.RawMessage(`{"tokens":80,"rate":100,"at":"2026-01-02T03:04:05Z"}`),
+		},
+	}
+	var wg sync.WaitGroup
+	for store, state := range snapshots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if err := store.Store(state); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	load := func(store *RedisStateStore) (persistedBackend, persistedBucket) {
+		t.Helper()
+		got, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pb persistedBackend
+		var bs persistedBucket
+		if json.Unmarshal(got["pool/default/x"], &pb) != nil || json.Unmarshal(got["tokens/acme/m"], &bs) != nil {
+			t.Fatalf("loaded %v", got)
+		}
+		return pb, bs
+	}
+	pb, bs := load(a)
+	if pb.Ejections != 4 || pb.Health != "unhealthy" {
+		t.Errorf("backend = %+v, want 4 ejections and b's later health", pb)
+	}
+	if bs.Tokens != 50 || bs.Rate != 100 {
+		t.Errorf("bucket = %+v, want 50 of 100 tokens left after both spent theirs", bs)
+	}
+
+	// a restored the sum; flushing it again, plus one more ejection and 10
+	// more tokens, must not count b's share twice.
+	if err := a.Store(map[string]json.RawMessage{
+		"pool/default/x": json.RawMessage(`{"ejections":5,"at":"2026-01-02T03:04:05Z"}`),
+		"tokens/acme/m":  json.RawMessage(`{"tokens":40,"rate":100,"at":"2026-01-02T03:04:05Z"}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := f.get("lb:state", "lb-1|pool/default/x"); !strings.Contains(v, `"ejections":4`) {
+		t.Errorf("lb-1's field = %s, want only its own 4 ejections", v)
+	}
+	pb, bs = load(b)
+	if pb.Ejections != 5 || bs.Tokens != 40 {
+		t.Errorf("after a's second flush: %d ejections, %v tokens, want 5 and 40", pb.Ejections, bs.Tokens)
+	}
+}
+
+func TestRedisStateStoreErrors(t *testing.T) {
+	for _, spec := range []string{"redis://", "redis://%zz"} {
+		if _, err := NewRedisStateStore(spec); err == nil {
+			t.Errorf("NewRedisStateStore(%q) accepted", spec)
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	store, _ := NewRedisStateStore("redis://" + addr)
+	if _, err := store.Load(); err == nil {
+		t.Error("Load from a closed port succeeded")
+	}
+}
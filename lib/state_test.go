@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateRestartContinuity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	// Before the restart: spend tokens and eject a backend.
+	l, _ := frozenLimiter(map[string]int64{"*": 1000})
+	res, _ := l.reserve(l.tenants["sk-a"], "org/model", 400)
+	res.settle(250)
+	pool, err := NewPool([]string{"http://a", "http://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[1]
+	b.ejected, b.ejectedUntil, b.ejections = true, until, 3
+	sp := NewStatePersister(NewFileStateStore(path), time.Minute)
+	sp.TrackTokens(l)
+	sp.TrackPool("gpu/east", pool)
+	if err := sp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After: fresh objects restored from the same file.
+	l2, _ := frozenLimiter(map[string]int64{"*": 1000})
+	pool2, err := NewPool([]string{"http://a", "http://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp2 := NewStatePersister(NewFileStateStore(path), time.Minute)
+	sp2.TrackTokens(l2)
+	sp2.TrackPool("gpu/east", pool2)
+	if err := sp2.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got := available(l2, "org/model"); got != 750 {
+		t.Errorf("restored bucket has %v tokens, want 750", got)
+	}
+	b2 := pool2.GetBackends()[1]
+	if !b2.ejected || !b2.ejectedUntil.Equal(until) || b2.ejections != 3 {
+		t.Errorf("restored backend: ejected %v until %v, %d ejections; want ejected until %v, 3", b2.ejected, b2.ejectedUntil, b2.ejections, until)
+	}
+	if a := pool2.GetBackends()[0]; a.ejected || a.ejections != 0 {
+		t.Error("restore ejected the wrong backend")
+	}
+}
+
+func TestStateCorruptFileQuarantined(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte(`{"tokens/a/m": {"tok`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := captureLog(t)
+	l, _ := frozenLimiter(map[string]int64{"m": 1000})
+	sp := NewStatePersister(NewFileStateStore(path), time.Minute)
+	sp.TrackTokens(l)
+	if err := sp.Restore(); err != nil {
+		t.Fatalf("corrupt state file failed the restore: %v", err)
+	}
+	if quarantined, _ := filepath.Glob(path + ".corrupt-*"); len(quarantined) != 1 {
+		t.Errorf("quarantined files = %v, want one", quarantined)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt file left in place: %v", err)
+	}
+	if !strings.Contains(out.String(), "[STATE] "+path+" is corrupt") {
+		t.Errorf("quarantine not logged:\n%s", out)
+	}
+	if err := sp.Flush(); err != nil {
+		t.Fatalf("flush after quarantine: %v", err)
+	}
+}
+
+// TestStateFlushDuringTraffic flushes repeatedly while requests debit and
+// settle buckets; every flushed file must load cleanly. Run with -race.
+func TestStateFlushDuringTraffic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store := NewFileStateStore(path)
+	l := NewTokenLimiter(map[string]TenantConfig{"a": {Keys: []string{"sk-a"}, TokensPerMinute: map[string]int64{"*": 1e9}}})
+	pool, err := NewPool([]string{"http://a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := NewStatePersister(store, time.Minute)
+	sp.TrackTokens(l)
+	sp.TrackPool("default", pool)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, model := range []string{"m1", "m2", "m3", "m4"} {
+		wg.Go(func() {
+			for {
+				res, _ := l.reserve(l.tenants["sk-a"], model, 100)
+				res.settle(60)
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		})
+	}
+	for range 50 {
+		if err := sp.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if err := sp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tokens/a/m1", "tokens/a/m4", "pool/default/http://a"} {
+		if _, ok := state[key]; !ok {
+			t.Errorf("flushed state missing %q", key)
+		}
+	}
+	if leftovers, _ := filepath.Glob(path + ".tmp-*"); len(leftovers) != 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
+}
+
+func TestStateRestoresUnhealthyBackends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	urls := []string{"http://a", "http://b", "http://c"}
+
+	pool, err := NewPool(urls, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.GetBackends()[0].RecordCheckSuccess()
+	down := pool.GetBackends()[1]
+	down.MarkUnhealthy()
+	_, since, reason := down.HealthTransition()
+	sp := NewStatePersister(NewFileStateStore(path), time.Minute)
+	sp.TrackPool("default", pool)
+	clock.advance(time.Minute)
+	if err := sp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	restart := func(after time.Duration) *Pool {
+		t.Helper()
+		clock.advance(after)
+		pool, err := NewPool(urls, WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sp := NewStatePersister(NewFileStateStore(path), time.Minute)
+		sp.TrackPool("default", pool)
+		if err := sp.Restore(); err != nil {
+			t.Fatal(err)
+		}
+		return pool
+	}
+
+	pool2 := restart(30 * time.Second)
+	states := func(p *Pool) []string {
+		var s []string
+		for _, b := range p.Stats().Backends {
+			s = append(s, b.State)
+		}
+		return s
+	}
+	if got := states(pool2); got[0] != "unknown" || got[1] != "unhealthy" || got[2] != "unknown" {
+		t.Errorf("restored states %v, want [unknown unhealthy unknown]", got)
+	}
+	healthy, gotSince, gotReason := pool2.GetBackends()[1].HealthTransition()
+	if healthy || !gotSince.Equal(since) || gotReason != reason {
+		t.Errorf("restored transition %v %v %q, want unhealthy since %v (%q)", healthy, gotSince, gotReason, since, reason)
+	}
+	// It rejoins like any recovering backend.
+	b := pool2.GetBackends()[1]
+	if b.RecordCheckSuccess() || !b.RecordCheckSuccess() {
+		t.Error("restored backend did not rejoin after 2 passing checks")
+	}
+
+	// Past the TTL the stored health is ignored.
+	if got := states(restart(5 * time.Minute)); got[1] != "unknown" {
+		t.Errorf("stale snapshot: state %q, want unknown", got[1])
+	}
+}
+
+// Snapshots of one bucket from several instances add up the tokens spent,
+// refilled to the later snapshot; subtracting them back leaves one's own.
+func TestStateSnapshotsAddAndSubtract(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	bucket := func(tokens float64, at time.Time) json.RawMessage {
+		raw, _ := json.Marshal(persistedBucket{Tokens: tokens, Rate: 60, At: at})
+		return raw
+	}
+	tokens := func(raw json.RawMessage) float64 {
+		var bs persistedBucket
+		if err := json.Unmarshal(raw, &bs); err != nil {
+			t.Fatal(err)
+		}
+		return bs.Tokens
+	}
+	// 30 spent at at, 20 spent 10s later of which 10 have refilled by then.
+	sum := addSnapshots("tokens/acme/m", bucket(30, at), bucket(40, at.Add(10*time.Second)))
+	if got := tokens(sum); got != 20 {
+		t.Errorf("added bucket has %v tokens, want 20", got)
+	}
+	// 55 spent, less the other instance's 20 left after refill.
+	own := subtractSnapshot("tokens/acme/m", bucket(5, at.Add(10*time.Second)), bucket(30, at))
+	if got := tokens(own); got != 25 {
+		t.Errorf("own bucket has %v tokens, want 25", got)
+	}
+
+	backend := func(ejections uint64, health string, at time.Time) json.RawMessage {
+		raw, _ := json.Marshal(persistedBackend{Ejections: ejections, Health: health, At: at})
+		return raw
+	}
+	var pb persistedBackend
+	_ = json.Unmarshal(addSnapshots("pool/default/x", backend(2, "unhealthy", at.Add(time.Second)), backend(3, "healthy", at)), &pb)
+	if pb.Ejections != 5 || pb.Health != "unhealthy" {
+		t.Errorf("added backend %+v, want 5 ejections and the later health", pb)
+	}
+	_ = json.Unmarshal(subtractSnapshot("pool/default/x", backend(4, "", at), backend(5, "", at)), &pb)
+	if pb.Ejections != 0 {
+		t.Errorf("subtracted backend has %d ejections, want 0", pb.Ejections)
+	}
+
+	if got := addSnapshots("other/x/y", json.RawMessage(`1`), json.RawMessage(`2`)); string(got) != "2" {
+		t.Errorf("unknown kind added to %s, want the later one", got)
+	}
+}
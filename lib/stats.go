@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"strconv"
+	"time"
+)
+
+// PoolStats is the JSON snapshot served at /stats.
+type PoolStats struct {
+	TotalBackends   int `json:"total_backends"`
+	HealthyBackends int `json:"healthy_backends"`
+	ActiveConns     int `json:"active_conns"`
+	// Queued is the number of requests waiting in the admission queue.
+	Queued int `json:"queued,omitempty"`
+	// Zone is lb's own zone (--zone); ZoneSpilling is set while selection
+	// spills to other zones (see locality.go).
+	Zone         string `json:"zone,omitempty"`
+	ZoneSpilling bool   `json:"zone_spilling,omitempty"`
+	// PanicMode is set while selection ignores health (see panic.go).
+	PanicMode bool `json:"panic_mode,omitempty"`
+	// CancellationRate is the share of the backends' requests their
+	// clients cancelled (see cancel.go).
+	CancellationRate float64 `json:"cancellation_rate"`
+	// OldestRequestMs is how long the oldest request in flight at a
+	// backend has been there; ReapedRequests counts the requests cut off
+	// by --max-request-age (see reaper.go).
+	OldestRequestMs float64 `json:"oldest_request_ms"`
+	ReapedRequests  uint64  `json:"reaped_requests"`
+	// Mirror is request mirroring, when enabled (see mirror.go).
+	Mirror *MirrorStats `json:"mirror,omitempty"`
+	// Hedging is request hedging, when enabled (see hedge.go).
+	Hedging *HedgeStats `json:"hedging,omitempty"`
+	// BodyReplay is request body recording, when enabled (see replay.go).
+	BodyReplay *BodyReplayStats `json:"body_replay,omitempty"`
+	// HeaderRouting counts requests per header route, when configured (see
+	// headerroute.go).
+	HeaderRouting *HeaderRoutingStats `json:"header_routing,omitempty"`
+	// Chaos is failure injection, shared by all pools, while it has rules
+	// or once it has injected (see chaos.go).
+	Chaos *ChaosStats `json:"chaos,omitempty"`
+	// Shedding is load shedding, shared by all pools, when enabled (see
+	// shed.go).
+	Shedding *ShedStats `json:"shedding,omitempty"`
+	// Priorities is request priorities, when enabled (see reqpriority.go).
+	Priorities *PriorityStats `json:"priorities,omitempty"`
+	// PrefixHash counts prefix-hash routing decisions, in that mode (see
+	// prefixhash.go).
+	PrefixHash *PrefixHashStats `json:"prefix_hash,omitempty"`
+	// ActiveTier is the priority tier new requests are served from, when
+	// backends have different priorities.
+	ActiveTier *int           `json:"active_tier,omitempty"`
+	Backends   []BackendStats `json:"backends"`
+}
+
+// BackendStats is one backend's entry in PoolStats.
+type BackendStats struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	// State summarizes selectability: "healthy", "slow-start", "at capacity"
+	// (selectable, but every slot taken or over its max_mbps=), "unknown"
+	// (selectable, not yet health checked), "blackholed (chaos)" (see
+	// chaos.go), "draining" (for maintenance), "ejected", "degraded",
+	// "restarting (expected)", "starting" or "unhealthy".
+	State string `json:"state"`
+	// HealthyFor or UnhealthyFor is the time since the backend's health last
+	// changed, Reason why it did (see transition.go).
+	HealthyFor   string `json:"healthy_for,omitempty"`
+	UnhealthyFor string `json:"unhealthy_for,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	// Priority is the backend's tier (see priority.go).
+	Priority    int `json:"priority,omitempty"`
+	ActiveConns int `json:"active_conns"`
+	// MaxConns is the backend's own max_conns, if it has one.
+	MaxConns int `json:"max_conns,omitempty"`
+	// Traffic is the bytes the backend was sent and sent back, and its
+	// throughput (see bandwidth.go).
+	Traffic TrafficStats `json:"traffic"`
+	// Prefix is the backend's prefix= (see pathrewrite.go).
+	Prefix string `json:"prefix,omitempty"`
+	// HealthURL is the URL health checks probe (see healthcheck.go).
+	HealthURL string `json:"health_url"`
+	// Share is a discovered backend's selection weight from its SRV weight,
+	// relative to the heaviest target (see discovery.go).
+	Share float64 `json:"share,omitempty"`
+	// Requests is the total number of requests sent to the backend.
+	Requests uint64 `json:"requests"`
+	// LatencyEWMAMs is the smoothed time to response headers.
+	LatencyEWMAMs float64    `json:"latency_ewma_ms"`
+	Ejected       bool       `json:"ejected"`
+	EjectedUntil  *time.Time `json:"ejected_until,omitempty"`
+	Ejections     uint64     `json:"ejections"`
+	// Responses counts final upstream responses by status class ("2xx",
+	// "3xx", ...); responses lb generates itself (502 on proxy error) are not
+	// included.
+	Responses map[string]uint64 `json:"responses,omitempty"`
+	// HeaderLimitViolations counts responses over the response header
+	// limits (truncated or rejected).
+	HeaderLimitViolations uint64 `json:"header_limit_violations,omitempty"`
+	// Timeout is the backend's own timeout; Timeouts counts requests that
+	// ran out of time at it (see timeout.go).
+	Timeout  string `json:"timeout,omitempty"`
+	Timeouts uint64 `json:"timeouts,omitempty"`
+	// ConnLimit is the adaptive concurrency limit (see adaptive.go).
+	ConnLimit *ConnLimitStats `json:"conn_limit,omitempty"`
+	// TokensPerSec is the decaying rate of reported usage tokens in
+	// least-tokens routing mode (see tokenload.go).
+	TokensPerSec *float64 `json:"tokens_per_sec,omitempty"`
+	// ReportedLoad is the backend's last fresh report in
+	// least-reported-load routing mode (see reportedload.go).
+	ReportedLoad *float64 `json:"reported_load,omitempty"`
+	// OutstandingBytes is the response bytes the backend still has in
+	// flight in outstanding-bytes routing mode (see outbytes.go).
+	OutstandingBytes *int64 `json:"outstanding_bytes,omitempty"`
+	// FailureMemory is the backend's decaying failure score and the
+	// selection weight it leaves (see failmemory.go).
+	FailureMemory *FailureMemoryStats `json:"failure_memory,omitempty"`
+	// Streak is the backend's consecutive strikes and passing checks
+	// against its health thresholds (see hysteresis.go).
+	Streak HealthStreakStats `json:"streak"`
+	// ProbeLatency is the backend's recent health check durations (see
+	// probelatency.go).
+	ProbeLatency *ProbeLatencyStats `json:"probe_latency,omitempty"`
+	// Connections is the backend's connection churn (see connrotate.go).
+	Connections *ConnStats `json:"connections,omitempty"`
+	// Latency is the distribution of the backend's request durations, from
+	// arrival to the end of the response (see latency.go).
+	Latency *LatencyStats `json:"latency,omitempty"`
+	// Cancelled is the requests their clients cancelled, by how long the
+	// backend had been serving them (see cancel.go).
+	Cancelled *LatencyStats `json:"cancelled,omitempty"`
+	// Labels are the backend's key=value attributes (see locality.go).
+	Labels map[string]string `json:"labels,omitempty"`
+	// Degraded is why the backend's request decorator last failed (see
+	// decorator.go).
+	Degraded string `json:"degraded,omitempty"`
+	// DiscoveredBy is the "dns+" spec that added the backend (see
+	// discovery.go).
+	DiscoveredBy string `json:"discovered_by,omitempty"`
+	// StartupFailed is set when the backend did not become ready within its
+	// startup grace, until it does (see startup.go).
+	StartupFailed bool `json:"startup_failed,omitempty"`
+	// DrainSignalled is set while the backend is drained by its drain
+	// signal (see drainsignal.go).
+	DrainSignalled bool `json:"drain_signalled,omitempty"`
+	// HealthSource says what decided Healthy: "probe" (health checks,
+	// failed requests and peers) or "manual" (an override, until
+	// ManualUntil; see override.go).
+	HealthSource string     `json:"health_source"`
+	ManualUntil  *time.Time `json:"manual_until,omitempty"`
+}
+
+// stateLocked returns the backend's State for stats and status logging;
+// maxConns is the pool's. Caller must hold b.mu.
+func (b *Backend) stateLocked(now time.Time, slowStart time.Duration, maxConns int) string {
+	weight := b.slowStartWeightLocked(now, slowStart)
+	switch {
+	case b.drained, b.signalDrained:
+		return "draining"
+	case b.restartingLocked(now):
+		return "restarting (expected)"
+	case b.starting:
+		return "starting"
+	case !b.healthy:
+		return "unhealthy"
+	case b.degraded != "":
+		return "degraded"
+	case b.ejected:
+		return "ejected"
+	}
+	if limit := b.connCap(maxConns); limit > 0 && b.GetActiveConns() >= slowStartCap(limit, weight*b.shareLocked()*b.weightMultiplier()) {
+		return "at capacity"
+	}
+	if b.overBandwidth(now) {
+		return "at capacity"
+	}
+	if b.unknownLocked() {
+		return "unknown"
+	}
+	if weight < 1 {
+		return "slow-start"
+	}
+	return "healthy"
+}
+
+// Stats returns a point-in-time snapshot of the pool for /stats.
+func (p *Pool) Stats() PoolStats {
+	now := p.clock.Now()
+	backends := p.GetBackends()
+	s := PoolStats{
+		TotalBackends:    len(backends),
+		Queued:           p.QueueDepth(),
+		Zone:             p.zone,
+		ZoneSpilling:     p.zoneSpilling.Load(),
+		PanicMode:        p.panicking.Load(),
+		CancellationRate: cancellationRate(backends),
+		OldestRequestMs:  float64(p.oldestRequest(now)) / float64(time.Millisecond),
+		ReapedRequests:   p.tracker.reaped.Load(),
+		Priorities:       p.priorityStats(),
+		Backends:         make([]BackendStats, 0, len(backends)),
+	}
+	if p.mirror != nil {
+		s.Mirror = p.mirror.stats()
+	}
+	if p.hedge != nil {
+		s.Hedging = p.hedge.stats()
+	}
+	if p.replay != nil {
+		s.BodyReplay = p.replay.stats()
+	}
+	if p.shedder != nil {
+		s.Shedding = p.shedder.stats()
+	}
+	if p.chaos != nil {
+		s.Chaos = p.chaos.stats()
+	}
+	if p.headerRoutes != nil {
+		s.HeaderRouting = p.headerRoutes.stats()
+	}
+	if p.prefixHash != nil {
+		s.PrefixHash = p.prefixHash.stats()
+	}
+	if p.tiered.Load() {
+		tier := int(p.activeTier.Load())
+		s.ActiveTier = &tier
+	}
+	for _, b := range backends {
+		// Counters are atomics; the state fields are copied under the
+		// backend lock, held for the copy only.
+		bs := BackendStats{
+			URL:                   b.ID(),
+			Priority:              b.priority,
+			ActiveConns:           b.GetActiveConns(),
+			MaxConns:              b.maxConns,
+			HealthURL:             p.shownHealthURL(b),
+			Requests:              b.TotalRequests(),
+			HeaderLimitViolations: b.headerViolations.Load(),
+			Timeouts:              b.timeouts.Load(),
+			Labels:                b.labels, // never modified
+			DiscoveredBy:          b.discoveredBy,
+			Prefix:                b.pathPrefix,
+		}
+		if b.timeout > 0 {
+			bs.Timeout = b.timeout.String()
+		}
+		for class := range b.responses {
+			if n := b.responses[class].Load(); n > 0 {
+				if bs.Responses == nil {
+					bs.Responses = make(map[string]uint64)
+				}
+				bs.Responses[strconv.Itoa(class)+"xx"] = n
+			}
+		}
+		if b.connLimit != nil {
+			bs.ConnLimit = b.connLimit.stats()
+		}
+		if b.tokens != nil {
+			rate := b.tokens.Rate(now)
+			bs.TokensPerSec = &rate
+		}
+		if b.outBytes != nil {
+			n := b.outBytes.Load()
+			bs.OutstandingBytes = &n
+		}
+		if b.failMem != nil {
+			bs.FailureMemory = b.failMem.stats(now)
+		}
+		bs.Connections = b.connStats()
+		bs.Latency = b.latency.stats()
+		bs.Cancelled = b.cancelled.stats()
+		bs.Traffic = b.trafficStats(now)
+		if p.reported != nil {
+			if load, ok := p.reported.reportOf(b, now); ok {
+				bs.ReportedLoad = &load
+			}
+		}
+		b.mu.Lock()
+		bs.Healthy = b.healthy
+		if b.healthy {
+			bs.HealthyFor = age(now.Sub(b.changedAt))
+		} else {
+			bs.UnhealthyFor = age(now.Sub(b.changedAt))
+		}
+		bs.Reason = b.changeReason
+		bs.Streak = b.streakStatsLocked()
+		bs.ProbeLatency = b.probeLatencyStatsLocked()
+		bs.Share = b.share
+		bs.LatencyEWMAMs = float64(b.latencyEWMA) / float64(time.Millisecond)
+		bs.Ejected = b.ejected
+		bs.Ejections = b.ejections
+		bs.State = b.stateLocked(now, p.slowStart, p.maxConns)
+		if p.chaos.blackholed(b, false) {
+			bs.State = "blackholed (chaos)"
+		}
+		bs.Degraded = b.degraded
+		bs.StartupFailed = b.startupFailed
+		bs.DrainSignalled = b.signalDrained
+		bs.HealthSource = b.healthSourceLocked(now)
+		if b.overriddenLocked(now) {
+			until := b.manualUntil
+			bs.ManualUntil = &until
+		}
+		if b.ejected {
+			until := b.ejectedUntil
+			bs.EjectedUntil = &until
+		}
+		b.mu.Unlock()
+
+		if bs.Healthy {
+			s.HealthyBackends++
+		}
+		s.ActiveConns += bs.ActiveConns
+		s.Backends = append(s.Backends, bs)
+	}
+	return s
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemd integration (--listen systemd): with socket activation systemd
+// binds lb's sockets and passes them in as file descriptors 3 and up
+// (LISTEN_FDS, LISTEN_PID, LISTEN_FDNAMES), so a restart never closes them:
+// connections made while lb restarts wait in the socket's backlog instead of
+// being refused. SystemdListeners turns the descriptors into listeners.
+// A Type=notify service is told over $NOTIFY_SOCKET, a unix datagram
+// socket, when it is ready (READY=1, after the initial health checks), when
+// it is stopping (STOPPING=1), and, under WatchdogSec, that it is alive
+// (WATCHDOG=1 every half of the watchdog interval). Both speak the
+// protocol directly; no libsystemd, no cgo.
+
+// systemdFirstFD is the first descriptor systemd passes.
+const systemdFirstFD = 3
+
+// ErrNotSocketActivated is returned by SystemdListeners when systemd passed
+// this process no sockets.
+var ErrNotSocketActivated = errors.New("not socket-activated: LISTEN_FDS is not set for this process; start lb from a systemd .socket unit, or listen on an address")
+
+// SystemdListener is a socket passed by systemd, with its
+// FileDescriptorName ("" when the unit names none).
+type SystemdListener struct {
+	net.Listener
+	Name string
+}
+
+// SystemdListeners returns the sockets systemd passed to this process, in
+// order, and unsets the LISTEN_* variables so child processes do not take
+// them for their own. It returns ErrNotSocketActivated when there are none
+// (or they were meant for another process).
+func SystemdListeners() ([]SystemdListener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, ErrNotSocketActivated
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	list := make([]int, n)
+	for i := range list {
+		list[i] = systemdFirstFD + i
+	}
+	var nameList []string
+	if names != "" {
+		nameList = strings.Split(names, ":")
+	}
+	return listenersFromFDs(list, nameList)
+}
+
+// listenersFromFDs returns a listener for each of fds, named by names in
+// order. The descriptors are closed, the listeners holding copies; on error
+// every one is.
+func listenersFromFDs(fds []int, names []string) ([]SystemdListener, error) {
+	listeners := make([]SystemdListener, 0, len(fds))
+	fail := func(err error) ([]SystemdListener, error) {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	for i, fd := range fds {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		accepting, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+		if err != nil {
+			return fail(fmt.Errorf("systemd socket fd %d: %w", fd, err))
+		}
+		if accepting == 0 {
+			return fail(fmt.Errorf("systemd socket fd %d is not a listening socket: want a stream socket with Accept=no", fd))
+		}
+		f := os.NewFile(uintptr(fd), "systemd:"+name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fail(fmt.Errorf("systemd socket fd %d: %w", fd, err))
+		}
+		listeners = append(listeners, SystemdListener{Listener: ln, Name: name})
+	}
+	return listeners, nil
+}
+
+// SdNotifier sends service state changes to systemd. A nil *SdNotifier
+// (no $NOTIFY_SOCKET) does nothing.
+type SdNotifier struct {
+	addr *net.UnixAddr
+}
+
+// NewSdNotifier returns a notifier for $NOTIFY_SOCKET, or nil when systemd
+// set none (not a Type=notify service).
+func NewSdNotifier() *SdNotifier {
+	return newSdNotifier(os.Getenv("NOTIFY_SOCKET"))
+}
+
+// newSdNotifier returns a notifier for the socket at path; "@" starts an
+// abstract socket name.
+func newSdNotifier(path string) *SdNotifier {
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	return &SdNotifier{addr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+}
+
+// Notify sends state, newline-separated assignments such as "READY=1".
+func (n *SdNotifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// Ready tells systemd the service is up, with a status line for
+// systemctl status.
+func (n *SdNotifier) Ready(status string) error {
+	return n.Notify("READY=1\nSTATUS=" + status)
+}
+
+// Stopping tells systemd the service is shutting down.
+func (n *SdNotifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// SystemdWatchdog returns the unit's WatchdogSec, if set for this process.
+func SystemdWatchdog() (time.Duration, bool) {
+	usec, pid := os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Microsecond, true
+}
+
+// Watchdog sends WATCHDOG=1 every half of interval until ctx is done, so
+// systemd restarts lb if it stops answering. Run it in a goroutine of its
+// own.
+func (n *SdNotifier) Watchdog(ctx context.Context, interval time.Duration, logger Logger) {
+	if n == nil {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if err := n.Notify("WATCHDOG=1"); err != nil {
+			logger.Printf("[SYSTEMD] watchdog ping failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
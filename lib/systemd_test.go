@@ -0,0 +1,231 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket listens where systemd's notify socket would be and
+// returns the datagrams it receives.
+func fakeNotifySocket(t *testing.T, path string) <-chan string {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return msgs
+}
+
+func recvNotify(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+		return ""
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	msgs := fakeNotifySocket(t, path)
+	t.Setenv("NOTIFY_SOCKET", path)
+	n := NewSdNotifier()
+	if n == nil {
+		t.Fatal("no notifier with NOTIFY_SOCKET set")
+	}
+	if err := n.Ready("3/3 backends healthy"); err != nil {
+		t.Fatal(err)
+	}
+	if got := recvNotify(t, msgs); got != "READY=1\nSTATUS=3/3 backends healthy" {
+		t.Errorf("ready sent %q", got)
+	}
+	if err := n.Stopping(); err != nil {
+		t.Fatal(err)
+	}
+	if got := recvNotify(t, msgs); got != "STOPPING=1" {
+		t.Errorf("stopping sent %q", got)
+	}
+
+	// Without a socket, notifying does nothing.
+	t.Setenv("NOTIFY_SOCKET", "")
+	none := NewSdNotifier()
+	if none != nil || none.Ready("up") != nil || none.Stopping() != nil {
+		t.Error("notifier without NOTIFY_SOCKET")
+	}
+	if err := newSdNotifier(filepath.Join(t.TempDir(), "gone.sock")).Ready("up"); err == nil {
+		t.Error("notifying a missing socket succeeded")
+	}
+}
+
+func TestSdNotifyAbstractSocket(t *testing.T) {
+	name := "lb-test-notify-" + strconv.Itoa(os.Getpid())
+	msgs := fakeNotifySocket(t, "\x00"+name)
+	if err := newSdNotifier("@" + name).Stopping(); err != nil {
+		t.Skipf("abstract sockets unsupported: %v", err)
+	}
+	if got := recvNotify(t, msgs); got != "STOPPING=1" {
+		t.Errorf("sent %q", got)
+	}
+}
+
+func TestSdWatchdog(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "40000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	interval, ok := SystemdWatchdog()
+	if !ok || interval != 40*time.Millisecond {
+		t.Fatalf("watchdog %v, %v", interval, ok)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if _, ok := SystemdWatchdog(); ok {
+		t.Error("another process's watchdog applied")
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if _, ok := SystemdWatchdog(); ok {
+		t.Error("watchdog without WATCHDOG_USEC")
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	msgs := fakeNotifySocket(t, path)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newSdNotifier(path).Watchdog(ctx, interval, &lineLogger{})
+	}()
+	for range 3 {
+		if got := recvNotify(t, msgs); got != "WATCHDOG=1" {
+			t.Fatalf("sent %q", got)
+		}
+	}
+	cancel()
+	<-done
+}
+
+// listenerFD returns a descriptor of a new listening TCP socket, owned by
+// the caller like one systemd passes.
+func listenerFD(t *testing.T) (int, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, ln.Addr().String()
+}
+
+func TestListenersFromFDs(t *testing.T) {
+	fd1, addr1 := listenerFD(t)
+	fd2, addr2 := listenerFD(t)
+	listeners, err := listenersFromFDs([]int{fd1, fd2}, []string{"http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	if len(listeners) != 2 || listeners[0].Name != "http" || listeners[1].Name != "" {
+		t.Fatalf("listeners %+v", listeners)
+	}
+	for i, addr := range []string{addr1, addr2} {
+		if got := listeners[i].Addr().String(); got != addr {
+			t.Errorf("listener %d on %s, want %s", i, got, addr)
+		}
+	}
+	// The passed socket accepts connections.
+	go func() {
+		if conn, err := listeners[0].Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	conn.Close()
+}
+
+func TestListenersFromFDsRejects(t *testing.T) {
+	// A connected socket pair is a socket, but not a listening one.
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pair[0])
+	defer syscall.Close(pair[1])
+	fd, addr := listenerFD(t)
+	if _, err := listenersFromFDs([]int{fd, pair[0]}, nil); err == nil {
+		t.Fatal("socketpair fd accepted as a listener")
+	}
+	// The listener taken before the failure was closed again.
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("listener still accepting after a failed call")
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := listenersFromFDs([]int{int(f.Fd())}, nil); err == nil {
+		t.Error("regular file accepted as a listener")
+	}
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "")
+	if _, err := SystemdListeners(); !errors.Is(err, ErrNotSocketActivated) {
+		t.Errorf("unset: %v", err)
+	}
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", "1")
+	if _, err := SystemdListeners(); !errors.Is(err, ErrNotSocketActivated) {
+		t.Errorf("another process's sockets: %v", err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS left set")
+	}
+	t.Setenv("LISTEN_FDS", "x")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	if _, err := SystemdListeners(); err == nil || errors.Is(err, ErrNotSocketActivated) {
+		t.Errorf("invalid LISTEN_FDS: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Tenant routing (config "tenant_routing"): each tenant is served by a pool
+// of its own, picked by API key before any path route. A request's tenant
+// is the one with the longest key prefix its bearer key starts with, else,
+// with a header configured, the tenant that header names — trust it only
+// behind a gateway that sets it. The header names only tenants without key
+// prefixes, so it cannot claim a keyed tenant's pool, whatever key the
+// request carries (if any). The tenant's pool serves every path, and
+// only that pool: with none of its backends healthy the tenant gets the
+// pool's 503, never another tenant's backends. Requests mapped to no
+// tenant make up the shared "default" group, served by the path routes and
+// default pool as without tenant routing, or are refused with 403 in strict
+// mode. Routing runs after API key validation (see apikeys.go). Requests,
+// their 5xx responses and those in flight are counted per tenant, in /stats
+// and on their own at /stats?tenant=NAME. A backend in several tenants'
+// pools is probed once for all of them (see probeshare.go).
+
+// TenantDefault is the tenant of requests mapped to no tenant.
+const TenantDefault = "default"
+
+// TenantRoutingConfig is the config file's "tenant_routing".
+type TenantRoutingConfig struct {
+	// Tenants are the tenants by name.
+	Tenants map[string]TenantRouteConfig `json:"tenants"`
+	// Header names the request header carrying the name of a tenant without
+	// key prefixes, for requests whose key matches no prefix.
+	Header string `json:"header"`
+	// Strict refuses requests mapped to no tenant instead of serving them
+	// from the default group.
+	Strict bool `json:"strict"`
+}
+
+// TenantRouteConfig is one tenant of tenant routing.
+type TenantRouteConfig struct {
+	// Pool is the pool serving the tenant.
+	Pool string `json:"pool"`
+	// KeyPrefixes are prefixes of the tenant's API keys (Authorization:
+	// Bearer).
+	KeyPrefixes []string `json:"key_prefixes"`
+}
+
+// validate checks c against the config's pools. A pool serves at most one
+// tenant, so its stats are the tenant's alone.
+func (c *TenantRoutingConfig) validate(pools map[string]PoolConfig) error {
+	if len(c.Tenants) == 0 {
+		return errors.New("at least one tenant is required")
+	}
+	if http.CanonicalHeaderKey(c.Header) == "Authorization" {
+		return errors.New("header cannot be Authorization: keys map to tenants by key_prefixes")
+	}
+	prefixes := make(map[string]string)
+	byPool := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(c.Tenants)) {
+		tc := c.Tenants[name]
+		if name == TenantDefault || name == "" {
+			return fmt.Errorf("tenant name %q is reserved for requests mapped to no tenant", name)
+		}
+		if _, ok := pools[tc.Pool]; !ok {
+			return fmt.Errorf("tenant %q: unknown pool %q", name, tc.Pool)
+		}
+		if other, dup := byPool[tc.Pool]; dup {
+			return fmt.Errorf("tenants %q and %q share pool %q", other, name, tc.Pool)
+		}
+		byPool[tc.Pool] = name
+		if len(tc.KeyPrefixes) == 0 && c.Header == "" {
+			return fmt.Errorf("tenant %q: at least one key prefix is required without a header", name)
+		}
+		for _, p := range tc.KeyPrefixes {
+			if p == "" {
+				return fmt.Errorf("tenant %q: empty key prefix", name)
+			}
+			if other, dup := prefixes[p]; dup {
+				return fmt.Errorf("tenants %q and %q share key prefix %q", other, name, p)
+			}
+			prefixes[p] = name
+		}
+	}
+	return nil
+}
+
+// TenantRouter sends each tenant's requests to its pool.
+type TenantRouter struct {
+	tenants  map[string]*tenantGroup
+	prefixes []tenantPrefix // longest first
+	header   string
+	// byHeader are the tenants without key prefixes, which header names
+	byHeader map[string]*tenantGroup
+	strict   bool
+	// unmapped is the default group
+	unmapped *tenantGroup
+	// errorFormat is how strict mode's 403 is written (see apierror.go)
+	errorFormat ErrorFormat
+}
+
+type tenantPrefix struct {
+	prefix string
+	group  *tenantGroup
+}
+
+type tenantGroup struct {
+	name     string
+	poolName string
+	pool     *Pool // nil for the default group
+	// requests counts the requests the group served, errors their 5xx
+	// responses, active those in flight, and rejected the requests strict
+	// mode refused (default group only)
+	requests, errors, rejected atomic.Uint64
+	active                     atomic.Int64
+}
+
+// NewTenantRouter builds a tenant router from cfg over the named pools.
+func NewTenantRouter(cfg TenantRoutingConfig, pools map[string]*Pool) (*TenantRouter, error) {
+	t := &TenantRouter{
+		tenants:  make(map[string]*tenantGroup, len(cfg.Tenants)),
+		header:   cfg.Header,
+		byHeader: make(map[string]*tenantGroup),
+		strict:   cfg.Strict,
+		unmapped: &tenantGroup{name: TenantDefault},
+	}
+	for name, tc := range cfg.Tenants {
+		pool, ok := pools[tc.Pool]
+		if !ok {
+			return nil, fmt.Errorf("tenant %q: unknown pool %q", name, tc.Pool)
+		}
+		g := &tenantGroup{name: name, poolName: tc.Pool, pool: pool}
+		t.tenants[name] = g
+		if len(tc.KeyPrefixes) == 0 {
+			t.byHeader[name] = g
+		}
+		for _, p := range tc.KeyPrefixes {
+			t.prefixes = append(t.prefixes, tenantPrefix{p, g})
+		}
+	}
+	slices.SortFunc(t.prefixes, func(a, b tenantPrefix) int {
+		return cmp.Or(len(b.prefix)-len(a.prefix), strings.Compare(a.prefix, b.prefix))
+	})
+	return t, nil
+}
+
+// SetErrorFormat sets how strict mode's 403 is written (default openai).
+// Call before serving traffic.
+func (t *TenantRouter) SetErrorFormat(f ErrorFormat) {
+	t.errorFormat = f
+}
+
+// resolve returns r's tenant group, nil when r is mapped to none.
+func (t *TenantRouter) resolve(r *http.Request) *tenantGroup {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = strings.TrimSpace(key)
+		for _, p := range t.prefixes {
+			if strings.HasPrefix(key, p.prefix) {
+				return p.group
+			}
+		}
+	}
+	if t.header != "" {
+		return t.byHeader[strings.TrimSpace(r.Header.Get(t.header))]
+	}
+	return nil
+}
+
+// Handler wraps next, the path routes, with tenant routing: next serves
+// the default group.
+func (t *TenantRouter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g := t.resolve(r)
+		if g == nil && t.strict {
+			t.unmapped.rejected.Add(1)
+			apiError{http.StatusForbidden, errTypePermission, "unknown_tenant", "No tenant is mapped to this API key.", nil}.write(w, r, t.errorFormat)
+			return
+		}
+		target := next
+		if g == nil {
+			g = t.unmapped
+		} else {
+			target = g.pool
+		}
+		g.requests.Add(1)
+		g.active.Add(1)
+		defer g.active.Add(-1)
+		sw := &statusWriter{ResponseWriter: w}
+		target.ServeHTTP(sw, r)
+		if sw.status >= 500 {
+			g.errors.Add(1)
+		}
+	})
+}
+
+// TenantStats is one tenant's entry in /stats. ErrorRate is Errors over
+// Requests; Active is requests in flight.
+type TenantStats struct {
+	Tenant    string  `json:"tenant"`
+	Pool      string  `json:"pool,omitempty"`
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Active    int64   `json:"active"`
+	Rejected  uint64  `json:"rejected,omitempty"`
+}
+
+func (g *tenantGroup) stats() TenantStats {
+	s := TenantStats{Tenant: g.name, Pool: g.poolName, Requests: g.requests.Load(), Errors: g.errors.Load(), Active: g.active.Load(), Rejected: g.rejected.Load()}
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	}
+	return s
+}
+
+// Stats returns every tenant by name, then the default group.
+func (t *TenantRouter) Stats() []TenantStats {
+	out := make([]TenantStats, 0, len(t.tenants)+1)
+	for _, name := range slices.Sorted(maps.Keys(t.tenants)) {
+		out = append(out, t.tenants[name].stats())
+	}
+	return append(out, t.unmapped.stats())
+}
+
+// Tenant returns one tenant's stats and its pool (nil for the default
+// group), or false for an unknown tenant.
+func (t *TenantRouter) Tenant(name string) (TenantStats, *Pool, bool) {
+	if name == TenantDefault {
+		return t.unmapped.stats(), nil, true
+	}
+	g, ok := t.tenants[name]
+	if !ok {
+		return TenantStats{}, nil, false
+	}
+	return g.stats(), g.pool, true
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// tenantSetup serves pools "a", "b" and "shared", one mock backend each,
+// pools "a" and "b" for tenants acme and globex and "shared" for the rest.
+func tenantSetup(t *testing.T, cfg TenantRoutingConfig) (*TenantRouter, http.Handler, map[string]*mockbackend.Server) {
+	t.Helper()
+	mocks := make(map[string]*mockbackend.Server)
+	pools := make(map[string]*Pool)
+	configs := make(map[string]PoolConfig)
+	for _, name := range []string{"a", "b", "shared"} {
+		mocks[name] = mockbackend.Start(t, mockbackend.DefaultConfig())
+		pool, err := NewPool([]string{mocks[name].URL}, WithLogger(&lineLogger{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools[name] = pool
+		configs[name] = PoolConfig{Backends: []string{mocks[name].URL}}
+	}
+	if cfg.Tenants == nil {
+		cfg.Tenants = map[string]TenantRouteConfig{
+			"acme":   {Pool: "a", KeyPrefixes: []string{"sk-acme-"}},
+			"globex": {Pool: "b", KeyPrefixes: []string{"sk-glx-", "sk-acme-glx-"}},
+		}
+	}
+	if err := cfg.validate(configs); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewTenantRouter(cfg, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, tr.Handler(pools["shared"]), mocks
+}
+
+func tenantRequest(h http.Handler, key string, header map[string]string) int {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}]}`))
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestTenantRoutingIsolation(t *testing.T) {
+	tr, h, mocks := tenantSetup(t, TenantRoutingConfig{})
+	for range 5 {
+		tenantRequest(h, "sk-acme-1", nil)
+	}
+	for range 3 {
+		tenantRequest(h, "sk-glx-1", nil)
+	}
+	// The longer prefix wins.
+	tenantRequest(h, "sk-acme-glx-2", nil)
+	tenantRequest(h, "sk-other", nil)
+	tenantRequest(h, "", nil)
+	for name, want := range map[string]uint64{"a": 5, "b": 4, "shared": 2} {
+		if got := mocks[name].Stats().Requests; got != want {
+			t.Errorf("pool %s backend served %d requests, want %d", name, got, want)
+		}
+	}
+
+	// With its backend down, acme gets 503 rather than anyone else's.
+	mocks["a"].SetMode(mockbackend.ModeFailing)
+	for range 2 {
+		tenantRequest(h, "sk-acme-1", nil)
+	}
+	if got := mocks["b"].Stats().Requests + mocks["shared"].Stats().Requests; got != 6 {
+		t.Errorf("acme's failed requests reached other backends: %d requests there", got)
+	}
+
+	stats := tr.Stats()
+	want := []TenantStats{
+		{Tenant: "acme", Pool: "a", Requests: 7, Errors: 2, ErrorRate: 2.0 / 7},
+		{Tenant: "globex", Pool: "b", Requests: 4},
+		{Tenant: TenantDefault, Requests: 2},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("stats %+v", stats)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("stats[%d] = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+	if s, pool, ok := tr.Tenant("globex"); !ok || pool == nil || s.Requests != 4 {
+		t.Errorf("tenant globex: %+v, pool %v, %v", s, pool, ok)
+	}
+	if _, _, ok := tr.Tenant("initech"); ok {
+		t.Error("unknown tenant found")
+	}
+}
+
+func TestTenantRoutingStrictAndHeader(t *testing.T) {
+	tr, h, mocks := tenantSetup(t, TenantRoutingConfig{
+		Tenants: map[string]TenantRouteConfig{
+			"acme":   {Pool: "a", KeyPrefixes: []string{"sk-acme-"}},
+			"globex": {Pool: "b"},
+		},
+		Header: "X-Tenant",
+		Strict: true,
+	})
+	if code := tenantRequest(h, "sk-other", nil); code != http.StatusForbidden {
+		t.Errorf("unmapped key: %d, want 403", code)
+	}
+	if code := tenantRequest(h, "", map[string]string{"X-Tenant": "initech"}); code != http.StatusForbidden {
+		t.Errorf("unknown tenant header: %d, want 403", code)
+	}
+	if code := tenantRequest(h, "", map[string]string{"X-Tenant": "globex"}); code != http.StatusOK {
+		t.Errorf("tenant header: %d", code)
+	}
+	// A key's prefix wins over the header.
+	if code := tenantRequest(h, "sk-acme-1", map[string]string{"X-Tenant": "globex"}); code != http.StatusOK {
+		t.Errorf("acme key: %d", code)
+	}
+	if a, b, shared := mocks["a"].Stats().Requests, mocks["b"].Stats().Requests, mocks["shared"].Stats().Requests; a != 1 || b != 1 || shared != 0 {
+		t.Errorf("requests a %d, b %d, shared %d", a, b, shared)
+	}
+	if s, _, _ := tr.Tenant(TenantDefault); s.Rejected != 2 || s.Requests != 0 {
+		t.Errorf("default group %+v", s)
+	}
+}
+
+// The header cannot claim a tenant mapped by key: without a key, with an
+// unmapped one, or in strict mode, naming acme gets the default group.
+func TestTenantRoutingHeaderCannotReachKeyedTenant(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		tr, h, mocks := tenantSetup(t, TenantRoutingConfig{
+			Tenants: map[string]TenantRouteConfig{
+				"acme":   {Pool: "a", KeyPrefixes: []string{"sk-acme-"}},
+				"globex": {Pool: "b"},
+			},
+			Header: "X-Tenant",
+			Strict: strict,
+		})
+		want := http.StatusOK
+		if strict {
+			want = http.StatusForbidden
+		}
+		for _, key := range []string{"", "sk-other"} {
+			if code := tenantRequest(h, key, map[string]string{"X-Tenant": "acme"}); code != want {
+				t.Errorf("strict %v, key %q, spoofed header: %d, want %d", strict, key, code, want)
+			}
+		}
+		if a := mocks["a"].Stats().Requests; a != 0 {
+			t.Errorf("strict %v: acme's pool served %d spoofed requests", strict, a)
+		}
+		if s, _, _ := tr.Tenant("acme"); s.Requests != 0 {
+			t.Errorf("strict %v: acme counted %+v", strict, s)
+		}
+	}
+}
+
+func TestTenantRoutingConfigValidate(t *testing.T) {
+	pools := map[string]PoolConfig{"a": {Backends: []string{"b1"}}, "b": {Backends: []string{"b2"}}}
+	for _, tt := range []struct {
+		cfg  TenantRoutingConfig
+		want string
+	}{
+		{TenantRoutingConfig{}, "at least one tenant"},
+		{TenantRoutingConfig{Tenants: map[string]TenantRouteConfig{"x": {Pool: "c", KeyPrefixes: []string{"k"}}}}, `unknown pool "c"`},
+		{TenantRoutingConfig{Tenants: map[string]TenantRouteConfig{"default": {Pool: "a", KeyPrefixes: []string{"k"}}}}, "reserved"},
+		{TenantRoutingConfig{Tenants: map[string]TenantRouteConfig{"x": {Pool: "a"}}}, "key prefix is required"},
+		{TenantRoutingConfig{Tenants: map[string]TenantRouteConfig{"x": {Pool: "a", KeyPrefixes: []string{"k"}}, "y": {Pool: "a", KeyPrefixes: []string{"j"}}}}, `share pool "a"`},
+		{TenantRoutingConfig{Tenants: map[string]TenantRouteConfig{"x": {Pool: "a", KeyPrefixes: []string{"k"}}, "y": {Pool: "b", KeyPrefixes: []string{"k"}}}}, `share key prefix "k"`},
+		{TenantRoutingConfig{Tenants: map[string]TenantRouteConfig{"x": {Pool: "a"}}, Header: "authorization"}, "cannot be Authorization"},
+	} {
+		if err := tt.cfg.validate(pools); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Per-request timeouts (--request-timeout, and "timeout" per route in the
+// config file): the deadline is a context deadline on the proxied request,
+// not the server's WriteTimeout, so a route serving long completions streams
+// can run for hours while every other route gets a short bound. A backend
+// given ",timeout=5s" (a fast embedding server) also bounds each request's
+// time at it, from when the request is sent there; whichever deadline comes
+// first ends the request. A request over its deadline is answered 504 (or
+// cut off mid-stream), counted in the backend's timeouts, and does not count
+// against its health. With --deadline-header the milliseconds left are sent
+// to the backend in that header, so it can give up on work nobody will
+// receive; a client's own value of the header is dropped.
+
+type requestTimeoutKey struct{}
+
+// errRequestTimeout is the context cause of a request over its timeout.
+var errRequestTimeout = errors.New("request timeout exceeded")
+
+// withRequestTimeout overrides the pool's request timeout for requests
+// carrying ctx.
+func withRequestTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey{}, d)
+}
+
+// SetRequestTimeout bounds each proxied request, queueing included
+// (0 = unlimited). Routes may override it. Call before serving traffic.
+func (p *Pool) SetRequestTimeout(d time.Duration) {
+	p.requestTimeout = d
+}
+
+// requestContext applies the route's or the pool's request timeout to ctx.
+func (p *Pool) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d := p.requestTimeout
+	if override, ok := ctx.Value(requestTimeoutKey{}).(time.Duration); ok {
+		d = override
+	}
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, d, errRequestTimeout)
+}
+
+// SetDeadlineHeader sends each proxied request's remaining time in ms to
+// the backend in the header name ("" = off). Call before serving traffic.
+func (p *Pool) SetDeadlineHeader(name string) {
+	p.deadlineHeader = http.CanonicalHeaderKey(name)
+	for _, b := range p.GetBackends() {
+		b.deadlineHeader = p.deadlineHeader
+	}
+}
+
+// requestContext applies the backend's timeout, if it has one, to ctx, and
+// ends it if the backend is retired (see replace.go).
+func (b *Backend) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(b.retired, func() { cancel(context.Cause(b.retired)) })
+	release := func() {
+		stop()
+		cancel(nil)
+	}
+	if b.timeout <= 0 {
+		return ctx, release
+	}
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, b.timeout, errRequestTimeout)
+	return ctx, func() {
+		cancelTimeout()
+		release()
+	}
+}
+
+// setDeadlineHeader replaces r's deadline header with the time left before
+// its context's deadline, or drops it without a deadline.
+func (b *Backend) setDeadlineHeader(r *http.Request) {
+	if b.deadlineHeader == "" {
+		return
+	}
+	r.Header.Del(b.deadlineHeader)
+	if deadline, ok := r.Context().Deadline(); ok {
+		r.Header.Set(b.deadlineHeader, strconv.FormatInt(max(0, time.Until(deadline).Milliseconds()), 10))
+	}
+}
+
+// Timeouts returns how many requests to the backend ran out of time.
+func (b *Backend) Timeouts() uint64 {
+	return b.timeouts.Load()
+}
+
+// requestElapsed is how long r has been at the backend at now, for logging.
+func requestElapsed(r *http.Request, now time.Time) time.Duration {
+	start, ok := r.Context().Value(proxyStartKey{}).(time.Time)
+	if !ok {
+		return 0
+	}
+	return now.Sub(start).Round(time.Millisecond)
+}
+
+// timedOut reports whether ctx ended because its request timeout expired.
+func timedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRequestTimeout)
+}
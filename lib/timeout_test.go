@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteRequestTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			_, _ = w.Write([]byte(`{}`))
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	rt, pools := newTestRouter(t, []RouteConfig{
+		{ID: "completions", Prefix: "/v1/completions", Targets: []RouteTarget{{Pool: "llm", Weight: 1}}, Timeout: Duration(time.Hour)},
+		{ID: "rest", Prefix: "/", Targets: []RouteTarget{{Pool: "llm", Weight: 1}}},
+	}, map[string]string{"llm": slow.URL})
+	pool := pools["llm"]
+	pool.SetRequestTimeout(50 * time.Millisecond)
+	lb := httptest.NewServer(rt)
+	defer lb.Close()
+	out := captureLog(t)
+
+	resp, err := http.Get(lb.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("short route: status %d, want 504", resp.StatusCode)
+	}
+	if !strings.Contains(out.String(), slow.URL+" request timed out after") {
+		t.Errorf("timeout not logged with the backend and elapsed time:\n%s", out)
+	}
+	if !pool.GetBackends()[0].IsHealthy() {
+		t.Error("a request timeout marked the backend unhealthy")
+	}
+
+	resp, err = http.Get(lb.URL + "/v1/completions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("long route: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestBackendTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+			_, _ = w.Write([]byte(`{}`))
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond) // longer than the slow backend's timeout
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer fast.Close()
+	pool, err := NewPool([]string{slow.URL + ",timeout=100ms", fast.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+	slowB, fastB := pool.GetBackends()[0], pool.GetBackends()[1]
+
+	codes := make(map[*Backend]int)
+	for _, b := range []*Backend{slowB, fastB} {
+		b.IncrementConns() // the slot proxy releases
+		rec := httptest.NewRecorder()
+		pool.proxy(rec, httptest.NewRequest(http.MethodGet, "/v1/embeddings", nil), b, 1)
+		codes[b] = rec.Code
+	}
+	if codes[slowB] != http.StatusGatewayTimeout || codes[fastB] != http.StatusOK {
+		t.Errorf("slow backend answered %d, fast %d; want 504 and 200", codes[slowB], codes[fastB])
+	}
+	if slowB.Timeouts() != 1 || fastB.Timeouts() != 0 {
+		t.Errorf("timeouts: slow %d, fast %d; want 1 and 0", slowB.Timeouts(), fastB.Timeouts())
+	}
+	if !slowB.IsHealthy() {
+		t.Error("a backend timeout marked the backend unhealthy")
+	}
+	if s := pool.Stats().Backends[0]; s.Timeout != "100ms" || s.Timeouts != 1 {
+		t.Errorf("stats: timeout %q, timeouts %d", s.Timeout, s.Timeouts)
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Request-Deadline-Ms")))
+	}))
+	defer srv.Close()
+	pool, err := NewPool([]string{srv.URL + ",timeout=2s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetDeadlineHeader("x-request-deadline-ms")
+	pool.SetRequestTimeout(time.Hour)
+	send := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		r.Header.Set("X-Request-Deadline-Ms", "99999999") // the client's is dropped
+		pool.ServeHTTP(rec, r)
+		return rec.Body.String()
+	}
+	// The backend's timeout ends first.
+	if ms, err := strconv.Atoi(send()); err != nil || ms <= 1000 || ms > 2000 {
+		t.Errorf("deadline header = %d ms, %v; want just under 2000", ms, err)
+	}
+
+	pool.GetBackends()[0].timeout = 0
+	pool.SetRequestTimeout(0)
+	if got := send(); got != "" {
+		t.Errorf("without a deadline the backend got %q, want no header", got)
+	}
+}
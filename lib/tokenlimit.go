@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token rate limits ("tenants" in the config file): each tenant, identified
+// by its API key, gets a token bucket per model holding one minute of its
+// tokens_per_minute. Admission debits an estimate — the request body's size
+// in bytes / 4 for the prompt, plus max_tokens (times n) for the completion —
+// and the request is refused with a 429 if the bucket can't cover it. When
+// the response ends, the estimate is replaced by the backend's reported
+// usage (usage.total_tokens; for streams the last chunk carrying usage, sent
+// when the client asks for stream_options.include_usage). Without reported
+// usage the estimate stands if the backend answered 2xx — a client that
+// aborts mid-stream still cost the tokens generated so far — and is refunded
+// otherwise, since a failed request generated nothing; a client retrying it
+// is charged once. Requests without a tenant key, or for a model the tenant
+// has no limit on, pass through unmetered.
+
+const (
+	// tokenBytesPerToken is the prompt estimate's bytes per token, on the
+	// low side so the estimate rarely falls short of actual usage.
+	tokenBytesPerToken = 4
+	// tokenDefaultMaxTokens is the completion estimate when a request sets
+	// no max_tokens.
+	tokenDefaultMaxTokens = 1024
+	// tokenMaxUsageBody bounds the non-streamed response body kept to read
+	// its usage.
+	tokenMaxUsageBody = 1 << 20 // 1 MiB
+	// tokenAnyModel in tokens_per_minute limits each model not listed.
+	tokenAnyModel = "*"
+)
+
+// TenantConfig is one tenant in the config file.
+type TenantConfig struct {
+	// Keys are the API keys (Authorization: Bearer) identifying the tenant.
+	Keys []string `json:"keys"`
+	// TokensPerMinute maps a model name to the tenant's token rate on it;
+	// "*" gives each model not listed its own bucket at that rate.
+	TokensPerMinute map[string]int64 `json:"tokens_per_minute"`
+}
+
+func (tc TenantConfig) validate() error {
+	if len(tc.Keys) == 0 {
+		return errors.New("at least one key is required")
+	}
+	if len(tc.TokensPerMinute) == 0 {
+		return errors.New("tokens_per_minute must limit at least one model")
+	}
+	for model, n := range tc.TokensPerMinute {
+		if n <= 0 {
+			return fmt.Errorf("tokens_per_minute for %q must be positive, got %d", model, n)
+		}
+	}
+	return nil
+}
+
+// TokenLimiter enforces per-tenant, per-model token rates.
+type TokenLimiter struct {
+	tenants map[string]*tokenTenant // by API key
+	clock   Clock
+
+	mu      sync.Mutex
+	buckets map[tokenBucketKey]*tokenBucket
+	// errorFormat is how rejections are written (see apierror.go)
+	errorFormat ErrorFormat
+}
+
+type tokenTenant struct {
+	name  string
+	rates map[string]int64
+}
+
+type tokenBucketKey struct{ tenant, model string }
+
+// tokenBucket holds up to one minute of tokens and refills continuously.
+// Debits over the actual usage can leave it negative: the debt is paid off
+// by refill before the tenant is admitted again.
+type tokenBucket struct {
+	rate   float64 // tokens per minute, also the capacity
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Minutes()*b.rate)
+	b.last = now
+}
+
+// NewTokenLimiter returns a limiter for the config file's tenants, which
+// LoadConfig has validated.
+func NewTokenLimiter(tenants map[string]TenantConfig, opts ...Option) *TokenLimiter {
+	l := &TokenLimiter{
+		tenants: make(map[string]*tokenTenant),
+		clock:   clockFrom(systemClock{}, opts),
+		buckets: make(map[tokenBucketKey]*tokenBucket),
+	}
+	for name, tc := range tenants {
+		t := &tokenTenant{name: name, rates: tc.TokensPerMinute}
+		for _, key := range tc.Keys {
+			l.tenants[key] = t
+		}
+	}
+	return l
+}
+
+// tokenRejection names the limit a request ran into.
+type tokenRejection struct {
+	tenant, model string
+	limit         int64
+	requested     int64
+	retryAfter    time.Duration // 0 when the request can never fit
+}
+
+// reserve debits estimate from the tenant's bucket for model, or reports
+// why it can't.
+func (l *TokenLimiter) reserve(t *tokenTenant, model string, estimate int64) (*tokenReservation, *tokenRejection) {
+	rate, ok := t.rates[model]
+	key := tokenBucketKey{t.name, model}
+	if !ok {
+		if rate, ok = t.rates[tokenAnyModel]; !ok {
+			return nil, nil // unmetered
+		}
+	}
+	if estimate > rate {
+		return nil, &tokenRejection{tenant: t.name, model: model, limit: rate, requested: estimate}
+	}
+
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens < float64(estimate) {
+		wait := time.Duration((float64(estimate) - b.tokens) / b.rate * float64(time.Minute))
+		return nil, &tokenRejection{tenant: t.name, model: model, limit: rate, requested: estimate, retryAfter: wait}
+	}
+	b.tokens -= float64(estimate)
+	return &tokenReservation{limiter: l, key: key, estimate: estimate}, nil
+}
+
+// tokenReservation is one admitted request's debit, settled exactly once.
+type tokenReservation struct {
+	limiter  *TokenLimiter
+	key      tokenBucketKey
+	estimate int64
+	settled  bool
+}
+
+// settle replaces the estimated debit with actual tokens.
+func (r *tokenReservation) settle(actual int64) {
+	if r.settled {
+		return
+	}
+	r.settled = true
+	l := r.limiter
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[r.key]
+	b.refill(now)
+	b.tokens = math.Min(b.rate, b.tokens+float64(r.estimate-actual))
+}
+
+// Handler wraps next with token rate limiting.
+func (l *TokenLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		t := l.tenants[token]
+		_, upload := streamingUpload(r)
+		if !ok || t == nil || r.Body == nil || r.Body == http.NoBody || upload {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, affinityMaxBody)
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, l.errorFormat, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(raw)), nil
+		}
+		r.ContentLength = int64(len(raw))
+
+		model, estimate, ok := estimateTokens(raw)
+		if !ok {
+			next.ServeHTTP(w, r) // not a completion request
+			return
+		}
+		res, rej := l.reserve(t, model, estimate)
+		if rej != nil {
+			rej.write(w, r, l.errorFormat)
+			return
+		}
+		if res == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		uw := &usageWriter{ResponseWriter: w}
+		defer func() { res.settle(uw.tokens(res.estimate)) }() // also on ErrAbortHandler panics
+		next.ServeHTTP(uw, r)
+	})
+}
+
+// estimateTokens returns a completion request's model and estimated token
+// cost. ok is false for bodies without a model.
+func estimateTokens(body []byte) (model string, estimate int64, ok bool) {
+	var req struct {
+		Model               string `json:"model"`
+		MaxTokens           *int64 `json:"max_tokens"`
+		MaxCompletionTokens *int64 `json:"max_completion_tokens"`
+		N                   int64  `json:"n"`
+	}
+	if json.Unmarshal(body, &req) != nil || req.Model == "" {
+		return "", 0, false
+	}
+	completion := int64(tokenDefaultMaxTokens)
+	if req.MaxCompletionTokens != nil {
+		completion = *req.MaxCompletionTokens
+	} else if req.MaxTokens != nil {
+		completion = *req.MaxTokens
+	}
+	if req.N > 1 {
+		completion *= req.N
+	}
+	prompt := (int64(len(body)) + tokenBytesPerToken - 1) / tokenBytesPerToken
+	return req.Model, prompt + max(completion, 0), true
+}
+
+func (rej *tokenRejection) write(w http.ResponseWriter, r *http.Request, f ErrorFormat) {
+	msg := fmt.Sprintf("Rate limit reached for tenant %s on model %s: tokens per minute (limit %d, requested %d).",
+		rej.tenant, rej.model, rej.limit, rej.requested)
+	if rej.retryAfter == 0 {
+		msg = fmt.Sprintf("Request too large for tenant %s on model %s: tokens per minute (limit %d, requested %d).",
+			rej.tenant, rej.model, rej.limit, rej.requested)
+	} else {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rej.retryAfter.Seconds()))))
+	}
+	apiError{
+		status:  http.StatusTooManyRequests,
+		typ:     "tokens",
+		code:    "rate_limit_exceeded",
+		message: msg,
+		fields: map[string]any{
+			"param":     "tokens_per_minute",
+			"tenant":    rej.tenant,
+			"model":     rej.model,
+			"limit":     rej.limit,
+			"requested": rej.requested,
+		},
+	}.write(w, r, f)
+}
+
+// usageWriter watches a response for the backend's reported token usage:
+// the whole body of a JSON response (up to tokenMaxUsageBody), or each
+// `data:` line of an SSE stream.
+type usageWriter struct {
+	http.ResponseWriter
+	status int
+	sse    bool
+	buf    []byte // JSON body so far, or the SSE stream's unfinished line
+	over   bool   // JSON body exceeded tokenMaxUsageBody
+	usage  int64  // last total_tokens seen in the stream (-1 = none)
+}
+
+func (w *usageWriter) WriteHeader(code int) {
+	if w.status == 0 && !isInterim(code) {
+		w.status = code
+		w.sse = strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+		w.usage = -1
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *usageWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.sse {
+		w.buf = append(w.buf, p...)
+		for {
+			i := bytes.IndexByte(w.buf, '\n')
+			if i < 0 {
+				break
+			}
+			if n, ok := usageTotal(bytes.TrimPrefix(bytes.TrimSpace(w.buf[:i]), []byte("data:"))); ok {
+				w.usage = n
+			}
+			w.buf = w.buf[i+1:]
+		}
+	} else if !w.over {
+		if len(w.buf)+len(p) > tokenMaxUsageBody {
+			w.over, w.buf = true, nil
+		} else {
+			w.buf = append(w.buf, p...)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's Flush
+// and deadline methods, which ReverseProxy needs to stream SSE responses.
+func (w *usageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tokens returns what the request cost: the reported usage when there is
+// one, else the estimate for a 2xx response and nothing for a failed one.
+func (w *usageWriter) tokens(estimate int64) int64 {
+	if !w.sse && !w.over {
+		if n, ok := usageTotal(w.buf); ok {
+			return n
+		}
+	} else if w.sse && w.usage >= 0 {
+		return w.usage
+	}
+	if w.status >= 200 && w.status < 300 {
+		return estimate
+	}
+	return 0
+}
+
+// usageTotal extracts usage.total_tokens from a JSON object.
+func usageTotal(b []byte) (int64, bool) {
+	b = bytes.TrimSpace(b)
+	if !bytes.Contains(b, []byte(`"usage"`)) {
+		return 0, false
+	}
+	var v struct {
+		Usage *struct {
+			TotalTokens int64 `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(b, &v) != nil || v.Usage == nil {
+		return 0, false
+	}
+	return v.Usage.TotalTokens, true
+}
@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// frozenLimiter returns a limiter for tenant "a" (key "sk-a") whose clock
+// only moves when the test advances it.
+func frozenLimiter(rates map[string]int64) (*TokenLimiter, *fakeClock) {
+	clock := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	l := NewTokenLimiter(map[string]TenantConfig{"a": {Keys: []string{"sk-a"}, TokensPerMinute: rates}}, WithClock(clock))
+	return l, clock
+}
+
+// available returns the tokens left in a bucket, refilled to the limiter's
+// current time.
+func available(l *TokenLimiter, model string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[tokenBucketKey{"a", model}]
+	b.refill(l.clock.Now())
+	return b.tokens
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	l, now := frozenLimiter(map[string]int64{"m": 600})
+	tenant := l.tenants["sk-a"]
+
+	if _, rej := l.reserve(tenant, "m", 600); rej != nil {
+		t.Fatalf("full bucket refused 600: %+v", rej)
+	}
+	rej := func(n int64) *tokenRejection {
+		_, r := l.reserve(tenant, "m", n)
+		return r
+	}
+	if r := rej(60); r == nil || r.retryAfter != 6*time.Second {
+		t.Fatalf("empty bucket: rejection %+v, want retry after 6s (60 tokens at 10/s)", r)
+	}
+
+	now.advance(30 * time.Second) // refills 300
+	if r := rej(300); r != nil {
+		t.Fatalf("refused 300 after 30s: %+v", r)
+	}
+	if r := rej(1); r == nil {
+		t.Fatal("admitted beyond the refill")
+	}
+
+	now.advance(10 * time.Minute) // capped at one minute's worth
+	if got := available(l, "m"); got != 600 {
+		t.Errorf("available = %v after a long idle, want the 600 cap", got)
+	}
+	if r := rej(601); r == nil || r.retryAfter != 0 {
+		t.Errorf("request over the whole limit: rejection %+v, want one with no retry", r)
+	}
+
+	// Unlisted models are unmetered without a "*" limit.
+	if res, r := l.reserve(tenant, "other", 1e9); res != nil || r != nil {
+		t.Errorf("unlisted model metered: %v %+v", res, r)
+	}
+}
+
+func TestTokenSettleIsExact(t *testing.T) {
+	l, _ := frozenLimiter(map[string]int64{"*": 1000})
+	res, _ := l.reserve(l.tenants["sk-a"], "any", 500)
+	res.settle(100)
+	res.settle(100) // a second settlement must not refund again
+	if got := available(l, "any"); got != 900 {
+		t.Errorf("available = %v, want 900 after 100 actual tokens", got)
+	}
+
+	res, _ = l.reserve(l.tenants["sk-a"], "any", 100)
+	res.settle(1200) // more than estimated: the bucket goes into debt
+	if got := available(l, "any"); got != -300 {
+		t.Errorf("available = %v, want -300", got)
+	}
+	if _, r := l.reserve(l.tenants["sk-a"], "any", 1); r == nil {
+		t.Error("admitted while in debt")
+	}
+}
+
+func TestTokenLimitReconciliation(t *testing.T) {
+	var fail atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "overloaded", http.StatusTooManyRequests)
+			return
+		}
+		if strings.Contains(r.URL.Path, "stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"))
+			w.(http.Flusher).Flush()
+			if strings.Contains(r.URL.Path, "abort") {
+				<-r.Context().Done()
+				return
+			}
+			_, _ = w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":25,\"total_tokens\":30}}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":40,"total_tokens":50}}`))
+	}))
+	defer backend.Close()
+	pool, err := NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := frozenLimiter(map[string]int64{"m": 10000})
+	lb := httptest.NewServer(l.Handler(pool))
+	defer lb.Close()
+
+	const body = `{"model":"m","max_tokens":100}`
+	_, estimate, _ := estimateTokens([]byte(body))
+	post := func(ctx context.Context, path string) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, lb.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-a")
+		return http.DefaultClient.Do(req)
+	}
+	do := func(path string) int {
+		t.Helper()
+		resp, err := post(context.Background(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	do("/v1/chat/completions")
+	if got := available(l, "m"); got != 10000-50 {
+		t.Errorf("after a JSON response: available = %v, want %d (usage 50)", got, 10000-50)
+	}
+	do("/v1/chat/completions/stream")
+	if got := available(l, "m"); got != 10000-80 {
+		t.Errorf("after a stream: available = %v, want %d (usage 30 more)", got, 10000-80)
+	}
+
+	// A failed attempt is refunded, so the client's retry is charged once.
+	fail.Store(true)
+	if code := do("/v1/chat/completions"); code != http.StatusTooManyRequests {
+		t.Fatalf("failing backend: status %d", code)
+	}
+	fail.Store(false)
+	do("/v1/chat/completions")
+	if got := available(l, "m"); got != 10000-130 {
+		t.Errorf("after a failure and its retry: available = %v, want %d", got, 10000-130)
+	}
+
+	// A client abort mid-stream keeps the estimate: tokens were generated
+	// but never reported.
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := post(ctx, "/v1/chat/completions/stream/abort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	_ = resp.Body.Close()
+	lb.Close() // waits for the handler, and its settlement, to finish
+	if got := available(l, "m"); got != float64(10000-130-estimate) {
+		t.Errorf("after an abort: available = %v, want %d (estimate %d kept)", got, 10000-130-estimate, estimate)
+	}
+}
+
+func TestTokenLimitRejection(t *testing.T) {
+	var served atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	pool, err := NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := frozenLimiter(map[string]int64{"mixtral": 100})
+	lb := httptest.NewServer(l.Handler(pool))
+	defer lb.Close()
+
+	post := func(key, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, lb.URL+"/v1/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	resp := post("sk-a", `{"model":"mixtral","max_tokens":500}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", resp.StatusCode)
+	}
+	var e struct {
+		Error struct {
+			Message, Param, Code, Tenant, Model string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Error.Param != "tokens_per_minute" || e.Error.Tenant != "a" || e.Error.Model != "mixtral" || e.Error.Code != "rate_limit_exceeded" {
+		t.Errorf("error = %+v, want the tenant, model and tokens_per_minute named", e.Error)
+	}
+
+	if resp := post("sk-a", `{"model":"mixtral","max_tokens":50}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("within the limit: status %d", resp.StatusCode)
+	}
+	resp = post("sk-a", `{"model":"mixtral","max_tokens":50}`)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("bucket spent: status %d, Retry-After %q; want 429 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if resp := post("sk-other", `{"model":"mixtral","max_tokens":5000}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("unknown key: status %d, want unmetered", resp.StatusCode)
+	}
+	if n := served.Load(); n != 2 {
+		t.Errorf("backend served %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token-aware routing (--routing least-tokens): a connection count treats a
+// 10-token completion like a 4000-token one. Backends report what each
+// request cost in an OpenAI-style usage block, which the proxy reads from
+// JSON responses up to tokenMaxUsageBody (the body is put back for the
+// client) and from the data: lines of SSE streams as they pass. Each backend
+// keeps a tokens-per-second gauge decaying with time constant
+// tokenRateWindow. Selection picks the least loaded backend by that gauge
+// plus its requests in flight, each counted at the pool's average reported
+// tokens per request; until any usage has been reported, and for streams
+// without a usage block, that falls back to counting connections.
+
+// tokenRateWindow is the time constant of the tokens-per-second gauges.
+const tokenRateWindow = 30 * time.Second
+
+// tokenLoad is a pool's token accounting.
+type tokenLoad struct {
+	mu sync.Mutex
+	// avgTokens is an EWMA of the reported tokens per request
+	avgTokens float64
+}
+
+// tokenGauge is one backend's decaying tokens-per-second rate.
+type tokenGauge struct {
+	load *tokenLoad
+
+	mu   sync.Mutex
+	rate float64 // as of last
+	last time.Time
+}
+
+// EnableLeastTokens switches the pool to token-aware routing. Call before
+// serving traffic.
+func (p *Pool) EnableLeastTokens() {
+	p.tokens = &tokenLoad{}
+	for _, b := range p.GetBackends() {
+		b.tokens = &tokenGauge{load: p.tokens}
+	}
+}
+
+// avg returns the pool's average reported tokens per request, 0 before the
+// first report.
+func (l *tokenLoad) avg() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.avgTokens
+}
+
+func (l *tokenLoad) observe(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.avgTokens == 0 {
+		l.avgTokens = float64(n)
+	} else {
+		l.avgTokens += latencyEWMAAlpha * (float64(n) - l.avgTokens)
+	}
+}
+
+// decayedLocked returns the rate at now. Caller must hold g.mu.
+func (g *tokenGauge) decayedLocked(now time.Time) float64 {
+	if g.last.IsZero() {
+		return 0
+	}
+	return g.rate * math.Exp(-now.Sub(g.last).Seconds()/tokenRateWindow.Seconds())
+}
+
+// add records a response that cost n tokens.
+func (g *tokenGauge) add(n int64, now time.Time) {
+	if n <= 0 {
+		return
+	}
+	g.mu.Lock()
+	g.rate = g.decayedLocked(now) + float64(n)/tokenRateWindow.Seconds()
+	g.last = now
+	g.mu.Unlock()
+	g.load.observe(n)
+}
+
+// Rate returns the backend's tokens per second at now.
+func (g *tokenGauge) Rate(now time.Time) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.decayedLocked(now)
+}
+
+// tokenLoadOf returns b's token load with one more request when the pool
+// has seen any usage, given its conns requests in flight.
+func (l *tokenLoad) tokenLoadOf(b *Backend, conns int, now time.Time) (float64, bool) {
+	avg := l.avg()
+	if avg <= 0 {
+		return 0, false
+	}
+	return b.tokens.Rate(now) + float64(conns+1)*avg/tokenRateWindow.Seconds(), true
+}
+
+// watchUsage arranges for resp's reported usage to be added to the
+// backend's gauge: read now from a JSON body under the cap, or as an SSE
+// stream is copied to the client.
+func (b *Backend) watchUsage(resp *http.Response) {
+	if b.tokens == nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return
+	}
+	ct := resp.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(ct, "text/event-stream"):
+		resp.Body = &sseUsageReader{ReadCloser: resp.Body, b: b, usage: -1}
+	case strings.HasPrefix(ct, "application/json") && resp.ContentLength <= tokenMaxUsageBody:
+		orig := resp.Body
+		body, err := io.ReadAll(io.LimitReader(orig, tokenMaxUsageBody+1))
+		// The client gets the same bytes, and the same read error, if any.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), orig), orig}
+		if err != nil || len(body) > tokenMaxUsageBody {
+			return
+		}
+		if n, ok := usageTotal(body); ok {
+			b.tokens.add(n, b.clock.Now())
+		}
+	}
+}
+
+// sseUsageReader watches the data: lines of an SSE stream for the last
+// usage block and records it when the stream ends cleanly.
+type sseUsageReader struct {
+	io.ReadCloser
+	b     *Backend
+	line  []byte // the unfinished line
+	usage int64  // last total_tokens seen (-1 = none)
+	done  bool
+}
+
+func (r *sseUsageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.line = append(r.line, p[:n]...)
+	for {
+		i := bytes.IndexByte(r.line, '\n')
+		if i < 0 {
+			break
+		}
+		if u, ok := usageTotal(bytes.TrimPrefix(bytes.TrimSpace(r.line[:i]), []byte("data:"))); ok {
+			r.usage = u
+		}
+		r.line = r.line[i+1:]
+	}
+	if len(r.line) > tokenMaxUsageBody {
+		r.line = nil // not a line anyone reports usage in
+	}
+	if err == io.EOF && !r.done && r.usage >= 0 {
+		r.done = true
+		r.b.tokens.add(r.usage, r.b.clock.Now())
+	}
+	return n, err
+}
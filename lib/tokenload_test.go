@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usageServer answers every request with a canned completion costing tokens.
+func usageServer(t *testing.T, tokens int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[{"text":"ok"}],"usage":{"prompt_tokens":1,"completion_tokens":%d,"total_tokens":%d}}`, tokens-1, tokens)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLeastTokensRouting(t *testing.T) {
+	heavy, light := usageServer(t, 4000), usageServer(t, 10)
+	pool, err := NewPool([]string{heavy.URL, light.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.EnableLeastTokens()
+	lb := httptest.NewServer(pool)
+	t.Cleanup(lb.Close)
+
+	for range 20 {
+		resp, err := http.Post(lb.URL+"/v1/completions", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if !strings.HasSuffix(string(body), `"total_tokens":4000}}`) && !strings.HasSuffix(string(body), `"total_tokens":10}}`) {
+			t.Fatalf("body not passed through: %q", body)
+		}
+	}
+	s := pool.Stats()
+	// Once each has answered, the light backend takes everything until the
+	// heavy one's 4000 tokens decay (30s), whatever the connection counts.
+	if s.Backends[0].Requests > 2 {
+		t.Errorf("heavy backend got %d of 20 requests", s.Backends[0].Requests)
+	}
+	if s.Backends[0].TokensPerSec == nil || *s.Backends[0].TokensPerSec < 100 {
+		t.Errorf("heavy backend tokens/sec %v", s.Backends[0].TokensPerSec)
+	}
+	if got := pool.strategy(false); got != "least-tokens" {
+		t.Errorf("strategy %q", got)
+	}
+}
+
+func TestWatchUsage(t *testing.T) {
+	clock := newFakeClock(time.Unix(1_700_000_000, 0))
+	pool, err := NewPool([]string{"http://a"}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.EnableLeastTokens()
+	b := pool.GetBackends()[0]
+	watch := func(contentType, body string) {
+		t.Helper()
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {contentType}},
+			Body: io.NopCloser(strings.NewReader(body)), ContentLength: -1}
+		b.watchUsage(resp)
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Errorf("%s body changed: %q", contentType, got)
+		}
+	}
+	rate := func() float64 { return b.tokens.Rate(clock.Now()) }
+
+	watch("application/json; charset=utf-8", `{"usage":{"total_tokens":300}}`)
+	if got := rate(); got != 10 {
+		t.Errorf("after 300 tokens: %v tokens/sec", got)
+	}
+	clock.advance(tokenRateWindow)
+	if got := rate(); got < 3.6 || got > 3.7 {
+		t.Errorf("after one time constant: %v tokens/sec", got)
+	}
+
+	// A stream counts its last usage block, when it ends.
+	clock.advance(time.Hour)
+	watch("text/event-stream", "data: {\"choices\":[]}\n\ndata: {\"usage\":{\"total_tokens\":60}}\n\ndata: [DONE]\n\n")
+	if got := rate(); got != 2 {
+		t.Errorf("after a 60-token stream: %v tokens/sec", got)
+	}
+	// Without usage, or over the cap, nothing is counted.
+	watch("text/event-stream", "data: {\"choices\":[]}\n\ndata: [DONE]\n\n")
+	watch("application/json", `{"usage":{"total_tokens":300},"pad":"`+strings.Repeat("x", tokenMaxUsageBody)+`"}`)
+	watch("text/plain", `{"usage":{"total_tokens":300}}`)
+	if got := rate(); got != 2 {
+		t.Errorf("after uncounted responses: %v tokens/sec", got)
+	}
+	if got := pool.tokens.avg(); got != 300+latencyEWMAAlpha*(60-300) {
+		t.Errorf("average tokens per request %v", got)
+	}
+}
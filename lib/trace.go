@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracing (--otlp-endpoint): each request a pool serves gets a server span,
+// continuing the client's trace when it sends a W3C traceparent header, and
+// each attempt at a backend (the request, or a hedge) a client span under
+// it, whose context is sent on to the backend in a traceparent header.
+// Health check probes are root spans of their own. Finished spans go to a
+// SpanExporter (OTLP/HTTP in otlp.go). Without a tracer no span is created:
+// Span methods are nil-safe, so call sites don't branch on whether tracing
+// is on. A client's unsampled traceparent is propagated but not recorded.
+
+// traceparentHeader carries W3C trace context.
+const traceparentHeader = "traceparent"
+
+// TraceID and SpanID identify a trace and a span in it.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanKind is a span's role, numbered as in OTLP.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// SpanStatus is a span's outcome, numbered as in OTLP.
+type SpanStatus int
+
+const (
+	SpanStatusUnset SpanStatus = 0
+	SpanStatusOK    SpanStatus = 1
+	SpanStatusError SpanStatus = 2
+)
+
+// Attribute is a span attribute: a string, int64, float64 or bool value.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span is one traced operation. Its fields are final once it has ended
+// and been handed to the exporter.
+type Span struct {
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentID      SpanID // zero for a root span
+	Name          string
+	Kind          SpanKind
+	Start, End    time.Time
+	Attributes    []Attribute
+	Status        SpanStatus
+	StatusMessage string
+
+	tracer  *Tracer
+	sampled bool
+}
+
+// SpanExporter receives ended spans. ExportSpan must not block.
+type SpanExporter interface {
+	ExportSpan(*Span)
+}
+
+// Tracer creates spans and hands them to its exporter when they end.
+type Tracer struct {
+	exporter SpanExporter
+	clock    Clock
+}
+
+// NewTracer returns a tracer exporting to exporter.
+func NewTracer(exporter SpanExporter, opts ...Option) *Tracer {
+	return &Tracer{exporter: exporter, clock: clockFrom(systemClock{}, opts)}
+}
+
+// SetTracer traces the pool's requests and health checks (nil = off).
+// Call before serving traffic and before creating the pool's HealthChecker.
+func (p *Pool) SetTracer(t *Tracer) {
+	p.tracer = t
+	for _, b := range p.GetBackends() {
+		b.tracer = t
+	}
+}
+
+type spanKey struct{}
+
+// spanFromContext returns the span ctx carries, nil without one.
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// start begins a span under the one ctx carries, or a root span, and
+// returns it with a context carrying it. A nil tracer returns nil and ctx.
+func (t *Tracer) start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (*Span, context.Context) {
+	if t == nil {
+		return nil, ctx
+	}
+	s := &Span{Name: name, Kind: kind, Start: t.clock.Now(), Attributes: attrs, tracer: t, sampled: true}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.TraceID, s.ParentID, s.sampled = parent.TraceID, parent.SpanID, parent.sampled
+	} else {
+		s.TraceID = newTraceID()
+	}
+	s.SpanID = newSpanID()
+	return s, context.WithValue(ctx, spanKey{}, s)
+}
+
+// startServer begins r's server span, continuing the trace of its
+// traceparent header if it has a valid one, and returns r carrying it.
+func (t *Tracer) startServer(r *http.Request, name string, attrs ...Attribute) (*Span, *http.Request) {
+	if t == nil {
+		return nil, r
+	}
+	ctx := r.Context()
+	if remote, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+		ctx = context.WithValue(ctx, spanKey{}, remote)
+	}
+	s, ctx := t.start(ctx, name, SpanKindServer, attrs...)
+	return s, r.WithContext(ctx)
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.Attributes = append(s.Attributes, attrs...)
+}
+
+// setHTTPStatus records a response status; 5xx marks the span failed.
+func (s *Span) setHTTPStatus(code int) {
+	if s == nil {
+		return
+	}
+	s.SetAttributes(Attribute{"http.response.status_code", int64(code)})
+	if code >= 500 {
+		s.Status = SpanStatusError
+	}
+}
+
+// recordError marks the span failed with err.
+func (s *Span) recordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Status, s.StatusMessage = SpanStatusError, err.Error()
+}
+
+// end finishes the span and exports it if sampled.
+func (s *Span) end() {
+	if s == nil {
+		return
+	}
+	s.End = s.tracer.clock.Now()
+	if s.sampled {
+		s.tracer.exporter.ExportSpan(s)
+	}
+}
+
+// inject sets h's traceparent to the span's context.
+func (s *Span) inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	h.Set(traceparentHeader, "00-"+s.TraceID.String()+"-"+s.SpanID.String()+"-"+flags)
+}
+
+// parseTraceparent parses a version 00 traceparent header into a remote
+// parent span.
+func parseTraceparent(v string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, false
+	}
+	var s Span
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if len(parts[3]) != 2 || err != nil ||
+		hex.DecodedLen(len(parts[1])) != len(s.TraceID) || hex.DecodedLen(len(parts[2])) != len(s.SpanID) {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.TraceID[:], []byte(parts[1])); err != nil || s.TraceID == (TraceID{}) {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.SpanID[:], []byte(parts[2])); err != nil || s.SpanID == (SpanID{}) {
+		return nil, false
+	}
+	s.sampled = flags&1 == 1
+	return &s, true
+}
+
+func newTraceID() (id TraceID) {
+	for id == (TraceID{}) {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64()) // #nosec G404 -- trace IDs, not security-sensitive
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64()) // #nosec G404 -- trace IDs, not security-sensitive
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for id == (SpanID{}) {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64()) // #nosec G404 -- span IDs, not security-sensitive
+	}
+	return id
+}
+
+// statusWriter records the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && !isInterim(code) {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.NewResponseController reach the underlying writer's Flush,
+// Hijack and deadline methods.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
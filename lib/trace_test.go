@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spanRecorder is an in-memory SpanExporter.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *spanRecorder) ExportSpan(s *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) ended() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
+
+func attr(s *Span, key string) any {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// tracedPool returns a traced pool of urls and its recorder.
+func tracedPool(t *testing.T, urls ...string) (*Pool, *spanRecorder) {
+	t.Helper()
+	pool, err := NewPool(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &spanRecorder{}
+	pool.SetTracer(NewTracer(rec))
+	return pool, rec
+}
+
+const (
+	remoteTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	remoteSpan  = "00f067aa0ba902b7"
+)
+
+func TestTraceProxiedRequest(t *testing.T) {
+	var sent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("traceparent")
+	}))
+	t.Cleanup(backend.Close)
+	pool, spans := tracedPool(t, backend.URL)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{}`))
+	req.Header.Set("traceparent", "00-"+remoteTrace+"-"+remoteSpan+"-01")
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	got := spans.ended()
+	if len(got) != 2 {
+		t.Fatalf("%d spans, want client and server", len(got))
+	}
+	client, server := got[0], got[1]
+	if server.Kind != SpanKindServer || server.TraceID.String() != remoteTrace || server.ParentID.String() != remoteSpan {
+		t.Errorf("server span %+v does not continue the client's trace", server)
+	}
+	if client.Kind != SpanKindClient || client.TraceID != server.TraceID || client.ParentID != server.SpanID {
+		t.Errorf("client span %+v is not the server span's child", client)
+	}
+	if want := "00-" + remoteTrace + "-" + client.SpanID.String() + "-01"; sent != want {
+		t.Errorf("backend got traceparent %q, want %q", sent, want)
+	}
+	for key, want := range map[string]any{
+		"lb.backend":                backend.URL,
+		"lb.strategy":               "least-conn",
+		"lb.attempt":                int64(1),
+		"http.response.status_code": int64(200),
+	} {
+		if got := attr(client, key); got != want {
+			t.Errorf("client span %s = %v, want %v", key, got, want)
+		}
+	}
+	if attr(server, "http.response.status_code") != int64(200) || server.Status != SpanStatusUnset || client.Status != SpanStatusUnset {
+		t.Errorf("statuses: server %v %v, client %v", attr(server, "http.response.status_code"), server.Status, client.Status)
+	}
+}
+
+func TestTraceBackendError(t *testing.T) {
+	captureLog(t)
+	pool, spans := tracedPool(t, "http://127.0.0.1:1")
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d", w.Code)
+	}
+	got := spans.ended()
+	if len(got) != 2 {
+		t.Fatalf("%d spans", len(got))
+	}
+	client, server := got[0], got[1]
+	if server.ParentID != (SpanID{}) || client.ParentID != server.SpanID {
+		t.Errorf("hierarchy: server parent %v, client parent %v (server %v)", server.ParentID, client.ParentID, server.SpanID)
+	}
+	if client.Status != SpanStatusError || !strings.Contains(client.StatusMessage, "connection refused") ||
+		attr(client, "http.response.status_code") != int64(502) {
+		t.Errorf("client span: status %v %q, code %v", client.Status, client.StatusMessage, attr(client, "http.response.status_code"))
+	}
+	if server.Status != SpanStatusError || attr(server, "http.response.status_code") != int64(502) {
+		t.Errorf("server span: status %v, code %v", server.Status, attr(server, "http.response.status_code"))
+	}
+}
+
+func TestTraceUnsampledAndOff(t *testing.T) {
+	var sent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("traceparent")
+	}))
+	t.Cleanup(backend.Close)
+	incoming := "00-" + remoteTrace + "-" + remoteSpan + "-00"
+	serve := func(pool *Pool) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		req.Header.Set("traceparent", incoming)
+		pool.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Not sampled by the client: propagated, not recorded.
+	pool, spans := tracedPool(t, backend.URL)
+	serve(pool)
+	if n := len(spans.ended()); n != 0 {
+		t.Errorf("%d unsampled spans exported", n)
+	}
+	if !strings.HasPrefix(sent, "00-"+remoteTrace+"-") || !strings.HasSuffix(sent, "-00") || sent == incoming {
+		t.Errorf("backend got traceparent %q", sent)
+	}
+
+	// Without a tracer the header passes through untouched.
+	plain, err := NewPool([]string{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(plain)
+	if sent != incoming {
+		t.Errorf("untraced pool sent traceparent %q, want %q", sent, incoming)
+	}
+}
+
+func TestTraceHealthCheck(t *testing.T) {
+	captureLog(t)
+	up := echoServer(t)
+	pool, spans := tracedPool(t, up.URL, "http://127.0.0.1:1")
+	NewHealthChecker(pool, WithInterval(time.Minute)).checkAll(context.Background())
+	got := map[string]*Span{}
+	for _, s := range spans.ended() {
+		got[attr(s, "lb.backend").(string)] = s
+	}
+	ok, down := got[up.URL], got["http://127.0.0.1:1"]
+	if ok == nil || down == nil {
+		t.Fatalf("health spans %v", got)
+	}
+	if ok.Name != "health check" || ok.ParentID != (SpanID{}) || ok.Status != SpanStatusUnset ||
+		attr(ok, "url.full") != up.URL+"/v1/models" || attr(ok, "http.response.status_code") != int64(200) {
+		t.Errorf("passing probe span %+v", ok)
+	}
+	if down.Status != SpanStatusError || down.StatusMessage == "" {
+		t.Errorf("failing probe span %+v", down)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	s, ok := parseTraceparent("00-" + remoteTrace + "-" + remoteSpan + "-01")
+	if !ok || s.TraceID.String() != remoteTrace || s.SpanID.String() != remoteSpan || !s.sampled {
+		t.Errorf("valid traceparent: %+v, %v", s, ok)
+	}
+	if _, ok := parseTraceparent("01-" + remoteTrace + "-" + remoteSpan + "-01-future"); !ok {
+		t.Error("later version with extra fields rejected")
+	}
+	for _, v := range []string{
+		"",
+		"00-" + remoteTrace + "-" + remoteSpan,
+		"00-" + remoteTrace + "-" + remoteSpan + "-01-extra",
+		"ff-" + remoteTrace + "-" + remoteSpan + "-01",
+		"00-00000000000000000000000000000000-" + remoteSpan + "-01",
+		"00-" + remoteTrace + "-0000000000000000-01",
+		"00-" + remoteTrace[1:] + "-" + remoteSpan + "-01",
+		"00-" + remoteTrace + "-" + remoteSpan + "-zz",
+	} {
+		if _, ok := parseTraceparent(v); ok {
+			t.Errorf("parseTraceparent(%q) accepted", v)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	type otlpAttr struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	var body struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttr `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string     `json:"traceId"`
+					SpanID       string     `json:"spanId"`
+					ParentSpanID string     `json:"parentSpanId"`
+					Kind         int        `json:"kind"`
+					Attributes   []otlpAttr `json:"attributes"`
+					Status       struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("posted to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(collector.Close)
+	exp, err := NewOTLPExporter(collector.URL, "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(exp)
+	server, ctx := tracer.start(context.Background(), "GET", SpanKindServer)
+	client, _ := tracer.start(ctx, "GET", SpanKindClient, Attribute{"lb.attempt", int64(2)})
+	client.setHTTPStatus(503)
+	client.end()
+	server.end()
+	exp.Flush()
+
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("posted %+v", body)
+	}
+	if a := body.ResourceSpans[0].Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value["stringValue"] != "lb" {
+		t.Errorf("resource %+v", a)
+	}
+	got := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(got) != 2 {
+		t.Fatalf("%d spans posted", len(got))
+	}
+	c, s := got[0], got[1]
+	if c.TraceID != server.TraceID.String() || c.ParentSpanID != s.SpanID || s.ParentSpanID != "" || c.Kind != 3 || s.Kind != 2 {
+		t.Errorf("spans %+v", got)
+	}
+	if c.Status.Code != 2 || len(c.Attributes) != 2 || c.Attributes[0].Value["intValue"] != "2" {
+		t.Errorf("client span %+v", c)
+	}
+
+	if _, err := NewOTLPExporter("collector:4318", "lb"); err == nil {
+		t.Error("endpoint without a scheme accepted")
+	}
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+// Health transitions: every backend remembers when its health last changed
+// and why ("probe timeout", "status: 503", "proxy error: connection
+// refused"), set with the health flag under the backend lock so readers
+// never see one transition's time with another's reason. Verbose status
+// lines, /stats (healthy_for or unhealthy_for, reason) and /health (the
+// unhealthy backends) show them, and the pool keeps the last ones (see
+// report.go). A backend starts healthy as of its
+// creation, with no reason.
+
+// maxReasonLen bounds a transition reason, in bytes.
+const maxReasonLen = 96
+
+// boundReason cuts reason to maxReasonLen, on a rune boundary.
+func boundReason(reason string) string {
+	if len(reason) <= maxReasonLen {
+		return reason
+	}
+	cut := maxReasonLen - len("...")
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut] + "..."
+}
+
+// rootCause is the innermost error of err's chain: "connection refused"
+// rather than the request, address and syscall wrapped around it.
+func rootCause(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err.Error()
+		}
+		err = next
+	}
+}
+
+// isTimeout reports whether err is a deadline or network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// probeFailure is the reason a health probe failing with err gives.
+func probeFailure(err error) string {
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		if isTimeout(err) {
+			return "probe timeout (proxy " + pe.proxy + ")"
+		}
+		return "probe error: proxy " + pe.proxy + ": " + rootCause(pe.err)
+	}
+	if isTimeout(err) {
+		return "probe timeout"
+	}
+	return "probe error: " + rootCause(err)
+}
+
+// setTransitionLocked records a health transition, also in the pool's
+// history (see report.go). Caller must hold b.mu.
+func (b *Backend) setTransitionLocked(now time.Time, reason string) {
+	b.changedAt, b.changeReason = now, boundReason(reason)
+	b.history.record(Transition{Time: now, Backend: b.id, Healthy: b.healthy, Reason: b.changeReason})
+}
+
+// HealthTransition returns whether the backend is healthy, since when, and
+// the reason of the transition to that state ("" for a backend healthy
+// since it was created), read together.
+func (b *Backend) HealthTransition() (healthy bool, since time.Time, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy, b.changedAt, b.changeReason
+}
+
+// age formats a time in state to the second, e.g. "3m12s".
+func age(d time.Duration) string {
+	return max(0, d).Round(time.Second).String()
+}
+
+// UnhealthyBackend is an unhealthy backend in /health.
+type UnhealthyBackend struct {
+	URL          string `json:"url"`
+	UnhealthyFor string `json:"unhealthy_for"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// Unhealthy returns the pool's unhealthy backends with how long they have
+// been down and why.
+func (p *Pool) Unhealthy() []UnhealthyBackend {
+	now := p.clock.Now()
+	var down []UnhealthyBackend
+	for _, b := range p.GetBackends() {
+		if healthy, since, reason := b.HealthTransition(); !healthy {
+			down = append(down, UnhealthyBackend{URL: b.ID(), UnhealthyFor: age(now.Sub(since)), Reason: reason})
+		}
+	}
+	return down
+}
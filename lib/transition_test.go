@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+func TestHealthTransitionTimeAndReason(t *testing.T) {
+	captureLog(t)
+	mock := mockbackend.Start(t, mockbackend.DefaultConfig())
+	clock := newFakeClock(time.Now())
+	pool, err := NewPool([]string{mock.URL}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	hc.SetTimeout(200 * time.Millisecond)
+	b := pool.GetBackends()[0]
+	stats := func() BackendStats {
+		t.Helper()
+		return pool.Stats().Backends[0]
+	}
+	heal := func() {
+		t.Helper()
+		mock.SetMode(mockbackend.ModeHealthy)
+		for range healthyThreshold {
+			hc.checkBackend(context.Background(), b)
+		}
+		if !b.IsHealthy() {
+			t.Fatal("backend did not recover")
+		}
+	}
+
+	clock.advance(time.Minute)
+	if s := stats(); s.HealthyFor != "1m0s" || s.Reason != "" {
+		t.Errorf("new backend: healthy for %q, reason %q", s.HealthyFor, s.Reason)
+	}
+
+	mock.SetMode(mockbackend.ModeFailing)
+	hc.checkBackend(context.Background(), b)
+	clock.advance(3*time.Minute + 12*time.Second)
+	if s := stats(); s.UnhealthyFor != "3m12s" || s.Reason != "status: 503" {
+		t.Errorf("failing: unhealthy for %q, reason %q", s.UnhealthyFor, s.Reason)
+	}
+	hc.checkBackend(context.Background(), b) // still down: same transition
+	clock.advance(time.Minute)
+	if s := stats(); s.UnhealthyFor != "4m12s" || s.Reason != "status: 503" {
+		t.Errorf("still failing: unhealthy for %q, reason %q", s.UnhealthyFor, s.Reason)
+	}
+	down := pool.Unhealthy()
+	if len(down) != 1 || down[0].URL != b.ID() || down[0].UnhealthyFor != "4m12s" || down[0].Reason != "status: 503" {
+		t.Errorf("Unhealthy() = %+v", down)
+	}
+
+	heal()
+	if s := stats(); s.HealthyFor != "0s" || s.Reason != "health checks passing" || pool.Unhealthy() != nil {
+		t.Errorf("recovered: healthy for %q, reason %q", s.HealthyFor, s.Reason)
+	}
+
+	mock.SetMode(mockbackend.ModeTimeout)
+	hc.checkBackend(context.Background(), b)
+	if _, _, reason := b.HealthTransition(); reason != "probe timeout" {
+		t.Errorf("timing out: reason %q, want probe timeout", reason)
+	}
+
+	heal()
+	mock.Close()
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if healthy, _, reason := b.HealthTransition(); healthy || reason != "proxy error: connection refused" {
+		t.Errorf("refused: healthy %v, reason %q", healthy, reason)
+	}
+}
+
+func TestBoundReason(t *testing.T) {
+	if got := boundReason("status: 503"); got != "status: 503" {
+		t.Errorf("short reason changed to %q", got)
+	}
+	long := "proxy error: " + strings.Repeat("é", 100)
+	got := boundReason(long)
+	if len(got) > maxReasonLen || !utf8.ValidString(got) || !strings.HasSuffix(got, "...") {
+		t.Errorf("boundReason = %q (%d bytes)", got, len(got))
+	}
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// backendIdleConnTimeout must stay below the backends' server-side keep-alive
+// timeout (vLLM's OpenAI server hardcodes uvicorn's TIMEOUT_KEEP_ALIVE at 5s).
+// Reusing a connection the server is concurrently closing surfaces as spurious
+// EOF/reset proxy errors — ejecting healthy backends — or, on unlucky
+// interleavings, a protocol-level 400 from uvicorn's HTTP parser.
+const backendIdleConnTimeout = 3 * time.Second
+
+// TransportConfig tunes the transport shared by all backend proxies and the
+// health checker. A zero duration disables the corresponding timeout.
+type TransportConfig struct {
+	// ConnectTimeout bounds dialing a backend, independently of how long the
+	// request itself may run.
+	ConnectTimeout time.Duration
+	// KeepAlive is the TCP keep-alive probe period of backend connections.
+	KeepAlive time.Duration
+	// IdleConnTimeout discards pooled idle connections; see
+	// backendIdleConnTimeout for why it must stay below the backends' own.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost is how many idle connections are kept per backend.
+	// net/http's default of 2 forces a fresh dial for nearly every request
+	// once concurrency exceeds it.
+	MaxIdleConnsPerHost int
+	// ResponseHeaderTimeout bounds the wait for response headers. Off by
+	// default: a long prefill before the first streamed token is normal.
+	ResponseHeaderTimeout time.Duration
+	// Proxy is the forward proxy backends are reached through (see
+	// fwdproxy.go); nil honors HTTP_PROXY and friends.
+	Proxy *url.URL
+	// ConnMaxLifetime and ConnMaxIdle retire a backend connection this
+	// long after it was dialed, or after bytes last moved on it (see
+	// connrotate.go). Zero for no limit.
+	ConnMaxLifetime time.Duration
+	ConnMaxIdle     time.Duration
+}
+
+// DefaultTransportConfig returns the defaults cmd/lb exposes as flag values.
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		ConnectTimeout:      10 * time.Second,
+		KeepAlive:           30 * time.Second,
+		IdleConnTimeout:     backendIdleConnTimeout,
+		MaxIdleConnsPerHost: 256,
+	}
+}
+
+// NewTransport builds a backend transport from cfg. It also dials unix
+// socket backends (see unixsock.go), keeps backends pinned to an address
+// family on it (see addrfamily.go), reaches backends through cfg.Proxy
+// (see fwdproxy.go) and tracks its connections for rotation (see
+// connrotate.go).
+func NewTransport(cfg TransportConfig) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	applyProxy(t, dialFamilies(net.DefaultResolver, dialer.DialContext), cfg.Proxy, true, newConnRotation(cfg.ConnMaxLifetime, cfg.ConnMaxIdle))
+	t.IdleConnTimeout = cfg.IdleConnTimeout
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.MaxIdleConns = 0 // bounded per host instead
+	t.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+	// The clone keeps the default 1s ExpectContinueTimeout: a request with
+	// Expect: 100-continue waits that long for the backend's 100 Continue
+	// or final answer before its body is sent (see replay.go).
+	return t
+}
+
+// defaultTransport is used by pools that never call SetTransport.
+var defaultTransport = NewTransport(DefaultTransportConfig())
+
+// defaultUploadTransport is defaultTransport's counterpart for streaming
+// uploads (see upload.go).
+var defaultUploadTransport = newUploadTransport(defaultTransport)
+
+// SetTransport replaces the transport used to proxy to and probe the pool's
+// backends. Call before serving traffic and before creating the pool's
+// HealthChecker. Streaming uploads use a clone with larger buffers.
+func (p *Pool) SetTransport(t *http.Transport) {
+	p.transport = t
+	p.uploadTransport = newUploadTransport(t)
+	for _, b := range p.GetBackends() {
+		p.attachTransport(b)
+	}
+}
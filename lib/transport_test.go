@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetTransportSharedByProxiesAndHealthChecker(t *testing.T) {
+	pool, err := NewPool([]string{"http://backend-0", "http://backend-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTransport(TransportConfig{ConnectTimeout: time.Second, IdleConnTimeout: 2 * time.Second, MaxIdleConnsPerHost: 7})
+	pool.SetTransport(tr)
+	for _, b := range pool.GetBackends() {
+		ut := b.proxy.Transport.(*redirectTransport).base.(*decoratingTransport).base.(*connRetryTransport).base.(*uploadTransport)
+		if ut.base != tr {
+			t.Errorf("%s: proxy does not use the configured transport", b.URL)
+		}
+		if up := ut.upload.(*http.Transport); up.MaxIdleConnsPerHost != 7 || up.WriteBufferSize != uploadBufferSize {
+			t.Errorf("%s: upload transport is not a tuned clone: %+v", b.URL, up)
+		}
+	}
+	if hc := NewHealthChecker(pool, WithInterval(5*time.Second)); hc.client.Transport != tr {
+		t.Error("health checker does not use the pool's transport")
+	}
+	if tr.MaxIdleConnsPerHost != 7 || tr.IdleConnTimeout != 2*time.Second || tr.ResponseHeaderTimeout != 0 {
+		t.Errorf("transport fields not applied: %+v", tr)
+	}
+}
+
+// benchmarkTransport drives b.N requests through a pool using tr from 50
+// concurrent clients against a mock backend.
+func benchmarkTransport(b *testing.B, tr *http.Transport) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"choices":[{"text":"ok"}]}`))
+	}))
+	defer backend.Close()
+	defer tr.CloseIdleConnections()
+
+	pool, err := NewPool([]string{backend.URL})
+	if err != nil {
+		b.Fatal(err)
+	}
+	pool.SetTransport(tr)
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+
+	// The client side is tuned in both runs so only the backend hop differs.
+	client := &http.Client{Transport: NewTransport(DefaultTransportConfig())}
+	const clients = 50
+	work := make(chan struct{})
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Go(func() {
+			for range work {
+				resp, err := client.Get(lb.URL + "/v1/completions")
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+		})
+	}
+	b.ResetTimer()
+	for range b.N {
+		work <- struct{}{}
+	}
+	close(work)
+	wg.Wait()
+}
+
+func BenchmarkBackendTransport(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkTransport(b, http.DefaultTransport.(*http.Transport).Clone())
+	})
+	b.Run("tuned", func(b *testing.B) {
+		benchmarkTransport(b, NewTransport(DefaultTransportConfig()))
+	})
+}
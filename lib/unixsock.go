@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Unix socket backends (unix:///var/run/vllm-0.sock): for backends on the
+// same machine, requests skip the TCP stack. Such a backend's requests are
+// addressed to a placeholder http URL whose host encodes the socket path,
+// and the dialer of every transport NewTransport builds recovers the path
+// from it, so proxied requests, streaming uploads, health checks and
+// prewarming all reach the socket without a transport per backend. The
+// placeholder is under the reserved .invalid TLD, so it can never resolve
+// to a real host.
+
+// unixSocketSuffix ends every placeholder host.
+const unixSocketSuffix = ".sock.invalid"
+
+// unixSocketHost returns the placeholder host for the socket at path.
+func unixSocketHost(path string) string {
+	return hex.EncodeToString([]byte(path)) + unixSocketSuffix
+}
+
+// unixSocketPath returns the socket path a dial address's placeholder host
+// encodes, if it is one.
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	encoded, ok := strings.CutSuffix(host, unixSocketSuffix)
+	if !ok {
+		return "", false
+	}
+	path, err := hex.DecodeString(encoded)
+	if err != nil || len(path) == 0 {
+		return "", false
+	}
+	return string(path), true
+}
+
+// dialUnixSockets wraps dial to connect placeholder hosts to their sockets.
+func dialUnixSockets(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if path, ok := unixSocketPath(addr); ok {
+			return dial(ctx, "unix", path)
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// bypassProxyForUnixSockets wraps proxy (e.g. http.ProxyFromEnvironment)
+// to connect placeholder hosts directly.
+func bypassProxyForUnixSockets(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		if _, ok := unixSocketPath(r.URL.Host); ok || proxy == nil {
+			return nil, nil
+		}
+		return proxy(r)
+	}
+}
+
+// shownHealthURL is HealthURL as stats and logs show it: a unix socket
+// backend's probe as its ID and path rather than the placeholder host, and
+// a tcp or grpc probe's target (see prober.go).
+func (p *Pool) shownHealthURL(b *Backend) string {
+	if kind := p.healthCheckOf(b); kind != HealthCheckHTTP {
+		return p.shownProbe(kind, b)
+	}
+	u := p.HealthURL(b)
+	if b.socket != "" && b.healthURL == "" {
+		return b.id + ":" + strings.TrimPrefix(u, b.URL.String())
+	}
+	return u
+}
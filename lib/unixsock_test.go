@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unixServer serves h on a unix socket and returns its path.
+func unixServer(t *testing.T, h http.Handler) string {
+	t.Helper()
+	// Socket paths are limited to ~100 bytes; t.TempDir's can be longer.
+	dir, err := os.MkdirTemp("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "backend.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return path
+}
+
+func TestUnixSocketBackend(t *testing.T) {
+	captureLog(t)
+	var health int
+	path := unixServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/models" {
+			health++
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	pool, err := NewPool([]string{"unix://" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := pool.GetBackends()[0]
+	if b.ID() != "unix://"+path {
+		t.Errorf("ID %q", b.ID())
+	}
+
+	hc := NewHealthChecker(pool, WithInterval(time.Minute))
+	hc.checkAll(context.Background())
+	if health != 1 || pool.Stats().Backends[0].State != "healthy" {
+		t.Errorf("%d probes, state %q", health, pool.Stats().Backends[0].State)
+	}
+	if got := pool.Stats().Backends[0].HealthURL; got != "unix://"+path+":/v1/models" {
+		t.Errorf("health URL shown as %q", got)
+	}
+
+	// Both the ordinary and the streaming upload transport dial the socket.
+	rec := httptest.NewRecorder()
+	pool.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader("hi")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "POST /v1/completions hi" {
+		t.Errorf("proxied: %d %q", rec.Code, rec.Body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/audio", strings.NewReader("upload"))
+	rec = httptest.NewRecorder()
+	pool.ServeHTTP(rec, req.WithContext(withStreamingUpload(req.Context(), 0)))
+	if rec.Code != http.StatusOK || rec.Body.String() != "POST /v1/audio upload" {
+		t.Errorf("streamed upload: %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestUnixSocketBypassesProxy(t *testing.T) {
+	viaProxy := bypassProxyForUnixSockets(func(*http.Request) (*url.URL, error) {
+		return url.Parse("http://proxy:3128")
+	})
+	for target, proxied := range map[string]bool{
+		"http://" + unixSocketHost("/run/vllm.sock") + "/v1/models": false,
+		"http://gpu-1:8000/v1/models":                               true,
+	} {
+		u, err := viaProxy(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil || (u != nil) != proxied {
+			t.Errorf("%s: proxy %v, %v", target, u, err)
+		}
+	}
+	if path, ok := unixSocketPath(unixSocketHost("/run/vllm.sock") + ":80"); !ok || path != "/run/vllm.sock" {
+		t.Errorf("unixSocketPath = %q, %v", path, ok)
+	}
+	if _, ok := unixSocketPath("gpu-1.sock.invalid:80"); ok {
+		t.Error("non-hex placeholder accepted")
+	}
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+)
+
+// Streaming uploads (per route, "streaming_upload" in the config file) are
+// for large request bodies — file and batch uploads, audio — that must never
+// be held in memory. lb passes such a body to the backend as it arrives:
+// cache-aware pools pick the least-loaded backend instead of reading the
+// prompt for affinity, the body is not mirrored or metered by the token
+// limiter, and it is never replayed, so a request that fails once its body
+// started is not retried. The only check on the body is a byte count as it
+// streams through: the route's max_upload_bytes, or else --max-request-body.
+// Uploads use a clone of the pool's transport with larger buffers. net/http
+// puts no deadline on writing a request, so only the route's timeout bounds
+// a slow upload.
+
+// uploadBufferSize is the upload transport's write and read buffer size;
+// net/http's 4KiB default costs a syscall per 4KiB of a gigabyte body.
+const uploadBufferSize = 256 << 10
+
+type streamingUploadKey struct{}
+
+// withStreamingUpload marks requests carrying ctx as streaming uploads
+// capped at limit bytes (0 = the pool's --max-request-body).
+func withStreamingUpload(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, streamingUploadKey{}, limit)
+}
+
+// streamingUpload reports whether r is a streaming upload, and its cap.
+func streamingUpload(r *http.Request) (limit int64, ok bool) {
+	limit, ok = r.Context().Value(streamingUploadKey{}).(int64)
+	return limit, ok
+}
+
+// StreamingUploads marks requests for streaming-upload routes before next
+// sees them, so handlers wrapping the router (the token limiter) leave their
+// bodies alone too. The router marks them itself otherwise.
+func (rt *Router) StreamingUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.mu.RLock()
+		rte := rt.match(r.URL.Path)
+		rt.mu.RUnlock()
+		if rte != nil && rte.streamingUpload {
+			r = r.WithContext(withStreamingUpload(r.Context(), rte.maxUploadBytes))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newUploadTransport clones t for streaming uploads.
+func newUploadTransport(t *http.Transport) *http.Transport {
+	u := t.Clone()
+	u.WriteBufferSize = uploadBufferSize
+	u.ReadBufferSize = uploadBufferSize
+	if d, ok := transportDialers.Load(t); ok && d.(*proxyDialer).rot != nil {
+		d.(*proxyDialer).rot.addTransport(u)
+	}
+	return u
+}
+
+// uploadTransport sends streaming uploads through upload and every other
+// request through base.
+type uploadTransport struct {
+	base, upload http.RoundTripper
+}
+
+func (t *uploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := streamingUpload(req); ok {
+		return t.upload.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// zeros is an endless body of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// uploadRouter serves /v1/files as a streaming-upload route and everything
+// else as a normal route, both on one cache-aware pool, behind a token
+// limiter whose tenant is key "k" — the way cmd/lb stacks them.
+func uploadRouter(t *testing.T, backend string, maxUpload int64) http.Handler {
+	t.Helper()
+	pool, err := NewPool([]string{backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.EnableCacheAware(time.Minute, 0)
+	pool.SetProxyPolicy(ProxyPolicy{MaxRequestBody: 1 << 20})
+	rt, err := NewRouter([]RouteConfig{
+		{ID: "files", Prefix: "/v1/files", Targets: []RouteTarget{{Pool: "p", Weight: 1}}, StreamingUpload: true, MaxUploadBytes: maxUpload},
+		{ID: "rest", Prefix: "/", Targets: []RouteTarget{{Pool: "p", Weight: 1}}},
+	}, map[string]*Pool{"p": pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewTokenLimiter(map[string]TenantConfig{"t": {Keys: []string{"k"}, TokensPerMinute: map[string]int64{"*": 1000}}})
+	return rt.StreamingUploads(limiter.Handler(rt))
+}
+
+func TestStreamingUploadMemoryStaysFlat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 1GiB")
+	}
+	var received atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer backend.Close()
+	const size = 1 << 30
+	lb := httptest.NewServer(uploadRouter(t, backend.URL, size))
+	defer lb.Close()
+
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	baseline := ms.HeapInuse
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				if ms.HeapInuse > peak.Load() {
+					peak.Store(ms.HeapInuse)
+				}
+			}
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, lb.URL+"/v1/files", io.LimitReader(zeros{}, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer k")
+	resp, err := http.DefaultClient.Do(req)
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || received.Load() != size {
+		t.Fatalf("upload: %d, backend received %d of %d bytes", resp.StatusCode, received.Load(), size)
+	}
+	if growth := int64(peak.Load()) - int64(baseline); growth > 64<<20 {
+		t.Errorf("heap grew by %d MiB streaming a 1GiB upload", growth>>20)
+	}
+}
+
+func TestStreamingUploadCap(t *testing.T) {
+	backend := echoServer(t)
+	lb := httptest.NewServer(uploadRouter(t, backend.URL, 4<<20))
+	defer lb.Close()
+	post := func(path string, n int64) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, lb.URL+path, io.LimitReader(zeros{}, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = -1 // chunked: the cap applies while streaming
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	// The route's cap replaces --max-request-body (1MiB) and the affinity
+	// buffer's bound.
+	if code := post("/v1/files", 3<<20); code != http.StatusOK {
+		t.Errorf("3MiB upload: %d, want 200", code)
+	}
+	if code := post("/v1/files", 5<<20); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("5MiB upload: %d, want 413", code)
+	}
+	if code := post("/v1/completions", 3<<20); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("3MiB completion: %d, want 413", code)
+	}
+
+	// Other routes keep their body handling: the limiter still meters them.
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model":"m","max_tokens":5000}`))
+	req.Header.Set("Authorization", "Bearer k")
+	rec := httptest.NewRecorder()
+	lb.Config.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("over-budget completion: %d, want 429", rec.Code)
+	}
+}
+
+func TestStreamingUploadConfig(t *testing.T) {
+	for name, rc := range map[string]RouteConfig{
+		"negative cap":       {StreamingUpload: true, MaxUploadBytes: -1},
+		"cap without upload": {MaxUploadBytes: 1 << 30},
+	} {
+		rc.ID, rc.Prefix, rc.Targets = "r", "/", []RouteTarget{{Pool: "p", Weight: 1}}
+		cfg := &Config{Pools: map[string]PoolConfig{"p": {Backends: []string{"http://a"}}}, Routes: []RouteConfig{rc}}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Request validation (--validate-requests): a POST to /v1/completions or
+// /v1/chat/completions is checked before it reaches the pool, so a
+// malformed request is answered 400 in the OpenAI error format instead of
+// taking a backend slot and coming back as a backend 400 counted against
+// it. The body must be a JSON object with a string model and, for
+// completions, a prompt, for chat completions, messages; with
+// --allowed-models the model must be one of them. The body is read whole
+// and put back, so a valid request is proxied byte for byte. One declared
+// or read over the size cap skips validation and is proxied as is: the
+// cap bounds the memory validation takes, not what the backends accept.
+
+// DefaultValidateMaxBody is the largest body validated by default.
+const DefaultValidateMaxBody = 1 << 20 // 1 MiB
+
+// RequestValidator rejects malformed completion requests.
+type RequestValidator struct {
+	maxBody int64
+	// models is the model allowlist, nil for any model
+	models map[string]bool
+	// counters for /stats (see ValidationStats)
+	invalidJSON, missingField, disallowedModel, oversized atomic.Uint64
+	// errorFormat is how rejections are written (see apierror.go)
+	errorFormat ErrorFormat
+}
+
+// NewRequestValidator returns a validator for bodies up to maxBody bytes
+// (0 = DefaultValidateMaxBody) allowing models (none = any model).
+func NewRequestValidator(maxBody int64, models []string) *RequestValidator {
+	if maxBody <= 0 {
+		maxBody = DefaultValidateMaxBody
+	}
+	v := &RequestValidator{maxBody: maxBody}
+	if len(models) > 0 {
+		v.models = make(map[string]bool, len(models))
+		for _, m := range models {
+			v.models[m] = true
+		}
+	}
+	return v
+}
+
+// SetErrorFormat sets how the validator writes its 400s (default openai).
+// Call before serving traffic.
+func (v *RequestValidator) SetErrorFormat(f ErrorFormat) {
+	v.errorFormat = f
+}
+
+// ValidationStats reports request validation in /stats: the requests
+// rejected, by reason, and those too large to validate.
+type ValidationStats struct {
+	InvalidJSON     uint64 `json:"rejected_invalid_json"`
+	MissingField    uint64 `json:"rejected_missing_field"`
+	DisallowedModel uint64 `json:"rejected_model"`
+	Oversized       uint64 `json:"skipped_oversized"`
+}
+
+// Stats returns the validation counters.
+func (v *RequestValidator) Stats() *ValidationStats {
+	return &ValidationStats{
+		InvalidJSON:     v.invalidJSON.Load(),
+		MissingField:    v.missingField.Load(),
+		DisallowedModel: v.disallowedModel.Load(),
+		Oversized:       v.oversized.Load(),
+	}
+}
+
+// validatedFields are the fields a validated path requires besides model.
+var validatedFields = map[string]string{
+	"/v1/completions":      "prompt",
+	"/v1/chat/completions": "messages",
+}
+
+// Handler wraps next with validation.
+func (v *RequestValidator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		field, ok := validatedFields[r.URL.Path]
+		if !ok || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > v.maxBody {
+			v.oversized.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		var raw []byte
+		if r.Body != nil {
+			var err error
+			raw, err = io.ReadAll(io.LimitReader(r.Body, v.maxBody+1))
+			if err != nil {
+				writeBodyError(w, r, v.errorFormat, err)
+				return
+			}
+		}
+		if int64(len(raw)) > v.maxBody {
+			// A chunked body over the cap: send what was read, then the rest.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(raw), r.Body), r.Body}
+			v.oversized.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(raw))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(raw)), nil
+			}
+			r.ContentLength = int64(len(raw))
+		}
+		if rej := v.check(raw, field); rej != nil {
+			rej.write(w, r, v.errorFormat)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check returns the rejection of body, which must carry model and field,
+// or nil if it is valid, and counts it.
+func (v *RequestValidator) check(body []byte, field string) *apiError {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil || req == nil {
+		v.invalidJSON.Add(1)
+		return &apiError{http.StatusBadRequest, errTypeInvalidRequest, "invalid_json",
+			"We could not parse the JSON body of your request: it must be a JSON object.", nil}
+	}
+	var model string
+	if raw, ok := req["model"]; !ok || json.Unmarshal(raw, &model) != nil || model == "" {
+		v.missingField.Add(1)
+		return missingParam("model")
+	}
+	if raw, ok := req[field]; !ok || bytes.Equal(raw, []byte("null")) {
+		v.missingField.Add(1)
+		return missingParam(field)
+	}
+	if v.models != nil && !v.models[model] {
+		v.disallowedModel.Add(1)
+		return &apiError{http.StatusBadRequest, errTypeInvalidRequest, "model_not_found",
+			fmt.Sprintf("The model %q is not served here.", model), map[string]any{"param": "model"}}
+	}
+	return nil
+}
+
+// missingParam rejects a request without the required field.
+func missingParam(field string) *apiError {
+	return &apiError{http.StatusBadRequest, errTypeInvalidRequest, "missing_required_parameter",
+		fmt.Sprintf("Missing required parameter: %q.", field), map[string]any{"param": field}}
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestValidator(t *testing.T) {
+	var received atomic.Value // string: the last body the backend saw
+	var count atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(string(body))
+		count.Add(1)
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer backend.Close()
+	pool, err := NewPool([]string{backend.URL}, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	v := NewRequestValidator(256, []string{"llama-3", "qwen-2"})
+	lb := httptest.NewServer(v.Handler(pool))
+	defer lb.Close()
+
+	big := `{"model":"nope","prompt":"` + strings.Repeat("a", 300) + `"}`
+	for _, c := range []struct {
+		name, method, path, body string
+		chunked                  bool
+		status                   int
+		code, param              string
+	}{
+		{"valid chat", "POST", "/v1/chat/completions", `{"model":"llama-3","messages":[{"role":"user","content":"hi"}]}`, false, 200, "", ""},
+		{"valid completion", "POST", "/v1/completions", `{"model":"qwen-2", "prompt": "hi", "max_tokens": 5}`, false, 200, "", ""},
+		{"invalid json", "POST", "/v1/chat/completions", `{"model":"llama-3","messages":[`, false, 400, "invalid_json", ""},
+		{"not an object", "POST", "/v1/completions", `["llama-3"]`, false, 400, "invalid_json", ""},
+		{"empty body", "POST", "/v1/completions", ``, false, 400, "invalid_json", ""},
+		{"missing model", "POST", "/v1/chat/completions", `{"messages":[]}`, false, 400, "missing_required_parameter", "model"},
+		{"model not a string", "POST", "/v1/chat/completions", `{"model":7,"messages":[]}`, false, 400, "missing_required_parameter", "model"},
+		{"missing messages", "POST", "/v1/chat/completions", `{"model":"llama-3","prompt":"hi"}`, false, 400, "missing_required_parameter", "messages"},
+		{"null prompt", "POST", "/v1/completions", `{"model":"llama-3","prompt":null}`, false, 400, "missing_required_parameter", "prompt"},
+		{"disallowed model", "POST", "/v1/completions", `{"model":"gpt-4","prompt":"hi"}`, false, 400, "model_not_found", "model"},
+		// Over the cap, declared or read: proxied unvalidated.
+		{"oversized", "POST", "/v1/completions", big, false, 200, "", ""},
+		{"oversized chunked", "POST", "/v1/completions", big, true, 200, "", ""},
+		// Other methods and paths are not validated.
+		{"other path", "POST", "/v1/embeddings", `not json`, false, 200, "", ""},
+		{"GET", "GET", "/v1/chat/completions", ``, false, 200, "", ""},
+	} {
+		before := count.Load()
+		var body io.Reader = strings.NewReader(c.body)
+		if c.chunked {
+			body = io.MultiReader(body) // hides the length
+		}
+		req, _ := http.NewRequest(c.method, lb.URL+c.path, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d: %s", c.name, resp.StatusCode, c.status, raw)
+			continue
+		}
+		if c.status == 200 {
+			if count.Load() != before+1 {
+				t.Errorf("%s: not proxied", c.name)
+			} else if got := received.Load().(string); got != c.body {
+				t.Errorf("%s: backend got %q, want %q", c.name, got, c.body)
+			}
+			continue
+		}
+		if count.Load() != before {
+			t.Errorf("%s: rejected request reached the backend", c.name)
+		}
+		var e struct {
+			Error struct {
+				Type, Code, Param string
+			}
+		}
+		if err := json.Unmarshal(raw, &e); err != nil || e.Error.Type != "invalid_request_error" || e.Error.Code != c.code || e.Error.Param != c.param {
+			t.Errorf("%s: error body %s, want code %s param %q", c.name, raw, c.code, c.param)
+		}
+	}
+	if s := *v.Stats(); s != (ValidationStats{InvalidJSON: 3, MissingField: 4, DisallowedModel: 1, Oversized: 2}) {
+		t.Errorf("stats %+v", s)
+	}
+	// A backend 400 is what validation spares the pool.
+	if st := pool.Stats(); st.Backends[0].Responses["4xx"] != 0 {
+		t.Errorf("backend answered %d 4xx", st.Backends[0].Responses["4xx"])
+	}
+}
+
+func TestRequestValidatorAnyModel(t *testing.T) {
+	v := NewRequestValidator(0, nil)
+	if v.maxBody != DefaultValidateMaxBody {
+		t.Errorf("max body %d", v.maxBody)
+	}
+	if rej := v.check([]byte(`{"model":"anything","messages":[]}`), "messages"); rej != nil {
+		t.Errorf("rejected without an allowlist: %+v", rej)
+	}
+}
@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Weight tuning (--weight-tuning): a backend's static weight (1, or its SRV
+// weight share, see discovery.go) says nothing of how fast it actually
+// serves, and drifts as hardware and model configurations change. A
+// WeightTuner recomputes a multiplier on each backend's weight every
+// interval from the window since the last: its capacity per connection
+// slot, concurrency over latency, is estimated as its success rate over its
+// median request duration, and the multiplier's target is that capacity
+// over the pool's median capacity, within [MinMultiplier, MaxMultiplier].
+// The multiplier moves at most weightTuneMaxStep (10%) toward the target
+// per interval, so one noisy window cannot swing traffic and two backends
+// cannot chase each other. A backend with fewer than MinRequests requests
+// in a window drifts back toward its static weight. Selection divides a
+// backend's load by its weight, so a backend with half the multiplier gets
+// about half the requests of its peers at equal load, and a multiplier
+// under 1 scales its connection cap like slow start does. A [WEIGHT] line
+// is logged whenever a multiplier has moved by LogThreshold since last
+// logged, and GET /admin/weights shows static and effective weights.
+
+// weightTuneMaxStep bounds a multiplier's relative change per interval.
+const weightTuneMaxStep = 0.1
+
+// WeightTuningConfig tunes adaptive backend weights.
+type WeightTuningConfig struct {
+	// Interval between adjustments; each judges the window since the last.
+	Interval time.Duration
+	// MinMultiplier and MaxMultiplier bound the effective weight as
+	// multiples of the static weight.
+	MinMultiplier, MaxMultiplier float64
+	// MinRequests is the number of requests a backend needs in a window to
+	// be judged.
+	MinRequests uint64
+	// LogThreshold is the relative move of a multiplier, since it was last
+	// logged, that logs it.
+	LogThreshold float64
+}
+
+// DefaultWeightTuningConfig returns the defaults cmd/lb exposes as flag
+// values.
+func DefaultWeightTuningConfig() WeightTuningConfig {
+	return WeightTuningConfig{
+		Interval:      10 * time.Second,
+		MinMultiplier: 0.25,
+		MaxMultiplier: 2,
+		MinRequests:   20,
+		LogThreshold:  0.2,
+	}
+}
+
+// tunedWeight is a backend's weight multiplier and the window it was
+// computed from. Never modified once published.
+type tunedWeight struct {
+	multiplier  float64
+	requests    uint64
+	successRate float64
+	median      time.Duration
+	adjusted    time.Time
+}
+
+// weightMultiplier returns the backend's tuned weight multiplier, 1 unless
+// a WeightTuner set one.
+func (b *Backend) weightMultiplier() float64 {
+	if t := b.tuned.Load(); t != nil {
+		return t.multiplier
+	}
+	return 1
+}
+
+// WeightTuner adjusts the pool's backend weights to their observed
+// performance.
+type WeightTuner struct {
+	pool   *Pool
+	cfg    WeightTuningConfig
+	clock  Clock
+	logger Logger
+	// windows are each backend's counters at the last adjustment
+	windows map[*Backend]*weightWindow
+}
+
+// weightWindow is a backend's cumulative counters at the start of the
+// current window, and its multiplier when last logged.
+type weightWindow struct {
+	latency     [latencyBuckets]uint64
+	ok, failed  uint64
+	loggedAt    float64
+	initialized bool
+}
+
+// NewWeightTuner creates a weight tuner for pool, on the pool's clock and
+// logger unless opts give others.
+func NewWeightTuner(pool *Pool, cfg WeightTuningConfig, opts ...Option) *WeightTuner {
+	return &WeightTuner{pool: pool, cfg: cfg, clock: clockFrom(pool.clock, opts), logger: loggerFrom(pool.logger, opts), windows: make(map[*Backend]*weightWindow)}
+}
+
+// Start runs adjustments until ctx is done or the pool is closed.
+func (wt *WeightTuner) Start(ctx context.Context) {
+	ctx, cancel := wt.pool.bind(ctx)
+	defer cancel()
+	wt.adjust() // open the first window
+	ticker := wt.clock.NewTicker(wt.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			wt.adjust()
+		}
+	}
+}
+
+type weightSample struct {
+	b        *Backend
+	w        *weightWindow
+	requests uint64
+	rate     float64
+	median   time.Duration
+	judged   bool
+	capacity float64
+}
+
+// adjust closes the current window of every backend, moves each multiplier
+// a step toward its target, and opens the next window.
+func (wt *WeightTuner) adjust() {
+	now := wt.clock.Now()
+	backends := wt.pool.GetBackends()
+	samples := make([]weightSample, 0, len(backends))
+	var capacities []float64
+	seen := make(map[*Backend]bool, len(backends))
+	for _, b := range backends {
+		seen[b] = true
+		w := wt.windows[b]
+		if w == nil {
+			w = &weightWindow{loggedAt: b.weightMultiplier()}
+			wt.windows[b] = w
+		}
+		counts := b.latency.counts()
+		ok, failed := b.outcomeOK.Load(), b.outcomeFailed.Load()
+		s := weightSample{b: b, w: w}
+		if w.initialized {
+			var window [latencyBuckets]uint64
+			for i := range counts {
+				window[i] = counts[i] - w.latency[i]
+				s.requests += window[i]
+			}
+			if n := (ok - w.ok) + (failed - w.failed); n > 0 {
+				s.rate = float64(ok-w.ok) / float64(n)
+			}
+			// Bucket bounds, uncapped by the all-time maximum, so backends
+			// serving alike are estimated alike.
+			s.median = bucketQuantiles(&window, math.MaxInt64, []float64{0.5})[0]
+			if s.requests >= wt.cfg.MinRequests && s.median > 0 && b.IsHealthy() {
+				s.judged, s.capacity = true, s.rate/s.median.Seconds()
+				capacities = append(capacities, s.capacity)
+			}
+		}
+		w.latency, w.ok, w.failed, w.initialized = counts, ok, failed, true
+		samples = append(samples, s)
+	}
+	for b := range wt.windows {
+		if !seen[b] {
+			delete(wt.windows, b)
+		}
+	}
+
+	med := median(capacities)
+	for _, s := range samples {
+		target := 1.0
+		if s.judged && med > 0 {
+			target = s.capacity / med
+		}
+		target = min(max(target, wt.cfg.MinMultiplier), wt.cfg.MaxMultiplier)
+		cur := s.b.weightMultiplier()
+		next := min(max(target, cur*(1-weightTuneMaxStep)), cur*(1+weightTuneMaxStep))
+		next = min(max(next, wt.cfg.MinMultiplier), wt.cfg.MaxMultiplier)
+		s.b.tuned.Store(&tunedWeight{multiplier: next, requests: s.requests, successRate: s.rate, median: s.median, adjusted: now})
+		if math.Abs(next-s.w.loggedAt) >= wt.cfg.LogThreshold*s.w.loggedAt {
+			wt.logger.Printf("[WEIGHT] %s weight x%.2f (was x%.2f): %d requests, %.1f%% ok, median %v",
+				s.b.ID(), next, s.w.loggedAt, s.requests, 100*s.rate, s.median.Round(time.Millisecond))
+			s.w.loggedAt = next
+		}
+	}
+}
+
+// BackendWeight is one backend's weight at GET /admin/weights: its static
+// weight, its tuned multiplier and the effective weight they make, and the
+// window the multiplier was last computed from.
+type BackendWeight struct {
+	Backend     string    `json:"backend"`
+	Static      float64   `json:"static"`
+	Multiplier  float64   `json:"multiplier"`
+	Effective   float64   `json:"effective"`
+	Requests    uint64    `json:"window_requests"`
+	SuccessRate float64   `json:"window_success_rate"`
+	MedianMs    float64   `json:"window_median_ms"`
+	Adjusted    time.Time `json:"adjusted,omitzero"`
+}
+
+// Weights returns the weights of the pool's backends.
+func (p *Pool) Weights() []BackendWeight {
+	backends := p.GetBackends()
+	out := make([]BackendWeight, 0, len(backends))
+	for _, b := range backends {
+		b.mu.Lock()
+		static := b.shareLocked()
+		b.mu.Unlock()
+		bw := BackendWeight{Backend: b.ID(), Static: static, Multiplier: 1, Effective: static}
+		if t := b.tuned.Load(); t != nil {
+			bw.Multiplier = t.multiplier
+			bw.Effective = static * t.multiplier
+			bw.Requests = t.requests
+			bw.SuccessRate = t.successRate
+			bw.MedianMs = durationMs(t.median)
+			bw.Adjusted = t.adjusted
+		}
+		out = append(out, bw)
+	}
+	return out
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-load-balance/lib/mockbackend"
+)
+
+// serveWindow records n successful requests of duration d at b, as the
+// proxy would.
+func serveWindow(b *Backend, n int, d time.Duration) {
+	for range n {
+		b.latency.observe(d)
+		b.outcomeOK.Add(1)
+	}
+}
+
+func TestWeightTunerDecaysAndRecovers(t *testing.T) {
+	pool, err := NewPool([]string{"http://a", "http://b", "http://c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &lineLogger{}
+	wt := NewWeightTuner(pool, DefaultWeightTuningConfig(), WithLogger(logger))
+	backends := pool.GetBackends()
+	slow := backends[2]
+	window := func(slowLatency time.Duration) float64 {
+		for _, b := range backends[:2] {
+			serveWindow(b, 50, 50*time.Millisecond)
+		}
+		serveWindow(slow, 50, slowLatency)
+		wt.adjust()
+		return slow.weightMultiplier()
+	}
+	wt.adjust() // opens the first window
+	if m := window(50 * time.Millisecond); m != 1 {
+		t.Fatalf("multiplier %v with equal backends", m)
+	}
+
+	// At four times the latency, the slow backend's target is a quarter of
+	// the weight; it gets there 10% per adjustment.
+	prev := 1.0
+	for i := range 20 {
+		m := window(200 * time.Millisecond)
+		if m > prev || m < prev*0.9-1e-9 {
+			t.Fatalf("adjustment %d: multiplier %v after %v", i, m, prev)
+		}
+		prev = m
+	}
+	if prev != 0.25 {
+		t.Errorf("multiplier %v after 20 slow windows, want the 0.25 floor", prev)
+	}
+	for _, b := range backends[:2] {
+		if m := b.weightMultiplier(); m != 1 {
+			t.Errorf("%s multiplier %v, want 1", b.ID(), m)
+		}
+	}
+	w := pool.Weights()[2]
+	if w.Static != 1 || w.Multiplier != 0.25 || w.Effective != 0.25 || w.Requests != 50 || w.SuccessRate != 1 || w.MedianMs < 150 || w.MedianMs > 250 {
+		t.Errorf("weights %+v", w)
+	}
+
+	// Fast again, it recovers 10% per adjustment.
+	for i := range 20 {
+		m := window(50 * time.Millisecond)
+		if m < prev || m > prev*1.1+1e-9 {
+			t.Fatalf("recovery %d: multiplier %v after %v", i, m, prev)
+		}
+		prev = m
+	}
+	if prev != 1 {
+		t.Errorf("multiplier %v after recovering", prev)
+	}
+	if logs := logger.String(); strings.Count(logs, "[WEIGHT] http://c") < 4 || strings.Contains(logs, "http://a") {
+		t.Errorf("log:\n%s", logs)
+	}
+}
+
+func TestWeightTunerFailuresAndIdle(t *testing.T) {
+	pool, err := NewPool([]string{"http://a", "http://b", "http://c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultWeightTuningConfig()
+	wt := NewWeightTuner(pool, cfg, WithLogger(&lineLogger{}))
+	backends := pool.GetBackends()
+	failing := backends[2]
+	wt.adjust()
+	for range 3 {
+		serveWindow(backends[0], 30, 50*time.Millisecond)
+		serveWindow(backends[1], 30, 50*time.Millisecond)
+		for range 30 { // fast failures are no capacity
+			failing.latency.observe(time.Millisecond)
+			failing.outcomeFailed.Add(1)
+		}
+		wt.adjust()
+	}
+	if m := failing.weightMultiplier(); m > 0.73 {
+		t.Errorf("failing backend's multiplier %v after 3 windows", m)
+	}
+	// Without enough requests to judge, it drifts back toward its static
+	// weight.
+	before := failing.weightMultiplier()
+	serveWindow(failing, int(cfg.MinRequests)-1, time.Millisecond)
+	wt.adjust()
+	if m := failing.weightMultiplier(); m <= before {
+		t.Errorf("idle backend's multiplier %v, was %v", m, before)
+	}
+}
+
+func TestWeightTunerShiftsTraffic(t *testing.T) {
+	var mocks []*mockbackend.Server
+	var urls []string
+	for range 3 {
+		m := mockbackend.Start(t, mockbackend.Config{Delay: 5 * time.Millisecond})
+		mocks = append(mocks, m)
+		urls = append(urls, m.URL)
+	}
+	pool, err := NewPool(urls, WithLogger(&lineLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := httptest.NewServer(pool)
+	defer lb.Close()
+	cfg := DefaultWeightTuningConfig()
+	cfg.MinRequests = 5
+	wt := NewWeightTuner(pool, cfg)
+	slow := pool.GetBackends()[2]
+
+	// load sends requests from 9 clients for d, then closes the window.
+	load := func(d time.Duration) {
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		defer cancel()
+		var wg sync.WaitGroup
+		for range 9 {
+			wg.Go(func() {
+				for ctx.Err() == nil {
+					req, _ := http.NewRequestWithContext(ctx, http.MethodPost, lb.URL+"/v1/completions", strings.NewReader(`{"prompt":"hi"}`))
+					if resp, err := http.DefaultClient.Do(req); err == nil {
+						resp.Body.Close()
+					}
+				}
+			})
+		}
+		wg.Wait()
+		wt.adjust()
+	}
+	wt.adjust()
+	mocks[2].Handler.SetDelay(60 * time.Millisecond)
+	for range 4 {
+		load(250 * time.Millisecond)
+	}
+	decayed := slow.weightMultiplier()
+	if decayed > 0.75 {
+		t.Fatalf("slow backend's multiplier %v after 4 windows", decayed)
+	}
+	mocks[2].Handler.SetDelay(5 * time.Millisecond)
+	for range 3 {
+		load(250 * time.Millisecond)
+	}
+	if m := slow.weightMultiplier(); m <= decayed {
+		t.Errorf("multiplier %v after recovering, was %v", m, decayed)
+	}
+}
@@ -451,6 +451,46 @@ class TestBackendsWithoutScheme:
         assert r.status_code == 200
 
 
+class TestChatStreaming:
+    """SSE chat completions stream through the LB chunk by chunk."""
+
+    @classmethod
+    def setup_class(cls):
+        start_scenario([
+            {"port": 8000, "mode": "healthy", "stream-chunks": "5", "stream-delay": "100ms"},
+        ])
+
+    def test_stream_arrives_incrementally(self):
+        start = time.time()
+        arrivals = []
+        with requests.post(
+            f"{LB_URL}/v1/chat/completions",
+            json={"messages": [{"role": "user", "content": "hi"}], "stream": True},
+            stream=True,
+            timeout=15,
+        ) as r:
+            assert r.status_code == 200
+            assert r.headers["Content-Type"] == "text/event-stream"
+            lines = []
+            for line in r.iter_lines():
+                if line:
+                    arrivals.append(time.time() - start)
+                    lines.append(line.decode())
+        assert lines[-1] == "data: [DONE]"
+        # role chunk + 5 content chunks + finish chunk + [DONE]
+        assert len(lines) == 8, lines
+        assert '"backend_port":8000' in lines[0]
+        # Unbuffered: the first chunk arrives well before the last.
+        assert arrivals[-1] - arrivals[0] >= 0.4, arrivals
+
+    def test_non_streaming_chat(self):
+        r = chat([{"role": "user", "content": "hi"}])
+        assert r.status_code == 200
+        body = r.json()
+        assert body["object"] == "chat.completion"
+        assert body["choices"][0]["message"]["role"] == "assistant"
+
+
 # --- Cache-aware routing (--routing cache-aware) ---
 
 